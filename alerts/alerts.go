@@ -0,0 +1,148 @@
+package alerts
+
+import (
+	"SCloud/anomaly"
+	"SCloud/config"
+	"SCloud/events"
+	"SCloud/mail"
+	"SCloud/webhook"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Levels remembers, per subject, the highest threshold its usage has
+// reached, so each threshold alerts once on the way up and re-arms when
+// usage falls back below it.
+type Levels struct {
+	Thresholds []int // percent, ascending
+
+	mu    sync.Mutex
+	level map[string]int
+}
+
+func NewLevels(thresholds []int) *Levels {
+	return &Levels{Thresholds: thresholds, level: map[string]int{}}
+}
+
+// Update records subject at percent and returns its level (the highest
+// threshold reached, 0 for none) and whether that level is new and higher.
+func (l *Levels) Update(subject string, percent int) (int, bool) {
+	level := 0
+	for _, t := range l.Thresholds {
+		if percent >= t {
+			level = t
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.level[subject]
+	l.level[subject] = level
+	return level, level > prev
+}
+
+// Get returns subject's last recorded level.
+func (l *Levels) Get(subject string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level[subject]
+}
+
+// Alerts turns usage readings into alerts: an event on the bus, mail to the
+// users concerned and the admins, and a POST to ALERT_WEBHOOK.
+type Alerts struct {
+	Quota   *Levels
+	Disk    *Levels
+	Mail    *mail.Mailer
+	Webhook string
+	Log     *log.Logger
+}
+
+func New(cfg *config.Config, mailer *mail.Mailer, logger *log.Logger) *Alerts {
+	return &Alerts{
+		Quota:   NewLevels(cfg.QuotaAlerts),
+		Disk:    NewLevels(cfg.DiskAlerts),
+		Mail:    mailer,
+		Webhook: cfg.AlertWebhook,
+		Log:     logger,
+	}
+}
+
+// Percent is used/total rounded down, 0 when total is.
+func Percent(used, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+	return int(used * 100 / total)
+}
+
+// CheckQuota records an org's usage and alerts when it crosses a threshold.
+// notify are the addresses of the org's owners and admins.
+func (a *Alerts) CheckQuota(org, name string, notify []string, used, quota int64) int {
+	level, raised := a.Quota.Update(org, Percent(used, quota))
+	if raised {
+		a.raise(events.Event{Type: events.QuotaAlert, Path: org, Size: used, Level: level})
+		err := a.Mail.SendTemplate(notify, "quota_warning", map[string]any{
+			"Org": name, "Level": level, "Used": used, "Quota": quota,
+		})
+		if err != nil {
+			a.Log.Printf("quota alert: %v", err)
+		}
+		a.Mail.Alert(fmt.Sprintf("org %s at %d%% of its quota", name, level),
+			fmt.Sprintf("Org %s (%s) uses %d of %d bytes.", name, org, used, quota))
+	}
+	return level
+}
+
+// CheckDisk records how full the disk holding dir is and alerts the admins
+// when it crosses a threshold.
+func (a *Alerts) CheckDisk(dir string, total, free uint64) int {
+	used := int64(total - free)
+	level, raised := a.Disk.Update(dir, Percent(used, int64(total)))
+	if raised {
+		a.raise(events.Event{Type: events.DiskAlert, Path: dir, Size: used, Level: level})
+		a.Mail.Alert(fmt.Sprintf("disk %d%% full", level),
+			fmt.Sprintf("The disk holding %s has %d of %d bytes free.", dir, free, total))
+	}
+	return level
+}
+
+// Anomaly alerts the admins to a detection and what was done about it:
+// action is "" when nothing was.
+func (a *Alerts) Anomaly(f anomaly.Finding, action string) {
+	subject := f.IP
+	if f.UserID != "" {
+		subject = f.UserID
+	}
+	a.raise(events.Event{Type: f.Kind, Path: subject, Size: f.Bytes, Level: f.Count, Detail: f.Detail})
+	detail := f.Detail + "."
+	switch action {
+	case config.AnomalyReauth:
+		detail += " The account's sessions must confirm the password before they are used again."
+	case config.AnomalyLock:
+		detail += " The account was locked; an admin can unlock it."
+	}
+	a.Mail.Alert(fmt.Sprintf("%s: %s", f.Kind, subject), detail)
+}
+
+// Honeytoken alerts the admins to a read of the honeytoken at path in the
+// tree stored at tree; detail describes the request.
+func (a *Alerts) Honeytoken(tree, path, detail string) {
+	a.raise(events.Event{Type: events.HoneytokenRead, Path: path, Detail: detail})
+	a.Mail.Alert("honeytoken read: "+path, fmt.Sprintf("The honeytoken %s in %s was read.\n\n%s", path, tree, detail))
+}
+
+func (a *Alerts) raise(e events.Event) {
+	e = events.Publish(e)
+	switch {
+	case e.Type == events.QuotaAlert || e.Type == events.DiskAlert:
+		a.Log.Printf("alert: %s %s at %d%%", e.Type, e.Path, e.Level)
+	case e.Level > 0:
+		a.Log.Printf("alert: %s %s (%d)", e.Type, e.Path, e.Level)
+	default:
+		a.Log.Printf("alert: %s %s", e.Type, e.Path)
+	}
+	if a.Webhook != "" {
+		webhook.Post(a.Webhook, e, a.Log)
+	}
+}
@@ -0,0 +1,183 @@
+package anomaly
+
+import (
+	"SCloud/config"
+	"SCloud/events"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Finding is one detection. UserID is "" for failures no account is known
+// for; Count and Bytes are what tripped it.
+type Finding struct {
+	Kind   events.Type
+	UserID string
+	IP     string
+	Count  int
+	Bytes  int64
+	Detail string
+}
+
+// window counts what happened to one subject since start. It restarts when
+// it fires or runs out, so a sustained pattern fires once per window.
+type window struct {
+	start time.Time
+	count int
+	bytes int64
+}
+
+type signIn struct {
+	at time.Time
+	ip string
+}
+
+// Detector watches auth failures, downloads and sign-ins for the patterns
+// the ANOMALY_* settings describe. It only keeps counters in memory.
+type Detector struct {
+	cfg *config.Config
+
+	mu        sync.Mutex
+	failures  map[string]*window // by client address and by "user:"+ID
+	downloads map[string]*window // by user ID
+	signIns   map[string]signIn  // last sign-in, by user ID
+	pruned    time.Time
+}
+
+func New(cfg *config.Config) *Detector {
+	return &Detector{
+		cfg:       cfg,
+		failures:  map[string]*window{},
+		downloads: map[string]*window{},
+		signIns:   map[string]signIn{},
+	}
+}
+
+// Failure counts a 401 from ip and, when known, against userID.
+func (d *Detector) Failure(ip, userID string, now time.Time) []Finding {
+	n, span := d.cfg.AnomalyAuthFailures, d.cfg.AnomalyAuthWindow
+	if n <= 0 || span <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(now)
+	var out []Finding
+	if w := count(d.failures, ip, span, now, 0); w.count >= n {
+		delete(d.failures, ip)
+		out = append(out, Finding{Kind: events.AnomalyAuthFailures, IP: ip, Count: w.count,
+			Detail: fmt.Sprintf("%d failed requests from %s within %s", w.count, ip, span)})
+	}
+	if userID == "" {
+		return out
+	}
+	key := "user:" + userID
+	if w := count(d.failures, key, span, now, 0); w.count >= n {
+		delete(d.failures, key)
+		out = append(out, Finding{Kind: events.AnomalyAuthFailures, UserID: userID, IP: ip, Count: w.count,
+			Detail: fmt.Sprintf("%d failed requests against the account within %s, the last from %s", w.count, span, ip)})
+	}
+	return out
+}
+
+// Download counts a download of n bytes by userID.
+func (d *Detector) Download(userID, ip string, n int64, now time.Time) *Finding {
+	files, size, span := d.cfg.AnomalyDownloads, d.cfg.AnomalyDownloadBytes, d.cfg.AnomalyDownloadWindow
+	if userID == "" || files <= 0 && size <= 0 || span <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(now)
+	w := count(d.downloads, userID, span, now, n)
+	if (files <= 0 || w.count < files) && (size <= 0 || w.bytes < size) {
+		return nil
+	}
+	delete(d.downloads, userID)
+	return &Finding{Kind: events.AnomalyDownloads, UserID: userID, IP: ip, Count: w.count, Bytes: w.bytes,
+		Detail: fmt.Sprintf("%d files, %d bytes downloaded within %s, the last from %s", w.count, w.bytes, span, ip)}
+}
+
+// SignIn records a sign-in by userID from ip. Without a location database
+// impossible travel is approximated: two sign-ins from different public
+// networks within ANOMALY_TRAVEL_WINDOW.
+func (d *Detector) SignIn(userID, ip string, now time.Time) *Finding {
+	span := d.cfg.AnomalyTravelWindow
+	if span <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(now)
+	last, ok := d.signIns[userID]
+	d.signIns[userID] = signIn{at: now, ip: ip}
+	if !ok || now.Sub(last.at) > span || !public(last.ip) || !public(ip) ||
+		SameNetwork(last.ip, ip, d.cfg.AnomalyTravelIPv4Prefix, d.cfg.AnomalyTravelIPv6Prefix) {
+		return nil
+	}
+	return &Finding{Kind: events.AnomalyTravel, UserID: userID, IP: ip, Count: 2,
+		Detail: fmt.Sprintf("signed in from %s %s after signing in from %s", ip, now.Sub(last.at).Round(time.Second), last.ip)}
+}
+
+// count adds one event of n bytes to key's window, starting a new window
+// when there is none or it has run out; the caller holds mu.
+func count(m map[string]*window, key string, span time.Duration, now time.Time, n int64) *window {
+	w := m[key]
+	if w == nil || now.Sub(w.start) > span {
+		w = &window{start: now}
+		m[key] = w
+	}
+	w.count++
+	w.bytes += n
+	return w
+}
+
+// prune drops windows and sign-ins that can no longer fire, at most once a
+// minute; the caller holds mu.
+func (d *Detector) prune(now time.Time) {
+	if now.Sub(d.pruned) < time.Minute {
+		return
+	}
+	d.pruned = now
+	for k, w := range d.failures {
+		if now.Sub(w.start) > d.cfg.AnomalyAuthWindow {
+			delete(d.failures, k)
+		}
+	}
+	for k, w := range d.downloads {
+		if now.Sub(w.start) > d.cfg.AnomalyDownloadWindow {
+			delete(d.downloads, k)
+		}
+	}
+	for k, s := range d.signIns {
+		if now.Sub(s.at) > d.cfg.AnomalyTravelWindow {
+			delete(d.signIns, k)
+		}
+	}
+}
+
+// public reports whether ip is a routable address; loopback and private
+// networks say nothing about where a user is.
+func public(ip string) bool {
+	a := net.ParseIP(ip)
+	return a != nil && !a.IsLoopback() && !a.IsPrivate() && !a.IsLinkLocalUnicast() && !a.IsUnspecified()
+}
+
+// SameNetwork reports whether a and b are in the same /v4 or /v6 network.
+// Addresses that do not parse are only the same when they are equal.
+func SameNetwork(a, b string, v4, v6 int) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	if a4, b4 := ipA.To4(), ipB.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(v4, 32)
+		return a4.Mask(mask).Equal(b4.Mask(mask))
+	}
+	mask := net.CIDRMask(v6, 128)
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
@@ -0,0 +1,135 @@
+// Package audit makes the audit log tamper-evident. Chain numbers every
+// event and MACs it together with the MAC of the event before, so an
+// edited, removed or inserted row breaks the chain from there on; Verify
+// finds the break. Anchors and the Exporter get the head of the chain off
+// the host, so that even with the key the log cannot be cut short or
+// rewritten without disagreeing with what was sent away.
+package audit
+
+import (
+	"SCloud/config"
+	"SCloud/store"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ActionAnchor is the action of the events Anchor appends.
+const ActionAnchor = "audit.anchor"
+
+// Key is the MAC key of the chain: AUDIT_KEY, or one derived from the
+// master key.
+func Key(cfg *config.Config) []byte {
+	if len(cfg.AuditKey) > 0 {
+		return cfg.AuditKey
+	}
+	m := hmac.New(sha256.New, cfg.MasterKey)
+	m.Write([]byte("SCloud audit chain"))
+	return m.Sum(nil)
+}
+
+// Sum is the MAC of a, chained to prev, the MAC of the event before it
+// ("" for the first).
+func Sum(key []byte, prev string, a *store.AuditEvent) string {
+	m := hmac.New(sha256.New, key)
+	for _, f := range []string{prev, strconv.FormatInt(a.Seq, 10), strconv.FormatInt(a.Time.UnixMilli(), 10),
+		a.ID, a.ActorID, a.Action, a.Tree, a.Path, a.Detail} {
+		writeField(m, f)
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// writeField writes f length-prefixed, so no two field lists run together
+// into the same bytes.
+func writeField(h hash.Hash, f string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(f)))
+	h.Write(n[:])
+	h.Write([]byte(f))
+}
+
+// Chain is an AuditStore that chains every event it adds. Other instances
+// on the same database chain through it too: a taken Seq is retried.
+type Chain struct {
+	store.AuditStore
+	key []byte
+
+	mu     sync.Mutex
+	loaded bool
+	seq    int64
+	mac    string
+}
+
+func NewChain(inner store.AuditStore, key []byte) *Chain {
+	return &Chain{AuditStore: inner, key: key}
+}
+
+// retries of a Seq another instance took first
+const maxAddTries = 5
+
+func (c *Chain) Add(ctx context.Context, a *store.AuditEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for try := 1; ; try++ {
+		if err := c.load(ctx); err != nil {
+			return err
+		}
+		a.Seq = c.seq + 1
+		a.MAC = Sum(c.key, c.mac, a)
+		err := c.AuditStore.Add(ctx, a)
+		if errors.Is(err, store.ErrExists) && try < maxAddTries {
+			c.loaded = false
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.seq, c.mac = a.Seq, a.MAC
+		return nil
+	}
+}
+
+// load reads the head of the chain if it is not known; the caller holds mu.
+func (c *Chain) load(ctx context.Context) error {
+	if c.loaded {
+		return nil
+	}
+	last, err := c.AuditStore.Last(ctx)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.seq, c.mac = 0, ""
+	case err != nil:
+		return fmt.Errorf("audit chain head: %w", err)
+	default:
+		c.seq, c.mac = last.Seq, last.MAC
+	}
+	c.loaded = true
+	return nil
+}
+
+// Anchor appends an event recording the head of the chain, for the export
+// and the server log to carry off the host; pass the "seq:mac" in its
+// Detail to `sc verify-audit --anchor`. With nothing new since the last
+// anchor it appends nothing and returns nil.
+func (c *Chain) Anchor(ctx context.Context) (*store.AuditEvent, error) {
+	last, err := c.AuditStore.Last(ctx)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last.Action == ActionAnchor {
+		return nil, nil
+	}
+	a := &store.AuditEvent{ID: newID(), Time: time.Now(), Action: ActionAnchor, Detail: fmt.Sprintf("%d:%s", last.Seq, last.MAC)}
+	return a, c.Add(ctx, a)
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"SCloud/config"
+	"SCloud/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const exportBatch = 500
+
+// Sink receives the chained audit events in order. An event may arrive
+// twice after a failed delivery; its Seq tells the copies apart.
+type Sink interface {
+	Name() string // stable, and free of credentials: it keys the cursor
+	Send(ctx context.Context, events []store.AuditEvent) error
+}
+
+// Sinks builds the sinks the AUDIT_* settings name.
+func Sinks(cfg *config.Config) []Sink {
+	var sinks []Sink
+	if cfg.AuditSyslog != "" {
+		sinks = append(sinks, newSyslogSink(cfg.AuditSyslog))
+	}
+	if cfg.AuditS3 != nil {
+		sinks = append(sinks, &s3Sink{cfg: cfg.AuditS3})
+	}
+	if cfg.AuditHECURL != "" {
+		sinks = append(sinks, &hecSink{url: cfg.AuditHECURL, token: cfg.AuditHECToken})
+	}
+	return sinks
+}
+
+// Exporter ships the chain to its sinks. How far each sink has got is kept
+// next to the store, so a restart resumes rather than starting over; a
+// sink that is down holds back only itself.
+type Exporter struct {
+	Store store.AuditStore
+	Sinks []Sink
+	Log   *log.Logger
+
+	path    string
+	cursors map[string]int64 // by sink name
+}
+
+func NewExporter(cfg *config.Config, st store.AuditStore, logger *log.Logger) *Exporter {
+	return &Exporter{
+		Store: st,
+		Sinks: Sinks(cfg),
+		Log:   logger,
+		path:  filepath.Join(cfg.BaseDir, "filestorage", "_audit_export.json"),
+	}
+}
+
+// Run ships new events every interval until the process exits.
+func (e *Exporter) Run(interval time.Duration) {
+	for {
+		if err := e.Ship(context.Background()); err != nil {
+			e.Log.Printf("audit export: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Ship sends every sink the events it has not had yet.
+func (e *Exporter) Ship(ctx context.Context) error {
+	if e.cursors == nil {
+		if err := e.loadCursors(); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, sink := range e.Sinks {
+		for {
+			batch, err := e.Store.Since(ctx, e.cursors[sink.Name()], exportBatch)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			if err := sink.Send(ctx, batch); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+				break
+			}
+			e.cursors[sink.Name()] = batch[len(batch)-1].Seq
+			if err := e.saveCursors(); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Exporter) loadCursors() error {
+	e.cursors = map[string]int64{}
+	b, err := os.ReadFile(e.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &e.cursors)
+}
+
+func (e *Exporter) saveCursors() error {
+	b, err := json.Marshal(e.cursors)
+	if err != nil {
+		return err
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.path)
+}
@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"SCloud/config"
+	"SCloud/egress"
+	"SCloud/store"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var client = egress.Client(30 * time.Second)
+
+// syslog facility authpriv, severity notice
+const syslogPriority = 10*8 + 5
+
+// syslogSink sends each event as an RFC 5424 message with the event as
+// JSON, one datagram each over UDP and octet-counted over TCP. Only TCP
+// can go through the egress proxy.
+type syslogSink struct {
+	network, addr, host string
+}
+
+func newSyslogSink(rawURL string) *syslogSink {
+	u, _ := url.Parse(rawURL) // LoadConfig checked it
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+	return &syslogSink{network: u.Scheme, addr: u.Host, host: host}
+}
+
+func (s *syslogSink) Name() string { return "syslog " + s.network + "://" + s.addr }
+
+func (s *syslogSink) Send(ctx context.Context, events []store.AuditEvent) error {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if s.network == "tcp" {
+		conn, err = egress.DialContext(dialCtx, s.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(dialCtx, s.network, s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	for i := range events {
+		body, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("<%d>1 %s %s SCloud - audit - %s", syslogPriority,
+			events[i].Time.UTC().Format(time.RFC3339Nano), s.host, body)
+		if s.network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := io.WriteString(conn, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hecSink posts batches to a Splunk HTTP Event Collector.
+type hecSink struct {
+	url   string
+	token *config.Secret // read per batch, so a rotated one is picked up
+}
+
+func (s *hecSink) Name() string { return "hec " + s.url }
+
+func (s *hecSink) Send(ctx context.Context, events []store.AuditEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i := range events {
+		err := enc.Encode(map[string]any{
+			"time":       float64(events[i].Time.UnixMilli()) / 1000,
+			"source":     "scloud",
+			"sourcetype": "scloud:audit",
+			"event":      &events[i],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token.Value())
+	req.Header.Set("Content-Type", "application/json")
+	return do(req)
+}
+
+// s3Sink puts each batch as an object of JSON lines named after the first
+// and last Seq in it. A bucket with object lock keeps them immutable.
+type s3Sink struct {
+	cfg *config.AuditS3
+}
+
+func (s *s3Sink) Name() string { return "s3 " + s.cfg.Bucket + "/" + s.cfg.Prefix }
+
+func (s *s3Sink) Send(ctx context.Context, events []store.AuditEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	key := fmt.Sprintf("%020d-%020d.jsonl", events[0].Seq, events[len(events)-1].Seq)
+	if s.cfg.Prefix != "" {
+		key = s.cfg.Prefix + "/" + key
+	}
+	segments := strings.Split(s.cfg.Bucket+"/"+key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.cfg.Endpoint+"/"+strings.Join(segments, "/"), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s.sign(req, body.Bytes(), time.Now().UTC())
+	return do(req)
+}
+
+// sign adds an AWS Signature Version 4 to req.
+func (s *s3Sink) sign(req *http.Request, payload []byte, now time.Time) {
+	stamp, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", stamp)
+
+	const signed = "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // no query
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + stamp,
+		"",
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	k := []byte("AWS4" + s.cfg.SecretKey)
+	for _, part := range []string{day, s.cfg.Region, "s3", "aws4_request", toSign} {
+		m := hmac.New(sha256.New, k)
+		m.Write([]byte(part))
+		k = m.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signed, hex.EncodeToString(k)))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// do sends req and turns a non-2xx answer into an error.
+func do(req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
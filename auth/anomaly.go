@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"SCloud/anomaly"
+	"SCloud/config"
+	"SCloud/events"
+	"SCloud/store"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// the account a failed sign-in was for, so WatchFailures can count it
+	ctxFailedUser = "failed_user"
+	// a 401 that refuses no credentials: a session held for re-auth, or a
+	// session check that found no session
+	ctxNoFailure = "no_failure"
+)
+
+// WatchFailures counts the 401s of the requests it wraps against the
+// caller's address and, when known, the account.
+func (s *Service) WatchFailures() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Next()
+		if context.Writer.Status() != http.StatusUnauthorized || context.GetBool(ctxNoFailure) {
+			return
+		}
+		userID := context.GetString("userid")
+		if userID == "" {
+			userID = context.GetString(ctxFailedUser)
+		}
+		for _, f := range s.Anomalies.Failure(context.ClientIP(), userID, time.Now()) {
+			s.reportAnomaly(context.Request.Context(), f)
+		}
+	}
+}
+
+// Downloaded counts a download of n bytes by the signed-in caller.
+func (s *Service) Downloaded(context *gin.Context, n int64) {
+	if f := s.Anomalies.Download(context.GetString("userid"), context.ClientIP(), n, time.Now()); f != nil {
+		s.reportAnomaly(context.Request.Context(), *f)
+	}
+}
+
+// signedIn checks a new session of userID for impossible travel.
+func (s *Service) signedIn(context *gin.Context, userID string) {
+	if f := s.Anomalies.SignIn(userID, context.ClientIP(), time.Now()); f != nil {
+		s.reportAnomaly(context.Request.Context(), *f)
+	}
+}
+
+// reportAnomaly records a finding in the audit log, alerts on it and
+// takes the ANOMALY_ACTIONS action for its kind against the account.
+func (s *Service) reportAnomaly(ctx context.Context, f anomaly.Finding) {
+	subject := f.IP
+	if f.UserID != "" {
+		subject = f.UserID
+		if user, err := s.Stores.Users.ByID(ctx, f.UserID); err == nil {
+			f.Detail = user.Email + ": " + f.Detail
+		}
+	}
+	action := s.Cfg.AnomalyActions[f.Kind]
+	if f.UserID == "" && (action != config.AnomalyLock || f.Kind != events.AnomalyAuthFailures) {
+		action = ""
+	}
+	detail := f.Detail
+	if action != "" {
+		detail += "; " + action
+	}
+	s.audit(ctx, "", string(f.Kind), subject, detail)
+	if s.Alerts != nil {
+		s.Alerts.Anomaly(f, action)
+	}
+
+	switch {
+	case action == config.AnomalyReauth:
+		s.holdSessions(f.UserID)
+	case action == config.AnomalyLock && f.Kind == events.AnomalyAuthFailures:
+		// anyone can fail a sign-in as anyone: lock out the address, not
+		// the account, and only for a while
+		s.lockOut(f.IP, f.UserID)
+	case action == config.AnomalyLock:
+		if err := s.Stores.Users.SetLocked(ctx, f.UserID, true); err != nil {
+			s.Log.Printf("Error locking %s: %v", f.UserID, err)
+			return
+		}
+		if err := s.endSessions(ctx, f.UserID); err != nil {
+			s.Log.Printf("Error ending sessions of %s: %v", f.UserID, err)
+		}
+	}
+}
+
+// holdSessions makes every session of userID confirm the password at
+// /api/auth/reauth before it is used again.
+func (s *Service) holdSessions(userID string) {
+	now := time.Now()
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	s.pruneHolds(now)
+	s.holds[userID] = now
+}
+
+// lockOut refuses passwords from ip, for userID or, when that is "", for
+// any account, for ANOMALY_AUTH_WINDOW.
+func (s *Service) lockOut(ip, userID string) {
+	now := time.Now()
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	s.pruneHolds(now)
+	s.lockouts[lockoutKey(ip, userID)] = now.Add(s.Cfg.AnomalyAuthWindow)
+}
+
+// lockedOut reports whether passwords for userID from ip are refused.
+func (s *Service) lockedOut(ip, userID string) bool {
+	now := time.Now()
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	return now.Before(s.lockouts[lockoutKey(ip, "")]) || now.Before(s.lockouts[lockoutKey(ip, userID)])
+}
+
+func lockoutKey(ip, userID string) string { return ip + "|" + userID }
+
+// confirmSession records that the owner of session token just gave their
+// password, which releases it from any hold placed before.
+func (s *Service) confirmSession(token string) {
+	now := time.Now()
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	s.pruneHolds(now)
+	s.confirmed[token] = now
+}
+
+// held reports whether session has not confirmed the password since its
+// owner's sessions were held.
+func (s *Service) held(session *Session) bool {
+	s.holdsMu.Lock()
+	defer s.holdsMu.Unlock()
+	since, ok := s.holds[session.UserID]
+	return ok && s.confirmed[session.SessionToken].Before(since)
+}
+
+// pruneHolds drops holds and confirmations older than any session can be,
+// and lockouts that ran out; the caller holds holdsMu.
+func (s *Service) pruneHolds(now time.Time) {
+	for id, at := range s.holds {
+		if now.Sub(at) > s.Cfg.SessionMaxAge {
+			delete(s.holds, id)
+		}
+	}
+	for token, at := range s.confirmed {
+		if now.Sub(at) > s.Cfg.SessionMaxAge {
+			delete(s.confirmed, token)
+		}
+	}
+	for key, until := range s.lockouts {
+		if now.After(until) {
+			delete(s.lockouts, key)
+		}
+	}
+}
+
+// endSessions signs userID out everywhere and forgets their file key.
+func (s *Service) endSessions(ctx context.Context, userID string) error {
+	s.keysMu.Lock()
+	delete(s.keys, userID)
+	s.keysMu.Unlock()
+	return s.Stores.Sessions.DeleteForUser(ctx, userID)
+}
+
+// audit records a security event; a failure to record it is logged.
+func (s *Service) audit(ctx context.Context, actorID, action, subject, detail string) {
+	a := store.AuditEvent{ID: generateID(), Time: time.Now(), ActorID: actorID, Action: action, Path: subject, Detail: detail}
+	if err := s.Stores.Audit.Add(ctx, &a); err != nil {
+		s.Log.Printf("audit %s %s: %v", action, subject, err)
+	}
+}
+
+// UnlockUserHandler lifts an anomaly lock from an account, and the lockouts
+// of its password, and releases its sessions from a re-auth hold, as after
+// an anomaly was looked into. A SCIM deprovisioning stays as it is.
+func (s *Service) UnlockUserHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	user, err := s.Stores.Users.ByID(ctx, context.Param("id"))
+	if err != nil {
+		context.String(http.StatusNotFound, "User not found")
+		return
+	}
+	if err := s.Stores.Users.SetLocked(ctx, user.UserID, false); err != nil {
+		context.String(http.StatusInternalServerError, "unlock user: %v", err)
+		return
+	}
+	s.holdsMu.Lock()
+	delete(s.holds, user.UserID)
+	for key := range s.lockouts {
+		if strings.HasSuffix(key, "|"+user.UserID) {
+			delete(s.lockouts, key)
+		}
+	}
+	s.holdsMu.Unlock()
+	s.audit(ctx, context.GetString("userid"), "unlock", user.UserID, user.Email)
+	s.Log.Printf("User %s unlocked by %s", user.Email, context.GetString("username"))
+	context.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"SCloud/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+type APIKey = store.APIKey
+
+// API key scopes. write covers read, upload and link too. admin adds the
+// admin API and an admin's override of file permissions, and only on an
+// admin's key; without it an admin's key acts as any user's would.
+const (
+	ScopeRead   = "read"   // list, download, search, stream
+	ScopeUpload = "upload" // add new files, never replace, delete or read them
+	ScopeLink   = "link"   // mint signed download links
+	ScopeWrite  = "write"  // everything a session may do with files
+	ScopeAdmin  = "admin"
+)
+
+var scopes = []string{ScopeRead, ScopeUpload, ScopeLink, ScopeWrite, ScopeAdmin}
+
+const (
+	// the request's *APIKey, when it came with one
+	ctxAPIKey = "api_key"
+	// API key tokens carry a prefix so leaked ones are easy to scan for
+	apiKeyPrefix = "sck_"
+	// a key's last use is recorded at most this often
+	apiKeyTouchEvery = time.Minute
+)
+
+// keyRoutes is the scope an API key needs for a route where the rule below
+// does not give it: under /api/files, GET and HEAD need read and other
+// methods write; under /api/admin, admin. Routes neither lists refuse keys,
+// so a key can never change a password or make another key.
+var keyRoutes = map[string]string{
+	"POST /api/files/upload":            ScopeUpload,
+	"PUT /api/files/uploadchunked":      ScopeUpload,
+	"PUT /api/files/upload":             ScopeUpload,
+	"GET /api/files/upload/status":      ScopeUpload,
+	"POST /api/files/precheck":          ScopeUpload,
+	"GET /api/files/renditionlink":      ScopeLink,
+	"GET /api/dlink/generateLink":       ScopeLink,
+	"GET /api/auth/genDLink":            ScopeLink,
+	"GET /api/dlink/links/:id/accesses": ScopeLink,
+	"POST /api/fs/stat":                 ScopeRead,
+	"GET /api/fs/readdir":               ScopeRead,
+	"POST /api/fs/open":                 ScopeRead,
+	"POST /api/fs/close":                ScopeRead,
+	"GET /api/photos/timeline":          ScopeRead,
+	"GET /api/account/usage":            ScopeRead,
+	"POST /api/graphql":                 ScopeWrite,
+}
+
+// keyScope is the scope an API key needs for route; "" refuses keys.
+func keyScope(method, route string) string {
+	if scope, ok := keyRoutes[method+" "+route]; ok {
+		return scope
+	}
+	switch {
+	case strings.HasPrefix(route, "/api/files/"):
+		if method == http.MethodGet || method == http.MethodHead {
+			return ScopeRead
+		}
+		return ScopeWrite
+	case strings.HasPrefix(route, "/api/admin/"):
+		return ScopeAdmin
+	}
+	return ""
+}
+
+func hasScope(have []string, need string) bool {
+	return slices.Contains(have, need) || need != ScopeAdmin && slices.Contains(have, ScopeWrite)
+}
+
+// UploadOnly reports whether the request came with an API key that may add
+// files but not replace them.
+func UploadOnly(context *gin.Context) bool {
+	v, ok := context.Get(ctxAPIKey)
+	return ok && !hasScope(v.(*APIKey).Scopes, ScopeWrite)
+}
+
+// bearerToken returns the API key token of an Authorization: Bearer header.
+func bearerToken(context *gin.Context) (string, bool) {
+	token, ok := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer ")
+	return token, ok && strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// authorizeKey is Authorize for a request bearing an API key: it aborts
+// unless the key may make the request.
+func (s *Service) authorizeKey(context *gin.Context, token string) {
+	key, err := s.Stores.APIKeys.ByToken(context.Request.Context(), hashToken(token))
+	if err != nil || key.Signing {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	s.admitKey(context, key)
+}
+
+// admitKey sets the request up as made with key, or aborts unless the key
+// may make it.
+func (s *Service) admitKey(context *gin.Context, key *APIKey) {
+	ctx := context.Request.Context()
+	now := time.Now()
+	if !key.Expires.IsZero() && now.After(key.Expires) {
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key expired"})
+		return
+	}
+	user, err := s.Stores.Users.ByID(ctx, key.UserID)
+	if err != nil || user.Disabled || user.Locked {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	need := keyScope(context.Request.Method, context.FullPath())
+	if need == "" || !hasScope(key.Scopes, need) {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key not allowed here", "scope": need})
+		return
+	}
+	if now.Sub(key.LastUsed) > apiKeyTouchEvery {
+		if err := s.Stores.APIKeys.Touch(ctx, key.ID, now); err != nil {
+			s.Log.Printf("Error touching API key: %v", err)
+		}
+	}
+
+	context.Set("username", user.Username)
+	context.Set("userid", user.UserID)
+	context.Set("admin", user.Admin && hasScope(key.Scopes, ScopeAdmin))
+	context.Set("authorized", true)
+	context.Set(TokenAuth, true)
+	context.Set(ctxAPIKey, key)
+	if len(key.Prefixes) > 0 {
+		context.Set("prefixes", key.Prefixes)
+	}
+}
+
+type apiKeyRequest struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Prefixes []string `json:"prefixes"`
+	Expires  int64    `json:"expires_at"` // unix seconds; 0 = never
+	Signing  bool     `json:"signing"`    // sign requests rather than bear a token
+}
+
+// CreateAPIKeyHandler makes an API key for the caller. The token, or for
+// a signing key the secret, is only ever shown in this response.
+func (s *Service) CreateAPIKeyHandler(context *gin.Context) {
+	var req apiKeyRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		context.String(http.StatusBadRequest, "Missing scopes")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(scopes, scope) {
+			context.String(http.StatusBadRequest, "unknown scope %q", scope)
+			return
+		}
+	}
+	if slices.Contains(req.Scopes, ScopeAdmin) && !context.GetBool("admin") {
+		context.String(http.StatusForbidden, "Only admins can create admin keys")
+		return
+	}
+	now := time.Now()
+	if req.Expires != 0 && !time.Unix(req.Expires, 0).After(now) {
+		context.String(http.StatusBadRequest, "expires_at is in the past")
+		return
+	}
+	var prefixes []string
+	for _, p := range req.Prefixes {
+		p = filepath.Clean("/" + p)[1:]
+		if p == "" {
+			// the whole tree: no limit
+			prefixes = nil
+			break
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	token := apiKeyPrefix + generateToken(32)
+	key := &APIKey{
+		ID:        generateID(),
+		UserID:    context.GetString("userid"),
+		Name:      req.Name,
+		TokenHash: hashToken(token),
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		Prefixes:  prefixes,
+		Created:   now,
+		Signing:   req.Signing,
+	}
+	if req.Expires != 0 {
+		key.Expires = time.Unix(req.Expires, 0)
+	}
+	if err := s.Stores.APIKeys.Create(context.Request.Context(), key); err != nil {
+		context.String(http.StatusInternalServerError, "create API key: %v", err)
+		return
+	}
+	s.audit(context.Request.Context(), key.UserID, "apikey.create", key.ID, strings.Join(key.Scopes, ","))
+	if key.Signing {
+		// the token is thrown away: a signing key never bears one
+		context.JSON(http.StatusOK, gin.H{"key": key, "secret": s.signingSecret(key.ID)})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"key": key, "token": token})
+}
+
+// ListAPIKeysHandler lists the caller's API keys, without their tokens.
+func (s *Service) ListAPIKeysHandler(context *gin.Context) {
+	keys, err := s.Stores.APIKeys.ListForUser(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list API keys: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// RevokeAPIKeyHandler deletes one of the caller's API keys.
+func (s *Service) RevokeAPIKeyHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	userID := context.GetString("userid")
+	err := s.Stores.APIKeys.Delete(ctx, userID, context.Param("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		context.String(http.StatusNotFound, "No such API key")
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "revoke API key: %v", err)
+		return
+	}
+	s.audit(ctx, userID, "apikey.revoke", context.Param("id"), "")
+	context.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"SCloud/anomaly"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+)
+
+var (
+	errSessionMoved = errors.New("session used from another network or browser")
+	// the session is held, not ended: currentSession returns it with this
+	errReauth = errors.New("session needs the password again")
+)
+
+// checkBinding enforces SESSION_BIND: the session must be used from the
+// address block and user agent it was signed in from. Sessions that
+// predate the binding have no address or agent recorded and pass.
+func (s *Service) checkBinding(context *gin.Context, session *Session) error {
+	cfg := s.Cfg
+	moved := cfg.SessionBindIP && session.IP != "" &&
+		!anomaly.SameNetwork(session.IP, context.ClientIP(), cfg.SessionBindIPv4Prefix, cfg.SessionBindIPv6Prefix)
+	moved = moved || cfg.SessionBindUserAgent && session.UserAgent != "" && session.UserAgent != context.Request.UserAgent()
+	if !moved {
+		return nil
+	}
+	s.Log.Printf("Session of %s signed in from %s (%s) used from %s (%s)",
+		session.UserID, session.IP, session.UserAgent, context.ClientIP(), context.Request.UserAgent())
+	if cfg.SessionBindReauth {
+		return errReauth
+	}
+	return errSessionMoved
+}
+
+// ReauthHandler takes the password again for a session SESSION_BIND_MODE
+// =reauth or an anomaly is holding, and binds the session to where it is
+// now used from.
+func (s *Service) ReauthHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	session, err := s.currentSession(context)
+	if err != nil && !errors.Is(err, errReauth) {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	header, _ := url.QueryUnescape(context.GetHeader("X-CSRF-TOKEN"))
+	cookie, _ := context.Cookie("csrf_token")
+	if header == "" || !tokenEqual(header, cookie) || !tokenEqual(header, session.CSRFToken) {
+		context.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	user, err := s.Stores.Users.ByID(ctx, session.UserID)
+	if err != nil || user.Disabled || user.Locked {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if s.lockedOut(context.ClientIP(), user.UserID) {
+		context.String(http.StatusTooManyRequests, "Too many failed sign-ins, try again later")
+		return
+	}
+	if !checkPasswordHash(context.PostForm("password"), user.Password) {
+		context.Set(ctxFailedUser, user.UserID)
+		context.String(http.StatusUnauthorized, "wrong password")
+		return
+	}
+	if err := s.Stores.Sessions.Rebind(ctx, session.SessionToken, context.ClientIP(), context.Request.UserAgent()); err != nil {
+		context.String(http.StatusInternalServerError, "rebind session: %v", err)
+		return
+	}
+	s.confirmSession(session.SessionToken)
+	s.Log.Printf("Session of %s confirmed from %s", user.Email, context.ClientIP())
+	context.JSON(http.StatusOK, gin.H{"message": "Session confirmed"})
+}
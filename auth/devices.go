@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"SCloud/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+type Device = store.Device
+
+// A browser is recognised by a random token in a long-lived cookie, shared by
+// every account used from it. Sessions are bound to the device they started
+// on: a session cookie replayed without its device cookie, or after the
+// device was revoked, is dead.
+const (
+	deviceCookie = "device_token"
+	deviceMaxAge = 400 * 24 * time.Hour // the most browsers allow
+)
+
+var (
+	errDeviceMismatch  = errors.New("session used from another device")
+	errDeviceUntrusted = errors.New("device not approved")
+)
+
+// deviceFor returns the device the request comes from for user, registering
+// it (and issuing the cookie) on first sight. A new device is trusted when
+// approval is off or it is the account's first.
+func (s *Service) deviceFor(context *gin.Context, user *User) (*Device, error) {
+	ctx := context.Request.Context()
+	token, err := context.Cookie(deviceCookie)
+	if err != nil || token == "" {
+		token = generateToken(32)
+		s.setCookie(context, deviceCookie, token, int(deviceMaxAge/time.Second), true)
+	}
+	now := time.Now()
+	d, err := s.Stores.Devices.ByToken(ctx, user.UserID, hashToken(token))
+	if err == nil {
+		if err := s.Stores.Devices.Touch(ctx, d.ID, context.ClientIP(), now); err != nil {
+			s.Log.Printf("Error touching device: %v", err)
+		}
+		return d, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	known, err := s.Stores.Devices.ListForUser(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	d = &Device{
+		ID:        generateID(),
+		UserID:    user.UserID,
+		TokenHash: hashToken(token),
+		UserAgent: context.Request.UserAgent(),
+		IP:        context.ClientIP(),
+		FirstSeen: now,
+		LastSeen:  now,
+		Trusted:   !s.Cfg.DeviceApproval || len(known) == 0,
+	}
+	if err := s.Stores.Devices.Create(ctx, d); err != nil {
+		return nil, err
+	}
+	s.Log.Printf("New device for %s: %s from %s (trusted=%v)", user.Email, d.UserAgent, d.IP, d.Trusted)
+	if len(known) > 0 {
+		s.sendMail(user.Email, "new_device", gin.H{
+			"UserAgent":     d.UserAgent,
+			"IP":            d.IP,
+			"Time":          now.UTC().Format(time.RFC1123),
+			"NeedsApproval": !d.Trusted,
+		})
+	}
+	return d, nil
+}
+
+// checkDevice enforces a session's device binding.
+func (s *Service) checkDevice(context *gin.Context, session *Session) error {
+	if session.DeviceID == "" {
+		return nil
+	}
+	d, err := s.Stores.Devices.Get(context.Request.Context(), session.DeviceID)
+	if err != nil {
+		return errDeviceMismatch
+	}
+	token, _ := context.Cookie(deviceCookie)
+	if token == "" || hashToken(token) != d.TokenHash {
+		return errDeviceMismatch
+	}
+	if !d.Trusted {
+		return errDeviceUntrusted
+	}
+	return nil
+}
+
+// ListDevicesHandler lists the caller's devices, flagging the current one.
+func (s *Service) ListDevicesHandler(context *gin.Context) {
+	devices, err := s.Stores.Devices.ListForUser(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list devices: %v", err)
+		return
+	}
+	current := s.SessionDevice(context)
+	out := make([]gin.H, 0, len(devices))
+	for _, d := range devices {
+		out = append(out, gin.H{
+			"id":         d.ID,
+			"user_agent": d.UserAgent,
+			"ip":         d.IP,
+			"first_seen": d.FirstSeen,
+			"last_seen":  d.LastSeen,
+			"trusted":    d.Trusted,
+			"current":    d.ID == current,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{"devices": out})
+}
+
+// TrustDeviceHandler approves one of the caller's devices.
+func (s *Service) TrustDeviceHandler(context *gin.Context) {
+	d, ok := s.ownDevice(context)
+	if !ok {
+		return
+	}
+	if err := s.Stores.Devices.SetTrusted(context.Request.Context(), d.ID, true); err != nil {
+		context.String(http.StatusInternalServerError, "trust device: %v", err)
+		return
+	}
+	s.Log.Printf("Device %s approved for %s", d.ID, d.UserID)
+	context.JSON(http.StatusOK, gin.H{"message": "Device trusted"})
+}
+
+// RevokeDeviceHandler forgets one of the caller's devices. Its sessions stop
+// working at once, and signing in from it again counts as a new device.
+func (s *Service) RevokeDeviceHandler(context *gin.Context) {
+	d, ok := s.ownDevice(context)
+	if !ok {
+		return
+	}
+	if err := s.Stores.Devices.Delete(context.Request.Context(), d.ID); err != nil {
+		context.String(http.StatusInternalServerError, "revoke device: %v", err)
+		return
+	}
+	s.Log.Printf("Device %s revoked for %s", d.ID, d.UserID)
+	context.JSON(http.StatusOK, gin.H{"message": "Device revoked"})
+}
+
+// ownDevice loads the :id device, which must belong to the caller. It writes
+// the error response.
+func (s *Service) ownDevice(context *gin.Context) (*Device, bool) {
+	d, err := s.Stores.Devices.Get(context.Request.Context(), context.Param("id"))
+	if err != nil || d.UserID != context.GetString("userid") {
+		context.String(http.StatusNotFound, "No such device")
+		return nil, false
+	}
+	return d, true
+}
+
+// SessionDevice returns the ID of the device the request's session is bound
+// to, "" for none.
+func (s *Service) SessionDevice(context *gin.Context) string {
+	if v, ok := context.Get(ctxSession); ok {
+		return v.(*Session).DeviceID
+	}
+	return ""
+}
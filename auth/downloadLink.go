@@ -1,35 +1,186 @@
 package auth
 
 import (
+	"SCloud/authz"
+	"SCloud/config"
+	"SCloud/storage"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 )
 
-func GenerateDownloadLink(c *gin.Context) {
-	sessionToken, _ := c.Cookie("session_token")
-	user := Sessions[sessionToken].user
+var (
+	ErrBadSignature = errors.New("invalid signature")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrRetiredKey   = errors.New("signing key retired")
+)
+
+func (s *Service) GenerateDownloadLink(c *gin.Context) {
+	userID := c.GetString("userid")
 	filepath := c.Query("filepath")
+	org := c.Query("org")
+	sub := authz.Subject{UserID: userID, Admin: c.GetBool("admin"), Prefixes: c.GetStringSlice("prefixes")}
+	baseDir := s.Cfg.BaseDir
+	if org != "" {
+		sub.Org, sub.OrgRole = org, s.OrgRole(org, userID)
+		if sub.OrgRole == "" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		baseDir = OrgBaseDir(s.Cfg.BaseDir, org)
+	}
+	ok, err := s.Authz.Check(c.Request.Context(), sub, authz.Share, baseDir, filepath)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "authorization: %v", err)
+		return
+	}
+	if !ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	_, entry, statErr := storage.StatFile(s.Cfg.MasterKey, baseDir, filepath)
+	if statErr == nil && entry.Quarantine != nil {
+		c.String(http.StatusForbidden, "File is quarantined: %s", entry.Quarantine.Reason)
+		return
+	}
 
 	exp := time.Now().Add(30 * time.Second)
-	sig := SignDownload(filepath, user.UserID, exp)
+	nonce := generateID()
+	kid, sig := s.SignDownload(http.MethodGet, filepath, userID, org, nonce, exp)
+
+	link := fmt.Sprintf("%s/api/dlink/download?fp=%s&u=%s&exp=%d&n=%s&kid=%s&sig=%s",
+		s.Cfg.PublicURL, url.QueryEscape(filepath), userID, exp.Unix(), nonce, url.QueryEscape(kid), sig)
+	if org != "" {
+		link += "&org=" + url.QueryEscape(org)
+	}
+	// a file under a folder key has it kept for the link, so the download
+	// skips the master key path; the key itself never goes in the URL
+	if statErr == nil {
+		if _, ok := storage.FolderKeyID(entry.KeyOwner); ok {
+			if k, err := s.KeyForUser(entry.KeyOwner); err == nil {
+				s.keepLinkKey(nonce, k, exp)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": link, "id": nonce})
+}
+
+type linkKey struct {
+	key []byte
+	exp time.Time
+}
+
+// keepLinkKey holds the folder key of the link with nonce until it expires.
+func (s *Service) keepLinkKey(nonce string, k []byte, exp time.Time) {
+	now := time.Now()
+	s.linkKeysMu.Lock()
+	defer s.linkKeysMu.Unlock()
+	for n, lk := range s.linkKeys {
+		if now.After(lk.exp) {
+			delete(s.linkKeys, n)
+		}
+	}
+	s.linkKeys[nonce] = linkKey{key: k, exp: exp}
+}
+
+// LinkKey is the folder key kept for the download link with nonce, or nil.
+func (s *Service) LinkKey(nonce string) []byte {
+	s.linkKeysMu.Lock()
+	defer s.linkKeysMu.Unlock()
+	lk, ok := s.linkKeys[nonce]
+	if !ok || time.Now().After(lk.exp) {
+		return nil
+	}
+	return lk.key
+}
 
-	link := fmt.Sprintf("https://apisc.rorocorp.org/api/dlink/download?fp=%s&u=%s&exp=%d&sig=%s",
-		url.QueryEscape(filepath), user.UserID, exp.Unix(), sig)
+// SignDownload MACs a download link under the current signing key and returns
+// that key's ID with the signature. org is "" for the user's own tree.
+func (s *Service) SignDownload(method, filepath, userID, org, nonce string, exp time.Time) (kid, sig string) {
+	key := s.signingKey()
+	return key.ID, linkMAC(key.Secret, method, filepath, userID, org, nonce, key.ID, exp)
+}
+
+// RenditionMethod is what a rendition link is signed for in place of an
+// HTTP method: the MAC then covers the variant, and neither a download link
+// nor a link to another variant passes for it.
+func RenditionMethod(kind string) string {
+	return "RENDITION " + kind
+}
+
+// SignManifest signs a sync manifest response body with the ed25519 key of
+// the current signing key. Clients verify it against ManifestKeysHandler,
+// which hands out public keys only, so holding one proves nothing.
+func (s *Service) SignManifest(body []byte) (kid, sig string) {
+	key := s.signingKey()
+	msg := append([]byte("manifest|v2|"+key.ID+"|"), body...)
+	return key.ID, base64.StdEncoding.EncodeToString(ed25519.Sign(manifestKey(key), msg))
+}
+
+// manifestKey derives the manifest signing key from a link-signing key, so
+// it rotates and retires along with SIGN_KEYS.
+func manifestKey(k config.SignKey) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte("manifest|ed25519"))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// ManifestKeysHandler publishes the ed25519 public keys manifests are
+// signed with, base64 by key id: the current one and those of retired keys
+// still within SignKeyGrace.
+func (s *Service) ManifestKeysHandler(c *gin.Context) {
+	keys := map[string]string{}
+	for _, k := range s.Cfg.SignKeys {
+		if !k.RetiredAt.IsZero() && time.Now().After(k.RetiredAt.Add(s.Cfg.SignKeyGrace)) {
+			continue
+		}
+		pub := manifestKey(k).Public().(ed25519.PublicKey)
+		keys[k.ID] = base64.StdEncoding.EncodeToString(pub)
+	}
+	c.JSON(http.StatusOK, gin.H{"alg": "ed25519", "keys": keys})
+}
+
+// VerifyDownload checks a link signed by SignDownload. Links signed with a
+// retired key are honoured until SignKeyGrace after its retirement.
+func (s *Service) VerifyDownload(method, filepath, userID, org, nonce, kid string, exp time.Time, sig string) error {
+	for _, k := range s.Cfg.SignKeys {
+		if k.ID != kid {
+			continue
+		}
+		if !k.RetiredAt.IsZero() && time.Now().After(k.RetiredAt.Add(s.Cfg.SignKeyGrace)) {
+			return ErrRetiredKey
+		}
+		want := linkMAC(k.Secret, method, filepath, userID, org, nonce, kid, exp)
+		if !hmac.Equal([]byte(want), []byte(sig)) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return ErrUnknownKey
+}
 
-	c.JSON(http.StatusOK, gin.H{"url": link})
+// signingKey is the first live key, falling back to the newest one.
+func (s *Service) signingKey() config.SignKey {
+	for _, k := range s.Cfg.SignKeys {
+		if k.RetiredAt.IsZero() || time.Now().Before(k.RetiredAt) {
+			return k
+		}
+	}
+	return s.Cfg.SignKeys[0]
 }
 
-func SignDownload(filepath string, userID string, exp time.Time) string {
-	println("SignDownload: ", filepath, userID, exp.Unix())
-	secret := []byte(os.Getenv("SIGN_SECRET"))
-	message := fmt.Sprintf("%s|%s|%d", filepath, userID, exp.Unix())
+func linkMAC(secret []byte, method, filepath, userID, org, nonce, kid string, exp time.Time) string {
+	message := fmt.Sprintf("v2|%s|%s|%s|%s|%d|%s|%s", method, filepath, userID, org, exp.Unix(), nonce, kid)
 	mac := hmac.New(sha256.New, secret)
 	mac.Write([]byte(message))
 	return hex.EncodeToString(mac.Sum(nil))
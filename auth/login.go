@@ -1,31 +1,95 @@
 package auth
 
 import (
+	"SCloud/alerts"
+	"SCloud/anomaly"
+	"SCloud/authz"
+	"SCloud/config"
+	"SCloud/coord"
+	"SCloud/imagemeta"
+	"SCloud/mail"
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
-type User struct {
-	Email    string
-	Username string
-	Password string
-	UserID   string
-}
-type Session struct {
-	SessionToken string
-	CSRFToken    string
-	expiryTime   time.Time
-	user         *User
+type User = store.User
+type Session = store.Session
+
+// Service carries what the auth handlers and middleware depend on.
+type Service struct {
+	Cfg    *config.Config
+	Stores store.Stores
+	Log    *log.Logger
+	Authz  *authz.Authorizer
+	Mail   *mail.Mailer // nil sends nothing
+	Alerts *alerts.Alerts
+
+	Anomalies *anomaly.Detector
+
+	// spent nonces of signed requests; shared between instances when
+	// COORDINATION is set
+	Claims coord.Claimer
+
+	// serialises read-modify-write changes to orgs in Stores.Orgs
+	orgsMu sync.Mutex
+
+	// keys unwrapped at login (or on demand for master-wrapped keys), by user ID
+	keysMu sync.RWMutex
+	keys   map[string][]byte
+
+	// SAML requests sent, ACS tickets not yet redeemed and assertion IDs
+	// already used, each until it expires
+	samlMu       sync.Mutex
+	samlRequests map[string]samlRequest
+	samlTickets  map[string]samlTicket
+	samlUsed     map[string]time.Time
+
+	// sessions held for re-auth after an anomaly: since when, by user ID,
+	// and when each session last gave its password, by session token
+	holdsMu   sync.Mutex
+	holds     map[string]time.Time
+	confirmed map[string]time.Time
+	// passwords refused after repeated failures, until when, by client
+	// address and account (lockoutKey)
+	lockouts map[string]time.Time
+
+	// folder keys of download links, by nonce, until the link expires
+	linkKeysMu sync.Mutex
+	linkKeys   map[string]linkKey
 }
 
-// hashtable to store the uesrs logged in curently
-var Sessions = map[string]Session{}
-var Users = map[string]*User{} // map of pointers to user obj's
+func New(cfg *config.Config, stores store.Stores, logger *log.Logger) *Service {
+	return &Service{
+		Cfg:    cfg,
+		Stores: stores,
+		Log:    logger,
+		Authz:  authz.New(cfg.MasterKey, stores.Shares),
+		keys:   map[string][]byte{},
+
+		samlRequests: map[string]samlRequest{},
+		samlTickets:  map[string]samlTicket{},
+		samlUsed:     map[string]time.Time{},
+
+		Anomalies: anomaly.New(cfg),
+		Claims:    coord.NewLocal(),
+		holds:     map[string]time.Time{},
+		confirmed: map[string]time.Time{},
+		lockouts:  map[string]time.Time{},
 
-func RegisterHandler(context *gin.Context) {
+		linkKeys: map[string]linkKey{},
+	}
+}
+
+func (s *Service) RegisterHandler(context *gin.Context) {
+	ctx := context.Request.Context()
 	email := context.PostForm("email")
 	username := context.PostForm("username")
 	password := context.PostForm("password")
@@ -35,7 +99,7 @@ func RegisterHandler(context *gin.Context) {
 		return
 	}
 
-	if _, ok := Users[email]; ok {
+	if _, err := s.Stores.Users.ByEmail(ctx, email); err == nil {
 		er := http.StatusConflict
 		http.Error(context.Writer, http.StatusText(er), er)
 		return
@@ -43,19 +107,42 @@ func RegisterHandler(context *gin.Context) {
 
 	hashedPassword, err := hashPassword(password)
 	checkError(err)
-	Users[email] = &User{
+	user := &User{
 		Email:    email,
 		Username: username,
 		Password: hashedPassword,
-		UserID:   "1",
+		UserID:   generateID(),
+		Admin:    s.isAdminEmail(email),
 	}
-	context.JSON(http.StatusOK, gin.H{
-		"message": "User created successfully",
-	})
-	fmt.Println("User created successfully: ", Users[email].Username, Users[email].Password)
+	var codes []string
+	if s.UserKeysEnabled() {
+		if codes, err = s.unlockUserKey(user, password); err != nil {
+			s.Log.Printf("Error creating user key: %v", err)
+			er := http.StatusInternalServerError
+			http.Error(context.Writer, http.StatusText(er), er)
+			return
+		}
+	}
+	if err := s.Stores.Users.Create(ctx, user); err != nil {
+		er := http.StatusInternalServerError
+		if errors.Is(err, store.ErrExists) {
+			er = http.StatusConflict
+		}
+		checkError(err)
+		http.Error(context.Writer, http.StatusText(er), er)
+		return
+	}
+	s.sendVerification(user)
+	resp := gin.H{"message": "User created successfully"}
+	if codes != nil {
+		resp["recovery_codes"] = codes
+	}
+	context.JSON(http.StatusOK, resp)
+	s.Log.Printf("User created: %s (%s)", user.Username, user.UserID)
 }
 
-func LoginHandler(context *gin.Context) {
+func (s *Service) LoginHandler(context *gin.Context) {
+	ctx := context.Request.Context()
 	email := context.PostForm("email")
 	password := context.PostForm("password")
 	if len(email) < 8 || len(password) < 8 {
@@ -63,41 +150,208 @@ func LoginHandler(context *gin.Context) {
 		http.Error(context.Writer, http.StatusText(er), er)
 		return
 	}
-	_, userExist := Users[email]
-	if !userExist {
+	user, err := s.Stores.Users.ByEmail(ctx, email)
+	if err != nil {
 		er := http.StatusNotFound
 		http.Error(context.Writer, http.StatusText(er), er)
 		return
 	}
+	if s.lockedOut(context.ClientIP(), user.UserID) {
+		context.String(http.StatusTooManyRequests, "Too many failed sign-ins, try again later")
+		return
+	}
 
-	if !checkPasswordHash(password, Users[email].Password) {
+	if !checkPasswordHash(password, user.Password) {
+		context.Set(ctxFailedUser, user.UserID)
 		er := http.StatusUnauthorized
 		http.Error(context.Writer, http.StatusText(er), er)
 		return
 	}
+	if user.Disabled {
+		s.Log.Printf("Sign-in to disabled account %s from %s", email, context.ClientIP())
+		context.String(http.StatusForbidden, "Account disabled")
+		return
+	}
+	if user.Locked {
+		s.Log.Printf("Sign-in to locked account %s from %s", email, context.ClientIP())
+		context.String(http.StatusForbidden, "Account locked")
+		return
+	}
+
+	device, err := s.deviceFor(context, user)
+	if err != nil {
+		checkError(err)
+		er := http.StatusInternalServerError
+		http.Error(context.Writer, http.StatusText(er), er)
+		return
+	}
+	if !device.Trusted {
+		s.Log.Printf("Sign-in from unapproved device for %s from %s", email, context.ClientIP())
+		context.JSON(http.StatusForbidden, gin.H{
+			"message":   "New device: approve it from one of your trusted devices, then sign in again",
+			"device_id": device.ID,
+		})
+		return
+	}
+
+	var codes []string
+	if s.UserKeysEnabled() {
+		if codes, err = s.unlockUserKey(user, password); err != nil {
+			s.Log.Printf("Error unlocking user key for %s: %v", email, err)
+			er := http.StatusInternalServerError
+			http.Error(context.Writer, http.StatusText(er), er)
+			return
+		}
+	}
+
+	s.Log.Printf("User logged in successfully: %s from %s", email, context.ClientIP())
+
+	// never carry a pre-login session across the privilege change
+	if old, err := context.Cookie("session_token"); err == nil && old != "" {
+		_ = s.Stores.Sessions.Delete(ctx, hashToken(old))
+	}
+	if err := s.startSession(context, user.UserID, device.ID); err != nil {
+		checkError(err)
+		er := http.StatusInternalServerError
+		http.Error(context.Writer, http.StatusText(er), er)
+		return
+	}
 
-	log.Printf("User logged in successfully: %s", email)
+	resp := gin.H{"message": "User logged in successfully"}
+	if codes != nil {
+		resp["recovery_codes"] = codes
+	}
+	context.JSON(http.StatusOK, resp)
+}
 
+// ErrBadLogin is returned by CheckPassword for an unknown email or a wrong
+// password alike.
+var ErrBadLogin = errors.New("bad email or password")
+
+// ErrDisabled is a sign-in to an account that was deprovisioned.
+var ErrDisabled = errors.New("account disabled")
+
+// ErrLocked is a sign-in to an account an anomaly locked.
+var ErrLocked = errors.New("account locked")
+
+// CheckPassword signs in a client that has no browser session, such as an
+// SFTP login: it checks the password and unlocks the user's file key as
+// LoginHandler does, but starts no session and has no device to approve.
+func (s *Service) CheckPassword(ctx context.Context, email, password string) (*User, error) {
+	user, err := s.Stores.Users.ByEmail(ctx, email)
+	if err != nil || !checkPasswordHash(password, user.Password) {
+		return nil, ErrBadLogin
+	}
+	if user.Disabled {
+		return nil, ErrDisabled
+	}
+	if user.Locked {
+		return nil, ErrLocked
+	}
+	if s.UserKeysEnabled() {
+		if _, err := s.unlockUserKey(user, password); err != nil {
+			return nil, fmt.Errorf("unlock user key: %w", err)
+		}
+	}
+	return user, nil
+}
+
+// startSession issues fresh session and CSRF tokens for userID, bound to
+// deviceID, and sets their cookies. Only the session token's hash is stored.
+func (s *Service) startSession(context *gin.Context, userID, deviceID string) error {
 	sessionToken := generateToken(32)
 	csrfToken := generateToken(32)
+	now := time.Now()
 
-	context.SetCookie("session_token", sessionToken, 3600, "/", "rorocorp.org", false, true)
-	context.SetCookie("csrf_token", csrfToken, 3600, "/", "rorocorp.org", false, false)
+	err := s.Stores.Sessions.Create(context.Request.Context(), &Session{
+		SessionToken: hashToken(sessionToken),
+		UserID:       userID,
+		CSRFToken:    csrfToken,
+		ExpiryTime:   now.Add(s.Cfg.SessionMaxAge),
+		LastSeen:     now,
+		IP:           context.ClientIP(),
+		UserAgent:    context.Request.UserAgent(),
+		DeviceID:     deviceID,
+	})
+	if err != nil {
+		return err
+	}
+	// signing in gives the password (or the IdP's word) again
+	s.confirmSession(hashToken(sessionToken))
+	s.signedIn(context, userID)
 
-	context.SetCookie("session_token", sessionToken, 3600, "/", "localhost", false, true)
-	context.SetCookie("csrf_token", csrfToken, 3600, "/", "localhost", false, false)
 	//max age is how many seconds it remains active. Not the time
+	maxAge := int(s.Cfg.SessionMaxAge / time.Second)
+	s.setCookie(context, "session_token", sessionToken, maxAge, true)
+	// readable by the frontend so it can echo it back in X-CSRF-TOKEN
+	s.setCookie(context, "csrf_token", csrfToken, maxAge, false)
+	return nil
+}
 
-	Sessions[sessionToken] = Session{
-		SessionToken: sessionToken,
-		user:         Users[email],
-		CSRFToken:    csrfToken,
-		expiryTime:   time.Now().Add(24 * time.Hour),
+// ChangePasswordHandler swaps the caller's password, re-wraps a
+// password-wrapped file key, ends every other session and starts a new one.
+func (s *Service) ChangePasswordHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	current := context.PostForm("current_password")
+	next := context.PostForm("new_password")
+	if len(next) < 8 {
+		context.String(http.StatusNotAcceptable, "new password too short")
+		return
 	}
 
-	context.JSON(http.StatusOK, gin.H{
-		"message": "User logged in successfully",
-	})
+	user, err := s.Stores.Users.ByID(ctx, context.GetString("userid"))
+	if err != nil {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if !checkPasswordHash(current, user.Password) {
+		context.String(http.StatusUnauthorized, "wrong password")
+		return
+	}
+
+	hashed, err := hashPassword(next)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "hash: %v", err)
+		return
+	}
+	if err := storage.RewrapUserKey(s.Cfg.MasterKey, s.Cfg.BaseDir, user.UserID, current, next); err != nil {
+		context.String(http.StatusInternalServerError, "rewrap key: %v", err)
+		return
+	}
+	if err := s.Stores.Users.SetPassword(ctx, user.UserID, hashed); err != nil {
+		context.String(http.StatusInternalServerError, "update password: %v", err)
+		return
+	}
+
+	if err := s.Stores.Sessions.DeleteForUser(ctx, user.UserID); err != nil {
+		s.Log.Printf("Error revoking sessions for %s: %v", user.UserID, err)
+	}
+	if err := s.startSession(context, user.UserID, s.SessionDevice(context)); err != nil {
+		context.String(http.StatusInternalServerError, "session: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
+// ImageMetadataHandler sets what the caller's uploads do with image
+// metadata when an upload does not say: keep, strip or record.
+func (s *Service) ImageMetadataHandler(context *gin.Context) {
+	policy, err := imagemeta.ParsePolicy(context.PostForm("policy"))
+	if err != nil {
+		context.String(http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := s.Stores.Users.SetImageMetadata(context.Request.Context(), context.GetString("userid"), policy); err != nil {
+		context.String(http.StatusInternalServerError, "update: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"imageMetadata": policy})
+}
+
+// setCookie applies the configured domain, Secure and SameSite attributes.
+func (s *Service) setCookie(context *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	context.SetSameSite(s.Cfg.CookieSameSite)
+	context.SetCookie(name, value, maxAge, "/", s.Cfg.CookieDomain, s.Cfg.CookieSecure, httpOnly)
 }
 
 func checkError(err error) {
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Mailed links carry a stateless token: an HMAC under the signing key over
+// the purpose, user, expiry and a value the link should die with. A reset
+// link is bound to the password hash, so it stops working once used; a
+// verification link is bound to the address it was sent to.
+const (
+	resetLinkValid  = time.Hour
+	verifyLinkValid = 7 * 24 * time.Hour
+)
+
+func (s *Service) mailToken(purpose, userID, bound string, exp int64) string {
+	mac := hmac.New(sha256.New, s.signingKey().Secret)
+	fmt.Fprintf(mac, "%s|%s|%s|%d", purpose, userID, bound, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) checkMailToken(purpose, userID, bound, exp, token string) bool {
+	e, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > e {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(s.mailToken(purpose, userID, bound, e)))
+}
+
+// sendMail queues a templated message; mail is best effort and never fails
+// the request that caused it.
+func (s *Service) sendMail(to, name string, data any) {
+	if s.Mail == nil {
+		return
+	}
+	if err := s.Mail.SendTemplate([]string{to}, name, data); err != nil {
+		s.Log.Printf("mail %s: %v", name, err)
+	}
+}
+
+func (s *Service) sendVerification(user *User) {
+	exp := time.Now().Add(verifyLinkValid).Unix()
+	q := url.Values{
+		"u":     {user.UserID},
+		"exp":   {strconv.FormatInt(exp, 10)},
+		"token": {s.mailToken("verify", user.UserID, user.Email, exp)},
+	}
+	s.sendMail(user.Email, "verify_email", gin.H{
+		"Name": user.Username,
+		"Link": s.Cfg.PublicURL + "/api/auth/verify-email?" + q.Encode(),
+	})
+}
+
+// VerifyEmailHandler is where the link mailed at registration lands.
+func (s *Service) VerifyEmailHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	user, err := s.Stores.Users.ByID(ctx, context.Query("u"))
+	if err != nil || !s.checkMailToken("verify", user.UserID, user.Email, context.Query("exp"), context.Query("token")) {
+		context.String(http.StatusBadRequest, "invalid or expired link")
+		return
+	}
+	if err := s.Stores.Users.SetEmailVerified(ctx, user.UserID); err != nil {
+		context.String(http.StatusInternalServerError, "verify: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Email address confirmed"})
+}
+
+// ResendVerificationHandler mails the caller a fresh verification link.
+func (s *Service) ResendVerificationHandler(context *gin.Context) {
+	user, err := s.Stores.Users.ByID(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if user.EmailVerified {
+		context.String(http.StatusConflict, "email already verified")
+		return
+	}
+	s.sendVerification(user)
+	context.JSON(http.StatusOK, gin.H{"message": "Verification mail sent"})
+}
+
+// ResetRequestHandler mails a password reset link. The answer is the same
+// whether or not the address has an account. A mailed link cannot unlock
+// files under a password-wrapped key, so their owner is told to use a
+// recovery code instead.
+func (s *Service) ResetRequestHandler(context *gin.Context) {
+	email := context.PostForm("email")
+	if user, err := s.Stores.Users.ByEmail(context.Request.Context(), email); err == nil {
+		if wrapped, err := s.passwordWrapped(user.UserID); err != nil || wrapped {
+			if err != nil {
+				s.Log.Printf("Error reading the key mode of %s: %v", user.UserID, err)
+			} else {
+				s.sendMail(user.Email, "password_reset_recovery", gin.H{})
+			}
+			context.JSON(http.StatusOK, gin.H{"message": "If the address has an account, a reset link is on its way"})
+			return
+		}
+		exp := time.Now().Add(resetLinkValid).Unix()
+		q := url.Values{
+			"email": {user.Email},
+			"exp":   {strconv.FormatInt(exp, 10)},
+			"token": {s.mailToken("reset", user.UserID, user.Password, exp)},
+		}
+		s.sendMail(user.Email, "password_reset", gin.H{
+			"Link": s.Cfg.AppURL + "/reset-password?" + q.Encode(),
+		})
+		s.Log.Printf("Password reset requested for %s from %s", email, context.ClientIP())
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "If the address has an account, a reset link is on its way"})
+}
+
+// ResetPasswordHandler sets a new password from a mailed reset link. Every
+// session ends; the user signs in again. Following the link also proves the
+// address.
+func (s *Service) ResetPasswordHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	next := context.PostForm("new_password")
+	if len(next) < 8 {
+		context.String(http.StatusNotAcceptable, "new password too short")
+		return
+	}
+	user, err := s.Stores.Users.ByEmail(ctx, context.PostForm("email"))
+	if err != nil || !s.checkMailToken("reset", user.UserID, user.Password, context.PostForm("exp"), context.PostForm("token")) {
+		context.String(http.StatusBadRequest, "invalid or expired link")
+		return
+	}
+	wrapped, err := s.passwordWrapped(user.UserID)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "user key: %v", err)
+		return
+	}
+	if wrapped {
+		context.String(http.StatusConflict, "files are encrypted under your password: reset it with a recovery code")
+		return
+	}
+	hashed, err := hashPassword(next)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "hash: %v", err)
+		return
+	}
+	if err := s.Stores.Users.SetPassword(ctx, user.UserID, hashed); err != nil {
+		context.String(http.StatusInternalServerError, "update password: %v", err)
+		return
+	}
+	if err := s.Stores.Users.SetEmailVerified(ctx, user.UserID); err != nil {
+		s.Log.Printf("Error marking %s verified: %v", user.UserID, err)
+	}
+	if err := s.Stores.Sessions.DeleteForUser(ctx, user.UserID); err != nil {
+		s.Log.Printf("Error revoking sessions for %s: %v", user.UserID, err)
+	}
+	s.Log.Printf("Password reset by mail for %s from %s", user.Email, context.ClientIP())
+	context.JSON(http.StatusOK, gin.H{"message": "Password reset; sign in with the new password"})
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"SCloud/authz"
+	"SCloud/store"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	RoleOwner  = authz.RoleOwner
+	RoleAdmin  = authz.RoleAdmin
+	RoleMember = authz.RoleMember
+	RoleViewer = authz.RoleViewer
+)
+
+type Org = store.Org
+
+// OrgBaseDir is where an org's files live under the server's base directory.
+func OrgBaseDir(baseDir, orgID string) string {
+	return filepath.Join(baseDir, "orgs", orgID)
+}
+
+func validRole(r string) bool {
+	return r == RoleOwner || r == RoleAdmin || r == RoleMember || r == RoleViewer
+}
+
+// org loads orgID, or nil when there is no such org or it cannot be read.
+func (s *Service) org(orgID string) *Org {
+	o, err := s.Stores.Orgs.Get(context.Background(), orgID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			s.Log.Printf("org %s: %v", orgID, err)
+		}
+		return nil
+	}
+	return o
+}
+
+// OrgRole returns userID's role in orgID, or "" when not a member.
+func (s *Service) OrgRole(orgID, userID string) string {
+	if o := s.org(orgID); o != nil {
+		return o.Members[userID]
+	}
+	return ""
+}
+
+// OrgExists reports whether orgID names an org.
+func (s *Service) OrgExists(orgID string) bool {
+	return s.org(orgID) != nil
+}
+
+// OrgQuota returns the org's storage quota in bytes (0 = unlimited).
+func (s *Service) OrgQuota(orgID string) int64 {
+	if o := s.org(orgID); o != nil {
+		return o.QuotaBytes
+	}
+	return 0
+}
+
+// OrgName returns the org's display name, or "" for an unknown org.
+func (s *Service) OrgName(orgID string) string {
+	if o := s.org(orgID); o != nil {
+		return o.Name
+	}
+	return ""
+}
+
+// OrgAdmins returns the IDs of orgID's owners and admins.
+func (s *Service) OrgAdmins(orgID string) []string {
+	var ids []string
+	if o := s.org(orgID); o != nil {
+		for id, role := range o.Members {
+			if role == RoleOwner || role == RoleAdmin {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// OrgScope switches file routes to an org's storage root when ?org= is set,
+// after checking membership. Viewers are limited to reads.
+func (s *Service) OrgScope() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		orgID := context.Query("org")
+		if orgID == "" {
+			return
+		}
+		role := s.OrgRole(orgID, context.GetString("userid"))
+		if role == "" {
+			context.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if role == RoleViewer && context.Request.Method != http.MethodGet && context.Request.Method != http.MethodHead {
+			context.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		context.Set("org", orgID)
+		context.Set("orgrole", role)
+	}
+}
+
+func (s *Service) CreateOrgHandler(context *gin.Context) {
+	name := context.PostForm("name")
+	if name == "" {
+		context.String(http.StatusBadRequest, "Missing org name")
+		return
+	}
+	var quota int64
+	if q := context.PostForm("quota_bytes"); q != "" {
+		v, err := strconv.ParseInt(q, 10, 64)
+		if err != nil || v < 0 {
+			context.String(http.StatusBadRequest, "bad quota_bytes")
+			return
+		}
+		quota = v
+	}
+
+	org := &Org{
+		ID:         generateID(),
+		Name:       name,
+		Members:    map[string]string{context.GetString("userid"): RoleOwner},
+		QuotaBytes: quota,
+	}
+	if err := s.Stores.Orgs.Create(context.Request.Context(), org); err != nil {
+		context.String(http.StatusInternalServerError, "create org: %v", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, org)
+}
+
+func (s *Service) ListOrgsHandler(context *gin.Context) {
+	userID := context.GetString("userid")
+	orgs, err := s.Stores.Orgs.ListForUser(context.Request.Context(), userID)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list orgs: %v", err)
+		return
+	}
+
+	out := []gin.H{}
+	for _, o := range orgs {
+		out = append(out, gin.H{"id": o.ID, "name": o.Name, "role": o.Members[userID], "quota_bytes": o.QuotaBytes})
+	}
+	context.JSON(http.StatusOK, gin.H{"orgs": out})
+}
+
+// AddMemberHandler adds or re-roles a member by email. Owners and admins only;
+// only owners can hand out the owner role.
+func (s *Service) AddMemberHandler(context *gin.Context) {
+	orgID := context.Param("id")
+	email := context.PostForm("email")
+	role := context.DefaultPostForm("role", RoleMember)
+	if !validRole(role) {
+		context.String(http.StatusBadRequest, "bad role")
+		return
+	}
+	user, err := s.Stores.Users.ByEmail(context.Request.Context(), email)
+	if err != nil {
+		context.String(http.StatusNotFound, "No such user")
+		return
+	}
+
+	s.orgsMu.Lock()
+	defer s.orgsMu.Unlock()
+	org := s.org(orgID)
+	if org == nil {
+		context.String(http.StatusNotFound, "No such org")
+		return
+	}
+	callerRole := org.Members[context.GetString("userid")]
+	if callerRole != RoleOwner && callerRole != RoleAdmin {
+		context.String(http.StatusForbidden, "Not an org admin")
+		return
+	}
+	if (role == RoleOwner || org.Members[user.UserID] == RoleOwner) && callerRole != RoleOwner {
+		context.String(http.StatusForbidden, "Only owners can grant or change the owner role")
+		return
+	}
+	_, existed := org.Members[user.UserID]
+	if err := s.Stores.Orgs.SetMember(context.Request.Context(), org.ID, user.UserID, role); err != nil {
+		context.String(http.StatusInternalServerError, "add member: %v", err)
+		return
+	}
+	if !existed {
+		s.sendMail(user.Email, "org_added", gin.H{"Org": org.Name, "By": context.GetString("username"), "Role": role})
+	}
+	context.JSON(http.StatusOK, gin.H{"org": org.ID, "user": user.UserID, "role": role})
+}
+
+func (s *Service) RemoveMemberHandler(context *gin.Context) {
+	orgID := context.Param("id")
+	target := context.Param("userid")
+
+	s.orgsMu.Lock()
+	defer s.orgsMu.Unlock()
+	org := s.org(orgID)
+	if org == nil {
+		context.String(http.StatusNotFound, "No such org")
+		return
+	}
+	caller := context.GetString("userid")
+	callerRole := org.Members[caller]
+	if caller != target && callerRole != RoleOwner && callerRole != RoleAdmin {
+		context.String(http.StatusForbidden, "Not an org admin")
+		return
+	}
+	if org.Members[target] == RoleOwner {
+		owners := 0
+		for _, r := range org.Members {
+			if r == RoleOwner {
+				owners++
+			}
+		}
+		if owners == 1 {
+			context.String(http.StatusConflict, "Cannot remove the last owner")
+			return
+		}
+		if callerRole != RoleOwner {
+			context.String(http.StatusForbidden, "Only owners can remove owners")
+			return
+		}
+	}
+	if err := s.Stores.Orgs.RemoveMember(context.Request.Context(), org.ID, target); err != nil {
+		context.String(http.StatusInternalServerError, "remove member: %v", err)
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// RecoverHandler resets a forgotten password with a recovery code. The code
+// unwraps the file key, which is then wrapped under the new password, so a
+// password-wrapped key survives the reset. The code is used up; every
+// session ends and a new one starts. A code proves the account as well as a
+// trusted device does, so the device it was used from becomes trusted.
+func (s *Service) RecoverHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	email := context.PostForm("email")
+	code := context.PostForm("recovery_code")
+	next := context.PostForm("new_password")
+	if len(next) < 8 {
+		context.String(http.StatusNotAcceptable, "new password too short")
+		return
+	}
+	user, err := s.Stores.Users.ByEmail(ctx, email)
+	if err != nil {
+		context.String(http.StatusUnauthorized, "invalid recovery code")
+		return
+	}
+	k, err := storage.RecoverUserKey(s.Cfg.BaseDir, user.UserID, code)
+	if errors.Is(err, storage.ErrBadRecoveryCode) {
+		s.Log.Printf("Failed account recovery for %s from %s", email, context.ClientIP())
+		context.String(http.StatusUnauthorized, "invalid recovery code")
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "recover key: %v", err)
+		return
+	}
+
+	hashed, err := hashPassword(next)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "hash: %v", err)
+		return
+	}
+	if err := storage.ResetUserKey(s.Cfg.MasterKey, s.Cfg.BaseDir, user.UserID, next, k); err != nil {
+		context.String(http.StatusInternalServerError, "rewrap key: %v", err)
+		return
+	}
+	if err := s.Stores.Users.SetPassword(ctx, user.UserID, hashed); err != nil {
+		context.String(http.StatusInternalServerError, "update password: %v", err)
+		return
+	}
+	s.cacheUserKey(user.UserID, k)
+	s.Log.Printf("Account recovered with a recovery code: %s from %s", email, context.ClientIP())
+
+	if err := s.Stores.Sessions.DeleteForUser(ctx, user.UserID); err != nil {
+		s.Log.Printf("Error revoking sessions for %s: %v", user.UserID, err)
+	}
+	device, err := s.deviceFor(context, user)
+	if err == nil && !device.Trusted {
+		err = s.Stores.Devices.SetTrusted(ctx, device.ID, true)
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "device: %v", err)
+		return
+	}
+	if err := s.startSession(context, user.UserID, device.ID); err != nil {
+		context.String(http.StatusInternalServerError, "session: %v", err)
+		return
+	}
+	left, _ := storage.RecoveryCodesLeft(s.Cfg.BaseDir, user.UserID)
+	context.JSON(http.StatusOK, gin.H{"message": "Password reset", "recovery_codes_left": left})
+}
+
+// RecoveryCodesHandler reports how many recovery codes the caller has left.
+func (s *Service) RecoveryCodesHandler(context *gin.Context) {
+	left, err := storage.RecoveryCodesLeft(s.Cfg.BaseDir, context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "recovery codes: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"recovery_codes_left": left})
+}
+
+// NewRecoveryCodesHandler replaces the caller's recovery codes after
+// re-checking their password; the old codes stop working.
+func (s *Service) NewRecoveryCodesHandler(context *gin.Context) {
+	if !s.UserKeysEnabled() {
+		context.String(http.StatusNotFound, "per-user keys are not enabled")
+		return
+	}
+	user, err := s.Stores.Users.ByID(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	password := context.PostForm("password")
+	if !checkPasswordHash(password, user.Password) {
+		context.String(http.StatusUnauthorized, "wrong password")
+		return
+	}
+	k, err := storage.UnlockUserKey(s.Cfg.MasterKey, s.Cfg.BaseDir, user.UserID, password)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "unlock key: %v", err)
+		return
+	}
+	codes, err := storage.CreateRecoveryCodes(s.Cfg.BaseDir, user.UserID, k)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "recovery codes: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"SCloud/saml"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A SAML sign-in runs login -> IdP -> acs -> finish. The IdP posts to the
+// ACS cross-site, so the browser sends no SameSite cookies with it; the ACS
+// only checks the response and hands out a one-time ticket, and finish,
+// reached by a plain redirect with the cookies, checks the device and
+// starts the session as LoginHandler does.
+const (
+	samlRequestTTL = 10 * time.Minute
+	samlTicketTTL  = time.Minute
+	samlCookie     = "saml_request"
+)
+
+type samlRequest struct {
+	expires  time.Time
+	redirect string
+}
+
+type samlTicket struct {
+	expires   time.Time
+	userID    string
+	requestID string // "" for a sign-in the IdP started
+	redirect  string
+}
+
+// SAMLMetadataHandler serves the SP metadata to register with the IdP.
+func (s *Service) SAMLMetadataHandler(context *gin.Context) {
+	if s.Cfg.SAML == nil {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	context.Data(http.StatusOK, "application/samlmetadata+xml", s.Cfg.SAML.Metadata())
+}
+
+// SAMLLoginHandler sends the browser to the IdP. ?redirect= is the app
+// page to land on afterwards.
+func (s *Service) SAMLLoginHandler(context *gin.Context) {
+	if s.Cfg.SAML == nil {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	id := "_" + generateID()
+	target, err := s.Cfg.SAML.AuthnRequestURL(id, "", now)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "SAML request: %v", err)
+		return
+	}
+	s.samlMu.Lock()
+	s.pruneSAML(now)
+	s.samlRequests[id] = samlRequest{expires: now.Add(samlRequestTTL), redirect: appPath(context.Query("redirect"))}
+	s.samlMu.Unlock()
+	s.setCookie(context, samlCookie, id, int(samlRequestTTL/time.Second), true)
+	context.Redirect(http.StatusFound, target)
+}
+
+// SAMLACSHandler takes the response the IdP posts, maps the user and
+// redirects to SAMLFinishHandler.
+func (s *Service) SAMLACSHandler(context *gin.Context) {
+	sp := s.Cfg.SAML
+	if sp == nil {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	a, err := sp.ParseResponse(context.PostForm("SAMLResponse"), now)
+	if err != nil {
+		s.Log.Printf("SAML response refused from %s: %v", context.ClientIP(), err)
+		context.String(http.StatusUnauthorized, "SAML sign-in refused: %v", err)
+		return
+	}
+
+	s.samlMu.Lock()
+	s.pruneSAML(now)
+	if _, used := s.samlUsed[a.ID]; used {
+		s.samlMu.Unlock()
+		context.String(http.StatusUnauthorized, "SAML assertion already used")
+		return
+	}
+	redirect := appPath(context.PostForm("RelayState"))
+	if a.InResponseTo != "" {
+		req, ok := s.samlRequests[a.InResponseTo]
+		delete(s.samlRequests, a.InResponseTo)
+		if !ok {
+			s.samlMu.Unlock()
+			context.String(http.StatusUnauthorized, "Unknown or expired SAML request")
+			return
+		}
+		redirect = req.redirect
+	} else if !s.Cfg.SAMLIdPInitiated {
+		s.samlMu.Unlock()
+		context.String(http.StatusUnauthorized, "IdP-initiated sign-in is not enabled")
+		return
+	}
+	expires := a.NotOnOrAfter
+	if expires.IsZero() {
+		expires = now.Add(samlRequestTTL)
+	}
+	s.samlUsed[a.ID] = expires.Add(saml.Skew)
+	s.samlMu.Unlock()
+
+	user, err := s.samlUser(context, a)
+	if err != nil {
+		s.Log.Printf("SAML sign-in refused: %v", err)
+		context.String(http.StatusForbidden, "SAML sign-in refused: %v", err)
+		return
+	}
+
+	ticket := generateToken(32)
+	s.samlMu.Lock()
+	s.samlTickets[hashToken(ticket)] = samlTicket{
+		expires:   now.Add(samlTicketTTL),
+		userID:    user.UserID,
+		requestID: a.InResponseTo,
+		redirect:  redirect,
+	}
+	s.samlMu.Unlock()
+	context.Redirect(http.StatusSeeOther, s.Cfg.PublicURL+"/api/auth/saml/finish?ticket="+url.QueryEscape(ticket))
+}
+
+// SAMLFinishHandler redeems an ACS ticket for a session.
+func (s *Service) SAMLFinishHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	key := hashToken(context.Query("ticket"))
+	s.samlMu.Lock()
+	t, ok := s.samlTickets[key]
+	delete(s.samlTickets, key)
+	s.samlMu.Unlock()
+	if !ok || time.Now().After(t.expires) {
+		context.String(http.StatusUnauthorized, "Unknown or expired SAML ticket")
+		return
+	}
+	// a sign-in this browser started must come back to this browser
+	if t.requestID != "" {
+		if id, err := context.Cookie(samlCookie); err != nil || id != t.requestID {
+			context.String(http.StatusUnauthorized, "SAML sign-in was started in another browser")
+			return
+		}
+	}
+	s.setCookie(context, samlCookie, "", -1, true)
+
+	user, err := s.Stores.Users.ByID(ctx, t.userID)
+	if err != nil {
+		context.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	device, err := s.deviceFor(context, user)
+	if err != nil {
+		checkError(err)
+		er := http.StatusInternalServerError
+		http.Error(context.Writer, http.StatusText(er), er)
+		return
+	}
+	if !device.Trusted {
+		s.Log.Printf("SAML sign-in from unapproved device for %s from %s", user.Email, context.ClientIP())
+		context.JSON(http.StatusForbidden, gin.H{
+			"message":   "New device: approve it from one of your trusted devices, then sign in again",
+			"device_id": device.ID,
+		})
+		return
+	}
+	if s.UserKeysEnabled() {
+		_, err := s.KeyForUser(user.UserID)
+		if errors.Is(err, storage.ErrNoUserKey) {
+			// the codes are of no use with a master-wrapped key
+			_, err = s.unlockUserKey(user, "")
+		}
+		if errors.Is(err, ErrKeyLocked) {
+			context.String(http.StatusForbidden, "Your files are locked with your password: sign in with it instead")
+			return
+		}
+		if err != nil {
+			s.Log.Printf("Error unlocking user key for %s: %v", user.Email, err)
+			er := http.StatusInternalServerError
+			http.Error(context.Writer, http.StatusText(er), er)
+			return
+		}
+	}
+
+	s.Log.Printf("User logged in by SAML: %s from %s", user.Email, context.ClientIP())
+	if old, err := context.Cookie("session_token"); err == nil && old != "" {
+		_ = s.Stores.Sessions.Delete(ctx, hashToken(old))
+	}
+	if err := s.startSession(context, user.UserID, device.ID); err != nil {
+		checkError(err)
+		er := http.StatusInternalServerError
+		http.Error(context.Writer, http.StatusText(er), er)
+		return
+	}
+	context.Redirect(http.StatusSeeOther, s.Cfg.AppURL+t.redirect)
+}
+
+// samlUser finds, or with SAML_JIT creates, the account an assertion is
+// for, and applies the admin and org roles its groups map to.
+func (s *Service) samlUser(context *gin.Context, a *saml.Assertion) (*User, error) {
+	ctx := context.Request.Context()
+	email := s.samlEmail(a)
+	if email == "" {
+		return nil, errors.New("the IdP sent no email address")
+	}
+	user, err := s.Stores.Users.ByEmail(ctx, email)
+	if err != nil && !s.Cfg.SAMLJIT {
+		return nil, errors.New("no account for " + email)
+	}
+	if err != nil {
+		// no usable password: the account signs in through the IdP, or
+		// sets one with a reset
+		hashed, err := hashPassword(generateToken(32))
+		if err != nil {
+			return nil, err
+		}
+		name := a.Attr(s.Cfg.SAMLAttrName)
+		if s.Cfg.SAMLAttrName == "" || name == "" {
+			name, _, _ = strings.Cut(email, "@")
+		}
+		user = &User{
+			Email:         email,
+			Username:      name,
+			Password:      hashed,
+			UserID:        generateID(),
+			Admin:         s.isAdminEmail(email),
+			EmailVerified: true,
+		}
+		if err := s.Stores.Users.Create(ctx, user); err != nil {
+			return nil, err
+		}
+		s.Log.Printf("User created by SAML: %s", email)
+	}
+	if user.Disabled {
+		return nil, ErrDisabled
+	}
+	if user.Locked {
+		return nil, ErrLocked
+	}
+
+	groups := a.Attributes[s.Cfg.SAMLAttrGroups]
+	if len(s.Cfg.SAMLAdminGroups) > 0 {
+		admin := s.isAdminEmail(email) || slices.ContainsFunc(groups, func(g string) bool {
+			return slices.Contains(s.Cfg.SAMLAdminGroups, g)
+		})
+		if admin != user.Admin {
+			if err := s.Stores.Users.SetAdmin(ctx, user.UserID, admin); err != nil {
+				return nil, err
+			}
+			user.Admin = admin
+		}
+	}
+	// per org: the role the user's groups give now, and every role a
+	// mapping could have given, which is taken back once no group gives it
+	want, mapped := map[string]string{}, map[string][]string{}
+	for _, m := range s.Cfg.SAMLOrgRoles {
+		mapped[m.Org] = append(mapped[m.Org], m.Role)
+		if slices.Contains(groups, m.Group) {
+			want[m.Org] = m.Role
+		}
+	}
+	s.orgsMu.Lock()
+	defer s.orgsMu.Unlock()
+	for id, roles := range mapped {
+		org := s.org(id)
+		if org == nil {
+			s.Log.Printf("SAML_ORG_ROLES: no org %s", id)
+			continue
+		}
+		role, member := org.Members[user.UserID]
+		var err error
+		switch {
+		case role == RoleOwner:
+			// owners are only changed by hand
+		case want[id] != "" && want[id] != role:
+			err = s.Stores.Orgs.SetMember(ctx, id, user.UserID, want[id])
+		case want[id] == "" && member && slices.Contains(roles, role):
+			err = s.Stores.Orgs.RemoveMember(ctx, id, user.UserID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// samlEmail is the address an assertion is for: SAML_ATTR_EMAIL, else an
+// email NameID, else the common email attributes.
+func (s *Service) samlEmail(a *saml.Assertion) string {
+	if s.Cfg.SAMLAttrEmail != "" {
+		return a.Attr(s.Cfg.SAMLAttrEmail)
+	}
+	if a.NameIDFormat == saml.NameIDEmail {
+		return a.NameID
+	}
+	for _, name := range []string{"email", "mail", "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"} {
+		if v := a.Attr(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// pruneSAML drops expired requests, tickets and used assertion IDs; the
+// caller holds samlMu.
+func (s *Service) pruneSAML(now time.Time) {
+	for id, r := range s.samlRequests {
+		if now.After(r.expires) {
+			delete(s.samlRequests, id)
+		}
+	}
+	for k, t := range s.samlTickets {
+		if now.After(t.expires) {
+			delete(s.samlTickets, k)
+		}
+	}
+	for id, exp := range s.samlUsed {
+		if now.After(exp) {
+			delete(s.samlUsed, id)
+		}
+	}
+}
+
+// appPath keeps a redirect to a path in the app, so a sign-in cannot be
+// turned into an open redirect.
+func appPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.ContainsAny(p, "\\\r\n") {
+		return "/"
+	}
+	return p
+}
@@ -0,0 +1,620 @@
+package auth
+
+import (
+	"SCloud/store"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SCIM 2.0 provisioning (RFC 7643/7644) for identity providers, under
+// /scim/v2 with SCIM_TOKEN as the bearer token. Users are accounts, keyed
+// by email; groups are orgs, whose SCIM members get the member role.
+// Deleting a user only disables it: its files stay.
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimContentType = "application/scim+json"
+)
+
+// SCIMAuth checks the provisioning token. Without SCIM_TOKEN there is no
+// SCIM endpoint.
+func (s *Service) SCIMAuth() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		want := s.Cfg.SCIMToken.Value()
+		if want == "" {
+			context.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		token, _ := strings.CutPrefix(context.GetHeader("Authorization"), "Bearer ")
+		got, wantSum := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(want))
+		if subtle.ConstantTimeCompare(got[:], wantSum[:]) != 1 {
+			scimError(context, http.StatusUnauthorized, "", "bad provisioning token")
+			context.Abort()
+			return
+		}
+	}
+}
+
+func scimJSON(context *gin.Context, status int, body any) {
+	context.Header("Content-Type", scimContentType)
+	context.JSON(status, body)
+}
+
+func scimError(context *gin.Context, status int, scimType, detail string) {
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimJSON(context, status, body)
+}
+
+func (s *Service) scimLocation(kind, id string) string {
+	return s.Cfg.PublicURL + "/scim/v2/" + kind + "/" + id
+}
+
+func (s *Service) scimUser(u *User) gin.H {
+	return gin.H{
+		"schemas":     []string{scimUserSchema},
+		"id":          u.UserID,
+		"userName":    u.Email,
+		"displayName": u.Username,
+		"name":        gin.H{"formatted": u.Username},
+		"emails":      []gin.H{{"value": u.Email, "type": "work", "primary": true}},
+		"active":      !u.Disabled,
+		"meta":        gin.H{"resourceType": "User", "location": s.scimLocation("Users", u.UserID)},
+	}
+}
+
+// scimGroup renders org.
+func (s *Service) scimGroup(org *Org) gin.H {
+	members := []gin.H{}
+	for _, id := range slices.Sorted(maps.Keys(org.Members)) {
+		members = append(members, gin.H{"value": id, "$ref": s.scimLocation("Users", id)})
+	}
+	return gin.H{
+		"schemas":     []string{scimGroupSchema},
+		"id":          org.ID,
+		"displayName": org.Name,
+		"members":     members,
+		"meta":        gin.H{"resourceType": "Group", "location": s.scimLocation("Groups", org.ID)},
+	}
+}
+
+// scimList pages resources by the startIndex (1-based) and count query
+// parameters.
+func scimList(context *gin.Context, resources []gin.H) {
+	start, _ := strconv.Atoi(context.DefaultQuery("startIndex", "1"))
+	start = max(start, 1)
+	count, err := strconv.Atoi(context.Query("count"))
+	if err != nil || count < 0 {
+		count = len(resources)
+	}
+	page := resources[min(start-1, len(resources)):]
+	page = page[:min(count, len(page))]
+	scimJSON(context, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resources),
+		"startIndex":   start,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+var scimFilter = regexp.MustCompile(`^(\w+)\s+eq\s+"((?:[^"\\]|\\.)*)"$`)
+
+// parseFilter reads the one kind of filter IdPs send to look a resource
+// up: attr eq "value".
+func parseFilter(filter string) (attr, value string, err error) {
+	m := scimFilter.FindStringSubmatch(strings.TrimSpace(filter))
+	if m == nil {
+		return "", "", fmt.Errorf("unsupported filter %q", filter)
+	}
+	value, err = strconv.Unquote(`"` + m[2] + `"`)
+	return strings.ToLower(m[1]), value, err
+}
+
+// scimUserBody is the part of a User resource that maps onto an account.
+type scimUserBody struct {
+	UserName    string `json:"userName"`
+	DisplayName string `json:"displayName"`
+	Name        struct {
+		Formatted  string `json:"formatted"`
+		GivenName  string `json:"givenName"`
+		FamilyName string `json:"familyName"`
+	} `json:"name"`
+	Emails []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	} `json:"emails"`
+	Active   *bool  `json:"active"`
+	Password string `json:"password"`
+}
+
+// email is the account's address: userName if it is one, else the primary
+// email.
+func (b *scimUserBody) email() string {
+	if strings.Contains(b.UserName, "@") {
+		return b.UserName
+	}
+	for _, e := range b.Emails {
+		if e.Primary || len(b.Emails) == 1 {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+func (b *scimUserBody) displayName() string {
+	switch {
+	case b.DisplayName != "":
+		return b.DisplayName
+	case b.Name.Formatted != "":
+		return b.Name.Formatted
+	}
+	return strings.TrimSpace(b.Name.GivenName + " " + b.Name.FamilyName)
+}
+
+func (s *Service) SCIMListUsersHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	var users []User
+	if f := context.Query("filter"); f != "" {
+		attr, value, err := parseFilter(f)
+		if err != nil || attr != "username" {
+			scimError(context, http.StatusBadRequest, "invalidFilter", "only userName eq \"...\" filters are supported")
+			return
+		}
+		if u, err := s.Stores.Users.ByEmail(ctx, value); err == nil {
+			users = append(users, *u)
+		}
+	} else {
+		var err error
+		if users, err = s.Stores.Users.List(ctx); err != nil {
+			scimError(context, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+	out := []gin.H{}
+	for i := range users {
+		out = append(out, s.scimUser(&users[i]))
+	}
+	scimList(context, out)
+}
+
+func (s *Service) SCIMGetUserHandler(context *gin.Context) {
+	u, err := s.Stores.Users.ByID(context.Request.Context(), context.Param("id"))
+	if err != nil {
+		scimError(context, http.StatusNotFound, "", "no such user")
+		return
+	}
+	scimJSON(context, http.StatusOK, s.scimUser(u))
+}
+
+func (s *Service) SCIMCreateUserHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	var b scimUserBody
+	if err := context.ShouldBindJSON(&b); err != nil {
+		scimError(context, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	email := b.email()
+	if !strings.Contains(email, "@") {
+		scimError(context, http.StatusBadRequest, "invalidValue", "userName or a primary email must be an email address")
+		return
+	}
+	password := b.Password
+	if len(password) < 8 {
+		// the account signs in through the IdP, or sets a password with a reset
+		password = generateToken(32)
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	name := b.displayName()
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	user := &User{
+		Email:         email,
+		Username:      name,
+		Password:      hashed,
+		UserID:        generateID(),
+		Admin:         s.isAdminEmail(email),
+		EmailVerified: true,
+		Disabled:      b.Active != nil && !*b.Active,
+	}
+	if err := s.Stores.Users.Create(ctx, user); err != nil {
+		if errors.Is(err, store.ErrExists) {
+			scimError(context, http.StatusConflict, "uniqueness", "a user with this userName exists")
+			return
+		}
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.Log.Printf("SCIM: created user %s", email)
+	context.Header("Location", s.scimLocation("Users", user.UserID))
+	scimJSON(context, http.StatusCreated, s.scimUser(user))
+}
+
+// SCIMReplaceUserHandler takes a full User resource; of it, active and the
+// display name are applied. The userName cannot change.
+func (s *Service) SCIMReplaceUserHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	user, err := s.Stores.Users.ByID(ctx, context.Param("id"))
+	if err != nil {
+		scimError(context, http.StatusNotFound, "", "no such user")
+		return
+	}
+	var b scimUserBody
+	if err := context.ShouldBindJSON(&b); err != nil {
+		scimError(context, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if email := b.email(); email != "" && !strings.EqualFold(email, user.Email) {
+		scimError(context, http.StatusBadRequest, "mutability", "userName cannot be changed")
+		return
+	}
+	active := b.Active == nil || *b.Active
+	if err := s.updateUser(context, user, b.displayName(), &active); err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	scimJSON(context, http.StatusOK, s.scimUser(user))
+}
+
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// SCIMPatchUserHandler applies replace and add operations on active and
+// the display name; operations on other attributes are ignored, as IdPs
+// send every attribute they map.
+func (s *Service) SCIMPatchUserHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	user, err := s.Stores.Users.ByID(ctx, context.Param("id"))
+	if err != nil {
+		scimError(context, http.StatusNotFound, "", "no such user")
+		return
+	}
+	var p scimPatch
+	if err := context.ShouldBindJSON(&p); err != nil {
+		scimError(context, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	var name string
+	var active *bool
+	for _, op := range p.Operations {
+		switch strings.ToLower(op.Op) {
+		case "replace", "add":
+		default:
+			continue
+		}
+		values := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+				return
+			}
+		} else {
+			values[op.Path] = op.Value
+		}
+		for attr, v := range values {
+			switch strings.ToLower(attr) {
+			case "active":
+				b, err := scimBool(v)
+				if err != nil {
+					scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+					return
+				}
+				active = &b
+			case "displayname", "name.formatted":
+				if err := json.Unmarshal(v, &name); err != nil {
+					scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+					return
+				}
+			}
+		}
+	}
+	if err := s.updateUser(context, user, name, active); err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	scimJSON(context, http.StatusOK, s.scimUser(user))
+}
+
+// scimBool reads a boolean, which some IdPs send as the string "False".
+func scimBool(v json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var str string
+	if err := json.Unmarshal(v, &str); err != nil {
+		return false, fmt.Errorf("active: want a boolean")
+	}
+	return strconv.ParseBool(strings.ToLower(str))
+}
+
+// SCIMDeleteUserHandler deactivates the account.
+func (s *Service) SCIMDeleteUserHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	user, err := s.Stores.Users.ByID(ctx, context.Param("id"))
+	if err != nil {
+		scimError(context, http.StatusNotFound, "", "no such user")
+		return
+	}
+	inactive := false
+	if err := s.updateUser(context, user, "", &inactive); err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	context.Status(http.StatusNoContent)
+}
+
+// updateUser applies a new display name, if not empty, and active, if
+// set, to user. Deactivating ends the account's sessions and forgets its
+// unwrapped file key.
+func (s *Service) updateUser(context *gin.Context, user *User, name string, active *bool) error {
+	ctx := context.Request.Context()
+	if name != "" && name != user.Username {
+		if err := s.Stores.Users.SetUsername(ctx, user.UserID, name); err != nil {
+			return err
+		}
+		user.Username = name
+	}
+	if active == nil || *active == !user.Disabled {
+		return nil
+	}
+	if err := s.Stores.Users.SetDisabled(ctx, user.UserID, !*active); err != nil {
+		return err
+	}
+	user.Disabled = !*active
+	if user.Disabled {
+		if err := s.endSessions(ctx, user.UserID); err != nil {
+			return err
+		}
+	}
+	s.Log.Printf("SCIM: %s is now active=%v", user.Email, *active)
+	return nil
+}
+
+func (s *Service) SCIMListGroupsHandler(context *gin.Context) {
+	var name string
+	if f := context.Query("filter"); f != "" {
+		attr, value, err := parseFilter(f)
+		if err != nil || attr != "displayname" {
+			scimError(context, http.StatusBadRequest, "invalidFilter", "only displayName eq \"...\" filters are supported")
+			return
+		}
+		name = value
+	}
+	orgs, err := s.Stores.Orgs.List(context.Request.Context())
+	if err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	out := []gin.H{}
+	for _, o := range orgs {
+		if name == "" || o.Name == name {
+			out = append(out, s.scimGroup(&o))
+		}
+	}
+	scimList(context, out)
+}
+
+func (s *Service) SCIMGetGroupHandler(context *gin.Context) {
+	org := s.org(context.Param("id"))
+	if org == nil {
+		scimError(context, http.StatusNotFound, "", "no such group")
+		return
+	}
+	scimJSON(context, http.StatusOK, s.scimGroup(org))
+}
+
+type scimMember struct {
+	Value string `json:"value"`
+}
+
+func (s *Service) SCIMCreateGroupHandler(context *gin.Context) {
+	var b struct {
+		DisplayName string       `json:"displayName"`
+		Members     []scimMember `json:"members"`
+	}
+	if err := context.ShouldBindJSON(&b); err != nil || b.DisplayName == "" {
+		scimError(context, http.StatusBadRequest, "invalidValue", "a group needs a displayName")
+		return
+	}
+	members, err := s.scimMembers(context, b.Members)
+	if err != nil {
+		scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	org := &Org{ID: generateID(), Name: b.DisplayName, Members: map[string]string{}}
+	for _, id := range members {
+		org.Members[id] = RoleMember
+	}
+
+	s.orgsMu.Lock()
+	defer s.orgsMu.Unlock()
+	orgs, err := s.Stores.Orgs.List(context.Request.Context())
+	if err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	for _, o := range orgs {
+		if o.Name == b.DisplayName {
+			scimError(context, http.StatusConflict, "uniqueness", "a group with this displayName exists")
+			return
+		}
+	}
+	if err := s.Stores.Orgs.Create(context.Request.Context(), org); err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.Log.Printf("SCIM: created org %s (%s)", org.Name, org.ID)
+	context.Header("Location", s.scimLocation("Groups", org.ID))
+	scimJSON(context, http.StatusCreated, s.scimGroup(org))
+}
+
+var scimMemberPath = regexp.MustCompile(`^members\[value eq "([^"]+)"\]$`)
+
+// SCIMPatchGroupHandler renames a group and adds, removes or replaces its
+// members. Owners are left as they are: they are managed in SCloud.
+func (s *Service) SCIMPatchGroupHandler(context *gin.Context) {
+	var p scimPatch
+	if err := context.ShouldBindJSON(&p); err != nil {
+		scimError(context, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	type change struct {
+		op      string
+		name    string
+		members []string
+		all     bool // remove every member
+	}
+	var changes []change
+	for _, op := range p.Operations {
+		c := change{op: strings.ToLower(op.Op)}
+		path := strings.ToLower(op.Path)
+		if m := scimMemberPath.FindStringSubmatch(op.Path); m != nil {
+			path, c.members = "members", []string{m[1]}
+		}
+		values := map[string]json.RawMessage{}
+		if path == "" {
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+				return
+			}
+		} else {
+			values[path] = op.Value
+		}
+		for attr, v := range values {
+			switch strings.ToLower(attr) {
+			case "displayname":
+				if err := json.Unmarshal(v, &c.name); err != nil {
+					scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+					return
+				}
+			case "members":
+				var ms []scimMember
+				if len(v) > 0 {
+					if err := json.Unmarshal(v, &ms); err != nil {
+						scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+						return
+					}
+				}
+				ids, err := s.scimMembers(context, ms)
+				if err != nil {
+					scimError(context, http.StatusBadRequest, "invalidValue", err.Error())
+					return
+				}
+				c.members = append(c.members, ids...)
+			}
+		}
+		c.all = c.op == "remove" && path == "members" && len(c.members) == 0
+		changes = append(changes, c)
+	}
+
+	s.orgsMu.Lock()
+	defer s.orgsMu.Unlock()
+	org := s.org(context.Param("id"))
+	if org == nil {
+		scimError(context, http.StatusNotFound, "", "no such group")
+		return
+	}
+	name, before := org.Name, maps.Clone(org.Members)
+	for _, c := range changes {
+		if c.name != "" && c.op != "remove" {
+			org.Name = c.name
+		}
+		switch c.op {
+		case "add":
+			for _, id := range c.members {
+				if _, ok := org.Members[id]; !ok {
+					org.Members[id] = RoleMember
+				}
+			}
+		case "remove":
+			for id, role := range org.Members {
+				if role != RoleOwner && (c.all || slices.Contains(c.members, id)) {
+					delete(org.Members, id)
+				}
+			}
+		case "replace":
+			if c.members == nil {
+				continue
+			}
+			for id, role := range org.Members {
+				if role != RoleOwner && !slices.Contains(c.members, id) {
+					delete(org.Members, id)
+				}
+			}
+			for _, id := range c.members {
+				if _, ok := org.Members[id]; !ok {
+					org.Members[id] = RoleMember
+				}
+			}
+		}
+	}
+	if err := s.saveGroup(context.Request.Context(), org, name, before); err != nil {
+		scimError(context, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	scimJSON(context, http.StatusOK, s.scimGroup(org))
+}
+
+// saveGroup stores what a patch changed of org: its name, if not name any
+// more, and its members against before.
+func (s *Service) saveGroup(ctx context.Context, org *Org, name string, before map[string]string) error {
+	orgs := s.Stores.Orgs
+	if org.Name != name {
+		if err := orgs.Rename(ctx, org.ID, org.Name); err != nil {
+			return err
+		}
+	}
+	for id := range before {
+		if _, ok := org.Members[id]; !ok {
+			if err := orgs.RemoveMember(ctx, org.ID, id); err != nil {
+				return err
+			}
+		}
+	}
+	for id, role := range org.Members {
+		if before[id] != role {
+			if err := orgs.SetMember(ctx, org.ID, id, role); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scimMembers checks that every member is a user.
+func (s *Service) scimMembers(context *gin.Context, ms []scimMember) ([]string, error) {
+	ids := []string{}
+	for _, m := range ms {
+		if _, err := s.Stores.Users.ByID(context.Request.Context(), m.Value); err != nil {
+			return nil, fmt.Errorf("no user %q", m.Value)
+		}
+		ids = append(ids, m.Value)
+	}
+	return ids, nil
+}
@@ -1,15 +1,71 @@
 package auth
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
-	"net/url"
+	"strings"
 	"time"
 )
 
 // return AuthError = errors.New("Unauthorized")
 
-func Authorize() gin.HandlerFunc {
+var (
+	errNoSession      = errors.New("no session token")
+	errSessionExpired = errors.New("session expired")
+)
+
+// LastSeen is written at most this often per session
+const touchEvery = time.Minute
+
+// currentSession resolves the session cookie, enforcing the absolute and idle
+// timeouts, the device and SESSION_BIND bindings and anomaly holds. Expired
+// sessions are deleted on sight, as are moved ones unless they are held for
+// re-auth: then the session comes back with errReauth.
+func (s *Service) currentSession(context *gin.Context) (*Session, error) {
+	token, err := context.Cookie("session_token")
+	if err != nil || token == "" {
+		return nil, errNoSession
+	}
+	ctx := context.Request.Context()
+	key := hashToken(token)
+	session, err := s.Stores.Sessions.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	idle := s.Cfg.SessionIdleTimeout > 0 && now.Sub(session.LastSeen) > s.Cfg.SessionIdleTimeout
+	if session.IsExpired() || idle {
+		_ = s.Stores.Sessions.Delete(ctx, key)
+		return nil, errSessionExpired
+	}
+	if err := s.checkDevice(context, session); err != nil {
+		return nil, err
+	}
+	if err := s.checkBinding(context, session); errors.Is(err, errReauth) {
+		return session, err
+	} else if err != nil {
+		_ = s.Stores.Sessions.Delete(ctx, key)
+		return nil, err
+	}
+	if s.held(session) {
+		return session, errReauth
+	}
+	if now.Sub(session.LastSeen) > touchEvery {
+		if err := s.Stores.Sessions.Touch(ctx, key, now); err != nil {
+			s.Log.Printf("Error touching session: %v", err)
+		}
+		if session.DeviceID != "" {
+			if err := s.Stores.Devices.Touch(ctx, session.DeviceID, context.ClientIP(), now); err != nil {
+				s.Log.Printf("Error touching device: %v", err)
+			}
+		}
+	}
+	return session, nil
+}
+
+func (s *Service) Authorize() gin.HandlerFunc {
 	return func(context *gin.Context) {
 		context.Set("authorized", false)
 
@@ -21,57 +77,107 @@ func Authorize() gin.HandlerFunc {
 				return
 			}
 		*/
-		sessionToken, err := context.Cookie("session_token")
-		if err != nil || sessionToken == "" || sessionToken != Sessions[sessionToken].SessionToken {
+		if v, ok := context.Get(ctxSignedKey); ok {
+			s.admitKey(context, v.(*APIKey))
+			return
+		}
+		if token, ok := bearerToken(context); ok {
+			s.authorizeKey(context, token)
+			return
+		}
+		ctx := context.Request.Context()
+		session, err := s.currentSession(context)
+		if errors.Is(err, errReauth) {
+			context.Set(ctxNoFailure, true)
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Confirm your password to continue", "reauth": true})
+			return
+		}
+		if err != nil {
 			context.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
-		// Get CSRF token from the headers
-		rawcsrf := context.GetHeader("X-CSRF-TOKEN")
-		csrf, _ := url.QueryUnescape(rawcsrf)
-		if csrf == "" || csrf != Sessions[sessionToken].CSRFToken {
-			println("CSRF token error: ", csrf, " ", Sessions[sessionToken].CSRFToken, "")
+		user, err := s.Stores.Users.ByID(ctx, session.UserID)
+		if err != nil || user.Disabled || user.Locked {
 			context.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 
-		user := Sessions[sessionToken].user
-
 		context.Set("username", user.Username)
 		context.Set("userid", user.UserID)
+		context.Set("admin", user.Admin)
 		context.Set("authorized", true)
+		context.Set(ctxSession, session)
+	}
+}
+
+// RequireAdmin must run after Authorize.
+func RequireAdmin() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !context.GetBool("admin") {
+			context.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+	}
+}
+
+func (s *Service) isAdminEmail(email string) bool {
+	for _, e := range s.Cfg.AdminEmails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
 	}
+	return false
 }
 
-func SessionCheckHandler(context *gin.Context) {
-	// Get session token from cookie
-	sessionToken, err := context.Cookie("session_token")
-	if err != nil || sessionToken == "" {
+func (s *Service) SessionCheckHandler(context *gin.Context) {
+	// Check if session exists and is valid (expired ones are cleaned up)
+	ctx := context.Request.Context()
+	session, err := s.currentSession(context)
+	if err != nil {
+		message := "Invalid session token"
+		switch {
+		case errors.Is(err, errNoSession):
+			message = "No session token found"
+			context.Set(ctxNoFailure, true)
+		case errors.Is(err, errSessionExpired):
+			message = "Session expired"
+		case errors.Is(err, errDeviceMismatch), errors.Is(err, errDeviceUntrusted):
+			message = "Session not valid on this device"
+		case errors.Is(err, errSessionMoved):
+			message = "Session used from another network or browser"
+		case errors.Is(err, errReauth):
+			context.Set(ctxNoFailure, true)
+			context.JSON(http.StatusUnauthorized, gin.H{
+				"authenticated": false,
+				"message":       "Confirm your password to continue",
+				"reauth":        true,
+			})
+			return
+		}
 		context.JSON(http.StatusUnauthorized, gin.H{
 			"authenticated": false,
-			"message":       "No session token found",
+			"message":       message,
 		})
 		return
 	}
 
-	// Check if session exists and is valid
-	session, exists := Sessions[sessionToken]
-	if !exists {
+	user, err := s.Stores.Users.ByID(ctx, session.UserID)
+	if err != nil {
 		context.JSON(http.StatusUnauthorized, gin.H{
 			"authenticated": false,
-			"message":       "Invalid session token",
+			"message":       "Unknown user",
 		})
 		return
 	}
-
-	// Check if session has expired
-	if time.Now().After(session.expiryTime) {
-		// Clean up expired session
-		delete(Sessions, sessionToken)
+	if user.Disabled || user.Locked {
+		msg := "Account disabled"
+		if !user.Disabled {
+			msg = "Account locked"
+		}
 		context.JSON(http.StatusUnauthorized, gin.H{
 			"authenticated": false,
-			"message":       "Session expired",
+			"message":       msg,
 		})
 		return
 	}
@@ -79,9 +185,11 @@ func SessionCheckHandler(context *gin.Context) {
 	// Session is valid
 	context.JSON(http.StatusOK, gin.H{
 		"authenticated": true,
-		"username":      session.user.Username,
-		"email":         session.user.Email,
-		"userID":        session.user.UserID,
+		"username":      user.Username,
+		"email":         user.Email,
+		"emailVerified": user.EmailVerified,
+		"imageMetadata": user.ImageMetadata,
+		"userID":        user.UserID,
 		"message":       "User is authenticated",
 	})
 }
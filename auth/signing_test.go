@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"SCloud/config"
+	"SCloud/coord"
+	"SCloud/store"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	s := &Service{
+		Cfg: &config.Config{
+			MasterKey:             bytes.Repeat([]byte{7}, 32),
+			RequestSigningWindow:  5 * time.Minute,
+			RequestSigningMaxBody: 64,
+		},
+		Stores: store.NewMemoryStores(),
+		Claims: coord.NewLocal(),
+	}
+	key := &APIKey{ID: "k1", UserID: "u1", Signing: true}
+	if err := s.Stores.APIKeys.Create(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	secret := s.signingSecret(key.ID)
+
+	for _, tc := range []struct {
+		name      string
+		body      string
+		hashOf    string // body the header claims; "" is body itself
+		chunked   bool   // no Content-Length, so the body is spooled
+		age       time.Duration
+		badSig    bool
+		sendTwice bool
+		wantErr   error  // matched with errors.Is
+		wantText  string // or contained in the error
+	}{
+		{name: "good", body: "hello"},
+		{name: "good spooled", body: "hello", chunked: true},
+		{name: "empty body", body: ""},
+		{name: "replay", body: "hello", sendTwice: true, wantText: "already made"},
+		{name: "body mismatch", body: "hello", hashOf: "goodbye", wantErr: errBodyMismatch},
+		{name: "body mismatch spooled", body: "hello", hashOf: "goodbye", chunked: true, wantErr: errBodyMismatch},
+		{name: "too large", body: strings.Repeat("x", 65), wantErr: errBodyTooLarge},
+		{name: "too large spooled", body: strings.Repeat("x", 65), chunked: true, wantErr: errBodyTooLarge},
+		{name: "stale", body: "hello", age: 10 * time.Minute, wantText: "replay window"},
+		{name: "bad signature", body: "hello", badSig: true, wantText: "signature mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hashOf := tc.body
+			if tc.hashOf != "" {
+				hashOf = tc.hashOf
+			}
+			sum := sha256.Sum256([]byte(hashOf))
+			bodyHash := hex.EncodeToString(sum[:])
+			ts := strconv.FormatInt(time.Now().Add(-tc.age).Unix(), 10)
+			nonce := "nonce-" + tc.name
+			sig := requestSignature(secret, ts, nonce, "PUT", "/api/files/a.txt", bodyHash)
+			if tc.badSig {
+				sig = requestSignature("wrong", ts, nonce, "PUT", "/api/files/a.txt", bodyHash)
+			}
+
+			sends := 1
+			if tc.sendTwice {
+				sends = 2
+			}
+			var err error
+			for range sends {
+				r := httptest.NewRequest("PUT", "/api/files/a.txt", strings.NewReader(tc.body))
+				if tc.chunked {
+					r.ContentLength = -1
+				}
+				r.Header.Set(hdrKey, key.ID)
+				r.Header.Set(hdrTimestamp, ts)
+				r.Header.Set(hdrNonce, nonce)
+				r.Header.Set(hdrContentSHA256, bodyHash)
+
+				var spool *os.File
+				_, spool, err = s.verifySignature(r, sig)
+				if err == nil {
+					// the handler still gets the whole body
+					if got, _ := io.ReadAll(r.Body); string(got) != tc.body {
+						t.Errorf("body after check = %q, want %q", got, tc.body)
+					}
+				}
+				if spool != nil {
+					spool.Close()
+					os.Remove(spool.Name())
+				}
+			}
+
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err = %v, want %v", err, tc.wantErr)
+				}
+			case tc.wantText != "":
+				if err == nil || !strings.Contains(err.Error(), tc.wantText) {
+					t.Errorf("err = %v, want one mentioning %q", err, tc.wantText)
+				}
+			case err != nil:
+				t.Errorf("err = %v, want none", err)
+			}
+		})
+	}
+}
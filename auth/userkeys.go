@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"SCloud/storage"
+	"errors"
+)
+
+// Cfg.UserKeys (USER_KEYS) selects per-user file encryption:
+//
+//	""         off, every blob is encrypted under the master key
+//	"master"   per-user keys wrapped by the master key
+//	"password" per-user keys wrapped by a key derived from the account password;
+//	           the server can only unwrap while the user has logged in
+func (s *Service) userKeyMode() byte {
+	switch s.Cfg.UserKeys {
+	case "master":
+		return storage.WrapMaster
+	case "password":
+		return storage.WrapPassword
+	}
+	return 0
+}
+
+func (s *Service) UserKeysEnabled() bool { return s.userKeyMode() != 0 }
+
+// passwordWrapped reports whether userID's file key is wrapped by their
+// password, whatever USER_KEYS says now. A user without a key yet gets one
+// at their next sign-in, under whatever password they then have.
+func (s *Service) passwordWrapped(userID string) (bool, error) {
+	mode, err := storage.UserKeyMode(s.Cfg.BaseDir, userID)
+	if errors.Is(err, storage.ErrNoUserKey) {
+		return false, nil
+	}
+	return mode == storage.WrapPassword, err
+}
+
+var ErrKeyLocked = errors.New("user key is locked until the owner logs in")
+
+// KeyForUser returns userID's unwrapped file key.
+func (s *Service) KeyForUser(userID string) ([]byte, error) {
+	s.keysMu.RLock()
+	k, ok := s.keys[userID]
+	s.keysMu.RUnlock()
+	if ok {
+		return k, nil
+	}
+
+	mode, err := storage.UserKeyMode(s.Cfg.BaseDir, userID)
+	if err != nil {
+		return nil, err
+	}
+	if mode == storage.WrapPassword {
+		return nil, ErrKeyLocked
+	}
+	k, err = storage.UnlockUserKey(s.Cfg.MasterKey, s.Cfg.BaseDir, userID, "")
+	if err != nil {
+		return nil, err
+	}
+	s.cacheUserKey(userID, k)
+	return k, nil
+}
+
+// unlockUserKey unwraps (or lazily creates) the user's key at login. A new
+// key comes with recovery codes, returned for the user to keep.
+func (s *Service) unlockUserKey(user *User, password string) ([]string, error) {
+	mkey := s.Cfg.MasterKey
+	baseDir := s.Cfg.BaseDir
+
+	var codes []string
+	k, err := storage.UnlockUserKey(mkey, baseDir, user.UserID, password)
+	if errors.Is(err, storage.ErrNoUserKey) {
+		// new accounts, and those created before USER_KEYS was switched on
+		if k, err = storage.CreateUserKey(mkey, baseDir, user.UserID, password, s.userKeyMode()); err == nil {
+			codes, err = storage.CreateRecoveryCodes(baseDir, user.UserID, k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cacheUserKey(user.UserID, k)
+	return codes, nil
+}
+
+func (s *Service) cacheUserKey(userID string, k []byte) {
+	s.keysMu.Lock()
+	s.keys[userID] = k
+	s.keysMu.Unlock()
+}
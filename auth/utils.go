@@ -2,9 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"golang.org/x/crypto/bcrypt"
-	"time"
 )
 
 func hashPassword(password string) (string, error) {
@@ -23,6 +24,16 @@ func generateToken(length int) string {
 	return base64.URLEncoding.EncodeToString(arr)
 }
 
-func (s Session) IsExpired() bool {
-	return s.expiryTime.Before(time.Now())
+// hashToken is how session tokens are keyed server-side, so a leaked
+// sessions table cannot be replayed as cookies.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateID returns a random hex identifier, safe for filenames and URLs.
+func generateID() string {
+	arr := make([]byte, 16)
+	rand.Read(arr)
+	return hex.EncodeToString(arr)
 }
@@ -0,0 +1,223 @@
+package authz
+
+import (
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Org roles, strongest first.
+const (
+	RoleOwner  = "owner"  // manage members, delete org
+	RoleAdmin  = "admin"  // manage members
+	RoleMember = "member" // read/write files
+	RoleViewer = "viewer" // read-only
+)
+
+type Op int
+
+const (
+	Read Op = iota
+	Write
+	Share // mint links / grant access to others
+)
+
+// Subject is the caller as established by auth.Authorize and auth.OrgScope.
+type Subject struct {
+	UserID   string
+	Admin    bool
+	Org      string // "" = the shared tree
+	OrgRole  string
+	Prefixes []string // an API key's paths; nil = anywhere
+}
+
+// SubjectFrom reads the subject the auth middleware left on the request.
+func SubjectFrom(c *gin.Context) Subject {
+	return Subject{
+		UserID:   c.GetString("userid"),
+		Admin:    c.GetBool("admin"),
+		Org:      c.GetString("org"),
+		OrgRole:  c.GetString("orgrole"),
+		Prefixes: c.GetStringSlice("prefixes"),
+	}
+}
+
+// Authorizer decides what a subject may do to a logical path, combining
+// admin override, org roles, path ownership and shares.
+type Authorizer struct {
+	MasterKey []byte
+	Shares    store.ShareStore
+}
+
+func New(masterKey []byte, shares store.ShareStore) *Authorizer {
+	return &Authorizer{MasterKey: masterKey, Shares: shares}
+}
+
+func (a *Authorizer) CanRead(ctx context.Context, sub Subject, baseDir, logicalPath string) bool {
+	ok, _ := a.Check(ctx, sub, Read, baseDir, logicalPath)
+	return ok
+}
+
+func (a *Authorizer) CanWrite(ctx context.Context, sub Subject, baseDir, logicalPath string) bool {
+	ok, _ := a.Check(ctx, sub, Write, baseDir, logicalPath)
+	return ok
+}
+
+func (a *Authorizer) CanShare(ctx context.Context, sub Subject, baseDir, logicalPath string) bool {
+	ok, _ := a.Check(ctx, sub, Share, baseDir, logicalPath)
+	return ok
+}
+
+// Check reports whether sub may perform op on logicalPath under baseDir.
+//
+// In an org tree the caller's role decides (members who own a path may also
+// share it). In the shared tree owners may do anything, share grantees may
+// read, and unowned paths (written before ownership was recorded) stay open
+// to every signed-in user. Admins may do anything anywhere. An API key
+// limited to prefixes reaches nothing outside them, whoever holds it.
+func (a *Authorizer) Check(ctx context.Context, sub Subject, op Op, baseDir, logicalPath string) (bool, error) {
+	if sub.UserID == "" || !sub.within(logicalPath) {
+		return false, nil
+	}
+	if sub.Admin {
+		return true, nil
+	}
+	owner, err := storage.NearestOwner(a.MasterKey, baseDir, logicalPath)
+	if err != nil {
+		return false, err
+	}
+
+	if sub.Org != "" {
+		switch op {
+		case Read:
+			return sub.OrgRole != "", nil
+		case Write:
+			return sub.OrgRole == RoleOwner || sub.OrgRole == RoleAdmin || sub.OrgRole == RoleMember, nil
+		default:
+			return sub.OrgRole == RoleOwner || sub.OrgRole == RoleAdmin ||
+				(sub.OrgRole == RoleMember && owner == sub.UserID), nil
+		}
+	}
+
+	if owner == "" || owner == sub.UserID {
+		return true, nil
+	}
+	if op != Read {
+		return false, nil
+	}
+	shares, err := a.grants(ctx, sub.UserID)
+	if err != nil {
+		return false, err
+	}
+	return sharedWith(shares, owner, logicalPath), nil
+}
+
+// FilterReadable drops directory entries sub may not read. dirPath is the
+// listed directory; entries without an owner inherit the directory's.
+func (a *Authorizer) FilterReadable(ctx context.Context, sub Subject, baseDir, dirPath string, entries []storage.ManifestEntry) ([]storage.ManifestEntry, error) {
+	if len(sub.Prefixes) > 0 {
+		kept := make([]storage.ManifestEntry, 0, len(entries))
+		for _, e := range entries {
+			if sub.within(filepath.Join(dirPath, e.Name)) {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+	if sub.Admin || sub.Org != "" {
+		return entries, nil
+	}
+	dirOwner, err := storage.NearestOwner(a.MasterKey, baseDir, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := a.grants(ctx, sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]storage.ManifestEntry, 0, len(entries))
+	for _, e := range entries {
+		owner := e.Owner
+		if owner == "" {
+			owner = dirOwner
+		}
+		if owner == "" || owner == sub.UserID || sharedWith(shares, owner, filepath.Join(dirPath, e.Name)) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// ReadableVersion returns a token that changes whenever the shares
+// FilterReadable consults for sub do, for caching filtered listings; ""
+// when it filters nothing.
+func (a *Authorizer) ReadableVersion(ctx context.Context, sub Subject) (string, error) {
+	if sub.Admin || sub.Org != "" {
+		return "", nil
+	}
+	shares, err := a.grants(ctx, sub.UserID)
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, len(shares))
+	for i, sh := range shares {
+		ids[i] = fmt.Sprintf("%s|%d", sh.ID, sh.Expires.Unix())
+	}
+	slices.Sort(ids)
+	return strings.Join(ids, ";"), nil
+}
+
+// grants returns the live shares granted to userID in the shared tree.
+func (a *Authorizer) grants(ctx context.Context, userID string) ([]store.Share, error) {
+	if a.Shares == nil {
+		return nil, nil
+	}
+	all, err := a.Shares.ListForGrantee(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := all[:0]
+	for _, sh := range all {
+		if sh.Org == "" && (sh.Expires.IsZero() || sh.Expires.After(now)) {
+			live = append(live, sh)
+		}
+	}
+	return live, nil
+}
+
+// within reports whether logicalPath is one of sub's prefixes or under one.
+func (sub Subject) within(logicalPath string) bool {
+	if len(sub.Prefixes) == 0 {
+		return true
+	}
+	p := filepath.Clean(logicalPath)
+	for _, prefix := range sub.Prefixes {
+		if underPath(p, filepath.Clean(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func underPath(p, root string) bool {
+	return p == root || root == "." || strings.HasPrefix(p, root+string(filepath.Separator))
+}
+
+// sharedWith reports whether one of shares, granted by the path's current
+// owner, covers logicalPath.
+func sharedWith(shares []store.Share, owner, logicalPath string) bool {
+	p := filepath.Clean(logicalPath)
+	for _, sh := range shares {
+		if sh.OwnerID == owner && underPath(p, filepath.Clean(sh.Path)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package authz
+
+import (
+	"SCloud/storage"
+	"SCloud/store"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	mkey := bytes.Repeat([]byte{7}, 32)
+	baseDir := t.TempDir()
+	for _, d := range []struct{ path, owner string }{
+		{"alice/docs", "alice"},
+		{"bob/pub", "bob"},
+		{"bob/private", "bob"},
+		{"open", ""},
+	} {
+		if err := storage.MakeDir(mkey, baseDir, d.path, d.owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shares := store.NewMemoryStores().Shares
+	for _, sh := range []store.Share{
+		{ID: "live", OwnerID: "bob", GranteeID: "alice", Path: "bob/pub"},
+		{ID: "lapsed", OwnerID: "bob", GranteeID: "alice", Path: "bob/private", Expires: time.Now().Add(-time.Hour)},
+	} {
+		if err := shares.Create(ctx, &sh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := New(mkey, shares)
+
+	alice := Subject{UserID: "alice"}
+	for _, tc := range []struct {
+		name string
+		sub  Subject
+		op   Op
+		path string
+		want bool
+	}{
+		{"anonymous", Subject{}, Read, "open", false},
+		{"owner writes", alice, Write, "alice/docs/a.txt", true},
+		{"owner shares", alice, Share, "alice/docs", true},
+		{"stranger reads", Subject{UserID: "carol"}, Read, "bob/pub", false},
+		{"grantee reads", alice, Read, "bob/pub/a.txt", true},
+		{"grantee writes", alice, Write, "bob/pub/a.txt", false},
+		{"lapsed share", alice, Read, "bob/private", false},
+		{"unowned", Subject{UserID: "carol"}, Write, "open/a.txt", true},
+		{"admin", Subject{UserID: "root", Admin: true}, Write, "bob/private", true},
+		{"inside prefix", Subject{UserID: "alice", Prefixes: []string{"alice/docs"}}, Read, "alice/docs/a.txt", true},
+		{"outside prefix", Subject{UserID: "alice", Prefixes: []string{"alice/docs"}}, Read, "alice/other", false},
+		{"admin outside prefix", Subject{UserID: "root", Admin: true, Prefixes: []string{"open"}}, Read, "bob", false},
+		{"org viewer reads", Subject{UserID: "carol", Org: "o", OrgRole: RoleViewer}, Read, "bob/private", true},
+		{"org viewer writes", Subject{UserID: "carol", Org: "o", OrgRole: RoleViewer}, Write, "bob/private", false},
+		{"org member writes", Subject{UserID: "carol", Org: "o", OrgRole: RoleMember}, Write, "bob/private", true},
+		{"org member shares another's", Subject{UserID: "carol", Org: "o", OrgRole: RoleMember}, Share, "bob/private", false},
+		{"org member shares own", Subject{UserID: "bob", Org: "o", OrgRole: RoleMember}, Share, "bob/private", true},
+		{"org admin shares", Subject{UserID: "carol", Org: "o", OrgRole: RoleAdmin}, Share, "bob/private", true},
+		{"not in org", Subject{UserID: "carol", Org: "o"}, Read, "open", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := a.Check(ctx, tc.sub, tc.op, baseDir, tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("Check(%+v, %d, %q) = %v, want %v", tc.sub, tc.op, tc.path, got, tc.want)
+			}
+		})
+	}
+}
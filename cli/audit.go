@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"SCloud/audit"
+	"SCloud/config"
+	"SCloud/server"
+	"context"
+	"errors"
+	"fmt"
+)
+
+func runVerifyAudit(cfg *config.Config, args []string) error {
+	fs := newFlags("verify-audit")
+	anchors := map[int64]string{}
+	fs.Func("anchor", "seq:mac of an audit.anchor event as exported or logged; repeatable", func(v string) error {
+		seq, mac, err := audit.ParseAnchor(v)
+		anchors[seq] = mac
+		return err
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cfg.StoreBackend == "" || cfg.StoreBackend == "memory" {
+		return fmt.Errorf("the memory backend keeps no audit log between runs; set STORE_BACKEND")
+	}
+	stores, _, closers, err := server.OpenStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, c := range closers {
+			c()
+		}
+	}()
+	report, err := audit.Verify(context.Background(), stores.Audit, audit.Key(cfg), anchors)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return errors.New("the audit log has been tampered with")
+	}
+	return nil
+}
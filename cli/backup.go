@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"SCloud/config"
+	"SCloud/storage"
+	"fmt"
+)
+
+func backupStore(cfg *config.Config, dir string) (storage.BlobStore, error) {
+	if dir == "" {
+		dir = cfg.BackupDir
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("set BACKUP_DIR or pass --dir")
+	}
+	return storage.DirBlobStore{Root: dir}, nil
+}
+
+func runBackup(cfg *config.Config, args []string) error {
+	fs := newFlags("backup")
+	dir := fs.String("dir", "", "backup location (default $BACKUP_DIR)")
+	full := fs.Bool("full", false, "hash and copy every file instead of building on the latest point")
+	list := fs.Bool("list", false, "list restore points and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dst, err := backupStore(cfg, *dir)
+	if err != nil {
+		return err
+	}
+	if *list {
+		points, err := storage.ListRestorePoints(cfg.MasterKey, dst)
+		if err != nil {
+			return err
+		}
+		return printJSON(points)
+	}
+
+	rp, err := storage.Backup(cfg.MasterKey, cfg.BaseDir, dst, *full, nil)
+	if perr := printJSON(rp); perr != nil && err == nil {
+		err = perr
+	}
+	if err == nil && len(rp.Failures) > 0 {
+		err = fmt.Errorf("%d files failed", len(rp.Failures))
+	}
+	return err
+}
+
+func runRestore(cfg *config.Config, args []string) error {
+	fs := newFlags("restore")
+	dir := fs.String("dir", "", "backup location (default $BACKUP_DIR)")
+	point := fs.String("point", "", "restore point ID, from `sc backup --list`")
+	dest := fs.String("dest", "", "base dir to restore into (default the configured one)")
+	force := fs.Bool("force", false, "overwrite a store that already exists at dest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *point == "" {
+		return fmt.Errorf("--point is required")
+	}
+	src, err := backupStore(cfg, *dir)
+	if err != nil {
+		return err
+	}
+	if *dest == "" {
+		*dest = cfg.BaseDir
+	}
+
+	rp, err := storage.Restore(cfg.MasterKey, src, *point, *dest, *force, nil)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(rp); err != nil {
+		return err
+	}
+	if len(rp.Failures) > 0 {
+		return fmt.Errorf("%d files failed", len(rp.Failures))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"SCloud/config"
+	"SCloud/storage"
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runExport(cfg *config.Config, args []string) error {
+	fs := newFlags("export")
+	dest := fs.String("dest", "", `local directory to write into, or "-" for a tar stream on stdout`)
+	prefix := fs.String("prefix", "", "only export this logical directory")
+	org := fs.String("org", "", "export this org's tree instead of the shared one")
+	root := fs.String("root", "", "export this named storage root instead of the shared one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dest == "" {
+		return fmt.Errorf("--dest is required")
+	}
+	baseDir, err := baseDirFor(cfg, *org, *root)
+	if err != nil {
+		return err
+	}
+
+	var sink storage.ExportSink
+	var tw *tar.Writer
+	out := os.Stdout
+	if *dest == "-" {
+		// the archive owns stdout; the report goes to stderr
+		tw = tar.NewWriter(os.Stdout)
+		sink = tarSink{tw}
+		out = os.Stderr
+	} else {
+		if err := os.MkdirAll(*dest, 0755); err != nil {
+			return err
+		}
+		sink = dirSink{root: *dest}
+	}
+
+	report, err := storage.ExportTree(cfg.MasterKey, baseDir, *prefix, offlineKeys(cfg), sink, nil)
+	if tw != nil {
+		if cerr := tw.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if perr := writeJSON(out, report); perr != nil && err == nil {
+		err = perr
+	}
+	if err == nil && len(report.Failures) > 0 {
+		err = fmt.Errorf("%d files failed", len(report.Failures))
+	}
+	return err
+}
+
+// offlineKeys resolves blob keys from the master key alone. Keys wrapped by
+// a user's password cannot be opened offline; those files are reported as
+// failures.
+func offlineKeys(cfg *config.Config) storage.KeyFunc {
+	cache := map[string][]byte{}
+	return func(e *storage.ManifestEntry) ([]byte, error) {
+		if e.KeyOwner == "" {
+			return cfg.MasterKey, nil
+		}
+		if k, ok := cache[e.KeyOwner]; ok {
+			return k, nil
+		}
+		k, err := storage.UnlockUserKey(cfg.MasterKey, cfg.BaseDir, e.KeyOwner, "")
+		if err != nil {
+			return nil, fmt.Errorf("key of user %s: %w", e.KeyOwner, err)
+		}
+		cache[e.KeyOwner] = k
+		return k, nil
+	}
+}
+
+// dirSink mirrors the tree under root. Files already there with the same
+// size and mtime are left alone, so a broken-off export can be re-run.
+type dirSink struct{ root string }
+
+func (d dirSink) Write(f storage.ExportFile) (bool, error) {
+	dst := filepath.Join(d.root, filepath.FromSlash(f.Path))
+	if rel, err := filepath.Rel(d.root, dst); err != nil || strings.HasPrefix(rel, "..") {
+		return false, fmt.Errorf("refusing to write outside %s", d.root)
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.Size() == f.Size && fi.ModTime().Equal(f.ModTime) {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+
+	tmp := dst + ".export.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, f.Body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := os.Chtimes(tmp, f.ModTime, f.ModTime); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return false, os.Rename(tmp, dst)
+}
+
+type tarSink struct{ tw *tar.Writer }
+
+func (t tarSink) Write(f storage.ExportFile) (bool, error) {
+	if err := t.tw.WriteHeader(&tar.Header{
+		Name:    f.Path,
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: f.ModTime,
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return false, err
+	}
+	n, err := io.Copy(t.tw, f.Body)
+	if err != nil {
+		// keep the archive readable: pad the entry to its declared size
+		_, _ = io.CopyN(t.tw, zeros{}, f.Size-n)
+		return false, err
+	}
+	return false, nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
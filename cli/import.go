@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"SCloud/config"
+	"SCloud/storage"
+	"fmt"
+	"os"
+)
+
+func runImport(cfg *config.Config, args []string) error {
+	fs := newFlags("import")
+	src := fs.String("src", "", "local directory to import")
+	dest := fs.String("dest", "", "logical path prefix to import into")
+	org := fs.String("org", "", "import into this org's tree instead of the shared one")
+	root := fs.String("root", "", "import into this named storage root instead of the shared one")
+	owner := fs.String("owner", "", "user id recorded as owner of the imported files")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *src == "" {
+		return fmt.Errorf("--src is required")
+	}
+	if fi, err := os.Stat(*src); err != nil || !fi.IsDir() {
+		return fmt.Errorf("--src %q is not a directory", *src)
+	}
+	baseDir, err := baseDirFor(cfg, *org, *root)
+	if err != nil {
+		return err
+	}
+
+	report, err := storage.ImportTree(cfg.MasterKey, baseDir, *src, *dest, storage.ImportOptions{
+		DryRun: *dryRun,
+		Owner:  *owner,
+	})
+	if perr := printJSON(report); perr != nil && err == nil {
+		err = perr
+	}
+	if err == nil && len(report.Failures) > 0 {
+		err = fmt.Errorf("%d files failed", len(report.Failures))
+	}
+	return err
+}
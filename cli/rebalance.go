@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"SCloud/config"
+	"SCloud/storage"
+	"fmt"
+)
+
+func runRebalance(cfg *config.Config, args []string) error {
+	fs := newFlags("rebalance")
+	from := fs.String("from", "", `move every blob off this volume ("local" for the store itself)`)
+	to := fs.String("to", "", "move blobs onto this volume (default: by PLACEMENT)")
+	org := fs.String("org", "", "rebalance this org's tree instead of the shared one")
+	root := fs.String("root", "", "rebalance this named storage root instead of the shared one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	baseDir, err := baseDirFor(cfg, *org, *root)
+	if err != nil {
+		return err
+	}
+	report, err := storage.Rebalance(cfg.MasterKey, baseDir, storage.RebalancePlan{From: *from, To: *to}, nil)
+	if perr := printJSON(report); perr != nil && err == nil {
+		err = perr
+	}
+	if err == nil && len(report.Failures) > 0 {
+		err = fmt.Errorf("%d files failed", len(report.Failures))
+	}
+	return err
+}
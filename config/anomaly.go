@@ -0,0 +1,84 @@
+package config
+
+import (
+	"SCloud/events"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anomaly actions beyond the alert every detection raises.
+const (
+	AnomalyReauth = "reauth"
+	AnomalyLock   = "lock"
+)
+
+func loadAnomaly(cfg *Config) error {
+	for _, c := range []struct {
+		env string
+		dst *int
+	}{{"ANOMALY_AUTH_FAILURES", &cfg.AnomalyAuthFailures}, {"ANOMALY_DOWNLOADS", &cfg.AnomalyDownloads}} {
+		if v := os.Getenv(c.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s: want a count, got %q", c.env, v)
+			}
+			*c.dst = n
+		}
+	}
+	if v := os.Getenv("ANOMALY_DOWNLOAD_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("ANOMALY_DOWNLOAD_BYTES: want a byte count, got %q", v)
+		}
+		cfg.AnomalyDownloadBytes = n
+	}
+	for _, c := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"ANOMALY_AUTH_WINDOW", &cfg.AnomalyAuthWindow},
+		{"ANOMALY_DOWNLOAD_WINDOW", &cfg.AnomalyDownloadWindow},
+		{"ANOMALY_TRAVEL_WINDOW", &cfg.AnomalyTravelWindow},
+	} {
+		if v := os.Getenv(c.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("%s: want a duration, got %q", c.env, v)
+			}
+			*c.dst = d
+		}
+	}
+	for _, c := range []struct {
+		env      string
+		dst      *int
+		maxValue int
+	}{{"ANOMALY_TRAVEL_IPV4_PREFIX", &cfg.AnomalyTravelIPv4Prefix, 32}, {"ANOMALY_TRAVEL_IPV6_PREFIX", &cfg.AnomalyTravelIPv6Prefix, 128}} {
+		if v := os.Getenv(c.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > c.maxValue {
+				return fmt.Errorf("%s: want 0-%d, got %q", c.env, c.maxValue, v)
+			}
+			*c.dst = n
+		}
+	}
+
+	cfg.AnomalyActions = map[events.Type]string{}
+	for _, item := range splitList(os.Getenv("ANOMALY_ACTIONS")) {
+		kind, action, _ := strings.Cut(item, "=")
+		t := events.Type("anomaly." + strings.TrimSpace(kind))
+		if !t.Alert() {
+			return fmt.Errorf("ANOMALY_ACTIONS: want travel, downloads or auth_failures, got %q", kind)
+		}
+		switch action = strings.TrimSpace(action); action {
+		case "alert":
+		case AnomalyReauth, AnomalyLock:
+			cfg.AnomalyActions[t] = action
+		default:
+			return fmt.Errorf("ANOMALY_ACTIONS: want alert, reauth or lock for %s, got %q", kind, action)
+		}
+	}
+	return nil
+}
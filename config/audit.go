@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// minAuditKeyLen is the shortest AUDIT_KEY accepted.
+const minAuditKeyLen = 16
+
+// AuditS3 is where AUDIT_S3 puts the exported audit log: one object per
+// batch under Prefix in Bucket, addressed path-style on Endpoint.
+type AuditS3 struct {
+	Bucket    string
+	Prefix    string
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+func loadAudit(cfg *Config) error {
+	key, err := secretEnv("AUDIT_KEY")
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		if len(key) < minAuditKeyLen {
+			return fmt.Errorf("AUDIT_KEY must be at least %d bytes", minAuditKeyLen)
+		}
+		cfg.AuditKey = []byte(key)
+	}
+
+	cfg.AuditExportInterval = 10 * time.Second
+	if v := os.Getenv("AUDIT_EXPORT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("AUDIT_EXPORT_INTERVAL: want a duration, got %q", v)
+		}
+		cfg.AuditExportInterval = d
+	}
+
+	if v := os.Getenv("AUDIT_SYSLOG"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "udp" && u.Scheme != "tcp" || u.Port() == "" {
+			return fmt.Errorf("AUDIT_SYSLOG: want udp://host:port or tcp://host:port, got %q", v)
+		}
+		cfg.AuditSyslog = v
+	}
+
+	if v := os.Getenv("AUDIT_S3"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Scheme != "s3" || u.Host == "" {
+			return fmt.Errorf("AUDIT_S3: want s3://bucket/prefix, got %q", v)
+		}
+		s3 := &AuditS3{
+			Bucket:   u.Host,
+			Prefix:   strings.Trim(u.Path, "/"),
+			Endpoint: strings.TrimSuffix(os.Getenv("AUDIT_S3_ENDPOINT"), "/"),
+			Region:   os.Getenv("AUDIT_S3_REGION"),
+		}
+		if s3.AccessKey, err = secretEnv("AUDIT_S3_ACCESS_KEY"); err != nil {
+			return err
+		}
+		if s3.SecretKey, err = secretEnv("AUDIT_S3_SECRET_KEY"); err != nil {
+			return err
+		}
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		if s3.Endpoint == "" {
+			s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+		}
+		if s3.AccessKey == "" {
+			if s3.AccessKey, err = secretEnv("AWS_ACCESS_KEY_ID"); err != nil {
+				return err
+			}
+			if s3.SecretKey, err = secretEnv("AWS_SECRET_ACCESS_KEY"); err != nil {
+				return err
+			}
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			return fmt.Errorf("AUDIT_S3 needs AUDIT_S3_ACCESS_KEY and AUDIT_S3_SECRET_KEY")
+		}
+		if e, err := url.Parse(s3.Endpoint); err != nil || e.Scheme != "https" && e.Scheme != "http" || e.Host == "" {
+			return fmt.Errorf("AUDIT_S3_ENDPOINT: want an http(s) URL, got %q", s3.Endpoint)
+		}
+		cfg.AuditS3 = s3
+	}
+
+	cfg.AuditHECURL = os.Getenv("AUDIT_HEC_URL")
+	if cfg.AuditHECToken, err = cfg.secret("AUDIT_HEC_TOKEN"); err != nil {
+		return err
+	}
+	if cfg.AuditHECURL != "" {
+		u, err := url.Parse(cfg.AuditHECURL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("AUDIT_HEC_URL: want an http(s) URL, got %q", cfg.AuditHECURL)
+		}
+		if cfg.AuditHECToken.Value() == "" {
+			return fmt.Errorf("AUDIT_HEC_URL needs AUDIT_HEC_TOKEN")
+		}
+	}
+	return nil
+}
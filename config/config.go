@@ -1,12 +1,460 @@
 package config
 
-import "os"
+import (
+	"SCloud/events"
+	"SCloud/i18n"
+	"SCloud/saml"
+	"SCloud/schedule"
+	"SCloud/uploadfilter"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
+	// BASE_DIR: the main store (default: the working directory). Absolute.
 	BaseDir string
+	// STORAGE_ROOTS: further named stores, name=path, comma-separated, e.g.
+	// one per mount point. Requests pick one with ?root=name.
+	Roots map[string]string
+	// VOLUMES: extra disks for file blobs, name=path, comma-separated; the
+	// manifests stay in the store. PLACEMENT picks the disk of each new
+	// file: most-free (default) or round-robin, with the store itself as
+	// one candidate named "local". VOLUME_PINS, userID=volume, overrides it
+	// per user.
+	Volumes    map[string]string
+	Placement  string
+	VolumePins map[string]string
+
 	FileKey []byte
 	Port    string
+
+	// from FILEMASTERKEY or FILEMASTERPASSPHRASE (see loadMasterKey)
+	MasterKey []byte
+	// earlier master keys, still accepted for reading (FILEMASTERKEY_RETIRED,
+	// comma-separated, same formats as FILEMASTERKEY)
+	RetiredMasterKeys [][]byte
+	// link-signing keys, newest first. SIGN_KEYS is a comma-separated list of
+	// id=secret, with "@<RFC3339>" appended to mark when a key was retired.
+	// The first live key signs; retired ones verify until SignKeyGrace passes.
+	// A bare SIGN_SECRET is treated as the single key "0".
+	SignKeys     []SignKey
+	SignKeyGrace time.Duration
+
+	// Secret settings (the master and signing keys, AUDIT_KEY, DATABASE_URL,
+	// DB_PASSWORD, SMTP_PASSWORD, SCIM_TOKEN and the audit sinks'
+	// credentials) may be file://, env:// or vault:// references (see
+	// secrets.go). The ones held as a *Secret are read again every
+	// SECRET_RELOAD_INTERVAL (default 1m, 0 = never); the keys files, links
+	// and the audit chain are sealed with are only read at start.
+	SecretReloadInterval time.Duration
+	secrets              []*Secret
+
+	// per-user file keys: "", "master" or "password" (see auth.Service)
+	UserKeys string
+	// accounts granted admin at registration
+	AdminEmails []string
+
+	// APP_ENV=development relaxes browser-facing defaults for local work
+	Dev bool
+	// CORS_ORIGINS, comma-separated; wildcards like https://*.example.com work
+	CORSOrigins []string
+	// COOKIE_DOMAIN; shared by the frontend and API hosts so the frontend can
+	// read csrf_token. Host-only in Dev.
+	CookieDomain string
+	// COOKIE_SECURE; on unless Dev
+	CookieSecure bool
+	// COOKIE_SAMESITE: lax (default), strict or none
+	CookieSameSite http.SameSite
+
+	// TRUSTED_PROXIES: CIDRs or IPs whose X-Forwarded-For / X-Real-IP headers
+	// are believed. Empty trusts no one and uses the socket address.
+	TrustedProxies []string
+	// REMOTE_IP_HEADERS, checked in order on requests from a trusted proxy
+	RemoteIPHeaders []string
+
+	// sessions end SessionMaxAge after login, or after SessionIdleTimeout
+	// without a request (0 disables the idle check)
+	SessionMaxAge      time.Duration
+	SessionIdleTimeout time.Duration
+	// CSRF_ROTATE=request issues a new CSRF token after every state-changing
+	// request; the default keeps one token per session
+	CSRFRotatePerRequest bool
+	// SESSION_BIND: ip and/or user_agent, comma-separated. A session used
+	// from outside the address block it was signed in from
+	// (SESSION_BIND_IPV4_PREFIX, default 24; SESSION_BIND_IPV6_PREFIX,
+	// default 64) or by another user agent is ended, or with
+	// SESSION_BIND_MODE=reauth held until the password is given again at
+	// /api/auth/reauth.
+	SessionBindIP         bool
+	SessionBindUserAgent  bool
+	SessionBindIPv4Prefix int
+	SessionBindIPv6Prefix int
+	SessionBindReauth     bool
+	// DEVICE_APPROVAL=true turns away sign-ins from a device the user has not
+	// used before until one of their trusted devices approves it. The first
+	// device of an account is trusted on sight.
+	DeviceApproval bool
+	// signed requests (see auth.VerifySignature) are accepted this far
+	// either side of their timestamp, and each only once within it
+	// (REQUEST_SIGNING_WINDOW, default 5m). Their bodies are checked
+	// before the handler runs, and refused beyond REQUEST_SIGNING_MAX_BODY
+	// bytes (default 1 GiB).
+	RequestSigningWindow  time.Duration
+	RequestSigningMaxBody int64
+
+	// SAML single sign-on, on when SAML_IDP_METADATA names the IdP's
+	// metadata file, or SAML_IDP_ENTITY_ID, SAML_IDP_SSO_URL and
+	// SAML_IDP_CERT (a PEM file) describe the IdP. SAML_SP_ENTITY_ID
+	// defaults to the SP's metadata URL. Not available with
+	// USER_KEYS=password: there is no password to unlock file keys with.
+	SAML *saml.SP
+	// SAML_ATTR_EMAIL, SAML_ATTR_NAME and SAML_ATTR_GROUPS name the
+	// attributes a user's email, display name and groups are read from.
+	// Without SAML_ATTR_EMAIL an email NameID is used, else "email" or
+	// "mail"; groups default to "groups".
+	SAMLAttrEmail  string
+	SAMLAttrName   string
+	SAMLAttrGroups string
+	// SAML_ADMIN_GROUPS: members of these groups are made admins at sign-in
+	// and everyone else signing in by SAML loses admin. Empty leaves admin
+	// as it is.
+	SAMLAdminGroups []string
+	// SAML_ORG_ROLES: group=org:role, comma-separated; members of group are
+	// given role in org at each sign-in, and lose it at a sign-in without
+	// any group that maps to it (owners are left alone)
+	SAMLOrgRoles []SAMLOrgRole
+	// SAML_JIT=true creates accounts for users the IdP vouches for that this
+	// server has not seen; otherwise only existing accounts can sign in
+	SAMLJIT bool
+	// SAML_IDP_INITIATED=true accepts responses the IdP sends unasked, as
+	// when a user starts from the IdP's app portal
+	SAMLIdPInitiated bool
+	// SCIM_TOKEN: the bearer token identity providers provision accounts
+	// and orgs with on /scim/v2; unset turns SCIM off
+	SCIMToken *Secret
+
+	// PUBLIC_URL: where the API is reached from outside; links in download
+	// URLs and mail are built on it
+	PublicURL string
+	// APP_URL: the web app, for links in mail that open one of its pages
+	AppURL string
+	// outgoing mail. Without SMTP_HOST messages are only logged.
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUser     string
+	SMTPPassword *Secret
+	MailFrom     string
+
+	// usage alerts fire once per threshold crossed, in percent:
+	// QUOTA_ALERTS of an org's quota, DISK_ALERTS of the disk holding
+	// BaseDir (checked every DiskCheckInterval). Both are comma lists.
+	QuotaAlerts       []int
+	DiskAlerts        []int
+	DiskCheckInterval time.Duration
+	// ALERT_WEBHOOK: URL each alert event is POSTed to as JSON
+	AlertWebhook string
+
+	// anomaly detection alerts (audit log, event bus, ALERT_WEBHOOK and
+	// admin mail) on ANOMALY_AUTH_FAILURES 401s from one address or against
+	// one account within ANOMALY_AUTH_WINDOW; on a user downloading
+	// ANOMALY_DOWNLOADS files or ANOMALY_DOWNLOAD_BYTES within
+	// ANOMALY_DOWNLOAD_WINDOW; and on sign-ins to one account from two
+	// public networks (ANOMALY_TRAVEL_IPV4_PREFIX, default 16;
+	// ANOMALY_TRAVEL_IPV6_PREFIX, default 32) within ANOMALY_TRAVEL_WINDOW.
+	// A threshold or window of 0 turns that check off.
+	AnomalyAuthFailures     int
+	AnomalyAuthWindow       time.Duration
+	AnomalyDownloads        int
+	AnomalyDownloadBytes    int64
+	AnomalyDownloadWindow   time.Duration
+	AnomalyTravelWindow     time.Duration
+	AnomalyTravelIPv4Prefix int
+	AnomalyTravelIPv6Prefix int
+	// ANOMALY_ACTIONS: kind=action, comma-separated, with kind travel,
+	// downloads or auth_failures. reauth holds the account's sessions until
+	// the password is given again at /api/auth/reauth; lock locks the
+	// account until an admin unlocks it, except for auth_failures, where it
+	// refuses passwords from the address for ANOMALY_AUTH_WINDOW: for the
+	// account, or for any account after failures against many. Kinds not
+	// listed only alert.
+	AnomalyActions map[events.Type]string
+
+	// AUDIT_KEY keys the MACs chaining each audit event to the one before
+	// (default: derived from the master key); `sc verify-audit` checks the
+	// chain. A host that holds the key can rewrite the chain, so the
+	// audit_anchor task records its head, and every event is exported off
+	// the host every AUDIT_EXPORT_INTERVAL (default 10s) to AUDIT_SYSLOG
+	// (udp:// or tcp://host:port, RFC 5424), AUDIT_S3 (s3://bucket/prefix,
+	// one object per batch; AUDIT_S3_ENDPOINT, AUDIT_S3_REGION,
+	// AUDIT_S3_ACCESS_KEY and AUDIT_S3_SECRET_KEY, falling back to the AWS_*
+	// variables) and AUDIT_HEC_URL, a Splunk HTTP Event Collector taking
+	// AUDIT_HEC_TOKEN.
+	AuditKey            []byte
+	AuditExportInterval time.Duration
+	AuditSyslog         string
+	AuditS3             *AuditS3
+	AuditHECURL         string
+	AuditHECToken       *Secret
+
+	// per-user metering: stored bytes are sampled every UsageSampleInterval;
+	// USAGE_WEBHOOK receives every batch of counters as JSON
+	UsageSampleInterval time.Duration
+	UsageWebhook        string
+
+	// outbound connections: webhooks, the audit sinks, the extraction and
+	// preview services and SMTP. EGRESS_PROXY is an http://, https:// or
+	// socks5:// proxy URL (credentials in it are used), or none; unset, HTTP
+	// requests follow HTTP_PROXY and friends and the rest connect directly.
+	// EGRESS_NO_PROXY lists hosts reached directly: names, which cover their
+	// subdomains, IPs, CIDRs or *. EGRESS_CA_BUNDLE is a PEM file of CAs
+	// trusted besides the system's. EGRESS_CONNECT_TIMEOUT (default 10s)
+	// bounds connecting and the TLS handshake, EGRESS_RESPONSE_TIMEOUT
+	// (default none) the wait for a reply to a sent request; each
+	// integration keeps its own overall limit. A request that fails to
+	// connect or gets 502, 503 or 504 is sent again up to EGRESS_RETRIES
+	// times (default 2) when its body can be replayed.
+	EgressProxy           string
+	EgressNoProxy         []string
+	EgressCAs             *x509.CertPool // nil: the system's
+	EgressConnectTimeout  time.Duration
+	EgressResponseTimeout time.Duration
+	EgressRetries         int
+
+	// LISTEN_ADDR: where the API is served, comma-separated host:port
+	// (default 0.0.0.0:8443). METRICS_ADDR serves Prometheus metrics at
+	// /metrics without authentication, and ADMIN_ADDR everything including
+	// the admin API, which LISTEN_ADDR then no longer serves; bind both to
+	// loopback or a management network. Any of them may instead be
+	// systemd:<name>, the sockets systemd passed under that
+	// FileDescriptorName= (socket activation, LISTEN_FDS).
+	ListenAddrs  []string
+	MetricsAddrs []string
+	AdminAddrs   []string
+	// client connections: HTTP_READ_HEADER_TIMEOUT (default 10s) to send a
+	// request's headers, HTTP_IDLE_TIMEOUT (default 2m) kept alive between
+	// requests, HTTP_MAX_HEADER_BYTES (default 1MiB). HTTP_MAX_CONNS and
+	// HTTP_MAX_CONNS_PER_IP (by socket address) cap the API's open
+	// connections, HTTP_MAX_REQUESTS_PER_CONN the requests one serves
+	// (0 = no limit). HTTP_MIN_RATE, in bytes a second (0 = off), cuts a
+	// client that sends a body or takes a response slower than that once it
+	// is HTTP_MIN_RATE_GRACE (default 30s) behind, however fast it was
+	// before; only the time the server spends waiting on it counts. A
+	// paused video player is cut too, and resumes with a range request.
+	HTTPReadHeaderTimeout  time.Duration
+	HTTPIdleTimeout        time.Duration
+	HTTPMaxHeaderBytes     int
+	HTTPMaxConns           int
+	HTTPMaxConnsPerIP      int
+	HTTPMaxRequestsPerConn int
+	HTTPMinRate            int64
+	HTTPMinRateGrace       time.Duration
+	// CONCURRENCY_LIMITS: how many uploads and downloads (each encrypting or
+	// decrypting) run at once, as class=count, e.g. upload=8,download=32;
+	// unset or 0 is no limit. One over the limit waits up to
+	// CONCURRENCY_QUEUE_WAIT (default 5s) for its turn, then gets 503 with
+	// Retry-After. Renditions, hashes, GraphQL and SFTP/FTP reads count as
+	// downloads. A request holding a slot must send its body at an average
+	// CONCURRENCY_MIN_RATE bytes a second (default 16384, 0 = any) once 10s
+	// have passed, or is cut off.
+	ConcurrencyLimits    map[string]int
+	ConcurrencyQueueWait time.Duration
+	ConcurrencyMinRate   int64
+	// DEBUG_ADDR: a loopback host:port serving pprof, expvar and Prometheus
+	// metrics (/debug/metrics) without authentication; admins also reach
+	// them under /api/admin/debug/
+	DebugAddr string
+	// METRICS_TOP_USERS: how many users get their own label in the per-user
+	// transfer metrics (default 20); the server-wide totals cover the rest
+	MetricsTopUsers int
+
+	// SFTP_ADDR: host:port of an SFTP listener (off when empty). Users sign
+	// in with their email and password and see the main store.
+	// SFTP_HOST_KEY is the server's key, created there on first start
+	// (default: sftp_host_key in BaseDir).
+	SFTPAddr    string
+	SFTPHostKey string
+
+	// FTP_ADDR: host:port of an FTP listener for devices that only speak
+	// FTP (off when empty). FTP_TLS_CERT and FTP_TLS_KEY enable AUTH TLS,
+	// which is then required unless FTP_PLAIN=true; without them FTP_PLAIN
+	// must be set. Each user is confined to FTP_CHROOT in the main store
+	// ({id}, {email} and {username} are filled in; default home/{id}; "/"
+	// for the whole store).
+	// FTP_PASSIVE_PORTS (e.g. 30000-30099) and FTP_PUBLIC_IP shape PASV
+	// replies for firewalls and NAT.
+	FTPAddr         string
+	FTPTLSCert      string
+	FTPTLSKey       string
+	FTPPlain        bool
+	FTPChroot       string
+	FTPPassivePorts [2]int
+	FTPPublicIP     net.IP
+
+	// scratch space for uploads. UPLOAD_TMP_DIR holds multipart bodies too
+	// big for UPLOAD_MEMORY (it becomes TMPDIR); UPLOAD_STAGING_DIR holds
+	// chunked uploads until they are assembled. Empty keeps the defaults:
+	// the system temp dir, and _uploads inside each storage root.
+	UploadTempDir    string
+	UploadStagingDir string
+	UploadMemory     int64
+
+	// UPLOAD_STAGING_MAX_AGE is how long an unfinished chunked upload keeps
+	// its staged chunks before the sweep reclaims them (default 24h).
+	// Admins can override it per user.
+	UploadStagingMaxAge time.Duration
+
+	// MAX_DIR_ENTRIES, MAX_USER_FILES, MAX_PATH_DEPTH and MAX_NAME_LENGTH
+	// bound new entries: per folder, per user and tree, folders deep, and
+	// bytes per name. 0 = no limit; names default to 255 bytes and paths to
+	// 64 deep.
+	MaxDirEntries int
+	MaxUserFiles  int
+	MaxPathDepth  int
+	MaxNameLength int
+
+	// NAME_CASE=insensitive makes names that differ only in case the same
+	// file or folder, as Windows and macOS clients expect; the default is
+	// sensitive. Names are matched in Unicode NFC either way.
+	CaseInsensitiveNames bool
+
+	// Error messages are translated for the client's Accept-Language from
+	// the built-in catalogs (de, es, fr) and any <lang>.json in I18N_DIR,
+	// which add to or override them.
+	Messages *i18n.Catalogs
+
+	// UPLOAD_FILTERS lists the filters every upload passes, in order, as
+	// name or name:arg (maxsize:1073741824). Filters register themselves
+	// with uploadfilter.Register; an unknown name fails startup. Built in
+	// are maxsize and filetype:<policy.json>, which refuses file types with
+	// 415 by allow and deny lists of extensions and media types, for
+	// everyone and per org and user (see uploadfilter.TypePolicy).
+	UploadFilters uploadfilter.Chain
+
+	// how often expired files/dirs are purged
+	ExpirySweepInterval time.Duration
+
+	// LINK_ACCESS_RETENTION is how long downloads through signed links stay
+	// in their owners' access logs (default 90 days; 0 keeps them forever)
+	LinkAccessRetention time.Duration
+
+	// ABUSE_REPORT_THRESHOLD suspends a signed link once this many
+	// different networks (/24, or /48 for IPv6) have open abuse reports
+	// against it; the file is left to an admin (0, the default, leaves
+	// every report to an admin)
+	AbuseReportThreshold int
+
+	// CONTENT_INDEX=true indexes the text of uploaded files for
+	// /api/files/searchcontent. Each user's index is kept encrypted under
+	// their key (the master key without per-user keys).
+	ContentIndex bool
+	// EXTRACT_URL: a text extraction service (e.g. Apache Tika's /tika, with
+	// Tesseract for OCR) uploaded images and PDFs are sent to from a
+	// background job. The text feeds the content index and the file's
+	// "text" meta field. EXTRACT_TIMEOUT bounds each document (default 2m).
+	ExtractURL     string
+	ExtractTimeout time.Duration
+	// PREVIEW_URL: a document conversion service office files are sent to
+	// from a background job for a preview; PREVIEW_SERVICE says which API it
+	// speaks: gotenberg (default) or collabora. PREVIEW_FORMAT is pdf
+	// (default) or, with collabora, png of the first page. PREVIEW_TIMEOUT
+	// bounds each document (default 2m).
+	PreviewURL     string
+	PreviewService string
+	PreviewFormat  string
+	PreviewTimeout time.Duration
+	// FFMPEG: the ffmpeg binary uploaded video and audio are transcoded
+	// with, in a background job, to a rendition phones can stream: H.264 at
+	// most TRANSCODE_HEIGHT lines high (default 720) with AAC, or AAC alone.
+	// Off when empty. TRANSCODE_TIMEOUT bounds each file (default 30m).
+	FFmpeg           string
+	TranscodeHeight  int
+	TranscodeTimeout time.Duration
+
+	// FRONTEND_DIR: the built single-page app (index.html plus assets) to
+	// serve at every path outside the API; unknown paths get index.html so
+	// the app's router takes over. Empty (the default) serves the API only.
+	// Files under FRONTEND_ASSETS (default "assets") carry content hashes in
+	// their names and are cached for a year; the rest revalidate.
+	FrontendDir    string
+	FrontendAssets string
+
+	// PUBLIC_MAX_AGE: how long browsers and CDNs may cache files served from
+	// public folders (/pub/...) before revalidating (default 5m; 0 = always
+	// revalidate)
+	PublicMaxAge time.Duration
+
+	// API responses are gzip- or deflate-compressed for clients that accept
+	// it when they are at least COMPRESS_MIN_SIZE bytes (default 1024) and
+	// of one of COMPRESS_TYPES (default application/json, text/plain,
+	// text/csv). File contents never are. COMPRESS=false turns it off.
+	Compress        bool
+	CompressMinSize int
+	CompressTypes   []string
+
+	// READ_ONLY=true serves the store without changing it, e.g. from a
+	// read-only mount; the server refuses to start on an unwritable store
+	// otherwise
+	ReadOnly bool
+	// REPLICA_OF: the URL of the primary this instance mirrors. A replica
+	// is read-only and serves a copy of the store kept current by the
+	// operator (rsync, ZFS send, a replicated volume); writes are refused
+	// with a pointer to the primary. Restart without it to promote a
+	// standby. With REPLICA_MAX_LAG, /health fails once the copy's
+	// heartbeat is older than that.
+	ReplicaOf     string
+	ReplicaMaxLag time.Duration
+	// HEARTBEAT_INTERVAL: how often a primary stamps the time into each
+	// store, for replicas to measure their lag (0 = off)
+	HeartbeatInterval time.Duration
+
+	// BACKUP_DIR: where `sc backup` and scheduled backups write restore
+	// points. BACKUP_INTERVAL schedules them in the server (0 = off); one is
+	// a full backup whenever the last full is older than BACKUP_FULL_EVERY.
+	BackupDir       string
+	BackupInterval  time.Duration
+	BackupFullEvery time.Duration
+
+	// SCHEDULE_GC, SCHEDULE_SCRUB, SCHEDULE_BACKUP, SCHEDULE_RETENTION,
+	// SCHEDULE_SESSIONS and SCHEDULE_AUDIT_ANCHOR set when each maintenance
+	// task runs: a cron expression ("0 3 * * *"), a macro such as @daily,
+	// "@every 10m", or off. retention purges expired files and abandoned
+	// uploads, sessions drops expired sessions, locks and old link access
+	// logs; both default to every EXPIRY_SWEEP_INTERVAL, backup to every
+	// BACKUP_INTERVAL, audit_anchor to @hourly, and gc and scrub to off.
+	Schedules map[string]*schedule.Spec // nil = off
+
+	// persistence backend: "memory", "postgres" or "sqlite".
+	// Defaults to postgres when DATABASE_URL is set, memory otherwise.
+	StoreBackend string
+	SQLitePath   string
+
+	// Postgres
+	DatabaseURL      string
+	DatabasePassword *Secret
+	DBMaxConns       int32
+	DBConnectRetries int
+
+	// COORDINATION: how instances sharing the store take turns on manifest
+	// writes, chunk assembly and jobs. "local" (default) locks within the
+	// process; "postgres" takes advisory locks on the postgres store; a
+	// redis://[:password@]host[:port][/db] URL holds them in Redis.
+	Coordination string
 }
+type SignKey struct {
+	ID        string
+	Secret    []byte
+	RetiredAt time.Time // zero while the key is live
+}
+
 type configInterface interface {
 	LoadConfig() (*Config, error)
 }
@@ -17,11 +465,82 @@ func LoadConfig() (*Config, error) {
 		BaseDir: "./",
 		FileKey: []byte("secret"),
 		Port:    "8080",
+
+		ExpirySweepInterval: 10 * time.Minute,
+		UploadStagingMaxAge: 24 * time.Hour,
+		MaxPathDepth:        64,
+		MaxNameLength:       255,
+		LinkAccessRetention: 90 * 24 * time.Hour,
+		BackupFullEvery:     7 * 24 * time.Hour,
+
+		SignKeyGrace: 24 * time.Hour,
+
+		SecretReloadInterval: time.Minute,
+
+		SessionMaxAge:      24 * time.Hour,
+		SessionIdleTimeout: 2 * time.Hour,
+
+		SessionBindIPv4Prefix: 24,
+		SessionBindIPv6Prefix: 64,
+
+		RequestSigningWindow:  5 * time.Minute,
+		RequestSigningMaxBody: 1 << 30,
+
+		DBConnectRetries: 5,
+
+		PublicURL: "https://apisc.rorocorp.org",
+		AppURL:    "https://sc.rorocorp.org",
+		SMTPPort:  "587",
+		MailFrom:  "SCloud <no-reply@rorocorp.org>",
+
+		QuotaAlerts:       []int{80, 95, 100},
+		DiskAlerts:        []int{90, 95, 99},
+		DiskCheckInterval: 5 * time.Minute,
+
+		AnomalyAuthFailures:     30,
+		AnomalyAuthWindow:       10 * time.Minute,
+		AnomalyDownloads:        500,
+		AnomalyDownloadWindow:   10 * time.Minute,
+		AnomalyTravelWindow:     time.Hour,
+		AnomalyTravelIPv4Prefix: 16,
+		AnomalyTravelIPv6Prefix: 32,
+
+		UsageSampleInterval: time.Hour,
+
+		UploadMemory: 32 << 20,
 	}
 
-	cfg.BaseDir, err = os.Getwd()
-	if err != nil {
-		cfg.BaseDir = "./"
+	if v := os.Getenv("BASE_DIR"); v != "" {
+		cfg.BaseDir = v
+	} else if wd, err := os.Getwd(); err == nil {
+		cfg.BaseDir = wd
+	}
+	if cfg.BaseDir, err = storeDir(cfg.BaseDir); err != nil {
+		return cfg, fmt.Errorf("BASE_DIR: %w", err)
+	}
+	if cfg.Roots, err = parseRoots(os.Getenv("STORAGE_ROOTS")); err != nil {
+		return cfg, fmt.Errorf("STORAGE_ROOTS: %w", err)
+	}
+	if cfg.Volumes, err = parseRoots(os.Getenv("VOLUMES")); err != nil {
+		return cfg, fmt.Errorf("VOLUMES: %w", err)
+	}
+	if _, ok := cfg.Volumes["local"]; ok {
+		return cfg, fmt.Errorf("VOLUMES: \"local\" names the store itself")
+	}
+	switch cfg.Placement = os.Getenv("PLACEMENT"); cfg.Placement {
+	case "":
+		cfg.Placement = "most-free"
+	case "most-free", "round-robin":
+	default:
+		return cfg, fmt.Errorf("PLACEMENT: want most-free or round-robin, got %q", cfg.Placement)
+	}
+	cfg.VolumePins = map[string]string{}
+	for _, item := range splitList(os.Getenv("VOLUME_PINS")) {
+		user, vol, _ := strings.Cut(item, "=")
+		if _, ok := cfg.Volumes[vol]; user == "" || !ok && vol != "local" {
+			return cfg, fmt.Errorf("VOLUME_PINS: want userID=volume with a volume from VOLUMES, got %q", item)
+		}
+		cfg.VolumePins[user] = vol
 	}
 
 	if v := os.Getenv("PORT"); v != "" {
@@ -32,5 +551,616 @@ func LoadConfig() (*Config, error) {
 		cfg.FileKey = []byte(v)
 	}
 
-	return cfg, nil
+	if cfg.MasterKey, err = loadMasterKey(cfg.BaseDir); err != nil {
+		return cfg, err
+	}
+	retired, err := secretEnv("FILEMASTERKEY_RETIRED")
+	if err != nil {
+		return cfg, err
+	}
+	for _, v := range splitList(retired) {
+		k, err := parseMasterKey(v)
+		if err != nil {
+			return cfg, fmt.Errorf("FILEMASTERKEY_RETIRED: %w", err)
+		}
+		cfg.RetiredMasterKeys = append(cfg.RetiredMasterKeys, k)
+	}
+	signKeys, err := secretEnv("SIGN_KEYS")
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.SignKeys, err = parseSignKeys(signKeys); err != nil {
+		return cfg, err
+	}
+	if len(cfg.SignKeys) == 0 {
+		secret, err := secretEnv("SIGN_SECRET")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.SignKeys = []SignKey{{ID: "0", Secret: []byte(secret)}}
+	}
+	if v := os.Getenv("SIGN_KEY_GRACE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.SignKeyGrace = d
+		}
+	}
+	if v := os.Getenv("SECRET_RELOAD_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("SECRET_RELOAD_INTERVAL: want a duration, got %q", v)
+		}
+		cfg.SecretReloadInterval = d
+	}
+	cfg.UserKeys = os.Getenv("USER_KEYS")
+	cfg.AdminEmails = splitList(os.Getenv("ADMIN_EMAILS"))
+
+	switch strings.ToLower(os.Getenv("APP_ENV")) {
+	case "dev", "development":
+		cfg.Dev = true
+	}
+	cfg.CORSOrigins = splitList(os.Getenv("CORS_ORIGINS"))
+	if len(cfg.CORSOrigins) == 0 {
+		cfg.CORSOrigins = []string{"https://sc.rorocorp.org", "https://apisc.rorocorp.org"}
+		if cfg.Dev {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, "http://localhost:*", "http://127.0.0.1:*")
+		}
+	}
+	cfg.TrustedProxies = splitList(os.Getenv("TRUSTED_PROXIES"))
+	for _, p := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return cfg, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP or CIDR", p)
+		}
+	}
+	cfg.RemoteIPHeaders = splitList(os.Getenv("REMOTE_IP_HEADERS"))
+	if len(cfg.RemoteIPHeaders) == 0 {
+		cfg.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	}
+
+	cfg.CookieDomain = "rorocorp.org"
+	if cfg.Dev {
+		cfg.CookieDomain = ""
+	}
+	if v, ok := os.LookupEnv("COOKIE_DOMAIN"); ok {
+		cfg.CookieDomain = v
+	}
+	cfg.CookieSecure = !cfg.Dev
+	if v, err := strconv.ParseBool(os.Getenv("COOKIE_SECURE")); err == nil {
+		cfg.CookieSecure = v
+	}
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "strict":
+		cfg.CookieSameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers drop SameSite=None cookies that are not Secure
+		cfg.CookieSameSite = http.SameSiteNoneMode
+		cfg.CookieSecure = true
+	default:
+		cfg.CookieSameSite = http.SameSiteLaxMode
+	}
+
+	if v := os.Getenv("SESSION_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.SessionMaxAge = d
+		}
+	}
+	if v := os.Getenv("SESSION_IDLE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.SessionIdleTimeout = d
+		}
+	}
+
+	cfg.CSRFRotatePerRequest = os.Getenv("CSRF_ROTATE") == "request"
+	for _, b := range splitList(os.Getenv("SESSION_BIND")) {
+		switch strings.ToLower(b) {
+		case "ip":
+			cfg.SessionBindIP = true
+		case "user_agent", "ua":
+			cfg.SessionBindUserAgent = true
+		default:
+			return cfg, fmt.Errorf("SESSION_BIND: want ip or user_agent, got %q", b)
+		}
+	}
+	if v := os.Getenv("SESSION_BIND_IPV4_PREFIX"); v != "" {
+		if cfg.SessionBindIPv4Prefix, err = strconv.Atoi(v); err != nil || cfg.SessionBindIPv4Prefix < 0 || cfg.SessionBindIPv4Prefix > 32 {
+			return cfg, fmt.Errorf("SESSION_BIND_IPV4_PREFIX: want 0-32, got %q", v)
+		}
+	}
+	if v := os.Getenv("SESSION_BIND_IPV6_PREFIX"); v != "" {
+		if cfg.SessionBindIPv6Prefix, err = strconv.Atoi(v); err != nil || cfg.SessionBindIPv6Prefix < 0 || cfg.SessionBindIPv6Prefix > 128 {
+			return cfg, fmt.Errorf("SESSION_BIND_IPV6_PREFIX: want 0-128, got %q", v)
+		}
+	}
+	switch v := os.Getenv("SESSION_BIND_MODE"); v {
+	case "", "strict":
+	case "reauth":
+		cfg.SessionBindReauth = true
+	default:
+		return cfg, fmt.Errorf("SESSION_BIND_MODE: want strict or reauth, got %q", v)
+	}
+	cfg.DeviceApproval = os.Getenv("DEVICE_APPROVAL") == "true"
+	if v := os.Getenv("REQUEST_SIGNING_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("REQUEST_SIGNING_WINDOW: want a positive duration, got %q", v)
+		}
+		cfg.RequestSigningWindow = d
+	}
+	if v := os.Getenv("REQUEST_SIGNING_MAX_BODY"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("REQUEST_SIGNING_MAX_BODY: want a size in bytes, got %q", v)
+		}
+		cfg.RequestSigningMaxBody = n
+	}
+
+	if v := os.Getenv("PUBLIC_URL"); v != "" {
+		cfg.PublicURL = strings.TrimSuffix(v, "/")
+	}
+	if v := os.Getenv("APP_URL"); v != "" {
+		cfg.AppURL = strings.TrimSuffix(v, "/")
+	}
+	if err := loadSAML(cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.SCIMToken, err = cfg.secret("SCIM_TOKEN"); err != nil {
+		return cfg, err
+	}
+	cfg.SMTPHost = os.Getenv("SMTP_HOST")
+	if v := os.Getenv("SMTP_PORT"); v != "" {
+		cfg.SMTPPort = v
+	}
+	cfg.SMTPUser = os.Getenv("SMTP_USER")
+	if cfg.SMTPPassword, err = cfg.secret("SMTP_PASSWORD"); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("MAIL_FROM"); v != "" {
+		cfg.MailFrom = v
+	}
+
+	if v, ok := os.LookupEnv("QUOTA_ALERTS"); ok {
+		if cfg.QuotaAlerts, err = parsePercents(v); err != nil {
+			return cfg, fmt.Errorf("QUOTA_ALERTS: %w", err)
+		}
+	}
+	if v, ok := os.LookupEnv("DISK_ALERTS"); ok {
+		if cfg.DiskAlerts, err = parsePercents(v); err != nil {
+			return cfg, fmt.Errorf("DISK_ALERTS: %w", err)
+		}
+	}
+	if v := os.Getenv("DISK_CHECK_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.DiskCheckInterval = d
+		}
+	}
+	cfg.AlertWebhook = os.Getenv("ALERT_WEBHOOK")
+	if err := loadAnomaly(cfg); err != nil {
+		return cfg, err
+	}
+	if err := loadAudit(cfg); err != nil {
+		return cfg, err
+	}
+	if err := loadEgress(cfg); err != nil {
+		return cfg, err
+	}
+	if err := loadListen(cfg); err != nil {
+		return cfg, err
+	}
+	if err := loadHTTP(cfg); err != nil {
+		return cfg, err
+	}
+	if err := loadLimits(cfg); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("USAGE_SAMPLE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.UsageSampleInterval = d
+		}
+	}
+	cfg.UsageWebhook = os.Getenv("USAGE_WEBHOOK")
+	for _, d := range []struct {
+		env string
+		dst *string
+	}{{"UPLOAD_TMP_DIR", &cfg.UploadTempDir}, {"UPLOAD_STAGING_DIR", &cfg.UploadStagingDir}} {
+		v := os.Getenv(d.env)
+		if v == "" {
+			continue
+		}
+		if err := os.MkdirAll(v, 0o700); err != nil {
+			return cfg, fmt.Errorf("%s: %w", d.env, err)
+		}
+		if *d.dst, err = filepath.Abs(v); err != nil {
+			return cfg, fmt.Errorf("%s: %w", d.env, err)
+		}
+	}
+	if v, err := strconv.ParseInt(os.Getenv("UPLOAD_MEMORY"), 10, 64); err == nil && v > 0 {
+		cfg.UploadMemory = v
+	}
+	if v := os.Getenv("DEBUG_ADDR"); v != "" {
+		host, _, err := net.SplitHostPort(v)
+		if err != nil {
+			return cfg, fmt.Errorf("DEBUG_ADDR: %w", err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return cfg, fmt.Errorf("DEBUG_ADDR: %q is not a loopback address", host)
+		}
+		cfg.DebugAddr = v
+	}
+	cfg.MetricsTopUsers = 20
+	if v := os.Getenv("METRICS_TOP_USERS"); v != "" {
+		if cfg.MetricsTopUsers, err = strconv.Atoi(v); err != nil || cfg.MetricsTopUsers < 0 {
+			return cfg, fmt.Errorf("METRICS_TOP_USERS: want a count, got %q", v)
+		}
+	}
+
+	if cfg.SFTPAddr = os.Getenv("SFTP_ADDR"); cfg.SFTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SFTPAddr); err != nil {
+			return cfg, fmt.Errorf("SFTP_ADDR: %w", err)
+		}
+	}
+	if cfg.SFTPHostKey = os.Getenv("SFTP_HOST_KEY"); cfg.SFTPHostKey == "" {
+		cfg.SFTPHostKey = filepath.Join(cfg.BaseDir, "sftp_host_key")
+	}
+
+	if cfg.FTPAddr = os.Getenv("FTP_ADDR"); cfg.FTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.FTPAddr); err != nil {
+			return cfg, fmt.Errorf("FTP_ADDR: %w", err)
+		}
+		cfg.FTPTLSCert, cfg.FTPTLSKey = os.Getenv("FTP_TLS_CERT"), os.Getenv("FTP_TLS_KEY")
+		cfg.FTPPlain, _ = strconv.ParseBool(os.Getenv("FTP_PLAIN"))
+		if (cfg.FTPTLSCert == "") != (cfg.FTPTLSKey == "") {
+			return cfg, fmt.Errorf("FTP_TLS_CERT and FTP_TLS_KEY go together")
+		}
+		if cfg.FTPTLSCert == "" && !cfg.FTPPlain {
+			return cfg, fmt.Errorf("FTP_ADDR needs FTP_TLS_CERT/FTP_TLS_KEY, or FTP_PLAIN=true for unencrypted FTP")
+		}
+	}
+	if cfg.FTPChroot = os.Getenv("FTP_CHROOT"); cfg.FTPChroot == "" {
+		cfg.FTPChroot = "home/{id}"
+	}
+	if v := os.Getenv("FTP_PASSIVE_PORTS"); v != "" {
+		lo, hi, _ := strings.Cut(v, "-")
+		a, err1 := strconv.Atoi(lo)
+		b, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || a < 1024 || b < a || b > 65535 {
+			return cfg, fmt.Errorf("FTP_PASSIVE_PORTS: want a range like 30000-30099, got %q", v)
+		}
+		cfg.FTPPassivePorts = [2]int{a, b}
+	}
+	if v := os.Getenv("FTP_PUBLIC_IP"); v != "" {
+		if cfg.FTPPublicIP = net.ParseIP(v); cfg.FTPPublicIP == nil {
+			return cfg, fmt.Errorf("FTP_PUBLIC_IP: %q is not an IP", v)
+		}
+	}
+
+	if v := os.Getenv("EXPIRY_SWEEP_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.ExpirySweepInterval = d
+		}
+	}
+	if v := os.Getenv("UPLOAD_STAGING_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.UploadStagingMaxAge = d
+		}
+	}
+	for env, limit := range map[string]*int{
+		"MAX_DIR_ENTRIES": &cfg.MaxDirEntries,
+		"MAX_USER_FILES":  &cfg.MaxUserFiles,
+		"MAX_PATH_DEPTH":  &cfg.MaxPathDepth,
+		"MAX_NAME_LENGTH": &cfg.MaxNameLength,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("%s: want a count, 0 for no limit, got %q", env, v)
+			}
+			*limit = n
+		}
+	}
+	switch v := os.Getenv("NAME_CASE"); v {
+	case "", "sensitive":
+	case "insensitive":
+		cfg.CaseInsensitiveNames = true
+	default:
+		return cfg, fmt.Errorf("NAME_CASE: want sensitive or insensitive, got %q", v)
+	}
+	if cfg.Messages, err = i18n.Load(os.Getenv("I18N_DIR")); err != nil {
+		return cfg, fmt.Errorf("I18N_DIR: %w", err)
+	}
+	if cfg.UploadFilters, err = uploadfilter.Build(splitList(os.Getenv("UPLOAD_FILTERS"))); err != nil {
+		return cfg, fmt.Errorf("UPLOAD_FILTERS: %w", err)
+	}
+	if v := os.Getenv("LINK_ACCESS_RETENTION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.LinkAccessRetention = d
+		}
+	}
+	if v := os.Getenv("ABUSE_REPORT_THRESHOLD"); v != "" {
+		if cfg.AbuseReportThreshold, err = strconv.Atoi(v); err != nil || cfg.AbuseReportThreshold < 0 {
+			return cfg, fmt.Errorf("ABUSE_REPORT_THRESHOLD: want a count, got %q", v)
+		}
+	}
+
+	cfg.ContentIndex, _ = strconv.ParseBool(os.Getenv("CONTENT_INDEX"))
+	cfg.ExtractURL = os.Getenv("EXTRACT_URL")
+	cfg.ExtractTimeout = 2 * time.Minute
+	if v := os.Getenv("EXTRACT_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.ExtractTimeout = d
+		}
+	}
+	cfg.PreviewURL = strings.TrimSuffix(os.Getenv("PREVIEW_URL"), "/")
+	cfg.PreviewService, cfg.PreviewFormat = os.Getenv("PREVIEW_SERVICE"), os.Getenv("PREVIEW_FORMAT")
+	if cfg.PreviewService == "" {
+		cfg.PreviewService = "gotenberg"
+	}
+	if cfg.PreviewFormat == "" {
+		cfg.PreviewFormat = "pdf"
+	}
+	switch {
+	case cfg.PreviewService != "gotenberg" && cfg.PreviewService != "collabora":
+		return cfg, fmt.Errorf("PREVIEW_SERVICE: want gotenberg or collabora, got %q", cfg.PreviewService)
+	case cfg.PreviewFormat != "pdf" && cfg.PreviewFormat != "png":
+		return cfg, fmt.Errorf("PREVIEW_FORMAT: want pdf or png, got %q", cfg.PreviewFormat)
+	case cfg.PreviewFormat == "png" && cfg.PreviewService != "collabora":
+		return cfg, fmt.Errorf("PREVIEW_FORMAT=png needs PREVIEW_SERVICE=collabora")
+	}
+	cfg.PreviewTimeout = 2 * time.Minute
+	if v := os.Getenv("PREVIEW_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.PreviewTimeout = d
+		}
+	}
+	cfg.FFmpeg = os.Getenv("FFMPEG")
+	cfg.TranscodeHeight = 720
+	if v := os.Getenv("TRANSCODE_HEIGHT"); v != "" {
+		if cfg.TranscodeHeight, err = strconv.Atoi(v); err != nil || cfg.TranscodeHeight < 144 {
+			return cfg, fmt.Errorf("TRANSCODE_HEIGHT: want at least 144, got %q", v)
+		}
+	}
+	cfg.TranscodeTimeout = 30 * time.Minute
+	if v := os.Getenv("TRANSCODE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.TranscodeTimeout = d
+		}
+	}
+	if cfg.FrontendDir = os.Getenv("FRONTEND_DIR"); cfg.FrontendDir != "" {
+		if _, err := os.Stat(filepath.Join(cfg.FrontendDir, "index.html")); err != nil {
+			return cfg, fmt.Errorf("FRONTEND_DIR: %w", err)
+		}
+	}
+	cfg.FrontendAssets = strings.Trim(os.Getenv("FRONTEND_ASSETS"), "/")
+	if cfg.FrontendAssets == "" {
+		cfg.FrontendAssets = "assets"
+	}
+	cfg.PublicMaxAge = 5 * time.Minute
+	if v := os.Getenv("PUBLIC_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.PublicMaxAge = d
+		}
+	}
+	cfg.Compress = true
+	if v, err := strconv.ParseBool(os.Getenv("COMPRESS")); err == nil {
+		cfg.Compress = v
+	}
+	cfg.CompressMinSize = 1024
+	if v := os.Getenv("COMPRESS_MIN_SIZE"); v != "" {
+		if cfg.CompressMinSize, err = strconv.Atoi(v); err != nil || cfg.CompressMinSize < 0 {
+			return cfg, fmt.Errorf("COMPRESS_MIN_SIZE: want a byte count, got %q", v)
+		}
+	}
+	cfg.CompressTypes = splitList(os.Getenv("COMPRESS_TYPES"))
+	if len(cfg.CompressTypes) == 0 {
+		cfg.CompressTypes = []string{"application/json", "text/plain", "text/csv"}
+	}
+
+	cfg.ReadOnly, _ = strconv.ParseBool(os.Getenv("READ_ONLY"))
+	if cfg.ReplicaOf = strings.TrimSuffix(os.Getenv("REPLICA_OF"), "/"); cfg.ReplicaOf != "" {
+		cfg.ReadOnly = true
+	}
+	if v := os.Getenv("REPLICA_MAX_LAG"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.ReplicaMaxLag = d
+		}
+	}
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.HeartbeatInterval = d
+		}
+	}
+
+	cfg.BackupDir = os.Getenv("BACKUP_DIR")
+	if v := os.Getenv("BACKUP_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.BackupInterval = d
+		}
+	}
+	if v := os.Getenv("BACKUP_FULL_EVERY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.BackupFullEvery = d
+		}
+	}
+
+	schedules := map[string]string{
+		"gc":           "off",
+		"scrub":        "off",
+		"backup":       "off",
+		"retention":    "@every " + cfg.ExpirySweepInterval.String(),
+		"sessions":     "@every " + cfg.ExpirySweepInterval.String(),
+		"audit_anchor": "@hourly",
+	}
+	if cfg.BackupDir != "" && cfg.BackupInterval > 0 {
+		schedules["backup"] = "@every " + cfg.BackupInterval.String()
+	}
+	cfg.Schedules = map[string]*schedule.Spec{}
+	for task, expr := range schedules {
+		env := "SCHEDULE_" + strings.ToUpper(task)
+		if v := os.Getenv(env); v != "" {
+			expr = v
+		}
+		if expr == "off" {
+			cfg.Schedules[task] = nil
+			continue
+		}
+		if cfg.Schedules[task], err = schedule.Parse(expr); err != nil {
+			return cfg, fmt.Errorf("%s: %w", env, err)
+		}
+	}
+	if cfg.Schedules["backup"] != nil && cfg.BackupDir == "" {
+		return cfg, errors.New("SCHEDULE_BACKUP needs BACKUP_DIR")
+	}
+
+	if cfg.DatabaseURL, err = secretEnv("DATABASE_URL"); err != nil {
+		return cfg, err
+	}
+	if cfg.DatabasePassword, err = cfg.secret("DB_PASSWORD"); err != nil {
+		return cfg, err
+	}
+	cfg.StoreBackend = os.Getenv("STORE_BACKEND")
+	if cfg.StoreBackend == "" {
+		cfg.StoreBackend = "memory"
+		if cfg.DatabaseURL != "" {
+			cfg.StoreBackend = "postgres"
+		}
+	}
+	cfg.SQLitePath = os.Getenv("SQLITE_PATH")
+	if cfg.SQLitePath == "" {
+		cfg.SQLitePath = filepath.Join(cfg.BaseDir, "scloud.db")
+	}
+	if v, err := strconv.Atoi(os.Getenv("DB_MAX_CONNS")); err == nil && v > 0 {
+		cfg.DBMaxConns = int32(v)
+	}
+	if v, err := strconv.Atoi(os.Getenv("DB_CONNECT_RETRIES")); err == nil && v > 0 {
+		cfg.DBConnectRetries = v
+	}
+	switch cfg.Coordination = os.Getenv("COORDINATION"); {
+	case cfg.Coordination == "":
+		cfg.Coordination = "local"
+	case cfg.Coordination == "local", strings.HasPrefix(cfg.Coordination, "redis://"):
+	case cfg.Coordination == "postgres":
+		if cfg.StoreBackend != "postgres" {
+			return cfg, fmt.Errorf("COORDINATION=postgres needs the postgres store backend")
+		}
+	default:
+		return cfg, fmt.Errorf("COORDINATION: want local, postgres or a redis:// URL, got %q", cfg.Coordination)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// MinKeyLen is the shortest master or signing key accepted: 256 bits.
+const MinKeyLen = 32
+
+// Validate reports every missing or weak secret at once, so a misconfigured
+// deployment fails at boot instead of on first use.
+func (c *Config) Validate() error {
+	var errs []error
+	switch {
+	case len(c.MasterKey) == 0:
+		errs = append(errs, fmt.Errorf("FILEMASTERKEY (or FILEMASTERPASSPHRASE) is not set"))
+	case len(c.MasterKey) < MinKeyLen:
+		// only reachable through raw:
+		errs = append(errs, fmt.Errorf("FILEMASTERKEY must be at least %d bytes, got %d", MinKeyLen, len(c.MasterKey)))
+	}
+	for _, k := range c.SignKeys {
+		switch {
+		case len(k.Secret) == 0:
+			errs = append(errs, fmt.Errorf("SIGN_SECRET (or SIGN_KEYS) is not set"))
+		case len(k.Secret) < MinKeyLen:
+			errs = append(errs, fmt.Errorf("signing key %q must be at least %d bytes, got %d", k.ID, MinKeyLen, len(k.Secret)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitList parses a comma-separated env value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// storeDir makes dir absolute and checks it is a directory, creating it if
+// it does not exist yet.
+func storeDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return dir, nil
+}
+
+func parseRoots(v string) (map[string]string, error) {
+	roots := map[string]string{}
+	for _, item := range splitList(v) {
+		name, dir, ok := strings.Cut(item, "=")
+		if !ok || !validRootName(name) || dir == "" {
+			return nil, fmt.Errorf("want name=path with a name of a-z, 0-9, - or _, got %q", item)
+		}
+		if _, dup := roots[name]; dup {
+			return nil, fmt.Errorf("root %q given twice", name)
+		}
+		dir, err := storeDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("root %q: %w", name, err)
+		}
+		roots[name] = dir
+	}
+	return roots, nil
+}
+
+func validRootName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// parsePercents parses a comma list of thresholds in (0, 100], sorted.
+func parsePercents(v string) ([]int, error) {
+	var out []int
+	for _, item := range splitList(v) {
+		n, err := strconv.Atoi(strings.TrimSuffix(item, "%"))
+		if err != nil || n <= 0 || n > 100 {
+			return nil, fmt.Errorf("%q is not a percentage", item)
+		}
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+func parseSignKeys(v string) ([]SignKey, error) {
+	var keys []SignKey
+	for _, item := range splitList(v) {
+		id, secret, ok := strings.Cut(item, "=")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("SIGN_KEYS: want id=secret, got %q", id)
+		}
+		k := SignKey{ID: id}
+		// secrets may contain '@' themselves; only a parseable suffix counts
+		if at := strings.LastIndex(secret, "@"); at >= 0 {
+			if t, err := time.Parse(time.RFC3339, secret[at+1:]); err == nil {
+				secret, k.RetiredAt = secret[:at], t
+			}
+		}
+		k.Secret = []byte(secret)
+		keys = append(keys, k)
+	}
+	return keys, nil
 }
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func loadEgress(cfg *Config) error {
+	cfg.EgressProxy = os.Getenv("EGRESS_PROXY")
+	switch cfg.EgressProxy {
+	case "", "none":
+	default:
+		u, err := url.Parse(cfg.EgressProxy)
+		if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return fmt.Errorf("EGRESS_PROXY: want an http://, https:// or socks5:// URL, or none, got %q", cfg.EgressProxy)
+		}
+	}
+	cfg.EgressNoProxy = splitList(os.Getenv("EGRESS_NO_PROXY"))
+
+	if path := os.Getenv("EGRESS_CA_BUNDLE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("EGRESS_CA_BUNDLE: %w", err)
+		}
+		if cfg.EgressCAs, err = x509.SystemCertPool(); err != nil {
+			cfg.EgressCAs = x509.NewCertPool()
+		}
+		if !cfg.EgressCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("EGRESS_CA_BUNDLE: no certificates in %s", path)
+		}
+	}
+
+	cfg.EgressConnectTimeout = 10 * time.Second
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{{"EGRESS_CONNECT_TIMEOUT", &cfg.EgressConnectTimeout}, {"EGRESS_RESPONSE_TIMEOUT", &cfg.EgressResponseTimeout}} {
+		if v := os.Getenv(d.env); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil || t < 0 {
+				return fmt.Errorf("%s: want a duration, got %q", d.env, v)
+			}
+			*d.dst = t
+		}
+	}
+
+	cfg.EgressRetries = 2
+	if v := os.Getenv("EGRESS_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("EGRESS_RETRIES: want a count, got %q", v)
+		}
+		cfg.EgressRetries = n
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func loadHTTP(cfg *Config) error {
+	cfg.HTTPReadHeaderTimeout = 10 * time.Second
+	cfg.HTTPIdleTimeout = 2 * time.Minute
+	cfg.HTTPMinRateGrace = 30 * time.Second
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", &cfg.HTTPReadHeaderTimeout},
+		{"HTTP_IDLE_TIMEOUT", &cfg.HTTPIdleTimeout},
+		{"HTTP_MIN_RATE_GRACE", &cfg.HTTPMinRateGrace},
+	} {
+		if v := os.Getenv(d.env); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil || t < 0 {
+				return fmt.Errorf("%s: want a duration, got %q", d.env, v)
+			}
+			*d.dst = t
+		}
+	}
+
+	cfg.HTTPMaxHeaderBytes = 1 << 20
+	for _, n := range []struct {
+		env string
+		dst *int
+	}{
+		{"HTTP_MAX_HEADER_BYTES", &cfg.HTTPMaxHeaderBytes},
+		{"HTTP_MAX_CONNS", &cfg.HTTPMaxConns},
+		{"HTTP_MAX_CONNS_PER_IP", &cfg.HTTPMaxConnsPerIP},
+		{"HTTP_MAX_REQUESTS_PER_CONN", &cfg.HTTPMaxRequestsPerConn},
+	} {
+		if v := os.Getenv(n.env); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return fmt.Errorf("%s: want a count, got %q", n.env, v)
+			}
+			*n.dst = i
+		}
+	}
+	if v := os.Getenv("HTTP_MIN_RATE"); v != "" {
+		r, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || r < 0 {
+			return fmt.Errorf("HTTP_MIN_RATE: want bytes per second, got %q", v)
+		}
+		cfg.HTTPMinRate = r
+	}
+	return nil
+}
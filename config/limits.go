@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConcurrencyClasses are the kinds of request CONCURRENCY_LIMITS caps:
+// upload encrypts what comes in, download decrypts what goes out.
+var ConcurrencyClasses = []string{"upload", "download"}
+
+func loadLimits(cfg *Config) error {
+	cfg.ConcurrencyLimits = map[string]int{}
+	for _, item := range splitList(os.Getenv("CONCURRENCY_LIMITS")) {
+		class, v, _ := strings.Cut(item, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || !slices.Contains(ConcurrencyClasses, class) {
+			return fmt.Errorf("CONCURRENCY_LIMITS: want class=count with a class of %v, got %q", ConcurrencyClasses, item)
+		}
+		cfg.ConcurrencyLimits[class] = n
+	}
+	cfg.ConcurrencyQueueWait = 5 * time.Second
+	if v := os.Getenv("CONCURRENCY_QUEUE_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("CONCURRENCY_QUEUE_WAIT: want a duration, got %q", v)
+		}
+		cfg.ConcurrencyQueueWait = d
+	}
+	cfg.ConcurrencyMinRate = 16 << 10
+	if v := os.Getenv("CONCURRENCY_MIN_RATE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("CONCURRENCY_MIN_RATE: want bytes a second, got %q", v)
+		}
+		cfg.ConcurrencyMinRate = n
+	}
+	return nil
+}
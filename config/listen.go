@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ActivatedPrefix marks a listen address naming sockets passed in by
+// systemd socket activation, by their FileDescriptorName=.
+const ActivatedPrefix = "systemd:"
+
+func loadListen(cfg *Config) error {
+	cfg.ListenAddrs = []string{"0.0.0.0:8443"}
+	for _, l := range []struct {
+		env string
+		dst *[]string
+	}{{"LISTEN_ADDR", &cfg.ListenAddrs}, {"METRICS_ADDR", &cfg.MetricsAddrs}, {"ADMIN_ADDR", &cfg.AdminAddrs}} {
+		v := os.Getenv(l.env)
+		if v == "" {
+			continue
+		}
+		addrs := splitList(v)
+		for _, addr := range addrs {
+			if name, ok := strings.CutPrefix(addr, ActivatedPrefix); ok {
+				if name == "" {
+					return fmt.Errorf("%s: %q names no socket", l.env, addr)
+				}
+				continue
+			}
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("%s: want host:port or %s<name>, got %q", l.env, ActivatedPrefix, addr)
+			}
+		}
+		*l.dst = addrs
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The master key is FILEMASTERKEY as exactly 32 bytes in hex or base64, or
+// FILEMASTERPASSPHRASE stretched with scrypt. Stores created back when any
+// string was used verbatim open with FILEMASTERKEY=raw:<the old value>.
+const (
+	masterKeyLen     = 32
+	minPassphraseLen = 16
+)
+
+// scrypt cost for the master passphrase. It runs once per start, so it can
+// be much steeper than the per-login user key derivation.
+const (
+	kdfN = 1 << 17
+	kdfR = 8
+	kdfP = 1
+)
+
+// kdfParams sit in plaintext next to the store: the salt is not secret, and
+// losing it loses the key.
+type kdfParams struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+func kdfPath(baseDir string) string {
+	return filepath.Join(baseDir, "filestorage", "_kdf.json")
+}
+
+func loadMasterKey(baseDir string) ([]byte, error) {
+	key, err := secretEnv("FILEMASTERKEY")
+	if err != nil {
+		return nil, err
+	}
+	pass, err := secretEnv("FILEMASTERPASSPHRASE")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case key != "" && pass != "":
+		return nil, fmt.Errorf("set FILEMASTERKEY or FILEMASTERPASSPHRASE, not both")
+	case pass != "":
+		return stretchPassphrase(baseDir, pass)
+	case key == "":
+		return nil, nil // Validate reports it
+	}
+	return parseMasterKey(key)
+}
+
+func parseMasterKey(v string) ([]byte, error) {
+	if raw, ok := strings.CutPrefix(v, "raw:"); ok {
+		return []byte(raw), nil
+	}
+	if b, err := hex.DecodeString(v); err == nil && len(b) == masterKeyLen {
+		return b, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(v); err == nil && len(b) == masterKeyLen {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("FILEMASTERKEY must be %d bytes in hex (%d digits) or base64; use FILEMASTERPASSPHRASE for a passphrase",
+		masterKeyLen, 2*masterKeyLen)
+}
+
+// stretchPassphrase derives the master key, creating the store's KDF salt on
+// first use.
+func stretchPassphrase(baseDir, pass string) ([]byte, error) {
+	if len(pass) < minPassphraseLen {
+		return nil, fmt.Errorf("FILEMASTERPASSPHRASE must be at least %d characters", minPassphraseLen)
+	}
+	var p kdfParams
+	raw, err := os.ReadFile(kdfPath(baseDir))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &p); err != nil || len(p.Salt) == 0 {
+			return nil, fmt.Errorf("%s is damaged: %v", kdfPath(baseDir), err)
+		}
+	case os.IsNotExist(err):
+		p = kdfParams{Salt: make([]byte, 16), N: kdfN, R: kdfR, P: kdfP}
+		if _, err := rand.Read(p.Salt); err != nil {
+			return nil, err
+		}
+		raw, _ := json.Marshal(p)
+		if err := os.MkdirAll(filepath.Dir(kdfPath(baseDir)), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(kdfPath(baseDir), raw, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return scrypt.Key([]byte(pass), p.Salt, p.N, p.R, p.P, masterKeyLen)
+}
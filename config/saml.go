@@ -0,0 +1,74 @@
+package config
+
+import (
+	"SCloud/authz"
+	"SCloud/saml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SAMLOrgRole gives members of an IdP group a role in an org.
+type SAMLOrgRole struct {
+	Group, Org, Role string
+}
+
+func loadSAML(cfg *Config) error {
+	var idp *saml.IdP
+	if path := os.Getenv("SAML_IDP_METADATA"); path != "" {
+		var err error
+		if idp, err = saml.LoadIdP(path); err != nil {
+			return fmt.Errorf("SAML_IDP_METADATA: %w", err)
+		}
+	} else if id := os.Getenv("SAML_IDP_ENTITY_ID"); id != "" {
+		idp = &saml.IdP{EntityID: id, SSOURL: os.Getenv("SAML_IDP_SSO_URL")}
+		if idp.SSOURL == "" || os.Getenv("SAML_IDP_CERT") == "" {
+			return fmt.Errorf("SAML_IDP_ENTITY_ID needs SAML_IDP_SSO_URL and SAML_IDP_CERT")
+		}
+	}
+	if idp == nil {
+		return nil
+	}
+	if path := os.Getenv("SAML_IDP_CERT"); path != "" {
+		c, err := saml.LoadCert(path)
+		if err != nil {
+			return fmt.Errorf("SAML_IDP_CERT: %w", err)
+		}
+		idp.Certs = append(idp.Certs, c)
+	}
+	if cfg.UserKeys == "password" {
+		return fmt.Errorf("SAML sign-in cannot unlock password-wrapped file keys; use USER_KEYS=master")
+	}
+	cfg.SAML = &saml.SP{
+		EntityID: os.Getenv("SAML_SP_ENTITY_ID"),
+		ACSURL:   cfg.PublicURL + "/api/auth/saml/acs",
+		IdP:      idp,
+	}
+	if cfg.SAML.EntityID == "" {
+		cfg.SAML.EntityID = cfg.PublicURL + "/api/auth/saml/metadata"
+	}
+
+	cfg.SAMLAttrEmail = os.Getenv("SAML_ATTR_EMAIL")
+	cfg.SAMLAttrName = os.Getenv("SAML_ATTR_NAME")
+	cfg.SAMLAttrGroups = os.Getenv("SAML_ATTR_GROUPS")
+	if cfg.SAMLAttrGroups == "" {
+		cfg.SAMLAttrGroups = "groups"
+	}
+	cfg.SAMLAdminGroups = splitList(os.Getenv("SAML_ADMIN_GROUPS"))
+	for _, m := range splitList(os.Getenv("SAML_ORG_ROLES")) {
+		group, target, _ := strings.Cut(m, "=")
+		org, role, _ := strings.Cut(target, ":")
+		switch role {
+		case authz.RoleOwner, authz.RoleAdmin, authz.RoleMember, authz.RoleViewer:
+		default:
+			return fmt.Errorf("SAML_ORG_ROLES: want group=org:role, got %q", m)
+		}
+		if group == "" || org == "" {
+			return fmt.Errorf("SAML_ORG_ROLES: want group=org:role, got %q", m)
+		}
+		cfg.SAMLOrgRoles = append(cfg.SAMLOrgRoles, SAMLOrgRole{Group: group, Org: org, Role: role})
+	}
+	cfg.SAMLJIT = os.Getenv("SAML_JIT") == "true"
+	cfg.SAMLIdPInitiated = os.Getenv("SAML_IDP_INITIATED") == "true"
+	return nil
+}
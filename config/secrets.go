@@ -0,0 +1,193 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Secret settings may hold a reference instead of the value itself:
+//
+//	file:///run/secrets/name         the file, less trailing newlines
+//	env://NAME                       another environment variable
+//	vault://secret/data/scloud#key   a field of the Vault secret at that API
+//	                                 path: KV v2's data.data, else data
+//
+// Vault is reached with VAULT_ADDR, VAULT_TOKEN (itself possibly a file://
+// reference, as a Vault agent sink writes), VAULT_NAMESPACE and
+// VAULT_CACERT. Any other value is the secret as given.
+const vaultTimeout = 10 * time.Second
+
+// Secret is a secret setting that may change while SCloud runs: whenever
+// it comes from a file or Vault, ReloadSecrets reads it again. nil is
+// unset.
+type Secret struct {
+	env string
+	ref string
+	val atomic.Pointer[string]
+}
+
+// Value is the secret as last read.
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+	if v := s.val.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// secret reads env as a reloadable secret.
+func (c *Config) secret(env string) (*Secret, error) {
+	s := &Secret{env: env, ref: os.Getenv(env)}
+	v, err := resolveSecret(s.ref)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", env, err)
+	}
+	s.val.Store(&v)
+	c.secrets = append(c.secrets, s)
+	return s, nil
+}
+
+// secretEnv reads env as a secret resolved once, at start.
+func secretEnv(env string) (string, error) {
+	v, err := resolveSecret(os.Getenv(env))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", env, err)
+	}
+	return v, nil
+}
+
+// ReloadSecrets reads the secrets from files and Vault again, logging the
+// ones that changed. One that cannot be read, or reads empty, keeps its
+// last value.
+func (c *Config) ReloadSecrets(logger *log.Logger) {
+	for _, s := range c.secrets {
+		if !strings.HasPrefix(s.ref, "file://") && !strings.HasPrefix(s.ref, "vault://") {
+			continue
+		}
+		v, err := resolveSecret(s.ref)
+		if err == nil && v == "" {
+			err = errors.New("empty")
+		}
+		if err != nil {
+			logger.Printf("reload %s: %v", s.env, err)
+			continue
+		}
+		if v != s.Value() {
+			s.val.Store(&v)
+			logger.Printf("%s reloaded", s.env)
+		}
+	}
+}
+
+func resolveSecret(ref string) (string, error) {
+	scheme, rest, _ := strings.Cut(ref, "://")
+	switch scheme {
+	case "file":
+		b, err := os.ReadFile(rest)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case "env":
+		v, ok := os.LookupEnv(rest)
+		if !ok {
+			return "", fmt.Errorf("%s is not set", rest)
+		}
+		return v, nil
+	case "vault":
+		return vaultSecret(rest)
+	}
+	return ref, nil
+}
+
+// vaultSecret reads path#field from Vault.
+func vaultSecret(ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	if path = strings.Trim(path, "/"); path == "" || field == "" {
+		return "", fmt.Errorf("want vault://<path>#<field>, got %q", "vault://"+ref)
+	}
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	tokenRef := os.Getenv("VAULT_TOKEN")
+	if strings.HasPrefix(tokenRef, "vault://") {
+		return "", errors.New("VAULT_TOKEN cannot come from Vault")
+	}
+	token, err := resolveSecret(tokenRef)
+	if err != nil {
+		return "", fmt.Errorf("VAULT_TOKEN: %w", err)
+	}
+	client, err := vaultClient()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		data = inner
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s has no field %q", path, field)
+	}
+	return v, nil
+}
+
+// vaultClient trusts VAULT_CACERT as well as the system's CAs. Secrets are
+// read before the egress settings apply, so it goes by the environment's
+// proxy.
+func vaultClient() (*http.Client, error) {
+	client := &http.Client{Timeout: vaultTimeout}
+	if path := os.Getenv("VAULT_CACERT"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("VAULT_CACERT: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("VAULT_CACERT: no certificates in %s", path)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.Transport = t
+	}
+	return client, nil
+}
@@ -0,0 +1,112 @@
+// Package coord lets several SCloud instances that share one store take
+// turns: named locks held in this process, in Redis, or as Postgres
+// advisory locks.
+package coord
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ErrHeld is TryLock's answer for a lock someone else holds.
+var ErrHeld = errors.New("lock is held elsewhere")
+
+type Locker interface {
+	// Lock takes the named lock, waiting for it until ctx is done.
+	Lock(ctx context.Context, name string) (unlock func(), err error)
+	// TryLock takes the named lock if it is free and fails with ErrHeld if
+	// it is not.
+	TryLock(ctx context.Context, name string) (unlock func(), err error)
+}
+
+// Claimer remembers names for a while, so that something done once (a
+// nonce spent, say) is refused by every instance until the claim lapses.
+type Claimer interface {
+	// Claim takes name for ttl and reports false if it is already taken.
+	Claim(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// Local locks within the process; enough for a single instance.
+type Local struct {
+	mu     sync.Mutex
+	locks  map[string]chan struct{}
+	claims map[string]bool
+}
+
+func NewLocal() *Local {
+	return &Local{locks: map[string]chan struct{}{}, claims: map[string]bool{}}
+}
+
+func (l *Local) slot(name string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch, ok := l.locks[name]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		l.locks[name] = ch
+	}
+	return ch
+}
+
+func (l *Local) Lock(ctx context.Context, name string) (func(), error) {
+	ch := l.slot(name)
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Local) TryLock(_ context.Context, name string) (func(), error) {
+	ch := l.slot(name)
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	default:
+		return nil, ErrHeld
+	}
+}
+
+// Claim forgets each claim on a timer once its ttl is up.
+func (l *Local) Claim(_ context.Context, name string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.claims[name] {
+		return false, nil
+	}
+	l.claims[name] = true
+	time.AfterFunc(ttl, func() {
+		l.mu.Lock()
+		delete(l.claims, name)
+		l.mu.Unlock()
+	})
+	return true, nil
+}
+
+// poll takes a lock by retrying try until it succeeds or ctx is done.
+func poll(ctx context.Context, try func() (func(), error)) (func(), error) {
+	wait := 10 * time.Millisecond
+	for {
+		unlock, err := try()
+		if !errors.Is(err, ErrHeld) {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, 500*time.Millisecond)
+	}
+}
+
+// key turns a lock name into a 64-bit advisory lock key.
+func key(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
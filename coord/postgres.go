@@ -0,0 +1,68 @@
+package coord
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sync/atomic"
+	"time"
+)
+
+// Postgres holds session-level advisory locks, each on a pooled connection
+// of its own until released. A lock dies with its connection, so a crashed
+// instance never leaves one behind. Give it a small pool of its own: held
+// locks would otherwise starve the store's queries of connections.
+type Postgres struct {
+	Pool *pgxpool.Pool
+
+	pruned atomic.Int64 // unix seconds of the last sweep of lapsed claims
+}
+
+// Lock polls TryLock, so a wait ties up no connection.
+func (p *Postgres) Lock(ctx context.Context, name string) (func(), error) {
+	return poll(ctx, func() (func(), error) { return p.TryLock(ctx, name) })
+}
+
+func (p *Postgres) TryLock(ctx context.Context, name string) (func(), error) {
+	conn, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k := key(name)
+	var ok bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", k).Scan(&ok); err != nil || !ok {
+		conn.Release()
+		if err == nil {
+			err = ErrHeld
+		}
+		return nil, err
+	}
+	return unlocker(conn, k), nil
+}
+
+func unlocker(conn *pgxpool.Conn, k int64) func() {
+	return func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", k); err != nil {
+			// closing the session drops the lock all the same
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}
+}
+
+// Claim keeps claims in coord_claims. A lapsed claim is taken over in
+// place; the rest of the lapsed ones are swept at most once a minute.
+func (p *Postgres) Claim(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	if last := p.pruned.Load(); now.Unix()-last >= 60 && p.pruned.CompareAndSwap(last, now.Unix()) {
+		if _, err := p.Pool.Exec(ctx, "DELETE FROM coord_claims WHERE expires < $1", now); err != nil {
+			return false, err
+		}
+	}
+	tag, err := p.Pool.Exec(ctx, `INSERT INTO coord_claims (name, expires) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET expires = EXCLUDED.expires WHERE coord_claims.expires < $3`,
+		name, now.Add(ttl), now)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,230 @@
+package coord
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis holds each lock as a key with a random token and a TTL that a
+// goroutine keeps extending while the lock is held, so a crashed instance's
+// locks expire after TTL. Only the holder's token can release or extend a
+// lock. It speaks just enough RESP for that over one connection.
+type Redis struct {
+	Addr     string
+	Password string
+	DB       int
+	TTL      time.Duration
+	Prefix   string // key prefix, e.g. "sc:lock:"
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedis parses redis://[:password@]host[:port][/db].
+func NewRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("want redis://[:password@]host[:port][/db]")
+	}
+	r := &Redis{Addr: u.Host, TTL: 30 * time.Second, Prefix: "sc:lock:"}
+	if u.Port() == "" {
+		r.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if pw, ok := u.User.Password(); ok {
+		r.Password = pw
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.DB, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("bad redis db %q", db)
+		}
+	}
+	return r, nil
+}
+
+// release deletes the key only if it still holds our token; extend renews
+// the TTL on the same condition.
+const (
+	releaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	extendScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+func (r *Redis) Lock(ctx context.Context, name string) (func(), error) {
+	return poll(ctx, func() (func(), error) { return r.TryLock(ctx, name) })
+}
+
+func (r *Redis) TryLock(_ context.Context, name string) (func(), error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	k, token, ttl := r.Prefix+name, hex.EncodeToString(b), strconv.FormatInt(r.TTL.Milliseconds(), 10)
+	reply, err := r.do("SET", k, token, "NX", "PX", ttl)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrHeld
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(r.TTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if n, err := r.do("EVAL", extendScript, "1", k, token, ttl); err != nil || n != int64(1) {
+					log.Printf("coord: lost lock %s: %v", name, err)
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			if _, err := r.do("EVAL", releaseScript, "1", k, token); err != nil {
+				log.Printf("coord: release %s: %v", name, err)
+			}
+		})
+	}, nil
+}
+
+// Claim sets a key that expires with the claim; Redis does the forgetting.
+func (r *Redis) Claim(_ context.Context, name string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	reply, err := r.do("SET", r.Prefix+"claim:"+name, "1", "NX", "PX", ms)
+	return reply != nil, err
+}
+
+// do sends one command and reads its reply: a string, an int64, nil for a
+// null reply, or an error for an error reply. A broken connection is
+// redialled once.
+func (r *Redis) do(args ...string) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if r.conn == nil {
+			if err := r.dial(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := r.roundTrip(args)
+		var redisErr redisError
+		if err == nil || errors.As(err, &redisErr) {
+			return reply, err
+		}
+		r.conn.Close()
+		r.conn = nil
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+func (r *Redis) dial() error {
+	conn, err := net.DialTimeout("tcp", r.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	r.conn, r.r = conn, bufio.NewReader(conn)
+	if r.Password != "" {
+		if _, err := r.roundTrip([]string{"AUTH", r.Password}); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := r.roundTrip([]string{"SELECT", strconv.Itoa(r.DB)}); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (r *Redis) roundTrip(args []string) (any, error) {
+	r.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return r.readReply()
+}
+
+func (r *Redis) readReply() (any, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = r.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", line)
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
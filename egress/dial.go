@@ -0,0 +1,170 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DialContext opens a TCP connection to addr (host:port) for a protocol
+// other than HTTP: through EGRESS_PROXY when it applies to the host, by
+// CONNECT on an http(s) proxy or by SOCKS5, else directly. The proxies of
+// the environment are for HTTP only and are not used.
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	s := current()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.proxy == nil || bypassed(s.cfg.EgressNoProxy, host) {
+		return s.dialer.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := s.dialer.DialContext(ctx, "tcp", proxyAddr(s.proxy))
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	// the handshake with the proxy counts as connecting
+	deadline, _ := ctx.Deadline()
+	if t := s.cfg.EgressConnectTimeout; t > 0 && (deadline.IsZero() || time.Now().Add(t).Before(deadline)) {
+		deadline = time.Now().Add(t)
+	}
+	conn.SetDeadline(deadline)
+	tunnel := conn
+	switch s.proxy.Scheme {
+	case "socks5":
+		err = socks5Connect(conn, s.proxy.User, host, port)
+	case "https":
+		tc := tls.Client(conn, TLSConfig(s.proxy.Hostname()))
+		conn = tc
+		if err = tc.HandshakeContext(ctx); err == nil {
+			tunnel, err = httpConnect(tc, s.proxy.User, addr)
+		}
+	default:
+		tunnel, err = httpConnect(conn, s.proxy.User, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", s.proxy.Host, err)
+	}
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// bufferedConn reads first what was buffered past the proxy's reply.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// httpConnect asks an HTTP proxy on conn for a tunnel to addr.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if user != nil {
+		pass, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy on conn (RFC 1928) for a connection to
+// host:port, signing in with user (RFC 1929) if given.
+func socks5Connect(conn net.Conn, user *url.Userinfo, host, port string) error {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || len(host) > 255 {
+		return fmt.Errorf("bad address %s:%s", host, port)
+	}
+	method := byte(0x00) // no authentication
+	if user != nil {
+		method = 0x02 // username and password
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		msg := append([]byte{1, byte(len(user.Username()))}, user.Username()...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 proxy refused the credentials")
+		}
+	}
+
+	msg := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(p))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy refused the connection (reply %d)", head[1])
+	}
+	// skip the bound address the reply ends with
+	var n int
+	switch head[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return errors.New("SOCKS5 proxy sent a bad reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
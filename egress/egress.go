@@ -0,0 +1,160 @@
+// Package egress is how SCloud reaches other services. Webhooks, the audit
+// sinks, the extraction and preview services and SMTP all connect through
+// it, so the EGRESS_* settings (proxy, CA bundle, timeouts, retries) hold
+// for each of them alike rather than whatever the environment says.
+package egress
+
+import (
+	"SCloud/config"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// first wait before a retry; it doubles each time
+const retryBackoff = 500 * time.Millisecond
+
+type setup struct {
+	cfg       *config.Config
+	proxy     *url.URL // nil: none, or the environment's for HTTP
+	fromEnv   bool
+	tls       *tls.Config
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+var (
+	mu  sync.RWMutex
+	cur = build(&config.Config{EgressConnectTimeout: 10 * time.Second})
+)
+
+// Configure applies cfg's EGRESS_* settings to every connection made from
+// now on. Until it is called the defaults apply.
+func Configure(cfg *config.Config) {
+	s := build(cfg)
+	mu.Lock()
+	cur = s
+	mu.Unlock()
+}
+
+func current() *setup {
+	mu.RLock()
+	defer mu.RUnlock()
+	return cur
+}
+
+func build(cfg *config.Config) *setup {
+	s := &setup{
+		cfg:     cfg,
+		fromEnv: cfg.EgressProxy == "",
+		tls:     &tls.Config{RootCAs: cfg.EgressCAs, MinVersion: tls.VersionTLS12},
+		dialer:  &net.Dialer{Timeout: cfg.EgressConnectTimeout, KeepAlive: 30 * time.Second},
+	}
+	if !s.fromEnv && cfg.EgressProxy != "none" {
+		s.proxy, _ = url.Parse(cfg.EgressProxy) // LoadConfig checked it
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = s.proxyFor
+	t.DialContext = s.dialer.DialContext
+	t.TLSClientConfig = s.tls
+	t.TLSHandshakeTimeout = cfg.EgressConnectTimeout
+	t.ResponseHeaderTimeout = cfg.EgressResponseTimeout
+	s.transport = t
+	return s
+}
+
+func (s *setup) proxyFor(req *http.Request) (*url.URL, error) {
+	if s.fromEnv {
+		return http.ProxyFromEnvironment(req)
+	}
+	if s.proxy == nil || bypassed(s.cfg.EgressNoProxy, req.URL.Hostname()) {
+		return nil, nil
+	}
+	return s.proxy, nil
+}
+
+// bypassed reports whether EGRESS_NO_PROXY sends host direct.
+func bypassed(noProxy []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, n, err := net.ParseCIDR(entry); err == nil && ip != nil && n.Contains(ip) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TLSConfig is the client TLS configuration for serverName, trusting the
+// EGRESS_CA_BUNDLE CAs as well as the system's.
+func TLSConfig(serverName string) *tls.Config {
+	c := current().tls.Clone()
+	c.ServerName = serverName
+	return c
+}
+
+// Transport sends HTTP requests out through the configured egress, trying
+// again after a failure to connect or a 502, 503 or 504, up to
+// EGRESS_RETRIES times, when the request's body can be sent again. A
+// request may so arrive twice, if the first reply was lost on the way.
+var Transport http.RoundTripper = retrier{}
+
+// Client is an HTTP client over Transport giving up after timeout; 0 sets
+// no limit beyond the request's context.
+func Client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Transport, Timeout: timeout}
+}
+
+type retrier struct{}
+
+func (retrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := current()
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for try := 0; ; try++ {
+		resp, err := s.transport.RoundTrip(req)
+		if try >= s.cfg.EgressRetries || !replayable || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(retryBackoff << try):
+		}
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		req = next
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type names a storage mutation. Consumers (changes feed, webhooks, SSE,
+// audit, replication) switch on it instead of hooking into storage directly.
+type Type string
+
+const (
+	FileCreated Type = "file.created"
+	FileUpdated Type = "file.updated"
+	FileDeleted Type = "file.deleted"
+	DirCreated  Type = "dir.created"
+	DirDeleted  Type = "dir.deleted"
+	MetaUpdated Type = "meta.updated"
+	// an upload based on a stale revision of Path was kept as Copy
+	FileConflict Type = "file.conflict"
+	// a file was set aside, or let out again, by an admin or a scan
+	FileQuarantined Type = "file.quarantined"
+	FileReleased    Type = "file.released"
+
+	// usage crossed an alert threshold: Path is the org (QuotaAlert) or the
+	// storage directory (DiskAlert), Size the bytes used, Level the percent
+	QuotaAlert Type = "quota.alert"
+	DiskAlert  Type = "disk.alert"
+
+	// anomaly detection fired: Path is the user ID, or the client address
+	// for failures no account is known for, Level the count that tripped it
+	// and Size the bytes downloaded
+	AnomalyTravel       Type = "anomaly.travel"
+	AnomalyDownloads    Type = "anomaly.downloads"
+	AnomalyAuthFailures Type = "anomaly.auth_failures"
+	// a honeytoken file was read: Path is the file, Detail the request
+	HoneytokenRead Type = "honeytoken.read"
+)
+
+// Alert reports whether t is an alert rather than a storage mutation; its
+// Path may not be a file, and it is for admins only.
+func (t Type) Alert() bool {
+	switch t {
+	case QuotaAlert, DiskAlert, AnomalyTravel, AnomalyDownloads, AnomalyAuthFailures, HoneytokenRead:
+		return true
+	}
+	return false
+}
+
+type Event struct {
+	Seq    uint64 `json:"seq"`
+	Type   Type   `json:"type"`
+	Path   string `json:"path"` // logical path
+	Copy   string `json:"copy,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Level  int    `json:"level,omitempty"`
+	Detail string `json:"detail,omitempty"` // alerts: what happened, in words
+	Time   int64  `json:"time"`
+}
+
+const (
+	journalSize   = 4096 // events kept in memory for Since()
+	subscriberBuf = 256
+)
+
+type bus struct {
+	mu      sync.Mutex
+	seq     uint64
+	journal []Event // ring buffer
+	next    int
+	full    bool
+	subs    map[int]chan Event
+	subID   int
+}
+
+var defaultBus = &bus{
+	journal: make([]Event, journalSize),
+	subs:    map[int]chan Event{},
+}
+
+// Publish stamps the event with a sequence number and time, appends it to the
+// journal and fans it out. Slow subscribers drop events rather than block storage.
+func Publish(e Event) Event {
+	b := defaultBus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+
+	b.journal[b.next] = e
+	b.next = (b.next + 1) % journalSize
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	return e
+}
+
+// Subscribe returns a channel receiving every future event and a func to stop.
+func Subscribe() (<-chan Event, func()) {
+	b := defaultBus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subID++
+	id := b.subID
+	ch := make(chan Event, subscriberBuf)
+	b.subs[id] = ch
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if c, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			close(c)
+		}
+	}
+}
+
+// Since returns journaled events with Seq > seq, oldest first. Events that
+// have rotated out of the journal are gone; callers compare against Oldest().
+func Since(seq uint64) []Event {
+	b := defaultBus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := []Event{}
+	for _, e := range b.ordered() {
+		if e.Seq > seq {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Oldest returns the lowest sequence number still held in the journal (0 if empty).
+func Oldest() uint64 {
+	b := defaultBus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ev := b.ordered()
+	if len(ev) == 0 {
+		return 0
+	}
+	return ev[0].Seq
+}
+
+func (b *bus) ordered() []Event {
+	if !b.full {
+		return b.journal[:b.next]
+	}
+	out := make([]Event, 0, journalSize)
+	out = append(out, b.journal[b.next:]...)
+	return append(out, b.journal[:b.next]...)
+}
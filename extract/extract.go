@@ -0,0 +1,127 @@
+package extract
+
+import (
+	"SCloud/config"
+	"SCloud/egress"
+	"SCloud/jobs"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MaxText bounds the text kept from one document.
+const MaxText = 4 << 20
+
+// Extractor turns a document (a scan, a photo, a PDF) into plain text.
+type Extractor interface {
+	Extract(ctx context.Context, name string, r io.Reader, size int64) (string, error)
+}
+
+// HTTP sends documents to a text extraction service: the body is PUT to URL
+// and the plain-text reply is the result. Apache Tika's /tika endpoint
+// works as is, with Tesseract behind it for OCR; other services can sit
+// behind a small adapter speaking the same.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (x HTTP) Extract(ctx context.Context, name string, r io.Reader, size int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, x.URL, r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Accept", "text/plain")
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+	client := x.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusUnprocessableEntity, http.StatusUnsupportedMediaType:
+		// nothing to read in it
+		return "", nil
+	default:
+		return "", fmt.Errorf("extraction service: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, MaxText))
+	return strings.ToValidUTF8(string(b), ""), err
+}
+
+// Wanted reports whether a file of this name goes to the extractor: images
+// and PDFs, whose text the server cannot read itself.
+func Wanted(name string) bool {
+	ct, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))))
+	return strings.HasPrefix(ct, "image/") || ct == "application/pdf"
+}
+
+// ErrGone is returned by Task.Open for a document removed or rewritten
+// since it was queued; the task is dropped.
+var ErrGone = errors.New("document gone")
+
+// Task is one document to extract. Open returns its plaintext and size;
+// Store receives the text, which may be empty.
+type Task struct {
+	Path  string
+	Open  func() (io.ReadCloser, int64, error)
+	Store func(text string) error
+}
+
+// Queue runs extraction tasks in an "extract" background job.
+type Queue struct {
+	Extractor Extractor
+	Timeout   time.Duration
+	jobs      *jobs.Queue
+}
+
+// New returns a queue sending to EXTRACT_URL, or nil when it is not set.
+func New(cfg *config.Config, runner *jobs.Runner, logger *log.Logger) *Queue {
+	if cfg.ExtractURL == "" {
+		return nil
+	}
+	return &Queue{
+		Extractor: HTTP{URL: cfg.ExtractURL, Client: egress.Client(0)},
+		Timeout:   cfg.ExtractTimeout,
+		jobs:      &jobs.Queue{Name: "extract", Runner: runner, Log: logger, Attempts: 2, RetryDelay: 10 * time.Second},
+	}
+}
+
+// Add queues t.
+func (q *Queue) Add(t Task) {
+	q.jobs.Add(jobs.Task{Desc: t.Path, Run: func() error { return q.run(t) }})
+}
+
+func (q *Queue) run(t Task) error {
+	rc, size, err := t.Open()
+	if errors.Is(err, ErrGone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), q.Timeout)
+	defer cancel()
+	text, err := q.Extractor.Extract(ctx, t.Path, rc, size)
+	if err != nil {
+		return err
+	}
+	return t.Store(text)
+}
@@ -0,0 +1,627 @@
+package ftpd
+
+import (
+	"SCloud/sftpd"
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server is an FTP server (RFC 959) with explicit TLS (RFC 4217) over the
+// same trees sftpd serves. It speaks what scanners, cameras and phone
+// systems need: passive and active transfers, listings, RETR with REST,
+// STOR, renames and directory changes. Files are always sent as binary.
+type Server struct {
+	// TLS enables AUTH TLS; nil serves plain FTP only.
+	TLS *tls.Config
+	// AllowPlain lets users sign in without AUTH TLS first.
+	AllowPlain bool
+	// PassivePorts bounds the ports PASV listens on; zero picks any.
+	PassivePorts [2]int
+	// PublicIP is announced in PASV replies, for servers behind NAT; nil
+	// announces the address the client connected to.
+	PublicIP net.IP
+
+	Password func(user, password string, remote net.Addr) (string, error)
+	FS       func(userID string) (sftpd.FS, error)
+	Log      *log.Logger
+}
+
+const (
+	idleTimeout = 5 * time.Minute
+	dataTimeout = 30 * time.Second
+	maxFails    = 3
+)
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+// session is one control connection.
+type session struct {
+	s    *Server
+	ctrl net.Conn
+	r    *bufio.Reader
+
+	secure bool // control channel is TLS
+	protP  bool // data channels are TLS too
+
+	user   string
+	userID string
+	fails  int
+	tree   sftpd.FS
+	cwd    string // absolute, slash-separated
+
+	pasv   net.Listener
+	active string // PORT/EPRT address
+	rest   int64
+	from   string // RNFR path
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	ss := &session{s: s, ctrl: c, r: bufio.NewReader(c), cwd: "/"}
+	defer func() {
+		ss.closeData()
+		ss.ctrl.Close()
+	}()
+	ss.reply(220, "SCloud FTP ready")
+	for {
+		ss.ctrl.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := ss.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !ss.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+func (ss *session) reply(code int, format string, args ...any) {
+	fmt.Fprintf(ss.ctrl, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+// handle runs one command; false ends the session.
+func (ss *session) handle(cmd, arg string) bool {
+	switch cmd {
+	case "AUTH":
+		if ss.s.TLS == nil || ss.secure || !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "SSL") {
+			ss.reply(504, "AUTH TLS not available")
+			return true
+		}
+		ss.reply(234, "Proceed with TLS")
+		tc := tls.Server(ss.ctrl, ss.s.TLS)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		ss.ctrl, ss.r, ss.secure = tc, bufio.NewReader(tc), true
+		return true
+	case "PBSZ":
+		ss.reply(200, "PBSZ=0")
+		return true
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "P":
+			if !ss.secure {
+				ss.reply(503, "AUTH TLS first")
+				return true
+			}
+			ss.protP = true
+		case "C":
+			ss.protP = false
+		default:
+			ss.reply(504, "PROT %s not supported", arg)
+			return true
+		}
+		ss.reply(200, "PROT %s", strings.ToUpper(arg))
+		return true
+	case "USER":
+		if !ss.secure && !ss.s.AllowPlain {
+			ss.reply(530, "AUTH TLS first")
+			return true
+		}
+		ss.user, ss.userID, ss.tree = arg, "", nil
+		ss.reply(331, "Password required")
+		return true
+	case "PASS":
+		return ss.login(arg)
+	case "QUIT":
+		ss.reply(221, "Bye")
+		return false
+	case "NOOP":
+		ss.reply(200, "OK")
+		return true
+	case "ABOR":
+		// transfers run to completion before the next command is read
+		ss.reply(225, "No transfer in progress")
+		return true
+	case "SYST":
+		ss.reply(215, "UNIX Type: L8")
+		return true
+	case "FEAT":
+		fmt.Fprint(ss.ctrl, "211-Features:\r\n")
+		if ss.s.TLS != nil {
+			fmt.Fprint(ss.ctrl, " AUTH TLS\r\n PBSZ\r\n PROT\r\n")
+		}
+		fmt.Fprint(ss.ctrl, " EPSV\r\n EPRT\r\n MLST type*;size*;modify*;\r\n MDTM\r\n MFMT\r\n SIZE\r\n REST STREAM\r\n UTF8\r\n")
+		ss.reply(211, "End")
+		return true
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			ss.reply(200, "UTF8 is always on")
+		} else {
+			ss.reply(501, "Option not understood")
+		}
+		return true
+	}
+
+	if ss.tree == nil {
+		ss.reply(530, "Not logged in")
+		return true
+	}
+	switch cmd {
+	case "PWD", "XPWD":
+		ss.reply(257, "%q is the current directory", ss.cwd)
+	case "CWD", "XCWD":
+		ss.cwdTo(ss.abs(arg))
+	case "CDUP", "XCUP":
+		ss.cwdTo(path.Dir(ss.cwd))
+	case "TYPE", "MODE", "STRU":
+		// only binary streams of files are sent; A and the defaults are accepted
+		ss.reply(200, "OK")
+	case "PASV", "EPSV":
+		ss.passive(cmd == "EPSV")
+	case "PORT", "EPRT":
+		ss.port(cmd == "EPRT", arg)
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			ss.reply(501, "Bad offset")
+			return true
+		}
+		ss.rest = n
+		ss.reply(350, "Restarting at %d", n)
+	case "LIST", "NLST", "MLSD":
+		ss.list(cmd, arg)
+	case "MLST":
+		fi, err := ss.tree.Stat(ss.fsPath(ss.abs(arg)))
+		if err != nil {
+			ss.fail(err)
+			return true
+		}
+		fmt.Fprintf(ss.ctrl, "250-Listing\r\n %s\r\n", factLine(fi, ss.abs(arg)))
+		ss.reply(250, "End")
+	case "SIZE", "MDTM":
+		fi, err := ss.tree.Stat(ss.fsPath(ss.abs(arg)))
+		if err == nil && fi.Dir {
+			err = fmt.Errorf("not a file")
+		}
+		if err != nil {
+			ss.fail(err)
+		} else if cmd == "SIZE" {
+			ss.reply(213, "%d", fi.Size)
+		} else {
+			ss.reply(213, "%s", fi.ModTime.UTC().Format("20060102150405"))
+		}
+	case "MFMT":
+		// MFMT YYYYMMDDHHMMSS path, in UTC
+		stamp, name, _ := strings.Cut(arg, " ")
+		t, err := time.Parse("20060102150405", stamp)
+		if err != nil || name == "" {
+			ss.reply(501, "Usage: MFMT YYYYMMDDHHMMSS path")
+			return true
+		}
+		p := ss.abs(name)
+		ss.done(ss.tree.Chtimes(ss.fsPath(p), t), 213, fmt.Sprintf("Modify=%s; %s", stamp, p))
+	case "RETR":
+		ss.retr(ss.fsPath(ss.abs(arg)))
+	case "STOR":
+		ss.stor(ss.fsPath(ss.abs(arg)))
+	case "DELE":
+		ss.done(ss.tree.Remove(ss.fsPath(ss.abs(arg))), 250, "Deleted")
+	case "MKD", "XMKD":
+		p := ss.abs(arg)
+		if err := ss.tree.Mkdir(ss.fsPath(p)); err != nil {
+			ss.fail(err)
+		} else {
+			ss.reply(257, "%q created", p)
+		}
+	case "RMD", "XRMD":
+		ss.done(ss.tree.Rmdir(ss.fsPath(ss.abs(arg))), 250, "Removed")
+	case "RNFR":
+		if _, err := ss.tree.Stat(ss.fsPath(ss.abs(arg))); err != nil {
+			ss.fail(err)
+			return true
+		}
+		ss.from = ss.abs(arg)
+		ss.reply(350, "Ready for RNTO")
+	case "RNTO":
+		if ss.from == "" {
+			ss.reply(503, "RNFR first")
+			return true
+		}
+		from := ss.from
+		ss.from = ""
+		ss.done(ss.tree.Rename(ss.fsPath(from), ss.fsPath(ss.abs(arg))), 250, "Renamed")
+	default:
+		ss.reply(502, "%s not implemented", cmd)
+	}
+	return true
+}
+
+func (ss *session) login(password string) bool {
+	if ss.user == "" {
+		ss.reply(503, "USER first")
+		return true
+	}
+	id, err := ss.s.Password(ss.user, password, ss.ctrl.RemoteAddr())
+	if err == nil {
+		ss.tree, err = ss.s.FS(id)
+	}
+	if err != nil {
+		ss.s.Log.Printf("ftp: login %q from %s: %v", ss.user, ss.ctrl.RemoteAddr(), err)
+		ss.fails++
+		ss.reply(530, "Login incorrect")
+		return ss.fails < maxFails
+	}
+	ss.userID = id
+	ss.s.Log.Printf("ftp: %s signed in from %s", ss.user, ss.ctrl.RemoteAddr())
+	ss.reply(230, "Logged in")
+	return true
+}
+
+// abs resolves a client path against the working directory. ".." stops at
+// the user's root.
+func (ss *session) abs(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(ss.cwd, p)
+	}
+	return path.Clean("/" + p)
+}
+
+// fsPath turns an absolute session path into a tree path.
+func (ss *session) fsPath(abs string) string {
+	if abs == "/" {
+		return "."
+	}
+	return abs[1:]
+}
+
+func (ss *session) cwdTo(abs string) {
+	fi, err := ss.tree.Stat(ss.fsPath(abs))
+	if err == nil && !fi.Dir {
+		err = fmt.Errorf("not a directory")
+	}
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	ss.cwd = abs
+	ss.reply(250, "Directory is %q", abs)
+}
+
+func (ss *session) done(err error, code int, msg string) {
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	ss.reply(code, "%s", msg)
+}
+
+func (ss *session) fail(err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		ss.reply(550, "No such file or directory")
+	case errors.Is(err, fs.ErrPermission):
+		ss.reply(550, "Permission denied")
+	default:
+		ss.reply(550, "%s", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+}
+
+func (ss *session) list(cmd, arg string) {
+	// LIST -la and friends: the flags are ignored
+	if strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	abs := ss.abs(arg)
+	fi, err := ss.tree.Stat(ss.fsPath(abs))
+	var entries []sftpd.FileInfo
+	switch {
+	case err != nil:
+	case fi.Dir:
+		entries, err = ss.tree.ReadDir(ss.fsPath(abs))
+	case cmd == "MLSD":
+		err = fmt.Errorf("not a directory")
+	default:
+		fi.Name = path.Base(abs)
+		entries = []sftpd.FileInfo{fi}
+	}
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	ss.transfer(func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for _, e := range entries {
+			switch cmd {
+			case "NLST":
+				fmt.Fprintf(bw, "%s\r\n", e.Name)
+			case "MLSD":
+				fmt.Fprintf(bw, "%s\r\n", factLine(e, e.Name))
+			default:
+				fmt.Fprintf(bw, "%s\r\n", listLine(e))
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+func listLine(fi sftpd.FileInfo) string {
+	mode := "-rw-r--r--"
+	if fi.Dir {
+		mode = "drwxr-xr-x"
+	}
+	stamp := fi.ModTime.Format("Jan _2 15:04")
+	if time.Since(fi.ModTime) > 180*24*time.Hour {
+		stamp = fi.ModTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, fi.Size, stamp, fi.Name)
+}
+
+// factLine is an RFC 3659 MLSx entry.
+func factLine(fi sftpd.FileInfo, name string) string {
+	typ := "file"
+	if fi.Dir {
+		typ = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s; %s", typ, fi.Size, fi.ModTime.UTC().Format("20060102150405"), name)
+}
+
+func (ss *session) retr(p string) {
+	off := ss.rest
+	ss.rest = 0
+	fi, err := ss.tree.Stat(p)
+	if err == nil && fi.Dir {
+		err = fmt.Errorf("is a directory")
+	}
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	r, err := ss.tree.Open(p, off)
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	defer r.Close()
+	ss.transfer(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (ss *session) stor(p string) {
+	if ss.rest != 0 {
+		ss.rest = 0
+		ss.reply(504, "Uploads cannot be resumed; send the whole file")
+		return
+	}
+	u, err := ss.tree.Create(p)
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+	ss.transferIn(u)
+}
+
+// openData connects the data channel set up by PASV or PORT.
+func (ss *session) openData() (net.Conn, error) {
+	defer ss.closeData()
+	var c net.Conn
+	switch {
+	case ss.pasv != nil:
+		if tl, ok := ss.pasv.(*net.TCPListener); ok {
+			tl.SetDeadline(time.Now().Add(dataTimeout))
+		}
+		var err error
+		if c, err = ss.pasv.Accept(); err != nil {
+			return nil, err
+		}
+		// only the client on the control connection may take the channel
+		if !sameHost(c.RemoteAddr(), ss.ctrl.RemoteAddr()) {
+			c.Close()
+			return nil, fmt.Errorf("data connection from another host")
+		}
+	case ss.active != "":
+		var err error
+		if c, err = net.DialTimeout("tcp", ss.active, dataTimeout); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("use PASV or PORT first")
+	}
+	if ss.protP {
+		c.SetDeadline(time.Now().Add(dataTimeout))
+		tc := tls.Server(c, ss.s.TLS)
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	return c, nil
+}
+
+func (ss *session) closeData() {
+	if ss.pasv != nil {
+		ss.pasv.Close()
+		ss.pasv = nil
+	}
+	ss.active = ""
+}
+
+// transfer sends what fill writes over a new data connection.
+func (ss *session) transfer(fill func(w io.Writer) error) {
+	ss.reply(150, "Opening data connection")
+	c, err := ss.openData()
+	if err != nil {
+		ss.reply(425, "Cannot open data connection: %v", err)
+		return
+	}
+	c.SetDeadline(time.Now().Add(idleTimeout))
+	err = fill(&deadlineWriter{c})
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		ss.reply(426, "Transfer aborted: %v", err)
+		return
+	}
+	ss.reply(226, "Transfer complete")
+}
+
+// transferIn receives a file into u over a new data connection.
+func (ss *session) transferIn(u sftpd.Upload) {
+	ss.reply(150, "Ready to receive")
+	c, err := ss.openData()
+	if err != nil {
+		u.Abort()
+		ss.reply(425, "Cannot open data connection: %v", err)
+		return
+	}
+	_, err = io.Copy(u, &deadlineReader{c})
+	c.Close()
+	if err != nil {
+		u.Abort()
+		ss.reply(426, "Transfer aborted: %v", err)
+		return
+	}
+	if err := u.Close(); err != nil {
+		ss.reply(451, "Storing failed: %v", err)
+		return
+	}
+	ss.reply(226, "Transfer complete")
+}
+
+// deadlineReader and deadlineWriter keep a stalled data connection from
+// outliving idleTimeout.
+type deadlineReader struct{ c net.Conn }
+
+func (d *deadlineReader) Read(b []byte) (int, error) {
+	d.c.SetReadDeadline(time.Now().Add(idleTimeout))
+	return d.c.Read(b)
+}
+
+type deadlineWriter struct{ c net.Conn }
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+	d.c.SetWriteDeadline(time.Now().Add(idleTimeout))
+	return d.c.Write(b)
+}
+
+func (ss *session) passive(extended bool) {
+	ss.closeData()
+	l, err := ss.s.listenPassive(ss.ctrl.LocalAddr())
+	if err != nil {
+		ss.reply(425, "Cannot open passive port: %v", err)
+		return
+	}
+	ss.pasv = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		ss.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+		return
+	}
+	ip := ss.s.PublicIP
+	if ip == nil {
+		if a, ok := ss.ctrl.LocalAddr().(*net.TCPAddr); ok {
+			ip = a.IP
+		}
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ss.closeData()
+		ss.reply(522, "PASV needs IPv4; use EPSV")
+		return
+	}
+	ss.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+}
+
+func (s *Server) listenPassive(local net.Addr) (net.Listener, error) {
+	host := ""
+	if a, ok := local.(*net.TCPAddr); ok {
+		host = a.IP.String()
+	}
+	if s.PassivePorts[0] == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	var err error
+	for p := s.PassivePorts[0]; p <= s.PassivePorts[1]; p++ {
+		var l net.Listener
+		if l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d: %w", s.PassivePorts[0], s.PassivePorts[1], err)
+}
+
+// port takes the address of an active-mode data connection. Only the
+// client's own address is accepted, so the server cannot be bounced onto
+// other hosts.
+func (ss *session) port(extended bool, arg string) {
+	ss.closeData()
+	var addr string
+	if extended {
+		// EPRT |proto|host|port|
+		f := strings.Split(arg, "|")
+		if len(f) != 5 {
+			ss.reply(501, "Bad EPRT")
+			return
+		}
+		addr = net.JoinHostPort(f[2], f[3])
+	} else {
+		f := strings.Split(arg, ",")
+		if len(f) != 6 {
+			ss.reply(501, "Bad PORT")
+			return
+		}
+		hi, err1 := strconv.Atoi(f[4])
+		lo, err2 := strconv.Atoi(f[5])
+		if err1 != nil || err2 != nil || hi < 0 || hi > 255 || lo < 0 || lo > 255 {
+			ss.reply(501, "Bad PORT")
+			return
+		}
+		addr = net.JoinHostPort(strings.Join(f[:4], "."), strconv.Itoa(hi<<8|lo))
+	}
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || a.Port < 1024 || !sameHost(a, ss.ctrl.RemoteAddr()) {
+		ss.reply(504, "Data connections only go back to the client")
+		return
+	}
+	ss.active = a.String()
+	ss.reply(200, "PORT OK")
+}
+
+func sameHost(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && ta.IP.Equal(tb.IP)
+}
@@ -0,0 +1,445 @@
+// Package graphql runs GraphQL requests against a schema of resolver funcs.
+// It covers what a web frontend sends: queries and mutations with
+// variables, aliases, fragments, @skip/@include and __typename. There is no
+// introspection and there are no subscriptions.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// maxDepth bounds how deep selections nest, so a request cannot make the
+// server walk a recursive graph without end.
+const maxDepth = 16
+
+// Schema is the graph requests run against. Mutation may be nil.
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+}
+
+// Object is a type of the graph. Fields resolve lazily: only those a request
+// selects run.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field is one field of an Object. Type is the object its values are, nil
+// for scalars; a resolver returning a slice makes the field a list. Without
+// Resolve the value is looked up by field name in a map source.
+type Field struct {
+	Type    *Object
+	Args    map[string]Arg
+	Resolve func(p Params) (any, error)
+}
+
+// Arg declares an argument by its type as the schema language writes it
+// ("String!", "[String]", "Int", "Boolean", "JSON") and its default.
+type Arg struct {
+	Type    string
+	Default any
+}
+
+// Params is what a resolver gets. Args hold every declared argument,
+// coerced: string, int64, float64, bool, []any, map[string]any or nil.
+type Params struct {
+	Context context.Context
+	Source  any
+	Args    map[string]any
+}
+
+// Request is one GraphQL request as clients POST it.
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type Response struct {
+	Data   any     `json:"data"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Execute runs req. Errors in single fields null those fields and are
+// listed next to the data; errors in the request itself leave data null.
+func (s *Schema) Execute(ctx context.Context, req Request) Response {
+	fail := func(err error) Response { return Response{Errors: []Error{{Message: err.Error()}}} }
+	doc, err := parse(req.Query)
+	if err != nil {
+		return fail(err)
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return fail(err)
+	}
+	root := s.Query
+	if op.kind == "mutation" {
+		root = s.Mutation
+	}
+	if root == nil {
+		return fail(fmt.Errorf("%ss are not supported", op.kind))
+	}
+	vars := map[string]any{}
+	for _, v := range op.vars {
+		val, given := req.Variables[v.name]
+		if !given {
+			val = v.def
+		}
+		if vars[v.name], err = coerce(val, v.typ); err != nil {
+			return fail(fmt.Errorf("variable $%s: %w", v.name, err))
+		}
+	}
+	e := &execution{ctx: ctx, doc: doc, vars: vars}
+	data := e.selectionSet(root, nil, op.sel, nil)
+	return Response{Data: data, Errors: e.errs}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.ops) > 1 {
+			return nil, fmt.Errorf("operationName is required for a document with several operations")
+		}
+		return d.ops[0], nil
+	}
+	for _, op := range d.ops {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("no operation named %q", name)
+}
+
+type execution struct {
+	ctx  context.Context
+	doc  *document
+	vars map[string]any
+	errs []Error
+}
+
+func (e *execution) fail(path []any, err error) {
+	e.errs = append(e.errs, Error{Message: err.Error(), Path: append([]any(nil), path...)})
+}
+
+func (e *execution) selectionSet(obj *Object, src any, sel []selection, path []any) *ordered {
+	keys, fields := map[string][]selection{}, &ordered{}
+	if err := e.collect(obj, sel, keys, fields, map[string]bool{}); err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	for _, key := range fields.keys {
+		fields.vals[key] = e.field(obj, src, keys[key], append(path, key))
+	}
+	return fields
+}
+
+// collect groups the fields sel selects on obj by response key, in order,
+// flattening fragments and applying @skip/@include.
+func (e *execution) collect(obj *Object, sel []selection, keys map[string][]selection, out *ordered, seen map[string]bool) error {
+	for _, s := range sel {
+		include, err := e.included(s.dirs)
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			f := e.doc.fragments[s.spread]
+			if f == nil {
+				return fmt.Errorf("unknown fragment %q", s.spread)
+			}
+			if seen[s.spread] || f.on != obj.Name {
+				continue
+			}
+			seen[s.spread] = true
+			if err := e.collect(obj, f.sel, keys, out, seen); err != nil {
+				return err
+			}
+		case s.inline:
+			if s.on != "" && s.on != obj.Name {
+				continue
+			}
+			if err := e.collect(obj, s.sel, keys, out, seen); err != nil {
+				return err
+			}
+		default:
+			key := s.alias
+			if key == "" {
+				key = s.name
+			}
+			if _, ok := keys[key]; !ok {
+				out.add(key, nil)
+			}
+			keys[key] = append(keys[key], s)
+		}
+	}
+	return nil
+}
+
+func (e *execution) included(dirs []directive) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		v, err := e.resolveVars(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if", d.name)
+		}
+		if b == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// field resolves one response key; all selections share name and
+// arguments, and their sub-selections are merged.
+func (e *execution) field(obj *Object, src any, same []selection, path []any) any {
+	s := same[0]
+	if s.name == "__typename" {
+		return obj.Name
+	}
+	f := obj.Fields[s.name]
+	if f == nil {
+		e.fail(path, fmt.Errorf("no field %q on %s", s.name, obj.Name))
+		return nil
+	}
+	if len(path) > maxDepth {
+		e.fail(path, fmt.Errorf("query nests deeper than %d", maxDepth))
+		return nil
+	}
+	args := map[string]any{}
+	for name := range s.args {
+		if _, ok := f.Args[name]; !ok {
+			e.fail(path, fmt.Errorf("unknown argument %q on %s.%s", name, obj.Name, s.name))
+			return nil
+		}
+	}
+	for name, a := range f.Args {
+		v, given := s.args[name]
+		if !given {
+			v = a.Default
+		}
+		v, err := e.resolveVars(v)
+		if err == nil {
+			v, err = coerce(v, a.Type)
+		}
+		if err != nil {
+			e.fail(path, fmt.Errorf("argument %q: %w", name, err))
+			return nil
+		}
+		args[name] = v
+	}
+
+	var v any
+	var err error
+	if f.Resolve != nil {
+		v, err = f.Resolve(Params{Context: e.ctx, Source: src, Args: args})
+	} else if m := reflect.ValueOf(src); m.Kind() == reflect.Map && m.Type().Key().Kind() == reflect.String {
+		if x := m.MapIndex(reflect.ValueOf(s.name).Convert(m.Type().Key())); x.IsValid() {
+			v = x.Interface()
+		}
+	} else {
+		err = fmt.Errorf("%s.%s has no resolver", obj.Name, s.name)
+	}
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+	var sub []selection
+	for _, s := range same {
+		sub = append(sub, s.sel...)
+	}
+	return e.complete(f.Type, v, sub, path)
+}
+
+// complete shapes a resolved value after its type: lists element by element,
+// objects through their selection, scalars as they are.
+func (e *execution) complete(typ *Object, v any, sel []selection, path []any) any {
+	rv := reflect.ValueOf(v)
+	switch {
+	case v == nil, rv.Kind() == reflect.Pointer && rv.IsNil():
+		return nil
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8:
+		out := make([]any, rv.Len())
+		for i := range out {
+			out[i] = e.complete(typ, rv.Index(i).Interface(), sel, append(path, i))
+		}
+		return out
+	case typ != nil:
+		if len(sel) == 0 {
+			e.fail(path, fmt.Errorf("a %s needs a selection of fields", typ.Name))
+			return nil
+		}
+		return e.selectionSet(typ, v, sel, path)
+	case len(sel) > 0:
+		e.fail(path, fmt.Errorf("scalar fields take no selection"))
+		return nil
+	}
+	return v
+}
+
+// resolveVars replaces variable references in v with their values.
+func (e *execution) resolveVars(v any) (any, error) {
+	switch v := v.(type) {
+	case variable:
+		val, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("undeclared variable $%s", v)
+		}
+		return val, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, x := range v {
+			var err error
+			if out[i], err = e.resolveVars(x); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, x := range v {
+			var err error
+			if out[k], err = e.resolveVars(x); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// coerce checks v against typ and converts it to the Go value resolvers see.
+func coerce(v any, typ string) (any, error) {
+	if t, required := strings.CutSuffix(typ, "!"); required {
+		if v == nil {
+			return nil, fmt.Errorf("a %s is required", typ)
+		}
+		typ = t
+	}
+	if v == nil {
+		return nil, nil
+	}
+	if inner, ok := strings.CutPrefix(typ, "["); ok {
+		inner = strings.TrimSuffix(inner, "]")
+		list, ok := v.([]any)
+		if !ok {
+			// a single value stands for a list of one
+			list = []any{v}
+		}
+		out := make([]any, len(list))
+		for i, x := range list {
+			var err error
+			if out[i], err = coerce(x, inner); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	switch typ {
+	case "String", "ID":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "Int":
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case float64:
+			// JSON variables arrive as floats
+			if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+				return int64(n), nil
+			}
+		case json.Number:
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+		}
+	case "Float":
+		switch n := v.(type) {
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "JSON":
+		return plain(v), nil
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%v is not a %s", v, typ)
+}
+
+// plain turns enum literals back into strings inside a JSON argument.
+func plain(v any) any {
+	switch v := v.(type) {
+	case enumValue:
+		return string(v)
+	case []any:
+		for i := range v {
+			v[i] = plain(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = plain(v[k])
+		}
+	}
+	return v
+}
+
+// ordered is a JSON object that keeps its keys in the order the request
+// selected them.
+type ordered struct {
+	keys []string
+	vals map[string]any
+}
+
+func (o *ordered) add(key string, v any) {
+	if o.vals == nil {
+		o.vals = map[string]any{}
+	}
+	o.keys = append(o.keys, key)
+	o.vals[key] = v
+}
+
+func (o *ordered) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		val, err := json.Marshal(o.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,542 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// document is a parsed request: its operations and fragments.
+type document struct {
+	ops       []*operation
+	fragments map[string]*fragment
+}
+
+type operation struct {
+	kind string // "query" or "mutation"
+	name string
+	vars []varDef
+	sel  []selection
+}
+
+type varDef struct {
+	name string
+	typ  string // as written, e.g. "[String!]!"
+	def  any    // nil when there is no default
+}
+
+type fragment struct {
+	on  string
+	sel []selection
+}
+
+// selection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set).
+type selection struct {
+	alias, name string
+	args        map[string]any
+	dirs        []directive
+	sel         []selection
+
+	spread string
+	inline bool
+	on     string
+}
+
+type directive struct {
+	name string
+	args map[string]any
+}
+
+// variable is a $name reference inside a value, resolved at execution.
+type variable string
+
+// enumValue is a bare name used as a value.
+type enumValue string
+
+type token struct {
+	kind byte // 'n' name, 'i' int, 'f' float, 's' string, 'p' punctuator, 0 end
+	val  string
+	pos  int
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+func parse(src string) (*document, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.tok.kind != 0 {
+		switch {
+		case p.is('p', "{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, &operation{kind: "query", sel: sel})
+		case p.is('n', "query"), p.is('n', "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, op)
+		case p.is('n', "fragment"):
+			if err := p.fragment(doc); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf("unexpected %q", p.tok.val)
+		}
+	}
+	if len(doc.ops) == 0 {
+		return nil, fmt.Errorf("no operation in document")
+	}
+	return doc, nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:p.tok.pos], "\n")
+	return fmt.Errorf("syntax error at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) is(kind byte, val string) bool {
+	return p.tok.kind == kind && p.tok.val == val
+}
+
+func (p *parser) expect(kind byte, val string) error {
+	if !p.is(kind, val) {
+		return p.errorf("expected %q, got %q", val, p.tok.val)
+	}
+	return p.next()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.errorf("expected a name, got %q", p.tok.val)
+	}
+	n := p.tok.val
+	return n, p.next()
+}
+
+func (p *parser) operation() (*operation, error) {
+	op := &operation{kind: p.tok.val}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == 'n' {
+		op.name = p.tok.val
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is('p', "(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.is('p', ")") {
+			if err := p.expect('p', "$"); err != nil {
+				return nil, err
+			}
+			var v varDef
+			var err error
+			if v.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect('p', ":"); err != nil {
+				return nil, err
+			}
+			if v.typ, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if p.is('p', "=") {
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+				if v.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			op.vars = append(op.vars, v)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	op.sel = sel
+	return op, err
+}
+
+func (p *parser) typeRef() (string, error) {
+	var t string
+	if p.is('p', "[") {
+		if err := p.next(); err != nil {
+			return "", err
+		}
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect('p', "]"); err != nil {
+			return "", err
+		}
+		t = "[" + inner + "]"
+	} else {
+		n, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		t = n
+	}
+	if p.is('p', "!") {
+		t += "!"
+		return t, p.next()
+	}
+	return t, nil
+}
+
+func (p *parser) fragment(doc *document) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	if err := p.expect('n', "on"); err != nil {
+		return err
+	}
+	f := &fragment{}
+	if f.on, err = p.name(); err != nil {
+		return err
+	}
+	if _, err := p.directives(); err != nil {
+		return err
+	}
+	if f.sel, err = p.selectionSet(); err != nil {
+		return err
+	}
+	if _, dup := doc.fragments[name]; dup {
+		return fmt.Errorf("fragment %q defined twice", name)
+	}
+	doc.fragments[name] = f
+	return nil
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.expect('p', "{"); err != nil {
+		return nil, err
+	}
+	var out []selection
+	for !p.is('p', "}") {
+		if p.tok.kind == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	if len(out) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return out, p.next()
+}
+
+func (p *parser) selection() (selection, error) {
+	var s selection
+	var err error
+	if p.is('p', "...") {
+		if err := p.next(); err != nil {
+			return s, err
+		}
+		if p.tok.kind == 'n' && p.tok.val != "on" {
+			s.spread = p.tok.val
+			if err := p.next(); err != nil {
+				return s, err
+			}
+			s.dirs, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.is('n', "on") {
+			if err := p.next(); err != nil {
+				return s, err
+			}
+			if s.on, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+		if s.dirs, err = p.directives(); err != nil {
+			return s, err
+		}
+		s.sel, err = p.selectionSet()
+		return s, err
+	}
+
+	if s.name, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.is('p', ":") {
+		if err := p.next(); err != nil {
+			return s, err
+		}
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return s, err
+	}
+	if s.dirs, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.is('p', "{") {
+		s.sel, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *parser) arguments() (map[string]any, error) {
+	if !p.is('p', "(") {
+		return nil, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	args := map[string]any{}
+	for !p.is('p', ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect('p', ":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+func (p *parser) directives() ([]directive, error) {
+	var out []directive
+	for p.is('p', "@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		var d directive
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// value parses a literal; constant values (defaults) may not use variables.
+func (p *parser) value(constant bool) (any, error) {
+	t := p.tok
+	switch {
+	case t.kind == 'p' && t.val == "$" && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		return variable(n), err
+	case t.kind == 'i':
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return nil, p.errorf("bad int %s", t.val)
+		}
+		return n, p.next()
+	case t.kind == 'f':
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, p.errorf("bad float %s", t.val)
+		}
+		return f, p.next()
+	case t.kind == 's':
+		return t.val, p.next()
+	case t.kind == 'n':
+		var v any
+		switch t.val {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enumValue(t.val)
+		}
+		return v, p.next()
+	case t.kind == 'p' && t.val == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []any{}
+		for !p.is('p', "]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case t.kind == 'p' && t.val == "{":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := map[string]any{}
+		for !p.is('p', "}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect('p', ":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	}
+	return nil, p.errorf("unexpected %q in value", t.val)
+}
+
+// next reads the following token, skipping whitespace, commas and comments.
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{pos: start}
+		return nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = token{kind: 'p', val: "...", pos: start}
+	case strings.IndexByte("!$()[]{}:=@|&", c) >= 0:
+		p.pos++
+		p.tok = token{kind: 'p', val: string(c), pos: start}
+	case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: 'n', val: p.src[start:p.pos], pos: start}
+	case c == '-' || '0' <= c && c <= '9':
+		p.pos++
+		kind := byte('i')
+		for p.pos < len(p.src) {
+			d := p.src[p.pos]
+			if d == '.' || d == 'e' || d == 'E' || (d == '+' || d == '-') && kind == 'f' {
+				kind = 'f'
+			} else if d < '0' || d > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.tok = token{kind: kind, val: p.src[start:p.pos], pos: start}
+	case c == '"':
+		s, err := p.str()
+		if err != nil {
+			return err
+		}
+		p.tok = token{kind: 's', val: s, pos: start}
+	default:
+		p.tok = token{pos: start}
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// str reads a string literal; block strings are taken verbatim.
+func (p *parser) str() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			return "", p.errorf("unterminated block string")
+		}
+		s := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		return s, nil
+	}
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			switch e := p.src[p.pos]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'u':
+				if p.pos+4 >= len(p.src) {
+					return "", p.errorf("bad escape")
+				}
+				r, err := strconv.ParseUint(p.src[p.pos+1:p.pos+5], 16, 32)
+				if err != nil {
+					return "", p.errorf("bad escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"SCloud/auth"
+	"SCloud/storage"
+	"SCloud/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var abuseCategories = []string{"spam", "malware", "dmca"}
+
+const maxReportDetails = 4000
+
+type abuseReportRequest struct {
+	URL      string `json:"url"` // the link as it was received
+	Category string `json:"category"`
+	Details  string `json:"details"`
+}
+
+// how many abuse reports one network may file, and per how long
+const (
+	reportWindow     = time.Hour
+	reportsPerWindow = 20
+)
+
+// reportLimiter counts reports per network. Counts start over with each
+// window, so no address is remembered for longer than one.
+type reportLimiter struct {
+	mu    sync.Mutex
+	since time.Time
+	byNet map[string]int
+}
+
+func (l *reportLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byNet == nil || now.Sub(l.since) >= reportWindow {
+		l.since, l.byNet = now, map[string]int{}
+	}
+	n := reporterNet(ip)
+	if l.byNet[n] >= reportsPerWindow {
+		return false
+	}
+	l.byNet[n]++
+	return true
+}
+
+// reporterNet is the network a report comes from: the address's /24, or its
+// /48 for IPv6, since one party easily holds many addresses of either.
+func reporterNet(ip string) string {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	a = a.Unmap()
+	bits := 48
+	if a.Is4() {
+		bits = 24
+	}
+	p, err := a.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return p.String()
+}
+
+// linkSuspended reports whether reports stop a link: one an admin actioned,
+// or open ones from ABUSE_REPORT_THRESHOLD networks.
+func linkSuspended(reports []store.AbuseReport, threshold int) bool {
+	nets := map[string]bool{}
+	for _, r := range reports {
+		switch r.Status {
+		case store.ReportActioned:
+			return true
+		case store.ReportOpen:
+			nets[reporterNet(r.IP)] = true
+		}
+	}
+	return threshold > 0 && len(nets) >= threshold
+}
+
+// linkReported answers 403 for a signed link suspended by abuse reports,
+// and reports whether it did.
+func (h *Handlers) linkReported(context *gin.Context, nonce string) bool {
+	reports, err := h.Stores.Reports.ListForLink(context.Request.Context(), nonce)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "reports: %v", err)
+		return true
+	}
+	if !linkSuspended(reports, h.Cfg.AbuseReportThreshold) {
+		return false
+	}
+	context.String(http.StatusForbidden, "Link suspended pending abuse review")
+	return true
+}
+
+// ReportLinkHandler lets anyone holding a signed download link flag it.
+// Only genuine links are taken, expired or not, and each network may file
+// only so many an hour. The report waits for an admin; once
+// ABUSE_REPORT_THRESHOLD networks have reported the same link, that link
+// stops working, while the file itself is left to the admin's review.
+func (h *Handlers) ReportLinkHandler(context *gin.Context) {
+	ip := context.ClientIP()
+	if !h.reports.allow(ip, time.Now()) {
+		context.String(http.StatusTooManyRequests, "Too many reports, try again later")
+		return
+	}
+	var req abuseReportRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if !slices.Contains(abuseCategories, req.Category) {
+		context.String(http.StatusBadRequest, "category must be one of %s", strings.Join(abuseCategories, ", "))
+		return
+	}
+	if len(req.Details) > maxReportDetails {
+		context.String(http.StatusBadRequest, "details may be at most %d bytes", maxReportDetails)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		context.String(http.StatusBadRequest, "bad url: %v", err)
+		return
+	}
+	q := u.Query()
+	fp, userID, org, nonce := q.Get("fp"), q.Get("u"), q.Get("org"), q.Get("n")
+	expUnix, _ := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err := h.Auth.VerifyDownload(http.MethodGet, fp, userID, org, nonce, q.Get("kid"), time.Unix(expUnix, 0), q.Get("sig")); err != nil {
+		context.String(http.StatusBadRequest, "not a link from this server: %v", err)
+		return
+	}
+	tree := h.Cfg.BaseDir
+	if org != "" {
+		tree = auth.OrgBaseDir(h.Cfg.BaseDir, org)
+	}
+	p := filepath.Clean(fp)
+
+	ctx := context.Request.Context()
+	reports, err := h.Stores.Reports.ListForLink(ctx, nonce)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "report: %v", err)
+		return
+	}
+	for _, r := range reports {
+		if r.Status == store.ReportOpen && reporterNet(r.IP) == reporterNet(ip) {
+			// one network counts once until the reports are reviewed
+			context.JSON(http.StatusAccepted, gin.H{"message": "Report received"})
+			return
+		}
+	}
+	r := store.AbuseReport{
+		ID:       randomHex(16),
+		LinkID:   nonce,
+		OwnerID:  userID,
+		Tree:     tree,
+		Path:     p,
+		Category: req.Category,
+		Details:  req.Details,
+		IP:       ip,
+		Created:  time.Now(),
+		Status:   store.ReportOpen,
+	}
+	if err := h.Stores.Reports.Add(ctx, &r); err != nil {
+		context.String(http.StatusInternalServerError, "report: %v", err)
+		return
+	}
+	if !linkSuspended(reports, h.Cfg.AbuseReportThreshold) && linkSuspended(append(reports, r), h.Cfg.AbuseReportThreshold) {
+		h.audit(ctx, "", "link.suspended", tree, p, "link "+nonce)
+	}
+	context.JSON(http.StatusAccepted, gin.H{"message": "Report received", "id": r.ID})
+}
+
+// ListReportsHandler lists abuse reports, newest first: the open ones, or
+// those with ?status= (all for "all").
+func (h *Handlers) ListReportsHandler(context *gin.Context) {
+	status := context.DefaultQuery("status", store.ReportOpen)
+	if status == "all" {
+		status = ""
+	}
+	reports, err := h.Stores.Reports.List(context.Request.Context(), status)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "reports: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+type reviewRequest struct {
+	Status     string `json:"status"`     // dismissed or actioned
+	Quarantine bool   `json:"quarantine"` // with actioned: quarantine the file too
+	Note       string `json:"note"`
+}
+
+// ReviewReportHandler closes an open report, dismissing it or recording
+// that it was acted on.
+func (h *Handlers) ReviewReportHandler(context *gin.Context) {
+	var req reviewRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.Status != store.ReportDismissed && req.Status != store.ReportActioned {
+		context.String(http.StatusBadRequest, "status must be %s or %s", store.ReportDismissed, store.ReportActioned)
+		return
+	}
+	ctx := context.Request.Context()
+	adminID := context.GetString("userid")
+	r, err := h.Stores.Reports.Get(ctx, context.Param("id"))
+	if err != nil {
+		context.String(http.StatusNotFound, "Unknown report")
+		return
+	}
+	if req.Quarantine && req.Status == store.ReportActioned {
+		_, e, err := storage.StatFile(h.Cfg.MasterKey, r.Tree, r.Path)
+		if err != nil {
+			context.String(http.StatusNotFound, "File not found")
+			return
+		}
+		if e.Quarantine == nil {
+			if err := h.quarantineFile(ctx, adminID, r.Tree, r.Path, storage.QuarantineReport, r.Category+" report"); err != nil {
+				context.String(http.StatusInternalServerError, "quarantine: %v", err)
+				return
+			}
+		}
+	}
+	err = h.Stores.Reports.Review(ctx, r.ID, req.Status, adminID, time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		context.String(http.StatusConflict, "report was already reviewed")
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "review: %v", err)
+		return
+	}
+	h.audit(ctx, adminID, "report."+req.Status, r.Tree, r.Path, strings.TrimSpace(r.Category+" "+req.Note))
+	context.JSON(http.StatusOK, gin.H{"message": "Reviewed", "id": r.ID, "status": req.Status})
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"SCloud/auth"
+	"SCloud/jobs"
+	"SCloud/stats"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// allBaseDirs returns the server root, the named roots and every org root
+// on disk.
+func (h *Handlers) allBaseDirs() ([]string, error) {
+	baseDir := h.Cfg.BaseDir
+	dirs := []string{baseDir}
+	for _, name := range slices.Sorted(maps.Keys(h.Cfg.Roots)) {
+		dirs = append(dirs, h.Cfg.Roots[name])
+	}
+	ents, err := os.ReadDir(filepath.Join(baseDir, "orgs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(baseDir, "orgs", e.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+func (h *Handlers) AdminStatsHandler(context *gin.Context) {
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	var disk storage.DiskStats
+	for _, d := range dirs {
+		st, err := storage.StorageStats(d)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "disk stats: %v", err)
+			return
+		}
+		disk.EncryptedBytes += st.EncryptedBytes
+		disk.Blobs += st.Blobs
+		disk.StagingUploads += st.StagingUploads
+		disk.StagingBytes += st.StagingBytes
+	}
+
+	users, err := h.Stores.Users.Count(context.Request.Context())
+	if err != nil {
+		context.String(http.StatusInternalServerError, "user count: %v", err)
+		return
+	}
+
+	upCount, upBytes := stats.Last24h(stats.Upload)
+	downCount, downBytes := stats.Last24h(stats.Download)
+
+	jobStatus := gin.H{}
+	for _, name := range []string{"gc", "scrub", "rotate-keys", "rebalance", "backup"} {
+		if j, ok := h.Jobs.Last(name); ok {
+			jobStatus[name] = j
+		} else {
+			jobStatus[name] = nil
+		}
+	}
+
+	volumes := gin.H{}
+	for name, dir := range storage.VolumeDirs(h.Cfg.BaseDir) {
+		if name == "" {
+			name = storage.LocalVolume
+		}
+		v := gin.H{"dir": dir}
+		if total, free, err := storage.DiskSpace(dir); err == nil {
+			v["total_bytes"], v["free_bytes"] = total, free
+		}
+		volumes[name] = v
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"users":           users,
+		"orgs":            len(dirs) - 1 - len(h.Cfg.Roots),
+		"encrypted_bytes": disk.EncryptedBytes,
+		"blobs":           disk.Blobs,
+		"staging": gin.H{
+			"uploads": disk.StagingUploads,
+			"bytes":   disk.StagingBytes,
+		},
+		"last_24h": gin.H{
+			"uploads":        upCount,
+			"upload_bytes":   upBytes,
+			"downloads":      downCount,
+			"download_bytes": downBytes,
+		},
+		"volumes": volumes,
+		"jobs":    jobStatus,
+	})
+}
+
+// GCJob collects garbage across every storage root: unreferenced blobs and
+// dirs, leftover temp files and expired upload staging.
+func (h *Handlers) GCJob(p jobs.Progress) (any, error) {
+	var total storage.GCReport
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		return total, err
+	}
+	p.SetTotal(int64(len(dirs)))
+	policy := h.stagingPolicy()
+	for _, d := range dirs {
+		r, err := storage.CollectGarbage(h.Cfg.MasterKey, d, policy)
+		total.OrphanBlobs += r.OrphanBlobs
+		total.OrphanDirs += r.OrphanDirs
+		total.StaleTemps += r.StaleTemps
+		total.StaleUploads += r.StaleUploads
+		total.FreedBytes += r.FreedBytes
+		if err != nil {
+			return total, err
+		}
+		p.Add(1)
+	}
+	return total, nil
+}
+
+// ScrubJob verifies every file across every storage root decrypts intact.
+func (h *Handlers) ScrubJob(p jobs.Progress) (any, error) {
+	reports := map[string]storage.ScrubReport{}
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		return reports, err
+	}
+	keyFor := func(e *storage.ManifestEntry) ([]byte, error) { return h.readKeyFor(h.Cfg.MasterKey, e) }
+	for _, d := range dirs {
+		r, err := storage.Scrub(h.Cfg.MasterKey, d, keyFor, func() { p.Add(1) })
+		reports[d] = r
+		if err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+// StartJobHandler kicks off gc, scrub, rotate-keys, backfill, rebalance or
+// usage-sample across every storage root, a backup of all of them, or an import into one.
+func (h *Handlers) StartJobHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	keyFor := func(e *storage.ManifestEntry) ([]byte, error) { return h.readKeyFor(mkey, e) }
+
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+
+	var fn jobs.Func
+	name := context.Param("name")
+	switch name {
+	case "gc":
+		fn = h.GCJob
+	case "scrub":
+		fn = h.ScrubJob
+	case "rotate-keys":
+		fn = func(p jobs.Progress) (any, error) {
+			reports := map[string]storage.RekeyReport{}
+			for _, d := range dirs {
+				r, err := storage.RekeyFiles(mkey, d, keyFor, func() { p.Add(1) })
+				reports[d] = r
+				if err != nil {
+					return reports, err
+				}
+			}
+			return reports, nil
+		}
+	case "backfill":
+		fn = func(p jobs.Progress) (any, error) {
+			reports := map[string]storage.BackfillReport{}
+			for _, d := range dirs {
+				r, err := storage.Backfill(mkey, d, keyFor, func() { p.Add(1) })
+				reports[d] = r
+				if err != nil {
+					return reports, err
+				}
+			}
+			return reports, nil
+		}
+	case "usage-sample":
+		fn = h.SampleUsageJob
+	case "rebalance":
+		// ?from= drains a volume, ?to= fills one; with neither, pinned
+		// users' files move to their volume
+		plan := storage.RebalancePlan{From: context.Query("from"), To: context.Query("to")}
+		fn = func(p jobs.Progress) (any, error) {
+			reports := map[string]storage.RebalanceReport{}
+			for _, d := range dirs {
+				r, err := storage.Rebalance(mkey, d, plan, func() { p.Add(1) })
+				reports[d] = r
+				if err != nil {
+					return reports, err
+				}
+			}
+			return reports, nil
+		}
+	case "backup":
+		if h.Cfg.BackupDir == "" {
+			context.String(http.StatusBadRequest, "BACKUP_DIR is not set")
+			return
+		}
+		fn = h.backupJob(context.Query("full") == "true")
+	case "import":
+		// ?src= is a directory on the server's disk, imported under ?dest=
+		// in the shared tree or, with ?org= or ?root=, that org's or root's
+		src := context.Query("src")
+		if fi, err := os.Stat(src); src == "" || err != nil || !fi.IsDir() {
+			context.String(http.StatusBadRequest, "src must be a directory on the server")
+			return
+		}
+		baseDir := h.Cfg.BaseDir
+		if org := context.Query("org"); org != "" {
+			if !h.Auth.OrgExists(org) {
+				context.String(http.StatusNotFound, "No such org")
+				return
+			}
+			baseDir = auth.OrgBaseDir(h.Cfg.BaseDir, org)
+		} else if root := context.Query("root"); root != "" {
+			dir, ok := h.Cfg.Roots[root]
+			if !ok {
+				context.String(http.StatusNotFound, "No such storage root")
+				return
+			}
+			baseDir = dir
+		}
+		opts := storage.ImportOptions{
+			DryRun: context.Query("dry_run") == "true",
+			Owner:  context.GetString("userid"),
+		}
+		dest := context.Query("dest")
+		fn = func(p jobs.Progress) (any, error) {
+			opts.Progress = func() { p.Add(1) }
+			return storage.ImportTree(mkey, baseDir, src, dest, opts)
+		}
+	default:
+		context.String(http.StatusNotFound, "unknown job %q", name)
+		return
+	}
+
+	job, err := h.Jobs.Start(name, fn)
+	if errors.Is(err, jobs.ErrRunning) {
+		context.String(http.StatusConflict, "%s is already running", name)
+		return
+	}
+	context.JSON(http.StatusAccepted, job)
+}
+
+// ScheduleHandler lists the scheduled maintenance tasks with their next and
+// last runs.
+func (h *Handlers) ScheduleHandler(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"tasks": h.Schedule.Status()})
+}
+
+func (h *Handlers) ListJobsHandler(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"jobs": h.Jobs.List()})
+}
+
+func (h *Handlers) JobStatusHandler(context *gin.Context) {
+	job, ok := h.Jobs.Get(context.Param("id"))
+	if !ok {
+		context.String(http.StatusNotFound, "No such job")
+		return
+	}
+	context.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"SCloud/auth"
+	"SCloud/authz"
+	"SCloud/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+)
+
+// allow writes a 403 and returns false unless the caller may perform op on
+// logicalPath in baseDir.
+func (h *Handlers) allow(context *gin.Context, op authz.Op, baseDir, logicalPath string) bool {
+	ok, err := h.Auth.Authz.Check(context.Request.Context(), authz.SubjectFrom(context), op, baseDir, filepath.Clean(logicalPath))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "authorization: %v", err)
+		return false
+	}
+	if !ok {
+		context.String(http.StatusForbidden, "Access denied")
+		return false
+	}
+	if op == authz.Write && auth.UploadOnly(context) {
+		if _, _, err := storage.StatFile(h.Cfg.MasterKey, baseDir, filepath.Clean(logicalPath)); err == nil {
+			context.String(http.StatusForbidden, "An upload-only key cannot replace files")
+			return false
+		}
+	}
+	if op == authz.Write {
+		l, err := h.foreignLock(context.Request.Context(), baseDir, context.GetString("userid"), logicalPath)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "lock: %v", err)
+			return false
+		}
+		if l != nil {
+			context.String(http.StatusLocked, "%s", lockedMessage(l))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"SCloud/jobs"
+	"SCloud/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+func (h *Handlers) backupJob(full bool) jobs.Func {
+	dst := storage.DirBlobStore{Root: h.Cfg.BackupDir}
+	return func(p jobs.Progress) (any, error) {
+		return storage.Backup(h.Cfg.MasterKey, h.Cfg.BaseDir, dst, full, func() { p.Add(1) })
+	}
+}
+
+// BackupsHandler lists the restore points in BACKUP_DIR, oldest first.
+func (h *Handlers) BackupsHandler(context *gin.Context) {
+	if h.Cfg.BackupDir == "" {
+		context.String(http.StatusNotFound, "Backups are not configured")
+		return
+	}
+	points, err := storage.ListRestorePoints(h.Cfg.MasterKey, storage.DirBlobStore{Root: h.Cfg.BackupDir})
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list backups: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"restore_points": points})
+}
+
+// ScheduledBackupJob backs the main store up, in full when the last full
+// backup is older than BackupFullEvery and incrementally otherwise.
+func (h *Handlers) ScheduledBackupJob(p jobs.Progress) (any, error) {
+	points, err := storage.ListRestorePoints(h.Cfg.MasterKey, storage.DirBlobStore{Root: h.Cfg.BackupDir})
+	if err != nil {
+		return nil, err
+	}
+	full := storage.FullBackupDue(points, h.Cfg.BackupFullEvery, time.Now())
+	return h.backupJob(full)(p)
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/stats"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// AppendHandler appends the raw request body to an existing file, sealing
+// only the new chunks.
+func (h *Handlers) AppendHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, requestedPath) {
+		return
+	}
+	if context.Request.ContentLength < 0 {
+		// a body of unknown length could not be held to the quota
+		context.String(http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	if !h.withinQuota(context, mkey, baseDir, context.Request.ContentLength) {
+		return
+	}
+
+	_, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(requestedPath))
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+
+	// appended bytes arrive on their own, like a chunk: filters see the
+	// file's size after the append, not its content
+	grown := entry.Size + context.Request.ContentLength
+	if _, ok := h.filterUpload(context, filepath.Clean(requestedPath), grown, "", entry.Encryption, true); !ok {
+		return
+	}
+	before := entry.Size
+	size, err := storage.AppendFile(mkey, baseDir, filepath.Clean(requestedPath), key, context.Request.Body)
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "append failed: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "append failed: %v", err)
+		return
+	}
+	h.record(context, stats.Upload, size-before)
+	context.JSON(http.StatusOK, gin.H{
+		"path": requestedPath,
+		"size": size,
+	})
+}
+
+// PatchHandler overwrites part of a file with the raw request body, starting
+// at ?offset=. Only the chunks the write overlaps are re-encrypted.
+func (h *Handlers) PatchHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	offset, err := strconv.ParseInt(context.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		context.String(http.StatusBadRequest, "bad offset")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, requestedPath) {
+		return
+	}
+	if context.Request.ContentLength < 0 {
+		// a body of unknown length could not be held to the quota
+		context.String(http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	if !h.withinQuota(context, mkey, baseDir, context.Request.ContentLength) {
+		return
+	}
+
+	_, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(requestedPath))
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+
+	grown := max(entry.Size, offset+context.Request.ContentLength)
+	if _, ok := h.filterUpload(context, filepath.Clean(requestedPath), grown, "", entry.Encryption, true); !ok {
+		return
+	}
+	counted := &storage.CountReader{R: context.Request.Body}
+	size, err := storage.PatchFile(mkey, baseDir, filepath.Clean(requestedPath), key, offset, counted)
+	switch {
+	case errors.Is(err, storage.ErrPatchOffset):
+		context.String(http.StatusRequestedRangeNotSatisfiable, "patch failed: %v", err)
+		return
+	case errors.Is(err, storage.ErrImmutable):
+		context.String(http.StatusConflict, "patch failed: %v", err)
+		return
+	case err != nil:
+		context.String(http.StatusInternalServerError, "patch failed: %v", err)
+		return
+	}
+	h.record(context, stats.Upload, counted.N)
+	context.JSON(http.StatusOK, gin.H{
+		"path":    requestedPath,
+		"offset":  offset,
+		"written": counted.N,
+		"size":    size,
+	})
+}
+
+type composeRequest struct {
+	Sources    []string `json:"sources"`
+	FilePath   string   `json:"filepath"`
+	OnConflict string   `json:"on_conflict"`
+}
+
+type composeSource struct {
+	blob string
+	key  []byte
+}
+
+// ComposeHandler concatenates stored files, in order, into a new file.
+// Sources are decrypted and the result re-encrypted under a fresh header.
+func (h *Handlers) ComposeHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	var req composeRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" || len(req.Sources) == 0 {
+		context.String(http.StatusBadRequest, "Need filepath and at least one source")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	dest := filepath.Clean(req.FilePath)
+
+	var srcs []composeSource
+	var total int64
+	for _, p := range req.Sources {
+		p = filepath.Clean(p)
+		if p == dest && req.OnConflict != storage.ConflictRename {
+			context.String(http.StatusBadRequest, "destination %q is also a source", p)
+			return
+		}
+		if !h.allow(context, authz.Read, baseDir, p) {
+			return
+		}
+		blob, entry, err := storage.StatFile(mkey, baseDir, p)
+		if err != nil {
+			context.String(http.StatusNotFound, "source %q not found", p)
+			return
+		}
+		if quarantined(context, entry) {
+			return
+		}
+		h.tripwire(context, baseDir, p)
+		if entry.Encryption == storage.EncryptionClient {
+			context.String(http.StatusBadRequest, "source %q is client-encrypted and cannot be composed", p)
+			return
+		}
+		key, err := h.readKeyFor(mkey, entry)
+		if err != nil {
+			context.String(http.StatusForbidden, "key unavailable: %v", err)
+			return
+		}
+		srcs = append(srcs, composeSource{blob: blob, key: key})
+		total += entry.Size
+	}
+
+	if !h.allow(context, authz.Write, baseDir, dest) || !h.withinQuota(context, mkey, baseDir, total) {
+		return
+	}
+	dest, ok := h.conflictPath(context, mkey, baseDir, dest, req.OnConflict)
+	if !ok {
+		return
+	}
+	blobKey, keyOwner, encryption, err := h.uploadKey(context, mkey, baseDir, dest)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+	if encryption == storage.EncryptionClient {
+		context.String(http.StatusBadRequest, "compose output is always server-encrypted")
+		return
+	}
+	run, ok := h.filterUpload(context, dest, total, "", encryption, false)
+	if !ok {
+		return
+	}
+	dstPath, err := storage.ResolveForCreateAs(mkey, baseDir, dest, context.GetString("userid"))
+	if createRefused(context, err) {
+		return
+	}
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "resolve: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "resolve: %v", err)
+		return
+	}
+
+	dst, err := storage.CreateBlob(dstPath)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "create: %v", err)
+		return
+	}
+	defer dst.Abort()
+
+	// Decrypt the sources back to back into the encryptor
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for _, s := range srcs {
+			f, err := os.Open(s.blob)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			err = storage.Decrypt(s.key, f, pipeWriter)
+			f.Close()
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+	counted := &storage.CountReader{R: run.Wrap(pipeReader)}
+	if err := writeBlob(blobKey, encryption, counted, dst); err != nil {
+		pipeReader.CloseWithError(err)
+		if !uploadDenied(context, err) {
+			context.String(http.StatusInternalServerError, "compose failed: %v", err)
+		}
+		return
+	}
+	if err := run.Verdict(); err != nil {
+		if !uploadDenied(context, err) {
+			context.String(http.StatusInternalServerError, "upload filter: %v", err)
+		}
+		return
+	}
+	info := storage.BlobInfo{KeyOwner: keyOwner, Encryption: encryption, Size: counted.N}
+	if err := storage.CommitBlob(mkey, baseDir, dest, dst, info); err != nil {
+		context.String(http.StatusInternalServerError, "compose failed: %v", err)
+		return
+	}
+
+	h.record(context, stats.Upload, counted.N)
+	context.JSON(http.StatusOK, gin.H{
+		"path": dest,
+		"size": counted.N,
+	})
+}
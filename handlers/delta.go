@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/stats"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// deltaBlockSize reads a block size, defaulting and bounding it so a client
+// can't ask for a signature with billions of entries.
+func deltaBlockSize(raw string) (int, bool) {
+	if raw == "" {
+		return storage.DefaultDeltaBlock, true
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < storage.MinDeltaBlock || n > storage.MaxDeltaBlock {
+		return 0, false
+	}
+	return n, true
+}
+
+// SignatureHandler returns block checksums of a file so a sync client can
+// work out which of its blocks the server already has.
+func (h *Handlers) SignatureHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	blockSize, ok := deltaBlockSize(context.Query("block_size"))
+	if !ok {
+		context.String(http.StatusBadRequest, "block_size must be between %d and %d", storage.MinDeltaBlock, storage.MaxDeltaBlock)
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	_, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(requestedPath))
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	h.tripwire(context, baseDir, requestedPath)
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+
+	sums, size, err := storage.Signature(mkey, baseDir, filepath.Clean(requestedPath), key, blockSize)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "signature failed: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"path":       requestedPath,
+		"etag":       entry.ETag(),
+		"size":       size,
+		"block_size": blockSize,
+		"blocks":     sums,
+	})
+}
+
+// what a delta's JSON body may take: it carries only the changed bytes
+const maxDeltaBody = 64 << 20
+
+type deltaRequest struct {
+	FilePath  string            `json:"filepath"`
+	BaseETag  string            `json:"base_etag"` // from the signature; the delta only applies to that version
+	BlockSize int               `json:"block_size"`
+	Ops       []storage.DeltaOp `json:"ops"`
+}
+
+// DeltaHandler rebuilds a file from block references into its current
+// version plus literal data, then re-encrypts the result.
+func (h *Handlers) DeltaHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, maxDeltaBody)
+	var req deltaRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			context.String(http.StatusRequestEntityTooLarge, "request too large")
+			return
+		}
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" || req.BaseETag == "" {
+		context.String(http.StatusBadRequest, "Need filepath and base_etag")
+		return
+	}
+	raw := ""
+	if req.BlockSize != 0 {
+		raw = strconv.Itoa(req.BlockSize)
+	}
+	blockSize, ok := deltaBlockSize(raw)
+	if !ok {
+		context.String(http.StatusBadRequest, "block_size must be between %d and %d", storage.MinDeltaBlock, storage.MaxDeltaBlock)
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, req.FilePath) {
+		return
+	}
+	_, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(req.FilePath))
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	if entry.ETag() != req.BaseETag {
+		context.String(http.StatusPreconditionFailed, "file changed since the signature was taken")
+		return
+	}
+	var literal int64
+	for _, op := range req.Ops {
+		literal += int64(len(op.Data))
+	}
+	newSize, err := storage.DeltaSize(req.Ops, blockSize, entry.Size)
+	if err != nil {
+		context.String(http.StatusBadRequest, "delta failed: %v", err)
+		return
+	}
+	if _, ok := h.filterUpload(context, filepath.Clean(req.FilePath), newSize, "", entry.Encryption, true); !ok {
+		return
+	}
+	if !h.withinQuota(context, mkey, baseDir, max(newSize-entry.Size, 0)) {
+		return
+	}
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+
+	size, err := storage.ApplyDelta(mkey, baseDir, filepath.Clean(req.FilePath), req.BaseETag, key, blockSize, req.Ops)
+	if errors.Is(err, storage.ErrChanged) {
+		context.String(http.StatusPreconditionFailed, "file changed since the signature was taken")
+		return
+	}
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "delta failed: %v", err)
+		return
+	}
+	if errors.Is(err, storage.ErrBadDelta) {
+		context.String(http.StatusBadRequest, "delta failed: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "delta failed: %v", err)
+		return
+	}
+	h.record(context, stats.Upload, literal)
+	context.JSON(http.StatusOK, gin.H{
+		"path":    req.FilePath,
+		"size":    size,
+		"literal": literal,
+	})
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"SCloud/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// room for the multipart framing and form fields around a drop's file
+const dropFormSlack = 1 << 20
+
+type dropRequest struct {
+	FilePath string `json:"filepath"`
+	Label    string `json:"label"`
+	MaxSize  int64  `json:"max_size"`   // per file; 0 = no limit
+	Expires  int64  `json:"expires_at"` // unix seconds; 0 = never
+}
+
+func dropJSON(d store.Drop) gin.H {
+	out := gin.H{"slug": d.Slug, "path": d.Path, "org": d.Org, "label": d.Label, "max_size": d.MaxSize,
+		"created": d.Created, "url": "/api/drop/" + d.Slug}
+	if !d.Expires.IsZero() {
+		out["expires"] = d.Expires
+	}
+	return out
+}
+
+// CreateDropHandler turns a directory into a drop folder: anyone with its
+// URL may upload into it, but not list or download from it.
+func (h *Handlers) CreateDropHandler(context *gin.Context) {
+	var req dropRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" {
+		context.String(http.StatusBadRequest, "Missing directory path")
+		return
+	}
+	if req.MaxSize < 0 {
+		context.String(http.StatusBadRequest, "max_size must not be negative")
+		return
+	}
+	now := time.Now()
+	if req.Expires != 0 && !time.Unix(req.Expires, 0).After(now) {
+		context.String(http.StatusBadRequest, "expires_at is in the past")
+		return
+	}
+	if context.GetString("root") != "" {
+		context.String(http.StatusBadRequest, "drop folders are only made in the main tree or an org's")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	dir := path.Clean("/" + req.FilePath)[1:]
+	if dir == "" {
+		dir = "."
+	}
+	if !h.allow(context, authz.Share, baseDir, dir) {
+		return
+	}
+	if _, err := storage.ListDir(h.Cfg.MasterKey, baseDir, dir); err != nil {
+		context.String(http.StatusNotFound, "not a directory: %v", err)
+		return
+	}
+	d := store.Drop{Slug: randomHex(16), OwnerID: context.GetString("userid"), Org: context.GetString("org"),
+		Path: dir, Label: req.Label, MaxSize: req.MaxSize, Created: now}
+	if req.Expires != 0 {
+		d.Expires = time.Unix(req.Expires, 0)
+	}
+	if err := h.Stores.Drops.Create(context.Request.Context(), &d); err != nil {
+		context.String(http.StatusInternalServerError, "create drop folder: %v", err)
+		return
+	}
+	context.JSON(http.StatusCreated, dropJSON(d))
+}
+
+// ListDropsHandler lists the caller's drop folders.
+func (h *Handlers) ListDropsHandler(context *gin.Context) {
+	drops, err := h.Stores.Drops.ListByOwner(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list: %v", err)
+		return
+	}
+	out := []gin.H{}
+	for _, d := range drops {
+		out = append(out, dropJSON(d))
+	}
+	context.JSON(http.StatusOK, gin.H{"drops": out})
+}
+
+// DeleteDropHandler closes a drop folder; its owner or an admin may. The
+// files already dropped stay.
+func (h *Handlers) DeleteDropHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	d, err := h.Stores.Drops.Get(ctx, context.Query("slug"))
+	if err != nil || d.OwnerID != context.GetString("userid") && !context.GetBool("admin") {
+		context.String(http.StatusNotFound, "No such drop folder")
+		return
+	}
+	if err := h.Stores.Drops.Delete(ctx, d.Slug); err != nil {
+		context.String(http.StatusInternalServerError, "delete drop folder: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Drop folder closed", "slug": d.Slug})
+}
+
+// openDrop looks up the drop folder the URL names, answering 404 or 410
+// itself when there is none to upload to.
+func (h *Handlers) openDrop(context *gin.Context) (*store.Drop, bool) {
+	d, err := h.Stores.Drops.Get(context.Request.Context(), context.Param("slug"))
+	if errors.Is(err, store.ErrNotFound) {
+		context.String(http.StatusNotFound, "Not found")
+		return nil, false
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "drop folder: %v", err)
+		return nil, false
+	}
+	if !d.Expires.IsZero() && time.Now().After(d.Expires) {
+		context.String(http.StatusGone, "This drop folder is closed")
+		return nil, false
+	}
+	return d, true
+}
+
+// DropInfoHandler tells an uploader what a drop folder accepts, and
+// nothing about what it holds.
+func (h *Handlers) DropInfoHandler(context *gin.Context) {
+	d, ok := h.openDrop(context)
+	if !ok {
+		return
+	}
+	out := gin.H{"label": d.Label, "max_size": d.MaxSize}
+	if !d.Expires.IsZero() {
+		out["expires"] = d.Expires
+	}
+	context.JSON(http.StatusOK, out)
+}
+
+// DropUploadHandler stores a file sent to a drop folder's URL, without
+// sign-in. It is written as the folder's owner, whose access is checked
+// as for any upload, and never replaces a file: a taken name gets a
+// " (n)" suffix. The reply does not say where in the tree it went.
+func (h *Handlers) DropUploadHandler(context *gin.Context) {
+	d, ok := h.openDrop(context)
+	if !ok {
+		return
+	}
+	if d.MaxSize > 0 {
+		context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, d.MaxSize+dropFormSlack)
+	}
+	fh, err := context.FormFile("file")
+	if err != nil {
+		context.String(http.StatusBadRequest, "No file uploaded: %v", err)
+		return
+	}
+	if d.MaxSize > 0 && fh.Size > d.MaxSize {
+		context.String(http.StatusRequestEntityTooLarge, "File is too large")
+		return
+	}
+	name := dropFileName(fh.Filename)
+	if name == "" {
+		context.String(http.StatusBadRequest, "Missing file name")
+		return
+	}
+	if !h.actAsLinkOwner(context, d.OwnerID, d.Org) {
+		return
+	}
+	_, finalPath, ok := h.storeUpload(context, fh, "", path.Join(d.Path, name), storage.ConflictRename)
+	if !ok {
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "name": path.Base(finalPath)})
+}
+
+// dropFileName is the base of an uploader's file name, without control
+// characters; "" when nothing usable is left.
+func dropFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name = strings.TrimSpace(name); name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// EnableFolderKeyHandler gives the directory at ?filepath a folder key.
+// Files written beneath it from now on are encrypted under that key.
+func (h *Handlers) EnableFolderKeyHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	requestedPath := context.Query("filepath")
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Share, baseDir, requestedPath) {
+		return
+	}
+	id, err := storage.EnableFolderKey(mkey, baseDir, h.Cfg.BaseDir, requestedPath)
+	if err != nil {
+		context.String(http.StatusNotFound, "folder key: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"path": requestedPath, "key_id": id})
+}
+
+// FolderKeyHandler hands the folder key covering the directory at ?filepath
+// to anyone who may read it, share grantees included.
+func (h *Handlers) FolderKeyHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	requestedPath := context.Query("filepath")
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	id, err := storage.FolderKeyFor(mkey, baseDir, requestedPath)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "folder key: %v", err)
+		return
+	}
+	if id == "" {
+		context.String(http.StatusNotFound, "No folder key")
+		return
+	}
+	key, err := h.Auth.KeyForUser(storage.FolderKeyOwner(id))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "folder key: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"path": requestedPath, "key_id": id, "key": base64.RawURLEncoding.EncodeToString(key)})
+}
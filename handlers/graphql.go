@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/events"
+	"SCloud/graphql"
+	"SCloud/storage"
+	"SCloud/store"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxGraphQLBody  = 1 << 20
+	maxGraphQLBatch = 20
+	maxActivity     = 500
+)
+
+// GraphQLHandler serves /api/graphql: files, folders, shares, sessions and
+// activity as one graph, so a view such as a folder with its entries, quota
+// and shares is fetched in one round trip. The body is one request or a
+// JSON array of them, answered in order.
+func (h *Handlers) GraphQLHandler(context *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(context.Request.Body, maxGraphQLBody+1))
+	if err != nil {
+		context.String(http.StatusBadRequest, "read body: %v", err)
+		return
+	}
+	if len(body) > maxGraphQLBody {
+		context.String(http.StatusRequestEntityTooLarge, "request too large")
+		return
+	}
+	schema, err := h.graphSchema(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		var reqs []graphql.Request
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			context.String(http.StatusBadRequest, "bad body: %v", err)
+			return
+		}
+		if len(reqs) > maxGraphQLBatch {
+			context.String(http.StatusBadRequest, "at most %d requests per batch", maxGraphQLBatch)
+			return
+		}
+		out := make([]graphql.Response, len(reqs))
+		for i, req := range reqs {
+			out[i] = schema.Execute(context, req)
+		}
+		context.JSON(http.StatusOK, out)
+		return
+	}
+	var req graphql.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, schema.Execute(context, req))
+}
+
+// scalars declares fields read straight off map sources.
+func scalars(names ...string) map[string]*graphql.Field {
+	fields := map[string]*graphql.Field{}
+	for _, n := range names {
+		fields[n] = &graphql.Field{}
+	}
+	return fields
+}
+
+func graphEntry(p string, e storage.ManifestEntry) map[string]any {
+	return map[string]any{
+		"name": e.Name, "path": p, "type": e.Type, "size": e.Size,
+		"created": e.Created, "modTime": e.ModTime, "rev": e.Rev, "etag": e.ETag(),
+		"owner": e.Owner, "tags": e.Tags, "meta": e.Meta, "encryption": e.Encryption,
+		"md5": e.MD5, "sha1": e.SHA1, "expiresAt": e.ExpiresAt,
+		"immutable": e.Immutable, "immutableUntil": e.ImmutableUntil,
+	}
+}
+
+func graphShare(sh store.Share) map[string]any {
+	var expires int64
+	if !sh.Expires.IsZero() {
+		expires = sh.Expires.Unix()
+	}
+	return map[string]any{
+		"id": sh.ID, "path": sh.Path, "ownerId": sh.OwnerID, "granteeId": sh.GranteeID,
+		"created": sh.Created.Unix(), "expiresAt": expires,
+	}
+}
+
+func graphUser(u *store.User) map[string]any {
+	return map[string]any{"id": u.UserID, "email": u.Email, "username": u.Username, "admin": u.Admin}
+}
+
+// graphSchema binds the graph to one request: its user, scope and
+// permissions, as the REST routes would apply them.
+func (h *Handlers) graphSchema(context *gin.Context) (*graphql.Schema, error) {
+	mkey := h.Cfg.MasterKey
+	baseDir, err := h.baseDirFor(context)
+	if err != nil {
+		return nil, err
+	}
+	sub := authz.SubjectFrom(context)
+	ctx := context.Request.Context()
+
+	allowed := func(op authz.Op, p string) error {
+		if op != authz.Read && (h.Cfg.ReadOnly || h.Cfg.ReplicaOf != "") {
+			return errors.New("server is read-only")
+		}
+		ok, err := h.Auth.Authz.Check(ctx, sub, op, baseDir, p)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("access denied")
+		}
+		if op == authz.Write {
+			if l, err := h.foreignLock(ctx, baseDir, sub.UserID, p); err != nil || l != nil {
+				if l != nil {
+					err = errors.New(lockedMessage(l))
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	stat := func(p string) (any, error) {
+		e, err := storage.StatEntry(mkey, baseDir, p)
+		if err != nil {
+			return nil, err
+		}
+		return graphEntry(p, *e), nil
+	}
+	ownShares := func(within string) ([]map[string]any, error) {
+		shares, err := h.Stores.Shares.ListByOwner(ctx, sub.UserID)
+		if err != nil {
+			return nil, err
+		}
+		out := []map[string]any{}
+		for _, sh := range shares {
+			if within == "" || within == "." || sh.Path == within || strings.HasPrefix(sh.Path, within+"/") {
+				out = append(out, graphShare(sh))
+			}
+		}
+		return out, nil
+	}
+
+	user := &graphql.Object{Name: "User", Fields: scalars("id", "email", "username", "admin")}
+	entry := &graphql.Object{Name: "Entry", Fields: scalars("name", "path", "type", "size", "created", "modTime", "rev", "etag",
+		"owner", "tags", "meta", "encryption", "md5", "sha1", "expiresAt", "immutable", "immutableUntil")}
+	lock := &graphql.Object{Name: "Lock", Fields: scalars("owner", "ownerId", "created", "expires")}
+	entry.Fields["lock"] = &graphql.Field{Type: lock, Resolve: func(p graphql.Params) (any, error) {
+		l, err := h.Stores.Locks.Get(ctx, baseDir, lockPath(p.Source.(map[string]any)["path"].(string)))
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"owner": l.Owner, "ownerId": l.OwnerID, "created": l.Created.Unix(), "expires": l.Expires.Unix()}, nil
+	}}
+	quota := &graphql.Object{Name: "Quota", Fields: scalars("usedBytes", "quotaBytes", "percent", "alertLevel", "diskAlertLevel", "org")}
+	share := &graphql.Object{Name: "Share", Fields: scalars("id", "path", "ownerId", "granteeId", "created", "expiresAt")}
+	share.Fields["grantee"] = &graphql.Field{Type: user, Resolve: func(p graphql.Params) (any, error) {
+		u, err := h.Stores.Users.ByID(ctx, p.Source.(map[string]any)["granteeId"].(string))
+		if err != nil {
+			return nil, err
+		}
+		return graphUser(u), nil
+	}}
+	session := &graphql.Object{Name: "Session", Fields: scalars("id", "userAgent", "ip", "firstSeen", "lastSeen", "trusted", "current")}
+	event := &graphql.Object{Name: "Event", Fields: scalars("seq", "type", "path", "copy", "size", "time")}
+
+	resolveQuota := func(graphql.Params) (any, error) {
+		q, err := h.quota(context)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"usedBytes": q["used_bytes"], "quotaBytes": q["quota_bytes"], "percent": q["percent"],
+			"alertLevel": q["alert_level"], "diskAlertLevel": q["disk_alert_level"], "org": q["org"],
+		}, nil
+	}
+	folder := &graphql.Object{Name: "Folder", Fields: scalars("path")}
+	folder.Fields["entries"] = &graphql.Field{Type: entry, Args: map[string]graphql.Arg{"tag": {Type: "String"}}, Resolve: func(p graphql.Params) (any, error) {
+		dir := p.Source.(map[string]any)["path"].(string)
+		entries, err := storage.ListDir(mkey, baseDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		if entries, err = h.Auth.Authz.FilterReadable(ctx, sub, baseDir, dir, entries); err != nil {
+			return nil, err
+		}
+		tag, _ := p.Args["tag"].(string)
+		out := []map[string]any{}
+		for _, e := range storage.FilterByTag(entries, tag) {
+			out = append(out, graphEntry(filepath.Join(dir, e.Name), e))
+		}
+		return out, nil
+	}}
+	folder.Fields["quota"] = &graphql.Field{Type: quota, Resolve: resolveQuota}
+	folder.Fields["shares"] = &graphql.Field{Type: share, Resolve: func(p graphql.Params) (any, error) {
+		return ownShares(p.Source.(map[string]any)["path"].(string))
+	}}
+
+	path := func(p graphql.Params, arg string) string { return filepath.Clean(p.Args[arg].(string)) }
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"me": {Type: user, Resolve: func(graphql.Params) (any, error) {
+			u, err := h.Stores.Users.ByID(ctx, sub.UserID)
+			if err != nil {
+				return nil, err
+			}
+			return graphUser(u), nil
+		}},
+		"folder": {Type: folder, Args: map[string]graphql.Arg{"path": {Type: "String", Default: "."}}, Resolve: func(p graphql.Params) (any, error) {
+			dir := path(p, "path")
+			if err := allowed(authz.Read, dir); err != nil {
+				return nil, err
+			}
+			return map[string]any{"path": dir}, nil
+		}},
+		"file": {Type: entry, Args: map[string]graphql.Arg{"path": {Type: "String!"}}, Resolve: func(p graphql.Params) (any, error) {
+			if err := allowed(authz.Read, path(p, "path")); err != nil {
+				return nil, err
+			}
+			return stat(path(p, "path"))
+		}},
+		"quota": {Type: quota, Resolve: resolveQuota},
+		"shares": {Type: share, Resolve: func(graphql.Params) (any, error) {
+			return ownShares("")
+		}},
+		"sharedWithMe": {Type: share, Resolve: func(graphql.Params) (any, error) {
+			shares, err := h.Stores.Shares.ListForGrantee(ctx, sub.UserID)
+			if err != nil {
+				return nil, err
+			}
+			out := []map[string]any{}
+			for _, sh := range shares {
+				out = append(out, graphShare(sh))
+			}
+			return out, nil
+		}},
+		"sessions": {Type: session, Resolve: func(graphql.Params) (any, error) {
+			devices, err := h.Stores.Devices.ListForUser(ctx, sub.UserID)
+			if err != nil {
+				return nil, err
+			}
+			current := h.Auth.SessionDevice(context)
+			out := []map[string]any{}
+			for _, d := range devices {
+				out = append(out, map[string]any{
+					"id": d.ID, "userAgent": d.UserAgent, "ip": d.IP, "firstSeen": d.FirstSeen.Unix(),
+					"lastSeen": d.LastSeen.Unix(), "trusted": d.Trusted, "current": d.ID == current,
+				})
+			}
+			return out, nil
+		}},
+		"activity": {Type: event, Args: map[string]graphql.Arg{"since": {Type: "Int", Default: int64(0)}, "limit": {Type: "Int", Default: int64(50)}}, Resolve: func(p graphql.Params) (any, error) {
+			// the event journal records paths of the main tree only
+			if baseDir != h.Cfg.BaseDir {
+				return nil, errors.New("activity is only kept for the main tree")
+			}
+			since, limit := p.Args["since"].(int64), min(max(p.Args["limit"].(int64), 0), maxActivity)
+			evs := events.Since(uint64(max(since, 0)))
+			out := []map[string]any{}
+			for i := len(evs) - 1; i >= 0 && int64(len(out)) < limit; i-- {
+				ev := evs[i]
+				if ev.Type.Alert() {
+					continue
+				}
+				if ok, err := h.Auth.Authz.Check(ctx, sub, authz.Read, baseDir, ev.Path); err != nil || !ok {
+					continue
+				}
+				out = append(out, map[string]any{"seq": ev.Seq, "type": string(ev.Type), "path": ev.Path, "copy": ev.Copy, "size": ev.Size, "time": ev.Time})
+			}
+			return out, nil
+		}},
+	}}
+
+	mutation := &graphql.Object{Name: "Mutation", Fields: map[string]*graphql.Field{
+		"mkdir": {Type: entry, Args: map[string]graphql.Arg{"path": {Type: "String!"}}, Resolve: func(p graphql.Params) (any, error) {
+			dir := path(p, "path")
+			if err := allowed(authz.Write, dir); err != nil {
+				return nil, err
+			}
+			if err := storage.MakeDir(mkey, baseDir, dir, sub.UserID); err != nil {
+				return nil, err
+			}
+			return stat(dir)
+		}},
+		"delete": {Args: map[string]graphql.Arg{"path": {Type: "String!"}}, Resolve: func(p graphql.Params) (any, error) {
+			target := path(p, "path")
+			if target == "." {
+				return nil, errors.New("cannot delete the root")
+			}
+			if err := allowed(authz.Write, target); err != nil {
+				return nil, err
+			}
+			return true, storage.Remove(mkey, baseDir, target)
+		}},
+		"rename": {Type: entry, Args: map[string]graphql.Arg{"from": {Type: "String!"}, "to": {Type: "String!"}}, Resolve: func(p graphql.Params) (any, error) {
+			from, to := path(p, "from"), path(p, "to")
+			if err := allowed(authz.Write, from); err != nil {
+				return nil, err
+			}
+			if err := allowed(authz.Write, to); err != nil {
+				return nil, err
+			}
+			if err := h.filterRename(sub, baseDir, from, to); err != nil {
+				return nil, err
+			}
+			if err := storage.Rename(mkey, baseDir, from, to); err != nil {
+				return nil, err
+			}
+			return stat(to)
+		}},
+		"setMeta": {Type: entry, Args: map[string]graphql.Arg{
+			"path": {Type: "String!"}, "tags": {Type: "[String!]"}, "meta": {Type: "JSON"},
+			"expiresAt": {Type: "Int"}, "modTime": {Type: "Int"},
+		}, Resolve: func(p graphql.Params) (any, error) {
+			target := path(p, "path")
+			if err := allowed(authz.Write, target); err != nil {
+				return nil, err
+			}
+			var patch storage.EntryPatch
+			if tags, ok := p.Args["tags"].([]any); ok {
+				patch.Tags = []string{}
+				for _, t := range tags {
+					patch.Tags = append(patch.Tags, t.(string))
+				}
+			}
+			if meta, ok := p.Args["meta"].(map[string]any); ok {
+				patch.Meta = map[string]string{}
+				for k, v := range meta {
+					s, ok := v.(string)
+					if !ok {
+						return nil, fmt.Errorf("meta value for %q must be a string", k)
+					}
+					patch.Meta[k] = s
+				}
+			}
+			if v, ok := p.Args["expiresAt"].(int64); ok {
+				patch.ExpiresAt = &v
+			}
+			if v, ok := p.Args["modTime"].(int64); ok {
+				patch.ModTime = &v
+			}
+			e, err := storage.PatchEntryMeta(mkey, baseDir, target, patch)
+			if err != nil {
+				return nil, err
+			}
+			return graphEntry(target, *e), nil
+		}},
+		"share": {Type: share, Args: map[string]graphql.Arg{"path": {Type: "String!"}, "email": {Type: "String!"}, "expiresAt": {Type: "Int"}}, Resolve: func(p graphql.Params) (any, error) {
+			// grants only apply in the main tree; org members share by role
+			if baseDir != h.Cfg.BaseDir {
+				return nil, errors.New("shares are only granted in the main tree")
+			}
+			target := path(p, "path")
+			if err := allowed(authz.Share, target); err != nil {
+				return nil, err
+			}
+			if _, e, err := storage.StatFile(mkey, baseDir, target); err == nil && e.Quarantine != nil {
+				return nil, errors.New("file is quarantined")
+			}
+			grantee, err := h.Stores.Users.ByEmail(ctx, p.Args["email"].(string))
+			if err != nil {
+				return nil, errors.New("no such user")
+			}
+			sh := store.Share{ID: randomHex(16), OwnerID: sub.UserID, Path: target, GranteeID: grantee.UserID, Created: time.Now()}
+			if v, ok := p.Args["expiresAt"].(int64); ok && v > 0 {
+				sh.Expires = time.Unix(v, 0)
+			}
+			if err := h.Stores.Shares.Create(ctx, &sh); err != nil {
+				return nil, err
+			}
+			return graphShare(sh), nil
+		}},
+		"unshare": {Args: map[string]graphql.Arg{"id": {Type: "ID!"}}, Resolve: func(p graphql.Params) (any, error) {
+			if h.Cfg.ReadOnly || h.Cfg.ReplicaOf != "" {
+				return nil, errors.New("server is read-only")
+			}
+			sh, err := h.Stores.Shares.Get(ctx, p.Args["id"].(string))
+			if err != nil || sh.OwnerID != sub.UserID && !sub.Admin {
+				return nil, errors.New("no such share")
+			}
+			return true, h.Stores.Shares.Delete(ctx, sh.ID)
+		}},
+		"revokeSession": {Args: map[string]graphql.Arg{"id": {Type: "ID!"}}, Resolve: func(p graphql.Params) (any, error) {
+			d, err := h.Stores.Devices.Get(ctx, p.Args["id"].(string))
+			if err != nil || d.UserID != sub.UserID {
+				return nil, errors.New("no such session")
+			}
+			h.Log.Printf("Device %s revoked for %s", d.ID, d.UserID)
+			return true, h.Stores.Devices.Delete(ctx, d.ID)
+		}},
+	}}
+	return &graphql.Schema{Query: query, Mutation: mutation}, nil
+}
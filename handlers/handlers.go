@@ -1,26 +1,62 @@
 package handlers
 
 import (
+	"SCloud/alerts"
 	"SCloud/auth"
+	"SCloud/authz"
+	"SCloud/config"
+	"SCloud/extract"
+	"SCloud/jobs"
+	"SCloud/mail"
+	"SCloud/metering"
+	"SCloud/preview"
+	"SCloud/progress"
+	"SCloud/stats"
 	"SCloud/storage"
-	"crypto/hmac"
+	"SCloud/store"
+	"SCloud/transcode"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var db *gorm.DB
+// Handlers serves the file and admin routes.
+type Handlers struct {
+	Cfg       *config.Config
+	Stores    store.Stores
+	Auth      *auth.Service
+	Jobs      *jobs.Runner
+	Schedule  *jobs.Scheduler
+	Mail      *mail.Mailer
+	Extract   *extract.Queue   // nil without EXTRACT_URL
+	Preview   *preview.Queue   // nil without PREVIEW_URL
+	Transcode *transcode.Queue // nil without FFMPEG
+	Alerts    *alerts.Alerts
+	Meter     *metering.Meter
+	Progress  *progress.Registry
+	Log       *log.Logger
+
+	mounts  mountTable
+	reports reportLimiter
+}
 
-func UploadHandler(c *gin.Context) {
-	// 32-byte key for AES-256-GCM
-	mkey := []byte(os.Getenv("FILEMASTERKEY"))
+func (h *Handlers) UploadHandler(c *gin.Context) {
+	// optional client id for polling /progress while this request runs
+	uploadID := c.Query("upload_id")
+	finish := h.trackUpload(c, uploadID, c.Request.ContentLength, func() bool { return true })
+	defer finish()
 
 	fh, err := c.FormFile("file")
 	if err != nil {
@@ -33,79 +69,200 @@ func UploadHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Missing target filepath")
 		return
 	}
+	policy := onConflict(c)
+	logicalPath, finalPath, ok := h.storeUpload(c, fh, uploadID, logicalPath, policy)
+	if ok {
+		uploaded(c, policy, logicalPath, finalPath)
+	}
+}
+
+// storeUpload stores the uploaded file fh at logicalPath, applying the
+// conflict policy. It answers failures itself; on success it returns the
+// path policy chose and the path the file was committed at.
+func (h *Handlers) storeUpload(c *gin.Context, fh *multipart.FileHeader, uploadID, logicalPath, policy string) (string, string, bool) {
+	// 32-byte key for AES-256-GCM
+	mkey := h.Cfg.MasterKey
 
 	// Open the uploaded file as an io.Reader (Gin stores large files on disk temp)
 	src, err := fh.Open()
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Error opening upload: %v", err)
-		return
+		return "", "", false
 	}
 	defer src.Close()
 
 	// Build a sane destination path (NO leading slash) and ensure directory exists
-	baseDir, err := os.Getwd()
+	baseDir, err := h.baseDirFor(c)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "cwd error: %v", err)
-		return
+		c.String(http.StatusInternalServerError, "storage root: %v", err)
+		return "", "", false
 	}
-	dstPath, err := storage.ResolveForCreate(mkey, baseDir, filepath.Clean(logicalPath))
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-		c.String(http.StatusInternalServerError, "mkdir: %v", err)
-		return
+	if !h.allow(c, authz.Write, baseDir, logicalPath) || !h.withinQuota(c, mkey, baseDir, fh.Size) {
+		return "", "", false
+	}
+	modTime, ok := uploadModTime(c)
+	if !ok {
+		return "", "", false
+	}
+	imagePolicy, ok := h.imagePolicy(c)
+	if !ok {
+		return "", "", false
+	}
+	base, ok := syncBase(c)
+	if !ok {
+		return "", "", false
+	}
+	logicalPath, ok = h.conflictPath(c, mkey, baseDir, logicalPath, policy)
+	if !ok {
+		return "", "", false
+	}
+	blobKey, keyOwner, encryption, err := h.uploadKey(c, mkey, baseDir, logicalPath)
+	if err != nil {
+		c.String(http.StatusForbidden, "key unavailable: %v", err)
+		return "", "", false
+	}
+	run, ok := h.filterUpload(c, filepath.Clean(logicalPath), fh.Size, fh.Header.Get("Content-Type"), encryption, false)
+	if !ok {
+		return "", "", false
+	}
+	dstPath, err := storage.ResolveForCreateAs(mkey, baseDir, filepath.Clean(logicalPath), c.GetString("userid"))
+	if createRefused(c, err) {
+		return "", "", false
+	}
+	if errors.Is(err, storage.ErrImmutable) {
+		c.String(http.StatusConflict, "resolve: %v", err)
+		return "", "", false
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "resolve: %v", err)
+		return "", "", false
 	}
 
-	// Open the destination file for writing (truncate if exists)
-	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	// Encrypt into a temp file; the old blob stays until the new one is complete
+	dst, err := storage.CreateBlob(dstPath)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Error creating file: %v", err)
-		return
+		return "", "", false
 	}
-	defer func() {
-		_ = dst.Sync()
-		_ = dst.Close()
-	}()
+	defer dst.Abort()
 
 	// Stream-encrypt directly from src -> dst (no pipes needed)
-	if err := storage.Encrypt(mkey, src, dst, 0); err != nil {
+	uid := c.GetString("userid")
+	h.Progress.Processing(uid, uploadID, fh.Size)
+	sums, text, check := storage.NewHashes(), h.textCapture(encryption), newIntegrityCheck(c.Request)
+	filter := newImageFilter(h.Progress.CountProcessed(uid, uploadID, io.TeeReader(src, check)), imagePolicy, encryption)
+	defer filter.Close()
+	stored := &storage.CountReader{R: run.Wrap(filter)}
+	if err := writeBlob(blobKey, encryption, io.TeeReader(stored, io.MultiWriter(sums, text)), dst); err != nil {
+		if uploadDenied(c, err) {
+			return "", "", false
+		}
 		c.String(http.StatusInternalServerError, "Encrypt failed: %v", err)
-		return
+		return "", "", false
+	}
+	if err := check.verify(c.Request); err != nil {
+		c.String(http.StatusBadRequest, "integrity: %v", err)
+		return "", "", false
+	}
+	if err := run.Verdict(); err != nil {
+		if !uploadDenied(c, err) {
+			c.String(http.StatusInternalServerError, "upload filter: %v", err)
+		}
+		return "", "", false
 	}
 
 	// sanity log
 	if fi, err := dst.Stat(); err == nil {
-		log.Printf("wrote %s (%d bytes) to %s", fh.Filename, fi.Size(), dstPath)
+		h.Log.Printf("wrote %s (%d bytes) to %s", fh.Filename, fi.Size(), dstPath)
 	}
 
-	plainSize := fh.Size
-	_ = storage.UpdateFileMeta(mkey, baseDir, filepath.Clean(logicalPath), plainSize, time.Now())
-
-	c.String(http.StatusOK, "File uploaded successfully")
+	info := storage.BlobInfo{KeyOwner: keyOwner, Encryption: encryption, Size: fh.Size, ModTime: modTime}
+	info.MD5, info.SHA1 = sums.Sums()
+	filter.apply(&info)
+	if run.Active() {
+		info.Size = stored.N
+	}
+	finalPath, err := commitUpload(c, mkey, baseDir, filepath.Clean(logicalPath), dst, info, base)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error saving file: %v", err)
+		return "", "", false
+	}
+	h.record(c, stats.Upload, info.Size)
+	h.afterUpload(c, baseDir, finalPath, info.MD5, encryption, text)
+	return logicalPath, finalPath, true
 }
 
-func SignedDownloadHandler(context *gin.Context) {
+func (h *Handlers) SignedDownloadHandler(context *gin.Context) {
 	fp := context.Query("fp")
 	userID := context.Query("u")
 	expStr := context.Query("exp")
 	sig := context.Query("sig")
 
 	expUnix, _ := strconv.ParseInt(expStr, 10, 64)
+	org := context.Query("org")
+	// a GET link also serves HEAD pre-flights for the same file
+	method := context.Request.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	err := h.Auth.VerifyDownload(method, fp, userID, org, context.Query("n"), context.Query("kid"), time.Unix(expUnix, 0), sig)
+	if err != nil {
+		context.String(http.StatusUnauthorized, "Invalid signature: %v", err)
+		return
+	}
+	// only genuine links are logged, so forgeries cannot flood an owner's log
+	defer h.logLinkAccess(context, context.Query("n"), userID, fp)
 	if time.Now().Unix() > expUnix {
 		context.String(http.StatusUnauthorized, "Link expired")
 		return
 	}
-
-	expectedSig := auth.SignDownload(fp, userID, time.Unix(expUnix, 0))
-	if !hmac.Equal([]byte(expectedSig), []byte(sig)) {
-		println("Expected Sig: ", expectedSig, "Sig: ", sig)
-		context.String(http.StatusUnauthorized, "Invalid signature")
+	if h.linkReported(context, context.Query("n")) {
+		return
+	}
+	// DownloadHandler re-checks the owner's access, which may have been
+	// revoked since the link was minted
+	if !h.actAsLinkOwner(context, userID, org) {
 		return
 	}
+	// a folder key kept for the link decrypts the file without the master
+	// key path
+	if k := h.Auth.LinkKey(context.Query("n")); k != nil {
+		context.Set("linkkey", k)
+	}
 	//Use DownloadHandler to do rest
-	DownloadHandler(context)
+	h.DownloadHandler(context)
+}
+
+// actAsLinkOwner sets the request up as made by the user who minted a
+// signed link, in org if the link has one. It answers 403 and returns false
+// when they can no longer act there, deprovisioned or locked accounts
+// included.
+func (h *Handlers) actAsLinkOwner(context *gin.Context, userID, org string) bool {
+	owner, err := h.Stores.Users.ByID(context.Request.Context(), userID)
+	if err != nil {
+		context.String(http.StatusForbidden, "Link owner no longer exists")
+		return false
+	}
+	if owner.Disabled || owner.Locked {
+		context.String(http.StatusForbidden, "Account disabled")
+		return false
+	}
+	context.Set("userid", owner.UserID)
+	context.Set("admin", owner.Admin)
+	if org != "" {
+		role := h.Auth.OrgRole(org, userID)
+		if role == "" {
+			context.String(http.StatusForbidden, "No longer an org member")
+			return false
+		}
+		context.Set("org", org)
+		context.Set("orgrole", role)
+	}
+	return true
 }
 
-func DownloadHandler(context *gin.Context) {
-	mkey := []byte(os.Getenv("FILEMASTERKEY"))
+func (h *Handlers) DownloadHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
 
 	requestedPath := context.Query("filepath")
 	if requestedPath == "" {
@@ -116,77 +273,303 @@ func DownloadHandler(context *gin.Context) {
 		}
 	}
 
-	baseDir, _ := os.Getwd()
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
 	//filePath := filepath.Join(baseDir, "/filestorage/", filepath.Clean(requestedPath))
-	filePath, err := storage.ResolveForRead(mkey, baseDir, filepath.Clean(requestedPath))
-	file, err := os.Open(filePath)
-
+	filePath, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(requestedPath))
 	if err != nil {
 		context.String(http.StatusNotFound, "File not found")
-		log.Printf("Error opening file: %v", err)
+		h.Log.Printf("Error resolving file: %v", err)
+		return
+	}
+	if quarantined(context, entry) {
+		return
+	}
+	h.tripwire(context, baseDir, requestedPath)
+
+	// Validators first so unchanged files never hit the disk or the cipher
+	etag := entry.ETag()
+	modTime := time.Unix(entry.ModTime, 0)
+	context.Header("ETag", etag)
+	context.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if notModified(context.Request, etag, modTime) {
+		context.Status(http.StatusNotModified)
 		return
 	}
-	defer file.Close()
 
 	// Set download headers (use the requested base name)
 	context.Header("Content-Type", "application/octet-stream")
 	context.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, filepath.Base(requestedPath)))
+	if entry.Encryption == storage.EncryptionClient {
+		context.Header("X-Encryption", storage.EncryptionClient)
+	}
+	if entry.MD5 != "" {
+		context.Header("X-Checksum-MD5", entry.MD5)
+		context.Header("X-Checksum-SHA1", entry.SHA1)
+	}
+	// Ranges need the plaintext size to map offsets onto chunks
+	size, sized := h.contentLength(filePath, entry)
+	if sized {
+		context.Header("Accept-Ranges", "bytes")
+	} else {
+		context.Header("Accept-Ranges", "none")
+	}
+
+	// HEAD is answered from the manifest alone: no disk read, no decrypt
+	if context.Request.Method == http.MethodHead {
+		if sized {
+			context.Header("Content-Length", strconv.FormatInt(size, 10))
+		}
+		context.Status(http.StatusOK)
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		h.Log.Printf("Error opening file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	// Client-encrypted blobs go back exactly as they were stored, so the
+	// standard library can handle ranges on them directly
+	if entry.Encryption == storage.EncryptionClient {
+		http.ServeContent(context.Writer, context.Request, "", modTime, file)
+		h.record(context, stats.Download, int64(max(context.Writer.Size(), 0)))
+		return
+	}
+
+	key, err := h.downloadKey(context, mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+
+	if sized && h.serveRanges(context, key, file, size, etag) {
+		return
+	}
 
 	// Pipe so we can detect decrypt errors and optionally fall back
 	pipeReader, pipeWriter := io.Pipe()
 	go func() {
 		defer pipeWriter.Close()
-		if err := storage.Decrypt(mkey, file, pipeWriter); err != nil {
-			log.Printf("Error decrypting file %s: %v", filePath, err)
+		if err := storage.Decrypt(key, file, pipeWriter); err != nil {
+			h.Log.Printf("Error decrypting file %s: %v", filePath, err)
 			pipeWriter.CloseWithError(err)
 		}
 	}()
 
 	// Stream plaintext to client
 	bytesWritten, copyErr := io.Copy(context.Writer, pipeReader)
+	h.record(context, stats.Download, bytesWritten)
 	if copyErr != nil && bytesWritten == 0 {
 		// Decryption failed before anything was sent:
 		// fall back to streaming the raw file for testing convenience.
 		if _, seekErr := file.Seek(0, io.SeekStart); seekErr == nil {
 			if _, err := io.Copy(context.Writer, file); err != nil {
-				log.Printf("Error streaming raw file %s: %v", filePath, err)
+				h.Log.Printf("Error streaming raw file %s: %v", filePath, err)
 			}
 			return
 		}
 		// If we can't seek, we can't recover; response likely has headers but no body.
-		log.Printf("Download failed and could not fall back for %s: %v", filePath, copyErr)
+		h.Log.Printf("Download failed and could not fall back for %s: %v", filePath, copyErr)
+		return
+	}
+}
+
+// contentLength reports the size a GET would send. Server-encrypted files use
+// the plaintext size from the manifest; client blobs are sent verbatim, so the
+// on-disk size is exact for them. Entries written before sizes were recorded
+// report ok=false rather than a wrong length.
+func (h *Handlers) contentLength(filePath string, entry *storage.ManifestEntry) (int64, bool) {
+	if entry.Encryption == storage.EncryptionClient {
+		if fi, err := os.Stat(filePath); err == nil {
+			return fi.Size(), true
+		}
+		return 0, false
+	}
+	return entry.Size, entry.Size > 0
+}
+
+// notModified evaluates If-None-Match (preferred) and If-Modified-Since per RFC 9110.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !modTime.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
+func (h *Handlers) DeleteHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" || filepath.Clean(requestedPath) == "." {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, requestedPath) {
 		return
 	}
+
+	if err := storage.Remove(mkey, baseDir, filepath.Clean(requestedPath)); err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, storage.ErrImmutable) {
+			status = http.StatusConflict
+		}
+		context.String(status, "Error deleting: %v", err)
+		return
+	}
+	context.String(http.StatusOK, "Deleted successfully")
 }
 
-func DeleteHandler(context *gin.Context) {
+// ExpiringHandler lists entries under filepath that expire within the given window (default 7 days).
+func (h *Handlers) ExpiringHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		requestedPath = "."
+	}
+	within := 7 * 24 * time.Hour
+	if w := context.Query("within"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < 0 {
+			context.String(http.StatusBadRequest, "bad within")
+			return
+		}
+		within = d
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
 
+	entries, err := storage.ListExpiring(mkey, baseDir, filepath.Clean(requestedPath), time.Now().Add(within))
+	if err != nil {
+		context.String(http.StatusNotFound, "Error listing expirations: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"path":    requestedPath,
+		"entries": entries,
+	})
 }
 
-func ListHandler(context *gin.Context) {
-	mkey := []byte(os.Getenv("FILEMASTERKEY"))
+func (h *Handlers) ListHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
 
 	requestedPath := context.Query("filepath")
 	if requestedPath == "" {
 		requestedPath = "." // default to root
 	}
-	baseDir, _ := os.Getwd()
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+
+	locks, err := h.dirLocks(context.Request.Context(), baseDir, requestedPath)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "locks: %v", err)
+		return
+	}
+
+	// Validators first so pollers of an unchanged folder never decrypt it
+	etag, err := h.listingETag(context, baseDir, filepath.Clean(requestedPath), locks)
+	if err != nil {
+		context.String(http.StatusNotFound, "Error listing directory: %v", err)
+		return
+	}
+	context.Header("ETag", etag)
+	context.Header("Cache-Control", "private, no-cache")
+	if context.GetHeader("If-None-Match") != "" && notModified(context.Request, etag, time.Time{}) {
+		context.Status(http.StatusNotModified)
+		return
+	}
 
 	entries, err := storage.ListDir(mkey, baseDir, filepath.Clean(requestedPath))
 	if err != nil {
 		context.String(http.StatusNotFound, "Error listing directory: %v", err)
 		return
 	}
+	// hide what the caller cannot open (other users' files in a shared dir)
+	entries, err = h.Auth.Authz.FilterReadable(context.Request.Context(), authz.SubjectFrom(context), baseDir, filepath.Clean(requestedPath), entries)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "authorization: %v", err)
+		return
+	}
+
+	// Optional tag filter
+	entries = storage.FilterByTag(entries, context.Query("tag"))
 
 	// Return plaintext metadata as JSON
 	context.JSON(http.StatusOK, gin.H{
 		"path":    requestedPath,
 		"entries": entries,
+		"locks":   locks,
+		"etag":    etag,
 	})
 }
 
-func ChunkedUploadHandler(context *gin.Context) {
-	mkey := []byte(os.Getenv("FILEMASTERKEY"))
+// listingETag is the validator for a listing of dir: it covers the
+// directory itself and everything else the response depends on, the
+// caller, the shares and key prefixes that decide what they see, the tag
+// filter and locks.
+func (h *Handlers) listingETag(context *gin.Context, baseDir, dir string, locks map[string]store.FileLock) (string, error) {
+	dirTag, err := storage.DirETag(h.Cfg.MasterKey, baseDir, dir)
+	if err != nil {
+		return "", err
+	}
+	sub := authz.SubjectFrom(context)
+	shares, err := h.Auth.Authz.ReadableVersion(context.Request.Context(), sub)
+	if err != nil {
+		return "", err
+	}
+	lockJSON, err := json.Marshal(locks)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s|%s|%t|%s|%s|%q|%s|%s|%s", dirTag, sub.UserID, sub.Admin, sub.Org, sub.OrgRole, sub.Prefixes, shares, context.Query("tag"), lockJSON))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
+
+// DiskUsageHandler reports recursive size and file/dir counts for a directory.
+func (h *Handlers) DiskUsageHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		requestedPath = "."
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+
+	usage, err := storage.DiskUsage(mkey, baseDir, filepath.Clean(requestedPath))
+	if err != nil {
+		context.String(http.StatusNotFound, "Error computing usage: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, usage)
+}
+
+func (h *Handlers) ChunkedUploadHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
 
 	// --- Chunked, stateless mode (single endpoint) ---
 	// Metadata is passed as query params or headers.
@@ -198,11 +581,16 @@ func ChunkedUploadHandler(context *gin.Context) {
 		chunkSizeStr := context.Query("chunk_size")
 		totalChunksStr := context.Query("total_chunks")
 		totalSizeStr := context.Query("total_size") // optional but recommended
+		uploadID := context.DefaultQuery("upload_id", fileID)
 
 		if path == "" || fileID == "" || chunkSizeStr == "" || totalChunksStr == "" {
 			context.String(http.StatusBadRequest, "missing chunk params")
 			return
 		}
+		if !storage.ValidFileID(fileID) {
+			context.String(http.StatusBadRequest, storage.ErrBadFileID.Error())
+			return
+		}
 
 		idx64, err := strconv.ParseUint(idxStr, 10, 32)
 		if err != nil {
@@ -226,22 +614,64 @@ func ChunkedUploadHandler(context *gin.Context) {
 			}
 		}
 
-		blob, err := io.ReadAll(context.Request.Body)
+		var done bool
+		finish := h.trackUpload(context, uploadID, totalSize, func() bool { return done })
+		defer finish()
+
+		check := newIntegrityCheck(context.Request)
+		blob, err := io.ReadAll(io.TeeReader(context.Request.Body, check))
 		if err != nil {
 			context.String(http.StatusBadRequest, "read body: %v", err)
 			return
 		}
+		// here the digest covers this chunk, not the whole file
+		if err := check.verify(context.Request); err != nil {
+			context.String(http.StatusBadRequest, "integrity: %v", err)
+			return
+		}
 		if len(blob) == 0 || len(blob) > chunkSize {
 			context.String(http.StatusBadRequest, "invalid body len=%d (max %d)", len(blob), chunkSize)
 			return
 		}
 
-		baseDir, err := os.Getwd()
+		baseDir, err := h.baseDirFor(context)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "storage root: %v", err)
+			return
+		}
+		if !h.allow(context, authz.Write, baseDir, path) || !h.withinQuota(context, mkey, baseDir, max(totalSize, int64(len(blob)))) {
+			return
+		}
+		// rename is settled at assembly; fail is also checked per chunk so the
+		// client learns early instead of after sending everything
+		policy := context.Query("on_conflict")
+		if policy != storage.ConflictRename {
+			if _, ok := h.conflictPath(context, mkey, baseDir, path, policy); !ok {
+				return
+			}
+		}
+		base, ok := syncBase(context)
+		if !ok {
+			return
+		}
+		blobKey, keyOwner, encryption, err := h.uploadKey(context, mkey, baseDir, path)
 		if err != nil {
-			context.String(http.StatusInternalServerError, "cwd error: %v", err)
+			context.String(http.StatusForbidden, "key unavailable: %v", err)
+			return
+		}
+		declared := totalSize
+		if declared == 0 {
+			declared = -1
+		}
+		if _, ok := h.filterUpload(context, filepath.Clean(path), declared, "", encryption, true); !ok {
+			return
+		}
+		if err := storage.CheckPath(path); createRefused(context, err) {
 			return
 		}
 
+		uid := context.GetString("userid")
+		h.Progress.Processing(uid, uploadID, 0)
 		done, assembledTo, err := storage.IngestChunkStateless(mkey, baseDir, storage.ChunkMeta{
 			LogicalPath: filepath.Clean(path),
 			FileID:      fileID,
@@ -249,11 +679,24 @@ func ChunkedUploadHandler(context *gin.Context) {
 			Index:       uint32(idx64),
 			TotalChunks: tc,
 			TotalSize:   totalSize,
+			BlobKey:     blobKey,
+			KeyOwner:    keyOwner,
+			Owner:       context.GetString("userid"),
+			Passthrough: encryption == storage.EncryptionClient,
+			Conflict:    policy,
+			Base:        base,
 		}, blob)
+		if createRefused(context, err) {
+			return
+		}
 		if err != nil {
 			context.String(http.StatusConflict, "ingest failed: %v", err)
 			return
 		}
+		h.Progress.AddProcessed(uid, uploadID, int64(len(blob)))
+		if done {
+			h.record(context, stats.Upload, totalSize)
+		}
 		context.JSON(http.StatusOK, gin.H{
 			"ok":          true,
 			"assembled":   done,
@@ -264,6 +707,10 @@ func ChunkedUploadHandler(context *gin.Context) {
 	}
 
 	// --- Fall back to your existing single-shot upload (unchanged) ---
+	uploadID := context.Query("upload_id")
+	finish := h.trackUpload(context, uploadID, context.Request.ContentLength, func() bool { return true })
+	defer finish()
+
 	fh, err := context.FormFile("file")
 	if err != nil {
 		context.String(http.StatusBadRequest, "No file uploaded: %v", err)
@@ -281,35 +728,191 @@ func ChunkedUploadHandler(context *gin.Context) {
 	}
 	defer src.Close()
 
-	baseDir, err := os.Getwd()
+	baseDir, err := h.baseDirFor(context)
 	if err != nil {
-		context.String(http.StatusInternalServerError, "cwd error: %v", err)
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	if !h.allow(context, authz.Write, baseDir, logicalPath) || !h.withinQuota(context, mkey, baseDir, fh.Size) {
 		return
 	}
-	dstPath, err := storage.ResolveForCreate(mkey, baseDir, filepath.Clean(logicalPath))
+	policy := onConflict(context)
+	modTime, ok := uploadModTime(context)
+	if !ok {
+		return
+	}
+	imagePolicy, ok := h.imagePolicy(context)
+	if !ok {
+		return
+	}
+	base, ok := syncBase(context)
+	if !ok {
+		return
+	}
+	logicalPath, ok = h.conflictPath(context, mkey, baseDir, logicalPath, policy)
+	if !ok {
+		return
+	}
+	blobKey, keyOwner, encryption, err := h.uploadKey(context, mkey, baseDir, logicalPath)
 	if err != nil {
-		context.String(http.StatusInternalServerError, "resolve: %v", err)
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+	run, ok := h.filterUpload(context, filepath.Clean(logicalPath), fh.Size, fh.Header.Get("Content-Type"), encryption, false)
+	if !ok {
+		return
+	}
+	dstPath, err := storage.ResolveForCreateAs(mkey, baseDir, filepath.Clean(logicalPath), context.GetString("userid"))
+	if createRefused(context, err) {
+		return
+	}
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "resolve: %v", err)
 		return
 	}
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-		context.String(http.StatusInternalServerError, "mkdir: %v", err)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "resolve: %v", err)
 		return
 	}
 
-	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	dst, err := storage.CreateBlob(dstPath)
 	if err != nil {
 		context.String(http.StatusInternalServerError, "create: %v", err)
 		return
 	}
-	defer func() { _ = dst.Sync(); _ = dst.Close() }()
-
-	if err := storage.Encrypt(mkey, src, dst, 0); err != nil {
+	defer dst.Abort()
+
+	uid := context.GetString("userid")
+	h.Progress.Processing(uid, uploadID, fh.Size)
+	sums, text, check := storage.NewHashes(), h.textCapture(encryption), newIntegrityCheck(context.Request)
+	filter := newImageFilter(h.Progress.CountProcessed(uid, uploadID, io.TeeReader(src, check)), imagePolicy, encryption)
+	defer filter.Close()
+	stored := &storage.CountReader{R: run.Wrap(filter)}
+	if err := writeBlob(blobKey, encryption, io.TeeReader(stored, io.MultiWriter(sums, text)), dst); err != nil {
+		if uploadDenied(context, err) {
+			return
+		}
 		context.String(http.StatusInternalServerError, "Encrypt failed: %v", err)
 		return
 	}
+	if err := check.verify(context.Request); err != nil {
+		context.String(http.StatusBadRequest, "integrity: %v", err)
+		return
+	}
+	if err := run.Verdict(); err != nil {
+		if !uploadDenied(context, err) {
+			context.String(http.StatusInternalServerError, "upload filter: %v", err)
+		}
+		return
+	}
 	if fi, err := dst.Stat(); err == nil {
-		log.Printf("wrote %s (%d bytes) to %s", fh.Filename, fi.Size(), dstPath)
+		h.Log.Printf("wrote %s (%d bytes) to %s", fh.Filename, fi.Size(), dstPath)
+	}
+	info := storage.BlobInfo{KeyOwner: keyOwner, Encryption: encryption, Size: fh.Size, ModTime: modTime}
+	info.MD5, info.SHA1 = sums.Sums()
+	filter.apply(&info)
+	if run.Active() {
+		info.Size = stored.N
+	}
+	finalPath, err := commitUpload(context, mkey, baseDir, filepath.Clean(logicalPath), dst, info, base)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "save: %v", err)
+		return
+	}
+	h.record(context, stats.Upload, info.Size)
+	h.afterUpload(context, baseDir, finalPath, info.MD5, encryption, text)
+	uploaded(context, policy, logicalPath, finalPath)
+}
+
+// onConflict reads the upload's on_conflict policy from the query or form.
+func onConflict(context *gin.Context) string {
+	if p := context.Query("on_conflict"); p != "" {
+		return p
+	}
+	return context.PostForm("on_conflict")
+}
+
+// uploadModTime reads the optional mtime (unix seconds) an upload should
+// carry, so sync tools can keep the source's times. Zero means now; a bad
+// value is answered with 400.
+func uploadModTime(context *gin.Context) (time.Time, bool) {
+	v := context.Query("mtime")
+	if v == "" {
+		v = context.PostForm("mtime")
+	}
+	if v == "" {
+		return time.Time{}, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		context.String(http.StatusBadRequest, "mtime must be unix seconds")
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+// conflictPath applies policy to logicalPath, answering 400/409 itself when
+// the upload cannot go ahead.
+func (h *Handlers) conflictPath(context *gin.Context, mkey []byte, baseDir, logicalPath, policy string) (string, bool) {
+	if !storage.ValidConflict(policy) {
+		context.String(http.StatusBadRequest, "on_conflict must be overwrite, fail or rename")
+		return "", false
+	}
+	final, err := storage.ResolveConflict(mkey, baseDir, logicalPath, policy)
+	if errors.Is(err, storage.ErrExists) {
+		context.String(http.StatusConflict, "%v", err)
+		return "", false
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "resolve: %v", err)
+		return "", false
+	}
+	return final, true
+}
+
+// syncBase reads the base_rev a sync client names the revision its upload
+// is based on with, and its device name; nil when there is none.
+func syncBase(context *gin.Context) (*storage.SyncBase, bool) {
+	v := context.Query("base_rev")
+	if v == "" {
+		v = context.PostForm("base_rev")
+	}
+	if v == "" {
+		return nil, true
+	}
+	rev, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || rev < 0 {
+		context.String(http.StatusBadRequest, "base_rev must be a revision number")
+		return nil, false
+	}
+	device := context.Query("device")
+	if device == "" {
+		device = context.PostForm("device")
+	}
+	return &storage.SyncBase{Rev: rev, Device: device}, true
+}
+
+// commitUpload commits an upload's blob, keeping it as a conflicted copy
+// when base is stale. It returns the path the file landed at.
+func commitUpload(context *gin.Context, mkey []byte, baseDir, logicalPath string, dst *storage.BlobFile, info storage.BlobInfo, base *storage.SyncBase) (string, error) {
+	if base == nil {
+		return logicalPath, storage.CommitBlob(mkey, baseDir, logicalPath, dst, info)
+	}
+	return storage.CommitBlobSynced(mkey, baseDir, logicalPath, dst, info, *base, context.GetString("userid"))
+}
+
+// uploaded answers a finished single-shot upload. Callers that chose a
+// conflict policy get JSON with the final path, since rename may change it;
+// older clients keep the plain-text reply. An upload kept as a conflicted
+// copy always says so.
+func uploaded(context *gin.Context, policy, logicalPath, finalPath string) {
+	if finalPath != filepath.Clean(logicalPath) {
+		context.JSON(http.StatusOK, gin.H{"message": "Saved as a conflicted copy", "path": finalPath, "conflict": true})
+		return
+	}
+	if policy == "" {
+		context.String(http.StatusOK, "File uploaded successfully")
+		return
 	}
-	_ = storage.UpdateFileMeta(mkey, baseDir, filepath.Clean(logicalPath), fh.Size, time.Now())
-	context.String(http.StatusOK, "File uploaded successfully")
+	context.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "path": logicalPath})
 }
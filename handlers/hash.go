@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// HashHandler returns the sha256 or blake3 digest of a file's content as it
+// downloads, so a client can check its copy without fetching the file
+// again. The first request reads the file through once; the digest is then
+// kept on the manifest entry until the content changes.
+func (h *Handlers) HashHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	algo := context.DefaultQuery("algo", storage.HashSHA256)
+	sum, ok := storage.NewContentHash(algo)
+	if !ok {
+		context.String(http.StatusBadRequest, "algo must be %s or %s", storage.HashSHA256, storage.HashBLAKE3)
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	clean := filepath.Clean(requestedPath)
+	blob, entry, err := storage.StatFile(mkey, baseDir, clean)
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	h.tripwire(context, baseDir, clean)
+	if cached := entry.CachedHash(algo); cached != "" {
+		context.JSON(http.StatusOK, gin.H{"path": clean, "algo": algo, "hash": cached, "size": entry.Size, "rev": entry.Rev, "cached": true})
+		return
+	}
+
+	var r io.ReadCloser
+	if entry.Encryption == storage.EncryptionClient {
+		// stored verbatim: what downloads is what is on disk
+		if r, err = os.Open(blob); err != nil {
+			context.String(http.StatusInternalServerError, "open: %v", err)
+			return
+		}
+	} else {
+		key, err := h.readKeyFor(mkey, entry)
+		if err != nil {
+			context.String(http.StatusForbidden, "key unavailable: %v", err)
+			return
+		}
+		br, err := storage.OpenBlobReader(key, blob)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "open: %v", err)
+			return
+		}
+		r = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(br, 0, br.Size()), br}
+	}
+	defer r.Close()
+	if _, err := io.Copy(sum, r); err != nil {
+		context.String(http.StatusInternalServerError, "hash failed: %v", err)
+		return
+	}
+	digest := hex.EncodeToString(sum.Sum(nil))
+	// a file rewritten meanwhile keeps its own; this one is still the
+	// digest of the revision read
+	if err := storage.SetFileHash(mkey, baseDir, clean, entry.Rev, algo, digest); err != nil && !errors.Is(err, storage.ErrChanged) {
+		h.Log.Printf("hash %s: caching %s: %v", clean, algo, err)
+	}
+	context.JSON(http.StatusOK, gin.H{"path": clean, "algo": algo, "hash": digest, "size": entry.Size, "rev": entry.Rev, "cached": false})
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// headers whose values are credentials, left out of honeytoken alerts
+var secretHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Csrf-Token"}
+
+// tripwire alerts when the file at p in baseDir, about to be read for the
+// request, is a honeytoken. The read goes ahead: whoever took the bait
+// should not learn that they did.
+func (h *Handlers) tripwire(context *gin.Context, baseDir, p string) {
+	// signed links and public folders act as their owner, who did not ask
+	userID := ""
+	if context.GetBool("authorized") {
+		userID = context.GetString("userid")
+	}
+	h.trip(context.Request.Context(), baseDir, p, userID, func() string {
+		return describeRequest(context)
+	})
+}
+
+// trip is tripwire for reads that do not come over HTTP; describe says
+// who read, and is only called for a honeytoken.
+func (h *Handlers) trip(ctx context.Context, baseDir, p, userID string, describe func() string) {
+	t, err := h.Stores.Honey.Get(ctx, baseDir, storage.PathKey(p))
+	if errors.Is(err, store.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		h.Log.Printf("honeytoken lookup %s: %v", p, err)
+		return
+	}
+	detail := describe()
+	if t.Label != "" {
+		detail = "Label: " + t.Label + "\n" + detail
+	}
+	h.Log.Printf("HONEYTOKEN %s in %s read by %q", t.Path, t.Tree, userID)
+	h.audit(ctx, userID, "honeytoken.read", t.Tree, t.Path, detail)
+	if h.Alerts != nil {
+		h.Alerts.Honeytoken(t.Tree, t.Path, detail)
+	}
+}
+
+// describeRequest sets down everything known about a request: who sent it,
+// from where and with which headers, credentials left out.
+func describeRequest(context *gin.Context) string {
+	r := context.Request
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	fmt.Fprintf(&b, "Time: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Client: %s (connection from %s)\n", context.ClientIP(), r.RemoteAddr)
+	if context.GetBool("authorized") {
+		fmt.Fprintf(&b, "User: %s (%s)\n", context.GetString("username"), context.GetString("userid"))
+	} else {
+		fmt.Fprintf(&b, "User: none; a signed link or public folder of %s\n", context.GetString("userid"))
+	}
+	b.WriteString("Headers:\n")
+	for _, name := range slices.Sorted(maps.Keys(r.Header)) {
+		value := strings.Join(r.Header[name], ", ")
+		if slices.Contains(secretHeaders, name) {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", name, value)
+	}
+	return b.String()
+}
+
+type honeytokenRequest struct {
+	Root  string `json:"root"` // storage directory as listed; "" = the main tree
+	Path  string `json:"path"`
+	Label string `json:"label"`
+}
+
+// ListHoneytokensHandler lists the planted honeytokens.
+func (h *Handlers) ListHoneytokensHandler(context *gin.Context) {
+	tokens, err := h.Stores.Honey.List(context.Request.Context())
+	if err != nil {
+		context.String(http.StatusInternalServerError, "honeytokens: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"honeytokens": tokens})
+}
+
+// PlantHoneytokenHandler makes an existing file a honeytoken: upload the
+// bait as any file, then plant it. Listings do not tell it apart.
+func (h *Handlers) PlantHoneytokenHandler(context *gin.Context) {
+	var req honeytokenRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.Path == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	if !h.knownRoot(context, &req.Root) {
+		return
+	}
+	p := storage.PathKey(req.Path)
+	if _, _, err := storage.StatFile(h.Cfg.MasterKey, req.Root, p); err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	ctx := context.Request.Context()
+	t := &store.Honeytoken{Tree: req.Root, Path: p, Label: req.Label, CreatorID: context.GetString("userid"), Created: time.Now()}
+	err := h.Stores.Honey.Add(ctx, t)
+	if errors.Is(err, store.ErrExists) {
+		context.String(http.StatusConflict, "%s is a honeytoken already", p)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "plant honeytoken: %v", err)
+		return
+	}
+	h.audit(ctx, t.CreatorID, "honeytoken.plant", t.Tree, t.Path, t.Label)
+	context.JSON(http.StatusOK, t)
+}
+
+// RemoveHoneytokenHandler turns a honeytoken back into a plain file.
+func (h *Handlers) RemoveHoneytokenHandler(context *gin.Context) {
+	var req honeytokenRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if !h.knownRoot(context, &req.Root) {
+		return
+	}
+	ctx := context.Request.Context()
+	p := storage.PathKey(req.Path)
+	if err := h.Stores.Honey.Delete(ctx, req.Root, p); err != nil {
+		context.String(http.StatusNotFound, "%s is not a honeytoken", p)
+		return
+	}
+	h.audit(ctx, context.GetString("userid"), "honeytoken.remove", req.Root, p, "")
+	context.JSON(http.StatusOK, gin.H{"message": "Honeytoken removed", "root": req.Root, "path": p})
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"SCloud/imagemeta"
+	"SCloud/storage"
+	"github.com/gin-gonic/gin"
+	"io"
+	"maps"
+	"net/http"
+)
+
+// imagePolicy reads what an upload does with image metadata: the optional
+// metadata parameter (keep, strip or record), else the uploader's setting.
+// A bad value is answered with 400, a failed lookup of the setting with 500.
+func (h *Handlers) imagePolicy(context *gin.Context) (string, bool) {
+	v := context.Query("metadata")
+	if v == "" {
+		v = context.PostForm("metadata")
+	}
+	if v != "" {
+		policy, err := imagemeta.ParsePolicy(v)
+		if err != nil {
+			context.String(http.StatusBadRequest, "%v", err)
+			return "", false
+		}
+		return policy, true
+	}
+	user, err := h.Stores.Users.ByID(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "user lookup: %v", err)
+		return "", false
+	}
+	return user.ImageMetadata, true
+}
+
+// imageFilter strips metadata from an upload on its way to the blob, per
+// policy, and keeps the start of the original for imagemeta.Probe.
+// Client-encrypted uploads are opaque and pass as they are.
+type imageFilter struct {
+	io.ReadCloser
+	policy string
+	head   *textCapture
+	res    *imagemeta.Result
+	n      int64
+}
+
+func newImageFilter(r io.Reader, policy, encryption string) *imageFilter {
+	if encryption == storage.EncryptionClient {
+		return &imageFilter{ReadCloser: io.NopCloser(r)}
+	}
+	f := &imageFilter{policy: policy, head: &textCapture{limit: imagemeta.ProbeSize}}
+	r = io.TeeReader(r, f.head)
+	if policy == imagemeta.PolicyKeep {
+		f.ReadCloser = io.NopCloser(r)
+	} else {
+		f.ReadCloser, f.res = imagemeta.Strip(r)
+	}
+	return f
+}
+
+func (f *imageFilter) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	f.n += int64(n)
+	return n, err
+}
+
+// apply notes in info what the upload, once read, said about itself: a
+// stripped image's new size, its dimensions and capture time and, under
+// PolicyRecord, what its EXIF said. Whatever an earlier version of the file
+// said goes.
+func (f *imageFilter) apply(info *storage.BlobInfo) {
+	if f.head == nil {
+		return
+	}
+	info.ImageMeta = map[string]string{}
+	if f.res != nil && f.res.Format != "" {
+		info.Size = f.n
+		if f.policy == imagemeta.PolicyRecord && f.res.Exif != nil {
+			info.ImageMeta = f.res.Exif.Fields()
+		}
+	}
+	if i, err := imagemeta.Probe(f.head.buf); err == nil {
+		maps.Copy(info.ImageMeta, i.Fields())
+	}
+}
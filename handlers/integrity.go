@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// contentDigest is the header, or more usefully trailer, a client names
+// the SHA-256 of the file it is sending in. As a trailer it arrives after
+// the body, so a transfer cut short never carries a digest that matches.
+const contentDigest = "X-Content-SHA256"
+
+// integrityCheck hashes an upload's bytes as they stream through to be
+// compared with the client's X-Content-SHA256. It does nothing when the
+// client sent none.
+type integrityCheck struct {
+	h       hash.Hash
+	header  string
+	trailer bool
+}
+
+func newIntegrityCheck(r *http.Request) *integrityCheck {
+	_, trailer := r.Trailer[http.CanonicalHeaderKey(contentDigest)]
+	header := r.Header.Get(contentDigest)
+	if !trailer && header == "" {
+		return &integrityCheck{}
+	}
+	return &integrityCheck{h: sha256.New(), header: header, trailer: trailer}
+}
+
+func (c *integrityCheck) Write(p []byte) (int, error) {
+	if c.h != nil {
+		c.h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify compares what was hashed with the digest once the body has been
+// read. A declared trailer that never came means the body did not finish.
+func (c *integrityCheck) verify(r *http.Request) error {
+	if c.h == nil {
+		return nil
+	}
+	want := c.header
+	if c.trailer {
+		// the multipart reader stops at the closing boundary; the trailer
+		// is only parsed once the body is read to its end
+		io.Copy(io.Discard, io.LimitReader(r.Body, 64<<10))
+		if want = r.Trailer.Get(contentDigest); want == "" {
+			return errors.New("X-Content-SHA256 trailer missing; the upload did not complete")
+		}
+	}
+	if got := hex.EncodeToString(c.h.Sum(nil)); !strings.EqualFold(strings.TrimSpace(want), got) {
+		return errors.New("X-Content-SHA256 does not match the data received")
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"github.com/gin-gonic/gin"
+	"io"
+	"path/filepath"
+)
+
+// uploadKey decides how a new blob at logicalPath is stored for the caller:
+// the key to encrypt under, the key owner to record ("" = master key) and the
+// encryption mode. With ?encryption=client the blob is kept verbatim; inside
+// a folder with a folder key, that key is used.
+func (h *Handlers) uploadKey(context *gin.Context, mkey []byte, baseDir, logicalPath string) ([]byte, string, string, error) {
+	mode := context.Query("encryption")
+	if mode == "" {
+		mode = context.PostForm("encryption")
+	}
+	if mode == storage.EncryptionClient {
+		return nil, "", storage.EncryptionClient, nil
+	}
+	key, keyOwner, err := h.serverKey(mkey, baseDir, logicalPath, context.GetString("userid"))
+	return key, keyOwner, "", err
+}
+
+// serverKey picks the key a server-encrypted blob at logicalPath is written
+// under for userID, and the key owner to record: the folder's key, the
+// user's own or the master key.
+func (h *Handlers) serverKey(mkey []byte, baseDir, logicalPath, userID string) ([]byte, string, error) {
+	folder, err := storage.FolderKeyFor(mkey, baseDir, filepath.Dir(filepath.Clean(logicalPath)))
+	if err != nil {
+		return nil, "", err
+	}
+	if folder != "" {
+		owner := storage.FolderKeyOwner(folder)
+		key, err := h.Auth.KeyForUser(owner)
+		return key, owner, err
+	}
+	if !h.Auth.UserKeysEnabled() {
+		return mkey, "", nil
+	}
+	key, err := h.Auth.KeyForUser(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, userID, nil
+}
+
+// writeBlob encrypts src into dst, or copies it verbatim for client-encrypted uploads.
+func writeBlob(key []byte, encryption string, src io.Reader, dst io.Writer) error {
+	if encryption == storage.EncryptionClient {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return storage.Encrypt(key, src, dst, 0)
+}
+
+// downloadKey is readKeyFor, except that a share link the file's folder key
+// was kept for is served with that key, without unwrapping anything.
+func (h *Handlers) downloadKey(context *gin.Context, mkey []byte, entry *storage.ManifestEntry) ([]byte, error) {
+	if k, ok := context.Get("linkkey"); ok && storage.FolderKeyMatches(entry.KeyOwner, k.([]byte)) {
+		return k.([]byte), nil
+	}
+	return h.readKeyFor(mkey, entry)
+}
+
+// readKeyFor returns the key that decrypts entry's blob.
+func (h *Handlers) readKeyFor(mkey []byte, entry *storage.ManifestEntry) ([]byte, error) {
+	if entry.KeyOwner == "" {
+		return mkey, nil
+	}
+	return h.Auth.KeyForUser(entry.KeyOwner)
+}
+
+// openUpload opens the plaintext of the file at logicalPath for background
+// work on an upload, provided the file still has the MD5 md5sum; it fails
+// with storage.ErrChanged otherwise.
+func (h *Handlers) openUpload(baseDir, logicalPath, md5sum string) (io.ReadCloser, *storage.ManifestEntry, error) {
+	mkey := h.Cfg.MasterKey
+	blob, entry, err := storage.StatFile(mkey, baseDir, logicalPath)
+	if err != nil || entry.MD5 != md5sum {
+		return nil, nil, storage.ErrChanged
+	}
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	br, err := storage.OpenBlobReader(key, blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	// it seeks too, for work that reads a header before the whole
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{io.NewSectionReader(br, 0, br.Size()), br}, entry, nil
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"SCloud/store"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// logLinkAccess records a request made with a validly signed link once it
+// has been answered. It counts as complete when a GET sent the whole file,
+// or the whole rendition for a rendition link.
+func (h *Handlers) logLinkAccess(context *gin.Context, linkID, ownerID, fp string) {
+	a := store.LinkAccess{
+		ID:        randomHex(16),
+		LinkID:    linkID,
+		OwnerID:   ownerID,
+		Path:      fp,
+		Time:      time.Now(),
+		IP:        context.ClientIP(),
+		UserAgent: context.Request.UserAgent(),
+		Method:    context.Request.Method,
+		Status:    context.Writer.Status(),
+		Bytes:     int64(max(context.Writer.Size(), 0)),
+	}
+	if a.Method == http.MethodGet && a.Status == http.StatusOK && context.Query("v") != "" {
+		// a rendition link: the whole of the rendition was sent
+		n, err := strconv.ParseInt(context.Writer.Header().Get("Content-Length"), 10, 64)
+		a.Complete = err == nil && a.Bytes >= n
+	} else if a.Method == http.MethodGet && a.Status == http.StatusOK {
+		baseDir, _ := h.baseDirFor(context)
+		if filePath, entry, err := storage.StatFile(h.Cfg.MasterKey, baseDir, fp); err == nil {
+			if size, ok := h.contentLength(filePath, entry); ok {
+				a.Complete = a.Bytes >= size
+			}
+		}
+	}
+	if err := h.Stores.Links.Add(context.Request.Context(), &a); err != nil {
+		h.Log.Printf("link access log: %v", err)
+	}
+}
+
+// LinkAccessesHandler lists the uses of one of the caller's signed links,
+// newest first. Admins may see anyone's.
+func (h *Handlers) LinkAccessesHandler(context *gin.Context) {
+	accesses, err := h.Stores.Links.ListForLink(context.Request.Context(), context.Param("id"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "accesses: %v", err)
+		return
+	}
+	userID, admin := context.GetString("userid"), context.GetBool("admin")
+	out := []store.LinkAccess{}
+	for _, a := range accesses {
+		if a.OwnerID == userID || admin {
+			out = append(out, a)
+		}
+	}
+	slices.Reverse(out)
+	context.JSON(http.StatusOK, gin.H{"id": context.Param("id"), "accesses": out})
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLockTTL = 5 * time.Minute
+	maxLockTTL     = 24 * time.Hour
+)
+
+type lockRequest struct {
+	FilePath string `json:"filepath"`
+	TTL      int    `json:"ttl"`   // seconds; 0 is the default
+	Owner    string `json:"owner"` // shown to others, e.g. a WebDAV owner
+	Token    string `json:"token"` // set to refresh a lock already held
+}
+
+// lockToken reads the token a request proves a lock with: ?token= or a
+// WebDAV style Lock-Token header, angle brackets and all.
+func lockToken(context *gin.Context) string {
+	if t := context.Query("token"); t != "" {
+		return t
+	}
+	return strings.Trim(context.GetHeader("Lock-Token"), "<> ")
+}
+
+// lockPath is p as locks are keyed: its storage.PathKey, so every spelling
+// of a path finds the same lock, and "." for the top.
+func lockPath(p string) string {
+	if p = storage.PathKey(p); p == "" {
+		return "."
+	}
+	return p
+}
+
+// foreignLock returns the live lock someone other than userID holds on p,
+// or on a directory above it, in the tree at baseDir; nil if there is none.
+func (h *Handlers) foreignLock(ctx context.Context, baseDir, userID, p string) (*store.FileLock, error) {
+	for p = lockPath(p); ; p = filepath.Dir(p) {
+		l, err := h.Stores.Locks.Get(ctx, baseDir, p)
+		if err == nil && l.OwnerID != userID {
+			return l, nil
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+		if p == "." {
+			return nil, nil
+		}
+	}
+}
+
+// LockHandler takes or refreshes an advisory lock on a file or directory.
+// Writes there by anyone else are answered 423 until it is released or
+// its ttl runs out.
+func (h *Handlers) LockHandler(context *gin.Context) {
+	var req lockRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	ttl := defaultLockTTL
+	if req.TTL > 0 {
+		ttl = min(time.Duration(req.TTL)*time.Second, maxLockTTL)
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, req.FilePath) {
+		return
+	}
+	ctx := context.Request.Context()
+	now := time.Now()
+	l := store.FileLock{
+		Tree:    baseDir,
+		Path:    lockPath(req.FilePath),
+		Token:   req.Token,
+		OwnerID: context.GetString("userid"),
+		Owner:   req.Owner,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	if l.Token == "" {
+		l.Token = "opaquelocktoken:" + randomHex(16)
+	} else if cur, err := h.Stores.Locks.Get(ctx, baseDir, l.Path); err == nil && l.Owner == "" && cur.Token == l.Token {
+		l.Owner = cur.Owner
+	}
+	err := h.Stores.Locks.Acquire(ctx, &l)
+	if errors.Is(err, store.ErrExists) {
+		h.lockedResponse(context, baseDir, l.Path)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "lock: %v", err)
+		return
+	}
+	held, err := h.Stores.Locks.Get(ctx, baseDir, l.Path)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "lock: %v", err)
+		return
+	}
+	context.Header("Lock-Token", "<"+held.Token+">")
+	context.JSON(http.StatusOK, held)
+}
+
+// lockedResponse answers 423 naming whoever holds the lock on p.
+func (h *Handlers) lockedResponse(context *gin.Context, baseDir, p string) {
+	l, err := h.Stores.Locks.Get(context.Request.Context(), baseDir, p)
+	if err != nil {
+		context.String(http.StatusLocked, "%s is locked", p)
+		return
+	}
+	context.String(http.StatusLocked, "%s", lockedMessage(l))
+}
+
+func lockedMessage(l *store.FileLock) string {
+	holder := l.Owner
+	if holder == "" {
+		holder = l.OwnerID
+	}
+	return fmt.Sprintf("%s is locked by %s until %s", l.Path, holder, l.Expires.UTC().Format(time.RFC3339))
+}
+
+// UnlockHandler releases a lock given its token. An admin may break any
+// lock without one.
+func (h *Handlers) UnlockHandler(context *gin.Context) {
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	ctx := context.Request.Context()
+	p := lockPath(requestedPath)
+	token := lockToken(context)
+	if token == "" && context.GetBool("admin") {
+		if l, err := h.Stores.Locks.Get(ctx, baseDir, p); err == nil {
+			token = l.Token
+		}
+	}
+	err := h.Stores.Locks.Release(ctx, baseDir, p, token)
+	if errors.Is(err, store.ErrNotFound) {
+		context.String(http.StatusConflict, "no lock on %s with that token", p)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "unlock: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Unlocked", "path": p})
+}
+
+// LockInfoHandler reports the live lock on a path, if any. Only its holder
+// sees the token.
+func (h *Handlers) LockInfoHandler(context *gin.Context) {
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	l, err := h.Stores.Locks.Get(context.Request.Context(), baseDir, lockPath(requestedPath))
+	if errors.Is(err, store.ErrNotFound) {
+		context.JSON(http.StatusOK, gin.H{"path": lockPath(requestedPath), "locked": false})
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "lock: %v", err)
+		return
+	}
+	if l.OwnerID != context.GetString("userid") {
+		l.Token = ""
+	}
+	context.JSON(http.StatusOK, gin.H{"path": l.Path, "locked": true, "lock": l})
+}
+
+// dirLocks returns the live locks on the entries of dir, by name, for
+// listings. Tokens are left out.
+func (h *Handlers) dirLocks(ctx context.Context, baseDir, dir string) (map[string]store.FileLock, error) {
+	locks, err := h.Stores.Locks.List(ctx, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]store.FileLock{}
+	for _, l := range locks {
+		if l.Path != "." && filepath.Dir(l.Path) == lockPath(dir) {
+			l.Token = ""
+			out[filepath.Base(l.Path)] = l
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLockPath(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		fold     bool // case-insensitive lookups
+	}{
+		{in: "", want: "."},
+		{in: "/", want: "."},
+		{in: ".", want: "."},
+		{in: "a/b", want: "a/b"},
+		{in: "/a//b/", want: "a/b"},
+		{in: "a/./c/../b", want: "a/b"},
+		{in: "../../a", want: "a"},
+		{in: "Docs/A.txt", want: "Docs/A.txt"},
+		{in: "Docs/A.txt", want: "docs/a.txt", fold: true},
+		{in: "cafe\u0301", want: "caf\u00e9"}, // NFD to NFC
+		{in: "CAFE\u0301", want: "caf\u00e9", fold: true},
+	} {
+		storage.SetCaseInsensitive(tc.fold)
+		if got := lockPath(tc.in); got != tc.want {
+			t.Errorf("lockPath(%q) fold=%v = %q, want %q", tc.in, tc.fold, got, tc.want)
+		}
+	}
+	storage.SetCaseInsensitive(false)
+}
+
+func TestForeignLockSpellings(t *testing.T) {
+	ctx := context.Background()
+	h := &Handlers{Stores: store.NewMemoryStores()}
+	now := time.Now()
+	if err := h.Stores.Locks.Acquire(ctx, &store.FileLock{
+		Tree: "tree", Path: lockPath("Café"), Token: "t", OwnerID: "bob", Created: now, Expires: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user, path string
+		locked     bool
+	}{
+		{"alice", "Café", true},
+		{"alice", "/Cafe\u0301/menu.txt", true}, // NFD, below the lock
+		{"alice", "Cafés/menu.txt", false},
+		{"alice", "other.txt", false},
+		{"bob", "Café/menu.txt", false}, // the holder
+	} {
+		l, err := h.foreignLock(ctx, "tree", tc.user, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (l != nil) != tc.locked {
+			t.Errorf("foreignLock(%s, %q) = %v, want locked %v", tc.user, tc.path, l, tc.locked)
+		}
+	}
+}
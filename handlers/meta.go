@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+)
+
+type metaPatchRequest struct {
+	FilePath string            `json:"filepath"`
+	Tags     []string          `json:"tags"` // omitted = unchanged, [] = clear
+	Meta     map[string]string `json:"meta"` // merged; "" deletes a key
+	Expires  *int64            `json:"expires_at"`
+	ModTime  *int64            `json:"mod_time"` // unix seconds; omitted = now
+
+	Immutable      *bool  `json:"immutable"`
+	ImmutableUntil *int64 `json:"immutable_until"`
+}
+
+// MetaHandler sets tags, custom metadata, expiry, holds and the modification
+// time on a file or directory.
+func (h *Handlers) MetaHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	var req metaPatchRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, req.FilePath) {
+		return
+	}
+	entry, err := storage.PatchEntryMeta(mkey, baseDir, filepath.Clean(req.FilePath), storage.EntryPatch{
+		Tags:      req.Tags,
+		Meta:      req.Meta,
+		ExpiresAt: req.Expires,
+		ModTime:   req.ModTime,
+
+		Immutable:      req.Immutable,
+		ImmutableUntil: req.ImmutableUntil,
+	})
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "meta update failed: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusBadRequest, "meta update failed: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"path":  req.FilePath,
+		"entry": entry,
+	})
+}
@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/stats"
+	"SCloud/storage"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The mount API serves filesystem clients (FUSE and the like), which stat
+// and read far more often than a browser and in much smaller pieces.
+const (
+	maxStatBatch    = 1000
+	readdirPage     = 500
+	maxReaddirPage  = 5000
+	mountHandleIdle = 2 * time.Minute // a read token lapses this long after its last use
+	maxMountHandles = 256             // open per user
+)
+
+// mountHandle is a file opened through the mount API. It keeps the blob
+// open with its key derived and chunk table read, so reads only decrypt.
+type mountHandle struct {
+	userID  string
+	token   string
+	size    int64
+	mu      sync.Mutex // BlobReader is not safe for concurrent reads
+	r       io.ReaderAt
+	closer  io.Closer
+	expires time.Time
+}
+
+type mountTable struct {
+	mu      sync.Mutex
+	handles map[string]*mountHandle
+}
+
+// add registers mh, dropping lapsed handles first, and returns its ID.
+func (t *mountTable) add(mh *mountHandle) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.handles == nil {
+		t.handles = map[string]*mountHandle{}
+	}
+	now, held := time.Now(), 0
+	for id, o := range t.handles {
+		if now.After(o.expires) {
+			delete(t.handles, id)
+			o.close()
+		} else if o.userID == mh.userID {
+			held++
+		}
+	}
+	if held >= maxMountHandles {
+		return "", fmt.Errorf("too many open files (max %d)", maxMountHandles)
+	}
+	id := randomHex(16)
+	t.handles[id] = mh
+	return id, nil
+}
+
+// get returns the live handle id, if token opens it, and extends its life.
+func (t *mountTable) get(id, token string) *mountHandle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mh := t.handles[id]
+	if mh == nil || subtle.ConstantTimeCompare([]byte(mh.token), []byte(token)) != 1 {
+		return nil
+	}
+	if time.Now().After(mh.expires) {
+		delete(t.handles, id)
+		mh.close()
+		return nil
+	}
+	mh.expires = time.Now().Add(mountHandleIdle)
+	return mh
+}
+
+func (t *mountTable) remove(id, userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mh := t.handles[id]
+	if mh == nil || mh.userID != userID {
+		return false
+	}
+	delete(t.handles, id)
+	mh.close()
+	return true
+}
+
+// close waits out a read in progress, then releases the blob.
+func (mh *mountHandle) close() {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	mh.closer.Close()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type mountStat struct {
+	Path  string      `json:"path"`
+	Entry *mountEntry `json:"entry,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// mountEntry is a manifest entry less what only the server needs: the
+// on-disk name and whose key seals the blob.
+type mountEntry struct {
+	storage.ManifestEntry
+	Enc      string `json:"enc,omitempty"`
+	KeyOwner string `json:"key_owner,omitempty"`
+}
+
+// MountStatHandler stats up to maxStatBatch paths in one request. Each
+// parent directory is read once however many of its children are asked
+// for; paths that are missing or hidden from the caller report an error
+// instead of failing the batch.
+func (h *Handlers) MountStatHandler(context *gin.Context) {
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if len(req.Paths) > maxStatBatch {
+		context.String(http.StatusBadRequest, "at most %d paths per request", maxStatBatch)
+		return
+	}
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	sub := authz.SubjectFrom(context)
+	dirs := map[string][]storage.ManifestEntry{}
+	out := make([]mountStat, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		clean := filepath.Clean(p)
+		st := mountStat{Path: p}
+		if ok, err := h.Auth.Authz.Check(context.Request.Context(), sub, authz.Read, baseDir, clean); err != nil || !ok {
+			st.Error = "not found"
+			out = append(out, st)
+			continue
+		}
+		if clean == "." {
+			st.Entry = &mountEntry{ManifestEntry: storage.ManifestEntry{Name: ".", Type: "dir"}}
+			out = append(out, st)
+			continue
+		}
+		parent := filepath.Dir(clean)
+		entries, seen := dirs[parent]
+		if !seen {
+			entries, _ = storage.ListDir(mkey, baseDir, parent)
+			dirs[parent] = entries
+		}
+		if e := storage.LookupEntry(entries, filepath.Base(clean)); e != nil {
+			st.Entry = &mountEntry{ManifestEntry: *e}
+		} else {
+			st.Error = "not found"
+		}
+		out = append(out, st)
+	}
+	context.JSON(http.StatusOK, gin.H{"entries": out})
+}
+
+// MountReaddirHandler lists a directory a page at a time, in name order.
+// The cursor it returns resumes after the last entry sent, so entries added
+// or removed between pages neither repeat nor shift the rest.
+func (h *Handlers) MountReaddirHandler(context *gin.Context) {
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		requestedPath = "."
+	}
+	limit := readdirPage
+	if v := context.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			context.String(http.StatusBadRequest, "bad limit")
+			return
+		}
+		limit = min(n, maxReaddirPage)
+	}
+	var after string
+	if c := context.Query("cursor"); c != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			context.String(http.StatusBadRequest, "bad cursor")
+			return
+		}
+		after = string(raw)
+	}
+
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	clean := filepath.Clean(requestedPath)
+	entries, err := storage.ListDir(h.Cfg.MasterKey, baseDir, clean)
+	if err != nil {
+		context.String(http.StatusNotFound, "Error listing directory: %v", err)
+		return
+	}
+	entries, err = h.Auth.Authz.FilterReadable(context.Request.Context(), authz.SubjectFrom(context), baseDir, clean, entries)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "authorization: %v", err)
+		return
+	}
+	// a file and a directory may share a name, so the type breaks ties
+	key := func(e storage.ManifestEntry) string { return e.Name + "\x00" + e.Type }
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+	start := sort.Search(len(entries), func(i int) bool { return key(entries[i]) > after })
+	page := entries[start:min(start+limit, len(entries))]
+
+	resp := gin.H{"path": requestedPath, "entries": page}
+	if start+len(page) < len(entries) {
+		resp["cursor"] = base64.RawURLEncoding.EncodeToString([]byte(key(page[len(page)-1])))
+	}
+	context.JSON(http.StatusOK, resp)
+}
+
+// MountOpenHandler opens a file for reading and returns a handle with a
+// read token for MountReadHandler. The token lapses mountHandleIdle after
+// its last use; reads through it see the file as it was when opened.
+func (h *Handlers) MountOpenHandler(context *gin.Context) {
+	var req struct {
+		FilePath string `json:"filepath"`
+	}
+	if err := context.ShouldBindJSON(&req); err != nil || req.FilePath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, req.FilePath) {
+		return
+	}
+	blob, entry, err := storage.StatFile(mkey, baseDir, filepath.Clean(req.FilePath))
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	if quarantined(context, entry) {
+		return
+	}
+	h.tripwire(context, baseDir, req.FilePath)
+
+	mh := &mountHandle{userID: context.GetString("userid"), token: randomHex(32), expires: time.Now().Add(mountHandleIdle)}
+	// client-encrypted blobs are read as stored
+	if entry.Encryption == storage.EncryptionClient {
+		f, err := os.Open(blob)
+		if err != nil {
+			context.String(http.StatusNotFound, "File not found")
+			return
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			context.String(http.StatusInternalServerError, "open: %v", err)
+			return
+		}
+		mh.r, mh.closer, mh.size = f, f, fi.Size()
+	} else {
+		key, err := h.readKeyFor(mkey, entry)
+		if err != nil {
+			context.String(http.StatusForbidden, "key unavailable: %v", err)
+			return
+		}
+		br, err := storage.OpenBlobReader(key, blob)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "open: %v", err)
+			return
+		}
+		mh.r, mh.closer, mh.size = br, br, br.Size()
+	}
+	id, err := h.mounts.add(mh)
+	if err != nil {
+		mh.closer.Close()
+		context.String(http.StatusTooManyRequests, "%v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"handle":     id,
+		"token":      mh.token,
+		"size":       mh.size,
+		"etag":       entry.ETag(),
+		"mod_time":   entry.ModTime,
+		"expires_in": int(mountHandleIdle.Seconds()),
+	})
+}
+
+// MountReadHandler serves one byte range of an open handle. It needs only
+// the handle and its token, not a session, so each read costs a map lookup
+// and the chunks it touches. Without a Range header the whole file is sent.
+func (h *Handlers) MountReadHandler(context *gin.Context) {
+	mh := h.mounts.get(context.Param("handle"), context.Query("token"))
+	if mh == nil {
+		context.String(http.StatusUnauthorized, "Handle closed or token expired")
+		return
+	}
+	start, length := int64(0), mh.size
+	status := http.StatusOK
+	if header := context.GetHeader("Range"); header != "" {
+		ranges, err := parseRanges(header, mh.size)
+		if err != nil || len(ranges) != 1 {
+			context.Header("Content-Range", fmt.Sprintf("bytes */%d", mh.size))
+			context.String(http.StatusRequestedRangeNotSatisfiable, "one satisfiable range expected")
+			return
+		}
+		start, length = ranges[0].start, ranges[0].length
+		status = http.StatusPartialContent
+		context.Header("Content-Range", ranges[0].contentRange(mh.size))
+	}
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+	context.Header("Accept-Ranges", "bytes")
+	context.Header("Content-Type", "application/octet-stream")
+	context.Header("Content-Length", strconv.FormatInt(length, 10))
+	context.Status(status)
+	n, err := io.Copy(context.Writer, io.NewSectionReader(mh.r, start, length))
+	if err != nil {
+		h.Log.Printf("mount read: %v", err)
+	}
+	h.recordFor(mh.userID, stats.Download, n)
+}
+
+// MountCloseHandler releases a handle; its token stops working.
+func (h *Handlers) MountCloseHandler(context *gin.Context) {
+	var req struct {
+		Handle string `json:"handle"`
+	}
+	if err := context.ShouldBindJSON(&req); err != nil || req.Handle == "" {
+		context.String(http.StatusBadRequest, "Missing handle")
+		return
+	}
+	if !h.mounts.remove(req.Handle, context.GetString("userid")) {
+		context.String(http.StatusNotFound, "No such handle")
+		return
+	}
+	context.String(http.StatusOK, "Closed")
+}
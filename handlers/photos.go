@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/imagemeta"
+	"SCloud/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+const maxTimelinePhotos = 10000
+
+// timelineBound checks a from/to value: a day (2006-01-02) or a month
+// (2006-01).
+func timelineBound(v string) bool {
+	if v == "" {
+		return true
+	}
+	_, err1 := time.Parse("2006-01-02", v)
+	_, err2 := time.Parse("2006-01", v)
+	return err1 == nil || err2 == nil
+}
+
+// TimelineHandler lists the caller's photos by when they were taken, newest
+// first, in groups of a day or a month (group=month). from and to bound the
+// range, both inclusive, as days or months. A photo whose EXIF gave no
+// capture time goes by its modification time; uploads recorded as images
+// (imagemeta.Probe) are all that count as photos.
+func (h *Handlers) TimelineHandler(context *gin.Context) {
+	group := context.DefaultQuery("group", "day")
+	layout := map[string]string{"day": "2006-01-02", "month": "2006-01"}[group]
+	if layout == "" {
+		context.String(http.StatusBadRequest, "group must be day or month")
+		return
+	}
+	from, to := context.Query("from"), context.Query("to")
+	if !timelineBound(from) || !timelineBound(to) {
+		context.String(http.StatusBadRequest, "from and to must be YYYY-MM-DD or YYYY-MM")
+		return
+	}
+
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	files, err := storage.FilesWithMeta(mkey, baseDir, imagemeta.FieldWidth)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "timeline: %v", err)
+		return
+	}
+	type photo struct {
+		ref   storage.FileRef
+		info  imagemeta.Info
+		taken time.Time
+	}
+	var photos []photo
+	sub := authz.SubjectFrom(context)
+	for _, f := range files {
+		info, ok := imagemeta.ParseFields(f.Entry.Meta)
+		if !ok {
+			continue
+		}
+		taken := info.Taken
+		if taken.IsZero() {
+			taken = time.Unix(f.Entry.ModTime, 0).UTC()
+		}
+		day := taken.Format("2006-01-02")
+		if from != "" && day[:len(from)] < from || to != "" && day[:len(to)] > to {
+			continue
+		}
+		if ok, err := h.Auth.Authz.Check(context.Request.Context(), sub, authz.Read, baseDir, f.Path); err != nil || !ok {
+			continue
+		}
+		photos = append(photos, photo{f, info, taken})
+	}
+	sort.Slice(photos, func(i, j int) bool {
+		if !photos[i].taken.Equal(photos[j].taken) {
+			return photos[i].taken.After(photos[j].taken)
+		}
+		return photos[i].ref.Path < photos[j].ref.Path
+	})
+	truncated := len(photos) > maxTimelinePhotos
+	photos = photos[:min(len(photos), maxTimelinePhotos)]
+
+	groups := []gin.H{}
+	var items []gin.H
+	for i, p := range photos {
+		key := p.taken.Format(layout)
+		if i == 0 || key != photos[i-1].taken.Format(layout) {
+			items = []gin.H{}
+			groups = append(groups, gin.H{"date": key})
+		}
+		items = append(items, gin.H{
+			"path":     p.ref.Path,
+			"name":     path.Base(p.ref.Path),
+			"taken":    p.taken.Format(time.RFC3339),
+			"exifTime": !p.info.Taken.IsZero(),
+			"width":    p.info.Width,
+			"height":   p.info.Height,
+			"size":     p.ref.Entry.Size,
+			"rev":      p.ref.Entry.Rev,
+		})
+		g := groups[len(groups)-1]
+		g["count"], g["photos"] = len(items), items
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"group":     group,
+		"from":      from,
+		"to":        to,
+		"groups":    groups,
+		"truncated": truncated,
+	})
+}
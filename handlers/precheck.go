@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const maxPrecheckFiles = 5000
+
+type precheckFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"` // hex MD5 or SHA-1, told apart by length
+}
+
+type precheckRequest struct {
+	Files []precheckFile `json:"files"`
+}
+
+// PrecheckHandler tells a backup client which of the files it is about to
+// upload the caller already has: a readable file anywhere in the tree with
+// the same size and hash. One of the same name is preferred when several
+// match. Files stored without digests never match.
+func (h *Handlers) PrecheckHandler(context *gin.Context) {
+	var req precheckRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if len(req.Files) > maxPrecheckFiles {
+		context.String(http.StatusRequestEntityTooLarge, "at most %d files per precheck", maxPrecheckFiles)
+		return
+	}
+	wanted := map[string]bool{}
+	for i, f := range req.Files {
+		f.Hash = strings.ToLower(f.Hash)
+		if _, err := hex.DecodeString(f.Hash); err != nil || len(f.Hash) != 32 && len(f.Hash) != 40 {
+			context.String(http.StatusBadRequest, "file %d: hash must be a hex MD5 or SHA-1", i)
+			return
+		}
+		req.Files[i].Hash = f.Hash
+		wanted[f.Hash] = true
+	}
+
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	files, err := storage.ListFiles(mkey, baseDir, func(e *storage.ManifestEntry) bool {
+		return wanted[e.MD5] || wanted[e.SHA1]
+	})
+	if err != nil {
+		context.String(http.StatusInternalServerError, "precheck: %v", err)
+		return
+	}
+	byHash := map[string][]storage.FileRef{}
+	sub := authz.SubjectFrom(context)
+	for _, f := range files {
+		if ok, err := h.Auth.Authz.Check(context.Request.Context(), sub, authz.Read, baseDir, f.Path); err != nil || !ok {
+			continue
+		}
+		for _, sum := range []string{f.Entry.MD5, f.Entry.SHA1} {
+			if wanted[sum] {
+				byHash[sum] = append(byHash[sum], f)
+			}
+		}
+	}
+
+	results := make([]gin.H, len(req.Files))
+	existing := 0
+	for i, f := range req.Files {
+		match := ""
+		for _, ref := range byHash[f.Hash] {
+			if ref.Entry.Size != f.Size {
+				continue
+			}
+			if match == "" || path.Base(ref.Path) == f.Name {
+				match = ref.Path
+			}
+			if path.Base(ref.Path) == f.Name {
+				break
+			}
+		}
+		results[i] = gin.H{"name": f.Name, "exists": match != ""}
+		if match != "" {
+			results[i]["path"] = match
+			existing++
+		}
+	}
+	context.JSON(http.StatusOK, gin.H{"results": results, "existing": existing})
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/preview"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// queuePreview has a preview rendered for the file at logicalPath, as long
+// as it still has the MD5 md5sum when its turn comes.
+func (h *Handlers) queuePreview(baseDir, logicalPath, md5sum string) {
+	mkey := h.Cfg.MasterKey
+	var entry *storage.ManifestEntry
+	h.Preview.Add(preview.Task{
+		Key:  baseDir + "\x00" + logicalPath + "\x00" + md5sum,
+		Path: logicalPath,
+		Open: func() (io.ReadCloser, error) {
+			r, e, err := h.openUpload(baseDir, logicalPath, md5sum)
+			if errors.Is(err, storage.ErrChanged) {
+				return nil, preview.ErrGone
+			}
+			entry = e
+			return r, err
+		},
+		Store: func(r io.Reader) error {
+			key, err := h.readKeyFor(mkey, entry)
+			if err != nil {
+				return err
+			}
+			return storage.WriteRendition(key, baseDir, entry, h.Preview.Kind(), r)
+		},
+	})
+}
+
+// PreviewHandler serves the rendered preview of an office document, a PDF
+// or PNG depending on PREVIEW_FORMAT.
+func (h *Handlers) PreviewHandler(context *gin.Context) {
+	if h.Preview == nil {
+		context.String(http.StatusNotFound, "previews are not enabled")
+		return
+	}
+	kind := func(p string) string {
+		if !preview.Wanted(p) {
+			return ""
+		}
+		return h.Preview.Kind()
+	}
+	h.serveRendition(context, kind, func(string) string { return h.Preview.ContentType() },
+		func(baseDir, p, _, md5sum string) { h.queuePreview(baseDir, p, md5sum) })
+}
+
+// serveRendition serves a rendition of the file at ?filepath: kind names
+// the one a path has ("" for none) and queue has a missing one made. While
+// it is being made the answer is 202 with Retry-After, so files stored
+// before renditions were enabled get theirs on first request.
+func (h *Handlers) serveRendition(context *gin.Context, kind func(string) string, contentType func(string) string, queue func(baseDir, logicalPath, kind, md5sum string)) {
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		// a signed rendition link names it fp
+		requestedPath = context.Query("fp")
+	}
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	clean := filepath.Clean(requestedPath)
+	_, entry, err := storage.StatFile(mkey, baseDir, clean)
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	if quarantined(context, entry) {
+		return
+	}
+	h.tripwire(context, baseDir, clean)
+	k := kind(clean)
+	if k == "" || entry.Encryption == storage.EncryptionClient {
+		context.String(http.StatusUnsupportedMediaType, "no rendition of this file")
+		return
+	}
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+	br, err := storage.OpenRendition(key, baseDir, entry, k)
+	if errors.Is(err, fs.ErrNotExist) && h.Cfg.ReadOnly {
+		context.String(http.StatusNotFound, "No rendition")
+		return
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		// quick renditions are made on the spot rather than queued
+		queue(baseDir, clean, k, entry.MD5)
+		if br, err = storage.OpenRendition(key, baseDir, entry, k); errors.Is(err, fs.ErrNotExist) {
+			context.Header("Retry-After", "5")
+			context.String(http.StatusAccepted, "Rendition is being made")
+			return
+		}
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "rendition: %v", err)
+		return
+	}
+	defer br.Close()
+	context.Header("Content-Type", contentType(k))
+	context.Header("Cache-Control", "private, max-age=3600")
+	http.ServeContent(context.Writer, context.Request, "", time.Unix(entry.ModTime, 0), io.NewSectionReader(br, 0, br.Size()))
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// trackUpload registers the request under the client's upload_id (if any)
+// and counts body bytes as they arrive. It must run before the body is
+// parsed. The returned func records the outcome once the handler is done.
+func (h *Handlers) trackUpload(context *gin.Context, id string, total int64, complete func() bool) func() {
+	uid := context.GetString("userid")
+	h.Progress.Start(uid, id, total)
+	context.Request.Body = h.Progress.CountReceived(uid, id, context.Request.Body)
+	return func() {
+		h.Progress.Finish(uid, id, context.Writer.Status() < http.StatusBadRequest, complete())
+	}
+}
+
+// ProgressHandler reports server-side progress for one of the caller's uploads.
+func (h *Handlers) ProgressHandler(context *gin.Context) {
+	id := context.Query("upload_id")
+	if id == "" {
+		context.String(http.StatusBadRequest, "Missing upload_id")
+		return
+	}
+	u, ok := h.Progress.Get(context.GetString("userid"), id)
+	if !ok {
+		context.String(http.StatusNotFound, "Unknown upload")
+		return
+	}
+	context.JSON(http.StatusOK, u)
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/stats"
+	"SCloud/storage"
+	"SCloud/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var bucketSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,62}$`)
+
+type publishRequest struct {
+	FilePath string `json:"filepath"`
+	Slug     string `json:"slug"` // "" picks one
+}
+
+func bucketJSON(b store.Bucket) gin.H {
+	return gin.H{"slug": b.Slug, "path": b.Path, "org": b.Org, "created": b.Created, "url": "/pub/" + b.Slug + "/"}
+}
+
+// PublishHandler makes a directory publicly readable at /pub/<slug>/.
+func (h *Handlers) PublishHandler(context *gin.Context) {
+	var req publishRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	if req.FilePath == "" {
+		context.String(http.StatusBadRequest, "Missing directory path")
+		return
+	}
+	if req.Slug == "" {
+		req.Slug = randomHex(8)
+	}
+	if !bucketSlug.MatchString(req.Slug) {
+		context.String(http.StatusBadRequest, "slug must be 3-63 lowercase letters, digits or dashes")
+		return
+	}
+	if context.GetString("root") != "" {
+		context.String(http.StatusBadRequest, "public folders are only published from the main tree or an org's")
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	dir := path.Clean("/" + req.FilePath)[1:]
+	if dir == "" {
+		dir = "."
+	}
+	if !h.allow(context, authz.Share, baseDir, dir) {
+		return
+	}
+	if _, err := storage.ListDir(h.Cfg.MasterKey, baseDir, dir); err != nil {
+		context.String(http.StatusNotFound, "not a directory: %v", err)
+		return
+	}
+	b := store.Bucket{Slug: req.Slug, OwnerID: context.GetString("userid"), Org: context.GetString("org"), Path: dir, Created: time.Now()}
+	err := h.Stores.Buckets.Create(context.Request.Context(), &b)
+	if errors.Is(err, store.ErrExists) {
+		context.String(http.StatusConflict, "slug %q is taken", b.Slug)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "publish: %v", err)
+		return
+	}
+	context.JSON(http.StatusCreated, bucketJSON(b))
+}
+
+// ListPublishedHandler lists the caller's public folders.
+func (h *Handlers) ListPublishedHandler(context *gin.Context) {
+	buckets, err := h.Stores.Buckets.ListByOwner(context.Request.Context(), context.GetString("userid"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list: %v", err)
+		return
+	}
+	out := []gin.H{}
+	for _, b := range buckets {
+		out = append(out, bucketJSON(b))
+	}
+	context.JSON(http.StatusOK, gin.H{"buckets": out})
+}
+
+// UnpublishHandler takes a public folder down; its owner or an admin may.
+func (h *Handlers) UnpublishHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	b, err := h.Stores.Buckets.Get(ctx, context.Query("slug"))
+	if err != nil || b.OwnerID != context.GetString("userid") && !context.GetBool("admin") {
+		context.String(http.StatusNotFound, "no such public folder")
+		return
+	}
+	if err := h.Stores.Buckets.Delete(ctx, b.Slug); err != nil {
+		context.String(http.StatusInternalServerError, "unpublish: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Unpublished", "slug": b.Slug})
+}
+
+// PublicHandler serves a file below a public folder, decrypted, to anyone.
+// A directory serves its index.html. Access is checked as the folder's
+// owner on every request, so it ends when theirs does. Pages are sandboxed
+// (CSP) so their scripts cannot act on a signed-in visitor's session.
+func (h *Handlers) PublicHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	b, err := h.Stores.Buckets.Get(context.Request.Context(), context.Param("slug"))
+	if err != nil {
+		context.String(http.StatusNotFound, "Not found")
+		return
+	}
+	owner, err := h.Stores.Users.ByID(context.Request.Context(), b.OwnerID)
+	if err != nil {
+		context.String(http.StatusNotFound, "Not found")
+		return
+	}
+	if owner.Disabled || owner.Locked {
+		context.String(http.StatusForbidden, "Account disabled")
+		return
+	}
+	context.Set("userid", owner.UserID)
+	context.Set("admin", owner.Admin)
+	if b.Org != "" {
+		role := h.Auth.OrgRole(b.Org, owner.UserID)
+		if role == "" {
+			context.String(http.StatusNotFound, "Not found")
+			return
+		}
+		context.Set("org", b.Org)
+		context.Set("orgrole", role)
+	}
+	baseDir, err := h.baseDirFor(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+
+	rel := context.Param("path")
+	logical := path.Join(b.Path, path.Clean("/"+rel))
+	filePath, entry, err := storage.StatFile(mkey, baseDir, logical)
+	if err != nil || rel == "" || rel[len(rel)-1] == '/' {
+		// a directory: its index, at a URL ending in / so relative links work
+		index := path.Join(logical, "index.html")
+		if filePath, entry, err = storage.StatFile(mkey, baseDir, index); err != nil {
+			context.String(http.StatusNotFound, "Not found")
+			return
+		}
+		if rel == "" || rel[len(rel)-1] != '/' {
+			context.Redirect(http.StatusMovedPermanently, "/pub/"+b.Slug+path.Clean("/"+rel)+"/")
+			return
+		}
+		logical = index
+	}
+	if ok, err := h.Auth.Authz.Check(context.Request.Context(), authz.SubjectFrom(context), authz.Read, baseDir, logical); err != nil || !ok {
+		context.String(http.StatusNotFound, "Not found")
+		return
+	}
+	if entry.Encryption == storage.EncryptionClient || entry.Quarantine != nil {
+		context.String(http.StatusNotFound, "Not found")
+		return
+	}
+	h.tripwire(context, baseDir, logical)
+	key, err := h.readKeyFor(mkey, entry)
+	if err != nil {
+		context.String(http.StatusServiceUnavailable, "key unavailable")
+		return
+	}
+	br, err := storage.OpenBlobReader(key, filePath)
+	if err != nil {
+		context.String(http.StatusNotFound, "Not found")
+		return
+	}
+	defer br.Close()
+
+	ct := mime.TypeByExtension(path.Ext(logical))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	context.Header("Content-Type", ct)
+	context.Header("ETag", entry.ETag())
+	if age := int(h.Cfg.PublicMaxAge.Seconds()); age > 0 {
+		context.Header("Cache-Control", "public, max-age="+strconv.Itoa(age))
+	} else {
+		context.Header("Cache-Control", "no-cache")
+	}
+	context.Header("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-downloads")
+	context.Header("X-Content-Type-Options", "nosniff")
+	http.ServeContent(context.Writer, context.Request, "", time.Unix(entry.ModTime, 0), io.NewSectionReader(br, 0, br.Size()))
+	h.record(context, stats.Download, int64(max(context.Writer.Size(), 0)))
+}
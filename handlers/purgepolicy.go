@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"SCloud/jobs"
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// stagingPolicy returns how long each user's unfinished uploads keep their
+// staged chunks: their admin override, or UPLOAD_STAGING_MAX_AGE. Users are
+// looked up once per policy, so take a fresh one per sweep.
+func (h *Handlers) stagingPolicy() storage.StagingPolicy {
+	ages := map[string]time.Duration{}
+	return func(owner string) time.Duration {
+		if d, ok := ages[owner]; ok {
+			return d
+		}
+		d := h.Cfg.UploadStagingMaxAge
+		if owner != "" {
+			if u, err := h.Stores.Users.ByID(context.Background(), owner); err == nil && u.StagingMaxAge > 0 {
+				d = u.StagingMaxAge
+			}
+		}
+		ages[owner] = d
+		return d
+	}
+}
+
+type retentionReport struct {
+	Expired      int   `json:"expired"` // files and dirs past their expiry
+	StaleUploads int   `json:"stale_uploads"`
+	FreedBytes   int64 `json:"freed_bytes"` // by the stale uploads
+}
+
+// RetentionJob purges expired files and dirs, and the staged chunks of
+// uploads abandoned for longer than their owner's policy allows.
+func (h *Handlers) RetentionJob(p jobs.Progress) (any, error) {
+	var r retentionReport
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		return r, err
+	}
+	p.SetTotal(int64(len(dirs)))
+	policy := h.stagingPolicy()
+	now := time.Now()
+	for _, d := range dirs {
+		purged, err := storage.PurgeExpired(h.Cfg.MasterKey, d, now)
+		r.Expired += len(purged)
+		if err != nil {
+			return r, err
+		}
+		n, freed, err := storage.ReapStaging(h.Cfg.MasterKey, d, policy)
+		r.StaleUploads += n
+		r.FreedBytes += freed
+		if err != nil {
+			return r, err
+		}
+		p.Add(1)
+	}
+	return r, nil
+}
+
+type purgePolicyRequest struct {
+	StagingMaxAge string `json:"staging_max_age"` // Go duration; "" = the deployment default
+}
+
+// PurgePolicyHandler shows a user's retention overrides beside the
+// deployment defaults they replace.
+func (h *Handlers) PurgePolicyHandler(context *gin.Context) {
+	u, err := h.Stores.Users.ByID(context.Request.Context(), context.Param("id"))
+	if err != nil {
+		context.String(http.StatusNotFound, "Unknown user")
+		return
+	}
+	h.writePurgePolicy(context, u.UserID, u.StagingMaxAge)
+}
+
+// SetPurgePolicyHandler sets or, with "", clears a user's override of how
+// long their unfinished uploads are kept.
+func (h *Handlers) SetPurgePolicyHandler(context *gin.Context) {
+	var req purgePolicyRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return
+	}
+	var d time.Duration
+	if req.StagingMaxAge != "" {
+		var err error
+		if d, err = time.ParseDuration(req.StagingMaxAge); err != nil || d <= 0 {
+			context.String(http.StatusBadRequest, "staging_max_age must be a positive duration")
+			return
+		}
+	}
+	ctx := context.Request.Context()
+	userID := context.Param("id")
+	err := h.Stores.Users.SetStagingMaxAge(ctx, userID, d)
+	if errors.Is(err, store.ErrNotFound) {
+		context.String(http.StatusNotFound, "Unknown user")
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "purge policy: %v", err)
+		return
+	}
+	h.audit(ctx, context.GetString("userid"), "purge-policy", "", "", "user "+userID+": staging_max_age="+req.StagingMaxAge)
+	h.writePurgePolicy(context, userID, d)
+}
+
+func (h *Handlers) writePurgePolicy(context *gin.Context, userID string, stagingMaxAge time.Duration) {
+	override := ""
+	effective := h.Cfg.UploadStagingMaxAge
+	if stagingMaxAge > 0 {
+		override, effective = stagingMaxAge.String(), stagingMaxAge
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"user_id":         userID,
+		"staging_max_age": override,
+		"effective":       gin.H{"staging_max_age": effective.String()},
+	})
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"SCloud/audit"
+	"SCloud/storage"
+	"SCloud/store"
+	"cmp"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditPage = 100
+	maxAuditPage     = 1000
+)
+
+// quarantined answers 403 for a quarantined file and reports whether it did.
+func quarantined(context *gin.Context, e *storage.ManifestEntry) bool {
+	if e.Quarantine == nil {
+		return false
+	}
+	context.String(http.StatusForbidden, "File is quarantined: %s", e.Quarantine.Reason)
+	return true
+}
+
+// audit records an administrative action by actorID. A failure to record
+// it is logged rather than failing the action, which has happened.
+func (h *Handlers) audit(ctx context.Context, actorID, action, tree, p, detail string) {
+	a := store.AuditEvent{ID: randomHex(16), Time: time.Now(), ActorID: actorID, Action: action, Tree: tree, Path: p, Detail: detail}
+	if err := h.Stores.Audit.Add(ctx, &a); err != nil {
+		h.Log.Printf("audit %s %s: %v", action, p, err)
+	}
+}
+
+// quarantineFile sets the file at p aside, on behalf of actorID or, with
+// actorID "", of the server itself.
+func (h *Handlers) quarantineFile(ctx context.Context, actorID, baseDir, p, source, reason string) error {
+	q := &storage.Quarantine{Reason: reason, Source: source, At: time.Now().Unix()}
+	if err := storage.SetQuarantine(h.Cfg.MasterKey, baseDir, p, q); err != nil {
+		return err
+	}
+	h.audit(ctx, actorID, "quarantine", baseDir, p, source+": "+reason)
+	return nil
+}
+
+type quarantineRequest struct {
+	Root   string `json:"root"` // storage directory as listed; "" = the main tree
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// quarantineTarget binds a quarantineRequest and checks its root is one
+// of the server's trees.
+func (h *Handlers) quarantineTarget(context *gin.Context) (quarantineRequest, bool) {
+	var req quarantineRequest
+	if err := context.ShouldBindJSON(&req); err != nil {
+		context.String(http.StatusBadRequest, "bad body: %v", err)
+		return req, false
+	}
+	if req.Path == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return req, false
+	}
+	req.Path = filepath.Clean(req.Path)
+	return req, h.knownRoot(context, &req.Root)
+}
+
+// knownRoot checks root, "" for the main tree, is one of the server's
+// trees, and fills in the main tree.
+func (h *Handlers) knownRoot(context *gin.Context, root *string) bool {
+	if *root == "" {
+		*root = h.Cfg.BaseDir
+	}
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return false
+	}
+	if !slices.Contains(dirs, *root) {
+		context.String(http.StatusBadRequest, "unknown root %q", *root)
+		return false
+	}
+	return true
+}
+
+// QuarantineHandler lets an admin set a file aside by hand.
+func (h *Handlers) QuarantineHandler(context *gin.Context) {
+	req, ok := h.quarantineTarget(context)
+	if !ok {
+		return
+	}
+	if req.Reason == "" {
+		context.String(http.StatusBadRequest, "Missing reason")
+		return
+	}
+	if err := h.quarantineFile(context.Request.Context(), context.GetString("userid"), req.Root, req.Path, storage.QuarantineAdmin, req.Reason); err != nil {
+		context.String(http.StatusNotFound, "quarantine: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "Quarantined", "root": req.Root, "path": req.Path})
+}
+
+// ListQuarantinedHandler lists every quarantined file across the trees,
+// oldest first.
+func (h *Handlers) ListQuarantinedHandler(context *gin.Context) {
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	type item struct {
+		Root  string `json:"root"`
+		Path  string `json:"path"`
+		Size  int64  `json:"size"`
+		Owner string `json:"owner,omitempty"`
+		storage.Quarantine
+	}
+	out := []item{}
+	for _, d := range dirs {
+		files, err := storage.ListFiles(h.Cfg.MasterKey, d, func(e *storage.ManifestEntry) bool { return e.Quarantine != nil })
+		if err != nil {
+			context.String(http.StatusInternalServerError, "list: %v", err)
+			return
+		}
+		for _, f := range files {
+			out = append(out, item{Root: d, Path: f.Path, Size: f.Entry.Size, Owner: f.Entry.Owner, Quarantine: *f.Entry.Quarantine})
+		}
+	}
+	slices.SortStableFunc(out, func(a, b item) int { return cmp.Compare(a.At, b.At) })
+	context.JSON(http.StatusOK, gin.H{"files": out})
+}
+
+// ReleaseQuarantineHandler lets a quarantined file be served again.
+func (h *Handlers) ReleaseQuarantineHandler(context *gin.Context) {
+	req, ok := h.quarantineTarget(context)
+	if !ok {
+		return
+	}
+	err := storage.SetQuarantine(h.Cfg.MasterKey, req.Root, req.Path, nil)
+	if errors.Is(err, storage.ErrNotQuarantined) {
+		context.String(http.StatusConflict, "%s is not quarantined", req.Path)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusNotFound, "release: %v", err)
+		return
+	}
+	h.audit(context.Request.Context(), context.GetString("userid"), "quarantine.release", req.Root, req.Path, req.Reason)
+	context.JSON(http.StatusOK, gin.H{"message": "Released", "root": req.Root, "path": req.Path})
+}
+
+// PurgeQuarantinedHandler deletes a quarantined file for good. It refuses
+// files not in quarantine: it is not a general admin delete.
+func (h *Handlers) PurgeQuarantinedHandler(context *gin.Context) {
+	req, ok := h.quarantineTarget(context)
+	if !ok {
+		return
+	}
+	mkey := h.Cfg.MasterKey
+	_, entry, err := storage.StatFile(mkey, req.Root, req.Path)
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	if entry.Quarantine == nil {
+		context.String(http.StatusConflict, "%s is not quarantined", req.Path)
+		return
+	}
+	err = storage.Remove(mkey, req.Root, req.Path)
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "purge: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "purge: %v", err)
+		return
+	}
+	h.audit(context.Request.Context(), context.GetString("userid"), "quarantine.purge", req.Root, req.Path, req.Reason)
+	context.JSON(http.StatusOK, gin.H{"message": "Purged", "root": req.Root, "path": req.Path})
+}
+
+// AuditLogHandler lists the most recent administrative actions.
+func (h *Handlers) AuditLogHandler(context *gin.Context) {
+	limit := defaultAuditPage
+	if v := context.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			context.String(http.StatusBadRequest, "bad limit")
+			return
+		}
+		limit = min(n, maxAuditPage)
+	}
+	events, err := h.Stores.Audit.List(context.Request.Context(), limit)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "audit: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// VerifyAuditHandler checks the audit chain, against ?anchor=seq:mac
+// values taken from the export when given.
+func (h *Handlers) VerifyAuditHandler(context *gin.Context) {
+	anchors := map[int64]string{}
+	for _, v := range context.QueryArray("anchor") {
+		seq, mac, err := audit.ParseAnchor(v)
+		if err != nil {
+			context.String(http.StatusBadRequest, "%v", err)
+			return
+		}
+		anchors[seq] = mac
+	}
+	report, err := audit.Verify(context.Request.Context(), h.Stores.Audit, audit.Key(h.Cfg), anchors)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "verify audit: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
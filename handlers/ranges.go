@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"SCloud/stats"
+	"SCloud/storage"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges caps how many ranges one request may ask for. Larger sets are
+// answered with the whole file rather than decrypting overlapping chunks
+// over and over.
+const maxRanges = 16
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRanges parses a "bytes=" Range header against a file of the given size.
+// Unsatisfiable ranges are dropped; errUnsatisfiable is returned only when
+// none remain.
+func parseRanges(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported range unit")
+	}
+	var ranges []byteRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// suffix range: the final N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			if n == 0 {
+				continue
+			}
+			r.start = max(size-n, 0)
+			r.length = size - r.start
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				e, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || e < start {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+				end = min(e, size-1)
+			}
+			r.start, r.length = start, end-start+1
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+// serveRanges answers a Range request for a server-encrypted file of known
+// plaintext size. It reports false when the request should fall through to a
+// full 200 response (no Range header, a stale If-Range, or a malformed or
+// oversized range set).
+func (h *Handlers) serveRanges(context *gin.Context, key []byte, file io.ReadSeeker, size int64, etag string) bool {
+	header := context.GetHeader("Range")
+	if header == "" {
+		return false
+	}
+	if ir := context.GetHeader("If-Range"); ir != "" && ir != etag {
+		return false
+	}
+	ranges, err := parseRanges(header, size)
+	if errors.Is(err, errUnsatisfiable) {
+		context.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		context.Status(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if err != nil || len(ranges) > maxRanges {
+		return false
+	}
+
+	// every range restarts from the header; chunks before it are only seeked over
+	decrypt := func(w io.Writer, r byteRange) error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return storage.DecryptRange(key, file, w, r.start, r.length)
+	}
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		context.Header("Content-Range", r.contentRange(size))
+		context.Header("Content-Length", strconv.FormatInt(r.length, 10))
+		context.Status(http.StatusPartialContent)
+		if err := decrypt(context.Writer, r); err != nil {
+			h.Log.Printf("Error decrypting range %s: %v", r.contentRange(size), err)
+		}
+		h.record(context, stats.Download, int64(max(context.Writer.Size(), 0)))
+		return true
+	}
+
+	mw := multipart.NewWriter(context.Writer)
+	context.Header("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	context.Status(http.StatusPartialContent)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {r.contentRange(size)},
+		})
+		if err != nil {
+			h.Log.Printf("Error writing range part: %v", err)
+			return true
+		}
+		if err := decrypt(part, r); err != nil {
+			h.Log.Printf("Error decrypting range %s: %v", r.contentRange(size), err)
+			return true
+		}
+	}
+	mw.Close()
+	h.record(context, stats.Download, int64(max(context.Writer.Size(), 0)))
+	return true
+}
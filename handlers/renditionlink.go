@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"SCloud/auth"
+	"SCloud/authz"
+	"SCloud/preview"
+	"SCloud/storage"
+	"SCloud/thumbnail"
+	"SCloud/transcode"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRenditionLinkTTL = 10 * time.Minute
+	maxRenditionLinkTTL     = time.Hour
+)
+
+// renditionKind is the rendition of the file at p a variant names: preview,
+// stream, or thumb in size. "" when the file has no such rendition.
+func (h *Handlers) renditionKind(variant string, size int, p string) string {
+	switch variant {
+	case "preview":
+		if h.Preview != nil && preview.Wanted(p) {
+			return h.Preview.Kind()
+		}
+	case "stream":
+		if h.Transcode != nil {
+			return transcode.Kind(p)
+		}
+	case "thumb":
+		if thumbnail.Wanted(p) {
+			return thumbnail.Kind(size)
+		}
+	}
+	return ""
+}
+
+// RenditionLinkHandler mints a signed URL for a rendition of ?filepath, for
+// embedding in pages where there is no session cookie: ?variant= is thumb
+// (the default, in ?size=), preview or stream, and ?ttl= its lifetime in
+// seconds, at most an hour. The signature covers the rendition, size and
+// format included, so the link fetches that one and nothing else.
+func (h *Handlers) RenditionLinkHandler(context *gin.Context) {
+	requestedPath := context.Query("filepath")
+	if requestedPath == "" {
+		context.String(http.StatusBadRequest, "Missing file path")
+		return
+	}
+	if context.GetString("root") != "" {
+		context.String(http.StatusBadRequest, "Links are not available for this root")
+		return
+	}
+	size, _ := strconv.Atoi(context.DefaultQuery("size", "256"))
+	ttl := defaultRenditionLinkTTL
+	if v := context.Query("ttl"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			context.String(http.StatusBadRequest, "bad ttl")
+			return
+		}
+		ttl = min(time.Duration(secs)*time.Second, maxRenditionLinkTTL)
+	}
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Share, baseDir, requestedPath) {
+		return
+	}
+	clean := filepath.Clean(requestedPath)
+	_, entry, err := storage.StatFile(h.Cfg.MasterKey, baseDir, clean)
+	if err != nil {
+		context.String(http.StatusNotFound, "File not found")
+		return
+	}
+	if quarantined(context, entry) {
+		return
+	}
+	kind := h.renditionKind(context.DefaultQuery("variant", "thumb"), size, clean)
+	if kind == "" || entry.Encryption == storage.EncryptionClient {
+		context.String(http.StatusUnsupportedMediaType, "no such rendition of this file")
+		return
+	}
+
+	userID, org := context.GetString("userid"), context.GetString("org")
+	exp := time.Now().Add(ttl)
+	nonce := randomHex(16)
+	kid, sig := h.Auth.SignDownload(auth.RenditionMethod(kind), clean, userID, org, nonce, exp)
+	link := fmt.Sprintf("%s/api/dlink/rendition?fp=%s&u=%s&v=%s&exp=%d&n=%s&kid=%s&sig=%s",
+		h.Cfg.PublicURL, url.QueryEscape(clean), userID, url.QueryEscape(kind), exp.Unix(), nonce, url.QueryEscape(kid), sig)
+	if org != "" {
+		link += "&org=" + url.QueryEscape(org)
+	}
+	context.JSON(http.StatusOK, gin.H{"url": link, "id": nonce, "expires": exp.Unix()})
+}
+
+// SignedRenditionHandler serves the rendition a signed link names, without
+// a session. Like download links, it stops working when the signing key is
+// retired or the owner loses access to the file, and its uses are logged
+// against the link.
+func (h *Handlers) SignedRenditionHandler(context *gin.Context) {
+	fp, userID, org, kind := context.Query("fp"), context.Query("u"), context.Query("org"), context.Query("v")
+	expUnix, _ := strconv.ParseInt(context.Query("exp"), 10, 64)
+	err := h.Auth.VerifyDownload(auth.RenditionMethod(kind), fp, userID, org, context.Query("n"), context.Query("kid"), time.Unix(expUnix, 0), context.Query("sig"))
+	if err != nil {
+		context.String(http.StatusUnauthorized, "Invalid signature: %v", err)
+		return
+	}
+	defer h.logLinkAccess(context, context.Query("n"), userID, fp)
+	if time.Now().Unix() > expUnix {
+		context.String(http.StatusUnauthorized, "Link expired")
+		return
+	}
+	if !h.actAsLinkOwner(context, userID, org) {
+		return
+	}
+	size, thumb := thumbnail.SizeOf(kind)
+	switch {
+	case thumb:
+		h.serveThumbnail(context, size)
+	case kind == transcode.Video || kind == transcode.Audio:
+		h.StreamHandler(context)
+	case h.Preview != nil && kind == h.Preview.Kind():
+		h.PreviewHandler(context)
+	default:
+		// the server's preview format changed since the link was minted
+		context.String(http.StatusNotFound, "No rendition")
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/stats"
+	"SCloud/storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// resumeChunkSize is what a resumable upload is staged in; a dropped
+// transfer resumes from the last whole one.
+const resumeChunkSize = 4 << 20
+
+// resumeID names the staging of an upload the client gave no file_id for,
+// so a client that never saw the response can still resume by resending
+// the same path and size.
+func resumeID(userID, path string, total int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("resume|%s|%s|%d", userID, path, total)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// uploadRange reads which bytes of the file this request carries, end
+// exclusive, and the file's size: from Content-Range ("bytes
+// start-end/total"), or else all of it, sized by total_size or
+// Content-Length.
+func uploadRange(context *gin.Context) (start, end, total int64, ok bool) {
+	if cr := context.GetHeader("Content-Range"); cr != "" {
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total); err != nil || start < 0 || end < start || end >= total {
+			context.String(http.StatusBadRequest, "Content-Range must be bytes start-end/total")
+			return 0, 0, 0, false
+		}
+		return start, end + 1, total, true
+	}
+	total = context.Request.ContentLength
+	if v := context.Query("total_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			context.String(http.StatusBadRequest, "bad total_size")
+			return 0, 0, 0, false
+		}
+		total = n
+	}
+	if total <= 0 {
+		context.String(http.StatusBadRequest, "the file size is needed: send Content-Length, total_size or Content-Range")
+		return 0, 0, 0, false
+	}
+	return 0, total, total, true
+}
+
+// ResumableUploadHandler takes a file as the raw request body and stages it
+// in chunks as it streams in, the way chunked uploads are staged. If the
+// connection drops, the whole chunks received are kept: the client asks
+// UploadStatusHandler for the offset and sends the rest with a
+// Content-Range. A request starting at 0 always starts over.
+func (h *Handlers) ResumableUploadHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+
+	logicalPath := context.Query("path")
+	if logicalPath == "" {
+		context.String(http.StatusBadRequest, "Missing target filepath")
+		return
+	}
+	start, end, total, ok := uploadRange(context)
+	if !ok {
+		return
+	}
+	uid := context.GetString("userid")
+	fileID := context.Query("file_id")
+	if fileID == "" {
+		fileID = resumeID(uid, filepath.Clean(logicalPath), total)
+	} else if !storage.ValidFileID(fileID) {
+		context.String(http.StatusBadRequest, storage.ErrBadFileID.Error())
+		return
+	}
+
+	baseDir, err := h.baseDirFor(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	if !h.allow(context, authz.Write, baseDir, logicalPath) || !h.withinQuota(context, mkey, baseDir, total-start) {
+		return
+	}
+	policy := context.Query("on_conflict")
+	if policy != storage.ConflictRename {
+		if _, ok := h.conflictPath(context, mkey, baseDir, logicalPath, policy); !ok {
+			return
+		}
+	}
+	base, ok := syncBase(context)
+	if !ok {
+		return
+	}
+	blobKey, keyOwner, encryption, err := h.uploadKey(context, mkey, baseDir, logicalPath)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+	if _, ok := h.filterUpload(context, filepath.Clean(logicalPath), total, "", encryption, true); !ok {
+		return
+	}
+	if err := storage.CheckPath(logicalPath); createRefused(context, err) {
+		return
+	}
+
+	st, err := storage.UploadStatus(mkey, baseDir, fileID)
+	switch {
+	case err != nil && !errors.Is(err, storage.ErrNoUpload):
+		context.String(http.StatusInternalServerError, "upload status: %v", err)
+		return
+	case err == nil && st.Owner != uid:
+		context.String(http.StatusConflict, "file_id belongs to a different upload")
+		return
+	case start == 0:
+		if err := storage.DiscardUpload(mkey, baseDir, fileID); err != nil {
+			context.String(http.StatusInternalServerError, "discard: %v", err)
+			return
+		}
+	case err != nil:
+		context.String(http.StatusNotFound, "no upload to resume; start again from 0")
+		return
+	default:
+		if st.TotalSize != total || st.Path != filepath.Clean(logicalPath) {
+			context.String(http.StatusConflict, "file_id belongs to a different upload")
+			return
+		}
+		// anything already staged may be resent; a gap may not
+		if start > st.Offset || start%resumeChunkSize != 0 {
+			context.Header("Content-Range", fmt.Sprintf("bytes */%d", total))
+			context.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"file_id": fileID, "offset": st.Offset})
+			return
+		}
+	}
+
+	var done bool
+	finish := h.trackUpload(context, fileID, total-start, func() bool { return done })
+	defer finish()
+	h.Progress.Processing(uid, fileID, total-start)
+
+	meta := storage.ChunkMeta{
+		LogicalPath: filepath.Clean(logicalPath),
+		FileID:      fileID,
+		ChunkSize:   resumeChunkSize,
+		TotalChunks: int((total + resumeChunkSize - 1) / resumeChunkSize),
+		TotalSize:   total,
+		BlobKey:     blobKey,
+		KeyOwner:    keyOwner,
+		Owner:       uid,
+		Passthrough: encryption == storage.EncryptionClient,
+		Conflict:    policy,
+		Base:        base,
+	}
+	buf := make([]byte, resumeChunkSize)
+	var readErr error
+	for idx := start / resumeChunkSize; idx < int64(meta.TotalChunks); idx++ {
+		n, err := io.ReadFull(context.Request.Body, buf[:min(resumeChunkSize, total-idx*resumeChunkSize)])
+		if err != nil {
+			// a body ending inside a chunk leaves it to be resent; one ending
+			// before its Content-Range says is an interrupted transfer
+			if idx*resumeChunkSize+int64(n) < end {
+				readErr = err
+			}
+			break
+		}
+		meta.Index = uint32(idx)
+		var finalPath string
+		done, finalPath, err = storage.IngestChunkStateless(mkey, baseDir, meta, buf[:n])
+		if err != nil {
+			if createRefused(context, err) {
+				return
+			}
+			context.String(http.StatusConflict, "ingest failed: %v", err)
+			return
+		}
+		h.Progress.AddProcessed(uid, fileID, int64(n))
+		if done {
+			h.record(context, stats.Upload, total)
+			context.JSON(http.StatusOK, gin.H{"ok": true, "assembled": true, "final_path": finalPath, "file_id": fileID, "offset": total})
+			return
+		}
+	}
+
+	st, err = storage.UploadStatus(mkey, baseDir, fileID)
+	if err != nil && !errors.Is(err, storage.ErrNoUpload) {
+		context.String(http.StatusInternalServerError, "upload status: %v", err)
+		return
+	}
+	if readErr != nil {
+		h.Log.Printf("upload %s interrupted at %d of %d bytes: %v", fileID, st.Offset, total, readErr)
+		context.JSON(http.StatusBadRequest, gin.H{"ok": false, "assembled": false, "file_id": fileID, "offset": st.Offset, "error": readErr.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"ok": true, "assembled": false, "file_id": fileID, "offset": st.Offset})
+}
+
+// UploadStatusHandler reports how much of one of the caller's unfinished
+// uploads, chunked or resumable, is staged: by file_id, or by the path and
+// total_size a resumable upload was started with.
+func (h *Handlers) UploadStatusHandler(context *gin.Context) {
+	uid := context.GetString("userid")
+	fileID := context.Query("file_id")
+	if fileID == "" {
+		total, err := strconv.ParseInt(context.Query("total_size"), 10, 64)
+		if context.Query("path") == "" || err != nil {
+			context.String(http.StatusBadRequest, "Missing file_id, or path and total_size")
+			return
+		}
+		fileID = resumeID(uid, filepath.Clean(context.Query("path")), total)
+	} else if !storage.ValidFileID(fileID) {
+		context.String(http.StatusBadRequest, storage.ErrBadFileID.Error())
+		return
+	}
+	baseDir, err := h.baseDirFor(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	st, err := storage.UploadStatus(h.Cfg.MasterKey, baseDir, fileID)
+	if errors.Is(err, storage.ErrNoUpload) || err == nil && st.Owner != uid {
+		context.String(http.StatusNotFound, "Unknown upload")
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "upload status: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, st)
+}
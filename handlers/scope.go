@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"SCloud/alerts"
+	"SCloud/auth"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// baseDirFor returns the storage base for the request: the server root, the
+// org's own root when Auth.OrgScope selected one, or a named root.
+func (h *Handlers) baseDirFor(context *gin.Context) (string, error) {
+	if org := context.GetString("org"); org != "" {
+		return auth.OrgBaseDir(h.Cfg.BaseDir, org), nil
+	}
+	if root := context.GetString("root"); root != "" {
+		return h.Cfg.Roots[root], nil
+	}
+	return h.Cfg.BaseDir, nil
+}
+
+// withinQuota writes a 507 and returns false when storing incoming more bytes
+// would push the request's org over its quota.
+func (h *Handlers) withinQuota(context *gin.Context, mkey []byte, baseDir string, incoming int64) bool {
+	org := context.GetString("org")
+	if org == "" {
+		return true
+	}
+	quota := h.Auth.OrgQuota(org)
+	if quota <= 0 {
+		return true
+	}
+	usage, err := storage.DiskUsage(mkey, baseDir, ".")
+	if err != nil {
+		context.String(http.StatusInternalServerError, "usage: %v", err)
+		return false
+	}
+	if usage.Size+incoming > quota {
+		context.String(http.StatusInsufficientStorage, "org quota exceeded (%d of %d bytes used)", usage.Size, quota)
+		return false
+	}
+	return true
+}
+
+// alertQuota feeds the org's usage after a write to the quota alerts. Only
+// stored bytes count, so uploads refused for the quota raise none.
+func (h *Handlers) alertQuota(context *gin.Context) {
+	org := context.GetString("org")
+	if org == "" || h.Alerts == nil {
+		return
+	}
+	quota := h.Auth.OrgQuota(org)
+	if quota <= 0 {
+		return
+	}
+	baseDir, _ := h.baseDirFor(context)
+	usage, err := storage.DiskUsage(h.Cfg.MasterKey, baseDir, ".")
+	if err != nil {
+		h.Log.Printf("quota alert %s: %v", org, err)
+		return
+	}
+	h.checkQuota(context, org, usage.Size, quota)
+}
+
+// checkQuota feeds an org's usage to the quota alerts; the org's owners and
+// admins hear about thresholds it crosses.
+func (h *Handlers) checkQuota(context *gin.Context, org string, used, quota int64) int {
+	if h.Alerts == nil {
+		return 0
+	}
+	var notify []string
+	for _, id := range h.Auth.OrgAdmins(org) {
+		if u, err := h.Stores.Users.ByID(context.Request.Context(), id); err == nil {
+			notify = append(notify, u.Email)
+		}
+	}
+	return h.Alerts.CheckQuota(org, h.Auth.OrgName(org), notify, used, quota)
+}
+
+// QuotaHandler reports the storage used in the request's scope against its
+// quota, with the alert levels in force.
+func (h *Handlers) QuotaHandler(context *gin.Context) {
+	resp, err := h.quota(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "usage: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, resp)
+}
+
+func (h *Handlers) quota(context *gin.Context) (gin.H, error) {
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	usage, err := storage.DiskUsage(mkey, baseDir, ".")
+	if err != nil {
+		return nil, err
+	}
+	resp := gin.H{"used_bytes": usage.Size, "quota_bytes": 0, "alert_level": 0}
+	if org := context.GetString("org"); org != "" {
+		resp["org"] = org
+		if quota := h.Auth.OrgQuota(org); quota > 0 {
+			resp["quota_bytes"] = quota
+			resp["percent"] = alerts.Percent(usage.Size, quota)
+			resp["alert_level"] = h.checkQuota(context, org, usage.Size, quota)
+		}
+	}
+	if h.Alerts != nil {
+		resp["disk_alert_level"] = h.Alerts.Disk.Get(h.Cfg.BaseDir)
+	}
+	return resp, nil
+}
+
+// createRefused answers err if it is storage refusing a create, for a bad
+// name or one of its limits (named so clients can tell which), and reports
+// whether it was.
+func createRefused(context *gin.Context, err error) bool {
+	if errors.Is(err, storage.ErrInvalidName) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return true
+	}
+	var l *storage.LimitError
+	if !errors.As(err, &l) {
+		return false
+	}
+	status := http.StatusBadRequest
+	if l.Limit == storage.LimitDirEntries || l.Limit == storage.LimitUserFiles {
+		status = http.StatusInsufficientStorage
+	}
+	context.JSON(status, gin.H{"error": l.Error(), "limit": l.Limit, "max": l.Max, "path": l.Path})
+	return true
+}
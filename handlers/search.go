@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/extract"
+	"SCloud/preview"
+	"SCloud/storage"
+	"SCloud/transcode"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	searchResults    = 50
+	maxSearchResults = 200
+)
+
+// textCapture keeps the start of an upload's plaintext for the content
+// index. With limit 0 it keeps nothing.
+type textCapture struct {
+	limit int
+	buf   []byte
+}
+
+func (t *textCapture) Write(p []byte) (int, error) {
+	if room := t.limit - len(t.buf); room > 0 {
+		t.buf = append(t.buf, p[:min(len(p), room)]...)
+	}
+	return len(p), nil
+}
+
+// textCapture returns the capture for an upload: empty unless content
+// indexing is on and the server sees the plaintext.
+func (h *Handlers) textCapture(encryption string) *textCapture {
+	if !h.Cfg.ContentIndex || encryption == storage.EncryptionClient {
+		return &textCapture{}
+	}
+	return &textCapture{limit: storage.MaxIndexedText}
+}
+
+// contentKey is the key userID's content index is sealed under.
+func (h *Handlers) contentKey(userID string) ([]byte, error) {
+	if !h.Auth.UserKeysEnabled() {
+		return h.Cfg.MasterKey, nil
+	}
+	return h.Auth.KeyForUser(userID)
+}
+
+// afterUpload hands a finished upload on: a text file's text goes into the
+// uploader's index, an image or PDF to the extraction queue, an office
+// document to the preview queue and video or audio to the transcoder. It only logs failures: the upload itself
+// has succeeded.
+func (h *Handlers) afterUpload(context *gin.Context, baseDir, logicalPath, md5sum, encryption string, text *textCapture) {
+	uid := context.GetString("userid")
+	if h.Preview != nil && encryption != storage.EncryptionClient && preview.Wanted(logicalPath) {
+		h.queuePreview(baseDir, logicalPath, md5sum)
+	}
+	if kind := transcode.Kind(logicalPath); h.Transcode != nil && encryption != storage.EncryptionClient && kind != "" {
+		h.queueTranscode(baseDir, logicalPath, kind, md5sum)
+	}
+	if h.Extract != nil && encryption != storage.EncryptionClient && extract.Wanted(logicalPath) {
+		h.Extract.Add(h.extractTask(baseDir, uid, logicalPath, md5sum))
+		return
+	}
+	if !storage.IsText(text.buf) {
+		return
+	}
+	key, err := h.contentKey(uid)
+	if err == nil {
+		err = storage.IndexContent(key, baseDir, uid, logicalPath, md5sum, text.buf)
+	}
+	if err != nil {
+		h.Log.Printf("content index %s: %v", logicalPath, err)
+	}
+}
+
+// extractTask reads the file uploaded to logicalPath for the extractor, as
+// long as it still holds that upload, and files the text it yields.
+func (h *Handlers) extractTask(baseDir, userID, logicalPath, md5sum string) extract.Task {
+	mkey := h.Cfg.MasterKey
+	return extract.Task{
+		Path: logicalPath,
+		Open: func() (io.ReadCloser, int64, error) {
+			r, entry, err := h.openUpload(baseDir, logicalPath, md5sum)
+			if errors.Is(err, storage.ErrChanged) {
+				return nil, 0, extract.ErrGone
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			return r, entry.Size, nil
+		},
+		Store: func(text string) error {
+			err := storage.SetExtractedText(mkey, baseDir, logicalPath, md5sum, text)
+			if errors.Is(err, storage.ErrChanged) {
+				return nil
+			}
+			if err != nil || !h.Cfg.ContentIndex || text == "" {
+				return err
+			}
+			key, err := h.contentKey(userID)
+			if err != nil {
+				return err
+			}
+			return storage.IndexContent(key, baseDir, userID, logicalPath, md5sum, []byte(text))
+		},
+	}
+}
+
+// SearchContentHandler finds the caller's uploads whose text holds every
+// word of q. Hits the caller can no longer read are left out; those whose
+// file was removed, moved or rewritten since are also dropped from the
+// index.
+func (h *Handlers) SearchContentHandler(context *gin.Context) {
+	if !h.Cfg.ContentIndex {
+		context.String(http.StatusNotFound, "content indexing is not enabled")
+		return
+	}
+	q := context.Query("q")
+	if len(storage.Terms(q)) == 0 {
+		context.String(http.StatusBadRequest, "Missing search terms")
+		return
+	}
+	limit := searchResults
+	if v := context.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			context.String(http.StatusBadRequest, "bad limit")
+			return
+		}
+		limit = min(n, maxSearchResults)
+	}
+
+	mkey := h.Cfg.MasterKey
+	baseDir, err := h.baseDirFor(context)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "storage root: %v", err)
+		return
+	}
+	uid := context.GetString("userid")
+	key, err := h.contentKey(uid)
+	if err != nil {
+		context.String(http.StatusForbidden, "key unavailable: %v", err)
+		return
+	}
+	hits, err := storage.SearchContent(key, baseDir, uid, q)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "search: %v", err)
+		return
+	}
+	sub := authz.SubjectFrom(context)
+	results, stale := []gin.H{}, []string{}
+	for _, hit := range hits {
+		if len(results) == limit {
+			break
+		}
+		_, entry, err := storage.StatFile(mkey, baseDir, hit.Path)
+		if err != nil || entry.MD5 != hit.MD5 {
+			stale = append(stale, hit.Path)
+			continue
+		}
+		if ok, err := h.Auth.Authz.Check(context.Request.Context(), sub, authz.Read, baseDir, hit.Path); err != nil || !ok {
+			continue
+		}
+		if hit.Excerpt != "" {
+			// the excerpt shows the file's text
+			h.tripwire(context, baseDir, hit.Path)
+		}
+		results = append(results, gin.H{
+			"path":    hit.Path,
+			"name":    filepath.Base(hit.Path),
+			"score":   hit.Score,
+			"excerpt": hit.Excerpt,
+			"entry":   entry,
+		})
+	}
+	if len(stale) > 0 && !h.Cfg.ReadOnly {
+		if err := storage.UnindexContent(key, baseDir, uid, stale...); err != nil {
+			h.Log.Printf("content index: %v", err)
+		}
+	}
+	context.JSON(http.StatusOK, gin.H{"query": q, "results": results})
+}
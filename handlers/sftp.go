@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/sftpd"
+	"SCloud/stats"
+	"SCloud/storage"
+	"SCloud/store"
+	"SCloud/uploadfilter"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTPTree is the tree userID sees over SFTP: the main store, with the
+// access checks, keys and metering of the file routes. Uploads are
+// server-encrypted and replace whatever was at the path.
+func (h *Handlers) SFTPTree(userID string) (sftpd.FS, error) {
+	user, err := h.Stores.Users.ByID(context.Background(), userID)
+	if err != nil {
+		return nil, err
+	}
+	return h.remoteTree(user, "", "SFTP"), nil
+}
+
+// FTPTree is the tree userID sees over FTP: SFTPTree, confined to the
+// user's FTP_CHROOT directory, which is created on first login.
+func (h *Handlers) FTPTree(userID string) (sftpd.FS, error) {
+	user, err := h.Stores.Users.ByID(context.Background(), userID)
+	if err != nil {
+		return nil, err
+	}
+	root := strings.NewReplacer("{id}", user.UserID, "{email}", user.Email, "{username}", user.Username).Replace(h.Cfg.FTPChroot)
+	root = filepath.Clean(strings.TrimPrefix(root, "/"))
+	if root != "." && !h.Cfg.ReadOnly {
+		mkey := h.Cfg.MasterKey
+		// the dirs above are shared, so nobody owns them
+		if err := storage.MakeDir(mkey, h.Cfg.BaseDir, filepath.Dir(root), ""); err != nil {
+			return nil, err
+		}
+		if err := storage.MakeDir(mkey, h.Cfg.BaseDir, root, user.UserID); err != nil {
+			return nil, err
+		}
+	}
+	return h.remoteTree(user, root, "FTP"), nil
+}
+
+// remoteTree serves user the store below root ("" for all of it) over
+// proto.
+func (h *Handlers) remoteTree(user *store.User, root, proto string) *sftpTree {
+	return &sftpTree{h: h, sub: authz.Subject{UserID: user.UserID, Admin: user.Admin}, baseDir: h.Cfg.BaseDir, root: root, proto: proto}
+}
+
+type sftpTree struct {
+	h       *Handlers
+	sub     authz.Subject
+	baseDir string
+	root    string
+	proto   string // for honeytoken alerts
+
+	// files already read this session: clients reopen a file at each
+	// offset they jump to, and a honeytoken should alert once
+	readMu sync.Mutex
+	read   map[string]bool
+}
+
+// full maps a tree path onto the store.
+func (t *sftpTree) full(p string) string {
+	if t.root == "" {
+		return p
+	}
+	return filepath.Join(t.root, p)
+}
+
+func (t *sftpTree) check(op authz.Op, p string) error {
+	if op != authz.Read && t.h.Cfg.ReadOnly {
+		return fmt.Errorf("server is read-only: %w", fs.ErrPermission)
+	}
+	ok, err := t.h.Auth.Authz.Check(context.Background(), t.sub, op, t.baseDir, p)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fs.ErrPermission
+	}
+	if op == authz.Write {
+		l, err := t.h.foreignLock(context.Background(), t.baseDir, t.sub.UserID, p)
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			return fmt.Errorf("%s: %w", lockedMessage(l), fs.ErrPermission)
+		}
+	}
+	return nil
+}
+
+// sftpErr tags storage errors with the fs errors the protocol reports.
+func sftpErr(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrImmutable):
+		return fmt.Errorf("%w (%w)", err, fs.ErrPermission)
+	case errors.Is(err, storage.ErrExists):
+		return fmt.Errorf("%w (%w)", err, fs.ErrExist)
+	case errors.As(err, new(*storage.LimitError)), errors.Is(err, storage.ErrInvalidName):
+		return fmt.Errorf("%w (%w)", err, fs.ErrPermission)
+	}
+	return err
+}
+
+func sftpInfo(e storage.ManifestEntry) sftpd.FileInfo {
+	return sftpd.FileInfo{Name: e.Name, Size: e.Size, ModTime: time.Unix(e.ModTime, 0), Dir: e.Type == "dir"}
+}
+
+func (t *sftpTree) Stat(p string) (sftpd.FileInfo, error) {
+	if p = t.full(p); p == "." {
+		return sftpd.FileInfo{Name: ".", Dir: true}, nil
+	}
+	if err := t.check(authz.Read, p); err != nil {
+		return sftpd.FileInfo{}, err
+	}
+	e, err := storage.StatEntry(t.h.Cfg.MasterKey, t.baseDir, p)
+	if err != nil {
+		return sftpd.FileInfo{}, fs.ErrNotExist
+	}
+	return sftpInfo(*e), nil
+}
+
+func (t *sftpTree) ReadDir(p string) ([]sftpd.FileInfo, error) {
+	p = t.full(p)
+	if err := t.check(authz.Read, p); err != nil {
+		return nil, err
+	}
+	entries, err := storage.ListDir(t.h.Cfg.MasterKey, t.baseDir, p)
+	if err != nil {
+		return nil, fmt.Errorf("%v (%w)", err, fs.ErrNotExist)
+	}
+	entries, err = t.h.Auth.Authz.FilterReadable(context.Background(), t.sub, t.baseDir, p, entries)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]sftpd.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, sftpInfo(e))
+	}
+	return out, nil
+}
+
+func (t *sftpTree) Open(p string, offset int64) (io.ReadCloser, error) {
+	r, err := t.open(t.full(p), offset)
+	if err != nil {
+		return nil, err
+	}
+	r.done = func(n int64) { t.h.recordFor(t.sub.UserID, stats.Download, n) }
+	return r, nil
+}
+
+// open reads store path p without metering.
+func (t *sftpTree) open(p string, offset int64) (*sftpReader, error) {
+	if err := t.check(authz.Read, p); err != nil {
+		return nil, err
+	}
+	mkey := t.h.Cfg.MasterKey
+	blob, entry, err := storage.StatFile(mkey, t.baseDir, p)
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	if entry.Quarantine != nil {
+		return nil, fs.ErrPermission
+	}
+	if t.firstRead(p) {
+		t.h.trip(context.Background(), t.baseDir, p, t.sub.UserID, func() string {
+			return fmt.Sprintf("Read over %s by user %s, offset %d\nTime: %s\n", t.proto, t.sub.UserID, offset, time.Now().UTC().Format(time.RFC3339))
+		})
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		return nil, err
+	}
+	r := &sftpReader{f: f}
+	// client-encrypted blobs are served as stored
+	if entry.Encryption == storage.EncryptionClient {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		r.r = f
+		return r, nil
+	}
+	key, err := t.h.readKeyFor(mkey, entry)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("key unavailable: %w", err)
+	}
+	if offset > 0 && offset >= entry.Size {
+		r.r = strings.NewReader("")
+		return r, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		if offset == 0 {
+			pw.CloseWithError(storage.Decrypt(key, f, pw))
+		} else {
+			pw.CloseWithError(storage.DecryptRange(key, f, pw, offset, entry.Size-offset))
+		}
+	}()
+	r.r, r.pipe = pr, pr
+	return r, nil
+}
+
+// firstRead reports whether p is read for the first time this session.
+func (t *sftpTree) firstRead(p string) bool {
+	t.readMu.Lock()
+	defer t.readMu.Unlock()
+	if t.read[p] {
+		return false
+	}
+	if t.read == nil {
+		t.read = map[string]bool{}
+	}
+	t.read[p] = true
+	return true
+}
+
+// sftpReader reads a blob's plaintext and reports how much was read to done,
+// if set, on Close.
+type sftpReader struct {
+	r    io.Reader
+	f    *os.File
+	pipe *io.PipeReader
+	n    int64
+	done func(n int64)
+}
+
+func (r *sftpReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *sftpReader) Close() error {
+	if r.pipe != nil {
+		r.pipe.Close()
+	}
+	if r.done != nil {
+		r.done(r.n)
+	}
+	return r.f.Close()
+}
+
+func (t *sftpTree) Create(p string) (sftpd.Upload, error) {
+	p = t.full(p)
+	if err := t.check(authz.Write, p); err != nil {
+		return nil, err
+	}
+	mkey := t.h.Cfg.MasterKey
+	key, keyOwner, err := t.h.serverKey(mkey, t.baseDir, p, t.sub.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("key unavailable: %w", err)
+	}
+	run, err := t.h.Cfg.UploadFilters.Open(uploadfilter.Meta{Path: p, Size: -1, UserID: t.sub.UserID})
+	if err != nil {
+		return nil, fmt.Errorf("%w (%w)", err, fs.ErrPermission)
+	}
+	dst, err := storage.ResolveForCreateAs(mkey, t.baseDir, p, t.sub.UserID)
+	if err != nil {
+		return nil, sftpErr(err)
+	}
+	blob, err := storage.CreateBlob(dst)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	u := &sftpUpload{t: t, path: p, keyOwner: keyOwner, blob: blob, pw: pw, sums: storage.NewHashes(), done: make(chan error, 1)}
+	u.stored = &storage.CountReader{R: run.Wrap(pr)}
+	go func() {
+		err := storage.Encrypt(key, io.TeeReader(u.stored, u.sums), blob, 0)
+		if err == nil {
+			err = run.Verdict()
+		}
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u, nil
+}
+
+// sftpUpload encrypts an upload as it arrives and commits it on Close.
+type sftpUpload struct {
+	t        *sftpTree
+	path     string
+	keyOwner string
+	blob     *storage.BlobFile
+	pw       *io.PipeWriter
+	n        int64
+	stored   *storage.CountReader // what the upload filters passed on
+	sums     *storage.Hashes
+	done     chan error
+}
+
+func (u *sftpUpload) Write(b []byte) (int, error) {
+	n, err := u.pw.Write(b)
+	u.n += int64(n)
+	return n, err
+}
+
+func (u *sftpUpload) Close() error {
+	u.pw.Close()
+	if err := <-u.done; err != nil {
+		u.blob.Abort()
+		return err
+	}
+	info := storage.BlobInfo{KeyOwner: u.keyOwner, Size: u.stored.N}
+	info.MD5, info.SHA1 = u.sums.Sums()
+	if err := storage.CommitBlob(u.t.h.Cfg.MasterKey, u.t.baseDir, u.path, u.blob, info); err != nil {
+		return err
+	}
+	u.t.h.recordFor(u.t.sub.UserID, stats.Upload, u.n)
+	return nil
+}
+
+func (u *sftpUpload) Abort() {
+	u.pw.CloseWithError(errors.New("upload aborted"))
+	<-u.done
+	u.blob.Abort()
+}
+
+func (t *sftpTree) Mkdir(p string) error {
+	if _, err := t.Stat(p); err == nil {
+		return fs.ErrExist
+	}
+	if p = t.full(p); p == "." {
+		return fs.ErrExist
+	}
+	if err := t.check(authz.Write, p); err != nil {
+		return err
+	}
+	return sftpErr(storage.MakeDir(t.h.Cfg.MasterKey, t.baseDir, p, t.sub.UserID))
+}
+
+func (t *sftpTree) Remove(p string) error {
+	return t.remove(p, false)
+}
+
+func (t *sftpTree) Rmdir(p string) error {
+	return t.remove(p, true)
+}
+
+// remove deletes a file, or an empty directory with dir set, as rm and
+// rmdir would.
+func (t *sftpTree) remove(p string, dir bool) error {
+	fi, err := t.Stat(p)
+	if err != nil {
+		return err
+	}
+	if p == "." {
+		return fs.ErrPermission
+	}
+	p = t.full(p)
+	if err := t.check(authz.Write, p); err != nil {
+		return err
+	}
+	switch {
+	case fi.Dir != dir && dir:
+		return fmt.Errorf("%s is not a directory", p)
+	case fi.Dir != dir:
+		return fmt.Errorf("%s is a directory", p)
+	case dir:
+		entries, err := storage.ListDir(t.h.Cfg.MasterKey, t.baseDir, p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("%s is not empty", p)
+		}
+	}
+	return sftpErr(storage.Remove(t.h.Cfg.MasterKey, t.baseDir, p))
+}
+
+func (t *sftpTree) Rename(from, to string) error {
+	if from == "." || to == "." {
+		return fs.ErrPermission
+	}
+	from, to = t.full(from), t.full(to)
+	if err := t.check(authz.Write, from); err != nil {
+		return err
+	}
+	if err := t.check(authz.Write, to); err != nil {
+		return err
+	}
+	if err := t.h.filterRename(t.sub, t.baseDir, from, to); err != nil {
+		return fmt.Errorf("%w (%w)", err, fs.ErrPermission)
+	}
+	return sftpErr(storage.Rename(t.h.Cfg.MasterKey, t.baseDir, from, to))
+}
+
+func (t *sftpTree) Chtimes(p string, mtime time.Time) error {
+	// the root has no entry to carry a time
+	if p == "." {
+		return nil
+	}
+	p = t.full(p)
+	if err := t.check(authz.Write, p); err != nil {
+		return err
+	}
+	mod := mtime.Unix()
+	_, err := storage.PatchEntryMeta(t.h.Cfg.MasterKey, t.baseDir, p, storage.EntryPatch{ModTime: &mod})
+	return sftpErr(err)
+}
+
+// Hash answers from the sums recorded at upload, reading the file through
+// for those stored before sums were, or by other upload paths.
+func (t *sftpTree) Hash(p, algo string) (string, error) {
+	if algo != "md5" && algo != "sha1" {
+		return "", errors.New("unknown hash")
+	}
+	p = t.full(p)
+	if err := t.check(authz.Read, p); err != nil {
+		return "", err
+	}
+	_, entry, err := storage.StatFile(t.h.Cfg.MasterKey, t.baseDir, p)
+	if err != nil {
+		return "", fs.ErrNotExist
+	}
+	if entry.MD5 != "" {
+		if algo == "md5" {
+			return entry.MD5, nil
+		}
+		return entry.SHA1, nil
+	}
+	r, err := t.open(p, 0)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sums := storage.NewHashes()
+	if _, err := io.Copy(sums, r); err != nil {
+		return "", err
+	}
+	md5sum, sha1sum := sums.Sums()
+	if algo == "md5" {
+		return md5sum, nil
+	}
+	return sha1sum, nil
+}
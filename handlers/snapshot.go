@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// SnapshotHandler captures the directory at ?filepath (default the root).
+func (h *Handlers) SnapshotHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	requestedPath := context.Query("filepath")
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Write, baseDir, requestedPath) {
+		return
+	}
+	s, err := storage.CreateSnapshot(mkey, baseDir, requestedPath, context.GetString("userid"), context.Query("label"))
+	if err != nil {
+		context.String(http.StatusNotFound, "snapshot failed: %v", err)
+		return
+	}
+	context.JSON(http.StatusCreated, s)
+}
+
+func (h *Handlers) ListSnapshotsHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	requestedPath := context.Query("filepath")
+	baseDir, _ := h.baseDirFor(context)
+	if !h.allow(context, authz.Read, baseDir, requestedPath) {
+		return
+	}
+	snaps, err := storage.ListSnapshots(mkey, baseDir, requestedPath)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "list snapshots: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"path": requestedPath, "snapshots": snaps})
+}
+
+// findSnapshot resolves ?id, or ?filepath plus ?at (RFC 3339) to the newest
+// snapshot of that directory taken by then. It writes the error response.
+func (h *Handlers) findSnapshot(context *gin.Context, baseDir string) (storage.Snapshot, bool) {
+	mkey := h.Cfg.MasterKey
+	var s storage.Snapshot
+	var err error
+	if id := context.Query("id"); id != "" {
+		s, err = storage.GetSnapshot(mkey, baseDir, id)
+	} else if at := context.Query("at"); at != "" {
+		t, perr := time.Parse(time.RFC3339, at)
+		if perr != nil {
+			context.String(http.StatusBadRequest, "at must be RFC 3339: %v", perr)
+			return s, false
+		}
+		s, err = storage.SnapshotAt(mkey, baseDir, context.Query("filepath"), t)
+	} else {
+		context.String(http.StatusBadRequest, "Need id, or filepath and at")
+		return s, false
+	}
+	if errors.Is(err, storage.ErrNoSnapshot) {
+		context.String(http.StatusNotFound, "No such snapshot")
+		return s, false
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "snapshot: %v", err)
+		return s, false
+	}
+	return s, true
+}
+
+// RestoreSnapshotHandler rolls a directory back to a snapshot. The state it
+// replaces is kept as a new snapshot, returned as "undo".
+func (h *Handlers) RestoreSnapshotHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	s, ok := h.findSnapshot(context, baseDir)
+	if !ok {
+		return
+	}
+	if !h.allow(context, authz.Write, baseDir, s.Path) {
+		return
+	}
+	undo, err := storage.RestoreSnapshot(mkey, baseDir, s.ID, context.GetString("userid"))
+	if errors.Is(err, storage.ErrImmutable) {
+		context.String(http.StatusConflict, "restore failed: %v", err)
+		return
+	}
+	if err != nil {
+		context.String(http.StatusInternalServerError, "restore failed: %v", err)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"restored": s, "undo": undo})
+}
+
+func (h *Handlers) DeleteSnapshotHandler(context *gin.Context) {
+	mkey := h.Cfg.MasterKey
+	baseDir, _ := h.baseDirFor(context)
+	s, ok := h.findSnapshot(context, baseDir)
+	if !ok {
+		return
+	}
+	if !h.allow(context, authz.Write, baseDir, s.Path) {
+		return
+	}
+	if err := storage.DeleteSnapshot(mkey, baseDir, s.ID); err != nil {
+		context.String(http.StatusInternalServerError, "delete snapshot: %v", err)
+		return
+	}
+	context.String(http.StatusOK, "Snapshot deleted")
+}
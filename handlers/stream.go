@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"SCloud/transcode"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+// queueTranscode has the kind rendition made of the file at logicalPath, as
+// long as it still has the MD5 md5sum when its turn comes.
+func (h *Handlers) queueTranscode(baseDir, logicalPath, kind, md5sum string) {
+	mkey := h.Cfg.MasterKey
+	var entry *storage.ManifestEntry
+	h.Transcode.Add(transcode.Task{
+		Key:  baseDir + "\x00" + logicalPath + "\x00" + md5sum,
+		Path: logicalPath,
+		Kind: kind,
+		Open: func() (io.ReadCloser, error) {
+			r, e, err := h.openUpload(baseDir, logicalPath, md5sum)
+			if errors.Is(err, storage.ErrChanged) {
+				return nil, transcode.ErrGone
+			}
+			entry = e
+			return r, err
+		},
+		Store: func(r io.Reader) error {
+			key, err := h.readKeyFor(mkey, entry)
+			if err != nil {
+				return err
+			}
+			return storage.WriteRendition(key, baseDir, entry, kind, r)
+		},
+	})
+}
+
+// StreamHandler serves the streaming rendition of a video or audio file.
+// Players fetch it in ranges; each range decrypts only the chunks it
+// covers.
+func (h *Handlers) StreamHandler(context *gin.Context) {
+	if h.Transcode == nil {
+		context.String(http.StatusNotFound, "transcoding is not enabled")
+		return
+	}
+	h.serveRendition(context, transcode.Kind, transcode.ContentType, h.queueTranscode)
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"SCloud/storage"
+	"SCloud/thumbnail"
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// thumbSlots bounds the thumbnails decoded at once; each holds a whole
+// image in memory.
+var thumbSlots = make(chan struct{}, 2)
+
+// ThumbnailHandler serves a JPEG thumbnail of an image, ?size= one of
+// thumbnail.Sizes (256 by default). Thumbnails are quick to make, so a
+// missing one is made while the request waits.
+func (h *Handlers) ThumbnailHandler(context *gin.Context) {
+	size, err := strconv.Atoi(context.DefaultQuery("size", "256"))
+	if err != nil || thumbnail.Kind(size) == "" {
+		context.String(http.StatusBadRequest, "size must be one of %v", thumbnail.Sizes)
+		return
+	}
+	h.serveThumbnail(context, size)
+}
+
+func (h *Handlers) serveThumbnail(context *gin.Context, size int) {
+	kind := func(p string) string {
+		if !thumbnail.Wanted(p) {
+			return ""
+		}
+		return thumbnail.Kind(size)
+	}
+	h.serveRendition(context, kind, func(string) string { return thumbnail.ContentType },
+		func(baseDir, p, k, md5sum string) { h.makeThumbnail(baseDir, p, k, size, md5sum) })
+}
+
+// makeThumbnail renders and stores the size thumbnail of the file at
+// logicalPath, as long as it still has the MD5 md5sum. Failures are only
+// logged: the request that wanted it answers 202 and the next one retries.
+func (h *Handlers) makeThumbnail(baseDir, logicalPath, kind string, size int, md5sum string) {
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+	r, entry, err := h.openUpload(baseDir, logicalPath, md5sum)
+	if err != nil {
+		h.Log.Printf("thumbnail %s: %v", logicalPath, err)
+		return
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if err := thumbnail.Make(r.(io.ReadSeeker), size, &buf); err != nil {
+		h.Log.Printf("thumbnail %s: %v", logicalPath, err)
+		return
+	}
+	key, err := h.readKeyFor(h.Cfg.MasterKey, entry)
+	if err == nil {
+		err = storage.WriteRendition(key, baseDir, entry, kind, &buf)
+	}
+	if err != nil {
+		h.Log.Printf("thumbnail %s: %v", logicalPath, err)
+	}
+}
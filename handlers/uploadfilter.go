@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"SCloud/authz"
+	"SCloud/storage"
+	"SCloud/uploadfilter"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// filterUpload puts an upload to logicalPath before the UPLOAD_FILTERS; a
+// refusal is answered here. The run returned wraps the content of a
+// single-request upload.
+func (h *Handlers) filterUpload(context *gin.Context, logicalPath string, size int64, contentType, encryption string, staged bool) (*uploadfilter.Run, bool) {
+	run, err := h.Cfg.UploadFilters.Open(uploadfilter.Meta{
+		Path:            logicalPath,
+		Size:            size,
+		UserID:          context.GetString("userid"),
+		Org:             context.GetString("org"),
+		ContentType:     contentType,
+		ClientEncrypted: encryption == storage.EncryptionClient,
+		Staged:          staged,
+	})
+	if err != nil {
+		if !uploadDenied(context, err) {
+			context.String(http.StatusInternalServerError, "upload filter: %v", err)
+		}
+		return nil, false
+	}
+	return run, true
+}
+
+// filterRename puts a file moved to a new name before the UPLOAD_FILTERS,
+// by name and size as for a staged upload. Directories pass.
+func (h *Handlers) filterRename(sub authz.Subject, baseDir, from, to string) error {
+	_, entry, err := storage.StatFile(h.Cfg.MasterKey, baseDir, from)
+	if err != nil {
+		return nil
+	}
+	_, err = h.Cfg.UploadFilters.Open(uploadfilter.Meta{
+		Path:            to,
+		Size:            entry.Size,
+		UserID:          sub.UserID,
+		Org:             sub.Org,
+		ClientEncrypted: entry.Encryption == storage.EncryptionClient,
+		Staged:          true,
+	})
+	return err
+}
+
+// uploadDenied answers err if it is a filter refusing the upload, and
+// reports whether it was.
+func uploadDenied(context *gin.Context, err error) bool {
+	var d *uploadfilter.Denied
+	if !errors.As(err, &d) {
+		return false
+	}
+	context.String(d.Status, "Upload refused by %s: %s", d.Filter, d.Reason)
+	return true
+}
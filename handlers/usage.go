@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"SCloud/jobs"
+	"SCloud/metering"
+	"SCloud/stats"
+	"SCloud/storage"
+	"SCloud/store"
+	"context"
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record counts a finished transfer in the server-wide stats and against the
+// user who made it.
+func (h *Handlers) record(context *gin.Context, k stats.Kind, n int64) {
+	h.recordFor(context.GetString("userid"), k, n)
+	if k == stats.Download {
+		h.Auth.Downloaded(context, n)
+	} else {
+		h.alertQuota(context)
+	}
+}
+
+func (h *Handlers) recordFor(userID string, k stats.Kind, n int64) {
+	stats.Record(k, n)
+	stats.RecordUser(userID, k, n)
+	if h.Meter == nil {
+		return
+	}
+	if k == stats.Upload {
+		h.Meter.Transfer(userID, n, 0)
+	} else {
+		h.Meter.Transfer(userID, 0, n)
+	}
+}
+
+// CountFailures counts the transfer requests a route fails (4xx and 5xx)
+// against the caller; finished ones are counted by record.
+func CountFailures(k stats.Kind) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		context.Next()
+		if context.Writer.Status() >= http.StatusBadRequest {
+			stats.RecordUserFailure(context.GetString("userid"), k)
+		}
+	}
+}
+
+// AccountUsageHandler reports the caller's transfers since the server
+// started and their metered use per day over ?period= (as for the admin
+// usage report). Admins may ask about another user with ?user=.
+func (h *Handlers) AccountUsageHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	uid := context.GetString("userid")
+	if u := context.Query("user"); u != "" && u != uid {
+		if !context.GetBool("admin") {
+			context.String(http.StatusForbidden, "only admins may see other users' usage")
+			return
+		}
+		uid = u
+	}
+	from, to, ok := usagePeriod(context.Query("period"))
+	if !ok {
+		context.String(http.StatusBadRequest, "bad period: want 2006-01, 2006-01-02 or 2006-01-02..2006-01-31")
+		return
+	}
+	days := []store.Usage{}
+	if h.Meter != nil {
+		if err := h.Meter.Flush(ctx); err != nil {
+			h.Log.Printf("usage flush: %v", err)
+		}
+		rows, err := h.Stores.Usage.List(ctx, from, to)
+		if err != nil {
+			context.String(http.StatusInternalServerError, "usage: %v", err)
+			return
+		}
+		for _, r := range rows {
+			if r.UserID == uid {
+				days = append(days, r)
+			}
+		}
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"user_id": uid,
+		"since":   stats.Started.Unix(),
+		"live":    stats.User(uid),
+		"from":    from,
+		"to":      to,
+		"days":    days,
+	})
+}
+
+// SampleUsageJob records how many bytes each user stores today, across
+// every storage root.
+func (h *Handlers) SampleUsageJob(p jobs.Progress) (any, error) {
+	dirs, err := h.allBaseDirs()
+	if err != nil {
+		return nil, err
+	}
+	byUser := map[string]int64{}
+	p.SetTotal(int64(len(dirs)))
+	for _, d := range dirs {
+		if err := storage.UsageByOwner(h.Cfg.MasterKey, d, byUser); err != nil {
+			return nil, err
+		}
+		p.Add(1)
+	}
+	if err := h.Meter.SetStored(context.Background(), byUser); err != nil {
+		return nil, err
+	}
+	return gin.H{"users": len(byUser)}, nil
+}
+
+// usagePeriod turns ?period= into an inclusive day range: "2006-01" for a
+// month, "2006-01-02" for a day, "2006-01-02..2006-01-31" for a range.
+// The default is the current month.
+func usagePeriod(period string) (from, to string, ok bool) {
+	if period == "" {
+		period = time.Now().UTC().Format("2006-01")
+	}
+	if a, b, found := strings.Cut(period, ".."); found {
+		f, err1 := time.Parse("2006-01-02", a)
+		t, err2 := time.Parse("2006-01-02", b)
+		return metering.Day(f), metering.Day(t), err1 == nil && err2 == nil && !t.Before(f)
+	}
+	if d, err := time.Parse("2006-01-02", period); err == nil {
+		return metering.Day(d), metering.Day(d), true
+	}
+	if m, err := time.Parse("2006-01", period); err == nil {
+		return metering.Day(m), metering.Day(m.AddDate(0, 1, -1)), true
+	}
+	return "", "", false
+}
+
+type userUsage struct {
+	UserID        string  `json:"user_id"`
+	Email         string  `json:"email,omitempty"`
+	UploadBytes   int64   `json:"upload_bytes"`
+	DownloadBytes int64   `json:"download_bytes"`
+	ByteDays      int64   `json:"storage_byte_days"` // sum of the daily stored-bytes samples
+	GBDays        float64 `json:"storage_gb_days"`
+}
+
+// UsageHandler reports metered use per user over ?period=, as JSON or, with
+// ?format=csv, as a CSV download. ?daily=true lists the raw daily rows.
+func (h *Handlers) UsageHandler(context *gin.Context) {
+	ctx := context.Request.Context()
+	from, to, ok := usagePeriod(context.Query("period"))
+	if !ok {
+		context.String(http.StatusBadRequest, "bad period: want 2006-01, 2006-01-02 or 2006-01-02..2006-01-31")
+		return
+	}
+	// counters still in memory belong in the report
+	if err := h.Meter.Flush(ctx); err != nil {
+		h.Log.Printf("usage flush: %v", err)
+	}
+	rows, err := h.Stores.Usage.List(ctx, from, to)
+	if err != nil {
+		context.String(http.StatusInternalServerError, "usage: %v", err)
+		return
+	}
+	csvOut := context.Query("format") == "csv"
+
+	if context.Query("daily") == "true" {
+		if !csvOut {
+			context.JSON(http.StatusOK, gin.H{"from": from, "to": to, "days": rows})
+			return
+		}
+		records := [][]string{{"day", "user_id", "upload_bytes", "download_bytes", "stored_bytes"}}
+		for _, u := range rows {
+			records = append(records, []string{u.Day, u.UserID, itoa(u.UploadBytes), itoa(u.DownloadBytes), itoa(u.StoredBytes)})
+		}
+		writeCSV(context, "usage-daily-"+from+"-"+to+".csv", records)
+		return
+	}
+
+	byUser := map[string]*userUsage{}
+	var total userUsage
+	for _, r := range rows {
+		u, ok := byUser[r.UserID]
+		if !ok {
+			u = &userUsage{UserID: r.UserID}
+			if user, err := h.Stores.Users.ByID(ctx, r.UserID); err == nil {
+				u.Email = user.Email
+			}
+			byUser[r.UserID] = u
+		}
+		for _, t := range []*userUsage{u, &total} {
+			t.UploadBytes += r.UploadBytes
+			t.DownloadBytes += r.DownloadBytes
+			t.ByteDays += r.StoredBytes
+		}
+	}
+	users := make([]userUsage, 0, len(byUser))
+	for _, u := range byUser {
+		u.GBDays = float64(u.ByteDays) / 1e9
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(a, b int) bool { return users[a].UserID < users[b].UserID })
+	total.GBDays = float64(total.ByteDays) / 1e9
+
+	if !csvOut {
+		context.JSON(http.StatusOK, gin.H{"from": from, "to": to, "users": users, "total": total})
+		return
+	}
+	records := [][]string{{"user_id", "email", "upload_bytes", "download_bytes", "storage_byte_days", "storage_gb_days"}}
+	for _, u := range append(users, userUsage{UserID: "total", UploadBytes: total.UploadBytes, DownloadBytes: total.DownloadBytes, ByteDays: total.ByteDays, GBDays: total.GBDays}) {
+		records = append(records, []string{u.UserID, u.Email, itoa(u.UploadBytes), itoa(u.DownloadBytes), itoa(u.ByteDays), strconv.FormatFloat(u.GBDays, 'f', 6, 64)})
+	}
+	writeCSV(context, "usage-"+from+"-"+to+".csv", records)
+}
+
+func itoa(n int64) string { return strconv.FormatInt(n, 10) }
+
+func writeCSV(context *gin.Context, name string, records [][]string) {
+	context.Header("Content-Type", "text/csv; charset=utf-8")
+	context.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	context.Status(http.StatusOK)
+	w := csv.NewWriter(context.Writer)
+	if err := w.WriteAll(records); err != nil {
+		context.Error(err)
+	}
+}
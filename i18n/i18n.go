@@ -0,0 +1,184 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/language"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed locales/*.json
+var builtin embed.FS
+
+// A catalog file maps the server's English messages, written as the format
+// strings the handlers use ("File is quarantined: %s"), to their
+// translation. A translation takes the arguments in the same order, or
+// picks them with %[n]s.
+type catalog map[string]string
+
+// Catalogs translate the messages error responses carry.
+type Catalogs struct {
+	langs   []language.Tag // English first
+	matcher language.Matcher
+	byLang  map[string]catalog
+
+	exact    map[string]string // key -> key, for messages without arguments
+	patterns []pattern
+}
+
+type pattern struct {
+	re  *regexp.Regexp
+	key string
+}
+
+var (
+	verb = regexp.MustCompile(`%(\[\d+\])?[vdsqU]`)
+	// verb, once the key is quoted for a regexp
+	quotedVerb = regexp.MustCompile(`%(\\\[\d+\\\])?[vdsqU]`)
+)
+
+// Load reads the built-in catalogs and then those in dir, if set, one
+// <language tag>.json each; a file in dir adds to or overrides the
+// built-in catalog of its language.
+func Load(dir string) (*Catalogs, error) {
+	c := &Catalogs{byLang: map[string]catalog{}, exact: map[string]string{}}
+	entries, _ := builtin.ReadDir("locales")
+	for _, e := range entries {
+		b, err := builtin.ReadFile("locales/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		if err := c.add(e.Name(), b); err != nil {
+			return nil, err
+		}
+	}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.add(filepath.Base(f), b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.index()
+	return c, nil
+}
+
+func (c *Catalogs) add(name string, b []byte) error {
+	tag, err := language.Parse(strings.TrimSuffix(name, ".json"))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	var m catalog
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	lang := tag.String()
+	if c.byLang[lang] == nil {
+		c.byLang[lang] = catalog{}
+	}
+	for key, text := range m {
+		// arguments are passed as the strings they were rendered to
+		c.byLang[lang][key] = verb.ReplaceAllString(text, "%${1}s")
+	}
+	return nil
+}
+
+// index builds the matcher over the languages and the patterns over every
+// key any catalog has.
+func (c *Catalogs) index() {
+	c.langs = []language.Tag{language.English}
+	keys := map[string]bool{}
+	for lang, m := range c.byLang {
+		if lang != "en" {
+			c.langs = append(c.langs, language.MustParse(lang))
+		}
+		for key := range m {
+			keys[key] = true
+		}
+	}
+	sort.Slice(c.langs[1:], func(i, j int) bool { return c.langs[i+1].String() < c.langs[j+1].String() })
+	c.matcher = language.NewMatcher(c.langs)
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	// the longest key first, so "resolve: %v" is not taken for "%v: %v"
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, key := range sorted {
+		if !verb.MatchString(key) {
+			c.exact[key] = key
+			continue
+		}
+		expr := "(?s)^" + quotedVerb.ReplaceAllString(regexp.QuoteMeta(key), "(.*?)") + "$"
+		c.patterns = append(c.patterns, pattern{regexp.MustCompile(expr), key})
+	}
+}
+
+// Languages lists the languages there are catalogs for, English first.
+func (c *Catalogs) Languages() []string {
+	out := make([]string, len(c.langs))
+	for i, t := range c.langs {
+		out[i] = t.String()
+	}
+	return out
+}
+
+// Negotiate picks the language to answer an Accept-Language header in:
+// the best match among Languages, English when nothing matches.
+func (c *Catalogs) Negotiate(acceptLanguage string) string {
+	prefs, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(prefs) == 0 {
+		return "en"
+	}
+	_, i, conf := c.matcher.Match(prefs...)
+	if conf == language.No {
+		return "en"
+	}
+	return c.langs[i].String()
+}
+
+// Translate renders msg in lang. key is the catalog key msg was rendered
+// from, "" for a message no catalog knows; a message without a
+// translation into lang comes back as it is.
+func (c *Catalogs) Translate(lang, msg string) (text, key string) {
+	var args []any
+	if k, ok := c.exact[msg]; ok {
+		key = k
+	} else {
+		for _, p := range c.patterns {
+			if m := p.re.FindStringSubmatch(msg); m != nil {
+				key = p.key
+				for _, a := range m[1:] {
+					args = append(args, a)
+				}
+				break
+			}
+		}
+	}
+	if key == "" {
+		return msg, ""
+	}
+	t, ok := c.byLang[lang][key]
+	if !ok {
+		return msg, key
+	}
+	if args == nil {
+		return t, key
+	}
+	return fmt.Sprintf(t, args...), key
+}
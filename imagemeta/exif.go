@@ -0,0 +1,249 @@
+package imagemeta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exif is what an image's EXIF block says about where, when and with what
+// it was taken. Empty fields were not present.
+type Exif struct {
+	Make, Model, Software string
+	Artist, Copyright     string
+	LensModel, Serial     string
+	// as written: "2006:01:02 15:04:05", in the camera's local time;
+	// Offset ("+02:00") places it when the camera recorded one
+	DateTimeOriginal string
+	Offset           string
+	Orientation      int // 1-8; 0 = not given
+	Width, Height    int
+	GPS              *GPS
+}
+
+type GPS struct {
+	Latitude, Longitude float64
+	Altitude            *float64
+}
+
+// Time returns when the image was taken. Without an offset the time is
+// taken as UTC.
+func (e *Exif) Time() (time.Time, bool) {
+	if e.DateTimeOriginal == "" {
+		return time.Time{}, false
+	}
+	if e.Offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", e.DateTimeOriginal+e.Offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", e.DateTimeOriginal)
+	return t, err == nil
+}
+
+// Fields lists what e says as manifest meta under "exif." keys.
+func (e *Exif) Fields() map[string]string {
+	f := map[string]string{}
+	set := func(k, v string) {
+		if v = strings.TrimSpace(v); v != "" {
+			f["exif."+k] = v[:min(len(v), 256)]
+		}
+	}
+	set("make", e.Make)
+	set("model", e.Model)
+	set("software", e.Software)
+	set("artist", e.Artist)
+	set("copyright", e.Copyright)
+	set("lens", e.LensModel)
+	set("serial", e.Serial)
+	set("datetime", e.DateTimeOriginal+e.Offset)
+	if e.GPS != nil {
+		set("gps", strconv.FormatFloat(e.GPS.Latitude, 'f', 6, 64)+","+strconv.FormatFloat(e.GPS.Longitude, 'f', 6, 64))
+		if e.GPS.Altitude != nil {
+			set("altitude", strconv.FormatFloat(*e.GPS.Altitude, 'f', 1, 64))
+		}
+	}
+	return f
+}
+
+// TIFF tags read from IFD0, the Exif IFD and the GPS IFD.
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagSoftware    = 0x0131
+	tagArtist      = 0x013B
+	tagCopyright   = 0x8298
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagPixelX           = 0xA002
+	tagPixelY           = 0xA003
+	tagSerial           = 0xA431
+	tagLensModel        = 0xA434
+
+	tagLatRef = 1
+	tagLat    = 2
+	tagLonRef = 3
+	tagLon    = 4
+	tagAltRef = 5
+	tagAlt    = 6
+)
+
+type tiffValue struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+var typeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// ParseExif reads an EXIF block: a TIFF structure, as found after the
+// "Exif\0\0" of a JPEG APP1 segment or in a PNG eXIf chunk.
+func ParseExif(b []byte) (*Exif, error) {
+	if len(b) < 8 {
+		return nil, errors.New("exif: too short")
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: bad byte order")
+	}
+	ifd0, err := t.ifd(t.order.Uint32(b[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	e := &Exif{
+		Make:        t.str(ifd0[tagMake]),
+		Model:       t.str(ifd0[tagModel]),
+		Software:    t.str(ifd0[tagSoftware]),
+		Artist:      t.str(ifd0[tagArtist]),
+		Copyright:   t.str(ifd0[tagCopyright]),
+		Orientation: t.int(ifd0[tagOrientation]),
+	}
+	if off := t.int(ifd0[tagExifIFD]); off > 0 {
+		if sub, err := t.ifd(uint32(off)); err == nil {
+			e.DateTimeOriginal = t.str(sub[tagDateTimeOriginal])
+			e.Offset = t.str(sub[tagOffsetOriginal])
+			e.Width, e.Height = t.int(sub[tagPixelX]), t.int(sub[tagPixelY])
+			e.Serial = t.str(sub[tagSerial])
+			e.LensModel = t.str(sub[tagLensModel])
+		}
+	}
+	if off := t.int(ifd0[tagGPSIFD]); off > 0 {
+		if g, err := t.ifd(uint32(off)); err == nil {
+			e.GPS = t.gps(g)
+		}
+	}
+	return e, nil
+}
+
+func (t tiff) ifd(off uint32) (map[uint16]tiffValue, error) {
+	if uint64(off)+2 > uint64(len(t.b)) {
+		return nil, fmt.Errorf("exif: IFD at %d out of range", off)
+	}
+	n := uint32(t.order.Uint16(t.b[off:]))
+	if uint64(off)+2+uint64(n)*12 > uint64(len(t.b)) {
+		return nil, errors.New("exif: IFD truncated")
+	}
+	out := map[uint16]tiffValue{}
+	for i := uint32(0); i < n; i++ {
+		ent := t.b[off+2+i*12:]
+		v := tiffValue{typ: t.order.Uint16(ent[2:]), count: t.order.Uint32(ent[4:])}
+		size := uint64(typeSize[v.typ]) * uint64(v.count)
+		if size == 0 {
+			continue
+		}
+		if size <= 4 {
+			v.data = ent[8 : 8+size]
+		} else {
+			at := uint64(t.order.Uint32(ent[8:]))
+			if at+size > uint64(len(t.b)) {
+				continue
+			}
+			v.data = t.b[at : at+size]
+		}
+		out[t.order.Uint16(ent)] = v
+	}
+	return out, nil
+}
+
+func (t tiff) str(v tiffValue) string {
+	if v.typ != 2 {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(v.data), "\x00")
+	return strings.ToValidUTF8(strings.TrimSpace(s), "")
+}
+
+func (t tiff) int(v tiffValue) int {
+	switch {
+	case v.typ == 3 && len(v.data) >= 2:
+		return int(t.order.Uint16(v.data))
+	case (v.typ == 4 || v.typ == 9) && len(v.data) >= 4:
+		return int(t.order.Uint32(v.data))
+	}
+	return 0
+}
+
+func (t tiff) rationals(v tiffValue) []float64 {
+	if v.typ != 5 && v.typ != 10 {
+		return nil
+	}
+	var out []float64
+	for i := 0; i+8 <= len(v.data); i += 8 {
+		num, den := t.order.Uint32(v.data[i:]), t.order.Uint32(v.data[i+4:])
+		if den == 0 {
+			return nil
+		}
+		if v.typ == 10 {
+			out = append(out, float64(int32(num))/float64(int32(den)))
+		} else {
+			out = append(out, float64(num)/float64(den))
+		}
+	}
+	return out
+}
+
+func (t tiff) gps(g map[uint16]tiffValue) *GPS {
+	deg := func(v tiffValue, ref string, neg string) (float64, bool) {
+		r := t.rationals(v)
+		if len(r) != 3 {
+			return 0, false
+		}
+		d := r[0] + r[1]/60 + r[2]/3600
+		if ref == neg {
+			d = -d
+		}
+		return d, !math.IsNaN(d) && !math.IsInf(d, 0)
+	}
+	lat, ok1 := deg(g[tagLat], t.str(g[tagLatRef]), "S")
+	lon, ok2 := deg(g[tagLon], t.str(g[tagLonRef]), "W")
+	if !ok1 || !ok2 {
+		return nil
+	}
+	out := &GPS{Latitude: lat, Longitude: lon}
+	if r := t.rationals(g[tagAlt]); len(r) == 1 {
+		alt := r[0]
+		if v := g[tagAltRef]; len(v.data) == 1 && v.data[0] == 1 {
+			alt = -alt
+		}
+		out.Altitude = &alt
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ProbeSize is how much of the start of a file Probe looks at; cameras put
+// EXIF and the frame header well within it.
+const ProbeSize = 256 << 10
+
+// Info is what a photo timeline needs to know about an image.
+type Info struct {
+	Taken         time.Time // zero when the image does not say
+	Width, Height int       // as displayed, i.e. after the EXIF orientation
+}
+
+// Manifest meta keys Info.Fields uses.
+const (
+	FieldTaken  = "photo.taken"
+	FieldWidth  = "photo.width"
+	FieldHeight = "photo.height"
+)
+
+// Fields lists i as manifest meta.
+func (i *Info) Fields() map[string]string {
+	f := map[string]string{
+		FieldWidth:  strconv.Itoa(i.Width),
+		FieldHeight: strconv.Itoa(i.Height),
+	}
+	if !i.Taken.IsZero() {
+		f[FieldTaken] = i.Taken.Format(time.RFC3339)
+	}
+	return f
+}
+
+// ParseFields reads back what Fields wrote; ok is false for meta without a
+// photo's dimensions.
+func ParseFields(meta map[string]string) (i Info, ok bool) {
+	w, err1 := strconv.Atoi(meta[FieldWidth])
+	h, err2 := strconv.Atoi(meta[FieldHeight])
+	if err1 != nil || err2 != nil {
+		return Info{}, false
+	}
+	i.Width, i.Height = w, h
+	if t, err := time.Parse(time.RFC3339, meta[FieldTaken]); err == nil {
+		i.Taken = t
+	}
+	return i, true
+}
+
+var errNotImage = errors.New("not a JPEG or PNG image")
+
+// Probe reads the dimensions and capture time of the JPEG or PNG whose
+// first bytes are head.
+func Probe(head []byte) (*Info, error) {
+	var (
+		exif *Exif
+		w, h int
+	)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		exif, w, h = probeJPEG(head)
+	case bytes.HasPrefix(head, pngSig):
+		exif, w, h = probePNG(head)
+	default:
+		return nil, errNotImage
+	}
+	if w <= 0 || h <= 0 {
+		return nil, errors.New("image dimensions not found")
+	}
+	i := &Info{Width: w, Height: h}
+	if exif != nil {
+		if exif.Orientation >= 5 && exif.Orientation <= 8 {
+			i.Width, i.Height = h, w
+		}
+		i.Taken, _ = exif.Time()
+	}
+	return i, nil
+}
+
+// probeJPEG walks the header segments up to the first scan.
+func probeJPEG(b []byte) (exif *Exif, w, h int) {
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return
+		}
+		m := b[i+1]
+		if m == 0xFF {
+			i++
+			continue
+		}
+		if standalone(m) {
+			i += 2
+			continue
+		}
+		if m == 0xDA || m == 0xD9 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return
+		}
+		seg := b[i+4 : i+2+n]
+		switch {
+		case m == 0xE1 && exif == nil && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			exif, _ = ParseExif(seg[6:])
+		case m >= 0xC0 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC && len(seg) >= 5:
+			h, w = int(binary.BigEndian.Uint16(seg[1:])), int(binary.BigEndian.Uint16(seg[3:]))
+		}
+		i += 2 + n
+	}
+	return
+}
+
+// probePNG reads IHDR and any eXIf chunk.
+func probePNG(b []byte) (exif *Exif, w, h int) {
+	for i := len(pngSig); i+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		if n < 0 || i+8+n > len(b) {
+			return
+		}
+		body := b[i+8 : i+8+n]
+		switch typ {
+		case "IHDR":
+			if n >= 8 {
+				w, h = int(binary.BigEndian.Uint32(body)), int(binary.BigEndian.Uint32(body[4:]))
+			}
+		case "eXIf":
+			exif, _ = ParseExif(body)
+		case "IDAT", "IEND":
+			return
+		}
+		i += 12 + n
+	}
+	return
+}
@@ -0,0 +1,299 @@
+// Package imagemeta reads and removes the metadata cameras and phones write
+// into images: EXIF (GPS position, camera, serial numbers, times), XMP,
+// IPTC and comments.
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Result describes what Strip removed. It is complete once the stream Strip
+// returned has been read to the end.
+type Result struct {
+	Format  string // "jpeg" or "png"; "" for anything else, passed through as is
+	Removed int64  // bytes dropped
+	Exif    *Exif  // what the EXIF said, if there was one
+}
+
+// What uploads do with image metadata.
+const (
+	PolicyKeep   = ""
+	PolicyStrip  = "strip"  // remove it
+	PolicyRecord = "record" // remove it from the file, keep its Exif.Fields in the manifest
+)
+
+// ParsePolicy checks a policy as a client names it, "keep" for PolicyKeep.
+func ParsePolicy(s string) (string, error) {
+	switch s {
+	case "keep", PolicyKeep:
+		return PolicyKeep, nil
+	case PolicyStrip, PolicyRecord:
+		return s, nil
+	}
+	return "", fmt.Errorf("image metadata policy must be keep, strip or record, not %q", s)
+}
+
+var pngSig = []byte("\x89PNG\r\n\x1a\n")
+
+// Strip returns r's content with metadata removed as it streams through;
+// only the JPEG header is held in memory. What an image needs to be shown
+// the same stays: JFIF and Adobe segments, the ICC colour profile, and in
+// a JPEG the EXIF orientation, rewritten as a minimal EXIF block. Data
+// after the end of the image (trailers, embedded second images) is
+// dropped. Files that are not JPEG or PNG pass unchanged; malformed ones
+// fail the read. Close the stream if it is not read to the end.
+func Strip(r io.Reader) (io.ReadCloser, *Result) {
+	res := &Result{}
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, _ := br.Peek(len(pngSig))
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		res.Format = "jpeg"
+	case bytes.Equal(head, pngSig):
+		res.Format = "png"
+	default:
+		return io.NopCloser(br), res
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriterSize(pw, 64<<10)
+		var err error
+		if res.Format == "jpeg" {
+			err = stripJPEG(br, w, res)
+		} else {
+			err = stripPNG(br, w, res)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, res
+}
+
+// dropJPEG reports whether the marker m segment with body goes.
+func dropJPEG(m byte, body []byte) bool {
+	switch {
+	case m == 0xE0, m == 0xEE: // JFIF, Adobe: needed to decode right
+		return false
+	case m == 0xE2:
+		return !bytes.HasPrefix(body, []byte("ICC_PROFILE\x00"))
+	case m >= 0xE1 && m <= 0xEF, m == 0xFE: // APPn, COM
+		return true
+	}
+	return false
+}
+
+// readSegment reads the length and body following marker m.
+func readSegment(r *bufio.Reader, m byte) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(l[:]))
+	if n < 2 {
+		return nil, fmt.Errorf("jpeg: bad segment length %d", n)
+	}
+	seg := make([]byte, 2+n)
+	seg[0], seg[1], seg[2], seg[3] = 0xFF, m, l[0], l[1]
+	_, err := io.ReadFull(r, seg[4:])
+	return seg, err
+}
+
+// nextMarker reads the marker at r, skipping fill bytes.
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("jpeg: expected a marker, got %#x", b)
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func standalone(m byte) bool { return m == 0x01 || m >= 0xD0 && m <= 0xD7 }
+
+func stripJPEG(r *bufio.Reader, w io.Writer, res *Result) error {
+	if _, err := r.Discard(2); err != nil {
+		return err
+	}
+	// the header, up to the first scan, is held to place the orientation
+	var head [][]byte
+	for {
+		m, err := nextMarker(r)
+		if err != nil {
+			return err
+		}
+		if standalone(m) || m == 0xD9 {
+			head = append(head, []byte{0xFF, m})
+			if m == 0xD9 {
+				return writeHead(w, head, res)
+			}
+			continue
+		}
+		seg, err := readSegment(r, m)
+		if err != nil {
+			return err
+		}
+		if dropJPEG(m, seg[4:]) {
+			res.Removed += int64(len(seg))
+			if m == 0xE1 && res.Exif == nil && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+				res.Exif, _ = ParseExif(seg[10:])
+			}
+			continue
+		}
+		head = append(head, seg)
+		if m == 0xDA {
+			break
+		}
+	}
+	if err := writeHead(w, head, res); err != nil {
+		return err
+	}
+
+	// scans: entropy-coded data, with markers between them in progressive files
+	for {
+		chunk, err := r.ReadSlice(0xFF)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == io.EOF {
+			// truncated before EOI; keep what there is
+			_, err = w.Write(chunk)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk[:len(chunk)-1]); err != nil {
+			return err
+		}
+		m, err := r.ReadByte()
+		for err == nil && m == 0xFF {
+			m, err = r.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case m == 0x00 || standalone(m):
+			_, err = w.Write([]byte{0xFF, m})
+		case m == 0xD9:
+			if _, err := w.Write([]byte{0xFF, 0xD9}); err != nil {
+				return err
+			}
+			n, err := io.Copy(io.Discard, r)
+			res.Removed += n
+			return err
+		default:
+			var seg []byte
+			if seg, err = readSegment(r, m); err != nil {
+				return err
+			}
+			if dropJPEG(m, seg[4:]) {
+				res.Removed += int64(len(seg))
+				continue
+			}
+			_, err = w.Write(seg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeHead writes SOI and the kept header segments, with the orientation
+// after the JFIF segments that must come first.
+func writeHead(w io.Writer, head [][]byte, res *Result) error {
+	out := [][]byte{{0xFF, 0xD8}}
+	i := 0
+	for i < len(head) && head[i][1] == 0xE0 {
+		i++
+	}
+	out = append(out, head[:i]...)
+	if res.Exif != nil && res.Exif.Orientation > 1 && res.Exif.Orientation <= 8 {
+		out = append(out, orientationSegment(res.Exif.Orientation))
+	}
+	out = append(out, head[i:]...)
+	for _, seg := range out {
+		if _, err := w.Write(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orientationSegment is an APP1 EXIF block holding only the orientation.
+func orientationSegment(o int) []byte {
+	body := append([]byte("Exif\x00\x00"),
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, IFD0 at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // Orientation SHORT
+		0, 0, 0, 0) // no next IFD
+	n := len(body) + 2
+	return append([]byte{0xFF, 0xE1, byte(n >> 8), byte(n)}, body...)
+}
+
+// dropPNG lists the PNG chunks that carry metadata.
+var dropPNG = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNG(r *bufio.Reader, w io.Writer, res *Result) error {
+	if _, err := r.Discard(len(pngSig)); err != nil {
+		return err
+	}
+	if _, err := w.Write(pngSig); err != nil {
+		return err
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if n > 1<<31-1 {
+			return errors.New("png: bad chunk length")
+		}
+		typ := string(hdr[4:])
+		if dropPNG[typ] {
+			skip := n + 4
+			if typ == "eXIf" && res.Exif == nil && n <= 1<<20 {
+				body := make([]byte, n)
+				if _, err := io.ReadFull(r, body); err != nil {
+					return err
+				}
+				res.Exif, _ = ParseExif(body)
+				skip = 4
+			}
+			if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+				return err
+			}
+			res.Removed += 12 + n
+			continue
+		}
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n+4); err != nil {
+			return err
+		}
+		if typ == "IEND" {
+			n, err := io.Copy(io.Discard, r)
+			res.Removed += n
+			return err
+		}
+	}
+}
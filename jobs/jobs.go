@@ -0,0 +1,188 @@
+package jobs
+
+import (
+	"SCloud/coord"
+	"SCloud/store"
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	Running = "running"
+	Done    = "done"
+	Failed  = "failed"
+)
+
+var ErrRunning = errors.New("job already running")
+
+type Job = store.Job
+
+// Progress is handed to running jobs to report how far they got.
+type Progress struct {
+	r   *Runner
+	job *Job
+}
+
+func (p Progress) Add(n int64) {
+	p.r.mu.Lock()
+	p.job.Done += n
+	p.r.mu.Unlock()
+}
+
+func (p Progress) SetTotal(n int64) {
+	p.r.mu.Lock()
+	p.job.Total = n
+	p.r.mu.Unlock()
+}
+
+// Func does the work; its result is stored on the job for status queries.
+type Func func(p Progress) (any, error)
+
+const keepFinished = 100
+
+// Runner tracks background jobs and persists their records to a JobStore
+// so history survives restarts.
+type Runner struct {
+	mu    sync.Mutex
+	seq   int
+	all   map[string]*Job
+	byID  []string // insertion order, for pruning
+	store store.JobStore
+
+	// OnFail, if set, is called with every job that fails
+	OnFail func(Job)
+	// Locker, if set, is shared with the other instances on the store; a
+	// job holds "job:<name>" while it runs, so only one instance runs it
+	Locker coord.Locker
+}
+
+func New(s store.JobStore) *Runner {
+	return &Runner{all: map[string]*Job{}, store: s}
+}
+
+func (r *Runner) persist(j Job) {
+	if err := r.store.Save(context.Background(), &j); err != nil {
+		log.Printf("job %s: persist: %v", j.ID, err)
+	}
+}
+
+// Start runs fn in the background under name. Only one job per name runs at a time.
+func (r *Runner) Start(name string, fn Func) (Job, error) {
+	unlock := func() {}
+	if r.Locker != nil {
+		var err error
+		if unlock, err = r.Locker.TryLock(context.Background(), "job:"+name); errors.Is(err, coord.ErrHeld) {
+			return Job{}, ErrRunning
+		} else if err != nil {
+			return Job{}, err
+		}
+	}
+	r.mu.Lock()
+	for _, j := range r.all {
+		if j.Name == name && j.Status == Running {
+			r.mu.Unlock()
+			unlock()
+			return Job{}, ErrRunning
+		}
+	}
+	r.seq++
+	j := &Job{
+		ID:        name + "-" + time.Now().UTC().Format("20060102T150405") + "-" + strconv.Itoa(r.seq),
+		Name:      name,
+		Status:    Running,
+		StartedAt: time.Now().Unix(),
+	}
+	r.all[j.ID] = j
+	r.byID = append(r.byID, j.ID)
+	r.prune()
+	snapshot := *j
+	r.mu.Unlock()
+	r.persist(snapshot)
+
+	go func() {
+		result, err := fn(Progress{r: r, job: j})
+		unlock()
+		r.mu.Lock()
+		j.FinishedAt = time.Now().Unix()
+		j.Result = result
+		j.Status = Done
+		if err != nil {
+			j.Status = Failed
+			j.Error = err.Error()
+		}
+		final := *j
+		r.mu.Unlock()
+		r.persist(final)
+		if final.Status == Failed && r.OnFail != nil {
+			r.OnFail(final)
+		}
+	}()
+	return snapshot, nil
+}
+
+// Get returns a snapshot of the job with the given ID.
+func (r *Runner) Get(id string) (Job, bool) {
+	r.mu.Lock()
+	j, ok := r.all[id]
+	if ok {
+		defer r.mu.Unlock()
+		return *j, true
+	}
+	r.mu.Unlock()
+
+	stored, err := r.store.Get(context.Background(), id)
+	if err != nil {
+		return Job{}, false
+	}
+	return *stored, true
+}
+
+// List returns recent jobs, newest first; live progress wins over stored records.
+func (r *Runner) List() []Job {
+	stored, err := r.store.List(context.Background(), keepFinished)
+	if err != nil {
+		log.Printf("jobs: list: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]bool{}
+	out := make([]Job, 0, len(r.all)+len(stored))
+	for _, j := range r.all {
+		out = append(out, *j)
+		seen[j.ID] = true
+	}
+	for _, j := range stored {
+		if !seen[j.ID] {
+			out = append(out, j)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].StartedAt > out[b].StartedAt })
+	return out
+}
+
+// Last returns the most recent job with the given name.
+func (r *Runner) Last(name string) (Job, bool) {
+	for _, j := range r.List() {
+		if j.Name == name {
+			return j, true
+		}
+	}
+	return Job{}, false
+}
+
+// prune drops the oldest finished jobs beyond keepFinished. Caller holds r.mu.
+func (r *Runner) prune() {
+	for len(r.byID) > keepFinished {
+		j := r.all[r.byID[0]]
+		if j != nil && j.Status == Running {
+			return
+		}
+		delete(r.all, r.byID[0])
+		r.byID = r.byID[1:]
+	}
+}
@@ -0,0 +1,91 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Queue runs tasks one after another in a background job named Name,
+// started when work arrives and finishing when the queue runs dry, so
+// requests never wait on the slow service a task talks to.
+type Queue struct {
+	Name       string
+	Runner     *Runner
+	Log        *log.Logger
+	Attempts   int // per task; at least 1
+	RetryDelay time.Duration
+
+	mu      sync.Mutex
+	tasks   []Task
+	running bool
+}
+
+// Task is one unit of queued work. Desc names it in logs.
+type Task struct {
+	Desc string
+	Run  func() error
+}
+
+// Add queues t.
+func (q *Queue) Add(t Task) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, t)
+	start := !q.running
+	q.running = true
+	q.mu.Unlock()
+	if start {
+		go q.kick()
+	}
+}
+
+// kick starts the job. The previous one may still be finishing after it
+// saw an empty queue, so ErrRunning is retried briefly.
+func (q *Queue) kick() {
+	for {
+		_, err := q.Runner.Start(q.Name, q.drain)
+		if !errors.Is(err, ErrRunning) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (q *Queue) drain(p Progress) (any, error) {
+	done, failed := 0, 0
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			break
+		}
+		t := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.mu.Unlock()
+
+		var err error
+		for i := 0; i < max(q.Attempts, 1); i++ {
+			if i > 0 {
+				time.Sleep(q.RetryDelay)
+			}
+			if err = t.Run(); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			q.Log.Printf("%s %s: %v", q.Name, t.Desc, err)
+			failed++
+		} else {
+			done++
+		}
+		p.Add(1)
+	}
+	result := map[string]int{"done": done, "failed": failed}
+	if failed > 0 {
+		return result, fmt.Errorf("%d of %d tasks failed", failed, done+failed)
+	}
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package jobs
+
+import (
+	"SCloud/schedule"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Status is what the admin API shows of a scheduled task.
+type Status struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"` // "" when disabled
+	Enabled  bool   `json:"enabled"`
+	Next     int64  `json:"next,omitempty"`     // unix seconds
+	Skipped  int    `json:"skipped"`            // runs not started because the last was still going
+	LastRun  *Job   `json:"last_run,omitempty"` // from the job history, manual runs included
+}
+
+type task struct {
+	name    string
+	spec    *schedule.Spec // nil = disabled
+	fn      Func
+	next    time.Time
+	skipped int
+}
+
+// Scheduler starts tasks as jobs when their schedules come due. A task
+// runs under its own name, so a run is skipped while the last one, or one
+// an admin started by hand, is still going; with a Locker on the runner
+// that holds across instances too.
+type Scheduler struct {
+	Runner *Runner
+	Log    *log.Logger
+
+	mu    sync.Mutex
+	tasks []*task
+	wake  chan struct{}
+}
+
+func NewScheduler(runner *Runner, logger *log.Logger) *Scheduler {
+	return &Scheduler{Runner: runner, Log: logger, wake: make(chan struct{}, 1)}
+}
+
+// Add schedules fn under name; a nil spec lists the task as disabled.
+func (s *Scheduler) Add(name string, spec *schedule.Spec, fn Func) {
+	t := &task{name: name, spec: spec, fn: fn}
+	if spec != nil {
+		t.next = spec.Next(time.Now())
+	}
+	s.mu.Lock()
+	s.tasks = append(s.tasks, t)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts due tasks until the process exits.
+func (s *Scheduler) Run() {
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		var wait time.Duration = time.Hour
+		for _, t := range s.tasks {
+			if t.spec == nil {
+				continue
+			}
+			if !t.next.After(now) {
+				s.start(t)
+				t.next = t.spec.Next(now)
+			}
+			wait = min(wait, t.next.Sub(now))
+		}
+		s.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-s.wake:
+		}
+	}
+}
+
+// start runs t as a job. Caller holds s.mu.
+func (s *Scheduler) start(t *task) {
+	_, err := s.Runner.Start(t.name, t.fn)
+	if errors.Is(err, ErrRunning) {
+		t.skipped++
+		s.Log.Printf("schedule: %s still running, skipped", t.name)
+		return
+	}
+	if err != nil {
+		s.Log.Printf("schedule: %s: %v", t.name, err)
+	}
+}
+
+// Status lists the tasks in the order they were added.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	out := make([]Status, len(s.tasks))
+	for i, t := range s.tasks {
+		out[i] = Status{Name: t.name, Enabled: t.spec != nil, Skipped: t.skipped}
+		if t.spec != nil {
+			out[i].Schedule = t.spec.String()
+			out[i].Next = t.next.Unix()
+		}
+	}
+	s.mu.Unlock()
+	for i := range out {
+		if j, ok := s.Runner.Last(out[i].Name); ok {
+			out[i].LastRun = &j
+		}
+	}
+	return out
+}
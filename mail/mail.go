@@ -0,0 +1,249 @@
+package mail
+
+import (
+	"SCloud/config"
+	"SCloud/egress"
+	"SCloud/jobs"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is one plain-text email.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Sender delivers a message synchronously.
+type Sender interface {
+	Send(m Message) error
+}
+
+// SMTP relays through a mail server, connecting through the egress proxy
+// if one applies. It switches to TLS when the server offers STARTTLS and
+// only sends credentials over TLS (or to localhost).
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password *config.Secret // read per message, so a rotated one is picked up
+	From     string
+}
+
+// how long one message may take to hand over
+const smtpTimeout = 2 * time.Minute
+
+func (s SMTP) Send(m Message) error {
+	from, err := netmail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("MAIL_FROM: %w", err)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	ctx, cancel := context.WithTimeout(context.Background(), smtpTimeout)
+	defer cancel()
+	conn, err := egress.DialContext(ctx, s.Addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(egress.TLSConfig(host)); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password.Value(), host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(compose(s.From, m)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// compose renders m as an RFC 5322 message.
+func compose(from string, m Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime(m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// mime encodes a header value that is not plain ASCII. Line breaks are
+// dropped so a value cannot add headers.
+func mime(v string) string {
+	v = strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+	for _, r := range v {
+		if r > 0x7e {
+			return "=?utf-8?q?" + strings.NewReplacer("=", "=3D", "?", "=3F", "_", "=5F", " ", "_").Replace(v) + "?="
+		}
+	}
+	return v
+}
+
+// LogSender writes messages to the log instead of sending them; it stands in
+// when no SMTP server is configured.
+type LogSender struct{ Log *log.Logger }
+
+func (s LogSender) Send(m Message) error {
+	s.Log.Printf("mail to %s: %s\n%s", strings.Join(m.To, ", "), m.Subject, m.Body)
+	return nil
+}
+
+const (
+	jobName  = "mail"
+	attempts = 3
+)
+
+var retryDelay = 10 * time.Second
+
+// Mailer queues messages and delivers them from a "mail" background job, so
+// requests never wait on the mail server.
+type Mailer struct {
+	Sender Sender
+	Jobs   *jobs.Runner
+	Log    *log.Logger
+	// where Alert goes: ADMIN_EMAILS
+	Admins []string
+
+	mu      sync.Mutex
+	queue   []Message
+	running bool
+}
+
+// New sends through SMTP_HOST when it is set and logs messages otherwise.
+func New(cfg *config.Config, runner *jobs.Runner, logger *log.Logger) *Mailer {
+	var sender Sender = LogSender{Log: logger}
+	if cfg.SMTPHost != "" {
+		sender = SMTP{
+			Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+			Username: cfg.SMTPUser,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}
+	}
+	return &Mailer{Sender: sender, Jobs: runner, Log: logger, Admins: cfg.AdminEmails}
+}
+
+// Send queues m for delivery.
+func (m *Mailer) Send(msg Message) {
+	if len(msg.To) == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.queue = append(m.queue, msg)
+	start := !m.running
+	m.running = true
+	m.mu.Unlock()
+	if start {
+		go m.kick()
+	}
+}
+
+// SendTemplate renders the named template with data and queues the result.
+func (m *Mailer) SendTemplate(to []string, name string, data any) error {
+	msg, err := Render(name, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+	m.Send(msg)
+	return nil
+}
+
+// Alert mails the admins about something that needs a person.
+func (m *Mailer) Alert(subject, detail string) {
+	err := m.SendTemplate(m.Admins, "admin_alert", map[string]string{"Subject": subject, "Detail": detail})
+	if err != nil {
+		m.Log.Printf("admin alert: %v", err)
+	}
+}
+
+// kick starts the mail job. The previous one may still be finishing after
+// it saw an empty queue, so ErrRunning is retried briefly.
+func (m *Mailer) kick() {
+	for {
+		_, err := m.Jobs.Start(jobName, m.drain)
+		if !errors.Is(err, jobs.ErrRunning) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (m *Mailer) drain(p jobs.Progress) (any, error) {
+	sent, failed := 0, 0
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			break
+		}
+		msg := m.queue[0]
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+
+		var err error
+		for i := 0; i < attempts; i++ {
+			if i > 0 {
+				time.Sleep(retryDelay)
+			}
+			if err = m.Sender.Send(msg); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			m.Log.Printf("mail to %s (%s) dropped: %v", strings.Join(msg.To, ", "), msg.Subject, err)
+			failed++
+		} else {
+			sent++
+		}
+		p.Add(1)
+	}
+	result := map[string]int{"sent": sent, "failed": failed}
+	if failed > 0 {
+		return result, fmt.Errorf("%d of %d messages not delivered", failed, sent+failed)
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Each template renders a subject line, a blank line and the body.
+var templates = template.Must(template.New("").Parse(`
+{{define "password_reset"}}Reset your SCloud password
+
+Someone asked to reset the password of your SCloud account. If it was you,
+open this link within the hour:
+
+{{.Link}}
+
+If it was not, ignore this message; your password stays as it is.
+{{end}}
+
+{{define "password_reset_recovery"}}Reset your SCloud password
+
+Someone asked to reset the password of your SCloud account. Your files are
+encrypted under your password, so a mailed link cannot reset it without
+losing them: reset it with one of the recovery codes you were given.
+
+If it was not you, ignore this message; your password stays as it is.
+{{end}}
+
+{{define "verify_email"}}Confirm your email address
+
+Welcome to SCloud, {{.Name}}. Confirm that this address is yours by opening:
+
+{{.Link}}
+{{end}}
+
+{{define "new_device"}}New sign-in to your SCloud account
+
+Your account was signed in from a device it has not been used from before:
+
+  {{.UserAgent}}
+  from {{.IP}} at {{.Time}}
+{{if .NeedsApproval}}
+The device cannot use the account until you approve it from one of your
+trusted devices.
+{{end}}
+If this was not you, change your password and revoke the device.
+{{end}}
+
+{{define "org_added"}}You were added to {{.Org}}
+
+{{.By}} added you to the organisation {{.Org}} on SCloud as {{.Role}}. Its
+files now show up alongside your own.
+{{end}}
+
+{{define "quota_warning"}}{{.Org}} has used {{.Level}}% of its storage
+
+The organisation {{.Org}} on SCloud stores {{.Used}} of its {{.Quota}} bytes.
+{{if ge .Level 100}}Uploads are refused until files are deleted or the quota is raised.
+{{else}}Uploads will be refused once the quota is full.
+{{end}}{{end}}
+
+{{define "admin_alert"}}[SCloud] {{.Subject}}
+
+{{.Detail}}
+{{end}}
+`))
+
+// Render fills in the named template.
+func Render(name string, data any) (Message, error) {
+	var b bytes.Buffer
+	if err := templates.ExecuteTemplate(&b, name, data); err != nil {
+		return Message{}, fmt.Errorf("mail template %s: %w", name, err)
+	}
+	subject, body, _ := strings.Cut(b.String(), "\n\n")
+	return Message{Subject: subject, Body: body}, nil
+}
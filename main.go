@@ -1,14 +1,12 @@
 package main
 
 import (
-	"SCloud/auth"
+	"SCloud/cli"
 	"SCloud/config"
-	"SCloud/handlers"
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"SCloud/server"
+	"SCloud/storage"
 	"log"
-	"net/http"
-	"time"
+	"os"
 )
 
 //TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
@@ -19,81 +17,38 @@ func checkError(err error) {
 }
 
 func main() {
-	//db.ConnectDB()
-
-	router := gin.Default()
-	_, err := config.LoadConfig()
+	cfg, err := config.LoadConfig()
 	if err != nil {
-		log.Printf("Error loading config: %v", err)
+		log.Fatalf("Error loading config: %v", err)
+	}
+	storage.RetireKeys(cfg.RetiredMasterKeys...)
+	storage.SetStagingDir(cfg.UploadStagingDir)
+	storage.SetReadOnly(cfg.ReadOnly)
+	storage.SetPlacement(storage.Placement{Volumes: cfg.Volumes, Policy: cfg.Placement, Pins: cfg.VolumePins})
+	storage.SetCaseInsensitive(cfg.CaseInsensitiveNames)
+	storage.SetLimits(storage.Limits{DirEntries: cfg.MaxDirEntries, UserFiles: cfg.MaxUserFiles, Depth: cfg.MaxPathDepth, NameLength: cfg.MaxNameLength})
+	if cfg.UploadTempDir != "" {
+		// mime/multipart spills large parts to os.TempDir()
+		os.Setenv("TMPDIR", cfg.UploadTempDir)
 	}
-	router.Use(gin.Logger(), gin.Recovery())
-
-	router.GET("/health", func(context *gin.Context) {
-		context.String(http.StatusOK, "OK")
-	})
-
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"https://sc.rorocorp.org", "https://apisc.rorocorp.org"},
-		AllowMethods:     []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodHead, http.MethodDelete, http.MethodOptions},
-		AllowHeaders:     []string{"Origin", "Content-Type", "X-XSRF-TOKEN", "X-CSRF-TOKEN", "Accept", "Origin", "X-Requested-With", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		AllowOriginFunc: func(origin string) bool {
-			return origin == "exampleUrl"
-		},
-		MaxAge: 12 * time.Hour,
-	}))
-
-	apiGroup := router.Group("/api")
-	{
-		filesGroup := apiGroup.Group("/files")
-		filesGroup.Use(auth.Authorize())
-		{
-			filesGroup.POST("/upload", handlers.UploadHandler)
-			filesGroup.PUT("/uploadchunked", handlers.ChunkedUploadHandler)
-			filesGroup.GET("/download", handlers.DownloadHandler)
-			filesGroup.DELETE("/delete", handlers.DeleteHandler)
-			filesGroup.GET("/ls", handlers.ListHandler)
-		}
-
-		authGroup := apiGroup.Group("/auth")
-		{
-			authGroup.POST("/register", auth.RegisterHandler)
-			authGroup.POST("/login", auth.LoginHandler)
-			//Signed download handler
-			authGroup.GET("/genDLink", auth.GenerateDownloadLink)
-			authGroup.GET("/checksession", auth.SessionCheckHandler)
-		}
 
-		downloadGroup := apiGroup.Group("/dlink")
-		{
-			downloadGroup.GET("/generateLink", auth.GenerateDownloadLink)
-			downloadGroup.GET("/download", handlers.SignedDownloadHandler)
+	// `sc <command>` runs an offline tool instead of the server
+	if len(os.Args) > 1 {
+		if err := cli.Run(cfg, os.Args[1:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
 		}
-
+		return
 	}
 
-	apiGroup.OPTIONS("/*path", func(context *gin.Context) {
-		context.Status(204)
-	})
-
-	/*
-		router.Static("/assets", "./dist/assets")
-
-
-			router.NoRoute(func(context *gin.Context) {
-				context.File("./dist/index.html")
-			})
-
-
-		router.GET("/", func(context *gin.Context) {
-			context.File("./dist/index.html")
-		})
-	*/
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	defer srv.Close()
+	srv.StartBackground()
 
-	//router.MaxMultipartMemory = 4 << 30
-	//err = router.RunTLS("10.8.0.2:8443", os.Getenv("SSLPUBLIC"), os.Getenv("SSLPRIVATE"))
-	err = router.Run("0.0.0.0:8443")
+	//err = http.ListenAndServeTLS("10.8.0.2:8443", os.Getenv("SSLPUBLIC"), os.Getenv("SSLPRIVATE"), srv.Handler())
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Printf("server error: %v", err)
 		panic(err)
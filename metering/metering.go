@@ -0,0 +1,119 @@
+package metering
+
+import (
+	"SCloud/store"
+	"SCloud/webhook"
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Day is the usage-table key for t: its UTC date.
+func Day(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
+// Report is what USAGE_WEBHOOK receives: the transfer bytes added since the
+// last report, or a day's storage sample. ID is unique per report so a
+// billing system can de-duplicate retried deliveries.
+type Report struct {
+	ID      string        `json:"id"`
+	Kind    string        `json:"kind"` // "transfer" or "storage"
+	Time    int64         `json:"time"`
+	Records []store.Usage `json:"records"`
+}
+
+// Meter counts per-user transfer bytes in memory and writes them to the
+// usage store in batches, so a transfer costs no database round trip.
+type Meter struct {
+	Store   store.UsageStore
+	Webhook string // USAGE_WEBHOOK; "" sends nothing
+	Log     *log.Logger
+
+	mu      sync.Mutex
+	pending map[[2]string]*store.Usage // by {day, userID}
+	seq     int
+}
+
+func New(s store.UsageStore, hook string, logger *log.Logger) *Meter {
+	return &Meter{Store: s, Webhook: hook, Log: logger, pending: map[[2]string]*store.Usage{}}
+}
+
+// Transfer counts bytes userID moved. Anonymous transfers are not metered.
+func (m *Meter) Transfer(userID string, upload, download int64) {
+	if userID == "" || upload+download <= 0 {
+		return
+	}
+	day := Day(time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := [2]string{day, userID}
+	u, ok := m.pending[k]
+	if !ok {
+		u = &store.Usage{UserID: userID, Day: day}
+		m.pending[k] = u
+	}
+	u.UploadBytes += upload
+	u.DownloadBytes += download
+}
+
+// Flush writes the pending counters to the store and reports them. Rows that
+// fail to write are kept for the next flush.
+func (m *Meter) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	batch := m.pending
+	m.pending = map[[2]string]*store.Usage{}
+	m.mu.Unlock()
+
+	var written []store.Usage
+	var firstErr error
+	for k, u := range batch {
+		if err := m.Store.AddTransfer(ctx, u.UserID, u.Day, u.UploadBytes, u.DownloadBytes); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			m.mu.Lock()
+			if p, ok := m.pending[k]; ok {
+				p.UploadBytes += u.UploadBytes
+				p.DownloadBytes += u.DownloadBytes
+			} else {
+				m.pending[k] = u
+			}
+			m.mu.Unlock()
+			continue
+		}
+		written = append(written, *u)
+	}
+	m.report("transfer", written)
+	return firstErr
+}
+
+// SetStored records each user's stored bytes for today, replacing the
+// earlier sample of the day.
+func (m *Meter) SetStored(ctx context.Context, byUser map[string]int64) error {
+	day := Day(time.Now())
+	var rows []store.Usage
+	for userID, n := range byUser {
+		if userID == "" {
+			continue
+		}
+		if err := m.Store.SetStored(ctx, userID, day, n); err != nil {
+			return err
+		}
+		rows = append(rows, store.Usage{UserID: userID, Day: day, StoredBytes: n})
+	}
+	m.report("storage", rows)
+	return nil
+}
+
+func (m *Meter) report(kind string, rows []store.Usage) {
+	if m.Webhook == "" || len(rows) == 0 {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	m.seq++
+	id := kind + "-" + strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.Itoa(m.seq)
+	m.mu.Unlock()
+	webhook.Post(m.Webhook, Report{ID: id, Kind: kind, Time: now.Unix(), Records: rows}, m.Log)
+}
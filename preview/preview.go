@@ -0,0 +1,174 @@
+package preview
+
+import (
+	"SCloud/config"
+	"SCloud/egress"
+	"SCloud/jobs"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Renderer converts a document into a preview.
+type Renderer interface {
+	Render(ctx context.Context, name string, r io.Reader) (io.ReadCloser, error)
+}
+
+// Gotenberg converts through LibreOffice in a Gotenberg service, to PDF.
+type Gotenberg struct {
+	URL    string
+	Client *http.Client
+}
+
+func (g Gotenberg) Render(ctx context.Context, name string, r io.Reader) (io.ReadCloser, error) {
+	return post(ctx, g.Client, g.URL+"/forms/libreoffice/convert", "files", name, r)
+}
+
+// Collabora converts through a Collabora Online server's convert-to API,
+// to PDF or to a PNG of the first page.
+type Collabora struct {
+	URL    string
+	Format string
+	Client *http.Client
+}
+
+func (c Collabora) Render(ctx context.Context, name string, r io.Reader) (io.ReadCloser, error) {
+	return post(ctx, c.Client, c.URL+"/cool/convert-to/"+c.Format, "data", name, r)
+}
+
+// post uploads r as the multipart file field and returns the reply body.
+func post(ctx context.Context, client *http.Client, url, field, name string, r io.Reader) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile(field, filepath.Base(name))
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("preview service: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// office lists the extensions previews are rendered for.
+var office = map[string]bool{
+	".doc": true, ".docx": true, ".odt": true, ".rtf": true,
+	".xls": true, ".xlsx": true, ".ods": true,
+	".ppt": true, ".pptx": true, ".odp": true,
+}
+
+// Wanted reports whether a file of this name gets a preview.
+func Wanted(name string) bool {
+	return office[strings.ToLower(filepath.Ext(name))]
+}
+
+// ErrGone is returned by Task.Open for a document removed or rewritten
+// since it was queued; the task is dropped.
+var ErrGone = errors.New("document gone")
+
+// Task is one document to render. Key identifies the preview it makes, so
+// one asked for again while queued is only rendered once. Open returns the
+// document; Store receives the preview.
+type Task struct {
+	Key   string
+	Path  string
+	Open  func() (io.ReadCloser, error)
+	Store func(r io.Reader) error
+}
+
+// Queue renders previews in a "preview" background job.
+type Queue struct {
+	Renderer Renderer
+	Format   string // "pdf" or "png"
+	Timeout  time.Duration
+	jobs     *jobs.Queue
+	pending  sync.Map
+}
+
+// New returns a queue sending to PREVIEW_URL, or nil when it is not set.
+func New(cfg *config.Config, runner *jobs.Runner, logger *log.Logger) *Queue {
+	if cfg.PreviewURL == "" {
+		return nil
+	}
+	var r Renderer = Gotenberg{URL: cfg.PreviewURL, Client: egress.Client(0)}
+	if cfg.PreviewService == "collabora" {
+		r = Collabora{URL: cfg.PreviewURL, Format: cfg.PreviewFormat, Client: egress.Client(0)}
+	}
+	return &Queue{
+		Renderer: r,
+		Format:   cfg.PreviewFormat,
+		Timeout:  cfg.PreviewTimeout,
+		jobs:     &jobs.Queue{Name: "preview", Runner: runner, Log: logger, Attempts: 2, RetryDelay: 10 * time.Second},
+	}
+}
+
+// Kind is the rendition kind previews are stored as.
+func (q *Queue) Kind() string { return "preview." + q.Format }
+
+// ContentType is the media type of the previews.
+func (q *Queue) ContentType() string {
+	if q.Format == "png" {
+		return "image/png"
+	}
+	return "application/pdf"
+}
+
+// Add queues t unless a task with its key is queued already.
+func (q *Queue) Add(t Task) {
+	if _, dup := q.pending.LoadOrStore(t.Key, true); dup {
+		return
+	}
+	q.jobs.Add(jobs.Task{Desc: t.Path, Run: func() error {
+		err := q.run(t)
+		q.pending.Delete(t.Key)
+		return err
+	}})
+}
+
+func (q *Queue) run(t Task) error {
+	doc, err := t.Open()
+	if errors.Is(err, ErrGone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer doc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), q.Timeout)
+	defer cancel()
+	out, err := q.Renderer.Render(ctx, t.Path, doc)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return t.Store(out)
+}
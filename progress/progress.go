@@ -0,0 +1,158 @@
+package progress
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	Receiving  = "receiving"  // request body arriving
+	Processing = "processing" // encrypting / assembling on the server
+	Done       = "done"
+	Failed     = "failed"
+)
+
+// forget drops finished uploads this long after they end, and abandoned
+// ones this long after their last update.
+const forget = 10 * time.Minute
+
+// Upload is the server-side view of one in-flight upload.
+type Upload struct {
+	ID        string    `json:"upload_id"`
+	Phase     string    `json:"phase"`
+	Received  int64     `json:"received"`        // request bytes read off the wire
+	Processed int64     `json:"processed"`       // plaintext bytes encrypted and written
+	Total     int64     `json:"total,omitempty"` // 0 when unknown
+	Updated   time.Time `json:"updated"`
+}
+
+// Registry tracks uploads by client-chosen id, scoped per user so ids from
+// different accounts never collide or leak.
+type Registry struct {
+	mu      sync.Mutex
+	uploads map[string]*Upload
+}
+
+func New() *Registry {
+	return &Registry{uploads: map[string]*Upload{}}
+}
+
+func key(userID, id string) string { return userID + "/" + id }
+
+// Start registers an upload, or resumes tracking one already known (the next
+// chunk of a chunked upload). A total of 0 leaves an existing total alone.
+func (r *Registry) Start(userID, id string, total int64) {
+	if id == "" {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now)
+	u := r.uploads[key(userID, id)]
+	if u == nil {
+		u = &Upload{ID: id}
+		r.uploads[key(userID, id)] = u
+	}
+	u.Phase = Receiving
+	if total > 0 {
+		u.Total = total
+	}
+	u.Updated = now
+}
+
+func (r *Registry) update(userID, id string, fn func(u *Upload)) {
+	if id == "" {
+		return
+	}
+	r.mu.Lock()
+	if u := r.uploads[key(userID, id)]; u != nil {
+		fn(u)
+		u.Updated = time.Now()
+	}
+	r.mu.Unlock()
+}
+
+// Processing moves the upload into its server-side phase. While receiving,
+// Total is the request length; a non-zero total here replaces it with the
+// plaintext size so Processed can be compared against it.
+func (r *Registry) Processing(userID, id string, total int64) {
+	r.update(userID, id, func(u *Upload) {
+		u.Phase = Processing
+		if total > 0 {
+			u.Total = total
+		}
+	})
+}
+
+func (r *Registry) AddProcessed(userID, id string, n int64) {
+	r.update(userID, id, func(u *Upload) { u.Processed += n })
+}
+
+// Finish records the outcome. A chunked upload that is not yet assembled
+// stays in Receiving so the client sees it waiting for more chunks.
+func (r *Registry) Finish(userID, id string, ok, complete bool) {
+	r.update(userID, id, func(u *Upload) {
+		switch {
+		case !ok:
+			u.Phase = Failed
+		case complete:
+			u.Phase = Done
+		default:
+			u.Phase = Receiving
+		}
+	})
+}
+
+func (r *Registry) Get(userID, id string) (Upload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.uploads[key(userID, id)]
+	if !ok {
+		return Upload{}, false
+	}
+	return *u, true
+}
+
+// CountReceived wraps a request body so bytes are counted as they arrive.
+func (r *Registry) CountReceived(userID, id string, body io.ReadCloser) io.ReadCloser {
+	if id == "" {
+		return body
+	}
+	return &counter{ReadCloser: body, add: func(n int64) {
+		r.update(userID, id, func(u *Upload) { u.Received += n })
+	}}
+}
+
+// CountProcessed wraps the reader feeding the encryptor.
+func (r *Registry) CountProcessed(userID, id string, src io.Reader) io.Reader {
+	if id == "" {
+		return src
+	}
+	return &counter{ReadCloser: io.NopCloser(src), add: func(n int64) {
+		r.AddProcessed(userID, id, n)
+	}}
+}
+
+// prune runs under r.mu.
+func (r *Registry) prune(now time.Time) {
+	for k, u := range r.uploads {
+		if now.Sub(u.Updated) > forget {
+			delete(r.uploads, k)
+		}
+	}
+}
+
+type counter struct {
+	io.ReadCloser
+	add func(n int64)
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.add(int64(n))
+	}
+	return n, err
+}
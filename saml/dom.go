@@ -0,0 +1,63 @@
+package saml
+
+import (
+	"errors"
+	"github.com/beevik/etree"
+	"strings"
+)
+
+// parse reads a document into its root element. DTDs are refused, so no
+// entity can expand into what is signed.
+func parse(b []byte) (*etree.Element, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(b); err != nil {
+		return nil, err
+	}
+	for _, t := range doc.Child {
+		if _, ok := t.(*etree.Directive); ok {
+			return nil, errors.New("DTDs are not accepted")
+		}
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+func is(e *etree.Element, space, local string) bool {
+	return e.Tag == local && e.NamespaceURI() == space
+}
+
+// attr is the value of the unprefixed attribute name.
+func attr(e *etree.Element, name string) string {
+	for _, a := range e.Attr {
+		if a.Space == "" && a.Key == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func child(e *etree.Element, space, local string) *etree.Element {
+	for _, c := range e.ChildElements() {
+		if is(c, space, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+func all(e *etree.Element, space, local string) []*etree.Element {
+	var out []*etree.Element
+	for _, c := range e.ChildElements() {
+		if is(c, space, local) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func text(e *etree.Element) string {
+	return strings.TrimSpace(e.Text())
+}
@@ -0,0 +1,30 @@
+package saml
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const dsNS = "http://www.w3.org/2000/09/xmldsig#"
+
+// ErrUnsigned is a response with no signature over its assertion.
+var ErrUnsigned = errors.New("the assertion is not signed")
+
+// verify checks the enveloped signature on target against the IdP's
+// certificates and returns target as signed: read only that copy, so
+// nothing wrapped around the signed content is trusted. The key is never
+// taken from the message.
+func verify(target *etree.Element, certs []*x509.Certificate) (*etree.Element, error) {
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	signed, err := ctx.Validate(target)
+	if errors.Is(err, dsig.ErrMissingSignature) {
+		return nil, ErrUnsigned
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	return signed, nil
+}
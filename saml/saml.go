@@ -0,0 +1,409 @@
+// Package saml is a SAML 2.0 service provider: it publishes SP metadata,
+// sends users to the IdP with an AuthnRequest (HTTP-Redirect binding) and
+// checks the Response the IdP posts back (HTTP-POST binding). Assertions
+// must be signed, by the assertion or the response, and not encrypted.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	protocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	metadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	statusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer    = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// NameIDEmail is the NameID format of an email address.
+	NameIDEmail = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+// Skew is how far the IdP's clock may be off from ours.
+const Skew = 3 * time.Minute
+
+// IdP is what the SP knows of the identity provider, from its metadata.
+type IdP struct {
+	EntityID string
+	SSOURL   string // HTTP-Redirect SingleSignOnService
+	Certs    []*x509.Certificate
+}
+
+type mdEntity struct {
+	EntityID string `xml:"entityID,attr"`
+	IDP      *struct {
+		Keys []struct {
+			Use  string `xml:"use,attr"`
+			Cert string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"SingleSignOnService"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// LoadIdP reads the IdP's metadata file: an EntityDescriptor, or an
+// EntitiesDescriptor holding one with an IDPSSODescriptor. The file is
+// trusted as it is; its signature, if any, is not checked.
+func LoadIdP(path string) (*IdP, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		XMLName  xml.Name
+		Entities []mdEntity `xml:"EntityDescriptor"`
+		mdEntity
+	}
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	entities := doc.Entities
+	if doc.XMLName.Local == "EntityDescriptor" {
+		entities = []mdEntity{doc.mdEntity}
+	}
+	for _, e := range entities {
+		if e.IDP == nil {
+			continue
+		}
+		idp := &IdP{EntityID: e.EntityID}
+		for _, s := range e.IDP.SSO {
+			if s.Binding == bindingRedirect {
+				idp.SSOURL = s.Location
+			}
+		}
+		for _, k := range e.IDP.Keys {
+			if k.Use != "" && k.Use != "signing" {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(k.Cert), ""))
+			if err != nil {
+				return nil, fmt.Errorf("%s: certificate: %w", path, err)
+			}
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("%s: certificate: %w", path, err)
+			}
+			idp.Certs = append(idp.Certs, c)
+		}
+		switch {
+		case idp.SSOURL == "":
+			return nil, fmt.Errorf("%s: no HTTP-Redirect SingleSignOnService", path)
+		case len(idp.Certs) == 0:
+			return nil, fmt.Errorf("%s: no signing certificate", path)
+		}
+		return idp, nil
+	}
+	return nil, fmt.Errorf("%s: no IDPSSODescriptor", path)
+}
+
+// LoadCert reads a PEM certificate, for an IdP whose signing key is given
+// apart from its metadata.
+func LoadCert(path string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// SP is this service provider.
+type SP struct {
+	EntityID string
+	ACSURL   string // where the IdP posts its responses
+	IdP      *IdP
+}
+
+// Metadata is the SP metadata to register with the IdP.
+func (sp *SP) Metadata() []byte {
+	type acs struct {
+		Binding   string `xml:"Binding,attr"`
+		Location  string `xml:"Location,attr"`
+		Index     int    `xml:"index,attr"`
+		IsDefault bool   `xml:"isDefault,attr"`
+	}
+	md := struct {
+		XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+		EntityID string   `xml:"entityID,attr"`
+		SP       struct {
+			AuthnRequestsSigned  bool   `xml:"AuthnRequestsSigned,attr"`
+			WantAssertionsSigned bool   `xml:"WantAssertionsSigned,attr"`
+			Protocols            string `xml:"protocolSupportEnumeration,attr"`
+			NameIDFormat         string
+			ACS                  acs `xml:"AssertionConsumerService"`
+		} `xml:"SPSSODescriptor"`
+	}{EntityID: sp.EntityID}
+	md.SP.WantAssertionsSigned = true
+	md.SP.Protocols = protocolNS
+	md.SP.NameIDFormat = NameIDEmail
+	md.SP.ACS = acs{Binding: bindingPOST, Location: sp.ACSURL, IsDefault: true}
+	b, _ := xml.MarshalIndent(md, "", "  ")
+	return append([]byte(xml.Header), b...)
+}
+
+// AuthnRequestURL is where to send the browser to sign in at the IdP with
+// a request of the given ID. The IdP returns relayState with its response.
+func (sp *SP) AuthnRequestURL(id, relayState string, now time.Time) (string, error) {
+	req := struct {
+		XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+		ID           string   `xml:"ID,attr"`
+		Version      string   `xml:"Version,attr"`
+		IssueInstant string   `xml:"IssueInstant,attr"`
+		Destination  string   `xml:"Destination,attr"`
+		ACSURL       string   `xml:"AssertionConsumerServiceURL,attr"`
+		Binding      string   `xml:"ProtocolBinding,attr"`
+		Issuer       struct {
+			XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+			Value   string   `xml:",chardata"`
+		}
+		NameIDPolicy struct {
+			XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+			AllowCreate bool     `xml:"AllowCreate,attr"`
+		}
+	}{
+		ID:           id,
+		Version:      "2.0",
+		IssueInstant: now.UTC().Format(time.RFC3339),
+		Destination:  sp.IdP.SSOURL,
+		ACSURL:       sp.ACSURL,
+		Binding:      bindingPOST,
+	}
+	req.Issuer.Value = sp.EntityID
+	req.NameIDPolicy.AllowCreate = true
+	b, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(b)
+	w.Close()
+
+	u, err := url.Parse(sp.IdP.SSOURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		q.Set("RelayState", relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Assertion is what a verified response says of the user.
+type Assertion struct {
+	ID           string
+	NameID       string
+	NameIDFormat string
+	InResponseTo string    // "" for a response the IdP sent unasked
+	NotOnOrAfter time.Time // when the assertion may no longer be used
+	Attributes   map[string][]string
+}
+
+// Attr is the first value of the attribute named name, by its Name or its
+// FriendlyName.
+func (a *Assertion) Attr(name string) string {
+	if v := a.Attributes[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// ParseResponse checks the base64 SAMLResponse the IdP posted: its
+// signature, issuer, destination, audience and validity window. It does not
+// know which requests are outstanding or which assertions were used
+// before; the caller checks InResponseTo and ID.
+func (sp *SP) ParseResponse(samlResponse string, now time.Time) (*Assertion, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(samlResponse), ""))
+	if err != nil {
+		return nil, fmt.Errorf("SAMLResponse: %w", err)
+	}
+	root, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("SAMLResponse: %w", err)
+	}
+	if !is(root, protocolNS, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+	if d := attr(root, "Destination"); d != "" && d != sp.ACSURL {
+		return nil, fmt.Errorf("response is for %s", d)
+	}
+	if iss := child(root, assertionNS, "Issuer"); iss != nil && text(iss) != sp.IdP.EntityID {
+		return nil, fmt.Errorf("response issued by %s", text(iss))
+	}
+	if code := statusCode(root); code != statusSuccess {
+		return nil, fmt.Errorf("the IdP refused the sign-in: %s", code)
+	}
+	if child(root, assertionNS, "EncryptedAssertion") != nil {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	a, err := sp.signedAssertion(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything below is read from the signed assertion only
+	if iss := child(a, assertionNS, "Issuer"); iss == nil || text(iss) != sp.IdP.EntityID {
+		return nil, errors.New("assertion not issued by the IdP")
+	}
+	out := &Assertion{ID: attr(a, "ID"), Attributes: map[string][]string{}}
+	if err := sp.checkConditions(a, now, out); err != nil {
+		return nil, err
+	}
+	if err := sp.checkSubject(a, now, out); err != nil {
+		return nil, err
+	}
+	if irt := attr(root, "InResponseTo"); irt != "" && irt != out.InResponseTo {
+		return nil, errors.New("response and assertion answer different requests")
+	}
+	if st := child(a, assertionNS, "AttributeStatement"); st != nil {
+		for _, at := range all(st, assertionNS, "Attribute") {
+			var vals []string
+			for _, v := range all(at, assertionNS, "AttributeValue") {
+				vals = append(vals, text(v))
+			}
+			for _, name := range []string{attr(at, "Name"), attr(at, "FriendlyName")} {
+				if name != "" {
+					out.Attributes[name] = append(out.Attributes[name], vals...)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// signedAssertion is the response's one assertion as signed, by itself or
+// as part of the whole response.
+func (sp *SP) signedAssertion(root *etree.Element) (*etree.Element, error) {
+	as := all(root, assertionNS, "Assertion")
+	if len(as) != 1 {
+		return nil, fmt.Errorf("response holds %d assertions, want 1", len(as))
+	}
+	if child(as[0], dsNS, "Signature") != nil {
+		return verify(as[0], sp.IdP.Certs)
+	}
+	if child(root, dsNS, "Signature") == nil {
+		return nil, ErrUnsigned
+	}
+	signed, err := verify(root, sp.IdP.Certs)
+	if err != nil {
+		return nil, err
+	}
+	if as = all(signed, assertionNS, "Assertion"); len(as) != 1 {
+		return nil, fmt.Errorf("response holds %d assertions, want 1", len(as))
+	}
+	return as[0], nil
+}
+
+func statusCode(root *etree.Element) string {
+	st := child(root, protocolNS, "Status")
+	if st == nil {
+		return "no status"
+	}
+	code := child(st, protocolNS, "StatusCode")
+	if code == nil {
+		return "no status"
+	}
+	v := attr(code, "Value")
+	if sub := child(code, protocolNS, "StatusCode"); sub != nil {
+		v += " (" + attr(sub, "Value") + ")"
+	}
+	return v
+}
+
+func (sp *SP) checkConditions(a *etree.Element, now time.Time, out *Assertion) error {
+	c := child(a, assertionNS, "Conditions")
+	if c == nil {
+		return errors.New("assertion without conditions")
+	}
+	if t, err := instant(attr(c, "NotBefore")); err != nil {
+		return err
+	} else if !t.IsZero() && now.Add(Skew).Before(t) {
+		return errors.New("assertion not yet valid")
+	}
+	t, err := instant(attr(c, "NotOnOrAfter"))
+	if err != nil {
+		return err
+	}
+	if !t.IsZero() {
+		if !now.Add(-Skew).Before(t) {
+			return errors.New("assertion expired")
+		}
+		out.NotOnOrAfter = t
+	}
+	ars := all(c, assertionNS, "AudienceRestriction")
+	if len(ars) == 0 {
+		return errors.New("assertion without audience")
+	}
+	for _, ar := range ars {
+		ok := false
+		for _, au := range all(ar, assertionNS, "Audience") {
+			ok = ok || text(au) == sp.EntityID
+		}
+		if !ok {
+			return errors.New("assertion is for another audience")
+		}
+	}
+	return nil
+}
+
+// checkSubject takes the NameID and a bearer confirmation meant for this
+// SP's ACS.
+func (sp *SP) checkSubject(a *etree.Element, now time.Time, out *Assertion) error {
+	sub := child(a, assertionNS, "Subject")
+	if sub == nil {
+		return errors.New("assertion without subject")
+	}
+	if id := child(sub, assertionNS, "NameID"); id != nil {
+		out.NameID, out.NameIDFormat = text(id), attr(id, "Format")
+	}
+	for _, sc := range all(sub, assertionNS, "SubjectConfirmation") {
+		d := child(sc, assertionNS, "SubjectConfirmationData")
+		if attr(sc, "Method") != methodBearer || d == nil || attr(d, "Recipient") != sp.ACSURL {
+			continue
+		}
+		t, err := instant(attr(d, "NotOnOrAfter"))
+		if err != nil || t.IsZero() || !now.Add(-Skew).Before(t) {
+			continue
+		}
+		if out.NotOnOrAfter.IsZero() || t.Before(out.NotOnOrAfter) {
+			out.NotOnOrAfter = t
+		}
+		out.InResponseTo = attr(d, "InResponseTo")
+		return nil
+	}
+	return errors.New("assertion has no current bearer confirmation for this SP")
+}
+
+func instant(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return t, fmt.Errorf("bad instant %q", v)
+	}
+	return t, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipWriters  = sync.Pool{New: func() any { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	flateWriters = sync.Pool{New: func() any { w, _ := flate.NewWriter(nil, flate.DefaultCompression); return w }}
+)
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// by the client's q-values with gzip winning ties; "" when neither is
+// acceptable.
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		name = strings.ToLower(name)
+		if name != "gzip" && name != "deflate" || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && name == "gzip" {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compress compresses API responses per the COMPRESS settings. The choice
+// is made once the response has COMPRESS_MIN_SIZE bytes or ends: file
+// contents (anything with a Content-Disposition or Content-Range, or not of
+// COMPRESS_TYPES) go out as they are, so encrypted downloads and ranges are
+// never touched.
+func (s *Server) compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := acceptedEncoding(c.GetHeader("Accept-Encoding"))
+		if !s.Config.Compress || encoding == "" || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, min: s.Config.CompressMinSize, types: s.Config.CompressTypes, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		w.finish()
+	}
+}
+
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	min      int
+	types    []string
+
+	status  int
+	buf     []byte
+	decided bool
+	zw      io.WriteCloser // nil: passing through
+}
+
+func (w *compressWriter) wanted() bool {
+	h := w.ResponseWriter.Header()
+	if w.status < 200 || w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Disposition") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return slices.Contains(w.types, ct)
+}
+
+// decide sends the header, compressed or not, and what was held back.
+func (w *compressWriter) decide(full bool) error {
+	w.decided = true
+	h := w.ResponseWriter.Header()
+	if full && w.wanted() {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		if w.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(w.ResponseWriter)
+			w.zw = gz
+		} else {
+			fl := flateWriters.Get().(*flate.Writer)
+			fl.Reset(w.ResponseWriter)
+			w.zw = fl
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.zw != nil {
+		_, err := w.zw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) WriteHeaderNow() {}
+
+func (w *compressWriter) Status() int {
+	if w.decided {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *compressWriter) Written() bool { return w.decided || len(w.buf) > 0 }
+
+func (w *compressWriter) Size() int {
+	if !w.decided && len(w.buf) > 0 {
+		return len(w.buf)
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.min {
+			return len(p), nil
+		}
+		return len(p), w.decide(true)
+	}
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) { return w.Write([]byte(s)) }
+
+// Flush sends what there is: a streamed response cannot wait for the
+// threshold.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.min)
+	}
+	if fl, ok := w.zw.(interface{ Flush() error }); ok {
+		fl.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *compressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// finish ends the response once the handlers are done.
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.min)
+	}
+	switch zw := w.zw.(type) {
+	case *gzip.Writer:
+		zw.Close()
+		gzipWriters.Put(zw)
+	case *flate.Writer:
+		zw.Close()
+		flateWriters.Put(zw)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"SCloud/stats"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the request context's *trackedConn
+type connKey struct{}
+
+var errTooSlow = errors.New("client below HTTP_MIN_RATE")
+
+// trackedConn is a client connection, counted against the limits of the
+// listener it came from until it closes.
+type trackedConn struct {
+	net.Conn
+	limiter  *connLimiter // nil: not limited
+	ip       string
+	accepted time.Time
+	requests atomic.Int64 // started on it
+	closing  sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closing.Do(func() {
+		if c.limiter != nil {
+			c.limiter.release(c.ip)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// connLimiter caps open connections, in all (max) and per client address
+// (perIP), across the listeners it is on; 0 is no cap. Connections over a
+// cap are closed as soon as accepted.
+type connLimiter struct {
+	max, perIP int
+	mu         sync.Mutex
+	open       int
+	byIP       map[string]int
+}
+
+func (cl *connLimiter) on(l net.Listener) net.Listener { return limitedListener{l, cl} }
+
+type limitedListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func (l limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if reason := l.limiter.admit(ip); reason != "" {
+			stats.RecordDrop(reason)
+			c.Close()
+			continue
+		}
+		return &trackedConn{Conn: c, limiter: l.limiter, ip: ip, accepted: time.Now()}, nil
+	}
+}
+
+// admit counts a connection from ip in, or returns why it is over a cap.
+func (cl *connLimiter) admit(ip string) string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	switch {
+	case cl.max > 0 && cl.open >= cl.max:
+		return stats.DropMaxConns
+	case cl.perIP > 0 && cl.byIP[ip] >= cl.perIP:
+		return stats.DropPerIP
+	}
+	cl.open++
+	cl.byIP[ip]++
+	return ""
+}
+
+func (cl *connLimiter) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.open--
+	if cl.byIP[ip]--; cl.byIP[ip] <= 0 {
+		delete(cl.byIP, ip)
+	}
+}
+
+// trackingListener hands out trackedConns without limiting them.
+type trackingListener struct{ net.Listener }
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{Conn: c, accepted: time.Now()}, nil
+}
+
+// httpServer serves h with the HTTP_* connection settings.
+func (s *Server) httpServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           s.guardConn(h),
+		ReadHeaderTimeout: s.Config.HTTPReadHeaderTimeout,
+		IdleTimeout:       s.Config.HTTPIdleTimeout,
+		MaxHeaderBytes:    s.Config.HTTPMaxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+		ConnState: s.connState,
+	}
+}
+
+// connState counts the connections that closed without ever getting a
+// whole request in within the header timeout: slow-loris clients, mostly.
+func (s *Server) connState(c net.Conn, state http.ConnState) {
+	tc, ok := c.(*trackedConn)
+	if !ok || state != http.StateClosed {
+		return
+	}
+	if t := s.Config.HTTPReadHeaderTimeout; t > 0 && tc.requests.Load() == 0 && time.Since(tc.accepted) >= t {
+		stats.RecordDrop(stats.DropHeaderTimeout)
+	}
+}
+
+// guardConn closes a connection after HTTP_MAX_REQUESTS_PER_CONN requests,
+// and holds each request's body and response to HTTP_MIN_RATE.
+func (s *Server) guardConn(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, _ := r.Context().Value(connKey{}).(*trackedConn)
+		if tc == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if n := tc.requests.Add(1); s.Config.HTTPMaxRequestsPerConn > 0 && n >= int64(s.Config.HTTPMaxRequestsPerConn) {
+			w.Header().Set("Connection", "close")
+		}
+		if s.Config.HTTPMinRate <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		defer func() {
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+		}()
+		rate, grace := s.Config.HTTPMinRate, s.Config.HTTPMinRateGrace
+		in := &rateFloor{conn: tc, rate: rate, grace: grace, ahead: grace, setDeadline: rc.SetReadDeadline, drop: stats.DropSlowRead}
+		out := &rateFloor{conn: tc, rate: rate, grace: grace, ahead: grace, setDeadline: rc.SetWriteDeadline, drop: stats.DropSlowWrite}
+		r.Body = &slowReader{ReadCloser: r.Body, floor: in}
+		h.ServeHTTP(&slowWriter{ResponseWriter: w, floor: out}, r)
+	})
+}
+
+// rateFloor is one direction of a request held to a minimum rate. The
+// client is only charged for the time the server waits on it, so a slow
+// disk or a busy handler never counts against it. Each byte moved earns it
+// 1/rate seconds and each second waited costs one, with at most grace
+// banked: however fast it was before, it is cut once grace behind.
+type rateFloor struct {
+	conn        *trackedConn
+	rate        int64
+	grace       time.Duration
+	setDeadline func(time.Time) error
+	drop        string
+	ahead       time.Duration
+	cut         bool
+}
+
+func (f *rateFloor) earned(n int) time.Duration {
+	return time.Duration(float64(n) / float64(f.rate) * float64(time.Second))
+}
+
+// allow arms the deadline for moving up to n more bytes, reporting false
+// when the client is already behind.
+func (f *rateFloor) allow(n int) bool {
+	left := f.ahead + f.earned(n)
+	if f.cut || left <= 0 {
+		return false
+	}
+	f.setDeadline(time.Now().Add(left))
+	return true
+}
+
+// done records a transfer of n bytes that started at start, cutting the
+// connection if it ran into the deadline.
+func (f *rateFloor) done(start time.Time, n int, err error) error {
+	f.ahead = min(f.grace, f.ahead+f.earned(n)-time.Since(start))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return f.fail()
+	}
+	return err
+}
+
+func (f *rateFloor) fail() error {
+	if !f.cut {
+		f.cut = true
+		stats.RecordDrop(f.drop)
+		f.conn.Close()
+	}
+	return errTooSlow
+}
+
+type slowReader struct {
+	io.ReadCloser
+	floor *rateFloor
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if !r.floor.allow(0) {
+		return 0, r.floor.fail()
+	}
+	start := time.Now()
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// the whole body is in: nothing more to wait for
+		r.floor.setDeadline(time.Time{})
+	}
+	return n, r.floor.done(start, n, err)
+}
+
+type slowWriter struct {
+	http.ResponseWriter
+	floor *rateFloor
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	if !w.floor.allow(len(p)) {
+		return 0, w.floor.fail()
+	}
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(p)
+	return n, w.floor.done(start, n, err)
+}
+
+func (w *slowWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *slowWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
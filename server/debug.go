@@ -0,0 +1,123 @@
+package server
+
+import (
+	"SCloud/config"
+	"SCloud/stats"
+	"expvar"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+var publishVarsOnce sync.Once
+
+// publishVars adds the server's own counters to expvar's memstats and
+// cmdline. expvar names are process-wide, hence the Once.
+func publishVars() {
+	publishVarsOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+		expvar.Publish("transfers_24h", expvar.Func(func() any {
+			upCount, upBytes := stats.Last24h(stats.Upload)
+			downCount, downBytes := stats.Last24h(stats.Download)
+			return map[string]int64{
+				"uploads":        upCount,
+				"upload_bytes":   upBytes,
+				"downloads":      downCount,
+				"download_bytes": downBytes,
+			}
+		}))
+		expvar.Publish("dropped_connections", expvar.Func(func() any { return stats.Drops() }))
+	})
+}
+
+// writeMetrics writes the transfer counters in the Prometheus text format:
+// server-wide over the last 24h and since start, and per user since start
+// for just the topUsers busiest users, which keeps the label's cardinality
+// bounded. The rest are left to the server-wide totals: summed apart they
+// would fall whenever a user joined the top.
+func writeMetrics(w http.ResponseWriter, topUsers int) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	upCount, upBytes := stats.Last24h(stats.Upload)
+	downCount, downBytes := stats.Last24h(stats.Download)
+	fmt.Fprintf(w, "# HELP sc_transfers_24h Transfers in the last 24 hours.\n# TYPE sc_transfers_24h gauge\n")
+	fmt.Fprintf(w, "sc_transfers_24h{direction=\"upload\"} %d\nsc_transfers_24h{direction=\"download\"} %d\n", upCount, downCount)
+	fmt.Fprintf(w, "# HELP sc_transfer_bytes_24h Bytes moved in the last 24 hours.\n# TYPE sc_transfer_bytes_24h gauge\n")
+	fmt.Fprintf(w, "sc_transfer_bytes_24h{direction=\"upload\"} %d\nsc_transfer_bytes_24h{direction=\"download\"} %d\n", upBytes, downBytes)
+	fmt.Fprintf(w, "# HELP sc_dropped_connections_total Client connections cut, by reason.\n# TYPE sc_dropped_connections_total counter\n")
+	drops := stats.Drops()
+	for _, reason := range slices.Sorted(maps.Keys(drops)) {
+		fmt.Fprintf(w, "sc_dropped_connections_total{reason=%q} %d\n", reason, drops[reason])
+	}
+	busy, shed := stats.Slots(config.ConcurrencyClasses)
+	fmt.Fprintf(w, "# HELP sc_concurrency_in_use Requests holding a CONCURRENCY_LIMITS slot.\n# TYPE sc_concurrency_in_use gauge\n")
+	for _, class := range config.ConcurrencyClasses {
+		fmt.Fprintf(w, "sc_concurrency_in_use{class=%q} %d\n", class, busy[class])
+	}
+	fmt.Fprintf(w, "# HELP sc_concurrency_shed_total Requests turned away with 503 for want of a slot.\n# TYPE sc_concurrency_shed_total counter\n")
+	for _, class := range config.ConcurrencyClasses {
+		fmt.Fprintf(w, "sc_concurrency_shed_total{class=%q} %d\n", class, shed[class])
+	}
+
+	top, all := stats.TopUsers(topUsers)
+	ids := slices.Sorted(maps.Keys(top))
+	for _, id := range ids {
+		t := top[id]
+		all.Uploads += t.Uploads
+		all.UploadBytes += t.UploadBytes
+		all.UploadFailures += t.UploadFailures
+		all.Downloads += t.Downloads
+		all.DownloadBytes += t.DownloadBytes
+		all.DownloadFailures += t.DownloadFailures
+	}
+	for _, m := range []struct {
+		name, help string
+		up, down   func(stats.UserTotals) int64
+	}{
+		{"transfers_total", "Finished uploads and downloads",
+			func(t stats.UserTotals) int64 { return t.Uploads }, func(t stats.UserTotals) int64 { return t.Downloads }},
+		{"bytes_total", "Bytes moved",
+			func(t stats.UserTotals) int64 { return t.UploadBytes }, func(t stats.UserTotals) int64 { return t.DownloadBytes }},
+		{"failures_total", "Failed upload and download requests",
+			func(t stats.UserTotals) int64 { return t.UploadFailures }, func(t stats.UserTotals) int64 { return t.DownloadFailures }},
+	} {
+		name := "sc_" + m.name
+		fmt.Fprintf(w, "# HELP %s %s since start.\n# TYPE %s counter\n", name, m.help, name)
+		fmt.Fprintf(w, "%s{direction=\"upload\"} %d\n%s{direction=\"download\"} %d\n", name, m.up(all), name, m.down(all))
+		name = "sc_user_" + m.name
+		fmt.Fprintf(w, "# HELP %s %s per user, for the busiest users.\n# TYPE %s counter\n", name, m.help, name)
+		for _, id := range ids {
+			fmt.Fprintf(w, "%s{user=%q,direction=\"upload\"} %d\n", name, id, m.up(top[id]))
+			fmt.Fprintf(w, "%s{user=%q,direction=\"download\"} %d\n", name, id, m.down(top[id]))
+		}
+	}
+}
+
+// debugMux serves pprof under /debug/pprof/, expvar at /debug/vars and
+// Prometheus metrics at /debug/metrics.
+func (s *Server) debugMux() http.Handler {
+	publishVars()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, s.Config.MetricsTopUsers)
+	})
+	return mux
+}
+
+// serveDebug runs the debug endpoints on their own listener (DEBUG_ADDR),
+// without authentication; config only accepts a loopback address for it.
+func (s *Server) serveDebug(addr string) {
+	s.Logger.Printf("debug endpoints on http://%s/debug/pprof/", addr)
+	if err := http.ListenAndServe(addr, s.debugMux()); err != nil {
+		s.Logger.Printf("debug listener: %v", err)
+	}
+}
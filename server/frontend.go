@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isBackendPath reports whether p belongs to the server rather than the
+// single-page app; those paths never fall back to index.html.
+func isBackendPath(p string) bool {
+	for _, prefix := range []string{"/api", "/pub", "/health"} {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// frontendHandler serves FRONTEND_DIR for whatever the API routes did not
+// match. An existing file is served as is; any other GET gets index.html,
+// except under the assets directory, where a missing file is a 404 rather
+// than HTML a script tag would choke on.
+func (s *Server) frontendHandler(context *gin.Context) {
+	method := context.Request.Method
+	p := path.Clean("/" + context.Request.URL.Path)
+	if method != http.MethodGet && method != http.MethodHead || isBackendPath(p) {
+		context.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	dir := s.Config.FrontendDir
+	assets := "/" + s.Config.FrontendAssets + "/"
+	if p != "/" {
+		if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p))); err == nil && !fi.IsDir() {
+			if strings.HasPrefix(p, assets) {
+				context.Header("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				context.Header("Cache-Control", "no-cache")
+			}
+			http.ServeFile(context.Writer, context.Request, filepath.Join(dir, filepath.FromSlash(p)))
+			return
+		}
+		if strings.HasPrefix(p, assets) {
+			context.String(http.StatusNotFound, "404 page not found")
+			return
+		}
+	}
+	// the app shell names the current asset hashes, so it always revalidates
+	f, err := os.Open(filepath.Join(dir, "index.html"))
+	if err != nil {
+		context.String(http.StatusInternalServerError, "frontend: %v", err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		context.String(http.StatusInternalServerError, "frontend: %v", err)
+		return
+	}
+	context.Header("Cache-Control", "no-cache")
+	context.Header("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(context.Writer, context.Request, "index.html", fi.ModTime(), f)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"SCloud/ftpd"
+	"crypto/tls"
+	"net"
+)
+
+// serveFTP runs the FTP listener (FTP_ADDR), with AUTH TLS when a
+// certificate is configured.
+func (s *Server) serveFTP(addr string) {
+	srv := &ftpd.Server{
+		AllowPlain:   s.Config.FTPPlain,
+		PassivePorts: s.Config.FTPPassivePorts,
+		PublicIP:     s.Config.FTPPublicIP,
+		Password:     s.remoteLogin("ftp"),
+		FS:           s.limitFS(s.Handlers.FTPTree),
+		Log:          s.Logger,
+	}
+	if s.Config.FTPTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(s.Config.FTPTLSCert, s.Config.FTPTLSKey)
+		if err != nil {
+			s.Logger.Printf("ftp certificate: %v", err)
+			return
+		}
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.Logger.Printf("ftp listener: %v", err)
+		return
+	}
+	s.Logger.Printf("ftp on %s", addr)
+	if err := srv.Serve(l); err != nil {
+		s.Logger.Printf("ftp listener: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"SCloud/sftpd"
+	"SCloud/stats"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errBusy is a request that waited CONCURRENCY_QUEUE_WAIT without a slot.
+var errBusy = errors.New("server busy, try again later")
+
+// rateGrace is how long a body may take before CONCURRENCY_MIN_RATE applies.
+const rateGrace = 10 * time.Second
+
+// classSlots are the CONCURRENCY_LIMITS slots of one class; nil is no limit.
+type classSlots struct {
+	class string
+	ch    chan struct{}
+	wait  time.Duration
+}
+
+// slots returns class's slots, the same for every caller, HTTP routes and
+// SFTP and FTP alike.
+func (s *Server) slots(class string) *classSlots {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+	if sl, ok := s.classSlots[class]; ok {
+		return sl
+	}
+	var sl *classSlots
+	if n := s.Config.ConcurrencyLimits[class]; n > 0 {
+		sl = &classSlots{class: class, ch: make(chan struct{}, n), wait: s.Config.ConcurrencyQueueWait}
+	}
+	if s.classSlots == nil {
+		s.classSlots = map[string]*classSlots{}
+	}
+	s.classSlots[class] = sl
+	return sl
+}
+
+// take waits up to the queue wait for a slot; release gives it back.
+func (sl *classSlots) take(ctx context.Context) error {
+	select {
+	case sl.ch <- struct{}{}:
+	default:
+		timer := time.NewTimer(sl.wait)
+		defer timer.Stop()
+		select {
+		case sl.ch <- struct{}{}:
+		case <-timer.C:
+			stats.RecordShed(sl.class)
+			return errBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	stats.SlotTaken(sl.class, 1)
+	return nil
+}
+
+func (sl *classSlots) release() {
+	<-sl.ch
+	stats.SlotTaken(sl.class, -1)
+}
+
+// limit holds the requests of class to its CONCURRENCY_LIMITS slots. While
+// one holds a slot its body must arrive at CONCURRENCY_MIN_RATE, so a slow
+// sender cannot sit on a slot for the length of its transfer.
+func (s *Server) limit(class string) gin.HandlerFunc {
+	sl := s.slots(class)
+	if sl == nil {
+		return func(*gin.Context) {}
+	}
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(sl.wait.Seconds()))))
+	return func(context *gin.Context) {
+		if err := sl.take(context.Request.Context()); err != nil {
+			if errors.Is(err, errBusy) {
+				context.Header("Retry-After", retryAfter)
+				context.String(http.StatusServiceUnavailable, "Server busy, try again later")
+			}
+			context.Abort()
+			return
+		}
+		defer sl.release()
+		if rate := s.Config.ConcurrencyMinRate; rate > 0 && context.Request.Body != nil && context.Request.Body != http.NoBody {
+			context.Request.Body = &minRateBody{
+				ReadCloser: context.Request.Body,
+				rc:         http.NewResponseController(context.Writer),
+				rate:       rate,
+				start:      time.Now(),
+			}
+		}
+		context.Next()
+	}
+}
+
+// minRateBody ends a body that has, past rateGrace, averaged under rate
+// bytes a second, through the connection's read deadline so a sender that
+// stops altogether is caught as well.
+type minRateBody struct {
+	io.ReadCloser
+	rc    *http.ResponseController
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (b *minRateBody) Read(p []byte) (int, error) {
+	due := b.start.Add(rateGrace + time.Duration(float64(b.n)/float64(b.rate)*float64(time.Second)))
+	b.rc.SetReadDeadline(due)
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *minRateBody) Close() error {
+	b.rc.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+// limitedFS holds the file reads of an SFTP or FTP session to the download
+// slots.
+type limitedFS struct {
+	sftpd.FS
+	slots *classSlots
+}
+
+// limitFS wraps the trees fs opens in the download limit, if there is one.
+func (s *Server) limitFS(fs func(userID string) (sftpd.FS, error)) func(userID string) (sftpd.FS, error) {
+	sl := s.slots("download")
+	if sl == nil {
+		return fs
+	}
+	return func(userID string) (sftpd.FS, error) {
+		t, err := fs(userID)
+		if err != nil {
+			return nil, err
+		}
+		return limitedFS{FS: t, slots: sl}, nil
+	}
+}
+
+func (l limitedFS) Open(p string, offset int64) (io.ReadCloser, error) {
+	if err := l.slots.take(context.Background()); err != nil {
+		return nil, err
+	}
+	r, err := l.FS.Open(p, offset)
+	if err != nil {
+		l.slots.release()
+		return nil, err
+	}
+	return &slotReader{ReadCloser: r, release: l.slots.release}, nil
+}
+
+// slotReader gives its slot back when closed.
+type slotReader struct {
+	io.ReadCloser
+	release func()
+	closed  bool
+}
+
+func (r *slotReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.release()
+	}
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"SCloud/config"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first file descriptor systemd passes (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// ListenAndServe serves the API on LISTEN_ADDR, and the metrics and the
+// admin API on METRICS_ADDR and ADMIN_ADDR when those are set. The HTTP_*
+// connection caps only apply to the API's listeners. It returns the first
+// listener's failure.
+func (s *Server) ListenAndServe() error {
+	activated, err := activatedSockets()
+	if err != nil {
+		return err
+	}
+	api := s.Handler()
+	if len(s.Config.AdminAddrs) > 0 {
+		api = withoutAdmin(api)
+	}
+	surfaces := []struct {
+		name    string
+		addrs   []string
+		handler http.Handler
+	}{
+		{"api", s.Config.ListenAddrs, api},
+		{"metrics", s.Config.MetricsAddrs, http.HandlerFunc(s.metricsHandler)},
+		{"admin", s.Config.AdminAddrs, s.Handler()},
+	}
+
+	type served struct {
+		name    string
+		l       net.Listener
+		handler http.Handler
+	}
+	var all []served
+	fail := func(err error) error {
+		for _, sv := range all {
+			sv.l.Close()
+		}
+		for _, ls := range activated {
+			for _, l := range ls {
+				l.Close()
+			}
+		}
+		return err
+	}
+	for _, sf := range surfaces {
+		for _, addr := range sf.addrs {
+			if name, ok := strings.CutPrefix(addr, config.ActivatedPrefix); ok {
+				ls := activated[name]
+				if len(ls) == 0 {
+					return fail(fmt.Errorf("%s listener: systemd passed no socket named %q", sf.name, name))
+				}
+				delete(activated, name)
+				for _, l := range ls {
+					all = append(all, served{sf.name, l, sf.handler})
+				}
+				continue
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fail(fmt.Errorf("%s listener: %w", sf.name, err))
+			}
+			all = append(all, served{sf.name, l, sf.handler})
+		}
+	}
+	for name, ls := range activated {
+		s.Logger.Printf("closing %d systemd socket(s) named %q that no listener uses", len(ls), name)
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+
+	// one limiter for all of the API's listeners
+	limiter := &connLimiter{max: s.Config.HTTPMaxConns, perIP: s.Config.HTTPMaxConnsPerIP, byIP: map[string]int{}}
+	errc := make(chan error, len(all))
+	for _, sv := range all {
+		s.Logger.Printf("%s on %s", sv.name, sv.l.Addr())
+		var l net.Listener = trackingListener{sv.l}
+		if sv.name == "api" && (limiter.max > 0 || limiter.perIP > 0) {
+			l = limiter.on(sv.l)
+		}
+		go func() {
+			err := s.httpServer(sv.handler).Serve(l)
+			errc <- fmt.Errorf("%s listener %s: %w", sv.name, sv.l.Addr(), err)
+		}()
+	}
+	return <-errc
+}
+
+// withoutAdmin hides the admin API, for the public listener when ADMIN_ADDR
+// serves it.
+func withoutAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/admin" || strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// metricsHandler serves the Prometheus metrics at /metrics on METRICS_ADDR.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	writeMetrics(w, s.Config.MetricsTopUsers)
+}
+
+// activatedSockets takes the listening sockets systemd passed this process
+// (sd_listen_fds), by FileDescriptorName=; unnamed ones are "unknown", as
+// systemd calls them. The LISTEN_* variables are cleared so that programs
+// started later do not take them for theirs.
+func activatedSockets() (map[string][]net.Listener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.New("LISTEN_FDS: bad count " + strconv.Quote(fds))
+	}
+	nameOf := strings.Split(names, ":")
+	out := map[string][]net.Listener{}
+	for i := range n {
+		name := "unknown"
+		if i < len(nameOf) && nameOf[i] != "" {
+			name = nameOf[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ls := range out {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("systemd socket %d (%s): %w", listenFDsStart+i, name, err)
+		}
+		out[name] = append(out[name], l)
+	}
+	return out, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// localize translates error responses into the client's Accept-Language,
+// and answers them as {"error", "code", "locale"} when the client accepts
+// JSON: code is the untranslated message the error was made from, stable
+// across languages for frontends to key on. Other responses, and errors
+// that are neither text nor JSON, pass as they are.
+func (s *Server) localize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		msgs := s.Config.Messages
+		if msgs == nil {
+			c.Next()
+			return
+		}
+		lang := msgs.Negotiate(c.GetHeader("Accept-Language"))
+		envelope := acceptsJSON(c.GetHeader("Accept"))
+		c.Header("Vary", "Accept-Language")
+		if lang == "en" && !envelope {
+			c.Next()
+			return
+		}
+		w := &localizeWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		if !w.held {
+			return
+		}
+
+		h := w.ResponseWriter.Header()
+		ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		body := map[string]any{}
+		var msg string
+		switch {
+		case len(w.buf) == 0:
+			msg = http.StatusText(w.status)
+		case ct == "text/plain":
+			msg = string(w.buf)
+		case ct == "application/json" && json.Unmarshal(w.buf, &body) == nil:
+			msg, _ = body["error"].(string)
+		}
+		if msg == "" {
+			w.send(w.buf)
+			return
+		}
+		text, key := msgs.Translate(lang, msg)
+		h.Set("Content-Language", lang)
+		if len(w.buf) > 0 && ct == "text/plain" && !envelope {
+			w.send([]byte(text))
+			return
+		}
+		if len(w.buf) == 0 && !envelope {
+			w.send(nil)
+			return
+		}
+		body["error"], body["locale"] = text, lang
+		if key != "" {
+			body["code"] = key
+		}
+		out, _ := json.Marshal(body)
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		w.send(out)
+	}
+}
+
+// acceptsJSON reports whether an Accept header names application/json.
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && t == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// localizeWriter holds back error responses until they are translated;
+// anything below 400 goes straight through.
+type localizeWriter struct {
+	gin.ResponseWriter
+	status  int
+	held    bool
+	written bool // what a held response has of a header and body
+	buf     []byte
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *localizeWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *localizeWriter) WriteHeader(code int) {
+	w.status = code
+	if code >= http.StatusBadRequest {
+		w.held = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *localizeWriter) WriteHeaderNow() {
+	if w.held {
+		w.written = true
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *localizeWriter) Status() int {
+	if w.held {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *localizeWriter) Written() bool {
+	if w.held {
+		return w.written
+	}
+	return w.ResponseWriter.Written()
+}
+
+func (w *localizeWriter) Size() int {
+	if w.held {
+		return len(w.buf)
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *localizeWriter) Write(p []byte) (int, error) {
+	if w.held {
+		w.written = true
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *localizeWriter) WriteString(s string) (int, error) { return w.Write([]byte(s)) }
+
+func (w *localizeWriter) Flush() {
+	if !w.held {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// send writes the held response with body in place of what was written.
+func (w *localizeWriter) send(body []byte) {
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.WriteHeaderNow()
+	if len(body) > 0 {
+		w.ResponseWriter.Write(body)
+	}
+}
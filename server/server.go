@@ -0,0 +1,705 @@
+package server
+
+import (
+	"SCloud/alerts"
+	"SCloud/audit"
+	"SCloud/auth"
+	"SCloud/config"
+	"SCloud/coord"
+	"SCloud/db"
+	"SCloud/egress"
+	"SCloud/extract"
+	"SCloud/handlers"
+	"SCloud/jobs"
+	"SCloud/mail"
+	"SCloud/metering"
+	"SCloud/preview"
+	"SCloud/progress"
+	"SCloud/stats"
+	"SCloud/storage"
+	"SCloud/store"
+	"SCloud/transcode"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is one SCloud instance: its config, persistence and logger, and the
+// auth and file handlers built on them. Nothing here reads the environment;
+// that is config.LoadConfig's job.
+type Server struct {
+	Config *config.Config
+	Stores store.Stores
+	Logger *log.Logger
+	DB     *db.DB // only set for the postgres backend; used by /health
+
+	Auth     *auth.Service
+	Handlers *handlers.Handlers
+	Jobs     *jobs.Runner
+	Schedule *jobs.Scheduler
+	Mail     *mail.Mailer
+	Alerts   *alerts.Alerts
+	Meter    *metering.Meter
+	Audit    *audit.Chain // Stores.Audit, chaining every event
+
+	handlerOnce sync.Once
+	handler     http.Handler
+	closers     []func()
+
+	slotsMu    sync.Mutex
+	classSlots map[string]*classSlots // CONCURRENCY_LIMITS, by class
+}
+
+// lockConns bounds the pool COORDINATION=postgres holds its advisory locks
+// on, apart from the store's
+const lockConns = 8
+
+// New opens the persistence backend selected by cfg.StoreBackend and builds
+// a server on it. Call Close when done.
+func New(cfg *config.Config) (*Server, error) {
+	egress.Configure(cfg)
+	dirs := []string{cfg.BaseDir}
+	for _, d := range cfg.Roots {
+		dirs = append(dirs, d)
+	}
+	for _, d := range dirs {
+		if err := storage.SelfCheck(cfg.MasterKey, d); err != nil {
+			if !errors.Is(err, storage.ErrNotWritable) || !cfg.ReadOnly {
+				if errors.Is(err, storage.ErrNotWritable) {
+					err = fmt.Errorf("%w (set READ_ONLY=true to serve it read-only)", err)
+				}
+				return nil, fmt.Errorf("self-check %s: %w", d, err)
+			}
+			log.Printf("self-check %s: %v; serving read-only", d, err)
+		}
+	}
+
+	stores, d, closers, err := OpenStores(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var locker coord.Locker
+	switch {
+	case cfg.Coordination == "postgres":
+		ld, err := db.Connect(context.Background(), db.Options{
+			DSN:      cfg.DatabaseURL,
+			Password: cfg.DatabasePassword.Value,
+			MaxConns: lockConns,
+			Retries:  cfg.DBConnectRetries,
+		})
+		if err != nil {
+			for _, c := range closers {
+				c()
+			}
+			return nil, fmt.Errorf("COORDINATION: %w", err)
+		}
+		locker = &coord.Postgres{Pool: ld.Pool()}
+		closers = append(closers, ld.Close)
+	case strings.HasPrefix(cfg.Coordination, "redis://"):
+		r, err := coord.NewRedis(cfg.Coordination)
+		if err != nil {
+			for _, c := range closers {
+				c()
+			}
+			return nil, fmt.Errorf("COORDINATION: %w", err)
+		}
+		locker = r
+		closers = append(closers, func() { r.Close() })
+	}
+
+	s := NewWithStores(cfg, stores, nil)
+	s.DB = d
+	s.closers = closers
+	if locker != nil {
+		storage.SetLocker(locker)
+		s.Jobs.Locker = locker
+		s.Auth.Claims = locker.(coord.Claimer)
+	}
+	if err := s.corsConfig().Validate(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("CORS_ORIGINS: %w", err)
+	}
+	return s, nil
+}
+
+// OpenStores opens the persistence backend selected by cfg.StoreBackend.
+// d is only set for postgres; run the closers when done.
+func OpenStores(cfg *config.Config) (stores store.Stores, d *db.DB, closers []func(), err error) {
+	switch cfg.StoreBackend {
+	case "", "memory":
+		stores = store.NewMemoryStores()
+	case "sqlite":
+		sdb, err := store.OpenSQLite(cfg.SQLitePath)
+		if err != nil {
+			return stores, nil, nil, fmt.Errorf("open SQLite database: %w", err)
+		}
+		closers = append(closers, func() { sdb.Close() })
+		stores = store.NewSQLiteStores(sdb)
+	case "postgres":
+		d, err = db.Connect(context.Background(), db.Options{
+			DSN:      cfg.DatabaseURL,
+			Password: cfg.DatabasePassword.Value,
+			MaxConns: cfg.DBMaxConns,
+			Retries:  cfg.DBConnectRetries,
+		})
+		if err != nil {
+			return stores, nil, nil, fmt.Errorf("connect to database: %w", err)
+		}
+		closers = append(closers, d.Close)
+		if err := store.Migrate(context.Background(), d); err != nil {
+			d.Close()
+			return stores, nil, nil, fmt.Errorf("migrate database: %w", err)
+		}
+		stores = store.NewPostgresStores(d)
+	default:
+		return stores, nil, nil, fmt.Errorf("unknown store backend %q", cfg.StoreBackend)
+	}
+	return stores, d, closers, nil
+}
+
+// NewWithStores assembles a server around already-opened stores.
+// A nil logger means log.Default().
+func NewWithStores(cfg *config.Config, stores store.Stores, logger *log.Logger) *Server {
+	if logger == nil {
+		logger = log.Default()
+	}
+	chain := audit.NewChain(stores.Audit, audit.Key(cfg))
+	stores.Audit = chain
+	s := &Server{
+		Config: cfg,
+		Stores: stores,
+		Logger: logger,
+		Auth:   auth.New(cfg, stores, logger),
+		Jobs:   jobs.New(stores.Jobs),
+		Audit:  chain,
+	}
+	s.Schedule = jobs.NewScheduler(s.Jobs, logger)
+	s.Mail = mail.New(cfg, s.Jobs, logger)
+	s.Auth.Mail = s.Mail
+	s.Alerts = alerts.New(cfg, s.Mail, logger)
+	s.Auth.Alerts = s.Alerts
+	s.Meter = metering.New(stores.Usage, cfg.UsageWebhook, logger)
+	s.Jobs.OnFail = func(j jobs.Job) {
+		// a failing mail job cannot mail about itself
+		if j.Name != "mail" {
+			s.Mail.Alert("job "+j.Name+" failed", j.ID+": "+j.Error)
+		}
+	}
+	s.Handlers = &handlers.Handlers{
+		Cfg:       cfg,
+		Stores:    stores,
+		Auth:      s.Auth,
+		Jobs:      s.Jobs,
+		Schedule:  s.Schedule,
+		Mail:      s.Mail,
+		Extract:   extract.New(cfg, s.Jobs, logger),
+		Preview:   preview.New(cfg, s.Jobs, logger),
+		Transcode: transcode.New(cfg, s.Jobs, logger),
+		Alerts:    s.Alerts,
+		Meter:     s.Meter,
+		Progress:  progress.New(),
+		Log:       logger,
+	}
+	s.scheduleTasks()
+	return s
+}
+
+// Handler returns the server's HTTP handler, building the router on first use.
+// Wrap it for custom middleware or hand it to httptest.NewServer.
+func (s *Server) Handler() http.Handler {
+	s.handlerOnce.Do(func() {
+		router := gin.New()
+		// ClientIP() only honours forwarding headers from these proxies;
+		// LoadConfig has already validated the list
+		router.RemoteIPHeaders = s.Config.RemoteIPHeaders
+		if err := router.SetTrustedProxies(s.Config.TrustedProxies); err != nil {
+			s.Logger.Printf("trusted proxies: %v", err)
+		}
+		router.MaxMultipartMemory = s.Config.UploadMemory
+		router.Use(gin.Logger(), gin.Recovery())
+		s.Routes(router)
+
+		if s.Config.FrontendDir != "" {
+			router.NoRoute(s.frontendHandler)
+		}
+		s.handler = router
+	})
+	return s.handler
+}
+
+// StartBackground launches the maintenance scheduler and the periodic
+// loops (disk space checks, usage metering, the audit export and secret
+// reloads), and the debug, SFTP and FTP listeners when DEBUG_ADDR, SFTP_ADDR
+// and FTP_ADDR are set.
+func (s *Server) StartBackground() {
+	if s.Config.DebugAddr != "" {
+		go s.serveDebug(s.Config.DebugAddr)
+	}
+	if s.Config.SFTPAddr != "" {
+		go s.serveSFTP(s.Config.SFTPAddr)
+	}
+	if s.Config.FTPAddr != "" {
+		go s.serveFTP(s.Config.FTPAddr)
+	}
+	if !s.Config.ReadOnly && s.Config.HeartbeatInterval > 0 {
+		go s.heartbeat(s.Config.HeartbeatInterval)
+	}
+	go s.Schedule.Run()
+	go s.meterUsage(time.Minute, s.Config.UsageSampleInterval)
+	if len(s.Config.DiskAlerts) > 0 {
+		go s.watchDisk(s.Config.DiskCheckInterval)
+	}
+	if e := audit.NewExporter(s.Config, s.Stores.Audit, s.Logger); len(e.Sinks) > 0 && !s.Config.ReadOnly {
+		go e.Run(s.Config.AuditExportInterval)
+	}
+	if s.Config.SecretReloadInterval > 0 {
+		go s.reloadSecrets(s.Config.SecretReloadInterval)
+	}
+}
+
+// scheduleTasks registers the maintenance tasks on their SCHEDULE_*
+// schedules. A read-only server lists the ones that write as off.
+func (s *Server) scheduleTasks() {
+	h := s.Handlers
+	for _, t := range []struct {
+		name   string
+		fn     jobs.Func
+		writes bool
+	}{
+		{"gc", h.GCJob, true},
+		{"scrub", h.ScrubJob, false},
+		{"backup", h.ScheduledBackupJob, false},
+		{"retention", h.RetentionJob, true},
+		{"sessions", s.sweepSessions, false},
+		{"audit_anchor", s.anchorAudit, true},
+	} {
+		spec := s.Config.Schedules[t.name]
+		if t.writes && s.Config.ReadOnly {
+			spec = nil
+		}
+		s.Schedule.Add(t.name, spec, t.fn)
+	}
+}
+
+// sweepSessions drops expired sessions and locks, and link accesses older
+// than LINK_ACCESS_RETENTION.
+func (s *Server) sweepSessions(jobs.Progress) (any, error) {
+	ctx, now := context.Background(), time.Now()
+	var removed struct {
+		Sessions     int `json:"sessions"`
+		Locks        int `json:"locks"`
+		LinkAccesses int `json:"link_accesses"`
+	}
+	var errs []error
+	var err error
+	if removed.Sessions, err = s.Stores.Sessions.DeleteExpired(ctx, now); err != nil {
+		errs = append(errs, fmt.Errorf("sessions: %w", err))
+	}
+	if removed.Locks, err = s.Stores.Locks.DeleteExpired(ctx, now); err != nil {
+		errs = append(errs, fmt.Errorf("locks: %w", err))
+	}
+	if keep := s.Config.LinkAccessRetention; keep > 0 {
+		if removed.LinkAccesses, err = s.Stores.Links.DeleteBefore(ctx, now.Add(-keep)); err != nil {
+			errs = append(errs, fmt.Errorf("link accesses: %w", err))
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// anchorAudit records the head of the audit chain in the chain and the
+// server log, both of which the export carries off the host.
+func (s *Server) anchorAudit(jobs.Progress) (any, error) {
+	a, err := s.Audit.Anchor(context.Background())
+	if err != nil || a == nil {
+		return nil, err
+	}
+	s.Logger.Printf("audit anchor %s", a.Detail)
+	return gin.H{"anchor": a.Detail, "seq": a.Seq}, nil
+}
+
+// storeDirs lists the main store and the named roots.
+func (s *Server) storeDirs() []string {
+	dirs := []string{s.Config.BaseDir}
+	for _, name := range slices.Sorted(maps.Keys(s.Config.Roots)) {
+		dirs = append(dirs, s.Config.Roots[name])
+	}
+	return dirs
+}
+
+// heartbeat stamps the time into every store for replicas to measure their
+// lag against.
+func (s *Server) heartbeat(interval time.Duration) {
+	for {
+		for _, dir := range s.storeDirs() {
+			if err := storage.WriteHeartbeat(dir, time.Now()); err != nil {
+				s.Logger.Printf("heartbeat %s: %v", dir, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// reloadSecrets picks up secrets rotated in their files or in Vault.
+func (s *Server) reloadSecrets(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.Config.ReloadSecrets(s.Logger)
+	}
+}
+
+// replicaLag is how far the oldest replicated store trails the primary, by
+// the heartbeat it last copied.
+func (s *Server) replicaLag() (time.Duration, error) {
+	var lag time.Duration
+	for _, dir := range s.storeDirs() {
+		t, err := storage.ReadHeartbeat(dir)
+		if err != nil {
+			return 0, fmt.Errorf("no heartbeat in %s (is HEARTBEAT_INTERVAL set on the primary?): %w", dir, err)
+		}
+		lag = max(lag, time.Since(t))
+	}
+	return lag, nil
+}
+
+// watchDisk feeds the free space of the disks holding the store and its
+// volumes to the disk alerts.
+func (s *Server) watchDisk(interval time.Duration) {
+	dirs := []string{s.Config.BaseDir}
+	for _, name := range slices.Sorted(maps.Keys(s.Config.Volumes)) {
+		dirs = append(dirs, s.Config.Volumes[name])
+	}
+	failing := map[string]bool{}
+	for {
+		for _, dir := range dirs {
+			total, free, err := storage.DiskSpace(dir)
+			if err != nil {
+				// keep checking: a volume may be back after a remount
+				if !failing[dir] {
+					s.Logger.Printf("disk check %s: %v", dir, err)
+				}
+				failing[dir] = true
+				continue
+			}
+			delete(failing, dir)
+			s.Alerts.CheckDisk(dir, total, free)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// meterUsage flushes the transfer counters every flushEvery and samples
+// per-user storage every sampleEvery, as a "usage-sample" job.
+func (s *Server) meterUsage(flushEvery, sampleEvery time.Duration) {
+	next := time.Now()
+	for {
+		if err := s.Meter.Flush(context.Background()); err != nil {
+			s.Logger.Printf("usage flush: %v", err)
+		}
+		if !time.Now().Before(next) {
+			next = time.Now().Add(sampleEvery)
+			_, err := s.Jobs.Start("usage-sample", s.Handlers.SampleUsageJob)
+			if err != nil && !errors.Is(err, jobs.ErrRunning) {
+				s.Logger.Printf("usage sample: %v", err)
+			}
+		}
+		time.Sleep(flushEvery)
+	}
+}
+
+// Close releases what New opened.
+func (s *Server) Close() {
+	if err := s.Meter.Flush(context.Background()); err != nil {
+		s.Logger.Printf("usage flush: %v", err)
+	}
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
+
+func (s *Server) healthHandler(c *gin.Context) {
+	if s.Config.ReplicaOf != "" && s.Config.ReplicaMaxLag > 0 {
+		lag, err := s.replicaLag()
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, "Replica lag unknown: %v", err)
+			return
+		}
+		if lag > s.Config.ReplicaMaxLag {
+			c.String(http.StatusServiceUnavailable, "Replica %v behind the primary", lag.Round(time.Second))
+			return
+		}
+	}
+	if s.DB.Enabled() {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		defer cancel()
+		if err := s.DB.Ping(ctx); err != nil {
+			c.String(http.StatusServiceUnavailable, "DB unavailable: %v", err)
+			return
+		}
+	}
+	c.String(http.StatusOK, "OK")
+}
+
+func (s *Server) corsConfig() cors.Config {
+	return cors.Config{
+		AllowOrigins:     s.Config.CORSOrigins,
+		AllowWildcard:    true,
+		AllowMethods:     []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodHead, http.MethodDelete, http.MethodOptions},
+		AllowHeaders:     []string{"Origin", "Content-Type", "X-XSRF-TOKEN", "X-CSRF-TOKEN", "Accept", "Origin", "X-Requested-With", "Authorization", "X-Content-SHA256", "Lock-Token"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "ETag", "Last-Modified", "Accept-Ranges", "X-Encryption", "X-Checksum-MD5", "X-Checksum-SHA1", "Lock-Token", "X-Manifest-Signature"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}
+}
+
+// rootScope switches file routes to a named storage root (STORAGE_ROOTS)
+// when ?root= is set. Roots are shared trees like the main one, so the
+// usual checks apply; they do not combine with ?org=.
+func (s *Server) rootScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		root := c.Query("root")
+		if root == "" {
+			return
+		}
+		if _, ok := s.Config.Roots[root]; !ok {
+			c.String(http.StatusNotFound, "No such storage root")
+			c.Abort()
+			return
+		}
+		if c.GetString("org") != "" {
+			c.String(http.StatusBadRequest, "root and org are exclusive")
+			c.Abort()
+			return
+		}
+		c.Set("root", root)
+	}
+}
+
+// readOnlyGuard turns away requests that would change the store when it is
+// served read-only.
+func (s *Server) readOnlyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if s.Config.ReplicaOf != "" {
+			c.Header("X-SCloud-Primary", s.Config.ReplicaOf)
+			c.String(http.StatusServiceUnavailable, "Server is a read-only replica; send changes to %s", s.Config.ReplicaOf)
+			c.Abort()
+		} else if s.Config.ReadOnly {
+			c.String(http.StatusServiceUnavailable, "Server is read-only")
+			c.Abort()
+		}
+	}
+}
+
+// Routes registers the health check, CORS and the /api tree on router.
+func (s *Server) Routes(router *gin.Engine) {
+	a, h := s.Auth, s.Handlers
+	// CONCURRENCY_LIMITS, each shared by all the routes of its class
+	uploads, downloads := s.limit("upload"), s.limit("download")
+
+	router.GET("/health", s.healthHandler)
+
+	router.Use(cors.New(s.corsConfig()))
+
+	// public folders: no session, served as their owner
+	router.GET("/pub/:slug/*path", downloads, h.PublicHandler)
+	router.HEAD("/pub/:slug/*path", h.PublicHandler)
+
+	// SCIM provisioning for identity providers, on a bearer token
+	scimGroup := router.Group("/scim/v2", a.WatchFailures(), a.SCIMAuth(), s.readOnlyGuard())
+	{
+		scimGroup.GET("/Users", a.SCIMListUsersHandler)
+		scimGroup.POST("/Users", a.SCIMCreateUserHandler)
+		scimGroup.GET("/Users/:id", a.SCIMGetUserHandler)
+		scimGroup.PUT("/Users/:id", a.SCIMReplaceUserHandler)
+		scimGroup.PATCH("/Users/:id", a.SCIMPatchUserHandler)
+		scimGroup.DELETE("/Users/:id", a.SCIMDeleteUserHandler)
+		scimGroup.GET("/Groups", a.SCIMListGroupsHandler)
+		scimGroup.POST("/Groups", a.SCIMCreateGroupHandler)
+		scimGroup.GET("/Groups/:id", a.SCIMGetGroupHandler)
+		scimGroup.PATCH("/Groups/:id", a.SCIMPatchGroupHandler)
+	}
+
+	apiGroup := router.Group("/api")
+	apiGroup.Use(s.compress(), s.localize(), a.WatchFailures(), a.VerifySignature())
+	{
+		filesGroup := apiGroup.Group("/files")
+		filesGroup.Use(a.Authorize(), a.CSRF(), a.OrgScope(), s.rootScope(), s.readOnlyGuard())
+		{
+			filesGroup.POST("/upload", uploads, handlers.CountFailures(stats.Upload), h.UploadHandler)
+			filesGroup.PUT("/uploadchunked", uploads, handlers.CountFailures(stats.Upload), h.ChunkedUploadHandler)
+			filesGroup.PUT("/upload", uploads, handlers.CountFailures(stats.Upload), h.ResumableUploadHandler)
+			filesGroup.GET("/upload/status", h.UploadStatusHandler)
+			filesGroup.GET("/download", downloads, handlers.CountFailures(stats.Download), h.DownloadHandler)
+			filesGroup.HEAD("/download", h.DownloadHandler)
+			filesGroup.DELETE("/delete", h.DeleteHandler)
+			filesGroup.GET("/ls", h.ListHandler)
+			filesGroup.GET("/manifest", h.ManifestHandler)
+			filesGroup.POST("/lock", h.LockHandler)
+			filesGroup.GET("/lock", h.LockInfoHandler)
+			filesGroup.DELETE("/lock", h.UnlockHandler)
+			filesGroup.POST("/precheck", h.PrecheckHandler)
+			filesGroup.POST("/public", h.PublishHandler)
+			filesGroup.GET("/public", h.ListPublishedHandler)
+			filesGroup.DELETE("/public", h.UnpublishHandler)
+			filesGroup.POST("/drop", h.CreateDropHandler)
+			filesGroup.GET("/drop", h.ListDropsHandler)
+			filesGroup.DELETE("/drop", h.DeleteDropHandler)
+			filesGroup.GET("/searchcontent", h.SearchContentHandler)
+			filesGroup.GET("/preview", downloads, h.PreviewHandler)
+			filesGroup.GET("/stream", downloads, h.StreamHandler)
+			filesGroup.HEAD("/stream", h.StreamHandler)
+			filesGroup.GET("/thumbnail", downloads, h.ThumbnailHandler)
+			filesGroup.GET("/renditionlink", h.RenditionLinkHandler)
+			filesGroup.PATCH("/meta", h.MetaHandler)
+			filesGroup.GET("/du", h.DiskUsageHandler)
+			filesGroup.GET("/quota", h.QuotaHandler)
+			filesGroup.GET("/expiring", h.ExpiringHandler)
+			filesGroup.GET("/progress", h.ProgressHandler)
+			filesGroup.POST("/append", uploads, handlers.CountFailures(stats.Upload), h.AppendHandler)
+			filesGroup.POST("/compose", uploads, handlers.CountFailures(stats.Upload), h.ComposeHandler)
+			filesGroup.PATCH("/patch", uploads, handlers.CountFailures(stats.Upload), h.PatchHandler)
+			filesGroup.GET("/signature", downloads, h.SignatureHandler)
+			filesGroup.GET("/hash", downloads, h.HashHandler)
+			filesGroup.POST("/delta", uploads, handlers.CountFailures(stats.Upload), h.DeltaHandler)
+			filesGroup.POST("/snapshot", h.SnapshotHandler)
+			filesGroup.GET("/snapshots", h.ListSnapshotsHandler)
+			filesGroup.POST("/snapshot/restore", h.RestoreSnapshotHandler)
+			filesGroup.DELETE("/snapshot", h.DeleteSnapshotHandler)
+			filesGroup.POST("/folderkey", h.EnableFolderKeyHandler)
+			filesGroup.GET("/folderkey", h.FolderKeyHandler)
+		}
+
+		// drop folders: uploads without a session, stored as the folder's owner
+		dropGroup := apiGroup.Group("/drop")
+		{
+			dropGroup.GET("/:slug", h.DropInfoHandler)
+			dropGroup.POST("/:slug", s.readOnlyGuard(), uploads, handlers.CountFailures(stats.Upload), h.DropUploadHandler)
+		}
+
+		accountGroup := apiGroup.Group("/account")
+		accountGroup.Use(a.Authorize(), a.CSRF())
+		{
+			accountGroup.GET("/usage", h.AccountUsageHandler)
+		}
+
+		photosGroup := apiGroup.Group("/photos")
+		photosGroup.Use(a.Authorize(), a.CSRF(), a.OrgScope(), s.rootScope())
+		{
+			photosGroup.GET("/timeline", h.TimelineHandler)
+		}
+
+		// the mount API only reads, so replicas serve it too
+		mountGroup := apiGroup.Group("/fs")
+		{
+			session := mountGroup.Group("", a.Authorize(), a.CSRF(), a.OrgScope(), s.rootScope())
+			session.POST("/stat", h.MountStatHandler)
+			session.GET("/readdir", h.MountReaddirHandler)
+			session.POST("/open", h.MountOpenHandler)
+			session.POST("/close", h.MountCloseHandler)
+			// reads carry the handle's token instead of a session
+			mountGroup.GET("/read/:handle", downloads, h.MountReadHandler)
+		}
+
+		// mutations refuse on a read-only server themselves, so queries still run
+		apiGroup.POST("/graphql", a.Authorize(), a.CSRF(), a.OrgScope(), s.rootScope(), downloads, h.GraphQLHandler)
+
+		orgsGroup := apiGroup.Group("/orgs")
+		orgsGroup.Use(a.Authorize(), a.CSRF(), s.readOnlyGuard())
+		{
+			orgsGroup.POST("", a.CreateOrgHandler)
+			orgsGroup.GET("", a.ListOrgsHandler)
+			orgsGroup.POST("/:id/members", a.AddMemberHandler)
+			orgsGroup.DELETE("/:id/members/:userid", a.RemoveMemberHandler)
+		}
+
+		adminGroup := apiGroup.Group("/admin")
+		adminGroup.Use(a.Authorize(), a.CSRF(), auth.RequireAdmin(), s.readOnlyGuard())
+		{
+			adminGroup.GET("/stats", h.AdminStatsHandler)
+			adminGroup.GET("/backups", h.BackupsHandler)
+			adminGroup.GET("/jobs", h.ListJobsHandler)
+			adminGroup.GET("/usage", h.UsageHandler)
+			// pprof and expvar, e.g. go tool pprof with the session cookie
+			adminGroup.GET("/debug/*any", gin.WrapH(http.StripPrefix("/api/admin", s.debugMux())))
+			adminGroup.GET("/jobs/:id", h.JobStatusHandler)
+			adminGroup.GET("/schedule", h.ScheduleHandler)
+			adminGroup.POST("/jobs/:name", h.StartJobHandler)
+			adminGroup.GET("/quarantine", h.ListQuarantinedHandler)
+			adminGroup.POST("/quarantine", h.QuarantineHandler)
+			adminGroup.POST("/quarantine/release", h.ReleaseQuarantineHandler)
+			adminGroup.POST("/quarantine/purge", h.PurgeQuarantinedHandler)
+			adminGroup.GET("/audit", h.AuditLogHandler)
+			adminGroup.GET("/audit/verify", h.VerifyAuditHandler)
+			adminGroup.GET("/honeytokens", h.ListHoneytokensHandler)
+			adminGroup.POST("/honeytokens", h.PlantHoneytokenHandler)
+			adminGroup.DELETE("/honeytokens", h.RemoveHoneytokenHandler)
+			adminGroup.GET("/reports", h.ListReportsHandler)
+			adminGroup.POST("/reports/:id", h.ReviewReportHandler)
+			adminGroup.POST("/users/:id/unlock", a.UnlockUserHandler)
+			adminGroup.GET("/users/:id/purge-policy", h.PurgePolicyHandler)
+			adminGroup.POST("/users/:id/purge-policy", h.SetPurgePolicyHandler)
+		}
+
+		authGroup := apiGroup.Group("/auth")
+		{
+			authGroup.POST("/register", a.RegisterHandler)
+			authGroup.POST("/login", a.LoginHandler)
+			authGroup.GET("/saml/metadata", a.SAMLMetadataHandler)
+			authGroup.GET("/saml/login", a.SAMLLoginHandler)
+			authGroup.POST("/saml/acs", a.SAMLACSHandler)
+			authGroup.GET("/saml/finish", a.SAMLFinishHandler)
+			authGroup.POST("/password", a.Authorize(), a.CSRF(), a.ChangePasswordHandler)
+			authGroup.POST("/reauth", a.ReauthHandler)
+			authGroup.POST("/image-metadata", a.Authorize(), a.CSRF(), a.ImageMetadataHandler)
+			authGroup.POST("/recover", a.RecoverHandler)
+			authGroup.POST("/reset-request", a.ResetRequestHandler)
+			authGroup.POST("/reset", a.ResetPasswordHandler)
+			authGroup.GET("/verify-email", a.VerifyEmailHandler)
+			authGroup.POST("/verify-email", a.Authorize(), a.CSRF(), a.ResendVerificationHandler)
+			authGroup.GET("/recovery-codes", a.Authorize(), a.RecoveryCodesHandler)
+			authGroup.POST("/recovery-codes", a.Authorize(), a.CSRF(), a.NewRecoveryCodesHandler)
+			authGroup.GET("/devices", a.Authorize(), a.ListDevicesHandler)
+			authGroup.POST("/devices/:id/trust", a.Authorize(), a.CSRF(), a.TrustDeviceHandler)
+			authGroup.DELETE("/devices/:id", a.Authorize(), a.CSRF(), a.RevokeDeviceHandler)
+			authGroup.GET("/keys", a.Authorize(), a.ListAPIKeysHandler)
+			authGroup.POST("/keys", a.Authorize(), a.CSRF(), s.readOnlyGuard(), a.CreateAPIKeyHandler)
+			authGroup.DELETE("/keys/:id", a.Authorize(), a.CSRF(), s.readOnlyGuard(), a.RevokeAPIKeyHandler)
+			//Signed download handler
+			authGroup.GET("/genDLink", a.Authorize(), a.GenerateDownloadLink)
+			authGroup.GET("/checksession", a.SessionCheckHandler)
+		}
+
+		// public halves of the keys sync manifests are signed with
+		apiGroup.GET("/manifest/keys", a.ManifestKeysHandler)
+
+		downloadGroup := apiGroup.Group("/dlink")
+		{
+			downloadGroup.GET("/generateLink", a.Authorize(), a.GenerateDownloadLink)
+			downloadGroup.GET("/download", downloads, handlers.CountFailures(stats.Download), h.SignedDownloadHandler)
+			downloadGroup.HEAD("/download", h.SignedDownloadHandler)
+			downloadGroup.GET("/rendition", downloads, h.SignedRenditionHandler)
+			downloadGroup.HEAD("/rendition", h.SignedRenditionHandler)
+			downloadGroup.GET("/links/:id/accesses", a.Authorize(), h.LinkAccessesHandler)
+			downloadGroup.POST("/report", s.readOnlyGuard(), h.ReportLinkHandler)
+		}
+
+	}
+
+	apiGroup.OPTIONS("/*path", func(c *gin.Context) {
+		c.Status(204)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"SCloud/sftpd"
+	"context"
+	"net"
+)
+
+// remoteLogin checks the email and password of an SFTP or FTP login.
+func (s *Server) remoteLogin(proto string) func(user, password string, remote net.Addr) (string, error) {
+	return func(user, password string, remote net.Addr) (string, error) {
+		u, err := s.Auth.CheckPassword(context.Background(), user, password)
+		if err != nil {
+			return "", err
+		}
+		s.Logger.Printf("%s: %s signed in from %s", proto, user, remote)
+		return u.UserID, nil
+	}
+}
+
+// serveSFTP runs the SFTP listener (SFTP_ADDR). Logins are the accounts'
+// emails and passwords.
+func (s *Server) serveSFTP(addr string) {
+	key, err := sftpd.LoadHostKey(s.Config.SFTPHostKey)
+	if err != nil {
+		s.Logger.Printf("sftp host key: %v", err)
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.Logger.Printf("sftp listener: %v", err)
+		return
+	}
+	srv := &sftpd.Server{
+		HostKey:  key,
+		Password: s.remoteLogin("sftp"),
+		FS:       s.limitFS(s.Handlers.SFTPTree),
+		Log:      s.Logger,
+	}
+	s.Logger.Printf("sftp on %s", addr)
+	if err := srv.Serve(l); err != nil {
+		s.Logger.Printf("sftp listener: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"hash"
+	"io"
+	"strings"
+)
+
+// runCommand runs an exec request. There is no shell: only what rclone's
+// sftp backend runs beside SFTP is understood, namely the echo it probes the
+// shell with and md5sum/sha1sum, with which it checks hashes. Other commands
+// fail as missing ones would. It returns the exit status.
+func runCommand(ch ssh.Channel, tree FS, line string) uint32 {
+	args, ok := splitWords(line)
+	if !ok || len(args) == 0 {
+		fmt.Fprintln(ch.Stderr(), "syntax error")
+		return 2
+	}
+	switch args[0] {
+	case "echo":
+		fmt.Fprintln(ch, strings.Join(args[1:], " "))
+		return 0
+	case "md5sum", "sha1sum":
+		algo := strings.TrimSuffix(args[0], "sum")
+		if len(args) == 1 {
+			// the sum of stdin, which is how clients check the command works
+			var h hash.Hash = md5.New()
+			if algo == "sha1" {
+				h = sha1.New()
+			}
+			io.Copy(h, ch)
+			fmt.Fprintf(ch, "%x  -\n", h.Sum(nil))
+			return 0
+		}
+		var status uint32
+		for _, p := range args[1:] {
+			sum, err := tree.Hash(cleanPath(p), algo)
+			if err != nil {
+				fmt.Fprintf(ch.Stderr(), "%s: %s: %v\n", args[0], p, err)
+				status = 1
+				continue
+			}
+			fmt.Fprintf(ch, "%s  %s\n", sum, p)
+		}
+		return status
+	}
+	fmt.Fprintf(ch.Stderr(), "%s: command not found\n", args[0])
+	return 127
+}
+
+// splitWords splits a command line as a POSIX shell with an empty
+// environment would: quotes and backslashes are honoured and variables
+// expand to nothing. Nothing else (globs, pipes, substitutions) is special.
+// It fails on an unterminated quote.
+func splitWords(line string) ([]string, bool) {
+	var words []string
+	var w strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch c {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+			continue
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				w.WriteByte(line[i])
+			}
+		case '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			w.WriteString(line[i+1 : i+1+j])
+			i += j + 1
+		case '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$\"\\`", line[i+1]) >= 0:
+					i++
+					w.WriteByte(line[i])
+				case line[i] == '$':
+					end, ok := varEnd(line, i)
+					if !ok {
+						return nil, false
+					}
+					if end == i+1 {
+						w.WriteByte('$')
+					}
+					i = end - 1
+				default:
+					w.WriteByte(line[i])
+				}
+			}
+			if i == len(line) {
+				return nil, false
+			}
+		case '$':
+			end, ok := varEnd(line, i)
+			if !ok {
+				return nil, false
+			}
+			if end == i+1 {
+				w.WriteByte('$')
+			}
+			i = end - 1
+		default:
+			w.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, true
+}
+
+// varEnd returns where the variable reference at line[i] ends; i+1 when
+// the "$" starts none and is taken literally.
+func varEnd(line string, i int) (int, bool) {
+	if i+1 < len(line) && line[i+1] == '{' {
+		j := strings.IndexByte(line[i:], '}')
+		return i + j + 1, j >= 0
+	}
+	j := i + 1
+	for j < len(line) && (line[j] == '_' || 'a' <= line[j] && line[j] <= 'z' || 'A' <= line[j] && line[j] <= 'Z' || '0' <= line[j] && line[j] <= '9') {
+		j++
+	}
+	return j, true
+}
@@ -0,0 +1,461 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), the version every common
+// client speaks.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+
+	flagRead   = 0x01
+	flagWrite  = 0x02
+	flagAppend = 0x04
+	flagExcl   = 0x20
+
+	attrSize   = 0x01
+	attrUIDGID = 0x02
+	attrPerms  = 0x04
+	attrTimes  = 0x08
+
+	// the largest packet accepted, and the most a READ returns
+	maxPacket = 256 << 10
+	maxRead   = 64 << 10
+	// names per READDIR reply
+	dirBatch = 100
+)
+
+var errBadMessage = errors.New("malformed packet")
+
+// handle is an open file or directory.
+type handle struct {
+	path string
+
+	r    io.ReadCloser
+	rpos int64
+
+	w     Upload
+	wpos  int64
+	mtime time.Time // set on the file once the upload is stored
+
+	dir     bool
+	entries []FileInfo // left to send once listed
+	listed  bool
+}
+
+type session struct {
+	fs      FS
+	rw      io.ReadWriter
+	handles map[string]*handle
+	next    int
+}
+
+// serveSFTP answers requests on rw until the client goes away. Requests are
+// handled in order, so reads and writes of pipelining clients arrive in
+// offset order.
+func serveSFTP(rw io.ReadWriter, tree FS) error {
+	s := &session{fs: tree, rw: rw, handles: map[string]*handle{}}
+	defer func() {
+		for _, h := range s.handles {
+			if h.r != nil {
+				h.r.Close()
+			}
+			if h.w != nil {
+				h.w.Abort()
+			}
+		}
+	}()
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n == 0 || n > maxPacket {
+			return fmt.Errorf("packet of %d bytes", n)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(rw, body); err != nil {
+			return err
+		}
+		if err := s.handle(body[0], &reader{b: body[1:]}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) handle(typ byte, r *reader) error {
+	if typ == fxpInit {
+		return s.send(packet{fxpVersion}.u32(3))
+	}
+	id := r.u32()
+	if r.bad {
+		return errBadMessage
+	}
+	switch typ {
+	case fxpOpen:
+		p, flags := r.path(), r.u32()
+		if r.bad {
+			return s.status(id, errBadMessage)
+		}
+		return s.open(id, p, flags)
+	case fxpClose:
+		h, key := s.lookup(r)
+		if h == nil {
+			return s.status(id, fs.ErrInvalid)
+		}
+		delete(s.handles, key)
+		var err error
+		if h.r != nil {
+			err = h.r.Close()
+		}
+		if h.w != nil {
+			err = h.w.Close()
+		}
+		if err == nil && !h.mtime.IsZero() {
+			err = s.fs.Chtimes(h.path, h.mtime)
+		}
+		return s.status(id, err)
+	case fxpRead:
+		h, _ := s.lookup(r)
+		off, n := r.u64(), r.u32()
+		if h == nil || h.w != nil || h.dir || r.bad {
+			return s.status(id, fs.ErrInvalid)
+		}
+		return s.read(id, h, int64(off), int(min(n, maxRead)))
+	case fxpWrite:
+		h, _ := s.lookup(r)
+		off, data := r.u64(), r.bytes()
+		if h == nil || h.w == nil || r.bad {
+			return s.status(id, fs.ErrInvalid)
+		}
+		if int64(off) != h.wpos {
+			return s.status(id, errUnsupported("writes must be sequential"))
+		}
+		n, err := h.w.Write(data)
+		h.wpos += int64(n)
+		return s.status(id, err)
+	case fxpStat, fxpLstat:
+		fi, err := s.fs.Stat(r.path())
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.send(packet{fxpAttrs}.u32(id).attrs(fi))
+	case fxpFstat:
+		h, _ := s.lookup(r)
+		if h == nil {
+			return s.status(id, fs.ErrInvalid)
+		}
+		fi, err := s.fs.Stat(h.path)
+		if err != nil {
+			return s.status(id, err)
+		}
+		if h.w != nil {
+			fi.Size = h.wpos
+		}
+		return s.send(packet{fxpAttrs}.u32(id).attrs(fi))
+	case fxpSetstat:
+		p, mtime := r.path(), r.attrs()
+		if r.bad {
+			return s.status(id, errBadMessage)
+		}
+		// modes, owners and sizes are the server's to keep; only times stick
+		if mtime.IsZero() {
+			return s.status(id, nil)
+		}
+		return s.status(id, s.fs.Chtimes(p, mtime))
+	case fxpFsetstat:
+		h, _ := s.lookup(r)
+		mtime := r.attrs()
+		if h == nil || r.bad {
+			return s.status(id, fs.ErrInvalid)
+		}
+		if mtime.IsZero() {
+			return s.status(id, nil)
+		}
+		if h.w != nil {
+			h.mtime = mtime
+			return s.status(id, nil)
+		}
+		return s.status(id, s.fs.Chtimes(h.path, mtime))
+	case fxpOpendir:
+		p := r.path()
+		fi, err := s.fs.Stat(p)
+		if err == nil && !fi.Dir {
+			err = fmt.Errorf("%s is not a directory", p)
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.newHandle(id, &handle{path: p, dir: true})
+	case fxpReaddir:
+		return s.readDir(id, r)
+	case fxpRemove:
+		return s.status(id, s.fs.Remove(r.path()))
+	case fxpMkdir:
+		return s.status(id, s.fs.Mkdir(r.path()))
+	case fxpRmdir:
+		return s.status(id, s.fs.Rmdir(r.path()))
+	case fxpRealpath:
+		p := "/" + r.path()
+		if p == "/." {
+			p = "/"
+		}
+		fi := FileInfo{Name: p, Dir: true}
+		return s.send(packet{fxpName}.u32(id).u32(1).str(p).str(longName(fi)).attrs(fi))
+	case fxpRename:
+		from, to := r.path(), r.path()
+		return s.status(id, s.fs.Rename(from, to))
+	}
+	return s.status(id, errUnsupported("operation not supported"))
+}
+
+func (s *session) open(id uint32, p string, flags uint32) error {
+	switch {
+	case flags&flagWrite != 0 && flags&(flagRead|flagAppend) != 0:
+		return s.status(id, errUnsupported("files are written whole; open them for reading or writing"))
+	case flags&flagWrite != 0:
+		if flags&flagExcl != 0 {
+			if _, err := s.fs.Stat(p); err == nil {
+				return s.status(id, fs.ErrExist)
+			}
+		}
+		w, err := s.fs.Create(p)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.newHandle(id, &handle{path: p, w: w})
+	default:
+		fi, err := s.fs.Stat(p)
+		if err == nil && fi.Dir {
+			err = fmt.Errorf("%s is a directory", p)
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.newHandle(id, &handle{path: p})
+	}
+}
+
+// read serves a READ, reopening the file when the client jumps to another
+// offset.
+func (s *session) read(id uint32, h *handle, off int64, n int) error {
+	if h.r == nil || off != h.rpos {
+		if h.r != nil {
+			h.r.Close()
+		}
+		r, err := s.fs.Open(h.path, off)
+		if err != nil {
+			h.r = nil
+			return s.status(id, err)
+		}
+		h.r, h.rpos = r, off
+	}
+	buf := make([]byte, n)
+	got, err := io.ReadFull(h.r, buf)
+	h.rpos += int64(got)
+	if got == 0 {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return s.send(packet{fxpStatus}.u32(id).u32(fxEOF).str("EOF").str(""))
+		}
+		return s.status(id, err)
+	}
+	return s.send(packet{fxpData}.u32(id).str(string(buf[:got])))
+}
+
+func (s *session) readDir(id uint32, r *reader) error {
+	h, _ := s.lookup(r)
+	if h == nil || !h.dir {
+		return s.status(id, fs.ErrInvalid)
+	}
+	if !h.listed {
+		list, err := s.fs.ReadDir(h.path)
+		if err != nil {
+			return s.status(id, err)
+		}
+		h.entries, h.listed = list, true
+	}
+	if len(h.entries) == 0 {
+		return s.send(packet{fxpStatus}.u32(id).u32(fxEOF).str("EOF").str(""))
+	}
+	batch := h.entries[:min(len(h.entries), dirBatch)]
+	h.entries = h.entries[len(batch):]
+	p := packet{fxpName}.u32(id).u32(uint32(len(batch)))
+	for _, fi := range batch {
+		p = p.str(fi.Name).str(longName(fi)).attrs(fi)
+	}
+	return s.send(p)
+}
+
+func (s *session) newHandle(id uint32, h *handle) error {
+	s.next++
+	key := strconv.Itoa(s.next)
+	s.handles[key] = h
+	return s.send(packet{fxpHandle}.u32(id).str(key))
+}
+
+func (s *session) lookup(r *reader) (*handle, string) {
+	key := r.str()
+	return s.handles[key], key
+}
+
+type errUnsupported string
+
+func (e errUnsupported) Error() string { return string(e) }
+
+func (s *session) status(id uint32, err error) error {
+	code, msg := uint32(fxOK), "OK"
+	var unsupported errUnsupported
+	switch {
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		code, msg = fxNoSuchFile, err.Error()
+	case errors.Is(err, fs.ErrPermission):
+		code, msg = fxPermissionDenied, err.Error()
+	case errors.Is(err, errBadMessage):
+		code, msg = fxBadMessage, err.Error()
+	case errors.As(err, &unsupported):
+		code, msg = fxOpUnsupported, err.Error()
+	default:
+		code, msg = fxFailure, err.Error()
+	}
+	return s.send(packet{fxpStatus}.u32(id).u32(code).str(msg).str(""))
+}
+
+func (s *session) send(p packet) error {
+	out := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(p)), uint32(len(p)))
+	_, err := s.rw.Write(append(out, p...))
+	return err
+}
+
+// longName is the `ls -l` line clients like OpenSSH's sftp print.
+func longName(fi FileInfo) string {
+	mode := "-rw-r--r--"
+	if fi.Dir {
+		mode = "drwxr-xr-x"
+	}
+	return fmt.Sprintf("%s 1 scloud scloud %12d %s %s", mode, fi.Size, fi.ModTime.Format("Jan _2 15:04"), fi.Name)
+}
+
+type packet []byte
+
+func (p packet) u32(v uint32) packet { return binary.BigEndian.AppendUint32(p, v) }
+func (p packet) u64(v uint64) packet { return binary.BigEndian.AppendUint64(p, v) }
+func (p packet) str(v string) packet { return append(p.u32(uint32(len(v))), v...) }
+
+func (p packet) attrs(fi FileInfo) packet {
+	perms := uint32(0o100644)
+	if fi.Dir {
+		perms = 0o40755
+	}
+	mtime := uint32(max(fi.ModTime.Unix(), 0))
+	return p.u32(attrSize | attrPerms | attrTimes).u64(uint64(max(fi.Size, 0))).u32(perms).u32(mtime).u32(mtime)
+}
+
+// reader decodes a request; after a short read every field is zero and bad
+// is set.
+type reader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *reader) take(n int) []byte {
+	if r.bad || n < 0 || len(r.b) < n {
+		r.bad = true
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) bytes() []byte { return r.take(int(r.u32())) }
+
+func (r *reader) str() string { return string(r.bytes()) }
+
+// attrs reads an ATTRS block and returns the modification time it sets, or
+// the zero time.
+func (r *reader) attrs() time.Time {
+	flags := r.u32()
+	if flags&attrSize != 0 {
+		r.u64()
+	}
+	if flags&attrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if flags&attrPerms != 0 {
+		r.u32()
+	}
+	if flags&attrTimes == 0 || r.bad {
+		return time.Time{}
+	}
+	r.u32() // atime
+	return time.Unix(int64(r.u32()), 0)
+}
+
+// path reads a client path and cleans it to the tree's form: relative to
+// the root, "." for the root itself. ".." never climbs above the root.
+func (r *reader) path() string {
+	return cleanPath(r.str())
+}
+
+func cleanPath(p string) string {
+	p = path.Clean("/" + p)[1:]
+	if p == "" {
+		return "."
+	}
+	return p
+}
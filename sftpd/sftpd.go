@@ -0,0 +1,163 @@
+package sftpd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// FileInfo describes one entry of the tree.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Dir     bool
+}
+
+// Upload receives a file's bytes in order. Close stores the file; Abort
+// drops it, as when the connection goes away mid-transfer.
+type Upload interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// FS is the tree one signed-in user sees. Paths are slash-separated and
+// relative to the tree's root, which is ".". Errors wrapping fs.ErrNotExist,
+// fs.ErrPermission and fs.ErrExist reach the client as such.
+type FS interface {
+	Stat(p string) (FileInfo, error)
+	ReadDir(p string) ([]FileInfo, error)
+	// Open reads file p from offset on.
+	Open(p string, offset int64) (io.ReadCloser, error)
+	// Create replaces file p, or creates it, with what is written.
+	Create(p string) (Upload, error)
+	Mkdir(p string) error
+	Remove(p string) error
+	Rmdir(p string) error
+	Rename(from, to string) error
+	// Chtimes sets the modification time of p.
+	Chtimes(p string, mtime time.Time) error
+	// Hash returns the hex digest of file p's content, for algo "md5" or
+	// "sha1".
+	Hash(p, algo string) (string, error)
+}
+
+// Server serves SFTP over SSH. Password checks a login and returns the
+// user's ID; FS opens the tree for that ID. Only the "sftp" subsystem and
+// the hash commands sync tools run (see runCommand) are offered: no shells,
+// no port forwarding.
+type Server struct {
+	HostKey  ssh.Signer
+	Password func(user, password string, remote net.Addr) (string, error)
+	FS       func(userID string) (FS, error)
+	Log      *log.Logger
+}
+
+// LoadHostKey reads the host key at path, creating an ed25519 key there on
+// first use so clients see the same key across restarts.
+func LoadHostKey(path string) (ssh.Signer, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "scloud sftp")
+		if err != nil {
+			return nil, err
+		}
+		raw = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, raw, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(raw)
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			id, err := s.Password(meta.User(), string(password), meta.RemoteAddr())
+			if err != nil {
+				s.Log.Printf("sftp: login %q from %s: %v", meta.User(), meta.RemoteAddr(), err)
+				return nil, fmt.Errorf("login failed")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"userid": id}}, nil
+		},
+	}
+	cfg.AddHostKey(s.HostKey)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn, cfg)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	// the handshake must not hold a connection open forever
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	sc, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	userID := sc.Permissions.Extensions["userid"]
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are served")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveSession(ch, chReqs, userID)
+	}
+}
+
+func (s *Server) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request, userID string) {
+	defer ch.Close()
+	for req := range reqs {
+		// payload: string subsystem name, or string command
+		if len(req.Payload) < 4 || req.Type != "exec" && (req.Type != "subsystem" || string(req.Payload[4:]) != "sftp") {
+			req.Reply(false, nil)
+			continue
+		}
+		tree, err := s.FS(userID)
+		if err != nil {
+			s.Log.Printf("sftp: open tree for %s: %v", userID, err)
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+		var status uint32
+		if req.Type == "exec" {
+			status = runCommand(ch, tree, string(req.Payload[4:]))
+		} else if err := serveSFTP(ch, tree); err != nil && !errors.Is(err, io.EOF) {
+			s.Log.Printf("sftp: session of %s: %v", userID, err)
+		}
+		ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+		return
+	}
+}
@@ -0,0 +1,35 @@
+package stats
+
+import "sync"
+
+// Why the server cut a client's connection.
+const (
+	DropMaxConns      = "max_conns"      // HTTP_MAX_CONNS reached
+	DropPerIP         = "per_ip"         // HTTP_MAX_CONNS_PER_IP reached
+	DropHeaderTimeout = "header_timeout" // no request within HTTP_READ_HEADER_TIMEOUT
+	DropSlowRead      = "slow_read"      // sent its body below HTTP_MIN_RATE
+	DropSlowWrite     = "slow_write"     // took its response below HTTP_MIN_RATE
+)
+
+var (
+	dropsMu sync.Mutex
+	drops   = map[string]int64{}
+)
+
+// RecordDrop counts a connection cut for reason.
+func RecordDrop(reason string) {
+	dropsMu.Lock()
+	drops[reason]++
+	dropsMu.Unlock()
+}
+
+// Drops returns the connections cut since start, by reason.
+func Drops() map[string]int64 {
+	dropsMu.Lock()
+	defer dropsMu.Unlock()
+	out := map[string]int64{}
+	for _, reason := range []string{DropMaxConns, DropPerIP, DropHeaderTimeout, DropSlowRead, DropSlowWrite} {
+		out[reason] = drops[reason]
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+package stats
+
+import "sync"
+
+// Requests in the CONCURRENCY_LIMITS slots, and those turned away, by class.
+var (
+	slotsMu sync.Mutex
+	inUse   = map[string]int64{}
+	shed    = map[string]int64{}
+)
+
+// SlotTaken adds delta to the requests of class holding a slot.
+func SlotTaken(class string, delta int64) {
+	slotsMu.Lock()
+	inUse[class] += delta
+	slotsMu.Unlock()
+}
+
+// RecordShed counts a request of class turned away for want of a slot.
+func RecordShed(class string) {
+	slotsMu.Lock()
+	shed[class]++
+	slotsMu.Unlock()
+}
+
+// Slots returns the requests holding a slot and those turned away since
+// start, by class.
+func Slots(classes []string) (busy, turnedAway map[string]int64) {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	busy, turnedAway = map[string]int64{}, map[string]int64{}
+	for _, c := range classes {
+		busy[c], turnedAway[c] = inUse[c], shed[c]
+	}
+	return busy, turnedAway
+}
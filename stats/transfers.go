@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Rolling per-minute counters covering the last 24 hours.
+const buckets = 24 * 60
+
+type Kind int
+
+const (
+	Upload Kind = iota
+	Download
+	numKinds
+)
+
+type bucket struct {
+	minute int64 // unix minute this bucket currently holds
+	count  int64
+	bytes  int64
+}
+
+var (
+	mu     sync.Mutex
+	series [numKinds][buckets]bucket
+)
+
+// Record counts one transfer of n bytes.
+func Record(k Kind, n int64) {
+	minute := time.Now().Unix() / 60
+	mu.Lock()
+	defer mu.Unlock()
+	b := &series[k][minute%buckets]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+	b.count++
+	b.bytes += n
+}
+
+// Last24h returns the number of transfers and bytes moved in the last 24 hours.
+func Last24h(k Kind) (count, bytes int64) {
+	now := time.Now().Unix() / 60
+	mu.Lock()
+	defer mu.Unlock()
+	for _, b := range series[k] {
+		if now-b.minute < buckets {
+			count += b.count
+			bytes += b.bytes
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserTotals counts one user's transfers since the server started: those
+// that finished, with their bytes, and those that failed.
+type UserTotals struct {
+	Uploads          int64 `json:"uploads"`
+	UploadBytes      int64 `json:"upload_bytes"`
+	UploadFailures   int64 `json:"upload_failures"`
+	Downloads        int64 `json:"downloads"`
+	DownloadBytes    int64 `json:"download_bytes"`
+	DownloadFailures int64 `json:"download_failures"`
+}
+
+// Bytes is what the user moved either way.
+func (t UserTotals) Bytes() int64 { return t.UploadBytes + t.DownloadBytes }
+
+var (
+	usersMu sync.Mutex
+	users   = map[string]*UserTotals{}
+	Started = time.Now()
+)
+
+func userTotals(userID string) *UserTotals {
+	t, ok := users[userID]
+	if !ok {
+		t = &UserTotals{}
+		users[userID] = t
+	}
+	return t
+}
+
+// RecordUser counts a finished transfer of n bytes by userID.
+func RecordUser(userID string, k Kind, n int64) {
+	if userID == "" {
+		return
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	t := userTotals(userID)
+	if k == Upload {
+		t.Uploads++
+		t.UploadBytes += n
+	} else {
+		t.Downloads++
+		t.DownloadBytes += n
+	}
+}
+
+// RecordUserFailure counts a transfer by userID that failed.
+func RecordUserFailure(userID string, k Kind) {
+	if userID == "" {
+		return
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	t := userTotals(userID)
+	if k == Upload {
+		t.UploadFailures++
+	} else {
+		t.DownloadFailures++
+	}
+}
+
+// User returns userID's totals.
+func User(userID string) UserTotals {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	if t, ok := users[userID]; ok {
+		return *t
+	}
+	return UserTotals{}
+}
+
+// TopUsers returns the totals of the n users who moved the most bytes, and
+// everyone else's totals summed.
+func TopUsers(n int) (top map[string]UserTotals, rest UserTotals) {
+	usersMu.Lock()
+	ids := make([]string, 0, len(users))
+	all := make(map[string]UserTotals, len(users))
+	for id, t := range users {
+		ids = append(ids, id)
+		all[id] = *t
+	}
+	usersMu.Unlock()
+	sort.Slice(ids, func(i, j int) bool {
+		if bi, bj := all[ids[i]].Bytes(), all[ids[j]].Bytes(); bi != bj {
+			return bi > bj
+		}
+		return ids[i] < ids[j]
+	})
+	top = map[string]UserTotals{}
+	for i, id := range ids {
+		t := all[id]
+		if i < n {
+			top[id] = t
+			continue
+		}
+		rest.Uploads += t.Uploads
+		rest.UploadBytes += t.UploadBytes
+		rest.UploadFailures += t.UploadFailures
+		rest.Downloads += t.Downloads
+		rest.DownloadBytes += t.DownloadBytes
+		rest.DownloadFailures += t.DownloadFailures
+	}
+	return top, rest
+}
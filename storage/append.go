@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// appendLocks serialises appends per blob: two writers continuing the same
+// chunk sequence would reuse indexes, and with them GCM nonces. A blob's
+// lock is dropped once no one holds or waits for it.
+var (
+	appendLocksMu sync.Mutex
+	appendLocks   = map[string]*blobLock{} // by blob path
+)
+
+type blobLock struct {
+	sync.Mutex
+	refs int
+}
+
+func lockBlob(path string) func() {
+	appendLocksMu.Lock()
+	l := appendLocks[path]
+	if l == nil {
+		l = &blobLock{}
+		appendLocks[path] = l
+	}
+	l.refs++
+	appendLocksMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		appendLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(appendLocks, path)
+		}
+		appendLocksMu.Unlock()
+	}
+}
+
+// AppendFile appends plaintext from r to the file at logicalPath without
+// rewriting it: new chunks continue the existing index sequence under the
+// same header. blobKey is the key the blob was written with (nil = masterKey).
+// Client-encrypted blobs are opaque to us, so r is appended verbatim.
+// It returns the file's new plaintext size.
+func AppendFile(masterKey []byte, baseDir, logicalPath string, blobKey []byte, r io.Reader) (int64, error) {
+	blobPath, entry, err := StatFile(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkMutable(masterKey, baseDir, logicalPath, entry); err != nil {
+		return 0, err
+	}
+	if blobKey == nil {
+		blobKey = masterKey
+	}
+
+	unlock := lockBlob(blobPath)
+	defer unlock()
+	if err := unshareBlob(blobPath, true); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(blobPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	if entry.Encryption == EncryptionClient {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			return 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		size = fi.Size()
+	} else {
+		size, err = appendChunks(blobKey, f, r)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return size, UpdateFileMeta(masterKey, baseDir, logicalPath, size, time.Now())
+}
+
+// appendChunks walks the existing records to find the next index and the
+// plaintext size so far, then seals r after them.
+func appendChunks(key []byte, f *os.File, r io.Reader) (int64, error) {
+	chunkSize, hdr, salt, noncePrefix, err := readHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	cc, err := newChunkCipher(key, hdr, salt, noncePrefix)
+	if err != nil {
+		return 0, err
+	}
+	recs, plain, err := walkRecords(f, cc)
+	if err != nil {
+		return 0, err
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	counted := &CountReader{R: r}
+	if _, err := sealChunks(cc, uint32(len(recs)), chunkSize, counted, f); err != nil {
+		// drop any partial record so the next append can still walk the blob
+		_ = f.Truncate(end)
+		return 0, err
+	}
+	return plain + counted.N, nil
+}
+
+// CountReader counts the bytes read through it.
+type CountReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"SCloud/events"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobFile is a blob being written. Data goes to a temp file next to the
+// destination and only replaces it in CommitBlob, so a failed or interrupted
+// write never clobbers a good blob. Each writer gets its own temp file;
+// leftovers are reclaimed by GC. Finish with CommitBlob or Abort.
+type BlobFile struct {
+	*os.File
+	dst string
+}
+
+// CreateBlob starts writing the blob that will live at dst.
+func CreateBlob(dst string) (*BlobFile, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dst), strings.TrimSuffix(filepath.Base(dst), ".bin")+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &BlobFile{File: f, dst: dst}, nil
+}
+
+// BlobInfo is what CommitBlob records about a finished blob.
+type BlobInfo struct {
+	KeyOwner   string
+	Encryption string
+	Size       int64     // plaintext; < 0 measures the blob
+	ModTime    time.Time // zero = now
+	Exclusive  bool      // fail with an os.ErrExist error if a blob landed at the path meanwhile
+	MD5, SHA1  string    // of the content as downloaded; "" = unknown
+	// non-nil replaces the entry's "exif." and "photo." meta: what an
+	// uploaded image said about itself
+	ImageMeta map[string]string
+}
+
+// CommitBlob moves a finished blob into place for the file at logicalPath
+// and records info in its manifest entry. Readers see either the old blob or
+// the new one, never a mix; the journal covers a crash between the rename
+// and the manifest save.
+func CommitBlob(masterKey []byte, baseDir, logicalPath string, b *BlobFile, info BlobInfo) error {
+	err := b.Sync()
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	if info.Size < 0 {
+		if info.Size, err = blobPlainSize(masterKey, b.Name(), info.Encryption == EncryptionClient); err != nil {
+			b.Abort()
+			return err
+		}
+	}
+	if info.ModTime.IsZero() {
+		info.ModTime = time.Now()
+	}
+
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	_, e := findEntry(m, name, "file")
+	if e == nil || blobPath(parentDir, e) != b.dst {
+		b.Abort()
+		return fmt.Errorf("file missing")
+	}
+	next := *e
+	next.KeyOwner, next.Encryption = info.KeyOwner, info.Encryption
+	next.Size, next.ModTime = info.Size, info.ModTime.Unix()
+	next.MD5, next.SHA1 = info.MD5, info.SHA1
+	next.SHA256, next.BLAKE3 = "", ""
+	next.Rev++
+	if info.ImageMeta != nil {
+		next.Meta = replaceImageMeta(e.Meta, info.ImageMeta)
+	}
+
+	print, err := blobFingerprint(b.Name())
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	j, err := openJournal(masterKey, root)
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	rel, _ := filepath.Rel(root, parentDir)
+	seq, err := j.begin(journalRecord{Op: journalReplace, Dir: rel, Entry: next, Print: print})
+	if err != nil {
+		b.Abort()
+		return err
+	}
+	defer j.commit(seq)
+
+	if info.Exclusive {
+		if err = os.Link(b.Name(), b.dst); err == nil {
+			os.Remove(b.Name())
+		}
+	} else {
+		err = os.Rename(b.Name(), b.dst)
+	}
+	if err != nil {
+		b.Abort()
+		return err
+	}
+
+	// reload: other entries may have changed while the blob was written
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if m, err = loadManifest(masterKey, parentDir); err != nil {
+		return err
+	}
+	idx, e := findEntry(m, name, "file")
+	if e == nil || e.Enc != next.Enc {
+		return fmt.Errorf("file missing")
+	}
+	m.Entries[idx] = next
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return err
+	}
+	j.commitCreate(b.dst)
+	events.Publish(events.Event{Type: events.FileUpdated, Path: logicalPath, Size: next.Size})
+	return nil
+}
+
+// replaceImageMeta returns meta with its image keys swapped for fields,
+// leaving meta itself alone.
+func replaceImageMeta(meta, fields map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range meta {
+		if !strings.HasPrefix(k, "exif.") && !strings.HasPrefix(k, "photo.") {
+			out[k] = v
+		}
+	}
+	for k, v := range fields {
+		out[k] = v
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// blobPlainSize reads the plaintext size off a blob's record lengths.
+func blobPlainSize(masterKey []byte, blobPath string, raw bool) (int64, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if raw {
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	_, hdr, salt, noncePrefix, err := readHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	// the overhead per record doesn't depend on the key
+	cc, err := newChunkCipher(masterKey, hdr, salt, noncePrefix)
+	if err != nil {
+		return 0, err
+	}
+	_, size, err := walkRecords(f, cc)
+	return size, err
+}
+
+// Abort discards the blob; the destination is left as it was. It is a no-op
+// after CommitBlob.
+func (b *BlobFile) Abort() {
+	b.Close()
+	os.Remove(b.Name())
+}
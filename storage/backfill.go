@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+type BackfillReport struct {
+	Files    int           `json:"files"`   // read through for missing fields
+	Updated  int           `json:"updated"` // entries with fields filled in
+	Changed  int           `json:"changed"` // rewritten while being read; left alone
+	Skipped  int           `json:"skipped"`
+	Failures []FileFailure `json:"failures"`
+}
+
+// needsBackfill reports whether e predates a field recorded on upload now:
+// the MD5 and SHA-1 sums, the SHA-256 the checksum endpoint caches, or the
+// plaintext size (0 on entries from before it was tracked).
+func needsBackfill(e *ManifestEntry) bool {
+	return e.MD5 == "" || e.SHA1 == "" || e.SHA256 == "" || e.Size == 0
+}
+
+// Backfill reads through every file missing a field newer entries carry
+// and records it, without bumping the rev: the content is the same. A file
+// rewritten while it was being read is left to its new revision.
+// progress is called once per file.
+func Backfill(masterKey []byte, baseDir string, keyFor KeyFunc, progress func()) (BackfillReport, error) {
+	r := BackfillReport{Failures: []FileFailure{}}
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return r, err
+	}
+	err = walkFiles(masterKey, root, ".", func(dir, logical string, e *ManifestEntry) error {
+		defer progress()
+		if !needsBackfill(e) {
+			return nil
+		}
+		var key []byte
+		if e.Encryption != EncryptionClient {
+			k, err := keyFor(e)
+			if err != nil {
+				r.Skipped++
+				return nil
+			}
+			key = k
+		}
+		r.Files++
+		f, err := os.Open(blobPath(dir, e))
+		if err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		defer f.Close()
+		sums, sha := NewHashes(), sha256.New()
+		var cw countingWriter
+		w := io.MultiWriter(sums, sha, &cw)
+		if e.Encryption == EncryptionClient {
+			_, err = io.Copy(w, f)
+		} else {
+			err = Decrypt(key, f, w)
+		}
+		if err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		filled := *e
+		filled.MD5, filled.SHA1 = sums.Sums()
+		filled.SHA256 = hex.EncodeToString(sha.Sum(nil))
+		filled.Size = cw.n
+		if filled.MD5 == e.MD5 && filled.SHA1 == e.SHA1 && filled.SHA256 == e.SHA256 && filled.Size == e.Size {
+			// an empty file: nothing was missing after all
+			return nil
+		}
+		switch err := backfillEntry(masterKey, dir, &filled); {
+		case errors.Is(err, ErrChanged):
+			r.Changed++
+		case err != nil:
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+		default:
+			r.Updated++
+		}
+		return nil
+	})
+	return r, err
+}
+
+// backfillEntry copies the backfilled fields of filled onto its entry in
+// dir, provided the entry is still the revision that was read.
+func backfillEntry(masterKey []byte, dir string, filled *ManifestEntry) error {
+	unlock, err := lockManifest(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	_, e := findEntry(m, filled.Name, "file")
+	if e == nil || e.Enc != filled.Enc || e.Rev != filled.Rev {
+		return ErrChanged
+	}
+	e.MD5, e.SHA1, e.SHA256, e.Size = filled.MD5, filled.SHA1, filled.SHA256, filled.Size
+	return saveManifest(masterKey, dir, m)
+}
@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlobStore is where backups go. Keys are slash-separated; Put must not leave
+// a partial object behind under key if it fails.
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Has(key string) (bool, error)
+	List(prefix string) ([]string, error)
+}
+
+// DirBlobStore keeps objects as files under Root, e.g. a second disk or a
+// network mount.
+type DirBlobStore struct{ Root string }
+
+func (d DirBlobStore) path(key string) string {
+	return filepath.Join(d.Root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (d DirBlobStore) Put(key string, r io.Reader) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".put.tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d DirBlobStore) Get(key string) (io.ReadCloser, error) { return os.Open(d.path(key)) }
+
+func (d DirBlobStore) Has(key string) (bool, error) {
+	_, err := os.Stat(d.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d DirBlobStore) List(prefix string) ([]string, error) {
+	var keys []string
+	root := d.path(prefix)
+	err := filepath.WalkDir(root, func(p string, e fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || e.IsDir() || strings.HasSuffix(p, ".put.tmp") {
+			return err
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+)
+
+// RestorePoint is the catalog of one backup: every file of the storage trees
+// as it was, by content hash. Objects are shared between points, so an
+// incremental point only adds what changed since its parent.
+type RestorePoint struct {
+	ID         string        `json:"id"`
+	Created    time.Time     `json:"created"`
+	Kind       string        `json:"kind"`
+	Parent     string        `json:"parent,omitempty"`
+	Files      int           `json:"files"`
+	Bytes      int64         `json:"bytes"`
+	NewObjects int           `json:"new_objects"`
+	NewBytes   int64         `json:"new_bytes"`
+	Failures   []FileFailure `json:"failures,omitempty"`
+	Entries    []BackupEntry `json:"entries,omitempty"`
+}
+
+type BackupEntry struct {
+	Path    string `json:"path"` // relative to the server's base dir, slash separated
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // unix nanoseconds
+	Object  string `json:"object"`
+}
+
+var ErrNoRestorePoint = errors.New("no such restore point")
+
+func pointKey(id string) string { return "points/" + id + ".cat" }
+
+func objectKey(sum string) string { return "objects/" + sum[:2] + "/" + sum }
+
+// backupRoots lists the storage trees under baseDir: the shared one and
+// every org's.
+func backupRoots(baseDir string) ([]string, error) {
+	roots := []string{"filestorage"}
+	ents, err := os.ReadDir(filepath.Join(baseDir, "orgs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.IsDir() {
+			roots = append(roots, path.Join("orgs", e.Name(), "filestorage"))
+		}
+	}
+	return roots, nil
+}
+
+// Backup copies the storage trees under baseDir into dst and records a new
+// restore point. Everything copied is already ciphertext (blobs, manifests,
+// wrapped user keys); the catalog itself is encrypted under the master key.
+//
+// An incremental backup trusts size and mtime against the latest point and
+// only hashes files that changed. The in-memory event journal would be
+// cheaper but does not survive restarts, so it can miss changes. Staging
+// uploads and temp files are left out, and so is the database.
+//
+// Manifests are copied before blobs, so a point never references a blob
+// created after its manifest was read. Files removed mid-run are listed in
+// Failures; the result is crash-consistent, not a transaction.
+func Backup(masterKey []byte, baseDir string, dst BlobStore, full bool, progress func()) (RestorePoint, error) {
+	rp := RestorePoint{Created: time.Now().UTC(), Kind: BackupFull}
+	rp.ID = rp.Created.Format("20060102T150405.000Z")
+
+	prev := map[string]BackupEntry{}
+	if !full {
+		if last, err := latestRestorePoint(masterKey, dst); err == nil {
+			rp.Kind, rp.Parent = BackupIncremental, last.ID
+			for _, e := range last.Entries {
+				prev[e.Path] = e
+			}
+		} else if !errors.Is(err, ErrNoRestorePoint) {
+			return rp, err
+		}
+	}
+
+	roots, err := backupRoots(baseDir)
+	if err != nil {
+		return rp, err
+	}
+	// trees maps backup paths to dirs. Blobs on a volume are kept as
+	// volumes/<name>/<root ID>/..., the layout of the volume itself, so a
+	// restored copy can be given back as VOLUMES.
+	var trees [][2]string
+	for _, root := range roots {
+		trees = append(trees, [2]string{root, filepath.Join(baseDir, root)})
+	}
+	vols := Volumes()
+	for _, root := range roots {
+		for _, name := range sortedKeys(vols) {
+			id, err := rootID(filepath.Join(baseDir, root))
+			if err != nil {
+				return rp, err
+			}
+			trees = append(trees, [2]string{path.Join("volumes", name, id), filepath.Join(vols[name], id)})
+		}
+	}
+	var files []string
+	sources := map[string]string{}
+	for _, t := range trees {
+		err := filepath.WalkDir(t[1], func(p string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == "_uploads" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			rel, err := filepath.Rel(t[1], p)
+			if err != nil {
+				return err
+			}
+			rel = path.Join(t[0], filepath.ToSlash(rel))
+			sources[rel] = p
+			files = append(files, rel)
+			return nil
+		})
+		if err != nil {
+			return rp, err
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return path.Base(files[i]) == manifestFileName && path.Base(files[j]) != manifestFileName
+	})
+
+	for _, rel := range files {
+		e, added, err := backupFile(sources[rel], rel, prev, dst)
+		if progress != nil {
+			progress()
+		}
+		if err != nil {
+			rp.Failures = append(rp.Failures, FileFailure{Path: rel, Error: err.Error()})
+			continue
+		}
+		rp.Entries = append(rp.Entries, e)
+		rp.Files++
+		rp.Bytes += e.Size
+		if added {
+			rp.NewObjects++
+			rp.NewBytes += e.Size
+		}
+	}
+
+	raw, err := json.Marshal(rp)
+	if err != nil {
+		return rp, err
+	}
+	enc, err := encryptBytes(masterKey, raw)
+	if err != nil {
+		return rp, err
+	}
+	if err := dst.Put(pointKey(rp.ID), bytes.NewReader(enc)); err != nil {
+		return rp, err
+	}
+	rp.Entries = nil
+	return rp, nil
+}
+
+func backupFile(src, rel string, prev map[string]BackupEntry, dst BlobStore) (BackupEntry, bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return BackupEntry{}, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return BackupEntry{}, false, err
+	}
+	e := BackupEntry{Path: rel, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+
+	if p, ok := prev[rel]; ok && p.Size == e.Size && p.ModTime == e.ModTime {
+		if ok, err := dst.Has(objectKey(p.Object)); err == nil && ok {
+			e.Object = p.Object
+			return e, false, nil
+		}
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return e, false, err
+	}
+	e.Object = hex.EncodeToString(h.Sum(nil))
+	if ok, err := dst.Has(objectKey(e.Object)); err != nil || ok {
+		return e, false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return e, false, err
+	}
+	// the file may change between hashing and copying; verify on the way
+	vr := &verifyReader{r: io.LimitReader(f, e.Size), h: sha256.New(), want: e.Object}
+	if err := dst.Put(objectKey(e.Object), vr); err != nil {
+		return e, false, err
+	}
+	return e, true, nil
+}
+
+// verifyReader fails the final read if the content doesn't hash to want, so
+// a BlobStore never commits a mislabelled object.
+type verifyReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.want {
+		return n, fmt.Errorf("content changed while copying (want %s)", v.want[:12])
+	}
+	return n, err
+}
+
+// LoadRestorePoint reads one catalog, entries included.
+func LoadRestorePoint(masterKey []byte, src BlobStore, id string) (RestorePoint, error) {
+	var rp RestorePoint
+	rc, err := src.Get(pointKey(id))
+	if os.IsNotExist(err) {
+		return rp, ErrNoRestorePoint
+	}
+	if err != nil {
+		return rp, err
+	}
+	defer rc.Close()
+	enc, err := io.ReadAll(rc)
+	if err != nil {
+		return rp, err
+	}
+	raw, err := decryptBytes(masterKey, enc)
+	if err != nil {
+		return rp, fmt.Errorf("restore point %s: %w", id, err)
+	}
+	return rp, json.Unmarshal(raw, &rp)
+}
+
+// ListRestorePoints returns every point, oldest first, without entries.
+func ListRestorePoints(masterKey []byte, src BlobStore) ([]RestorePoint, error) {
+	keys, err := src.List("points")
+	if err != nil {
+		return nil, err
+	}
+	points := make([]RestorePoint, 0, len(keys))
+	for _, k := range keys {
+		id, ok := strings.CutSuffix(path.Base(k), ".cat")
+		if !ok {
+			continue
+		}
+		rp, err := LoadRestorePoint(masterKey, src, id)
+		if err != nil {
+			return nil, err
+		}
+		rp.Entries = nil
+		points = append(points, rp)
+	}
+	return points, nil
+}
+
+func latestRestorePoint(masterKey []byte, src BlobStore) (RestorePoint, error) {
+	keys, err := src.List("points")
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if id, ok := strings.CutSuffix(path.Base(keys[i]), ".cat"); ok {
+			return LoadRestorePoint(masterKey, src, id)
+		}
+	}
+	return RestorePoint{}, ErrNoRestorePoint
+}
+
+// Restore writes the files of restore point id under destDir, which then
+// serves as the server's base dir. Existing storage trees are only
+// overwritten with force; files newer than the point are left in place as
+// orphans for GC.
+func Restore(masterKey []byte, src BlobStore, id, destDir string, force bool, progress func()) (RestorePoint, error) {
+	rp, err := LoadRestorePoint(masterKey, src, id)
+	if err != nil {
+		return rp, err
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "filestorage")); err == nil && !force {
+		return rp, fmt.Errorf("%s already holds a store", destDir)
+	}
+	for _, e := range rp.Entries {
+		if err := restoreFile(src, destDir, e); err != nil {
+			rp.Failures = append(rp.Failures, FileFailure{Path: e.Path, Error: err.Error()})
+		}
+		if progress != nil {
+			progress()
+		}
+	}
+	rp.Entries = nil
+	return rp, nil
+}
+
+func restoreFile(src BlobStore, destDir string, e BackupEntry) error {
+	dst := filepath.Join(destDir, filepath.FromSlash(e.Path))
+	if rel, err := filepath.Rel(destDir, dst); err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("refusing to write outside %s", destDir)
+	}
+	rc, err := src.Get(objectKey(e.Object))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".restore.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, &verifyReader{r: rc, h: sha256.New(), want: e.Object})
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	mt := time.Unix(0, e.ModTime)
+	if err == nil {
+		err = os.Chtimes(tmp, mt, mt)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// FullBackupDue reports whether the next scheduled backup should be full:
+// when there is no full point yet, or the newest is older than every.
+func FullBackupDue(points []RestorePoint, every time.Duration, now time.Time) bool {
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Kind == BackupFull {
+			return now.Sub(points[i].Created) >= every
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// BlobReader reads the plaintext of a server-encrypted blob at any offset.
+// The key is derived and the chunk table read once, when it is opened, and
+// the last chunk decrypted is kept, so the many small reads a mounted
+// filesystem makes only decrypt each chunk they touch once. It reads the
+// blob that was in place when opened, even if the file is replaced since.
+// It is not safe for concurrent use.
+type BlobReader struct {
+	f     *os.File
+	cc    *chunkCipher
+	recs  []chunkRecord
+	size  int64
+	last  int // chunk held in plain; -1 for none
+	plain []byte
+}
+
+// OpenBlobReader opens the blob at path for reading with key.
+func OpenBlobReader(key []byte, path string) (*BlobReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, hdr, salt, noncePrefix, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cc, err := newChunkCipher(key, hdr, salt, noncePrefix)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	recs, size, err := walkRecords(f, cc)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BlobReader{f: f, cc: cc, recs: recs, size: size, last: -1}, nil
+}
+
+// Size is the plaintext size.
+func (b *BlobReader) Size() int64 { return b.size }
+
+// ReadAt reads plaintext as io.ReaderAt does.
+func (b *BlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < b.size {
+		i := sort.Search(len(b.recs), func(i int) bool { return b.recs[i].ptStart+b.recs[i].ptLen > off })
+		if err := b.load(i); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], b.plain[off-b.recs[i].ptStart:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load decrypts chunk i unless it is the one held.
+func (b *BlobReader) load(i int) error {
+	if i == b.last {
+		return nil
+	}
+	rec := b.recs[i]
+	ct := make([]byte, rec.ctLen)
+	if _, err := b.f.ReadAt(ct, rec.pos+4); err != nil {
+		return fmt.Errorf("chunk %d: %w", i, err)
+	}
+	plain, err := b.cc.open(uint32(i), ct)
+	if err != nil {
+		return err
+	}
+	b.last, b.plain = i, plain
+	return nil
+}
+
+func (b *BlobReader) Close() error { return b.f.Close() }
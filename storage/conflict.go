@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"SCloud/events"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// What to do when an upload targets a path that already holds a file.
+const (
+	ConflictOverwrite = "overwrite" // replace the existing file (the default)
+	ConflictFail      = "fail"      // refuse with ErrExists
+	ConflictRename    = "rename"    // pick a free "name (n).ext" alongside it
+)
+
+var ErrExists = errors.New("file already exists")
+
+const maxRenameTries = 10000
+
+func ValidConflict(policy string) bool {
+	switch policy {
+	case "", ConflictOverwrite, ConflictFail, ConflictRename:
+		return true
+	}
+	return false
+}
+
+// ResolveConflict applies policy to logicalPath and returns the path the
+// upload should be written to. Nothing is created; a missing parent
+// directory simply means there is no conflict.
+func ResolveConflict(masterKey []byte, baseDir, logicalPath, policy string) (string, error) {
+	logicalPath = filepath.Clean(logicalPath)
+	if policy == "" || policy == ConflictOverwrite {
+		return logicalPath, nil
+	}
+	parentDir, fileName, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return logicalPath, nil
+	}
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return "", err
+	}
+	if _, e := findEntry(m, fileName, "file"); e == nil {
+		return logicalPath, nil
+	}
+
+	switch policy {
+	case ConflictFail:
+		return "", fmt.Errorf("%q: %w", logicalPath, ErrExists)
+	case ConflictRename:
+		stem, ext := splitExt(fileName)
+		for n := 1; n <= maxRenameTries; n++ {
+			candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+			if _, e := findEntry(m, candidate, "file"); e == nil {
+				return filepath.Join(filepath.Dir(logicalPath), candidate), nil
+			}
+		}
+		return "", fmt.Errorf("%q: no free name after %d tries", logicalPath, maxRenameTries)
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+// splitExt splits name before its extension; a dotfile has none, so ".env"
+// becomes ".env (1)" rather than " (1).env".
+func splitExt(name string) (stem, ext string) {
+	ext = filepath.Ext(name)
+	if stem = strings.TrimSuffix(name, ext); stem == "" {
+		return name, ""
+	}
+	return stem, ext
+}
+
+// SyncBase is what a sync client knew of the file it is uploading over:
+// the revision it last saw (0 if it thought the path was free), and a name
+// for the device, for conflicted copies.
+type SyncBase struct {
+	Rev    int64
+	Device string
+}
+
+// conflictCopyName names the copy an upload based on a stale revision is
+// kept as: "report (conflicted copy from laptop 2024-05-01).txt".
+func conflictCopyName(logicalPath, device string, at time.Time) string {
+	stem, ext := splitExt(filepath.Base(logicalPath))
+	device = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, device)
+	if device = strings.TrimSpace(device); len(device) > 64 {
+		device = device[:64]
+	}
+	from := ""
+	if device != "" {
+		from = " from " + device
+	}
+	return filepath.Join(filepath.Dir(logicalPath), fmt.Sprintf("%s (conflicted copy%s %s)%s", stem, from, at.Format("2006-01-02"), ext))
+}
+
+// CommitBlobSynced commits b for a sync client like CommitBlob, unless the
+// file has moved past base.Rev since the client last saw it: then the
+// upload is kept beside it as a conflicted copy, owned by owner, and a
+// file.conflict event names both. It returns the path b was committed at.
+func CommitBlobSynced(masterKey []byte, baseDir, logicalPath string, b *BlobFile, info BlobInfo, base SyncBase, owner string) (string, error) {
+	logicalPath = filepath.Clean(logicalPath)
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		b.Abort()
+		return "", err
+	}
+	// synced writers of one path take turns, so only one can win a revision
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	unlock, err := locker.Lock(ctx, "sync:"+lockName(root)+"/"+filepath.ToSlash(logicalPath))
+	if err != nil {
+		b.Abort()
+		return "", err
+	}
+	defer unlock()
+
+	var rev int64
+	if _, e, err := StatFile(masterKey, baseDir, logicalPath); err == nil {
+		rev = e.Rev
+	}
+	if rev == base.Rev {
+		return logicalPath, CommitBlob(masterKey, baseDir, logicalPath, b, info)
+	}
+	copyPath, err := ResolveConflict(masterKey, baseDir, conflictCopyName(logicalPath, base.Device, time.Now()), ConflictRename)
+	if err != nil {
+		b.Abort()
+		return "", err
+	}
+	if b.dst, err = ResolveForCreateAs(masterKey, baseDir, copyPath, owner); err != nil {
+		b.Abort()
+		return "", err
+	}
+	if err := CommitBlob(masterKey, baseDir, copyPath, b, info); err != nil {
+		return "", err
+	}
+	events.Publish(events.Event{Type: events.FileConflict, Path: logicalPath, Copy: copyPath, Size: info.Size})
+	return copyPath, nil
+}
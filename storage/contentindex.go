@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A user's content index lives under <root>/_index/<userID>/, one shard per
+// directory named by an HMAC of its path, each sealed like a manifest but
+// under the key given (theirs, or the master key). A shard maps each
+// indexed file of its directory to the terms of its text; the MD5 recorded
+// with it tells whether the file still holds that text. An upload rewrites
+// only its own directory's shard; a search reads them all.
+const (
+	maxIndexTerms  = 20000 // distinct terms kept per file
+	maxTermLen     = 64
+	excerptLen     = 200
+	MaxIndexedText = 4 << 20 // of each file's text
+)
+
+type contentIndex struct {
+	Docs map[string]*indexedDoc `json:"docs"`
+}
+
+type indexedDoc struct {
+	MD5     string         `json:"md5"`
+	Terms   map[string]int `json:"terms"`
+	Excerpt string         `json:"excerpt"`
+}
+
+// ContentHit is one file matching a content search.
+type ContentHit struct {
+	Path    string `json:"path"`
+	Score   int    `json:"score"`
+	Excerpt string `json:"excerpt"`
+	MD5     string `json:"-"`
+}
+
+func contentIndexDir(baseDir, userID string) string {
+	return filepath.Join(baseDir, "filestorage", "_index", safeID(userID))
+}
+
+// contentShardPath is the shard holding the files of dir.
+func contentShardPath(key []byte, baseDir, userID, dir string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("content-index\x00" + dir))
+	return filepath.Join(contentIndexDir(baseDir, userID), hex.EncodeToString(m.Sum(nil)[:16])+".bin")
+}
+
+func loadContentIndex(key []byte, p string) (*contentIndex, error) {
+	ct, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return &contentIndex{Docs: map[string]*indexedDoc{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptBytes(key, ct)
+	if err != nil {
+		return nil, err
+	}
+	var idx contentIndex
+	if err := json.Unmarshal(plain, &idx); err != nil {
+		return nil, err
+	}
+	if idx.Docs == nil {
+		idx.Docs = map[string]*indexedDoc{}
+	}
+	return &idx, nil
+}
+
+func saveContentIndex(key []byte, p string, idx *contentIndex) error {
+	plain, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	ct, err := encryptBytes(key, plain)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(p, ct)
+}
+
+// updateContentIndex applies fn to the shard of userID's index for dir,
+// under its lock.
+func updateContentIndex(key []byte, baseDir, userID, dir string, fn func(*contentIndex)) error {
+	if err := splitContentIndex(key, baseDir, userID); err != nil {
+		return err
+	}
+	p := contentShardPath(key, baseDir, userID, dir)
+	unlock, err := lockManifest(p)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := loadContentIndex(key, p)
+	if err != nil {
+		return err
+	}
+	fn(idx)
+	if len(idx.Docs) == 0 {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return saveContentIndex(key, p, idx)
+}
+
+// splitContentIndex moves an index kept whole in <root>/_index/<userID>.bin,
+// as it was before shards, into per-directory shards.
+func splitContentIndex(key []byte, baseDir, userID string) error {
+	old := contentIndexDir(baseDir, userID) + ".bin"
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		return nil
+	}
+	unlock, err := lockManifest(old)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := loadContentIndex(key, old)
+	if err != nil {
+		return err
+	}
+	shards := map[string]*contentIndex{}
+	for p, doc := range idx.Docs {
+		dir := filepath.Dir(p)
+		if shards[dir] == nil {
+			shards[dir] = &contentIndex{Docs: map[string]*indexedDoc{}}
+		}
+		shards[dir].Docs[p] = doc
+	}
+	for dir, shard := range shards {
+		if err := saveContentIndex(key, contentShardPath(key, baseDir, userID, dir), shard); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IsText reports whether b looks like text worth indexing: valid UTF-8
+// without NULs. A truncated rune at the end is allowed.
+func IsText(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				b = b[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(b) && !strings.ContainsRune(string(b), 0)
+}
+
+// Terms splits text into lower-cased words of letters and digits.
+func Terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// IndexContent records text as the content of logicalPath, whose bytes
+// have the given MD5, in userID's index, replacing what it held before.
+func IndexContent(key []byte, baseDir, userID, logicalPath, md5sum string, text []byte) error {
+	doc := &indexedDoc{MD5: md5sum, Terms: map[string]int{}}
+	for _, t := range Terms(string(text)) {
+		if _, ok := doc.Terms[t]; !ok && (len(doc.Terms) >= maxIndexTerms || len(t) > maxTermLen) {
+			continue
+		}
+		doc.Terms[t]++
+	}
+	doc.Excerpt = strings.Join(strings.Fields(strings.ToValidUTF8(string(text[:min(len(text), 4*excerptLen)]), "")), " ")
+	if r := []rune(doc.Excerpt); len(r) > excerptLen {
+		doc.Excerpt = string(r[:excerptLen])
+	}
+	logicalPath = filepath.Clean(logicalPath)
+	return updateContentIndex(key, baseDir, userID, filepath.Dir(logicalPath), func(idx *contentIndex) {
+		idx.Docs[logicalPath] = doc
+	})
+}
+
+// UnindexContent drops paths from userID's index.
+func UnindexContent(key []byte, baseDir, userID string, paths ...string) error {
+	byDir := map[string][]string{}
+	for _, p := range paths {
+		byDir[filepath.Dir(p)] = append(byDir[filepath.Dir(p)], p)
+	}
+	for dir, ps := range byDir {
+		err := updateContentIndex(key, baseDir, userID, dir, func(idx *contentIndex) {
+			for _, p := range ps {
+				delete(idx.Docs, p)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchContent returns the files in userID's index holding every term of
+// query, best first. A file scores the sum of its counts of those terms.
+func SearchContent(key []byte, baseDir, userID, query string) ([]ContentHit, error) {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	ents, err := os.ReadDir(contentIndexDir(baseDir, userID))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// an index not yet split is read as one more shard
+	shards := []string{contentIndexDir(baseDir, userID) + ".bin"}
+	for _, e := range ents {
+		if strings.HasSuffix(e.Name(), ".bin") {
+			shards = append(shards, filepath.Join(contentIndexDir(baseDir, userID), e.Name()))
+		}
+	}
+	idx := &contentIndex{Docs: map[string]*indexedDoc{}}
+	for _, p := range shards {
+		shard, err := loadContentIndex(key, p)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(idx.Docs, shard.Docs)
+	}
+	var hits []ContentHit
+	for p, doc := range idx.Docs {
+		score := 0
+		for _, t := range terms {
+			n := doc.Terms[t]
+			if n == 0 {
+				score = 0
+				break
+			}
+			score += n
+		}
+		if score > 0 {
+			hits = append(hits, ContentHit{Path: p, Score: score, Excerpt: doc.Excerpt, MD5: doc.MD5})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+	return hits, nil
+}
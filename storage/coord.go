@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"SCloud/coord"
+	"context"
+	"path/filepath"
+	"time"
+)
+
+// locker serializes manifest changes and chunk assembly. It is in-process
+// by default; instances sharing a store share a Redis or Postgres locker.
+var locker coord.Locker = coord.NewLocal()
+
+// SetLocker replaces the in-process locker.
+func SetLocker(l coord.Locker) { locker = l }
+
+// lockTimeout bounds the wait for a manifest lock.
+const lockTimeout = 30 * time.Second
+
+// lockName identifies dir the same way on every instance, whatever path
+// each mounts the store at.
+func lockName(dir string) string {
+	root, rel := splitRoot(dir)
+	if id, err := rootID(root); err == nil {
+		return id + "/" + filepath.ToSlash(rel)
+	}
+	return dir
+}
+
+// lockManifest holds off other writers of dir's manifest, here and on other
+// instances, from a load to its save.
+func lockManifest(dir string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return locker.Lock(ctx, "manifest:"+lockName(dir))
+}
+
+// lockUserKey holds off other changes to userID's key files under baseDir,
+// here and on other instances, such as a second redemption of the same
+// recovery code.
+func lockUserKey(baseDir, userID string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return locker.Lock(ctx, "userkey:"+lockName(baseDir)+"|"+userID)
+}
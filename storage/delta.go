@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	DefaultDeltaBlock = 64 << 10
+	MinDeltaBlock     = 1 << 10
+	MaxDeltaBlock     = 4 << 20
+)
+
+// BlockSum describes one plaintext block for delta sync. Weak is rsync's
+// rolling checksum (a | b<<16, both mod 2^16) so clients can slide it over
+// their copy byte by byte; Strong confirms a weak match.
+type BlockSum struct {
+	Index  int64  `json:"index"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"` // hex, first 16 bytes of SHA-256
+}
+
+// DeltaOp is one step of a new version: copy a block of the current file,
+// or insert literal bytes the client sent.
+type DeltaOp struct {
+	Block *int64 `json:"block,omitempty"`
+	Data  []byte `json:"data,omitempty"` // base64 in JSON
+}
+
+// ErrBadDelta marks ops that reference blocks the current version lacks.
+var ErrBadDelta = errors.New("invalid delta")
+
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(p))
+	for i, c := range p {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+func strongSum(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Signature returns block checksums of the file's plaintext.
+func Signature(masterKey []byte, baseDir, logicalPath string, blobKey []byte, blockSize int) ([]BlockSum, int64, error) {
+	blobPath, entry, err := StatFile(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if blobKey == nil {
+		blobKey = masterKey
+	}
+	pr, err := openPlain(blobKey, blobPath, entry.Encryption == EncryptionClient)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer pr.Close()
+
+	sums := make([]BlockSum, 0, pr.size/int64(blockSize)+1)
+	buf := make([]byte, blockSize)
+	for off, i := int64(0), int64(0); off < pr.size; off, i = off+int64(blockSize), i+1 {
+		n, err := pr.ReadAt(buf[:min(int64(blockSize), pr.size-off)], off)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		sums = append(sums, BlockSum{Index: i, Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+	}
+	return sums, pr.size, nil
+}
+
+// DeltaSize is the plaintext size ops build against a version of baseSize
+// bytes.
+func DeltaSize(ops []DeltaOp, blockSize int, baseSize int64) (int64, error) {
+	var n int64
+	for i, op := range ops {
+		if op.Block == nil {
+			n += int64(len(op.Data))
+			continue
+		}
+		off := *op.Block * int64(blockSize)
+		if *op.Block < 0 || off >= baseSize {
+			return 0, fmt.Errorf("op %d: block %d out of range: %w", i, *op.Block, ErrBadDelta)
+		}
+		n += min(int64(blockSize), baseSize-off)
+	}
+	return n, nil
+}
+
+// ApplyDelta builds a new version of the file from ops against its current
+// content, provided that is still the version baseETag names (ErrChanged
+// otherwise), re-encrypts it under a fresh header and swaps it in. It
+// returns the new plaintext size.
+func ApplyDelta(masterKey []byte, baseDir, logicalPath, baseETag string, blobKey []byte, blockSize int, ops []DeltaOp) (int64, error) {
+	blobPath, entry, err := StatFile(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return 0, err
+	}
+	unlock := lockBlob(blobPath)
+	defer unlock()
+	// another write may have landed while we waited for the lock
+	if blobPath, entry, err = StatFile(masterKey, baseDir, logicalPath); err != nil {
+		return 0, err
+	}
+	if entry.ETag() != baseETag {
+		return 0, ErrChanged
+	}
+	if err := checkMutable(masterKey, baseDir, logicalPath, entry); err != nil {
+		return 0, err
+	}
+	if blobKey == nil {
+		blobKey = masterKey
+	}
+	raw := entry.Encryption == EncryptionClient
+
+	old, err := openPlain(blobKey, blobPath, raw)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+
+	out, err := CreateBlob(blobPath)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Abort()
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		for i, op := range ops {
+			var err error
+			if op.Block != nil {
+				off := *op.Block * int64(blockSize)
+				if *op.Block < 0 || off >= old.size {
+					err = fmt.Errorf("op %d: block %d out of range: %w", i, *op.Block, ErrBadDelta)
+				} else {
+					_, err = io.Copy(pipeWriter, io.NewSectionReader(old, off, min(int64(blockSize), old.size-off)))
+				}
+			} else {
+				_, err = pipeWriter.Write(op.Data)
+			}
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+
+	counted := &CountReader{R: pipeReader}
+	if raw {
+		_, err = io.Copy(out, counted)
+	} else {
+		err = Encrypt(blobKey, counted, out, 0)
+	}
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return 0, err
+	}
+	return counted.N, CommitBlob(masterKey, baseDir, logicalPath, out, BlobInfo{
+		KeyOwner:   entry.KeyOwner,
+		Encryption: entry.Encryption,
+		Size:       counted.N,
+	})
+}
+
+// plainReader gives random access to a blob's plaintext, decrypting one chunk
+// at a time and keeping the last one for the next (usually sequential) read.
+type plainReader struct {
+	f    *os.File
+	cc   *chunkCipher // nil: client-encrypted, read verbatim
+	recs []chunkRecord
+	size int64
+
+	cur   int
+	plain []byte
+}
+
+func openPlain(key []byte, blobPath string, raw bool) (*plainReader, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	p := &plainReader{f: f, cur: -1}
+	if raw {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		p.size = fi.Size()
+		return p, nil
+	}
+	_, hdr, salt, noncePrefix, err := readHeader(f)
+	if err == nil {
+		p.cc, err = newChunkCipher(key, hdr, salt, noncePrefix)
+	}
+	if err == nil {
+		p.recs, p.size, err = walkRecords(f, p.cc)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *plainReader) ReadAt(b []byte, off int64) (int, error) {
+	if p.cc == nil {
+		return p.f.ReadAt(b, off)
+	}
+	n := 0
+	for len(b) > 0 {
+		if off >= p.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(p.recs), func(i int) bool { return p.recs[i].ptStart+p.recs[i].ptLen > off })
+		if i != p.cur {
+			rec := p.recs[i]
+			ct := make([]byte, rec.ctLen)
+			if _, err := p.f.ReadAt(ct, rec.pos+4); err != nil {
+				return n, err
+			}
+			plain, err := p.cc.open(uint32(i), ct)
+			if err != nil {
+				return n, err
+			}
+			p.cur, p.plain = i, plain
+		}
+		c := copy(b, p.plain[off-p.recs[i].ptStart:])
+		n += c
+		off += int64(c)
+		b = b[c:]
+	}
+	return n, nil
+}
+
+func (p *plainReader) Close() error { return p.f.Close() }
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "errors"
+
+func DiskSpace(dir string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk space is not available on this platform")
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ExportReport struct {
+	Files           int           `json:"files"`
+	Bytes           int64         `json:"bytes"`
+	Skipped         int           `json:"skipped"`          // already exported (resume)
+	ClientEncrypted int           `json:"client_encrypted"` // written as stored; only the client can decrypt them
+	Failures        []FileFailure `json:"failures,omitempty"`
+}
+
+// ExportFile is one plaintext file handed to an ExportSink. Body yields
+// exactly Size bytes unless decryption fails part way.
+type ExportFile struct {
+	Path            string // logical, slash separated, relative to the export prefix
+	Size            int64
+	ModTime         time.Time
+	ClientEncrypted bool
+	Body            io.Reader
+}
+
+// ExportSink writes exported files somewhere. Write reports skipped=true
+// when the destination already holds an identical copy.
+type ExportSink interface {
+	Write(f ExportFile) (skipped bool, err error)
+}
+
+// ExportTree decrypts every file below prefix into sink. It only needs the
+// storage tree and keys, so it works with the HTTP server down. Files whose
+// key is unavailable, or that fail to decrypt, are listed in Failures.
+func ExportTree(masterKey []byte, baseDir, prefix string, keyFor KeyFunc, sink ExportSink, progress func()) (ExportReport, error) {
+	r := ExportReport{}
+	prefix = strings.Trim(filepath.ToSlash(filepath.Clean("/"+prefix)), "/")
+	dir, err := resolveDir(masterKey, baseDir, prefix)
+	if err != nil {
+		return r, err
+	}
+	err = walkFiles(masterKey, dir, ".", func(dir, logical string, e *ManifestEntry) error {
+		if progress != nil {
+			defer progress()
+		}
+		fail := func(err error) error {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+
+		raw := e.Encryption == EncryptionClient
+		key := masterKey
+		if !raw {
+			if key, err = keyFor(e); err != nil {
+				return fail(err)
+			}
+		}
+		pr, err := openPlain(key, blobPath(dir, e), raw)
+		if err != nil {
+			return fail(err)
+		}
+		defer pr.Close()
+
+		skipped, err := sink.Write(ExportFile{
+			Path:            logical,
+			Size:            pr.size,
+			ModTime:         time.Unix(e.ModTime, 0),
+			ClientEncrypted: raw,
+			Body:            io.NewSectionReader(pr, 0, pr.size),
+		})
+		switch {
+		case err != nil:
+			return fail(err)
+		case skipped:
+			r.Skipped++
+		default:
+			r.Files++
+			r.Bytes += pr.size
+			if raw {
+				r.ClientEncrypted++
+			}
+		}
+		return nil
+	})
+	return r, err
+}
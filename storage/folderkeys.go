@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A folder key is a random key a shared directory's files are encrypted
+// under instead of the master key, so it can be handed to grantees or
+// kept for a share link and serve the folder on its own. Directories name
+// their key by ID (FolderKey on the dir's entry); files name it through
+// KeyOwner, so a file moved out of the folder stays readable. A folder key is
+// stored as the master-wrapped user key of its KeyOwner, in the main root's
+// _keys, so everything that resolves KeyOwner keys (and rotate-keys) handles
+// it unchanged.
+const folderKeyPrefix = "folder-"
+
+// FolderKeyOwner is the KeyOwner recorded for blobs under folder key id.
+func FolderKeyOwner(id string) string { return folderKeyPrefix + id }
+
+// FolderKeyID returns the folder key a KeyOwner names, if it names one.
+func FolderKeyID(keyOwner string) (string, bool) {
+	return strings.CutPrefix(keyOwner, folderKeyPrefix)
+}
+
+// EnableFolderKey gives the directory at dirPath a folder key, or returns
+// the one it has. keyDir is the root whose _keys hold it. Only files written
+// afterwards use it; existing ones keep their key.
+func EnableFolderKey(masterKey []byte, baseDir, keyDir, dirPath string) (string, error) {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, dirPath, false)
+	if err != nil {
+		return "", err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return "", err
+	}
+	_, e := findEntry(m, name, "dir")
+	if e == nil {
+		return "", fmt.Errorf("%q is not a directory", dirPath)
+	}
+	if e.FolderKey != "" {
+		return e.FolderKey, nil
+	}
+	key := make([]byte, userKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%08x", KeyID(key))
+	if err := writeUserKey(masterKey, keyDir, FolderKeyOwner(id), "", WrapMaster, key); err != nil {
+		return "", err
+	}
+	e.FolderKey = id
+	return id, saveManifest(masterKey, parentDir, m)
+}
+
+// FolderKeyMatches reports whether key is the folder key keyOwner names.
+func FolderKeyMatches(keyOwner string, key []byte) bool {
+	id, ok := FolderKeyID(keyOwner)
+	return ok && id == fmt.Sprintf("%08x", KeyID(key))
+}
+
+// UnlockFolderKey unwraps folder key id.
+func UnlockFolderKey(masterKey []byte, keyDir, id string) ([]byte, error) {
+	return UnlockUserKey(masterKey, keyDir, FolderKeyOwner(id), "")
+}
+
+// FolderKeyFor returns the folder key covering the directory dirPath: its
+// own, else that of its nearest ancestor with one; "" for none.
+func FolderKeyFor(masterKey []byte, baseDir, dirPath string) (string, error) {
+	cleaned := strings.TrimPrefix(filepath.Clean(dirPath), string(filepath.Separator))
+	dir, err := ensureRoot(masterKey, baseDir)
+	if err != nil || cleaned == "." || cleaned == "" {
+		return "", err
+	}
+	parts := strings.Split(cleaned, string(filepath.Separator))
+	id := ""
+	for _, seg := range parts {
+		m, err := loadManifest(masterKey, dir)
+		if err != nil {
+			return "", err
+		}
+		_, e := findEntry(m, seg, "dir")
+		if e == nil {
+			break
+		}
+		if e.FolderKey != "" {
+			id = e.FolderKey
+		}
+		dir = filepath.Join(dir, e.Enc)
+	}
+	return id, nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"hash"
+)
+
+// Hashes computes the MD5 and SHA-1 of what is written to it: the plaintext
+// sums sync tools such as rclone compare files by. They are recorded on the
+// manifest entry, not used for integrity.
+type Hashes struct {
+	md5, sha1 hash.Hash
+}
+
+func NewHashes() *Hashes {
+	return &Hashes{md5: md5.New(), sha1: sha1.New()}
+}
+
+func (h *Hashes) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	h.sha1.Write(p)
+	return len(p), nil
+}
+
+// Sums returns the hex digests of everything written so far.
+func (h *Hashes) Sums() (md5sum, sha1sum string) {
+	return hex.EncodeToString(h.md5.Sum(nil)), hex.EncodeToString(h.sha1.Sum(nil))
+}
+
+// Digests computed on request rather than at upload.
+const (
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+)
+
+// NewContentHash returns a hash for algo, or false if it is not one of
+// HashSHA256 and HashBLAKE3.
+func NewContentHash(algo string) (hash.Hash, bool) {
+	switch algo {
+	case HashSHA256:
+		return sha256.New(), true
+	case HashBLAKE3:
+		return blake3.New(), true
+	}
+	return nil, false
+}
+
+// CachedHash returns the algo digest recorded on e, "" if there is none.
+func (e *ManifestEntry) CachedHash(algo string) string {
+	switch algo {
+	case HashSHA256:
+		return e.SHA256
+	case HashBLAKE3:
+		return e.BLAKE3
+	}
+	return ""
+}
+
+// SetFileHash records sum as the algo digest of the file at logicalPath,
+// provided the file is still at revision rev; ErrChanged otherwise. It is
+// derived data, so the rev and mod time stay.
+func SetFileHash(masterKey []byte, baseDir, logicalPath string, rev int64, algo, sum string) error {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return err
+	}
+	_, e := findEntry(m, name, "file")
+	if e == nil || e.Rev != rev {
+		return ErrChanged
+	}
+	switch algo {
+	case HashSHA256:
+		e.SHA256 = sum
+	case HashBLAKE3:
+		e.BLAKE3 = sum
+	default:
+		return fmt.Errorf("unknown hash %q", algo)
+	}
+	return saveManifest(masterKey, parentDir, m)
+}
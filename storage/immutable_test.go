@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+// mkfile creates logicalPath under baseDir, parents and all, with a blob.
+func mkfile(t *testing.T, baseDir, logicalPath string) {
+	t.Helper()
+	blob, err := ResolveForCreateAs(testKey, baseDir, logicalPath, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func patch(t *testing.T, baseDir, logicalPath string, p EntryPatch) {
+	t.Helper()
+	if _, err := PatchEntryMeta(testKey, baseDir, logicalPath, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hold(t *testing.T, baseDir, logicalPath string) {
+	t.Helper()
+	on := true
+	patch(t, baseDir, logicalPath, EntryPatch{Immutable: &on})
+}
+
+func TestCheckMutable(t *testing.T) {
+	baseDir := t.TempDir()
+	for _, p := range []string{"free/a.txt", "held/a.txt", "held/sub/b.txt", "frozen.txt"} {
+		mkfile(t, baseDir, p)
+	}
+	hold(t, baseDir, "held")
+	hold(t, baseDir, "frozen.txt")
+
+	for _, tc := range []struct {
+		path string
+		held bool
+	}{
+		{"free/a.txt", false},
+		{"free", false},
+		{"frozen.txt", true},
+		{"held", true},
+		{"held/a.txt", true},
+		{"held/sub", true},
+		{"held/sub/b.txt", true},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			e, err := StatEntry(testKey, baseDir, tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkMutable(testKey, baseDir, tc.path, e)
+			if got := errors.Is(err, ErrImmutable); got != tc.held {
+				t.Errorf("checkMutable = %v, want held %v", err, tc.held)
+			}
+		})
+	}
+
+	// nor may a hold's metadata, tags or expiry change beneath it
+	expires := int64(1)
+	if _, err := PatchEntryMeta(testKey, baseDir, "held/sub/b.txt", EntryPatch{ExpiresAt: &expires}); !errors.Is(err, ErrImmutable) {
+		t.Errorf("PatchEntryMeta below a hold = %v, want ErrImmutable", err)
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type ImportOptions struct {
+	DryRun   bool
+	Owner    string // recorded as owner of everything imported
+	Progress func() // called once per file considered, may be nil
+}
+
+type ImportReport struct {
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Skipped  int           `json:"skipped"` // already imported (resume) or not a regular file
+	DryRun   bool          `json:"dry_run,omitempty"`
+	Failures []FileFailure `json:"failures,omitempty"`
+}
+
+// ImportTree encrypts every regular file under src into baseDir at
+// destPrefix, building manifests as it goes. Files are encrypted under the
+// master key. A file whose entry already has the same size and modification
+// time is skipped, so an interrupted import can simply be run again.
+func ImportTree(masterKey []byte, baseDir, src, destPrefix string, opts ImportOptions) (ImportReport, error) {
+	r := ImportReport{DryRun: opts.DryRun}
+	destPrefix = strings.Trim(path.Clean("/"+filepath.ToSlash(destPrefix)), "/")
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: p, Error: err.Error()})
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if opts.Progress != nil {
+			opts.Progress()
+		}
+		if !d.Type().IsRegular() {
+			r.Skipped++
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		logical := path.Join(destPrefix, filepath.ToSlash(rel))
+		fi, err := d.Info()
+		if err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+
+		if _, e, err := StatFile(masterKey, baseDir, logical); err == nil &&
+			e.Size == fi.Size() && e.ModTime == fi.ModTime().Unix() {
+			r.Skipped++
+			return nil
+		}
+		if opts.DryRun {
+			r.Files++
+			r.Bytes += fi.Size()
+			return nil
+		}
+		if err := importFile(masterKey, baseDir, p, logical, opts.Owner, fi); err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		r.Files++
+		r.Bytes += fi.Size()
+		return nil
+	})
+	return r, err
+}
+
+func importFile(masterKey []byte, baseDir, src, logical, owner string, fi fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dstPath, err := ResolveForCreateAs(masterKey, baseDir, logical, owner)
+	if err != nil {
+		return err
+	}
+	out, err := CreateBlob(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	if err := Encrypt(masterKey, in, out, 0); err != nil {
+		return err
+	}
+	// the source mtime is what makes a re-run skip this file
+	return CommitBlob(masterKey, baseDir, logical, out, BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()})
+}
@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"SCloud/coord"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Manifest saves are atomic on their own, but most mutations pair a manifest
+// change with a blob change and a crash between the two strands one of them.
+// Those mutations are bracketed by begin and commit records in
+// <root>/_journal.<instance>, one file per process sharing the store, each
+// guarded by a journal lock its process holds until it exits. The first
+// ensureRoot of a process replays every begin that never committed in the
+// journals whose lock is free, finishing or undoing it against what is on
+// disk.
+const (
+	journalCreate  = "create"  // entry added ahead of its blob
+	journalReplace = "replace" // blob renamed into place, entry to follow
+	journalRemove  = "remove"  // entry dropped, blob to follow
+	journalCommit  = "commit"
+)
+
+// rewrite the journal down to its open records past this size
+const journalCompactAt = 1 << 20
+
+type journalRecord struct {
+	Seq   uint64        `json:"seq"`
+	Op    string        `json:"op"`
+	Dir   string        `json:"dir,omitempty"` // relative to the root
+	Entry ManifestEntry `json:"entry"`
+	Print string        `json:"print,omitempty"` // replace: fingerprint of the new blob
+}
+
+type journal struct {
+	mu   sync.Mutex
+	key  []byte
+	root string
+	seq  uint64
+	open map[uint64]journalRecord
+	size int64
+
+	creates map[string]uint64 // blob path -> open create
+}
+
+var (
+	journals  sync.Map // root -> *journal
+	journalMu sync.Mutex
+
+	// instanceID names this process's journals.
+	instanceID, _ = randSlugHex(8)
+)
+
+// journalPath is owner's journal under root; the unsuffixed one is what
+// releases before per-instance journals left behind.
+func journalPath(root, owner string) string {
+	if owner == "" {
+		return filepath.Join(root, "_journal")
+	}
+	return filepath.Join(root, "_journal."+owner)
+}
+
+// tryLockJournal takes owner's journal lock under root, failing with
+// coord.ErrHeld while owner is still running.
+func tryLockJournal(root, owner string) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return locker.TryLock(ctx, "journal:"+lockName(root)+"|"+owner)
+}
+
+// openJournal returns this process's journal for root, replaying what
+// departed instances left behind the first time it is asked for, unless the
+// store is read-only.
+func openJournal(masterKey []byte, root string) (*journal, error) {
+	if j, ok := journals.Load(root); ok {
+		return j.(*journal), nil
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if j, ok := journals.Load(root); ok {
+		return j.(*journal), nil
+	}
+	j := &journal{key: masterKey, root: root, open: map[uint64]journalRecord{}, creates: map[string]uint64{}}
+	if readOnly {
+		journals.Store(root, j)
+		return j, nil
+	}
+	// held until the process exits, so no other instance replays our journal
+	unlock, err := tryLockJournal(root, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("journal lock: %w", err)
+	}
+	if err := j.replayOrphans(); err != nil {
+		unlock()
+		return nil, fmt.Errorf("journal replay: %w", err)
+	}
+	journals.Store(root, j)
+	return j, nil
+}
+
+func (j *journal) encode(rec journalRecord) ([]byte, error) {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encryptBytes(j.key, raw)
+	if err != nil {
+		return nil, err
+	}
+	line := base64.StdEncoding.AppendEncode(nil, enc)
+	return append(line, '\n'), nil
+}
+
+func (j *journal) append(rec journalRecord, sync bool) error {
+	line, err := j.encode(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(journalPath(j.root, instanceID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	j.size += int64(len(line))
+	if sync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// begin durably records a mutation before it touches the disk.
+func (j *journal) begin(rec journalRecord) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	rec.Seq = j.seq
+	if err := j.append(rec, true); err != nil {
+		return 0, err
+	}
+	j.open[rec.Seq] = rec
+	return rec.Seq, nil
+}
+
+// commit marks a mutation finished. Replay is idempotent, so a lost commit
+// only costs a redundant check; the record isn't synced.
+func (j *journal) commit(seq uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.open[seq]; !ok {
+		return
+	}
+	delete(j.open, seq)
+	var err error
+	switch {
+	case len(j.open) == 0:
+		err = os.Truncate(journalPath(j.root, instanceID), 0)
+		j.size = 0
+	case j.size > journalCompactAt:
+		err = j.compact()
+	default:
+		err = j.append(journalRecord{Seq: seq, Op: journalCommit}, false)
+	}
+	if err != nil {
+		log.Printf("journal %s: %v", j.root, err)
+	}
+}
+
+func (j *journal) compact() error {
+	seqs := make([]uint64, 0, len(j.open))
+	for s := range j.open {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	var buf bytes.Buffer
+	for _, s := range seqs {
+		line, err := j.encode(j.open[s])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+	tmp := journalPath(j.root, instanceID) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	j.size = int64(buf.Len())
+	return os.Rename(tmp, journalPath(j.root, instanceID))
+}
+
+// beginCreate journals a new entry; it stays open until CommitBlob gives
+// the entry a blob.
+func (j *journal) beginCreate(dir string, e ManifestEntry) error {
+	rel, err := filepath.Rel(j.root, dir)
+	if err != nil {
+		return err
+	}
+	seq, err := j.begin(journalRecord{Op: journalCreate, Dir: rel, Entry: e})
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.creates[blobPath(dir, &e)] = seq
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *journal) commitCreate(blobPath string) {
+	j.mu.Lock()
+	seq, ok := j.creates[blobPath]
+	delete(j.creates, blobPath)
+	j.mu.Unlock()
+	if ok {
+		j.commit(seq)
+	}
+}
+
+// replayOrphans replays every journal under root whose owner no longer
+// holds its lock. Two instances starting together race for each lock, so
+// only one of them replays a given journal.
+func (j *journal) replayOrphans() error {
+	paths, err := filepath.Glob(journalPath(j.root, "") + "*")
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		owner := strings.TrimPrefix(strings.TrimPrefix(name, "_journal"), ".")
+		if owner == instanceID {
+			continue
+		}
+		unlock, err := tryLockJournal(j.root, owner)
+		if errors.Is(err, coord.ErrHeld) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = j.replay(p)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) replay(path string) error {
+	// a compaction cut short never replaced the journal it was rewriting
+	os.Remove(path + ".tmp")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	open := map[uint64]journalRecord{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var rec journalRecord
+		enc, err := base64.StdEncoding.DecodeString(sc.Text())
+		if err == nil {
+			var raw []byte
+			if raw, err = decryptBytes(j.key, enc); err == nil {
+				err = json.Unmarshal(raw, &rec)
+			}
+		}
+		if err != nil {
+			break // torn tail from the crash
+		}
+		if rec.Op == journalCommit {
+			delete(open, rec.Seq)
+		} else {
+			open[rec.Seq] = rec
+		}
+	}
+	seqs := make([]uint64, 0, len(open))
+	for s := range open {
+		seqs = append(seqs, s)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	for _, s := range seqs {
+		if err := j.reconcile(open[s]); err != nil {
+			return err
+		}
+	}
+	if len(seqs) > 0 {
+		log.Printf("journal: settled %d unfinished manifest changes in %s", len(seqs), j.root)
+	}
+	return os.Remove(path)
+}
+
+// reconcile settles one mutation that was cut short.
+func (j *journal) reconcile(rec journalRecord) error {
+	dir := filepath.Join(j.root, rec.Dir)
+	// other instances may be live and writing the same manifest
+	unlock, err := lockManifest(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(j.key, dir)
+	if err != nil {
+		return err
+	}
+	idx := -1
+	for i, e := range m.Entries {
+		if e.Enc == rec.Entry.Enc && e.Type == rec.Entry.Type {
+			idx = i
+		}
+	}
+	blob := blobPath(dir, &rec.Entry)
+
+	switch rec.Op {
+	case journalCreate:
+		// the upload never produced a blob: drop the placeholder
+		if _, err := os.Stat(blob); idx >= 0 && os.IsNotExist(err) {
+			m.Entries = append(m.Entries[:idx], m.Entries[idx+1:]...)
+			return saveManifest(j.key, dir, m)
+		}
+	case journalReplace:
+		// the new blob made it into place: record it
+		if print, err := blobFingerprint(blob); err == nil && print == rec.Print && idx >= 0 {
+			e := &m.Entries[idx]
+			e.KeyOwner, e.Encryption = rec.Entry.KeyOwner, rec.Entry.Encryption
+			e.Size, e.ModTime = rec.Entry.Size, rec.Entry.ModTime
+			e.MD5, e.SHA1 = rec.Entry.MD5, rec.Entry.SHA1
+			e.SHA256, e.BLAKE3 = rec.Entry.SHA256, rec.Entry.BLAKE3
+			e.Rev = max(e.Rev, rec.Entry.Rev)
+			return saveManifest(j.key, dir, m)
+		}
+	case journalRemove:
+		// the entry is gone: finish deleting its data
+		if idx < 0 {
+			if rec.Entry.Type == "dir" {
+				removeMirrors(filepath.Join(dir, rec.Entry.Enc))
+				return os.RemoveAll(filepath.Join(dir, rec.Entry.Enc))
+			}
+			if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blobFingerprint identifies one write of a blob: every encrypted blob
+// starts with a fresh salt, so its size and first bytes are enough.
+func blobFingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|", fi.Size())
+	if _, err := io.CopyN(h, f, 4096); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		op         string
+		typ        string
+		inManifest bool // the entry is listed when the process dies
+		onDisk     bool // so is its blob, or its directory
+		stalePrint bool // replace: the blob on disk is not the journaled one
+
+		wantEntry bool
+		wantSize  int64
+		wantDisk  bool
+	}{
+		{name: "create without blob", op: journalCreate, typ: "file", inManifest: true, wantEntry: false},
+		{name: "create with blob", op: journalCreate, typ: "file", inManifest: true, onDisk: true, wantEntry: true, wantSize: 1, wantDisk: true},
+		{name: "replace landed", op: journalReplace, typ: "file", inManifest: true, onDisk: true, wantEntry: true, wantSize: 8, wantDisk: true},
+		{name: "replace not landed", op: journalReplace, typ: "file", inManifest: true, onDisk: true, stalePrint: true, wantEntry: true, wantSize: 1, wantDisk: true},
+		{name: "remove file", op: journalRemove, typ: "file", onDisk: true, wantDisk: false},
+		{name: "remove dir", op: journalRemove, typ: "dir", onDisk: true, wantDisk: false},
+		{name: "remove not done", op: journalRemove, typ: "file", inManifest: true, onDisk: true, wantEntry: true, wantSize: 1, wantDisk: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "filestorage")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			e := ManifestEntry{Name: "a", Enc: "0123abcd", Type: tc.typ, Size: 1}
+			m := &DirManifest{Version: 1}
+			if tc.inManifest {
+				m.Entries = append(m.Entries, e)
+			}
+			if err := saveManifest(testKey, root, m); err != nil {
+				t.Fatal(err)
+			}
+			data := blobPath(root, &e)
+			if tc.typ == "dir" {
+				data = filepath.Join(root, e.Enc)
+			}
+			if tc.onDisk {
+				var err error
+				if tc.typ == "dir" {
+					err = os.MkdirAll(filepath.Join(data, "sub"), 0755)
+				} else {
+					err = os.WriteFile(data, []byte("new data"), 0600)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := journalRecord{Op: tc.op, Dir: ".", Entry: e}
+			if tc.op == journalReplace {
+				rec.Entry.Size = 8
+				rec.Print, _ = blobFingerprint(data)
+				if tc.stalePrint {
+					rec.Print = "stale"
+				}
+			}
+			// left behind by an instance that has since gone
+			dead := &journal{key: testKey, root: root, open: map[uint64]journalRecord{}}
+			if _, err := dead.begin(rec); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(journalPath(root, instanceID), journalPath(root, "gone")); err != nil {
+				t.Fatal(err)
+			}
+
+			j := &journal{key: testKey, root: root}
+			if err := j.replayOrphans(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(journalPath(root, "gone")); !os.IsNotExist(err) {
+				t.Errorf("journal still there after replay: %v", err)
+			}
+			m, err := loadManifest(testKey, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, got := findAnyEntry(m, e.Name)
+			if (got != nil) != tc.wantEntry {
+				t.Fatalf("entry listed %v, want %v", got != nil, tc.wantEntry)
+			}
+			if got != nil && got.Size != tc.wantSize {
+				t.Errorf("size %d, want %d", got.Size, tc.wantSize)
+			}
+			if _, err := os.Stat(data); (err == nil) != tc.wantDisk {
+				t.Errorf("data on disk %v, want %v", err == nil, tc.wantDisk)
+			}
+		})
+	}
+}
+
+func TestJournalReplaySkipsLiveInstances(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "filestorage")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveManifest(testKey, root, &DirManifest{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := tryLockJournal(root, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	live := journalPath(root, "live")
+	if err := os.WriteFile(live, []byte("not ours to read\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &journal{key: testKey, root: root}
+	if err := j.replayOrphans(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("live instance's journal: %v", err)
+	}
+}
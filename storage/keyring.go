@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+)
+
+// Blob and manifest headers name the key they were sealed under by its key
+// ID, a fingerprint of the key. Data sealed under a retired master key keeps
+// decrypting as long as that key is registered with RetireKeys, while new
+// writes use whatever key the caller passes (the current one). The
+// rotate-keys job re-seals everything under the current key, after which the
+// retired key can be dropped.
+//
+// Blobs written before key IDs existed carry none and decrypt only under the
+// key passed in, so run rotate-keys once before switching master keys.
+// Snapshots and restore points keep the key they were taken under; retire a
+// key only once those are gone too.
+var (
+	keyIDs  sync.Map // string(key) -> uint32
+	retired sync.Map // key ID -> []byte
+)
+
+// KeyID returns the ID a header records for key.
+func KeyID(key []byte) uint32 {
+	if id, ok := keyIDs.Load(string(key)); ok {
+		return id.(uint32)
+	}
+	var b [4]byte
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("key-id:v1")), b[:])
+	id := binary.BigEndian.Uint32(b[:])
+	keyIDs.Store(string(key), id)
+	return id
+}
+
+// RetireKeys registers old master keys so data sealed under them stays
+// readable.
+func RetireKeys(keys ...[]byte) {
+	for _, k := range keys {
+		retired.Store(KeyID(k), k)
+	}
+}
+
+func retiredKeys() [][]byte {
+	var keys [][]byte
+	retired.Range(func(_, k any) bool {
+		keys = append(keys, k.([]byte))
+		return true
+	})
+	return keys
+}
+
+// openingKey picks the key that opens a header: key itself, or the retired key
+// the header names.
+func openingKey(key, hdr []byte) ([]byte, error) {
+	id, ok := headerKeyID(hdr)
+	if !ok || id == KeyID(key) {
+		return key, nil
+	}
+	if k, ok := retired.Load(id); ok {
+		return k.([]byte), nil
+	}
+	return nil, fmt.Errorf("sealed under key %08x, which is neither the given key nor a retired one", id)
+}
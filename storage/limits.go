@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bound the shape of a tree, so no manifest grows until every
+// operation on it crawls. Zero means no limit. They are checked when an
+// entry is created; what already exists stays.
+type Limits struct {
+	DirEntries int // entries (files and folders) in one directory
+	UserFiles  int // files one user owns in one tree
+	Depth      int // folders an entry may be nested in, plus one
+	NameLength int // bytes in one file or folder name
+}
+
+// What a LimitError says was exceeded.
+const (
+	LimitDirEntries = "dir_entries"
+	LimitUserFiles  = "user_files"
+	LimitDepth      = "depth"
+	LimitNameLength = "name_length"
+)
+
+// LimitError is a create refused by one of the Limits.
+type LimitError struct {
+	Limit string
+	Max   int
+	Path  string // the entry that would have been created
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case LimitDirEntries:
+		return fmt.Sprintf("%s: the folder already holds %d entries", e.Path, e.Max)
+	case LimitUserFiles:
+		return fmt.Sprintf("%s: the owner already has %d files here", e.Path, e.Max)
+	case LimitDepth:
+		return fmt.Sprintf("%s: paths may be at most %d deep", e.Path, e.Max)
+	default:
+		return fmt.Sprintf("%s: names may be at most %d bytes", e.Path, e.Max)
+	}
+}
+
+var (
+	limitsMu sync.Mutex
+	limits   Limits
+)
+
+// SetLimits sets the limits every tree of the process is held to.
+func SetLimits(l Limits) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limits = l
+	ownerCounts = map[string]*ownerCount{}
+}
+
+func currentLimits() Limits {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	return limits
+}
+
+// CheckPath checks the depth of logicalPath and the length of its names.
+func CheckPath(logicalPath string) error {
+	l := currentLimits()
+	parts := strings.Split(strings.Trim(filepath.Clean(logicalPath), "/"), "/")
+	for i, seg := range parts {
+		if err := l.checkName(strings.Join(parts[:i+1], "/"), seg, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkName checks a new entry, name at depth in the tree.
+func (l Limits) checkName(logicalPath, name string, depth int) error {
+	if l.Depth > 0 && depth > l.Depth {
+		return &LimitError{Limit: LimitDepth, Max: l.Depth, Path: logicalPath}
+	}
+	if l.NameLength > 0 && len(name) > l.NameLength {
+		return &LimitError{Limit: LimitNameLength, Max: l.NameLength, Path: logicalPath}
+	}
+	return nil
+}
+
+// checkRoom checks that the directory manifest m has room for one more
+// entry.
+func (l Limits) checkRoom(logicalPath string, m *DirManifest) error {
+	if l.DirEntries > 0 && len(m.Entries) >= l.DirEntries {
+		return &LimitError{Limit: LimitDirEntries, Max: l.DirEntries, Path: logicalPath}
+	}
+	return nil
+}
+
+// Files per owner are counted by walking the tree, at most once every
+// ownerCountTTL; creates in between add to the count. Deletes only show at
+// the next walk, so until then the count errs high.
+const ownerCountTTL = time.Minute
+
+type ownerCount struct {
+	counted time.Time
+	files   map[string]int
+}
+
+var ownerCounts = map[string]*ownerCount{} // root -> counts, under limitsMu
+
+// checkOwnerFiles checks that owner may have one more file in the tree at
+// root, and counts it if so.
+func (l Limits) checkOwnerFiles(masterKey []byte, root, logicalPath, owner string) error {
+	if l.UserFiles <= 0 || owner == "" {
+		return nil
+	}
+	limitsMu.Lock()
+	c := ownerCounts[root]
+	limitsMu.Unlock()
+	if c == nil || time.Since(c.counted) > ownerCountTTL {
+		fresh := &ownerCount{counted: time.Now(), files: map[string]int{}}
+		if err := walkOwnerFiles(masterKey, root, fresh.files); err != nil {
+			return err
+		}
+		c = fresh
+	}
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	if cur := ownerCounts[root]; cur != nil && !cur.counted.Before(c.counted) {
+		c = cur
+	}
+	ownerCounts[root] = c
+	if c.files[owner] >= l.UserFiles {
+		return &LimitError{Limit: LimitUserFiles, Max: l.UserFiles, Path: logicalPath}
+	}
+	c.files[owner]++
+	return nil
+}
+
+func walkOwnerFiles(masterKey []byte, dir string, into map[string]int) error {
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		switch e.Type {
+		case "file":
+			into[e.Owner]++
+		case "dir":
+			if err := walkOwnerFiles(masterKey, filepath.Join(dir, e.Enc), into); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gcGrace protects blobs and dirs that were created on disk but whose manifest
+// entry may not have been saved yet by an in-flight request.
+const gcGrace = time.Hour
+
+// walkFiles calls fn for every file entry below dir, depth first.
+func walkFiles(masterKey []byte, dir, logical string, fn func(dir, logical string, e *ManifestEntry) error) error {
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		p := path.Join(logical, e.Name)
+		switch e.Type {
+		case "file":
+			if err := fn(dir, p, e); err != nil {
+				return err
+			}
+		case "dir":
+			if err := walkFiles(masterKey, filepath.Join(dir, e.Enc), p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkDirs calls fn for every directory (including the root) below root.
+func walkDirs(masterKey []byte, dir string, fn func(dir string) error) error {
+	if err := fn(dir); err != nil {
+		return err
+	}
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		if e.Type == "dir" {
+			if err := walkDirs(masterKey, filepath.Join(dir, e.Enc), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dirSize(dir string) int64 {
+	var n int64
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+type DiskStats struct {
+	EncryptedBytes int64 `json:"encrypted_bytes"` // blobs + manifests on disk
+	Blobs          int   `json:"blobs"`
+	StagingUploads int   `json:"staging_uploads"`
+	StagingBytes   int64 `json:"staging_bytes"`
+}
+
+// StorageStats measures what is physically on disk under baseDir's storage
+// root, its mirrors on the volumes, and its staging dir.
+func StorageStats(baseDir string) (DiskStats, error) {
+	var st DiskStats
+	root := filepath.Join(baseDir, "filestorage")
+	staging := stagingRoot(root)
+	trees := []string{root}
+	for _, vol := range Volumes() {
+		if mirror, err := volumeMirror(vol, root); err == nil {
+			trees = append(trees, mirror)
+		}
+	}
+	for _, tree := range trees {
+		err := filepath.Walk(tree, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if p == staging {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(p, ".bin") {
+				st.EncryptedBytes += info.Size()
+				if info.Name() != manifestFileName {
+					st.Blobs++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return st, err
+		}
+	}
+	ents, err := os.ReadDir(staging)
+	if err != nil && !os.IsNotExist(err) {
+		return st, err
+	}
+	for _, de := range ents {
+		if de.IsDir() {
+			st.StagingUploads++
+			st.StagingBytes += dirSize(filepath.Join(staging, de.Name()))
+		}
+	}
+	return st, nil
+}
+
+type GCReport struct {
+	OrphanBlobs  int   `json:"orphan_blobs"`
+	OrphanDirs   int   `json:"orphan_dirs"`
+	StaleTemps   int   `json:"stale_temps"`
+	StaleUploads int   `json:"stale_uploads"`
+	FreedBytes   int64 `json:"freed_bytes"`
+}
+
+// CollectGarbage removes blobs and slug dirs no manifest references, leftover
+// temp files, and chunk staging dirs stagingMaxAge says have expired.
+func CollectGarbage(masterKey []byte, baseDir string, stagingMaxAge StagingPolicy) (GCReport, error) {
+	var r GCReport
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return r, err
+	}
+	cutoff := time.Now().Add(-gcGrace)
+
+	err = walkDirs(masterKey, root, func(dir string) error {
+		m, err := loadManifest(masterKey, dir)
+		if err != nil {
+			return err
+		}
+		// dir's blobs and subdirs may sit beside its manifest and in its
+		// mirror on each volume
+		places := []string{dir}
+		for _, vol := range Volumes() {
+			if mirror, err := volumeMirror(vol, dir); err == nil {
+				places = append(places, mirror)
+			}
+		}
+		referenced := map[string]bool{filepath.Join(dir, manifestFileName): true}
+		for _, e := range m.Entries {
+			if e.Type == "dir" {
+				for _, p := range places {
+					referenced[filepath.Join(p, e.Enc)] = true
+				}
+			} else {
+				referenced[blobPath(dir, &e)] = true
+			}
+		}
+		for i, place := range places {
+			ents, err := os.ReadDir(place)
+			if i > 0 && os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, de := range ents {
+				name := de.Name()
+				p := filepath.Join(place, name)
+				if referenced[p] || (dir == root && strings.HasPrefix(name, "_")) {
+					continue
+				}
+				info, err := de.Info()
+				if err != nil || info.ModTime().After(cutoff) {
+					continue
+				}
+				switch {
+				case de.IsDir():
+					r.FreedBytes += dirSize(p)
+					r.OrphanDirs++
+					_ = os.RemoveAll(p)
+				case strings.HasSuffix(name, ".tmp"):
+					r.FreedBytes += info.Size()
+					r.StaleTemps++
+					_ = os.Remove(p)
+				case strings.HasSuffix(name, ".bin"):
+					r.FreedBytes += info.Size()
+					r.OrphanBlobs++
+					_ = os.Remove(p)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+
+	n, freed, err := ReapStaging(masterKey, baseDir, stagingMaxAge)
+	r.StaleUploads += n
+	r.FreedBytes += freed
+	return r, err
+}
+
+// StagingPolicy returns how long an unfinished upload by owner ("" when
+// not known) keeps its staged chunks.
+type StagingPolicy func(owner string) time.Duration
+
+// ReapStaging removes the chunk staging dirs untouched for longer than
+// their owner's maxAge, returning how many went and the bytes freed.
+func ReapStaging(masterKey []byte, baseDir string, maxAge StagingPolicy) (int, int64, error) {
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	staging := stagingRoot(root)
+	ents, err := os.ReadDir(staging)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	var n int
+	var freed int64
+	for _, de := range ents {
+		info, err := de.Info()
+		if err != nil || !de.IsDir() {
+			continue
+		}
+		p := filepath.Join(staging, de.Name())
+		owner := ""
+		if st, err := loadUploadState(masterKey, p); err == nil {
+			owner = st.Owner
+		}
+		if time.Since(info.ModTime()) < maxAge(owner) {
+			continue
+		}
+		freed += dirSize(p)
+		n++
+		_ = os.RemoveAll(p)
+	}
+	return n, freed, nil
+}
+
+type FileFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type ScrubReport struct {
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`   // plaintext bytes verified
+	Skipped  int           `json:"skipped"` // client-encrypted or key unavailable
+	Failures []FileFailure `json:"failures"`
+}
+
+// KeyFunc returns the key that decrypts an entry's blob.
+type KeyFunc func(e *ManifestEntry) ([]byte, error)
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Scrub decrypts every blob end to end, verifying each chunk's authentication
+// tag and the recorded plaintext size. progress is called once per file.
+func Scrub(masterKey []byte, baseDir string, keyFor KeyFunc, progress func()) (ScrubReport, error) {
+	r := ScrubReport{Failures: []FileFailure{}}
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return r, err
+	}
+	err = walkFiles(masterKey, root, ".", func(dir, logical string, e *ManifestEntry) error {
+		defer progress()
+		if e.Encryption == EncryptionClient {
+			r.Skipped++
+			return nil
+		}
+		key, err := keyFor(e)
+		if err != nil {
+			r.Skipped++
+			return nil
+		}
+		r.Files++
+		f, err := os.Open(blobPath(dir, e))
+		if err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		defer f.Close()
+		var cw countingWriter
+		if err := Decrypt(key, f, &cw); err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		if e.Size > 0 && cw.n != e.Size {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: fmt.Sprintf("size %d, manifest says %d", cw.n, e.Size)})
+		}
+		r.Bytes += cw.n
+		return nil
+	})
+	return r, err
+}
+
+type RekeyReport struct {
+	Files     int           `json:"files"`
+	Manifests int           `json:"manifests"`
+	UserKeys  int           `json:"user_keys"`
+	Skipped   int           `json:"skipped"`
+	Failures  []FileFailure `json:"failures"`
+}
+
+// RekeyFiles re-encrypts every blob and manifest with a fresh salt and nonce
+// prefix, which rotates every derived per-file key under the same master or
+// user key. Each blob is rewritten to a temp file and renamed into place.
+// Anything sealed under a retired master key moves to masterKey, master-
+// wrapped user keys included.
+func RekeyFiles(masterKey []byte, baseDir string, keyFor KeyFunc, progress func()) (RekeyReport, error) {
+	r := RekeyReport{Failures: []FileFailure{}}
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return r, err
+	}
+	if r.UserKeys, err = RewrapUserKeys(masterKey, baseDir); err != nil {
+		return r, err
+	}
+	err = walkFiles(masterKey, root, ".", func(dir, logical string, e *ManifestEntry) error {
+		defer progress()
+		if e.Encryption == EncryptionClient {
+			r.Skipped++
+			return nil
+		}
+		key, err := keyFor(e)
+		if err != nil {
+			r.Skipped++
+			return nil
+		}
+		if err := rekeyBlob(key, blobPath(dir, e)); err != nil {
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+			return nil
+		}
+		r.Files++
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	err = walkDirs(masterKey, root, func(dir string) error {
+		unlock, err := lockManifest(dir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		m, err := loadManifest(masterKey, dir)
+		if err != nil {
+			return err
+		}
+		r.Manifests++
+		return saveManifest(masterKey, dir, m)
+	})
+	return r, err
+}
+
+// rekeyBlob rewrites a blob under the blob lock, so that no append, patch
+// or delta lands in the copy being replaced.
+func rekeyBlob(key []byte, blobPath string) error {
+	unlock := lockBlob(blobPath)
+	defer unlock()
+	return rewriteBlob(key, blobPath, 0)
+}
+
+// rewriteBlob re-encrypts a blob under a fresh salt, in the given format
+// version (0 keeps the current one). The caller holds the blob lock.
+func rewriteBlob(key []byte, blobPath string, version byte) error {
+	in, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	chunkSize, hdr, _, _, err := readHeader(in)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		version = headerVersion(hdr)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(blobPath), filepath.Base(blobPath)+".rekey.*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(Decrypt(key, in, pw)) }()
+	if err := encryptVersion(key, pr, out, chunkSize, version); err != nil {
+		pr.CloseWithError(err)
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	out.Close()
+	return os.Rename(tmp, blobPath)
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"SCloud/events"
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -20,12 +22,64 @@ type ManifestEntry struct {
 	Size    int64  `json:"size,omitempty"` // plaintext size (files)
 	Created int64  `json:"created,omitempty"`
 	ModTime int64  `json:"mod_time,omitempty"`
+	Rev     int64  `json:"rev,omitempty"`   // bumped on every content/meta update
+	Owner   string `json:"owner,omitempty"` // user ID of the creator; "" = unowned
+
+	Tags []string          `json:"tags,omitempty"` // normalized (trimmed, lowercase, sorted, unique)
+	Meta map[string]string `json:"meta,omitempty"` // free-form user metadata
+
+	KeyOwner   string `json:"key_owner,omitempty"`  // user whose key encrypts the blob (or FolderKeyOwner); "" = master key
+	FolderKey  string `json:"folder_key,omitempty"` // dirs: ID of the folder key new files beneath use
+	Encryption string `json:"encryption,omitempty"` // "" = server-side AEAD, EncryptionClient = stored verbatim
+	Volume     string `json:"volume,omitempty"`     // files: volume holding the blob; "" = beside the manifest
+
+	MD5  string `json:"md5,omitempty"` // files: hex digests of the content as downloaded; "" = not recorded
+	SHA1 string `json:"sha1,omitempty"`
+
+	SHA256 string `json:"sha256,omitempty"` // files: computed on request and kept until the content changes
+	BLAKE3 string `json:"blake3,omitempty"`
+
+	ExpiresAt int64 `json:"expires_at,omitempty"` // unix seconds; purged by the expiry sweeper
+
+	Immutable      bool  `json:"immutable,omitempty"`       // WORM / legal hold
+	ImmutableUntil int64 `json:"immutable_until,omitempty"` // unix seconds; 0 = indefinitely
+
+	Quarantine *Quarantine `json:"quarantine,omitempty"` // files: set aside; nil = servable
 }
+
+// EncryptionClient marks blobs the client encrypted itself; the server stores
+// and serves them byte-for-byte.
+const EncryptionClient = "client"
+
 type DirManifest struct {
 	Version int             `json:"version"`
 	Entries []ManifestEntry `json:"entries"`
 }
 
+// ETag returns a strong validator for the entry's current revision.
+// The slug is hashed so the on-disk name never leaks to clients.
+func (e *ManifestEntry) ETag() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d", e.Enc, e.Rev, e.Size, e.ModTime)))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// DirETag returns a validator for the listing of the directory at
+// logicalPath. It hashes the sealed manifest rather than opening it, so
+// checking it costs no decryption; every save reseals with a fresh nonce,
+// so any change to the directory changes it.
+func DirETag(masterKey []byte, baseDir, logicalPath string) (string, error) {
+	dir, err := resolveDir(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := os.ReadFile(manifestPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	sum := sha256.Sum256(sealed)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
+
 func manifestPath(dir string) string { return filepath.Join(dir, manifestFileName) }
 
 func randSlugHex(nBytes int) (string, error) {
@@ -101,6 +155,14 @@ func ensureRoot(masterKey []byte, baseDir string) (string, error) {
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return "", err
 	}
+	if _, err := openJournal(masterKey, root); err != nil {
+		return "", err
+	}
+	// only a new store needs its root manifest written; this keeps reads
+	// working on a read-only mount
+	if _, err := os.Stat(manifestPath(root)); err == nil || readOnly {
+		return root, nil
+	}
 	m, err := loadManifest(masterKey, root)
 	if err != nil {
 		return "", err
@@ -117,10 +179,29 @@ func findEntry(m *DirManifest, name, typ string) (int, *ManifestEntry) {
 			return i, &m.Entries[i]
 		}
 	}
+	name = NormalizeName(name)
+	for i := range m.Entries {
+		if m.Entries[i].Type == typ && sameName(m.Entries[i].Name, name) {
+			return i, &m.Entries[i]
+		}
+	}
 	return -1, nil
 }
 
+// findAnyEntry looks up name regardless of type, preferring files over dirs.
+func findAnyEntry(m *DirManifest, name string) (int, *ManifestEntry) {
+	if i, e := findEntry(m, name, "file"); e != nil {
+		return i, e
+	}
+	return findEntry(m, name, "dir")
+}
+
 func resolveParentDir(masterKey []byte, baseDir, logicalPath string, create bool) (string, string, error) {
+	return resolveParentDirAs(masterKey, baseDir, logicalPath, create, "")
+}
+
+// resolveParentDirAs is resolveParentDir recording owner on any directories it creates.
+func resolveParentDirAs(masterKey []byte, baseDir, logicalPath string, create bool, owner string) (string, string, error) {
 	cleaned := filepath.Clean(logicalPath)
 	parts := strings.Split(cleaned, string(filepath.Separator))
 	if len(parts) == 0 {
@@ -129,6 +210,9 @@ func resolveParentDir(masterKey []byte, baseDir, logicalPath string, create bool
 	if parts[0] == "" {
 		parts = parts[1:]
 	}
+	for i := range parts {
+		parts[i] = NormalizeName(parts[i])
+	}
 
 	finalName := parts[len(parts)-1]
 	dirs := parts[:len(parts)-1]
@@ -139,7 +223,7 @@ func resolveParentDir(masterKey []byte, baseDir, logicalPath string, create bool
 	}
 	curDir := root
 
-	for _, seg := range dirs {
+	for i, seg := range dirs {
 		m, err := loadManifest(masterKey, curDir)
 		if err != nil {
 			return "", "", err
@@ -151,44 +235,143 @@ func resolveParentDir(masterKey []byte, baseDir, logicalPath string, create bool
 		if !create {
 			return "", "", fmt.Errorf("dir %q not found", seg)
 		}
-		// create new dir + manifest
+		// create new dir + manifest, unless another writer just did
+		unlock, err := lockManifest(curDir)
+		if err != nil {
+			return "", "", err
+		}
+		if m, err = loadManifest(masterKey, curDir); err != nil {
+			unlock()
+			return "", "", err
+		}
+		if _, e := findEntry(m, seg, "dir"); e != nil {
+			unlock()
+			curDir = filepath.Join(curDir, e.Enc)
+			continue
+		}
+		if err := validName(seg); err != nil {
+			unlock()
+			return "", "", err
+		}
+		l, rel := currentLimits(), strings.Join(dirs[:i+1], "/")
+		if err := l.checkName(rel, seg, i+1); err != nil {
+			unlock()
+			return "", "", err
+		}
+		if err := l.checkRoom(rel, m); err != nil {
+			unlock()
+			return "", "", err
+		}
 		slug, _ := randSlugHex(16)
 		_ = os.MkdirAll(filepath.Join(curDir, slug), 0755)
 		now := time.Now().Unix()
-		m.Entries = append(m.Entries, ManifestEntry{Name: seg, Enc: slug, Type: "dir", Created: now, ModTime: now})
+		m.Entries = append(m.Entries, ManifestEntry{Name: seg, Enc: slug, Type: "dir", Created: now, ModTime: now, Owner: owner})
 		saveManifest(masterKey, curDir, m)
+		unlock()
 		curDir = filepath.Join(curDir, slug)
 		saveManifest(masterKey, curDir, &DirManifest{Version: 1, Entries: nil})
+		events.Publish(events.Event{Type: events.DirCreated, Path: strings.Join(dirs[:i+1], "/")})
 	}
 	return curDir, finalName, nil
 }
 
 func ResolveForCreate(masterKey []byte, baseDir, logicalPath string) (string, error) {
-	parentDir, fileName, err := resolveParentDir(masterKey, baseDir, logicalPath, true)
+	return ResolveForCreateAs(masterKey, baseDir, logicalPath, "")
+}
+
+// ResolveForCreateAs is ResolveForCreate recording owner on the new file and
+// on any directories created along the way. Existing entries keep their owner.
+func ResolveForCreateAs(masterKey []byte, baseDir, logicalPath, owner string) (string, error) {
+	// a path too deep or too long must not leave its folders behind
+	if err := CheckPath(logicalPath); err != nil {
+		return "", err
+	}
+	parentDir, fileName, err := resolveParentDirAs(masterKey, baseDir, logicalPath, true, owner)
 	if err != nil {
 		return "", err
 	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 	m, _ := loadManifest(masterKey, parentDir)
 	if _, e := findEntry(m, fileName, "file"); e != nil {
-		return filepath.Join(parentDir, e.Enc+".bin"), nil
+		if err := checkMutable(masterKey, baseDir, logicalPath, e); err != nil {
+			return "", err
+		}
+		return blobPath(parentDir, e), nil
+	}
+	if err := validName(fileName); err != nil {
+		return "", err
+	}
+	l := currentLimits()
+	if err := l.checkRoom(logicalPath, m); err != nil {
+		return "", err
+	}
+	if err := l.checkOwnerFiles(masterKey, filepath.Join(baseDir, "filestorage"), logicalPath, owner); err != nil {
+		return "", err
 	}
 	slug, _ := randSlugHex(16)
 	now := time.Now().Unix()
-	m.Entries = append(m.Entries, ManifestEntry{Name: fileName, Enc: slug, Type: "file", Created: now, ModTime: now})
+	e := ManifestEntry{Name: fileName, Enc: slug, Type: "file", Created: now, ModTime: now, Owner: owner, Volume: placeBlob(baseDir, owner)}
+	// until CommitBlob lands a blob, the entry is a placeholder a crash must not strand
+	j, err := openJournal(masterKey, filepath.Join(baseDir, "filestorage"))
+	if err != nil {
+		return "", err
+	}
+	if err := j.beginCreate(parentDir, e); err != nil {
+		return "", err
+	}
+	m.Entries = append(m.Entries, e)
 	saveManifest(masterKey, parentDir, m)
-	return filepath.Join(parentDir, slug+".bin"), nil
+	events.Publish(events.Event{Type: events.FileCreated, Path: logicalPath})
+	return blobPath(parentDir, &e), nil
 }
 
 func ResolveForRead(masterKey []byte, baseDir, logicalPath string) (string, error) {
+	p, _, err := StatFile(masterKey, baseDir, logicalPath)
+	return p, err
+}
+
+// StatFile resolves a logical file path to its blob path and manifest entry.
+func StatFile(masterKey []byte, baseDir, logicalPath string) (string, *ManifestEntry, error) {
 	parentDir, fileName, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return "", nil, err
 	}
-	m, _ := loadManifest(masterKey, parentDir)
 	if _, e := findEntry(m, fileName, "file"); e != nil {
-		return filepath.Join(parentDir, e.Enc+".bin"), nil
+		return blobPath(parentDir, e), e, nil
 	}
-	return "", fmt.Errorf("file %q not found", fileName)
+	return "", nil, fmt.Errorf("file %q not found", fileName)
+}
+
+// LookupEntry finds name among a directory's entries. A file shadows a
+// directory of the same name, as in path lookups.
+func LookupEntry(entries []ManifestEntry, name string) *ManifestEntry {
+	var found *ManifestEntry
+	for i, e := range entries {
+		if e.Name == name && (found == nil || e.Type == "file") {
+			found = &entries[i]
+		}
+	}
+	return found
+}
+
+// StatEntry returns the entry at logicalPath, file or directory.
+func StatEntry(masterKey []byte, baseDir, logicalPath string) (*ManifestEntry, error) {
+	entries, err := ListDir(masterKey, baseDir, filepath.Dir(logicalPath))
+	if err != nil {
+		return nil, err
+	}
+	if e := LookupEntry(entries, filepath.Base(logicalPath)); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("%q not found: %w", logicalPath, os.ErrNotExist)
 }
 
 func UpdateFileMeta(masterKey []byte, baseDir, logicalPath string, size int64, mod time.Time) error {
@@ -196,6 +379,11 @@ func UpdateFileMeta(masterKey []byte, baseDir, logicalPath string, size int64, m
 	if err != nil {
 		return err
 	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	m, _ := loadManifest(masterKey, parentDir)
 	idx, e := findEntry(m, fileName, "file")
 	if e == nil {
@@ -203,5 +391,40 @@ func UpdateFileMeta(masterKey []byte, baseDir, logicalPath string, size int64, m
 	}
 	m.Entries[idx].Size = size
 	m.Entries[idx].ModTime = mod.Unix()
+	m.Entries[idx].MD5, m.Entries[idx].SHA1 = "", ""
+	m.Entries[idx].SHA256, m.Entries[idx].BLAKE3 = "", ""
+	m.Entries[idx].Rev++
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.FileUpdated, Path: logicalPath, Size: size})
+	return nil
+}
+
+// SetBlobInfo records how the blob behind logicalPath is encrypted: the user
+// whose key was used ("" = master key) and the encryption mode.
+func SetBlobInfo(masterKey []byte, baseDir, logicalPath, keyOwner, encryption string) error {
+	parentDir, fileName, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return err
+	}
+	idx, e := findEntry(m, fileName, "file")
+	if e == nil {
+		return fmt.Errorf("file missing")
+	}
+	if e.KeyOwner == keyOwner && e.Encryption == encryption {
+		return nil
+	}
+	m.Entries[idx].KeyOwner = keyOwner
+	m.Entries[idx].Encryption = encryption
 	return saveManifest(masterKey, parentDir, m)
 }
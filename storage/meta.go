@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"SCloud/events"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxTags      = 64
+	maxMetaKeys  = 64
+	maxMetaValue = 1024
+
+	// metaText holds text extracted from the file; SetExtractedText owns it
+	metaText = "text"
+)
+
+// HasTag reports whether the entry carries tag (compared after normalization).
+func (e *ManifestEntry) HasTag(tag string) bool {
+	tag = normalizeTag(tag)
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterByTag returns the entries carrying tag. An empty tag returns entries unchanged.
+func FilterByTag(entries []ManifestEntry, tag string) []ManifestEntry {
+	if tag == "" {
+		return entries
+	}
+	out := []ManifestEntry{}
+	for i := range entries {
+		if entries[i].HasTag(tag) {
+			out = append(out, entries[i])
+		}
+	}
+	return out
+}
+
+func normalizeTag(t string) string { return strings.ToLower(strings.TrimSpace(t)) }
+
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range tags {
+		t = normalizeTag(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// EntryPatch describes a metadata update. Nil fields are left unchanged.
+type EntryPatch struct {
+	Tags      []string          // replaces tags; [] clears
+	Meta      map[string]string // merged; an empty value deletes the key; "text" is reserved
+	ExpiresAt *int64            // unix seconds; 0 clears
+	ModTime   *int64            // unix seconds; nil = now
+
+	Immutable      *bool  // place (or, once lapsed, lift) a hold
+	ImmutableUntil *int64 // unix seconds; 0 = indefinitely
+}
+
+// PatchEntryMeta applies patch to a file or directory entry.
+func PatchEntryMeta(masterKey []byte, baseDir, logicalPath string, patch EntryPatch) (*ManifestEntry, error) {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return nil, err
+	}
+	idx, e := findAnyEntry(m, name)
+	if e == nil {
+		return nil, fmt.Errorf("%q not found", logicalPath)
+	}
+	// a hold freezes tags, metadata and expiry along with the content
+	if patch.Tags != nil || patch.Meta != nil || patch.ExpiresAt != nil {
+		if err := checkMutable(masterKey, baseDir, logicalPath, e); err != nil {
+			return nil, err
+		}
+	}
+
+	if tags := patch.Tags; tags != nil {
+		tags = normalizeTags(tags)
+		if len(tags) > maxTags {
+			return nil, fmt.Errorf("too many tags (max %d)", maxTags)
+		}
+		e.Tags = tags
+	}
+	for k, v := range patch.Meta {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if k == metaText {
+			return nil, fmt.Errorf("meta key %q is reserved", k)
+		}
+		if v == "" {
+			delete(e.Meta, k)
+			continue
+		}
+		if len(v) > maxMetaValue {
+			return nil, fmt.Errorf("meta value for %q too long (max %d)", k, maxMetaValue)
+		}
+		if e.Meta == nil {
+			e.Meta = map[string]string{}
+		}
+		e.Meta[k] = v
+	}
+	if len(e.Meta) > maxMetaKeys {
+		return nil, fmt.Errorf("too many meta keys (max %d)", maxMetaKeys)
+	}
+	if len(e.Meta) == 0 {
+		e.Meta = nil
+	}
+	if patch.ExpiresAt != nil {
+		if *patch.ExpiresAt < 0 {
+			return nil, fmt.Errorf("bad expires_at")
+		}
+		e.ExpiresAt = *patch.ExpiresAt
+	}
+	if err := applyHold(e, patch.Immutable, patch.ImmutableUntil, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+
+	e.ModTime = time.Now().Unix()
+	if patch.ModTime != nil {
+		if *patch.ModTime < 0 {
+			return nil, fmt.Errorf("bad mod_time")
+		}
+		e.ModTime = *patch.ModTime
+	}
+	e.Rev++
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return nil, err
+	}
+	events.Publish(events.Event{Type: events.MetaUpdated, Path: logicalPath})
+	updated := m.Entries[idx]
+	return &updated, nil
+}
+
+// ErrChanged is returned for a file no longer holding the content an
+// operation was computed from.
+var ErrChanged = errors.New("file changed")
+
+// SetExtractedText records the start of text extracted from the file at
+// logicalPath as its "text" meta field, provided the file still has the
+// MD5 md5sum. It is derived data, so the file's rev and mod time stay.
+func SetExtractedText(masterKey []byte, baseDir, logicalPath, md5sum, text string) error {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return err
+	}
+	_, e := findEntry(m, name, "file")
+	if e == nil || e.MD5 != md5sum {
+		return ErrChanged
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxMetaValue {
+		// drop a rune cut in half
+		text = strings.ToValidUTF8(text[:maxMetaValue], "")
+	}
+	if text == "" {
+		delete(e.Meta, metaText)
+	} else {
+		if e.Meta == nil {
+			e.Meta = map[string]string{}
+		}
+		e.Meta[metaText] = text
+	}
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return err
+	}
+	events.Publish(events.Event{Type: events.MetaUpdated, Path: logicalPath})
+	return nil
+}
+
+// FileRef is a file found by a walk of the tree.
+type FileRef struct {
+	Path  string
+	Entry ManifestEntry
+}
+
+// ListFiles lists every file in the tree that keep accepts.
+func ListFiles(masterKey []byte, baseDir string, keep func(e *ManifestEntry) bool) ([]FileRef, error) {
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []FileRef
+	err = walkFiles(masterKey, root, ".", func(dir, logical string, e *ManifestEntry) error {
+		if keep(e) {
+			out = append(out, FileRef{Path: logical, Entry: *e})
+		}
+		return nil
+	})
+	return out, err
+}
+
+// FilesWithMeta lists every file in the tree whose meta has key.
+func FilesWithMeta(masterKey []byte, baseDir, key string) ([]FileRef, error) {
+	return ListFiles(masterKey, baseDir, func(e *ManifestEntry) bool {
+		_, ok := e.Meta[key]
+		return ok
+	})
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidName is a name no new entry may take.
+var ErrInvalidName = errors.New("invalid name")
+
+// caseInsensitive makes names that differ only in case the same entry.
+var caseInsensitive bool
+
+// SetCaseInsensitive sets whether lookups ignore case. Entries that
+// already differ only in case stay apart; each is still found by its exact
+// name.
+func SetCaseInsensitive(on bool) { caseInsensitive = on }
+
+// NormalizeName is the form names are stored and looked up in: Unicode
+// NFC, so a name typed on macOS (which sends NFD) and one typed on Windows
+// are the same entry.
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// PathKey is the form two spellings of the path to one entry share: clean,
+// relative, NFC and, when lookups ignore case, lower case. Entries that
+// differ only in case share a key too.
+func PathKey(p string) string {
+	p = NormalizeName(strings.TrimPrefix(filepath.Clean("/"+p), "/"))
+	if caseInsensitive {
+		return strings.ToLower(p)
+	}
+	return p
+}
+
+// reservedNames cannot be created on Windows, with or without an
+// extension, so no synced client could hold an entry named so.
+var reservedNames = map[string]bool{"CON": true, "PRN": true, "AUX": true, "NUL": true}
+
+func init() {
+	for i := 1; i <= 9; i++ {
+		reservedNames[fmt.Sprintf("COM%d", i)] = true
+		reservedNames[fmt.Sprintf("LPT%d", i)] = true
+	}
+}
+
+// validName checks a name a new entry would take.
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%w: %q is not UTF-8", ErrInvalidName, name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r >= 0x7f && r < 0xa0 {
+			return fmt.Errorf("%w: %q contains %U", ErrInvalidName, name, r)
+		}
+	}
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// sameName reports whether a stored name matches name, which is normalized
+// already. Names stored before normalization are compared in NFC too.
+func sameName(stored, name string) bool {
+	stored = NormalizeName(stored)
+	if caseInsensitive {
+		return strings.EqualFold(stored, name)
+	}
+	return stored == name
+}
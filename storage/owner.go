@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// NearestOwner returns who owns logicalPath: the entry's own owner, else
+// that of the nearest owned ancestor directory. For paths that may not exist
+// yet (upload targets) it stops at the deepest existing ancestor. "" means
+// the path is unowned (written before ownership was recorded).
+func NearestOwner(masterKey []byte, baseDir, logicalPath string) (owner string, err error) {
+	cleaned := strings.TrimPrefix(filepath.Clean(logicalPath), string(filepath.Separator))
+	dir, err := ensureRoot(masterKey, baseDir)
+	if err != nil || cleaned == "." || cleaned == "" {
+		return "", err
+	}
+
+	parts := strings.Split(cleaned, string(filepath.Separator))
+	for i, seg := range parts {
+		m, err := loadManifest(masterKey, dir)
+		if err != nil {
+			return "", err
+		}
+		var e *ManifestEntry
+		if i == len(parts)-1 {
+			_, e = findAnyEntry(m, seg)
+		} else {
+			_, e = findEntry(m, seg, "dir")
+		}
+		if e == nil {
+			return owner, nil
+		}
+		if e.Owner != "" {
+			owner = e.Owner
+		}
+		dir = filepath.Join(dir, e.Enc)
+	}
+	return owner, nil
+}
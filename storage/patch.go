@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrPatchOffset rejects patches that would leave a hole past the end of file.
+var ErrPatchOffset = errors.New("offset past end of file")
+
+type chunkRecord struct {
+	pos     int64 // of the length prefix in the blob
+	ctLen   int64
+	ptStart int64
+	ptLen   int64
+}
+
+// PatchFile overwrites the plaintext at offset with r, re-sealing only the
+// chunks the write touches. Writing at the current end extends the file.
+// Blobs in the original format derive nonces from the chunk index, so
+// re-sealing a chunk there would reuse a nonce; they are rewritten once in
+// the random-nonce format on their first patch. Returns the new size.
+func PatchFile(masterKey []byte, baseDir, logicalPath string, blobKey []byte, offset int64, r io.Reader) (int64, error) {
+	blobPath, entry, err := StatFile(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkMutable(masterKey, baseDir, logicalPath, entry); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, ErrPatchOffset
+	}
+	if blobKey == nil {
+		blobKey = masterKey
+	}
+
+	unlock := lockBlob(blobPath)
+	defer unlock()
+	if err := unshareBlob(blobPath, true); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if entry.Encryption == EncryptionClient {
+		size, err = patchRaw(blobPath, offset, r)
+	} else {
+		size, err = patchChunks(blobKey, blobPath, offset, r)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, UpdateFileMeta(masterKey, baseDir, logicalPath, size, time.Now())
+}
+
+// patchRaw writes client-encrypted bytes verbatim; they are opaque to us.
+func patchRaw(blobPath string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(blobPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset > fi.Size() {
+		return 0, ErrPatchOffset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+	return max(fi.Size(), offset+n), f.Sync()
+}
+
+func patchChunks(key []byte, blobPath string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(blobPath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { f.Close() }()
+
+	_, hdr, _, _, err := readHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	if headerVersion(hdr) != versionRandomNonce {
+		f.Close()
+		if err := rewriteBlob(key, blobPath, versionRandomNonce); err != nil {
+			return 0, fmt.Errorf("convert for patching: %w", err)
+		}
+		if f, err = os.OpenFile(blobPath, os.O_RDWR, 0644); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	chunkSize, hdr, salt, noncePrefix, err := readHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	cc, err := newChunkCipher(key, hdr, salt, noncePrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	recs, size, err := walkRecords(f, cc)
+	if err != nil {
+		return 0, err
+	}
+	if offset > size {
+		return 0, ErrPatchOffset
+	}
+
+	// Re-seal the chunks the patch overlaps. Only the last chunk may grow
+	// (up to chunkSize), so every other record keeps its length and is
+	// rewritten in place.
+	end := offset
+	buf := make([]byte, chunkSize)
+	eof := false
+	for i, rec := range recs {
+		if eof {
+			break
+		}
+		last := i == len(recs)-1
+		if rec.ptStart+rec.ptLen <= offset && !(last && rec.ptLen < int64(chunkSize)) {
+			continue
+		}
+		capacity := rec.ptLen
+		if last {
+			capacity = int64(chunkSize)
+		}
+		lo := max(offset-rec.ptStart, 0)
+		n, err := io.ReadFull(r, buf[:capacity-lo])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+
+		ct := make([]byte, rec.ctLen)
+		if _, err := f.ReadAt(ct, rec.pos+4); err != nil {
+			return 0, err
+		}
+		plain, err := cc.open(uint32(i), ct)
+		if err != nil {
+			return 0, err
+		}
+		if need := lo + int64(n); need > int64(len(plain)) {
+			plain = append(plain, make([]byte, need-int64(len(plain)))...)
+		}
+		copy(plain[lo:], buf[:n])
+
+		sealed, err := cc.seal(uint32(i), plain)
+		if err != nil {
+			return 0, err
+		}
+		record := make([]byte, 4+len(sealed))
+		binary.BigEndian.PutUint32(record[:4], uint32(len(sealed)))
+		copy(record[4:], sealed)
+		if _, err := f.WriteAt(record, rec.pos); err != nil {
+			return 0, err
+		}
+		end = rec.ptStart + lo + int64(n)
+	}
+
+	// Whatever is left goes into new chunks after the last one
+	if !eof {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+		counted := &CountReader{R: r}
+		if _, err := sealChunks(cc, uint32(len(recs)), chunkSize, counted, f); err != nil {
+			return 0, err
+		}
+		end = max(end, size) + counted.N
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return max(size, end), nil
+}
+
+// walkRecords indexes a blob's chunk records after the header without
+// decrypting them, returning them with the total plaintext size.
+func walkRecords(f *os.File, cc *chunkCipher) ([]chunkRecord, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []chunkRecord
+	pos := int64(len(cc.hdr))
+	var plain int64
+	for pos < fi.Size() {
+		var lenPrefix [4]byte
+		if _, err := f.ReadAt(lenPrefix[:], pos); err != nil {
+			return nil, 0, fmt.Errorf("chunk %d: %w", len(recs), err)
+		}
+		ctLen := int64(binary.BigEndian.Uint32(lenPrefix[:]))
+		if pos+4+ctLen > fi.Size() {
+			return nil, 0, fmt.Errorf("chunk %d: truncated blob", len(recs))
+		}
+		ptLen := ctLen - int64(cc.overhead())
+		recs = append(recs, chunkRecord{pos: pos, ctLen: ctLen, ptStart: plain, ptLen: ptLen})
+		pos += 4 + ctLen
+		plain += ptLen
+	}
+	return recs, plain, nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"SCloud/events"
+	"errors"
+	"fmt"
+)
+
+// Quarantine sources: who set a file aside.
+const (
+	QuarantineAdmin  = "admin"
+	QuarantineScan   = "scan"
+	QuarantineReport = "report"
+)
+
+var ErrNotQuarantined = errors.New("file is not quarantined")
+
+// Quarantine marks a file set aside, say by a malware scan or after abuse
+// reports. It stays where it is, but it cannot be downloaded or shared
+// until an admin releases or purges it; overwriting it keeps the mark.
+type Quarantine struct {
+	Reason string `json:"reason"`
+	Source string `json:"source"`
+	At     int64  `json:"at"` // unix seconds
+}
+
+// SetQuarantine quarantines the file at logicalPath, or with q nil releases
+// it (ErrNotQuarantined if it was not). Like a hold, it is not a content
+// change, so the rev stays.
+func SetQuarantine(masterKey []byte, baseDir, logicalPath string, q *Quarantine) error {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return err
+	}
+	_, e := findEntry(m, name, "file")
+	if e == nil {
+		return fmt.Errorf("file %q not found", logicalPath)
+	}
+	if q == nil && e.Quarantine == nil {
+		return ErrNotQuarantined
+	}
+	e.Quarantine = q
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return err
+	}
+	typ := events.FileQuarantined
+	if q == nil {
+		typ = events.FileReleased
+	}
+	events.Publish(events.Event{Type: typ, Path: logicalPath, Size: e.Size})
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DecryptRange writes plaintext bytes [off, off+n) of an encrypted file to w.
+// Chunk lengths are read from their prefixes and the ciphertext of chunks
+// before the range is skipped with Seek, so only the chunks that overlap the
+// range are authenticated and decrypted.
+func DecryptRange(masterKey []byte, r io.ReadSeeker, w io.Writer, off, n int64) error {
+	if off < 0 || n < 0 {
+		return fmt.Errorf("invalid range %d+%d", off, n)
+	}
+	_, hdr, salt, noncePrefix, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+
+	cc, err := newChunkCipher(masterKey, hdr, salt, noncePrefix)
+	if err != nil {
+		return err
+	}
+
+	end := off + n
+	var pos int64 // plaintext offset of the current chunk
+	var index uint32 = 0
+	for pos < end {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(r, lenPrefix[:]); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		ctLen := int64(binary.BigEndian.Uint32(lenPrefix[:]))
+		ptLen := ctLen - int64(cc.overhead())
+		if ptLen < 0 {
+			return fmt.Errorf("chunk %d: short ciphertext", index)
+		}
+
+		if pos+ptLen <= off {
+			if _, err := r.Seek(ctLen, io.SeekCurrent); err != nil {
+				return err
+			}
+		} else {
+			ciphertext := make([]byte, ctLen)
+			if _, err := io.ReadFull(r, ciphertext); err != nil {
+				return err
+			}
+
+			plaintext, err := cc.open(index, ciphertext)
+			if err != nil {
+				return err
+			}
+
+			from, to := max(off-pos, 0), min(ptLen, end-pos)
+			if _, err := w.Write(plaintext[from:to]); err != nil {
+				return err
+			}
+		}
+
+		if index == ^uint32(0) {
+			return fmt.Errorf("too many chunks: index overflow")
+		}
+		pos += ptLen
+		index++
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"os"
+	"strings"
+)
+
+// Recovery codes escrow a user key: <root>/_keys/<userID>.recovery holds it
+// wrapped once per code,
+//
+//	salt(16) | nonce(12) | AES-GCM(userKey), AAD = userID
+//
+// Each code is 80 random bits, so a plain HKDF is enough to turn it into a
+// wrapping key. A code is struck from the file when it is used.
+const (
+	RecoveryCodeCount = 8
+
+	recoveryCodeBytes  = 10
+	recoveryRecordSize = 16 + 12 + userKeyLen + 16
+)
+
+var ErrBadRecoveryCode = errors.New("invalid recovery code")
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func recoveryPath(baseDir, userID string) string {
+	return strings.TrimSuffix(userKeyPath(baseDir, userID), ".key") + ".recovery"
+}
+
+// normalizeRecoveryCode accepts codes with any case, spacing or dashes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func recoveryAEAD(code string, salt []byte) (cipher.AEAD, error) {
+	k := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(normalizeRecoveryCode(code)), salt, []byte("recovery-wrap:v1")), k); err != nil {
+		return nil, err
+	}
+	return getGCMBlock(k)
+}
+
+// CreateRecoveryCodes replaces userID's recovery codes with a fresh set
+// escrowing userKey and returns them for the user to print.
+func CreateRecoveryCodes(baseDir, userID string, userKey []byte) ([]string, error) {
+	var codes []string
+	var file bytes.Buffer
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, recoveryCodeBytes)
+		salt := make([]byte, 16)
+		nonce := make([]byte, 12)
+		for _, b := range [][]byte{raw, salt, nonce} {
+			if _, err := rand.Read(b); err != nil {
+				return nil, err
+			}
+		}
+		enc := recoveryEncoding.EncodeToString(raw)
+		code := enc[0:4] + "-" + enc[4:8] + "-" + enc[8:12] + "-" + enc[12:16]
+		aead, err := recoveryAEAD(code, salt)
+		if err != nil {
+			return nil, err
+		}
+		file.Write(salt)
+		file.Write(nonce)
+		file.Write(aead.Seal(nil, nonce, userKey, []byte(userID)))
+		codes = append(codes, code)
+	}
+	unlock, err := lockUserKey(baseDir, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := writeKeyFile(recoveryPath(baseDir, userID), file.Bytes()); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoverUserKey unwraps userID's key with one of their recovery codes and
+// strikes that code. Redemptions are serialized, so a code unwraps once.
+func RecoverUserKey(baseDir, userID, code string) ([]byte, error) {
+	unlock, err := lockUserKey(baseDir, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	p := recoveryPath(baseDir, userID)
+	blob, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBadRecoveryCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	for off := 0; off+recoveryRecordSize <= len(blob); off += recoveryRecordSize {
+		rec := blob[off : off+recoveryRecordSize]
+		aead, err := recoveryAEAD(code, rec[:16])
+		if err != nil {
+			return nil, err
+		}
+		userKey, err := aead.Open(nil, rec[16:28], rec[28:], []byte(userID))
+		if err != nil {
+			continue
+		}
+		rest := append(append([]byte{}, blob[:off]...), blob[off+recoveryRecordSize:]...)
+		if err := writeKeyFile(p, rest); err != nil {
+			return nil, fmt.Errorf("strike recovery code: %w", err)
+		}
+		return userKey, nil
+	}
+	return nil, ErrBadRecoveryCode
+}
+
+// RecoveryCodesLeft counts userID's unused recovery codes.
+func RecoveryCodesLeft(baseDir, userID string) (int, error) {
+	fi, err := os.Stat(recoveryPath(baseDir, userID))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(fi.Size()) / recoveryRecordSize, nil
+}
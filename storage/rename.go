@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"SCloud/events"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MakeDir creates the directory logicalPath and any missing parents,
+// recording owner on the new ones. An existing directory is not an error.
+func MakeDir(masterKey []byte, baseDir, logicalPath, owner string) error {
+	logicalPath = filepath.Clean(logicalPath)
+	if logicalPath == "." {
+		return nil
+	}
+	_, _, err := resolveParentDirAs(masterKey, baseDir, filepath.Join(logicalPath, "_"), true, owner)
+	return err
+}
+
+// Rename moves the file or directory from to to, which must not exist and
+// whose parent must. Moving between directories takes the blob (or the
+// directory's subtree, on every volume) along. The target's manifest is
+// saved before the data moves, so a crash leaves the old entry in place.
+func Rename(masterKey []byte, baseDir, from, to string) error {
+	from, to = filepath.Clean(from), filepath.Clean(to)
+	if from == "." || to == "." {
+		return fmt.Errorf("cannot rename the root")
+	}
+	if to == from || strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return fmt.Errorf("cannot move %q into itself", from)
+	}
+	srcDir, srcName, err := resolveParentDir(masterKey, baseDir, from, false)
+	if err != nil {
+		return err
+	}
+	dstDir, dstName, err := resolveParentDir(masterKey, baseDir, to, false)
+	if err != nil {
+		return err
+	}
+
+	// lock in a fixed order so two opposite renames cannot deadlock
+	dirs := []string{srcDir}
+	if dstDir != srcDir {
+		dirs = append(dirs, dstDir)
+		if lockName(dstDir) < lockName(srcDir) {
+			dirs[0], dirs[1] = dstDir, srcDir
+		}
+	}
+	for _, d := range dirs {
+		unlock, err := lockManifest(d)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	src, err := loadManifest(masterKey, srcDir)
+	if err != nil {
+		return err
+	}
+	idx, e := findAnyEntry(src, srcName)
+	if e == nil {
+		return fmt.Errorf("%q not found", from)
+	}
+	if err := checkMutable(masterKey, baseDir, from, e); err != nil {
+		return err
+	}
+	if e.Type == "dir" {
+		held, err := heldWithin(masterKey, filepath.Join(srcDir, e.Enc), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if held {
+			return fmt.Errorf("%q contains held entries: %w", from, ErrImmutable)
+		}
+	}
+	dst := src
+	if dstDir != srcDir {
+		if dst, err = loadManifest(masterKey, dstDir); err != nil {
+			return err
+		}
+	}
+	if err := validName(dstName); err != nil {
+		return err
+	}
+	if err := CheckPath(to); err != nil {
+		return err
+	}
+	// a case-only rename finds the entry itself when case is ignored
+	if _, taken := findAnyEntry(dst, dstName); taken != nil && taken != e {
+		return fmt.Errorf("%q: %w", to, ErrExists)
+	}
+	if held, err := heldAncestor(masterKey, baseDir, to, time.Now().Unix()); err != nil {
+		return err
+	} else if held != "" {
+		return fmt.Errorf("%q is inside held directory %q: %w", to, held, ErrImmutable)
+	}
+
+	moved := *e
+	moved.Name = dstName
+	moved.ModTime = time.Now().Unix()
+	moved.Rev++
+	if dstDir == srcDir {
+		src.Entries[idx] = moved
+	} else {
+		dst.Entries = append(dst.Entries, moved)
+		if err := saveManifest(masterKey, dstDir, dst); err != nil {
+			return err
+		}
+		if err := moveData(srcDir, dstDir, *e); err != nil {
+			dst.Entries = dst.Entries[:len(dst.Entries)-1]
+			return errors.Join(err, saveManifest(masterKey, dstDir, dst))
+		}
+		src.Entries = append(src.Entries[:idx], src.Entries[idx+1:]...)
+	}
+	if err := saveManifest(masterKey, srcDir, src); err != nil {
+		return err
+	}
+	// watchers see a rename as the old path going and the new one appearing
+	if moved.Type == "dir" {
+		events.Publish(events.Event{Type: events.DirDeleted, Path: from})
+		events.Publish(events.Event{Type: events.DirCreated, Path: to})
+	} else {
+		events.Publish(events.Event{Type: events.FileDeleted, Path: from, Size: moved.Size})
+		events.Publish(events.Event{Type: events.FileCreated, Path: to, Size: moved.Size})
+	}
+	return nil
+}
+
+// moveData moves what entry e of manifest dir from stores on disk into
+// manifest dir to. Once a directory itself has moved, a volume that fails
+// to follow is only logged: the entry is committed to its new place.
+func moveData(from, to string, e ManifestEntry) error {
+	if e.Type == "file" {
+		src, dst := blobPath(from, &e), blobPath(to, &e)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.Rename(filepath.Join(from, e.Enc), filepath.Join(to, e.Enc)); err != nil {
+		return err
+	}
+	for name, vol := range Volumes() {
+		src, err1 := volumeMirror(vol, filepath.Join(from, e.Enc))
+		dst, err2 := volumeMirror(vol, filepath.Join(to, e.Enc))
+		err := errors.Join(err1, err2)
+		if err == nil {
+			if _, statErr := os.Stat(src); os.IsNotExist(statErr) {
+				continue
+			}
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				err = os.Rename(src, dst)
+			}
+		}
+		if err != nil {
+			log.Printf("rename: moving %s on volume %s: %v", e.Name, name, err)
+		}
+	}
+	return nil
+}
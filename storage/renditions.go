@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Renditions are files derived from a stored file, such as previews. They
+// live at <root>/_renditions/<key owner>/<content id>.<kind>, encrypted
+// under the key of the file they come from, and are named after its
+// content: a rewrite leaves the old ones unused, and identical files
+// share theirs.
+
+func renditionPath(baseDir string, e *ManifestEntry, kind string) string {
+	owner := "master"
+	if e.KeyOwner != "" {
+		owner = safeID(e.KeyOwner)
+	}
+	id := e.MD5
+	if id == "" {
+		id = e.Enc + "-" + strconv.FormatInt(e.Rev, 10)
+	}
+	return filepath.Join(baseDir, "filestorage", "_renditions", owner, id+"."+kind)
+}
+
+// WriteRendition stores what r yields as the kind rendition of e.
+func WriteRendition(key []byte, baseDir string, e *ManifestEntry, kind string, r io.Reader) error {
+	p := renditionPath(baseDir, e, kind)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := Encrypt(key, r, f, defaultChunk); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// OpenRendition opens the kind rendition of e; the error is
+// fs.ErrNotExist when there is none yet.
+func OpenRendition(key []byte, baseDir string, e *ManifestEntry, kind string) (*BlobReader, error) {
+	if e.Encryption == EncryptionClient {
+		return nil, fmt.Errorf("no renditions of client-encrypted files: %w", os.ErrNotExist)
+	}
+	return OpenBlobReader(key, renditionPath(baseDir, e, kind))
+}
+
+// HasRendition reports whether the kind rendition of e exists.
+func HasRendition(baseDir string, e *ManifestEntry, kind string) bool {
+	_, err := os.Stat(renditionPath(baseDir, e, kind))
+	return err == nil
+}
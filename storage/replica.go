@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readOnly is set for a store served read-only, e.g. a replica: whatever
+// its journal holds is the primary's business, so it is not replayed.
+var readOnly bool
+
+// SetReadOnly marks every store of the process as read-only.
+func SetReadOnly(ro bool) { readOnly = ro }
+
+func heartbeatPath(baseDir string) string {
+	return filepath.Join(baseDir, "filestorage", "_heartbeat")
+}
+
+// WriteHeartbeat stamps t into the store at baseDir. Replicas copy the stamp
+// along with the rest and read it back to tell how far behind they are.
+func WriteHeartbeat(baseDir string, t time.Time) error {
+	p := heartbeatPath(baseDir)
+	if err := os.WriteFile(p+".tmp", []byte(strconv.FormatInt(t.UnixNano(), 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// ReadHeartbeat returns the last stamp written to the store at baseDir.
+func ReadHeartbeat(baseDir string) (time.Time, error) {
+	raw, err := os.ReadFile(heartbeatPath(baseDir))
+	if err != nil {
+		return time.Time{}, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n), nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrNoUpload       = errors.New("no such upload")
+	ErrUploadMismatch = errors.New("file_id belongs to a different upload")
+	ErrBadFileID      = errors.New("file_id must be 1 to 128 letters, digits, '-' or '_'")
+)
+
+var fileIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// ValidFileID reports whether id can name an upload's staging dir.
+func ValidFileID(id string) bool { return fileIDPattern.MatchString(id) }
+
+// UploadState is what is known of an upload whose chunks are being staged
+// under its file ID, whether they come from a chunked client or from a
+// single-shot upload cut into chunks as it streams in.
+type UploadState struct {
+	FileID      string `json:"file_id"`
+	Path        string `json:"path"`
+	Owner       string `json:"owner"`
+	ChunkSize   int    `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	TotalSize   int64  `json:"total_size"`
+	Chunks      int    `json:"chunks"` // staged so far
+	Offset      int64  `json:"offset"` // bytes staged without a gap from the start
+}
+
+const uploadStateName = "state"
+
+func loadUploadState(masterKey []byte, staging string) (*UploadState, error) {
+	raw, err := os.ReadFile(filepath.Join(staging, uploadStateName))
+	if os.IsNotExist(err) {
+		return nil, ErrNoUpload
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptBytes(masterKey, raw)
+	if err != nil {
+		return nil, fmt.Errorf("upload state: %w", err)
+	}
+	var st UploadState
+	if err := json.Unmarshal(plain, &st); err != nil {
+		return nil, fmt.Errorf("upload state: %w", err)
+	}
+	return &st, nil
+}
+
+// recordUploadState notes meta in its staging dir on the first chunk, and
+// on later ones refuses chunks that do not belong to the same upload.
+func recordUploadState(masterKey []byte, staging string, meta ChunkMeta) error {
+	st, err := loadUploadState(masterKey, staging)
+	if err == nil {
+		if st.Owner != meta.Owner || st.Path != meta.LogicalPath || st.ChunkSize != meta.ChunkSize || st.TotalChunks != meta.TotalChunks {
+			return ErrUploadMismatch
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrNoUpload) {
+		return err
+	}
+	raw, err := json.Marshal(UploadState{
+		FileID:      meta.FileID,
+		Path:        meta.LogicalPath,
+		Owner:       meta.Owner,
+		ChunkSize:   meta.ChunkSize,
+		TotalChunks: meta.TotalChunks,
+		TotalSize:   meta.TotalSize,
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := encryptBytes(masterKey, raw)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(staging, uploadStateName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(staging, uploadStateName))
+}
+
+// UploadStatus reports how far the upload staged under fileID has got.
+func UploadStatus(masterKey []byte, baseDir, fileID string) (UploadState, error) {
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return UploadState{}, err
+	}
+	staging, err := stagingDirFor(root, fileID)
+	if err != nil {
+		return UploadState{}, err
+	}
+	st, err := loadUploadState(masterKey, staging)
+	if err != nil {
+		return UploadState{}, err
+	}
+	for i := 0; i < st.TotalChunks; i++ {
+		if _, err := os.Stat(filepath.Join(staging, fmt.Sprintf("%08d.part", i))); err != nil {
+			break
+		}
+		st.Offset += int64(st.ChunkSize)
+	}
+	if st.TotalSize > 0 {
+		st.Offset = min(st.Offset, st.TotalSize)
+	}
+	parts, err := listParts(staging)
+	if err != nil {
+		return UploadState{}, err
+	}
+	st.Chunks = len(parts)
+	return *st, nil
+}
+
+// DiscardUpload drops whatever is staged under fileID.
+func DiscardUpload(masterKey []byte, baseDir, fileID string) error {
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return err
+	}
+	staging, err := stagingDirFor(root, fileID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
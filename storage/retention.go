@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"SCloud/events"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Remove deletes a file or a whole directory tree from the manifest and disk.
+// The manifest is saved first so a crash never leaves an entry pointing at nothing.
+func Remove(masterKey []byte, baseDir, logicalPath string) error {
+	parentDir, name, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest(parentDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := loadManifest(masterKey, parentDir)
+	if err != nil {
+		return err
+	}
+	idx, e := findAnyEntry(m, name)
+	if e == nil {
+		return fmt.Errorf("%q not found", logicalPath)
+	}
+	if err := checkMutable(masterKey, baseDir, logicalPath, e); err != nil {
+		return err
+	}
+	if e.Type == "dir" {
+		held, err := heldWithin(masterKey, filepath.Join(parentDir, e.Enc), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if held {
+			return fmt.Errorf("%q contains held entries: %w", logicalPath, ErrImmutable)
+		}
+	}
+	entry := *e
+	root := filepath.Join(baseDir, "filestorage")
+	j, err := openJournal(masterKey, root)
+	if err != nil {
+		return err
+	}
+	rel, _ := filepath.Rel(root, parentDir)
+	seq, err := j.begin(journalRecord{Op: journalRemove, Dir: rel, Entry: entry})
+	if err != nil {
+		return err
+	}
+	defer j.commit(seq)
+	m.Entries = append(m.Entries[:idx], m.Entries[idx+1:]...)
+	if err := saveManifest(masterKey, parentDir, m); err != nil {
+		return err
+	}
+	removeBlob(parentDir, entry, logicalPath)
+	return nil
+}
+
+// removeBlob deletes an entry's on-disk data once it is gone from the manifest.
+func removeBlob(parentDir string, e ManifestEntry, logicalPath string) {
+	if e.Type == "dir" {
+		removeMirrors(filepath.Join(parentDir, e.Enc))
+		if err := os.RemoveAll(filepath.Join(parentDir, e.Enc)); err != nil {
+			log.Printf("remove dir %s: %v", logicalPath, err)
+		}
+		events.Publish(events.Event{Type: events.DirDeleted, Path: logicalPath})
+		return
+	}
+	if err := os.Remove(blobPath(parentDir, &e)); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove file %s: %v", logicalPath, err)
+	}
+	events.Publish(events.Event{Type: events.FileDeleted, Path: logicalPath, Size: e.Size})
+}
+
+type ExpiringEntry struct {
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size,omitempty"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (e *ManifestEntry) expired(now int64) bool {
+	return e.ExpiresAt > 0 && e.ExpiresAt <= now
+}
+
+// ListExpiring returns every entry under logicalPath expiring before the given time.
+func ListExpiring(masterKey []byte, baseDir, logicalPath string, before time.Time) ([]ExpiringEntry, error) {
+	dir, err := resolveDir(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return nil, err
+	}
+	out := []ExpiringEntry{}
+	err = collectExpiring(masterKey, dir, logicalPath, before.Unix(), &out)
+	return out, err
+}
+
+func collectExpiring(masterKey []byte, dir, logical string, before int64, out *[]ExpiringEntry) error {
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		p := path.Join(logical, e.Name)
+		if e.ExpiresAt > 0 && e.ExpiresAt <= before {
+			*out = append(*out, ExpiringEntry{Path: p, Type: e.Type, Size: e.Size, ExpiresAt: e.ExpiresAt})
+		}
+		if e.Type == "dir" {
+			if err := collectExpiring(masterKey, filepath.Join(dir, e.Enc), p, before, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeExpired removes every expired file and directory and returns their logical paths.
+func PurgeExpired(masterKey []byte, baseDir string, now time.Time) ([]string, error) {
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	err = purgeExpiredIn(masterKey, root, ".", now.Unix(), &purged)
+	return purged, err
+}
+
+func purgeExpiredIn(masterKey []byte, dir, logical string, now int64, purged *[]string) error {
+	unlock, err := lockManifest(dir)
+	if err != nil {
+		return err
+	}
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		unlock()
+		return err
+	}
+	keep := m.Entries[:0]
+	var gone []ManifestEntry
+	for _, e := range m.Entries {
+		if e.expired(now) && !e.held(now) {
+			if e.Type == "dir" {
+				// a hold anywhere below wins over the directory's retention
+				if h, err := heldWithin(masterKey, filepath.Join(dir, e.Enc), now); err != nil || h {
+					keep = append(keep, e)
+					continue
+				}
+			}
+			gone = append(gone, e)
+			continue
+		}
+		keep = append(keep, e)
+	}
+	if len(gone) > 0 {
+		m.Entries = keep
+		if err := saveManifest(masterKey, dir, m); err != nil {
+			unlock()
+			return err
+		}
+	}
+	unlock()
+	for _, e := range gone {
+		p := path.Join(logical, e.Name)
+		removeBlob(dir, e, p)
+		*purged = append(*purged, p)
+	}
+	for _, e := range m.Entries {
+		// nothing below a held directory goes, whatever its own expiry
+		if e.Type == "dir" && !e.held(now) {
+			if err := purgeExpiredIn(masterKey, filepath.Join(dir, e.Enc), path.Join(logical, e.Name), now, purged); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredHolds(t *testing.T) {
+	baseDir := t.TempDir()
+	expires := time.Now().Add(time.Minute).Unix()
+	for _, p := range []string{
+		"free/old.txt",
+		"held/old.txt",
+		"held/sub/old.txt",
+		"olddir/keep.txt",
+		"olddir2/a.txt",
+	} {
+		mkfile(t, baseDir, p)
+	}
+	// expiry first: a hold freezes it
+	for _, p := range []string{"free/old.txt", "held/old.txt", "held/sub", "held/sub/old.txt", "olddir", "olddir2"} {
+		patch(t, baseDir, p, EntryPatch{ExpiresAt: &expires})
+	}
+	hold(t, baseDir, "held")
+	hold(t, baseDir, "olddir/keep.txt")
+
+	purged, err := PurgeExpired(testKey, baseDir, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(purged)
+	if want := []string{"free/old.txt", "olddir2"}; !slices.Equal(purged, want) {
+		t.Errorf("purged %q, want %q", purged, want)
+	}
+
+	for _, tc := range []struct {
+		path string
+		gone bool
+	}{
+		{"free/old.txt", true},
+		{"olddir2", true},
+		{"held/old.txt", false},
+		{"held/sub", false},
+		{"held/sub/old.txt", false},
+		{"olddir", false},
+		{"olddir/keep.txt", false},
+	} {
+		_, err := StatEntry(testKey, baseDir, tc.path)
+		if gone := err != nil; gone != tc.gone {
+			t.Errorf("%s: gone %v, want %v (%v)", tc.path, gone, tc.gone, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotWritable marks a store that can be read but not changed.
+var ErrNotWritable = errors.New("storage root is not writable")
+
+// SelfCheck verifies at boot that the cipher works with masterKey, that
+// masterKey opens the store already at baseDir (a wrong key would otherwise
+// only show on the first read) and that the store can be written. A store
+// that only fails the last check returns an error wrapping ErrNotWritable.
+// It changes nothing on disk but a probe file.
+func SelfCheck(masterKey []byte, baseDir string) error {
+	probe := []byte("sc self-check")
+	enc, err := encryptBytes(masterKey, probe)
+	if err != nil {
+		return fmt.Errorf("cipher: %w", err)
+	}
+	if dec, err := decryptBytes(masterKey, enc); err != nil || !bytes.Equal(dec, probe) {
+		return fmt.Errorf("cipher round trip failed: %v", err)
+	}
+
+	root := filepath.Join(baseDir, "filestorage")
+	if raw, err := os.ReadFile(manifestPath(root)); err == nil {
+		if _, err := decryptBytes(masterKey, raw); err != nil {
+			return fmt.Errorf("the master key does not open the store at %s: %w", root, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotWritable, err)
+	}
+	f, err := os.CreateTemp(root, "selfcheck.*.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotWritable, err)
+	}
+	name := f.Name()
+	_, err = f.Write(probe)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotWritable, err)
+	}
+	return nil
+}
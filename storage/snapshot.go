@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"SCloud/events"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshots live in <root>/_snapshots/<id>/: an encrypted _snapshot.bin with
+// the metadata below, and tree/, a copy of the directory's manifests whose
+// blobs are hard links to the live ones. A snapshot costs only manifests
+// until the live files change; the link count is the refcount, and writers
+// call unshareBlob before touching a blob in place.
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"` // logical directory, "" = root
+	Label   string    `json:"label,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+	Files   int       `json:"files"`
+	Bytes   int64     `json:"bytes"` // plaintext
+}
+
+var ErrNoSnapshot = errors.New("no such snapshot")
+
+func snapshotsDir(baseDir string) string {
+	return filepath.Join(baseDir, "filestorage", "_snapshots")
+}
+
+func cleanDirPath(logicalPath string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean("/"+logicalPath)), "/")
+}
+
+// CreateSnapshot captures the directory at logicalPath and everything below.
+func CreateSnapshot(masterKey []byte, baseDir, logicalPath, owner, label string) (Snapshot, error) {
+	s := Snapshot{Path: cleanDirPath(logicalPath), Label: label, Owner: owner, Created: time.Now().UTC()}
+	live, err := resolveDir(masterKey, baseDir, s.Path)
+	if err != nil {
+		return s, err
+	}
+	if s.ID, err = randSlugHex(8); err != nil {
+		return s, err
+	}
+	dir := filepath.Join(snapshotsDir(baseDir), s.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return s, err
+	}
+	if err := linkTree(masterKey, live, filepath.Join(dir, "tree"), &s); err != nil {
+		os.RemoveAll(dir)
+		return s, err
+	}
+	if err := saveSnapshot(masterKey, dir, s); err != nil {
+		os.RemoveAll(dir)
+		return s, err
+	}
+	return s, nil
+}
+
+// linkTree mirrors the manifest tree at src into dst, copying manifests and
+// hard-linking blobs. The manifest is read first, so a blob that changes
+// meanwhile is caught in its newer state rather than missing.
+func linkTree(masterKey []byte, src, dst string, s *Snapshot) error {
+	raw, err := os.ReadFile(manifestPath(src))
+	if err != nil {
+		return err
+	}
+	plain, err := decryptBytes(masterKey, raw)
+	if err != nil {
+		return err
+	}
+	var m DirManifest
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		switch e.Type {
+		case "file":
+			blob, link := blobPath(src, &e), blobPath(dst, &e)
+			if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+				return err
+			}
+			unlock := lockBlob(blob)
+			err := os.Link(blob, link)
+			unlock()
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			s.Files++
+			s.Bytes += e.Size
+		case "dir":
+			if err := linkTree(masterKey, filepath.Join(src, e.Enc), filepath.Join(dst, e.Enc), s); err != nil {
+				return err
+			}
+		}
+	}
+	return os.WriteFile(manifestPath(dst), raw, 0644)
+}
+
+// unshareBlob makes sure nothing but the live tree sees the blob at path
+// before it is written. With keep, a blob that is shared with a snapshot is
+// replaced by a private copy to modify in place; without, it is unlinked so
+// the caller can create a new one.
+func unshareBlob(blobPath string, keep bool) error {
+	fi, err := os.Stat(blobPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || linkCount(fi) < 2 {
+		return err
+	}
+	if !keep {
+		return os.Remove(blobPath)
+	}
+	in, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := blobPath + ".cow.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, blobPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func saveSnapshot(masterKey []byte, dir string, s Snapshot) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	enc, err := encryptBytes(masterKey, raw)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "_snapshot.bin"), enc, 0644)
+}
+
+func loadSnapshot(masterKey []byte, baseDir, id string) (Snapshot, string, error) {
+	var s Snapshot
+	if id == "" || strings.ContainsAny(id, `./\`) {
+		return s, "", ErrNoSnapshot
+	}
+	dir := filepath.Join(snapshotsDir(baseDir), id)
+	raw, err := os.ReadFile(filepath.Join(dir, "_snapshot.bin"))
+	if os.IsNotExist(err) {
+		return s, "", ErrNoSnapshot
+	}
+	if err != nil {
+		return s, "", err
+	}
+	plain, err := decryptBytes(masterKey, raw)
+	if err != nil {
+		return s, "", err
+	}
+	return s, dir, json.Unmarshal(plain, &s)
+}
+
+// GetSnapshot returns the metadata of snapshot id.
+func GetSnapshot(masterKey []byte, baseDir, id string) (Snapshot, error) {
+	s, _, err := loadSnapshot(masterKey, baseDir, id)
+	return s, err
+}
+
+// ListSnapshots returns the snapshots of the directory at logicalPath,
+// oldest first.
+func ListSnapshots(masterKey []byte, baseDir, logicalPath string) ([]Snapshot, error) {
+	want := cleanDirPath(logicalPath)
+	ents, err := os.ReadDir(snapshotsDir(baseDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	out := []Snapshot{}
+	for _, d := range ents {
+		s, _, err := loadSnapshot(masterKey, baseDir, d.Name())
+		if errors.Is(err, ErrNoSnapshot) {
+			continue // half-created
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.Path == want {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+// SnapshotAt picks the newest snapshot of logicalPath taken at or before t.
+func SnapshotAt(masterKey []byte, baseDir, logicalPath string, t time.Time) (Snapshot, error) {
+	all, err := ListSnapshots(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		if !all[i].Created.After(t) {
+			return all[i], nil
+		}
+	}
+	return Snapshot{}, ErrNoSnapshot
+}
+
+// DeleteSnapshot drops a snapshot; blobs still used by the live tree or
+// other snapshots survive through their other links.
+func DeleteSnapshot(masterKey []byte, baseDir, id string) error {
+	_, dir, err := loadSnapshot(masterKey, baseDir, id)
+	if err != nil {
+		return err
+	}
+	removeMirrors(dir)
+	return os.RemoveAll(dir)
+}
+
+// RestoreSnapshot rolls the snapshot's directory back to its captured state.
+// The current state is snapshotted first, so a restore can itself be undone;
+// that snapshot is returned. Directories holding immutable entries are never
+// rolled back.
+func RestoreSnapshot(masterKey []byte, baseDir, id, owner string) (Snapshot, error) {
+	s, dir, err := loadSnapshot(masterKey, baseDir, id)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if s.Path != "" {
+		// recreate the directory if it was deleted since
+		if _, _, err := resolveParentDirAs(masterKey, baseDir, s.Path+"/x", true, owner); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	live, err := resolveDir(masterKey, baseDir, s.Path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if s.Path != "" {
+		parentDir, name, err := resolveParentDir(masterKey, baseDir, s.Path, false)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		m, err := loadManifest(masterKey, parentDir)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		_, e := findEntry(m, name, "dir")
+		if e == nil {
+			return Snapshot{}, fmt.Errorf("%q is not a directory", s.Path)
+		}
+		if err := checkMutable(masterKey, baseDir, s.Path, e); err != nil {
+			return Snapshot{}, err
+		}
+	}
+	held, err := heldWithin(masterKey, live, time.Now().Unix())
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if held {
+		return Snapshot{}, fmt.Errorf("%q contains held entries: %w", s.Path, ErrImmutable)
+	}
+
+	undo, err := CreateSnapshot(masterKey, baseDir, s.Path, owner, "before restoring "+s.ID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return undo, restoreTree(masterKey, filepath.Join(dir, "tree"), live, s.Path)
+}
+
+// restoreTree makes live match snap: snapshot blobs are linked over the live
+// ones, each manifest is swapped in once its children are in place, and only
+// then is whatever the snapshot doesn't know about removed.
+func restoreTree(masterKey []byte, snap, live, logical string) error {
+	m, err := loadManifest(masterKey, snap)
+	if err != nil {
+		return err
+	}
+	old, err := loadManifest(masterKey, live)
+	if err != nil {
+		return err
+	}
+	prev := map[string]ManifestEntry{}
+	for _, e := range old.Entries {
+		prev[e.Type+"/"+e.Enc] = e
+	}
+	keep := map[string]bool{}
+	for _, e := range m.Entries {
+		keep[e.Type+"/"+e.Enc] = true
+		p := path.Join(logical, e.Name)
+		was, existed := prev[e.Type+"/"+e.Enc]
+		switch e.Type {
+		case "file":
+			blob := blobPath(live, &e)
+			tmp := blob + ".restore.tmp"
+			os.Remove(tmp)
+			if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(blobPath(snap, &e), tmp); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			unlock := lockBlob(blob)
+			err := os.Rename(tmp, blob)
+			unlock()
+			if err != nil {
+				os.Remove(tmp)
+				return err
+			}
+			if !existed {
+				events.Publish(events.Event{Type: events.FileCreated, Path: p, Size: e.Size})
+			} else if was.Rev != e.Rev || was.Size != e.Size {
+				events.Publish(events.Event{Type: events.FileUpdated, Path: p, Size: e.Size})
+			}
+		case "dir":
+			if err := os.MkdirAll(filepath.Join(live, e.Enc), 0755); err != nil {
+				return err
+			}
+			if err := restoreTree(masterKey, filepath.Join(snap, e.Enc), filepath.Join(live, e.Enc), p); err != nil {
+				return err
+			}
+			if !existed {
+				events.Publish(events.Event{Type: events.DirCreated, Path: p})
+			}
+		}
+	}
+	raw, err := os.ReadFile(manifestPath(snap))
+	if err != nil {
+		return err
+	}
+	tmp := manifestPath(live) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, manifestPath(live)); err != nil {
+		return err
+	}
+	for _, e := range old.Entries {
+		if !keep[e.Type+"/"+e.Enc] {
+			removeBlob(live, e, path.Join(logical, e.Name))
+		}
+	}
+	return nil
+}
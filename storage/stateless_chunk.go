@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"SCloud/coord"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/hkdf"
@@ -11,7 +14,6 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-	"time"
 )
 
 type ChunkMeta struct {
@@ -21,11 +23,48 @@ type ChunkMeta struct {
 	Index       uint32
 	TotalChunks int
 	TotalSize   int64 // optional but used to UpdateFileMeta on assemble
+
+	BlobKey     []byte    // key for the blob itself; nil = masterKey
+	KeyOwner    string    // recorded in the manifest entry when BlobKey is a user key
+	Owner       string    // uploading user, recorded as the file's owner
+	Passthrough bool      // client-encrypted: store chunks verbatim, no header or framing
+	Conflict    string    // Conflict* policy, applied when the file is assembled
+	Base        *SyncBase // non-nil: a sync client's upload, see CommitBlobSynced
+}
+
+// stagingBase is UPLOAD_STAGING_DIR; "" stages inside each storage root.
+var stagingBase string
+
+// SetStagingDir moves chunk staging out of the storage roots and under dir,
+// e.g. onto scratch disk. Keep it on the data volume's filesystem where
+// possible: parts are read back into the final blob either way, but a
+// separate disk also has to hold every upload twice while it is assembled.
+func SetStagingDir(dir string) { stagingBase = dir }
+
+// stagingRoot holds root's in-progress chunked uploads: <root>/_uploads, or
+// a directory per root under the configured staging dir.
+func stagingRoot(root string) string {
+	if stagingBase == "" {
+		return filepath.Join(root, "_uploads")
+	}
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(stagingBase, hex.EncodeToString(sum[:8]))
 }
 
-// staging directory: <root>/_uploads/<fileid>/
-func stagingDirFor(root, fileID string) string {
-	return filepath.Join(root, "_uploads", safeID(fileID))
+// staging directory: <stagingRoot>/<fileid>/
+func stagingDirFor(root, fileID string) (string, error) {
+	if !ValidFileID(fileID) {
+		return "", ErrBadFileID
+	}
+	sr := stagingRoot(root)
+	dir := filepath.Join(sr, fileID)
+	if rel, err := filepath.Rel(sr, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") || strings.ContainsRune(rel, filepath.Separator) {
+		return "", ErrBadFileID
+	}
+	return dir, nil
 }
 func safeID(id string) string {
 	// make a filesystem-friendly id
@@ -38,19 +77,19 @@ func safeID(id string) string {
 }
 
 type stagedHeader struct {
-	hdr         []byte // exact header bytes used as AAD (version|salt|noncePrefix|chunkSize)
+	hdr         []byte // exact header bytes used as AAD (version|salt|noncePrefix|chunkSize|keyID)
 	salt        []byte
 	noncePrefix []byte
 }
 
-// derive deterministic header from (masterKey, fileID, chunkSize)
-func deriveHeaderFor(masterKey []byte, fileID string, chunkSize int) (stagedHeader, error) {
+// derive deterministic header from (masterKey, fileID, chunkSize); it names blobKey
+func deriveHeaderFor(masterKey, blobKey []byte, fileID string, chunkSize int) (stagedHeader, error) {
 	// Deterministic per-file salt & noncePrefix using HKDF with fileID as "salt" input.
 	// This keeps "stateless" across requests; uniqueness comes from FileID.
 	fileIDbytes := []byte(fileID)
 	salt := hkdfBytes(16, masterKey, fileIDbytes, []byte("upload-salt:v1"))
 	nonce := hkdfBytes(8, masterKey, fileIDbytes, []byte("upload-nonceprefix:v1"))
-	hdr := generateHeader(chunkSize, salt, nonce)
+	hdr := generateHeader(versionByte, chunkSize, salt, nonce, blobKey)
 	return stagedHeader{hdr: hdr, salt: salt, noncePrefix: nonce}, nil
 }
 func hkdfBytes(n int, key, salt, info []byte) []byte {
@@ -137,50 +176,70 @@ func haveAllParts(staging string, total int) (bool, error) {
 	return true, nil
 }
 
-func assemble(masterKey []byte, baseDir, logicalPath, staging string, sh stagedHeader, totalChunks int, totalSize int64) (string, error) {
+func assemble(masterKey []byte, baseDir, logicalPath, staging string, sh stagedHeader, meta ChunkMeta) (string, error) {
 	root, err := ensureRoot(masterKey, baseDir)
 	if err != nil {
 		return "", err
 	}
 
-	// allocate final path & manifest entry *now*
-	dstPath, err := ResolveForCreate(masterKey, baseDir, logicalPath)
+	// the name is only settled now; earlier chunks may predate a competing upload
+	logicalPath, err = ResolveConflict(masterKey, baseDir, logicalPath, meta.Conflict)
 	if err != nil {
 		return "", err
 	}
 
-	// create final file; write header
-	out, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_EXCL, 0644)
+	// allocate final path & manifest entry *now*
+	dstPath, err := ResolveForCreateAs(masterKey, baseDir, logicalPath, meta.Owner)
 	if err != nil {
 		return "", err
 	}
-	if _, err := out.Write(sh.hdr); err != nil {
-		out.Close()
+
+	// build the blob beside its final path; an overwrite only replaces the
+	// old one once every part is in
+	out, err := CreateBlob(dstPath)
+	if err != nil {
 		return "", err
 	}
+	defer out.Abort()
+	if !meta.Passthrough {
+		if _, err := out.Write(sh.hdr); err != nil {
+			return "", err
+		}
+	}
 
 	// append all parts in order
-	for i := 0; i < totalChunks; i++ {
+	for i := 0; i < meta.TotalChunks; i++ {
 		part := filepath.Join(staging, fmt.Sprintf("%08d.part", i))
 		b, err := os.ReadFile(part)
 		if err != nil {
-			out.Close()
 			return "", err
 		}
 		if _, err := out.Write(b); err != nil {
-			out.Close()
 			return "", err
 		}
 	}
-	if err := out.Sync(); err != nil {
-		out.Close()
-		return "", err
+	encryption := ""
+	if meta.Passthrough {
+		encryption = EncryptionClient
 	}
-	_ = out.Close()
-
-	// update manifest (plaintext size if known)
-	if totalSize > 0 {
-		_ = UpdateFileMeta(masterKey, baseDir, logicalPath, totalSize, time.Now())
+	size := meta.TotalSize
+	if size <= 0 {
+		size = -1 // not sent: measure the blob
+	}
+	// Only an overwrite may replace an existing blob
+	info := BlobInfo{
+		KeyOwner:   meta.KeyOwner,
+		Encryption: encryption,
+		Size:       size,
+		Exclusive:  meta.Conflict != "" && meta.Conflict != ConflictOverwrite,
+	}
+	if meta.Base != nil {
+		logicalPath, err = CommitBlobSynced(masterKey, baseDir, logicalPath, out, info, *meta.Base, meta.Owner)
+	} else {
+		err = CommitBlob(masterKey, baseDir, logicalPath, out, info)
+	}
+	if err != nil {
+		return "", err
 	}
 
 	// cleanup staging
@@ -213,20 +272,34 @@ func IngestChunkStateless(masterKey []byte, baseDir string, meta ChunkMeta, plai
 		return false, "", err
 	}
 
+	blobKey := meta.BlobKey
+	if blobKey == nil {
+		blobKey = masterKey
+	}
+
 	// derive deterministic header from (masterKey, fileID, chunkSize)
-	sh, err := deriveHeaderFor(masterKey, meta.FileID, meta.ChunkSize)
+	sh, err := deriveHeaderFor(masterKey, blobKey, meta.FileID, meta.ChunkSize)
 	if err != nil {
 		return false, "", err
 	}
 
-	// encrypt the record with header||index as AAD
-	rec, err := encryptRecord(masterKey, sh, meta.Index, plain)
+	// encrypt the record with header||index as AAD (client-encrypted chunks are kept as-is)
+	rec := plain
+	if !meta.Passthrough {
+		rec, err = encryptRecord(blobKey, sh, meta.Index, plain)
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	// write part file into the upload's staging dir
+	staging, err := stagingDirFor(root, meta.FileID)
 	if err != nil {
 		return false, "", err
 	}
-
-	// write part file into <root>/_uploads/<fileid>/
-	staging := stagingDirFor(root, meta.FileID)
+	if err := recordUploadState(masterKey, staging, meta); err != nil {
+		return false, "", err
+	}
 	if err := writePart(staging, meta.Index, rec); err != nil {
 		return false, "", err
 	}
@@ -240,7 +313,22 @@ func IngestChunkStateless(masterKey []byte, baseDir string, meta ChunkMeta, plai
 		return false, "", nil
 	}
 
-	lp, err := assemble(masterKey, baseDir, meta.LogicalPath, staging, sh, meta.TotalChunks, meta.TotalSize)
+	// one instance assembles; the last chunks arriving together elsewhere
+	// leave it to whoever got there first
+	unlock, err := locker.TryLock(context.Background(), "assemble:"+lockName(root)+"|"+safeID(meta.FileID))
+	if errors.Is(err, coord.ErrHeld) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	defer unlock()
+	// the upload may have been assembled while we waited
+	if all, err := haveAllParts(staging, meta.TotalChunks); err != nil || !all {
+		return false, "", err
+	}
+
+	lp, err := assemble(masterKey, baseDir, meta.LogicalPath, staging, sh, meta)
 	if err != nil {
 		return false, "", err
 	}
@@ -30,8 +30,15 @@ type Storage interface {
 
 const (
 	versionByte = 1
-	headerSize  = 1 + 16 + 8 + 4
-	// ver(1) + salt(16) + noncePrefix(8) + chunkSize(4) + name() + filesize()
+	// versionRandomNonce blobs carry a random 12-byte nonce in front of each
+	// chunk's ciphertext instead of deriving it from the chunk index, so a
+	// chunk can be re-sealed in place (PatchFile) without reusing a nonce.
+	versionRandomNonce = 2
+	// flagKeyID on the version byte means a 4-byte key ID (see KeyID)
+	// follows the fixed header and is part of it.
+	flagKeyID  = 0x80
+	headerSize = 1 + 16 + 8 + 4
+	// ver(1) + salt(16) + noncePrefix(8) + chunkSize(4) [+ keyID(4)]
 	defaultChunk = 1 << 20 // 1 MiB
 
 	manifestFileName = "_manifest.bin"
@@ -42,10 +49,16 @@ func readHeader(r io.Reader) (chunkSize int, hdr, salt, noncePrefix []byte, err
 	if _, err = io.ReadFull(r, hdr); err != nil {
 		return
 	}
-	if hdr[0] != versionByte {
+	if v := hdr[0] &^ flagKeyID; v != versionByte && v != versionRandomNonce {
 		err = fmt.Errorf("unsupported version: %d", hdr[0])
 		return
 	}
+	if hdr[0]&flagKeyID != 0 {
+		hdr = append(hdr, make([]byte, 4)...)
+		if _, err = io.ReadFull(r, hdr[headerSize:]); err != nil {
+			return
+		}
+	}
 	salt = make([]byte, 16)
 	copy(salt, hdr[1:17])
 
@@ -56,23 +69,34 @@ func readHeader(r io.Reader) (chunkSize int, hdr, salt, noncePrefix []byte, err
 	return
 }
 
-// writeHeader writes a header to the given writer containing version, salt, noncePrefix, and chunk size information.
+// writeHeader writes a header to the given writer containing version, salt, noncePrefix, chunk size and the ID of key.
 // It returns an error if writing to the writer fails.
-func writeHeader(w io.Writer, chunkSize int, salt, noncePrefix []byte) ([]byte, error) {
-	hdr := generateHeader(chunkSize, salt, noncePrefix)
+func writeHeader(w io.Writer, version byte, chunkSize int, salt, noncePrefix, key []byte) ([]byte, error) {
+	hdr := generateHeader(version, chunkSize, salt, noncePrefix, key)
 	_, err := w.Write(hdr)
 	return hdr, err
 }
 
-func generateHeader(chunkSize int, salt, noncePrefix []byte) []byte {
-	hdr := make([]byte, headerSize)
-	hdr[0] = versionByte
+func generateHeader(version byte, chunkSize int, salt, noncePrefix, key []byte) []byte {
+	hdr := make([]byte, headerSize+4)
+	hdr[0] = version | flagKeyID
 	copy(hdr[1:17], salt)
 	copy(hdr[17:25], noncePrefix)
 	binary.BigEndian.PutUint32(hdr[25:29], uint32(chunkSize))
+	binary.BigEndian.PutUint32(hdr[29:33], KeyID(key))
 	return hdr
 }
 
+func headerKeyID(hdr []byte) (uint32, bool) {
+	if hdr[0]&flagKeyID == 0 || len(hdr) < headerSize+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(hdr[headerSize:]), true
+}
+
+// headerVersion is the blob format, without flags.
+func headerVersion(hdr []byte) byte { return hdr[0] &^ flagKeyID }
+
 // Use HKDF to turn file salt and masterkey, into the actual file key.
 func deriveFileKey(masterKey, salt []byte) ([]byte, error) {
 	x := hkdf.New(sha256.New, masterKey, salt, []byte("file-key:v1"))
@@ -89,7 +113,96 @@ func getGCMBlock(key []byte) (cipher.AEAD, error) {
 	return cipher.NewGCM(block)
 }
 
+// chunkCipher seals and opens the chunk records of one blob. Every chunk is
+// authenticated with header || index as AAD, which pins it to its position.
+type chunkCipher struct {
+	aead        cipher.AEAD
+	hdr         []byte
+	noncePrefix []byte
+}
+
+func newChunkCipher(masterKey, hdr, salt, noncePrefix []byte) (*chunkCipher, error) {
+	masterKey, err := openingKey(masterKey, hdr)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveFileKey(masterKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	aeadBlock, err := getGCMBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aeadBlock, hdr: hdr, noncePrefix: noncePrefix}, nil
+}
+
+func (c *chunkCipher) randomNonce() bool { return headerVersion(c.hdr) == versionRandomNonce }
+
+// overhead is how much longer a chunk's record body is than its plaintext.
+func (c *chunkCipher) overhead() int {
+	if c.randomNonce() {
+		return c.aead.NonceSize() + c.aead.Overhead()
+	}
+	return c.aead.Overhead()
+}
+
+func (c *chunkCipher) aad(index uint32) []byte {
+	aad := make([]byte, len(c.hdr)+4)
+	copy(aad, c.hdr)
+	binary.BigEndian.PutUint32(aad[len(c.hdr):], index)
+	return aad
+}
+
+func (c *chunkCipher) seal(index uint32, plain []byte) ([]byte, error) {
+	if c.randomNonce() {
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return c.aead.Seal(nonce, nonce, plain, c.aad(index)), nil
+	}
+	nonce := make([]byte, 12) // 8B prefix || 4B counter
+	copy(nonce[:8], c.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[8:], index)
+	return c.aead.Seal(nil, nonce, plain, c.aad(index)), nil
+}
+
+func (c *chunkCipher) open(index uint32, ct []byte) ([]byte, error) {
+	var nonce []byte
+	if c.randomNonce() {
+		if len(ct) < c.aead.NonceSize() {
+			return nil, fmt.Errorf("auth failed on chunk %d: short record", index)
+		}
+		nonce, ct = ct[:c.aead.NonceSize()], ct[c.aead.NonceSize():]
+	} else {
+		nonce = make([]byte, 12)
+		copy(nonce[:8], c.noncePrefix)
+		binary.BigEndian.PutUint32(nonce[8:], index)
+	}
+	plaintext, err := c.aead.Open(nil, nonce, ct, c.aad(index))
+	if err != nil {
+		return nil, fmt.Errorf("auth failed on chunk %d: %w", index, err)
+	}
+	return plaintext, nil
+}
+
+// writeRecord writes one [len][ct] record.
+func writeRecord(w io.Writer, ct []byte) error {
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(ct)))
+	if _, err := w.Write(lenPrefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(ct)
+	return err
+}
+
 func Encrypt(masterKey []byte, r io.Reader, w io.Writer, chunkSize int) error {
+	return encryptVersion(masterKey, r, w, chunkSize, versionByte)
+}
+
+func encryptVersion(masterKey []byte, r io.Reader, w io.Writer, chunkSize int, version byte) error {
 	if chunkSize <= 0 {
 		chunkSize = defaultChunk
 	}
@@ -105,65 +218,53 @@ func Encrypt(masterKey []byte, r io.Reader, w io.Writer, chunkSize int) error {
 	}
 
 	// Write header and keep the exact bytes for AAD.
-	hdr, err := writeHeader(w, chunkSize, salt, noncePrefix)
+	hdr, err := writeHeader(w, version, chunkSize, salt, noncePrefix, masterKey)
 	if err != nil {
 		return err
 	}
 
-	key, err := deriveFileKey(masterKey, salt)
+	cc, err := newChunkCipher(masterKey, hdr, salt, noncePrefix)
 	if err != nil {
 		return err
 	}
-	aeadBlock, err := getGCMBlock(key)
+	index, err := sealChunks(cc, 0, chunkSize, r, w)
 	if err != nil {
 		return err
 	}
 
-	buf := make([]byte, chunkSize)
-	nonce := make([]byte, 12) // 8B prefix || 4B counter
-	copy(nonce[:8], noncePrefix)
-
-	// Prepare AAD buffer once: header || indexBE32
-	aad := make([]byte, len(hdr)+4)
-	copy(aad, hdr)
+	log.Printf("Encrypted %d chunks", index)
+	return nil
+}
 
-	var index uint32 = 0
+// sealChunks encrypts r in chunkSize pieces as [len][ct] records, numbering
+// them from index. It returns the index after the last chunk written.
+func sealChunks(cc *chunkCipher, index uint32, chunkSize int, r io.Reader, w io.Writer) (uint32, error) {
+	buf := make([]byte, chunkSize)
 	for {
-		n, readErr := r.Read(buf)
+		n, readErr := io.ReadFull(r, buf)
 		if n > 0 {
-			// Set per-chunk nonce and AAD index.
-			binary.BigEndian.PutUint32(nonce[8:], index)
-			binary.BigEndian.PutUint32(aad[len(hdr):], index)
-
-			// Encrypt this chunk.
-			ct := aeadBlock.Seal(nil, nonce, buf[:n], aad)
-
-			var lenPrefix [4]byte
-			binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(ct)))
-			if _, err := w.Write(lenPrefix[:]); err != nil {
-				return err
+			ct, err := cc.seal(index, buf[:n])
+			if err != nil {
+				return index, err
 			}
-			if _, err := w.Write(ct); err != nil {
-				return err
+			if err := writeRecord(w, ct); err != nil {
+				return index, err
 			}
 
 			// Overflow guard: 2^32 chunks max.
 			if index == ^uint32(0) {
-				return fmt.Errorf("too many chunks: index overflow")
+				return index, fmt.Errorf("too many chunks: index overflow")
 			}
 			index++
 		}
 
-		if readErr == io.EOF {
-			break
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return index, nil
 		}
 		if readErr != nil {
-			return readErr
+			return index, readErr
 		}
 	}
-
-	log.Printf("Encrypted %d chunks", index)
-	return nil
 }
 
 func Decrypt(masterKey []byte, r io.Reader, w io.Writer) error {
@@ -172,21 +273,11 @@ func Decrypt(masterKey []byte, r io.Reader, w io.Writer) error {
 		return err
 	}
 
-	key, err := deriveFileKey(masterKey, salt)
-	if err != nil {
-		return err
-	}
-	aeadBlock, err := getGCMBlock(key)
+	cc, err := newChunkCipher(masterKey, hdr, salt, noncePrefix)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, 12)
-	copy(nonce[:8], noncePrefix)
-
-	aad := make([]byte, len(hdr)+4)
-	copy(aad, hdr)
-
 	var index uint32 = 0
 	for {
 		var lenPrefix [4]byte
@@ -205,12 +296,9 @@ func Decrypt(masterKey []byte, r io.Reader, w io.Writer) error {
 			return err
 		}
 
-		binary.BigEndian.PutUint32(nonce[8:], index)
-		binary.BigEndian.PutUint32(aad[len(hdr):], index)
-
-		plaintext, err := aeadBlock.Open(nil, nonce, ciphertext, aad)
+		plaintext, err := cc.open(index, ciphertext)
 		if err != nil {
-			return fmt.Errorf("auth failed on chunk %d: %w", index, err)
+			return err
 		}
 
 		if _, err = w.Write(plaintext); err != nil {
@@ -225,39 +313,105 @@ func Decrypt(masterKey []byte, r io.Reader, w io.Writer) error {
 }
 
 func ListDir(masterKey []byte, baseDir, logicalPath string) ([]ManifestEntry, error) {
+	dir, err := resolveDir(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return nil, err
+	}
+	return m.Entries, nil
+}
+
+// resolveDir maps a logical directory path to its on-disk directory.
+func resolveDir(masterKey []byte, baseDir, logicalPath string) (string, error) {
 	// special case: root
 	if logicalPath == "" || logicalPath == "." || logicalPath == "/" {
-		root, err := ensureRoot(masterKey, baseDir)
-		if err != nil {
-			return nil, err
-		}
-		m, err := loadManifest(masterKey, root)
-		if err != nil {
-			return nil, err
-		}
-		return m.Entries, nil
+		return ensureRoot(masterKey, baseDir)
 	}
 
 	// resolve parent directory
 	parentDir, dirName, err := resolveParentDir(masterKey, baseDir, logicalPath, false)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	m, err := loadManifest(masterKey, parentDir)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	_, entry := findEntry(m, dirName, "dir")
 	if entry == nil {
-		return nil, fmt.Errorf("%q is not a directory", logicalPath)
+		return "", fmt.Errorf("%q is not a directory", logicalPath)
 	}
+	return filepath.Join(parentDir, entry.Enc), nil
+}
 
-	// load child manifest
-	childDir := filepath.Join(parentDir, entry.Enc)
-	cm, err := loadManifest(masterKey, childDir)
+type DirUsage struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"` // plaintext bytes, recursive
+	Files int    `json:"files"`
+	Dirs  int    `json:"dirs"`
+}
+
+// DiskUsage walks the manifest tree below logicalPath and sums file sizes.
+func DiskUsage(masterKey []byte, baseDir, logicalPath string) (*DirUsage, error) {
+	dir, err := resolveDir(masterKey, baseDir, logicalPath)
 	if err != nil {
 		return nil, err
 	}
-	return cm.Entries, nil
+	u := &DirUsage{Path: logicalPath}
+	if err := walkUsage(masterKey, dir, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UsageByOwner sums file sizes in the whole tree by Owner; unowned files
+// are counted under "".
+func UsageByOwner(masterKey []byte, baseDir string, into map[string]int64) error {
+	dir, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return err
+	}
+	return walkOwners(masterKey, dir, into)
+}
+
+func walkOwners(masterKey []byte, dir string, into map[string]int64) error {
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		switch e.Type {
+		case "file":
+			into[e.Owner] += e.Size
+		case "dir":
+			if err := walkOwners(masterKey, filepath.Join(dir, e.Enc), into); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func walkUsage(masterKey []byte, dir string, u *DirUsage) error {
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		switch e.Type {
+		case "file":
+			u.Files++
+			u.Size += e.Size
+		case "dir":
+			u.Dirs++
+			if err := walkUsage(masterKey, filepath.Join(dir, e.Enc), u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
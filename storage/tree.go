@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// TreeEntry is an entry met walking a tree, with its logical path.
+type TreeEntry struct {
+	Path string
+	ManifestEntry
+}
+
+// TreePos is where a tree listing stopped: the key of each entry on the
+// way down to the last one listed. Its String form is what ListTree takes
+// back to carry on.
+type TreePos []string
+
+func (p TreePos) String() string { return strings.Join(p, "/") }
+
+// ParseTreePos reads back a TreePos's String.
+func ParseTreePos(s string) TreePos {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "/")
+}
+
+// a file and a directory may share a name, so the type breaks ties
+func treeKey(e *ManifestEntry) string { return e.Name + "\x00" + e.Type }
+
+var errTreePageFull = errors.New("page full")
+
+type treeWalk struct {
+	masterKey []byte
+	recursive bool
+	limit     int
+	filter    func(dir string, entries []ManifestEntry) ([]ManifestEntry, error)
+
+	entries []TreeEntry
+	last    TreePos
+}
+
+// ListTree lists the entries of the directory logicalPath, and with
+// recursive everything below it, depth first with each directory's entries
+// in name order. It starts after the position after (nil for the top) and
+// stops at limit entries, returning the position to carry on from, or nil
+// when the listing is complete. Entries added or removed between pages
+// neither repeat nor shift the rest. filter, if set, drops entries of a
+// directory before they are listed or descended into.
+func ListTree(masterKey []byte, baseDir, logicalPath string, recursive bool, after TreePos, limit int, filter func(dir string, entries []ManifestEntry) ([]ManifestEntry, error)) ([]TreeEntry, TreePos, error) {
+	dir, err := resolveDir(masterKey, baseDir, logicalPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &treeWalk{masterKey: masterKey, recursive: recursive, limit: limit, filter: filter}
+	err = w.walk(dir, path.Clean(logicalPath), nil, after)
+	if errors.Is(err, errTreePageFull) {
+		return w.entries, w.last, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.entries, nil, nil
+}
+
+func (w *treeWalk) walk(dir, logical string, pos, after TreePos) error {
+	m, err := loadManifest(w.masterKey, dir)
+	if err != nil {
+		return err
+	}
+	entries := slices.Clone(m.Entries)
+	if w.filter != nil {
+		if entries, err = w.filter(logical, entries); err != nil {
+			return err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return treeKey(&entries[i]) < treeKey(&entries[j]) })
+	start := 0
+	if len(after) > 0 {
+		start = sort.Search(len(entries), func(i int) bool { return treeKey(&entries[i]) >= after[0] })
+	}
+	for i := start; i < len(entries); i++ {
+		e := &entries[i]
+		k := treeKey(e)
+		here := append(pos[:len(pos):len(pos)], k)
+		p := path.Join(logical, e.Name)
+		var sub TreePos
+		if len(after) > 0 && k == after[0] {
+			// listed on an earlier page; only what is below it may be left
+			sub = after[1:]
+		} else {
+			if len(w.entries) == w.limit {
+				return errTreePageFull
+			}
+			w.entries = append(w.entries, TreeEntry{Path: p, ManifestEntry: *e})
+			w.last = here
+		}
+		after = nil
+		if w.recursive && e.Type == "dir" {
+			if err := w.walk(filepath.Join(dir, e.Enc), p, here, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Per-user keys live wrapped at <root>/_keys/<userID>.key:
+//
+//	mode(1) | salt(16) | nonce(12) | AES-GCM(userKey), AAD = userID
+//
+// mode selects the wrapping key: the master key (server can always unwrap)
+// or a scrypt key derived from the user's password (server-blind at rest).
+const (
+	WrapMaster   byte = 1
+	WrapPassword byte = 2
+
+	userKeyLen = 32
+)
+
+var ErrNoUserKey = errors.New("user key not found")
+
+func userKeyPath(baseDir, userID string) string {
+	return filepath.Join(baseDir, "filestorage", "_keys", safeID(userID)+".key")
+}
+
+func wrappingKey(mode byte, masterKey []byte, password string, salt []byte) ([]byte, error) {
+	switch mode {
+	case WrapMaster:
+		k := make([]byte, 32)
+		_, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, []byte("user-key-wrap:v1")), k)
+		return k, err
+	case WrapPassword:
+		return scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+	default:
+		return nil, fmt.Errorf("unknown key wrap mode %d", mode)
+	}
+}
+
+// CreateUserKey generates a fresh user key, stores it wrapped and returns it.
+func CreateUserKey(masterKey []byte, baseDir, userID, password string, mode byte) ([]byte, error) {
+	userKey := make([]byte, userKeyLen)
+	if _, err := rand.Read(userKey); err != nil {
+		return nil, err
+	}
+	if err := writeUserKey(masterKey, baseDir, userID, password, mode, userKey); err != nil {
+		return nil, err
+	}
+	return userKey, nil
+}
+
+func writeUserKey(masterKey []byte, baseDir, userID, password string, mode byte, userKey []byte) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	wk, err := wrappingKey(mode, masterKey, password, salt)
+	if err != nil {
+		return err
+	}
+	aead, err := getGCMBlock(wk)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	blob := []byte{mode}
+	blob = append(blob, salt...)
+	blob = append(blob, nonce...)
+	blob = aead.Seal(blob, nonce, userKey, []byte(userID))
+
+	return writeKeyFile(userKeyPath(baseDir, userID), blob)
+}
+
+func writeKeyFile(p string, blob []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// UnlockUserKey unwraps a stored user key. password is ignored for master-wrapped keys.
+func UnlockUserKey(masterKey []byte, baseDir, userID, password string) ([]byte, error) {
+	blob, err := os.ReadFile(userKeyPath(baseDir, userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoUserKey
+		}
+		return nil, err
+	}
+	if len(blob) < 1+16+12 {
+		return nil, fmt.Errorf("user key file truncated")
+	}
+	mode, salt, nonce, ct := blob[0], blob[1:17], blob[17:29], blob[29:]
+
+	// a master-wrapped key may still be wrapped under a retired master key
+	candidates := [][]byte{masterKey}
+	if mode == WrapMaster {
+		candidates = append(candidates, retiredKeys()...)
+	}
+	for _, mk := range candidates {
+		wk, werr := wrappingKey(mode, mk, password, salt)
+		if werr != nil {
+			return nil, werr
+		}
+		aead, werr := getGCMBlock(wk)
+		if werr != nil {
+			return nil, werr
+		}
+		var userKey []byte
+		if userKey, err = aead.Open(nil, nonce, ct, []byte(userID)); err == nil {
+			return userKey, nil
+		}
+	}
+	return nil, fmt.Errorf("unwrap user key: %w", err)
+}
+
+// RewrapUserKeys re-wraps every master-wrapped user key under masterKey,
+// so none depends on a retired key. It returns how many it rewrote.
+func RewrapUserKeys(masterKey []byte, baseDir string) (int, error) {
+	ents, err := os.ReadDir(filepath.Join(baseDir, "filestorage", "_keys"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range ents {
+		userID, ok := strings.CutSuffix(e.Name(), ".key")
+		if !ok {
+			continue
+		}
+		if mode, err := UserKeyMode(baseDir, userID); err != nil || mode != WrapMaster {
+			continue
+		}
+		userKey, err := UnlockUserKey(masterKey, baseDir, userID, "")
+		if err != nil {
+			return n, fmt.Errorf("user %s: %w", userID, err)
+		}
+		if err := writeUserKey(masterKey, baseDir, userID, "", WrapMaster, userKey); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// UserKeyMode returns the wrap mode of a stored user key.
+func UserKeyMode(baseDir, userID string) (byte, error) {
+	f, err := os.Open(userKeyPath(baseDir, userID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNoUserKey
+		}
+		return 0, err
+	}
+	defer f.Close()
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// ResetUserKey stores userKey for userID again, keeping its wrap mode: a
+// password-wrapped key is wrapped under password. It is how a key recovered
+// without the old password gets a new one.
+func ResetUserKey(masterKey []byte, baseDir, userID, password string, userKey []byte) error {
+	mode, err := UserKeyMode(baseDir, userID)
+	if err != nil {
+		return err
+	}
+	return writeUserKey(masterKey, baseDir, userID, password, mode, userKey)
+}
+
+// RewrapUserKey re-wraps a password-wrapped key under newPassword. Keys
+// wrapped by the master key, and users without a key, are left alone.
+func RewrapUserKey(masterKey []byte, baseDir, userID, oldPassword, newPassword string) error {
+	mode, err := UserKeyMode(baseDir, userID)
+	if errors.Is(err, ErrNoUserKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mode != WrapPassword {
+		return nil
+	}
+	userKey, err := UnlockUserKey(masterKey, baseDir, userID, oldPassword)
+	if err != nil {
+		return err
+	}
+	return writeUserKey(masterKey, baseDir, userID, newPassword, mode, userKey)
+}
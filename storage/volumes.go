@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Blobs can live on other disks than the manifests. A file's entry records
+// the volume its blob was placed on; "" is the root itself. On a volume,
+// the blob of <root>/<rel>/<slug> sits at <volume>/<root ID>/<rel>/<slug>.bin,
+// so snapshots there are hard links on the same disk as the live blob.
+const (
+	PlaceMostFree   = "most-free"   // the volume with the most free bytes
+	PlaceRoundRobin = "round-robin" // each volume in turn
+
+	// LocalVolume names the root itself wherever volumes are named.
+	LocalVolume = "local"
+)
+
+// Placement decides where new blobs go. Pins send a user's files to one
+// volume whatever the policy says.
+type Placement struct {
+	Volumes map[string]string // name -> dir
+	Policy  string
+	Pins    map[string]string // user ID -> volume name
+}
+
+var (
+	placementMu sync.Mutex
+	placement   Placement
+	nextVolume  int
+
+	rootIDs sync.Map // root -> ID
+)
+
+// SetPlacement configures the blob volumes. Entries naming a volume that is
+// not configured are read from the root, where Rebalance can move them.
+func SetPlacement(p Placement) {
+	pins := make(map[string]string, len(p.Pins))
+	for user, name := range p.Pins {
+		pins[user] = volumeName(name)
+	}
+	p.Pins = pins
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	placement = p
+}
+
+func volumeDir(name string) (string, bool) {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	dir, ok := placement.Volumes[name]
+	return dir, ok
+}
+
+// Volumes returns the configured volumes by name.
+func Volumes() map[string]string {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	out := make(map[string]string, len(placement.Volumes))
+	for k, v := range placement.Volumes {
+		out[k] = v
+	}
+	return out
+}
+
+// volumeName turns LocalVolume into the "" stored in entries.
+func volumeName(name string) string {
+	if name == LocalVolume {
+		return ""
+	}
+	return name
+}
+
+// splitRoot finds the storage root a manifest dir belongs to: the last
+// "filestorage" element, as slugs are hex and never match it.
+func splitRoot(dir string) (root, rel string) {
+	sep := string(filepath.Separator)
+	i := strings.LastIndex(dir+sep, sep+"filestorage"+sep)
+	if i < 0 {
+		return dir, ""
+	}
+	root = dir[:i+len(sep+"filestorage")]
+	return root, strings.TrimPrefix(dir[len(root):], sep)
+}
+
+// rootID names root on the volumes. It is kept in the root, so moving a
+// store to another path keeps its blobs.
+func rootID(root string) (string, error) {
+	if id, ok := rootIDs.Load(root); ok {
+		return id.(string), nil
+	}
+	p := filepath.Join(root, "_rootid")
+	raw, err := os.ReadFile(p)
+	if os.IsNotExist(err) && !readOnly {
+		id, _ := randSlugHex(8)
+		if err := os.WriteFile(p+".tmp", []byte(id), 0644); err != nil {
+			return "", err
+		}
+		if err := os.Rename(p+".tmp", p); err != nil {
+			return "", err
+		}
+		raw, err = []byte(id), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(raw))
+	rootIDs.Store(root, id)
+	return id, nil
+}
+
+// volumeMirror is where a volume keeps the blobs of manifest dir.
+func volumeMirror(vol, dir string) (string, error) {
+	root, rel := splitRoot(dir)
+	id, err := rootID(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(vol, id, rel), nil
+}
+
+// blobPath is where the blob of file entry e in manifest dir is stored.
+func blobPath(dir string, e *ManifestEntry) string {
+	if e.Volume != "" {
+		if vol, ok := volumeDir(e.Volume); ok {
+			if mirror, err := volumeMirror(vol, dir); err == nil {
+				return filepath.Join(mirror, e.Enc+".bin")
+			}
+		}
+	}
+	return filepath.Join(dir, e.Enc+".bin")
+}
+
+// removeMirrors deletes what the volumes hold for manifest dir and below.
+func removeMirrors(dir string) {
+	for _, vol := range Volumes() {
+		if mirror, err := volumeMirror(vol, dir); err == nil {
+			os.RemoveAll(mirror)
+		}
+	}
+}
+
+// placeBlob picks the volume for a new file of owner under baseDir.
+func placeBlob(baseDir, owner string) string {
+	return pickVolume(filepath.Join(baseDir, "filestorage"), owner, nil)
+}
+
+// pickVolume applies the placement to a blob of owner under root, never
+// choosing a volume in skip.
+func pickVolume(root, owner string, skip map[string]bool) string {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+	if len(placement.Volumes) == 0 {
+		return ""
+	}
+	if v, ok := placement.Pins[owner]; ok && owner != "" && !skip[v] {
+		return v
+	}
+	var names []string
+	for _, name := range append([]string{""}, sortedKeys(placement.Volumes)...) {
+		if !skip[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	if placement.Policy == PlaceRoundRobin {
+		nextVolume++
+		return names[nextVolume%len(names)]
+	}
+	best, bestFree := names[0], uint64(0)
+	for _, name := range names {
+		dir := root
+		if name != "" {
+			dir = placement.Volumes[name]
+		}
+		if _, free, err := DiskSpace(dir); err == nil && free > bestFree {
+			best, bestFree = name, free
+		}
+	}
+	return best
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// VolumeDirs returns the dirs whose disks hold blobs: the root's and each
+// volume's, by volume name ("" = baseDir).
+func VolumeDirs(baseDir string) map[string]string {
+	dirs := Volumes()
+	dirs[""] = filepath.Join(baseDir, "filestorage")
+	return dirs
+}
+
+type RebalanceReport struct {
+	Files      int           `json:"files"`
+	Moved      int           `json:"moved"`
+	MovedBytes int64         `json:"moved_bytes"`
+	Skipped    int           `json:"skipped"` // changed while being moved; try again
+	Failures   []FileFailure `json:"failures,omitempty"`
+}
+
+// RebalancePlan says which blobs Rebalance moves. With From, every blob on
+// that volume moves to To, or where placement would put it now. With only
+// To, every blob moves there. With neither, the blobs of pinned users move
+// to their volume. Volumes are named as in Placement, LocalVolume for the
+// root.
+type RebalancePlan struct {
+	From string
+	To   string
+}
+
+func (p RebalancePlan) check() error {
+	for _, name := range []string{p.From, p.To} {
+		if name == "" || name == LocalVolume {
+			continue
+		}
+		if _, ok := volumeDir(name); !ok {
+			return fmt.Errorf("no volume %q", name)
+		}
+	}
+	if p.From != "" && p.From == p.To {
+		return fmt.Errorf("from and to are the same volume")
+	}
+	return nil
+}
+
+func (p RebalancePlan) target(root string, e *ManifestEntry) (string, bool) {
+	from, to := volumeName(p.From), volumeName(p.To)
+	switch {
+	case p.From != "":
+		if e.Volume != from {
+			return "", false
+		}
+		if p.To == "" {
+			to = pickVolume(root, e.Owner, map[string]bool{from: true})
+		}
+	case p.To == "":
+		placementMu.Lock()
+		pin, ok := placement.Pins[e.Owner]
+		placementMu.Unlock()
+		if !ok || e.Owner == "" {
+			return "", false
+		}
+		to = pin
+	}
+	return to, to != e.Volume
+}
+
+// Rebalance moves blobs under baseDir between volumes according to plan.
+// Each blob is copied, its entry repointed and the old copy removed; a file
+// written meanwhile is skipped. Snapshots keep their own links to the old
+// copies.
+func Rebalance(masterKey []byte, baseDir string, plan RebalancePlan, progress func()) (RebalanceReport, error) {
+	var r RebalanceReport
+	if err := plan.check(); err != nil {
+		return r, err
+	}
+	root, err := ensureRoot(masterKey, baseDir)
+	if err != nil {
+		return r, err
+	}
+	err = walkFiles(masterKey, root, "", func(dir, logical string, e *ManifestEntry) error {
+		r.Files++
+		if progress != nil {
+			progress()
+		}
+		to, move := plan.target(root, e)
+		if !move {
+			return nil
+		}
+		moved, err := moveBlob(masterKey, dir, *e, to)
+		switch {
+		case err != nil:
+			r.Failures = append(r.Failures, FileFailure{Path: logical, Error: err.Error()})
+		case !moved:
+			r.Skipped++
+		default:
+			r.Moved++
+			r.MovedBytes += e.Size
+		}
+		return nil
+	})
+	return r, err
+}
+
+// moveBlob moves the blob of e in dir onto volume to. It reports false when
+// the entry changed during the copy.
+func moveBlob(masterKey []byte, dir string, e ManifestEntry, to string) (bool, error) {
+	src := blobPath(dir, &e)
+	next := e
+	next.Volume = to
+	dst := blobPath(dir, &next)
+	if dst == src {
+		return false, fmt.Errorf("volume %q is not configured", to)
+	}
+	unlock := lockBlob(src)
+	defer unlock()
+
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil // a placeholder still waiting for its upload
+	}
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := CreateBlob(dst)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return false, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Abort()
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		out.Abort()
+		return false, err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		out.Abort()
+		return false, err
+	}
+
+	unlockDir, err := lockManifest(dir)
+	if err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	defer unlockDir()
+	m, err := loadManifest(masterKey, dir)
+	if err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	idx := -1
+	for i := range m.Entries {
+		if m.Entries[i].Type == "file" && m.Entries[i].Enc == e.Enc {
+			idx = i
+		}
+	}
+	if idx < 0 || m.Entries[idx].Rev != e.Rev || m.Entries[idx].Volume != e.Volume {
+		os.Remove(dst)
+		return false, nil
+	}
+	m.Entries[idx].Volume = to
+	if err := saveManifest(masterKey, dir, m); err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
@@ -0,0 +1,1056 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory implementations: the default for small deployments and for tests.
+
+type MemoryUserStore struct {
+	mu      sync.RWMutex
+	byEmail map[string]*User
+	byID    map[string]*User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{byEmail: map[string]*User{}, byID: map[string]*User{}}
+}
+
+func (m *MemoryUserStore) Create(_ context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(u.Email)
+	if _, ok := m.byEmail[key]; ok {
+		return ErrExists
+	}
+	cp := *u
+	m.byEmail[key] = &cp
+	m.byID[u.UserID] = &cp
+	return nil
+}
+
+func (m *MemoryUserStore) ByEmail(_ context.Context, email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.byEmail[strings.ToLower(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (m *MemoryUserStore) ByID(_ context.Context, id string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (m *MemoryUserStore) Count(context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.byID), nil
+}
+
+func (m *MemoryUserStore) SetPassword(_ context.Context, userID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Password = hash
+	return nil
+}
+
+func (m *MemoryUserStore) SetEmailVerified(_ context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.EmailVerified = true
+	return nil
+}
+
+func (m *MemoryUserStore) SetAdmin(_ context.Context, userID string, admin bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Admin = admin
+	return nil
+}
+
+func (m *MemoryUserStore) SetUsername(_ context.Context, userID, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Username = username
+	return nil
+}
+
+func (m *MemoryUserStore) SetDisabled(_ context.Context, userID string, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Disabled = disabled
+	return nil
+}
+
+func (m *MemoryUserStore) SetLocked(_ context.Context, userID string, locked bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Locked = locked
+	return nil
+}
+
+func (m *MemoryUserStore) List(context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]User, 0, len(m.byID))
+	for _, u := range m.byID {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(a, b int) bool { return strings.ToLower(out[a].Email) < strings.ToLower(out[b].Email) })
+	return out, nil
+}
+
+func (m *MemoryUserStore) SetImageMetadata(_ context.Context, userID, policy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.ImageMetadata = policy
+	return nil
+}
+
+func (m *MemoryUserStore) SetStagingMaxAge(_ context.Context, userID string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.byID[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	u.StagingMaxAge = d
+	return nil
+}
+
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]Session{}}
+}
+
+func (m *MemorySessionStore) Create(_ context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.SessionToken] = *s
+	return nil
+}
+
+func (m *MemorySessionStore) Get(_ context.Context, token string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+func (m *MemorySessionStore) Touch(_ context.Context, token string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[token]
+	if !ok {
+		return ErrNotFound
+	}
+	s.LastSeen = at
+	m.sessions[token] = s
+	return nil
+}
+
+func (m *MemorySessionStore) Rebind(_ context.Context, token, ip, userAgent string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[token]
+	if !ok {
+		return ErrNotFound
+	}
+	s.IP, s.UserAgent = ip, userAgent
+	m.sessions[token] = s
+	return nil
+}
+
+func (m *MemorySessionStore) SetCSRF(_ context.Context, token, csrf string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[token]
+	if !ok {
+		return ErrNotFound
+	}
+	s.CSRFToken = csrf
+	m.sessions[token] = s
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(_ context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, token)
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteForUser(_ context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, k)
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for k, s := range m.sessions {
+		if s.ExpiryTime.Before(now) {
+			delete(m.sessions, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type MemoryDeviceStore struct {
+	mu      sync.RWMutex
+	devices map[string]Device
+}
+
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{devices: map[string]Device{}}
+}
+
+func (m *MemoryDeviceStore) Create(_ context.Context, d *Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, o := range m.devices {
+		if o.ID == d.ID || (o.UserID == d.UserID && o.TokenHash == d.TokenHash) {
+			return ErrExists
+		}
+	}
+	m.devices[d.ID] = *d
+	return nil
+}
+
+func (m *MemoryDeviceStore) Get(_ context.Context, id string) (*Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.devices[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &d, nil
+}
+
+func (m *MemoryDeviceStore) ByToken(_ context.Context, userID, tokenHash string) (*Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, d := range m.devices {
+		if d.UserID == userID && d.TokenHash == tokenHash {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryDeviceStore) ListForUser(_ context.Context, userID string) ([]Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Device{}
+	for _, d := range m.devices {
+		if d.UserID == userID {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].LastSeen.After(out[b].LastSeen) })
+	return out, nil
+}
+
+func (m *MemoryDeviceStore) update(id string, fn func(*Device)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[id]
+	if !ok {
+		return ErrNotFound
+	}
+	fn(&d)
+	m.devices[id] = d
+	return nil
+}
+
+func (m *MemoryDeviceStore) Touch(_ context.Context, id, ip string, at time.Time) error {
+	return m.update(id, func(d *Device) { d.IP, d.LastSeen = ip, at })
+}
+
+func (m *MemoryDeviceStore) SetTrusted(_ context.Context, id string, trusted bool) error {
+	return m.update(id, func(d *Device) { d.Trusted = trusted })
+}
+
+func (m *MemoryDeviceStore) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.devices[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.devices, id)
+	return nil
+}
+
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: map[string]APIKey{}}
+}
+
+func (m *MemoryAPIKeyStore) Create(_ context.Context, k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, o := range m.keys {
+		if o.ID == k.ID || o.TokenHash == k.TokenHash {
+			return ErrExists
+		}
+	}
+	m.keys[k.ID] = *k
+	return nil
+}
+
+func (m *MemoryAPIKeyStore) Get(_ context.Context, id string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.keys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &k, nil
+}
+
+func (m *MemoryAPIKeyStore) ByToken(_ context.Context, tokenHash string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.keys {
+		if k.TokenHash == tokenHash {
+			return &k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryAPIKeyStore) ListForUser(_ context.Context, userID string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []APIKey{}
+	for _, k := range m.keys {
+		if k.UserID == userID {
+			out = append(out, k)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out, nil
+}
+
+func (m *MemoryAPIKeyStore) Touch(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	k.LastUsed = at
+	m.keys[id] = k
+	return nil
+}
+
+func (m *MemoryAPIKeyStore) Delete(_ context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.keys[id]; !ok || k.UserID != userID {
+		return ErrNotFound
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+type MemoryShareStore struct {
+	mu     sync.RWMutex
+	shares map[string]Share
+}
+
+func NewMemoryShareStore() *MemoryShareStore {
+	return &MemoryShareStore{shares: map[string]Share{}}
+}
+
+func (m *MemoryShareStore) Create(_ context.Context, sh *Share) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shares[sh.ID]; ok {
+		return ErrExists
+	}
+	m.shares[sh.ID] = *sh
+	return nil
+}
+
+func (m *MemoryShareStore) Get(_ context.Context, id string) (*Share, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sh, ok := m.shares[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &sh, nil
+}
+
+func (m *MemoryShareStore) list(match func(Share) bool) []Share {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Share{}
+	for _, sh := range m.shares {
+		if match(sh) {
+			out = append(out, sh)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out
+}
+
+func (m *MemoryShareStore) ListByOwner(_ context.Context, ownerID string) ([]Share, error) {
+	return m.list(func(sh Share) bool { return sh.OwnerID == ownerID }), nil
+}
+
+func (m *MemoryShareStore) ListForGrantee(_ context.Context, granteeID string) ([]Share, error) {
+	return m.list(func(sh Share) bool { return sh.GranteeID == granteeID }), nil
+}
+
+func (m *MemoryShareStore) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.shares[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.shares, id)
+	return nil
+}
+
+type MemoryBucketStore struct {
+	mu      sync.RWMutex
+	buckets map[string]Bucket
+}
+
+func NewMemoryBucketStore() *MemoryBucketStore {
+	return &MemoryBucketStore{buckets: map[string]Bucket{}}
+}
+
+func (m *MemoryBucketStore) Create(_ context.Context, b *Bucket) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.buckets[b.Slug]; ok {
+		return ErrExists
+	}
+	m.buckets[b.Slug] = *b
+	return nil
+}
+
+func (m *MemoryBucketStore) Get(_ context.Context, slug string) (*Bucket, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.buckets[slug]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+func (m *MemoryBucketStore) ListByOwner(_ context.Context, ownerID string) ([]Bucket, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Bucket{}
+	for _, b := range m.buckets {
+		if b.OwnerID == ownerID {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out, nil
+}
+
+func (m *MemoryBucketStore) Delete(_ context.Context, slug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.buckets[slug]; !ok {
+		return ErrNotFound
+	}
+	delete(m.buckets, slug)
+	return nil
+}
+
+type MemoryDropStore struct {
+	mu    sync.RWMutex
+	drops map[string]Drop
+}
+
+func NewMemoryDropStore() *MemoryDropStore {
+	return &MemoryDropStore{drops: map[string]Drop{}}
+}
+
+func (m *MemoryDropStore) Create(_ context.Context, d *Drop) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.drops[d.Slug]; ok {
+		return ErrExists
+	}
+	m.drops[d.Slug] = *d
+	return nil
+}
+
+func (m *MemoryDropStore) Get(_ context.Context, slug string) (*Drop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.drops[slug]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &d, nil
+}
+
+func (m *MemoryDropStore) ListByOwner(_ context.Context, ownerID string) ([]Drop, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Drop{}
+	for _, d := range m.drops {
+		if d.OwnerID == ownerID {
+			out = append(out, d)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out, nil
+}
+
+func (m *MemoryDropStore) Delete(_ context.Context, slug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.drops[slug]; !ok {
+		return ErrNotFound
+	}
+	delete(m.drops, slug)
+	return nil
+}
+
+type MemoryLinkAccessStore struct {
+	mu       sync.RWMutex
+	accesses []LinkAccess
+}
+
+func NewMemoryLinkAccessStore() *MemoryLinkAccessStore {
+	return &MemoryLinkAccessStore{}
+}
+
+func (m *MemoryLinkAccessStore) Add(_ context.Context, a *LinkAccess) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accesses = append(m.accesses, *a)
+	return nil
+}
+
+func (m *MemoryLinkAccessStore) ListForLink(_ context.Context, linkID string) ([]LinkAccess, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []LinkAccess{}
+	for _, a := range m.accesses {
+		if a.LinkID == linkID {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryLinkAccessStore) DeleteBefore(_ context.Context, t time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.accesses[:0]
+	for _, a := range m.accesses {
+		if !a.Time.Before(t) {
+			kept = append(kept, a)
+		}
+	}
+	n := len(m.accesses) - len(kept)
+	m.accesses = kept
+	return n, nil
+}
+
+type MemoryAbuseReportStore struct {
+	mu      sync.RWMutex
+	reports []AbuseReport
+}
+
+func NewMemoryAbuseReportStore() *MemoryAbuseReportStore {
+	return &MemoryAbuseReportStore{}
+}
+
+func (m *MemoryAbuseReportStore) Add(_ context.Context, r *AbuseReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = append(m.reports, *r)
+	return nil
+}
+
+func (m *MemoryAbuseReportStore) Get(_ context.Context, id string) (*AbuseReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, r := range m.reports {
+		if r.ID == id {
+			return &r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryAbuseReportStore) List(_ context.Context, status string) ([]AbuseReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []AbuseReport{}
+	for i := len(m.reports) - 1; i >= 0; i-- {
+		if status == "" || m.reports[i].Status == status {
+			out = append(out, m.reports[i])
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryAbuseReportStore) ListForLink(_ context.Context, linkID string) ([]AbuseReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []AbuseReport{}
+	for _, r := range m.reports {
+		if r.LinkID == linkID {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryAbuseReportStore) Review(_ context.Context, id, status, reviewerID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.reports {
+		if r := &m.reports[i]; r.ID == id && r.Status == ReportOpen {
+			r.Status, r.ReviewerID, r.Reviewed = status, reviewerID, at
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type MemoryAuditStore struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+	seq    int64 // highest Seq added
+}
+
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{}
+}
+
+func (m *MemoryAuditStore) Add(_ context.Context, a *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a.Seq > 0 {
+		if a.Seq <= m.seq {
+			return ErrExists
+		}
+		m.seq = a.Seq
+	}
+	m.events = append(m.events, *a)
+	return nil
+}
+
+func (m *MemoryAuditStore) List(_ context.Context, limit int) ([]AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []AuditEvent{}
+	for i := len(m.events) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, m.events[i])
+	}
+	return out, nil
+}
+
+func (m *MemoryAuditStore) Last(_ context.Context) (*AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if m.events[i].Seq > 0 {
+			a := m.events[i]
+			return &a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryAuditStore) Since(_ context.Context, seq int64, limit int) ([]AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []AuditEvent{}
+	for _, a := range m.events {
+		if a.Seq > seq && len(out) < limit {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+type MemoryFileLockStore struct {
+	mu    sync.RWMutex
+	locks map[[2]string]FileLock
+}
+
+func NewMemoryFileLockStore() *MemoryFileLockStore {
+	return &MemoryFileLockStore{locks: map[[2]string]FileLock{}}
+}
+
+func (m *MemoryFileLockStore) Acquire(_ context.Context, l *FileLock) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := [2]string{l.Tree, l.Path}
+	if cur, ok := m.locks[k]; ok && cur.Expires.After(l.Created) {
+		if cur.Token != l.Token || cur.OwnerID != l.OwnerID {
+			return ErrExists
+		}
+		cur.Owner, cur.Expires = l.Owner, l.Expires
+		m.locks[k] = cur
+		return nil
+	}
+	m.locks[k] = *l
+	return nil
+}
+
+func (m *MemoryFileLockStore) Get(_ context.Context, tree, path string) (*FileLock, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	l, ok := m.locks[[2]string{tree, path}]
+	if !ok || !l.Expires.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &l, nil
+}
+
+func (m *MemoryFileLockStore) List(_ context.Context, tree string) ([]FileLock, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	out := []FileLock{}
+	for _, l := range m.locks {
+		if l.Tree == tree && l.Expires.After(now) {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func (m *MemoryFileLockStore) Release(_ context.Context, tree, path, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := [2]string{tree, path}
+	if l, ok := m.locks[k]; !ok || l.Token != token {
+		return ErrNotFound
+	}
+	delete(m.locks, k)
+	return nil
+}
+
+func (m *MemoryFileLockStore) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for k, l := range m.locks {
+		if !l.Expires.After(now) {
+			delete(m.locks, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type MemoryHoneytokenStore struct {
+	mu     sync.RWMutex
+	tokens map[[2]string]Honeytoken
+}
+
+func NewMemoryHoneytokenStore() *MemoryHoneytokenStore {
+	return &MemoryHoneytokenStore{tokens: map[[2]string]Honeytoken{}}
+}
+
+func (m *MemoryHoneytokenStore) Add(_ context.Context, t *Honeytoken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := [2]string{t.Tree, t.Path}
+	if _, ok := m.tokens[k]; ok {
+		return ErrExists
+	}
+	m.tokens[k] = *t
+	return nil
+}
+
+func (m *MemoryHoneytokenStore) Get(_ context.Context, tree, path string) (*Honeytoken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.tokens[[2]string{tree, path}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (m *MemoryHoneytokenStore) List(_ context.Context) ([]Honeytoken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Honeytoken, 0, len(m.tokens))
+	for _, t := range m.tokens {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Tree != out[j].Tree {
+			return out[i].Tree < out[j].Tree
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out, nil
+}
+
+func (m *MemoryHoneytokenStore) Delete(_ context.Context, tree, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := [2]string{tree, path}
+	if _, ok := m.tokens[k]; !ok {
+		return ErrNotFound
+	}
+	delete(m.tokens, k)
+	return nil
+}
+
+type MemoryJobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]Job
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: map[string]Job{}}
+}
+
+func (m *MemoryJobStore) Save(_ context.Context, j *Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.ID] = *j
+	return nil
+}
+
+func (m *MemoryJobStore) Get(_ context.Context, id string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &j, nil
+}
+
+func (m *MemoryJobStore) List(_ context.Context, limit int) ([]Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		out = append(out, j)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].StartedAt > out[b].StartedAt })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+type MemoryUsageStore struct {
+	mu   sync.Mutex
+	days map[[2]string]*Usage // by {day, userID}
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{days: map[[2]string]*Usage{}}
+}
+
+func (m *MemoryUsageStore) row(userID, day string) *Usage {
+	k := [2]string{day, userID}
+	u, ok := m.days[k]
+	if !ok {
+		u = &Usage{UserID: userID, Day: day}
+		m.days[k] = u
+	}
+	return u
+}
+
+func (m *MemoryUsageStore) AddTransfer(_ context.Context, userID, day string, upload, download int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.row(userID, day)
+	u.UploadBytes += upload
+	u.DownloadBytes += download
+	return nil
+}
+
+func (m *MemoryUsageStore) SetStored(_ context.Context, userID, day string, bytes int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.row(userID, day).StoredBytes = bytes
+	return nil
+}
+
+func (m *MemoryUsageStore) List(_ context.Context, from, to string) ([]Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []Usage{}
+	for _, u := range m.days {
+		if u.Day >= from && u.Day <= to {
+			out = append(out, *u)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Day != out[b].Day {
+			return out[a].Day < out[b].Day
+		}
+		return out[a].UserID < out[b].UserID
+	})
+	return out, nil
+}
+
+type MemoryOrgStore struct {
+	mu   sync.RWMutex
+	orgs map[string]Org
+}
+
+func NewMemoryOrgStore() *MemoryOrgStore {
+	return &MemoryOrgStore{orgs: map[string]Org{}}
+}
+
+func cloneOrg(o Org) Org {
+	members := make(map[string]string, len(o.Members))
+	for id, role := range o.Members {
+		members[id] = role
+	}
+	o.Members = members
+	return o
+}
+
+func (m *MemoryOrgStore) Create(_ context.Context, o *Org) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[o.ID]; ok {
+		return ErrExists
+	}
+	m.orgs[o.ID] = cloneOrg(*o)
+	return nil
+}
+
+func (m *MemoryOrgStore) Get(_ context.Context, id string) (*Org, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.orgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	o = cloneOrg(o)
+	return &o, nil
+}
+
+func (m *MemoryOrgStore) list(keep func(Org) bool) []Org {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := []Org{}
+	for _, o := range m.orgs {
+		if keep(o) {
+			out = append(out, cloneOrg(o))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (m *MemoryOrgStore) List(context.Context) ([]Org, error) {
+	return m.list(func(Org) bool { return true }), nil
+}
+
+func (m *MemoryOrgStore) ListForUser(_ context.Context, userID string) ([]Org, error) {
+	return m.list(func(o Org) bool { _, ok := o.Members[userID]; return ok }), nil
+}
+
+func (m *MemoryOrgStore) Rename(_ context.Context, id, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.orgs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	o.Name = name
+	m.orgs[id] = o
+	return nil
+}
+
+func (m *MemoryOrgStore) SetMember(_ context.Context, orgID, userID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.orgs[orgID]
+	if !ok {
+		return ErrNotFound
+	}
+	o.Members[userID] = role
+	return nil
+}
+
+func (m *MemoryOrgStore) RemoveMember(_ context.Context, orgID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if o, ok := m.orgs[orgID]; ok {
+		delete(o.Members, userID)
+	}
+	return nil
+}
@@ -0,0 +1,1243 @@
+package store
+
+import (
+	"SCloud/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"strings"
+	"time"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS users (
+	user_id  TEXT PRIMARY KEY,
+	email    TEXT NOT NULL UNIQUE,
+	username TEXT NOT NULL DEFAULT '',
+	password TEXT NOT NULL,
+	admin    BOOLEAN NOT NULL DEFAULT FALSE
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS image_metadata TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS staging_max_age BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS sessions (
+	session_token TEXT PRIMARY KEY,
+	csrf_token    TEXT NOT NULL,
+	user_id       TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	expires_at    TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_expires_idx ON sessions (expires_at);
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+CREATE TABLE IF NOT EXISTS devices (
+	id         TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip         TEXT NOT NULL DEFAULT '',
+	first_seen TIMESTAMPTZ NOT NULL,
+	last_seen  TIMESTAMPTZ NOT NULL,
+	trusted    BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE (user_id, token_hash)
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	id         TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	name       TEXT NOT NULL DEFAULT '',
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes     TEXT NOT NULL,
+	prefixes   TEXT NOT NULL DEFAULT '[]',
+	created    TIMESTAMPTZ NOT NULL,
+	expires    TIMESTAMPTZ,
+	last_used  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS signing BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS shares (
+	id         TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	grantee_id TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS shares_owner_idx ON shares (owner_id);
+CREATE INDEX IF NOT EXISTS shares_grantee_idx ON shares (grantee_id);
+CREATE TABLE IF NOT EXISTS buckets (
+	slug       TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS buckets_owner_idx ON buckets (owner_id);
+CREATE TABLE IF NOT EXISTS drops (
+	slug       TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	label      TEXT NOT NULL DEFAULT '',
+	max_size   BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS drops_owner_idx ON drops (owner_id);
+CREATE TABLE IF NOT EXISTS link_accesses (
+	id         TEXT PRIMARY KEY,
+	link_id    TEXT NOT NULL,
+	owner_id   TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	at         TIMESTAMPTZ NOT NULL,
+	ip         TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	method     TEXT NOT NULL,
+	status     INTEGER NOT NULL,
+	bytes      BIGINT NOT NULL DEFAULT 0,
+	complete   BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS link_accesses_link_idx ON link_accesses (link_id);
+CREATE INDEX IF NOT EXISTS link_accesses_at_idx ON link_accesses (at);
+CREATE TABLE IF NOT EXISTS abuse_reports (
+	id          TEXT PRIMARY KEY,
+	link_id     TEXT NOT NULL,
+	owner_id    TEXT NOT NULL,
+	tree        TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	category    TEXT NOT NULL,
+	details     TEXT NOT NULL DEFAULT '',
+	ip          TEXT NOT NULL DEFAULT '',
+	created     TIMESTAMPTZ NOT NULL,
+	status      TEXT NOT NULL,
+	reviewer_id TEXT NOT NULL DEFAULT '',
+	reviewed    TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS abuse_reports_file_idx ON abuse_reports (tree, path);
+CREATE INDEX IF NOT EXISTS abuse_reports_link_idx ON abuse_reports (link_id);
+CREATE TABLE IF NOT EXISTS audit_events (
+	id       TEXT PRIMARY KEY,
+	at       TIMESTAMPTZ NOT NULL,
+	actor_id TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	tree     TEXT NOT NULL DEFAULT '',
+	path     TEXT NOT NULL DEFAULT '',
+	detail   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_events_at_idx ON audit_events (at);
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS mac TEXT NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX IF NOT EXISTS audit_events_seq_idx ON audit_events (seq) WHERE seq > 0;
+CREATE TABLE IF NOT EXISTS file_locks (
+	tree     TEXT NOT NULL,
+	path     TEXT NOT NULL,
+	token    TEXT NOT NULL,
+	owner_id TEXT NOT NULL,
+	owner    TEXT NOT NULL DEFAULT '',
+	created  TIMESTAMPTZ NOT NULL,
+	expires  TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tree, path)
+);
+CREATE TABLE IF NOT EXISTS honeytokens (
+	tree       TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	label      TEXT NOT NULL DEFAULT '',
+	creator_id TEXT NOT NULL,
+	created    TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tree, path)
+);
+CREATE TABLE IF NOT EXISTS jobs (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	started_at  BIGINT NOT NULL,
+	finished_at BIGINT NOT NULL DEFAULT 0,
+	done        BIGINT NOT NULL DEFAULT 0,
+	total       BIGINT NOT NULL DEFAULT 0,
+	result      JSONB,
+	error       TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS usage (
+	user_id        TEXT NOT NULL,
+	day            TEXT NOT NULL,
+	upload_bytes   BIGINT NOT NULL DEFAULT 0,
+	download_bytes BIGINT NOT NULL DEFAULT 0,
+	stored_bytes   BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (day, user_id)
+);
+CREATE TABLE IF NOT EXISTS orgs (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	quota_bytes BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS org_members (
+	org_id  TEXT NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+	user_id TEXT NOT NULL,
+	role    TEXT NOT NULL,
+	PRIMARY KEY (org_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (user_id);
+CREATE TABLE IF NOT EXISTS coord_claims (
+	name    TEXT PRIMARY KEY,
+	expires TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS coord_claims_expires_idx ON coord_claims (expires);
+`
+
+// Migrate creates the tables used by the Postgres stores if they are missing.
+func Migrate(ctx context.Context, d *db.DB) error {
+	_, err := d.Exec(ctx, schema)
+	return err
+}
+
+func NewPostgresStores(d *db.DB) Stores {
+	return Stores{
+		Users:    PostgresUserStore{DB: d},
+		Sessions: PostgresSessionStore{DB: d},
+		Devices:  PostgresDeviceStore{DB: d},
+		APIKeys:  PostgresAPIKeyStore{DB: d},
+		Shares:   PostgresShareStore{DB: d},
+		Buckets:  PostgresBucketStore{DB: d},
+		Drops:    PostgresDropStore{DB: d},
+		Links:    PostgresLinkAccessStore{DB: d},
+		Audit:    PostgresAuditStore{DB: d},
+		Reports:  PostgresAbuseReportStore{DB: d},
+		Locks:    PostgresFileLockStore{DB: d},
+		Honey:    PostgresHoneytokenStore{DB: d},
+		Jobs:     PostgresJobStore{DB: d},
+		Usage:    PostgresUsageStore{DB: d},
+		Orgs:     PostgresOrgStore{DB: d},
+	}
+}
+
+func pgErr(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pe *pgconn.PgError
+	if errors.As(err, &pe) && pe.Code == "23505" { // unique_violation
+		return ErrExists
+	}
+	return err
+}
+
+type PostgresUserStore struct{ DB *db.DB }
+
+func (s PostgresUserStore) Create(ctx context.Context, u *User) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO users (`+userCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		u.UserID, strings.ToLower(u.Email), u.Username, u.Password, u.Admin, u.EmailVerified, u.ImageMetadata, int64(u.StagingMaxAge/time.Second), u.Disabled, u.Locked)
+	return pgErr(err)
+}
+
+func (s PostgresUserStore) scan(row pgx.Row) (*User, error) {
+	var u User
+	var stagingSecs int64
+	if err := row.Scan(&u.UserID, &u.Email, &u.Username, &u.Password, &u.Admin, &u.EmailVerified, &u.ImageMetadata, &stagingSecs, &u.Disabled, &u.Locked); err != nil {
+		return nil, pgErr(err)
+	}
+	u.StagingMaxAge = time.Duration(stagingSecs) * time.Second
+	return &u, nil
+}
+
+func (s PostgresUserStore) ByEmail(ctx context.Context, email string) (*User, error) {
+	return s.scan(s.DB.QueryRow(ctx, `SELECT `+userCols+` FROM users WHERE email = $1`, strings.ToLower(email)))
+}
+
+func (s PostgresUserStore) ByID(ctx context.Context, id string) (*User, error) {
+	return s.scan(s.DB.QueryRow(ctx, `SELECT `+userCols+` FROM users WHERE user_id = $1`, id))
+}
+
+func (s PostgresUserStore) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.DB.QueryRow(ctx, `SELECT count(*) FROM users`).Scan(&n)
+	return n, pgErr(err)
+}
+
+func (s PostgresUserStore) SetPassword(ctx context.Context, userID, hash string) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET password = $2 WHERE user_id = $1`, userID, hash)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetEmailVerified(ctx context.Context, userID string) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET email_verified = TRUE WHERE user_id = $1`, userID)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetAdmin(ctx context.Context, userID string, admin bool) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET admin = $2 WHERE user_id = $1`, userID, admin)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetUsername(ctx context.Context, userID, username string) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET username = $2 WHERE user_id = $1`, userID, username)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetDisabled(ctx context.Context, userID string, disabled bool) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET disabled = $2 WHERE user_id = $1`, userID, disabled)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetLocked(ctx context.Context, userID string, locked bool) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET locked = $2 WHERE user_id = $1`, userID, locked)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) List(ctx context.Context) ([]User, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+userCols+` FROM users ORDER BY email`)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		u, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *u)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresUserStore) SetImageMetadata(ctx context.Context, userID, policy string) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET image_metadata = $2 WHERE user_id = $1`, userID, policy)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresUserStore) SetStagingMaxAge(ctx context.Context, userID string, d time.Duration) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE users SET staging_max_age = $2 WHERE user_id = $1`, userID, int64(d/time.Second))
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresSessionStore struct{ DB *db.DB }
+
+func (s PostgresSessionStore) Create(ctx context.Context, sess *Session) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO sessions (session_token, csrf_token, user_id, expires_at, last_seen, ip, user_agent, device_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		sess.SessionToken, sess.CSRFToken, sess.UserID, sess.ExpiryTime, sess.LastSeen, sess.IP, sess.UserAgent, sess.DeviceID)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	var sess Session
+	err := s.DB.QueryRow(ctx, `SELECT session_token, csrf_token, user_id, expires_at, last_seen, ip, user_agent, device_id FROM sessions WHERE session_token = $1`, token).
+		Scan(&sess.SessionToken, &sess.CSRFToken, &sess.UserID, &sess.ExpiryTime, &sess.LastSeen, &sess.IP, &sess.UserAgent, &sess.DeviceID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &sess, nil
+}
+
+func (s PostgresSessionStore) Touch(ctx context.Context, token string, at time.Time) error {
+	_, err := s.DB.Exec(ctx, `UPDATE sessions SET last_seen = $2 WHERE session_token = $1`, token, at)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) Rebind(ctx context.Context, token, ip, userAgent string) error {
+	_, err := s.DB.Exec(ctx, `UPDATE sessions SET ip = $2, user_agent = $3 WHERE session_token = $1`, token, ip, userAgent)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) SetCSRF(ctx context.Context, token, csrf string) error {
+	_, err := s.DB.Exec(ctx, `UPDATE sessions SET csrf_token = $2 WHERE session_token = $1`, token, csrf)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) DeleteForUser(ctx context.Context, userID string) error {
+	_, err := s.DB.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) Delete(ctx context.Context, token string) error {
+	_, err := s.DB.Exec(ctx, `DELETE FROM sessions WHERE session_token = $1`, token)
+	return pgErr(err)
+}
+
+func (s PostgresSessionStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM sessions WHERE expires_at < $1`, now)
+	return int(tag.RowsAffected()), pgErr(err)
+}
+
+type PostgresDeviceStore struct{ DB *db.DB }
+
+const deviceCols = `id, user_id, token_hash, user_agent, ip, first_seen, last_seen, trusted`
+
+func (s PostgresDeviceStore) Create(ctx context.Context, d *Device) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO devices (`+deviceCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		d.ID, d.UserID, d.TokenHash, d.UserAgent, d.IP, d.FirstSeen, d.LastSeen, d.Trusted)
+	return pgErr(err)
+}
+
+func scanDevice(row pgx.Row) (Device, error) {
+	var d Device
+	err := row.Scan(&d.ID, &d.UserID, &d.TokenHash, &d.UserAgent, &d.IP, &d.FirstSeen, &d.LastSeen, &d.Trusted)
+	return d, pgErr(err)
+}
+
+func (s PostgresDeviceStore) Get(ctx context.Context, id string) (*Device, error) {
+	d, err := scanDevice(s.DB.QueryRow(ctx, `SELECT `+deviceCols+` FROM devices WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s PostgresDeviceStore) ByToken(ctx context.Context, userID, tokenHash string) (*Device, error) {
+	d, err := scanDevice(s.DB.QueryRow(ctx, `SELECT `+deviceCols+` FROM devices WHERE user_id = $1 AND token_hash = $2`, userID, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s PostgresDeviceStore) ListForUser(ctx context.Context, userID string) ([]Device, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+deviceCols+` FROM devices WHERE user_id = $1 ORDER BY last_seen DESC`, userID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresDeviceStore) exec(ctx context.Context, query string, args ...any) error {
+	tag, err := s.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresDeviceStore) Touch(ctx context.Context, id, ip string, at time.Time) error {
+	return s.exec(ctx, `UPDATE devices SET ip = $2, last_seen = $3 WHERE id = $1`, id, ip, at)
+}
+
+func (s PostgresDeviceStore) SetTrusted(ctx context.Context, id string, trusted bool) error {
+	return s.exec(ctx, `UPDATE devices SET trusted = $2 WHERE id = $1`, id, trusted)
+}
+
+func (s PostgresDeviceStore) Delete(ctx context.Context, id string) error {
+	return s.exec(ctx, `DELETE FROM devices WHERE id = $1`, id)
+}
+
+type PostgresAPIKeyStore struct{ DB *db.DB }
+
+const apiKeyCols = `id, user_id, name, token_hash, scopes, prefixes, created, expires, last_used, signing`
+
+// encodeKeyLists gives an API key's scopes and prefixes as stored: JSON
+// arrays, as paths may hold any separator.
+func encodeKeyLists(k *APIKey) (string, string, error) {
+	scopes, err := json.Marshal(k.Scopes)
+	if err != nil {
+		return "", "", err
+	}
+	prefixes, err := json.Marshal(k.Prefixes)
+	return string(scopes), string(prefixes), err
+}
+
+func decodeKeyLists(k *APIKey, scopes, prefixes string) error {
+	if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(prefixes), &k.Prefixes)
+}
+
+func (s PostgresAPIKeyStore) Create(ctx context.Context, k *APIKey) error {
+	scopes, prefixes, err := encodeKeyLists(k)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(ctx, `INSERT INTO api_keys (`+apiKeyCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		k.ID, k.UserID, k.Name, k.TokenHash, scopes, prefixes, k.Created, nullTime(k.Expires), nullTime(k.LastUsed), k.Signing)
+	return pgErr(err)
+}
+
+func scanAPIKey(row pgx.Row) (APIKey, error) {
+	var k APIKey
+	var scopes, prefixes string
+	var expires, lastUsed *time.Time
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.TokenHash, &scopes, &prefixes, &k.Created, &expires, &lastUsed, &k.Signing); err != nil {
+		return k, pgErr(err)
+	}
+	if expires != nil {
+		k.Expires = *expires
+	}
+	if lastUsed != nil {
+		k.LastUsed = *lastUsed
+	}
+	return k, decodeKeyLists(&k, scopes, prefixes)
+}
+
+func (s PostgresAPIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanAPIKey(s.DB.QueryRow(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s PostgresAPIKeyStore) ByToken(ctx context.Context, tokenHash string) (*APIKey, error) {
+	k, err := scanAPIKey(s.DB.QueryRow(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE token_hash = $1`, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s PostgresAPIKeyStore) ListForUser(ctx context.Context, userID string) ([]APIKey, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE user_id = $1 ORDER BY created DESC`, userID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresAPIKeyStore) exec(ctx context.Context, query string, args ...any) error {
+	tag, err := s.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	return s.exec(ctx, `UPDATE api_keys SET last_used = $2 WHERE id = $1`, id, at)
+}
+
+func (s PostgresAPIKeyStore) Delete(ctx context.Context, userID, id string) error {
+	return s.exec(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+}
+
+type PostgresShareStore struct{ DB *db.DB }
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s PostgresShareStore) Create(ctx context.Context, sh *Share) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO shares (id, owner_id, org, path, grantee_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		sh.ID, sh.OwnerID, sh.Org, sh.Path, sh.GranteeID, sh.Created, nullTime(sh.Expires))
+	return pgErr(err)
+}
+
+const shareCols = `id, owner_id, org, path, grantee_id, created_at, expires_at`
+
+func scanShare(row pgx.Row) (Share, error) {
+	var sh Share
+	var exp *time.Time
+	if err := row.Scan(&sh.ID, &sh.OwnerID, &sh.Org, &sh.Path, &sh.GranteeID, &sh.Created, &exp); err != nil {
+		return sh, pgErr(err)
+	}
+	if exp != nil {
+		sh.Expires = *exp
+	}
+	return sh, nil
+}
+
+func (s PostgresShareStore) Get(ctx context.Context, id string) (*Share, error) {
+	sh, err := scanShare(s.DB.QueryRow(ctx, `SELECT `+shareCols+` FROM shares WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+func (s PostgresShareStore) list(ctx context.Context, where string, arg any) ([]Share, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+shareCols+` FROM shares WHERE `+where+` = $1 ORDER BY created_at DESC`, arg)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Share{}
+	for rows.Next() {
+		sh, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sh)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresShareStore) ListByOwner(ctx context.Context, ownerID string) ([]Share, error) {
+	return s.list(ctx, "owner_id", ownerID)
+}
+
+func (s PostgresShareStore) ListForGrantee(ctx context.Context, granteeID string) ([]Share, error) {
+	return s.list(ctx, "grantee_id", granteeID)
+}
+
+func (s PostgresShareStore) Delete(ctx context.Context, id string) error {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM shares WHERE id = $1`, id)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresBucketStore struct{ DB *db.DB }
+
+func (s PostgresBucketStore) Create(ctx context.Context, b *Bucket) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO buckets (slug, owner_id, org, path, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		b.Slug, b.OwnerID, b.Org, b.Path, b.Created)
+	return pgErr(err)
+}
+
+const bucketCols = `slug, owner_id, org, path, created_at`
+
+func scanBucket(row pgx.Row) (Bucket, error) {
+	var b Bucket
+	if err := row.Scan(&b.Slug, &b.OwnerID, &b.Org, &b.Path, &b.Created); err != nil {
+		return b, pgErr(err)
+	}
+	return b, nil
+}
+
+func (s PostgresBucketStore) Get(ctx context.Context, slug string) (*Bucket, error) {
+	b, err := scanBucket(s.DB.QueryRow(ctx, `SELECT `+bucketCols+` FROM buckets WHERE slug = $1`, slug))
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s PostgresBucketStore) ListByOwner(ctx context.Context, ownerID string) ([]Bucket, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+bucketCols+` FROM buckets WHERE owner_id = $1 ORDER BY created_at DESC`, ownerID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Bucket{}
+	for rows.Next() {
+		b, err := scanBucket(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresBucketStore) Delete(ctx context.Context, slug string) error {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM buckets WHERE slug = $1`, slug)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresDropStore struct{ DB *db.DB }
+
+const dropCols = `slug, owner_id, org, path, label, max_size, created_at, expires_at`
+
+func (s PostgresDropStore) Create(ctx context.Context, d *Drop) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO drops (`+dropCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		d.Slug, d.OwnerID, d.Org, d.Path, d.Label, d.MaxSize, d.Created, nullTime(d.Expires))
+	return pgErr(err)
+}
+
+func scanDrop(row pgx.Row) (Drop, error) {
+	var d Drop
+	var expires *time.Time
+	if err := row.Scan(&d.Slug, &d.OwnerID, &d.Org, &d.Path, &d.Label, &d.MaxSize, &d.Created, &expires); err != nil {
+		return d, pgErr(err)
+	}
+	if expires != nil {
+		d.Expires = *expires
+	}
+	return d, nil
+}
+
+func (s PostgresDropStore) Get(ctx context.Context, slug string) (*Drop, error) {
+	d, err := scanDrop(s.DB.QueryRow(ctx, `SELECT `+dropCols+` FROM drops WHERE slug = $1`, slug))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s PostgresDropStore) ListByOwner(ctx context.Context, ownerID string) ([]Drop, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+dropCols+` FROM drops WHERE owner_id = $1 ORDER BY created_at DESC`, ownerID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Drop{}
+	for rows.Next() {
+		d, err := scanDrop(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresDropStore) Delete(ctx context.Context, slug string) error {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM drops WHERE slug = $1`, slug)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresLinkAccessStore struct{ DB *db.DB }
+
+func (s PostgresLinkAccessStore) Add(ctx context.Context, a *LinkAccess) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO link_accesses (id, link_id, owner_id, path, at, ip, user_agent, method, status, bytes, complete) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		a.ID, a.LinkID, a.OwnerID, a.Path, a.Time, a.IP, a.UserAgent, a.Method, a.Status, a.Bytes, a.Complete)
+	return pgErr(err)
+}
+
+const linkAccessCols = `id, link_id, owner_id, path, at, ip, user_agent, method, status, bytes, complete`
+
+func (s PostgresLinkAccessStore) ListForLink(ctx context.Context, linkID string) ([]LinkAccess, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+linkAccessCols+` FROM link_accesses WHERE link_id = $1 ORDER BY at`, linkID)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []LinkAccess{}
+	for rows.Next() {
+		var a LinkAccess
+		if err := rows.Scan(&a.ID, &a.LinkID, &a.OwnerID, &a.Path, &a.Time, &a.IP, &a.UserAgent, &a.Method, &a.Status, &a.Bytes, &a.Complete); err != nil {
+			return nil, pgErr(err)
+		}
+		out = append(out, a)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresLinkAccessStore) DeleteBefore(ctx context.Context, t time.Time) (int, error) {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM link_accesses WHERE at < $1`, t)
+	if err != nil {
+		return 0, pgErr(err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+type PostgresAbuseReportStore struct{ DB *db.DB }
+
+const abuseReportCols = `id, link_id, owner_id, tree, path, category, details, ip, created, status, reviewer_id, reviewed`
+
+func (s PostgresAbuseReportStore) Add(ctx context.Context, r *AbuseReport) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO abuse_reports (`+abuseReportCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULL)`,
+		r.ID, r.LinkID, r.OwnerID, r.Tree, r.Path, r.Category, r.Details, r.IP, r.Created, r.Status, r.ReviewerID)
+	return pgErr(err)
+}
+
+func (s PostgresAbuseReportStore) Get(ctx context.Context, id string) (*AbuseReport, error) {
+	r, err := scanPostgresAbuseReport(s.DB.QueryRow(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s PostgresAbuseReportStore) List(ctx context.Context, status string) ([]AbuseReport, error) {
+	return s.query(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE $1 = '' OR status = $1 ORDER BY created DESC`, status)
+}
+
+func (s PostgresAbuseReportStore) ListForLink(ctx context.Context, linkID string) ([]AbuseReport, error) {
+	return s.query(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE link_id = $1 ORDER BY created`, linkID)
+}
+
+func (s PostgresAbuseReportStore) query(ctx context.Context, q string, args ...any) ([]AbuseReport, error) {
+	rows, err := s.DB.Query(ctx, q, args...)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []AbuseReport{}
+	for rows.Next() {
+		r, err := scanPostgresAbuseReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func scanPostgresAbuseReport(row rowScanner) (AbuseReport, error) {
+	var r AbuseReport
+	var reviewed *time.Time
+	if err := row.Scan(&r.ID, &r.LinkID, &r.OwnerID, &r.Tree, &r.Path, &r.Category, &r.Details, &r.IP, &r.Created, &r.Status, &r.ReviewerID, &reviewed); err != nil {
+		return r, pgErr(err)
+	}
+	if reviewed != nil {
+		r.Reviewed = *reviewed
+	}
+	return r, nil
+}
+
+func (s PostgresAbuseReportStore) Review(ctx context.Context, id, status, reviewerID string, at time.Time) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE abuse_reports SET status = $2, reviewer_id = $3, reviewed = $4 WHERE id = $1 AND status = $5`,
+		id, status, reviewerID, at, ReportOpen)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresAuditStore struct{ DB *db.DB }
+
+const auditEventCols = `id, at, actor_id, action, tree, path, detail, seq, mac`
+
+func (s PostgresAuditStore) Add(ctx context.Context, a *AuditEvent) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO audit_events (`+auditEventCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		a.ID, a.Time, a.ActorID, a.Action, a.Tree, a.Path, a.Detail, a.Seq, a.MAC)
+	return pgErr(err)
+}
+
+func (s PostgresAuditStore) List(ctx context.Context, limit int) ([]AuditEvent, error) {
+	return s.query(ctx, `SELECT `+auditEventCols+` FROM audit_events ORDER BY at DESC, id DESC LIMIT $1`, limit)
+}
+
+func (s PostgresAuditStore) Last(ctx context.Context) (*AuditEvent, error) {
+	a, err := scanPostgresAuditEvent(s.DB.QueryRow(ctx, `SELECT `+auditEventCols+` FROM audit_events WHERE seq > 0 ORDER BY seq DESC LIMIT 1`))
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &a, nil
+}
+
+func (s PostgresAuditStore) Since(ctx context.Context, seq int64, limit int) ([]AuditEvent, error) {
+	return s.query(ctx, `SELECT `+auditEventCols+` FROM audit_events WHERE seq > $1 ORDER BY seq LIMIT $2`, seq, limit)
+}
+
+func (s PostgresAuditStore) query(ctx context.Context, query string, args ...any) ([]AuditEvent, error) {
+	rows, err := s.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []AuditEvent{}
+	for rows.Next() {
+		a, err := scanPostgresAuditEvent(rows)
+		if err != nil {
+			return nil, pgErr(err)
+		}
+		out = append(out, a)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func scanPostgresAuditEvent(r rowScanner) (AuditEvent, error) {
+	var a AuditEvent
+	err := r.Scan(&a.ID, &a.Time, &a.ActorID, &a.Action, &a.Tree, &a.Path, &a.Detail, &a.Seq, &a.MAC)
+	return a, err
+}
+
+type PostgresFileLockStore struct{ DB *db.DB }
+
+const fileLockCols = `tree, path, token, owner_id, owner, created, expires`
+
+func (s PostgresFileLockStore) Acquire(ctx context.Context, l *FileLock) error {
+	tag, err := s.DB.Exec(ctx, `INSERT INTO file_locks (`+fileLockCols+`) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (tree, path) DO UPDATE SET
+			token = excluded.token, owner_id = excluded.owner_id, owner = excluded.owner, expires = excluded.expires,
+			created = CASE WHEN file_locks.token = excluded.token THEN file_locks.created ELSE excluded.created END
+		WHERE file_locks.expires <= excluded.created OR (file_locks.token = excluded.token AND file_locks.owner_id = excluded.owner_id)`,
+		l.Tree, l.Path, l.Token, l.OwnerID, l.Owner, l.Created, l.Expires)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func scanPostgresFileLock(r rowScanner) (*FileLock, error) {
+	var l FileLock
+	if err := r.Scan(&l.Tree, &l.Path, &l.Token, &l.OwnerID, &l.Owner, &l.Created, &l.Expires); err != nil {
+		return nil, pgErr(err)
+	}
+	return &l, nil
+}
+
+func (s PostgresFileLockStore) Get(ctx context.Context, tree, path string) (*FileLock, error) {
+	return scanPostgresFileLock(s.DB.QueryRow(ctx, `SELECT `+fileLockCols+` FROM file_locks WHERE tree = $1 AND path = $2 AND expires > now()`, tree, path))
+}
+
+func (s PostgresFileLockStore) List(ctx context.Context, tree string) ([]FileLock, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+fileLockCols+` FROM file_locks WHERE tree = $1 AND expires > now() ORDER BY path`, tree)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []FileLock{}
+	for rows.Next() {
+		l, err := scanPostgresFileLock(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *l)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresFileLockStore) Release(ctx context.Context, tree, path, token string) error {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM file_locks WHERE tree = $1 AND path = $2 AND token = $3`, tree, path, token)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresFileLockStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM file_locks WHERE expires <= $1`, now)
+	if err != nil {
+		return 0, pgErr(err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+type PostgresHoneytokenStore struct{ DB *db.DB }
+
+const honeytokenCols = `tree, path, label, creator_id, created`
+
+func (s PostgresHoneytokenStore) Add(ctx context.Context, t *Honeytoken) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO honeytokens (`+honeytokenCols+`) VALUES ($1, $2, $3, $4, $5)`,
+		t.Tree, t.Path, t.Label, t.CreatorID, t.Created)
+	return pgErr(err)
+}
+
+func scanPostgresHoneytoken(r rowScanner) (*Honeytoken, error) {
+	var t Honeytoken
+	if err := r.Scan(&t.Tree, &t.Path, &t.Label, &t.CreatorID, &t.Created); err != nil {
+		return nil, pgErr(err)
+	}
+	return &t, nil
+}
+
+func (s PostgresHoneytokenStore) Get(ctx context.Context, tree, path string) (*Honeytoken, error) {
+	return scanPostgresHoneytoken(s.DB.QueryRow(ctx, `SELECT `+honeytokenCols+` FROM honeytokens WHERE tree = $1 AND path = $2`, tree, path))
+}
+
+func (s PostgresHoneytokenStore) List(ctx context.Context) ([]Honeytoken, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+honeytokenCols+` FROM honeytokens ORDER BY tree, path`)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Honeytoken{}
+	for rows.Next() {
+		t, err := scanPostgresHoneytoken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *t)
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresHoneytokenStore) Delete(ctx context.Context, tree, path string) error {
+	tag, err := s.DB.Exec(ctx, `DELETE FROM honeytokens WHERE tree = $1 AND path = $2`, tree, path)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresJobStore struct{ DB *db.DB }
+
+func (s PostgresJobStore) Save(ctx context.Context, j *Job) error {
+	result, err := json.Marshal(j.Result)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(ctx, `
+		INSERT INTO jobs (id, name, status, started_at, finished_at, done, total, result, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET status = $3, finished_at = $5, done = $6, total = $7, result = $8, error = $9`,
+		j.ID, j.Name, j.Status, j.StartedAt, j.FinishedAt, j.Done, j.Total, result, j.Error)
+	return pgErr(err)
+}
+
+const jobCols = `id, name, status, started_at, finished_at, done, total, result, error`
+
+func scanJob(row pgx.Row) (Job, error) {
+	var j Job
+	var result []byte
+	if err := row.Scan(&j.ID, &j.Name, &j.Status, &j.StartedAt, &j.FinishedAt, &j.Done, &j.Total, &result, &j.Error); err != nil {
+		return j, pgErr(err)
+	}
+	if len(result) > 0 {
+		var v any
+		if json.Unmarshal(result, &v) == nil {
+			j.Result = v
+		}
+	}
+	return j, nil
+}
+
+func (s PostgresJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	j, err := scanJob(s.DB.QueryRow(ctx, `SELECT `+jobCols+` FROM jobs WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s PostgresJobStore) List(ctx context.Context, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.DB.Query(ctx, `SELECT `+jobCols+` FROM jobs ORDER BY started_at DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, pgErr(rows.Err())
+}
+
+type PostgresUsageStore struct{ DB *db.DB }
+
+func (s PostgresUsageStore) AddTransfer(ctx context.Context, userID, day string, upload, download int64) error {
+	_, err := s.DB.Exec(ctx, `
+		INSERT INTO usage (user_id, day, upload_bytes, download_bytes) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (day, user_id) DO UPDATE SET upload_bytes = usage.upload_bytes + $3,
+			download_bytes = usage.download_bytes + $4`,
+		userID, day, upload, download)
+	return pgErr(err)
+}
+
+func (s PostgresUsageStore) SetStored(ctx context.Context, userID, day string, bytes int64) error {
+	_, err := s.DB.Exec(ctx, `
+		INSERT INTO usage (user_id, day, stored_bytes) VALUES ($1, $2, $3)
+		ON CONFLICT (day, user_id) DO UPDATE SET stored_bytes = $3`,
+		userID, day, bytes)
+	return pgErr(err)
+}
+
+const usageCols = `user_id, day, upload_bytes, download_bytes, stored_bytes`
+
+func (s PostgresUsageStore) List(ctx context.Context, from, to string) ([]Usage, error) {
+	rows, err := s.DB.Query(ctx, `SELECT `+usageCols+` FROM usage WHERE day >= $1 AND day <= $2 ORDER BY day, user_id`, from, to)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	out := []Usage{}
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.UserID, &u.Day, &u.UploadBytes, &u.DownloadBytes, &u.StoredBytes); err != nil {
+			return nil, pgErr(err)
+		}
+		out = append(out, u)
+	}
+	return out, pgErr(rows.Err())
+}
+
+type PostgresOrgStore struct{ DB *db.DB }
+
+func (s PostgresOrgStore) Create(ctx context.Context, o *Org) error {
+	tx, err := s.DB.Pool().Begin(ctx)
+	if err != nil {
+		return pgErr(err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `INSERT INTO orgs (id, name, quota_bytes) VALUES ($1, $2, $3)`, o.ID, o.Name, o.QuotaBytes); err != nil {
+		return pgErr(err)
+	}
+	for id, role := range o.Members {
+		if _, err := tx.Exec(ctx, `INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)`, o.ID, id, role); err != nil {
+			return pgErr(err)
+		}
+	}
+	return pgErr(tx.Commit(ctx))
+}
+
+// load reads the orgs where picks, with their members.
+func (s PostgresOrgStore) load(ctx context.Context, where string, args ...any) ([]Org, error) {
+	rows, err := s.DB.Query(ctx, `SELECT id, name, quota_bytes FROM orgs `+where+` ORDER BY name`, args...)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	out := []Org{}
+	byID := map[string]int{}
+	for rows.Next() {
+		o := Org{Members: map[string]string{}}
+		if err := rows.Scan(&o.ID, &o.Name, &o.QuotaBytes); err != nil {
+			rows.Close()
+			return nil, pgErr(err)
+		}
+		byID[o.ID] = len(out)
+		out = append(out, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, pgErr(err)
+	}
+	rows, err = s.DB.Query(ctx, `SELECT org_id, user_id, role FROM org_members WHERE org_id IN (SELECT id FROM orgs `+where+`)`, args...)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orgID, userID, role string
+		if err := rows.Scan(&orgID, &userID, &role); err != nil {
+			return nil, pgErr(err)
+		}
+		if i, ok := byID[orgID]; ok {
+			out[i].Members[userID] = role
+		}
+	}
+	return out, pgErr(rows.Err())
+}
+
+func (s PostgresOrgStore) Get(ctx context.Context, id string) (*Org, error) {
+	orgs, err := s.load(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(orgs) == 0 {
+		return nil, ErrNotFound
+	}
+	return &orgs[0], nil
+}
+
+func (s PostgresOrgStore) List(ctx context.Context) ([]Org, error) {
+	return s.load(ctx, ``)
+}
+
+func (s PostgresOrgStore) ListForUser(ctx context.Context, userID string) ([]Org, error) {
+	return s.load(ctx, `WHERE id IN (SELECT org_id FROM org_members WHERE user_id = $1)`, userID)
+}
+
+func (s PostgresOrgStore) Rename(ctx context.Context, id, name string) error {
+	tag, err := s.DB.Exec(ctx, `UPDATE orgs SET name = $2 WHERE id = $1`, id, name)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresOrgStore) SetMember(ctx context.Context, orgID, userID, role string) error {
+	tag, err := s.DB.Exec(ctx, `
+		INSERT INTO org_members (org_id, user_id, role)
+		SELECT $1, $2, $3 WHERE EXISTS (SELECT 1 FROM orgs WHERE id = $1)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role`, orgID, userID, role)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s PostgresOrgStore) RemoveMember(ctx context.Context, orgID, userID string) error {
+	_, err := s.DB.Exec(ctx, `DELETE FROM org_members WHERE org_id = $1 AND user_id = $2`, orgID, userID)
+	return pgErr(err)
+}
@@ -0,0 +1,1255 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go, keeps the single static binary
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	user_id         TEXT PRIMARY KEY,
+	email           TEXT NOT NULL UNIQUE,
+	username        TEXT NOT NULL DEFAULT '',
+	password        TEXT NOT NULL,
+	admin           INTEGER NOT NULL DEFAULT 0,
+	email_verified  INTEGER NOT NULL DEFAULT 0,
+	image_metadata  TEXT NOT NULL DEFAULT '',
+	staging_max_age INTEGER NOT NULL DEFAULT 0,
+	disabled        INTEGER NOT NULL DEFAULT 0,
+	locked          INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	session_token TEXT PRIMARY KEY,
+	csrf_token    TEXT NOT NULL,
+	user_id       TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	expires_at    INTEGER NOT NULL,
+	last_seen     INTEGER NOT NULL DEFAULT 0,
+	ip            TEXT NOT NULL DEFAULT '',
+	user_agent    TEXT NOT NULL DEFAULT '',
+	device_id     TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS sessions_expires_idx ON sessions (expires_at);
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+CREATE TABLE IF NOT EXISTS devices (
+	id         TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip         TEXT NOT NULL DEFAULT '',
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL,
+	trusted    INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (user_id, token_hash)
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	id         TEXT PRIMARY KEY,
+	user_id    TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	name       TEXT NOT NULL DEFAULT '',
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes     TEXT NOT NULL,
+	prefixes   TEXT NOT NULL DEFAULT '[]',
+	created    INTEGER NOT NULL,
+	expires    INTEGER NOT NULL DEFAULT 0,
+	last_used  INTEGER NOT NULL DEFAULT 0,
+	signing    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id);
+CREATE TABLE IF NOT EXISTS shares (
+	id         TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	grantee_id TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS shares_owner_idx ON shares (owner_id);
+CREATE INDEX IF NOT EXISTS shares_grantee_idx ON shares (grantee_id);
+CREATE TABLE IF NOT EXISTS buckets (
+	slug       TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS buckets_owner_idx ON buckets (owner_id);
+CREATE TABLE IF NOT EXISTS drops (
+	slug       TEXT PRIMARY KEY,
+	owner_id   TEXT NOT NULL,
+	org        TEXT NOT NULL DEFAULT '',
+	path       TEXT NOT NULL,
+	label      TEXT NOT NULL DEFAULT '',
+	max_size   INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS drops_owner_idx ON drops (owner_id);
+CREATE TABLE IF NOT EXISTS link_accesses (
+	id         TEXT PRIMARY KEY,
+	link_id    TEXT NOT NULL,
+	owner_id   TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	at         INTEGER NOT NULL,
+	ip         TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	method     TEXT NOT NULL,
+	status     INTEGER NOT NULL,
+	bytes      INTEGER NOT NULL DEFAULT 0,
+	complete   INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS link_accesses_link_idx ON link_accesses (link_id);
+CREATE INDEX IF NOT EXISTS link_accesses_at_idx ON link_accesses (at);
+CREATE TABLE IF NOT EXISTS abuse_reports (
+	id          TEXT PRIMARY KEY,
+	link_id     TEXT NOT NULL,
+	owner_id    TEXT NOT NULL,
+	tree        TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	category    TEXT NOT NULL,
+	details     TEXT NOT NULL DEFAULT '',
+	ip          TEXT NOT NULL DEFAULT '',
+	created     INTEGER NOT NULL,
+	status      TEXT NOT NULL,
+	reviewer_id TEXT NOT NULL DEFAULT '',
+	reviewed    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS abuse_reports_file_idx ON abuse_reports (tree, path);
+CREATE INDEX IF NOT EXISTS abuse_reports_link_idx ON abuse_reports (link_id);
+CREATE TABLE IF NOT EXISTS audit_events (
+	id       TEXT PRIMARY KEY,
+	at       INTEGER NOT NULL,
+	actor_id TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	tree     TEXT NOT NULL DEFAULT '',
+	path     TEXT NOT NULL DEFAULT '',
+	detail   TEXT NOT NULL DEFAULT '',
+	seq      INTEGER NOT NULL DEFAULT 0,
+	mac      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_events_at_idx ON audit_events (at);
+CREATE TABLE IF NOT EXISTS file_locks (
+	tree     TEXT NOT NULL,
+	path     TEXT NOT NULL,
+	token    TEXT NOT NULL,
+	owner_id TEXT NOT NULL,
+	owner    TEXT NOT NULL DEFAULT '',
+	created  INTEGER NOT NULL,
+	expires  INTEGER NOT NULL,
+	PRIMARY KEY (tree, path)
+);
+CREATE TABLE IF NOT EXISTS honeytokens (
+	tree       TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	label      TEXT NOT NULL DEFAULT '',
+	creator_id TEXT NOT NULL,
+	created    INTEGER NOT NULL,
+	PRIMARY KEY (tree, path)
+);
+CREATE TABLE IF NOT EXISTS jobs (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	started_at  INTEGER NOT NULL,
+	finished_at INTEGER NOT NULL DEFAULT 0,
+	done        INTEGER NOT NULL DEFAULT 0,
+	total       INTEGER NOT NULL DEFAULT 0,
+	result      TEXT,
+	error       TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS usage (
+	user_id        TEXT NOT NULL,
+	day            TEXT NOT NULL,
+	upload_bytes   INTEGER NOT NULL DEFAULT 0,
+	download_bytes INTEGER NOT NULL DEFAULT 0,
+	stored_bytes   INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (day, user_id)
+);
+CREATE TABLE IF NOT EXISTS orgs (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	quota_bytes INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS org_members (
+	org_id  TEXT NOT NULL REFERENCES orgs(id) ON DELETE CASCADE,
+	user_id TEXT NOT NULL,
+	role    TEXT NOT NULL,
+	PRIMARY KEY (org_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS org_members_user_idx ON org_members (user_id);
+`
+
+// OpenSQLite opens (creating if needed) the database file and migrates it.
+func OpenSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	sdb, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// one writer at a time; WAL still lets readers proceed
+	sdb.SetMaxOpenConns(1)
+	if _, err := sdb.Exec(sqliteSchema); err != nil {
+		sdb.Close()
+		return nil, err
+	}
+	// columns added after the first release, and indexes on them; SQLite has
+	// no ADD COLUMN IF NOT EXISTS
+	for _, stmt := range []string{
+		`ALTER TABLE sessions ADD COLUMN last_seen INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE sessions ADD COLUMN device_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN image_metadata TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN staging_max_age INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN locked INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE audit_events ADD COLUMN seq INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE audit_events ADD COLUMN mac TEXT NOT NULL DEFAULT ''`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS audit_events_seq_idx ON audit_events (seq) WHERE seq > 0`,
+		`ALTER TABLE api_keys ADD COLUMN signing INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if _, err := sdb.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			sdb.Close()
+			return nil, err
+		}
+	}
+	return sdb, nil
+}
+
+func NewSQLiteStores(sdb *sql.DB) Stores {
+	return Stores{
+		Users:    SQLiteUserStore{DB: sdb},
+		Sessions: SQLiteSessionStore{DB: sdb},
+		Devices:  SQLiteDeviceStore{DB: sdb},
+		APIKeys:  SQLiteAPIKeyStore{DB: sdb},
+		Shares:   SQLiteShareStore{DB: sdb},
+		Buckets:  SQLiteBucketStore{DB: sdb},
+		Drops:    SQLiteDropStore{DB: sdb},
+		Links:    SQLiteLinkAccessStore{DB: sdb},
+		Audit:    SQLiteAuditStore{DB: sdb},
+		Reports:  SQLiteAbuseReportStore{DB: sdb},
+		Locks:    SQLiteFileLockStore{DB: sdb},
+		Honey:    SQLiteHoneytokenStore{DB: sdb},
+		Jobs:     SQLiteJobStore{DB: sdb},
+		Usage:    SQLiteUsageStore{DB: sdb},
+		Orgs:     SQLiteOrgStore{DB: sdb},
+	}
+}
+
+func sqliteErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrExists
+	}
+	return err
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(s int64) time.Time {
+	if s == 0 {
+		return time.Time{}
+	}
+	return time.Unix(s, 0)
+}
+
+type SQLiteUserStore struct{ DB *sql.DB }
+
+const userCols = `user_id, email, username, password, admin, email_verified, image_metadata, staging_max_age, disabled, locked`
+
+func (s SQLiteUserStore) Create(ctx context.Context, u *User) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO users (`+userCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.UserID, strings.ToLower(u.Email), u.Username, u.Password, u.Admin, u.EmailVerified, u.ImageMetadata, int64(u.StagingMaxAge/time.Second), u.Disabled, u.Locked)
+	return sqliteErr(err)
+}
+
+func (s SQLiteUserStore) scan(row rowScanner) (*User, error) {
+	var u User
+	var stagingSecs int64
+	if err := row.Scan(&u.UserID, &u.Email, &u.Username, &u.Password, &u.Admin, &u.EmailVerified, &u.ImageMetadata, &stagingSecs, &u.Disabled, &u.Locked); err != nil {
+		return nil, sqliteErr(err)
+	}
+	u.StagingMaxAge = time.Duration(stagingSecs) * time.Second
+	return &u, nil
+}
+
+func (s SQLiteUserStore) ByEmail(ctx context.Context, email string) (*User, error) {
+	return s.scan(s.DB.QueryRowContext(ctx, `SELECT `+userCols+` FROM users WHERE email = ?`, strings.ToLower(email)))
+}
+
+func (s SQLiteUserStore) ByID(ctx context.Context, id string) (*User, error) {
+	return s.scan(s.DB.QueryRowContext(ctx, `SELECT `+userCols+` FROM users WHERE user_id = ?`, id))
+}
+
+func (s SQLiteUserStore) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, `SELECT count(*) FROM users`).Scan(&n)
+	return n, sqliteErr(err)
+}
+
+func (s SQLiteUserStore) SetPassword(ctx context.Context, userID, hash string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET password = ? WHERE user_id = ?`, hash, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetEmailVerified(ctx context.Context, userID string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET email_verified = 1 WHERE user_id = ?`, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetAdmin(ctx context.Context, userID string, admin bool) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET admin = ? WHERE user_id = ?`, admin, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetUsername(ctx context.Context, userID, username string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET username = ? WHERE user_id = ?`, username, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetDisabled(ctx context.Context, userID string, disabled bool) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET disabled = ? WHERE user_id = ?`, disabled, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetLocked(ctx context.Context, userID string, locked bool) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET locked = ? WHERE user_id = ?`, locked, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) List(ctx context.Context) ([]User, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+userCols+` FROM users ORDER BY email`)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []User{}
+	for rows.Next() {
+		u, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *u)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteUserStore) SetImageMetadata(ctx context.Context, userID, policy string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET image_metadata = ? WHERE user_id = ?`, policy, userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) SetStagingMaxAge(ctx context.Context, userID string, d time.Duration) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE users SET staging_max_age = ? WHERE user_id = ?`, int64(d/time.Second), userID)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteSessionStore struct{ DB *sql.DB }
+
+func (s SQLiteSessionStore) Create(ctx context.Context, sess *Session) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO sessions (session_token, csrf_token, user_id, expires_at, last_seen, ip, user_agent, device_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sess.SessionToken, sess.CSRFToken, sess.UserID, sess.ExpiryTime.Unix(), unixOrZero(sess.LastSeen), sess.IP, sess.UserAgent, sess.DeviceID)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	var sess Session
+	var exp, seen int64
+	err := s.DB.QueryRowContext(ctx, `SELECT session_token, csrf_token, user_id, expires_at, last_seen, ip, user_agent, device_id FROM sessions WHERE session_token = ?`, token).
+		Scan(&sess.SessionToken, &sess.CSRFToken, &sess.UserID, &exp, &seen, &sess.IP, &sess.UserAgent, &sess.DeviceID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	sess.ExpiryTime = time.Unix(exp, 0)
+	sess.LastSeen = timeOrZero(seen)
+	return &sess, nil
+}
+
+func (s SQLiteSessionStore) Touch(ctx context.Context, token string, at time.Time) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE sessions SET last_seen = ? WHERE session_token = ?`, at.Unix(), token)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) Rebind(ctx context.Context, token, ip, userAgent string) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE sessions SET ip = ?, user_agent = ? WHERE session_token = ?`, ip, userAgent, token)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) SetCSRF(ctx context.Context, token, csrf string) error {
+	_, err := s.DB.ExecContext(ctx, `UPDATE sessions SET csrf_token = ? WHERE session_token = ?`, csrf, token)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) DeleteForUser(ctx context.Context, userID string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) Delete(ctx context.Context, token string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE session_token = ?`, token)
+	return sqliteErr(err)
+}
+
+func (s SQLiteSessionStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < ?`, now.Unix())
+	if err != nil {
+		return 0, sqliteErr(err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+type SQLiteDeviceStore struct{ DB *sql.DB }
+
+func (s SQLiteDeviceStore) Create(ctx context.Context, d *Device) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO devices (`+deviceCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.UserID, d.TokenHash, d.UserAgent, d.IP, d.FirstSeen.Unix(), d.LastSeen.Unix(), d.Trusted)
+	return sqliteErr(err)
+}
+
+func scanSQLiteDevice(row rowScanner) (Device, error) {
+	var d Device
+	var first, last int64
+	if err := row.Scan(&d.ID, &d.UserID, &d.TokenHash, &d.UserAgent, &d.IP, &first, &last, &d.Trusted); err != nil {
+		return d, sqliteErr(err)
+	}
+	d.FirstSeen, d.LastSeen = time.Unix(first, 0), time.Unix(last, 0)
+	return d, nil
+}
+
+func (s SQLiteDeviceStore) Get(ctx context.Context, id string) (*Device, error) {
+	d, err := scanSQLiteDevice(s.DB.QueryRowContext(ctx, `SELECT `+deviceCols+` FROM devices WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s SQLiteDeviceStore) ByToken(ctx context.Context, userID, tokenHash string) (*Device, error) {
+	d, err := scanSQLiteDevice(s.DB.QueryRowContext(ctx, `SELECT `+deviceCols+` FROM devices WHERE user_id = ? AND token_hash = ?`, userID, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s SQLiteDeviceStore) ListForUser(ctx context.Context, userID string) ([]Device, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+deviceCols+` FROM devices WHERE user_id = ? ORDER BY last_seen DESC`, userID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Device{}
+	for rows.Next() {
+		d, err := scanSQLiteDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteDeviceStore) exec(ctx context.Context, query string, args ...any) error {
+	res, err := s.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteDeviceStore) Touch(ctx context.Context, id, ip string, at time.Time) error {
+	return s.exec(ctx, `UPDATE devices SET ip = ?, last_seen = ? WHERE id = ?`, ip, at.Unix(), id)
+}
+
+func (s SQLiteDeviceStore) SetTrusted(ctx context.Context, id string, trusted bool) error {
+	return s.exec(ctx, `UPDATE devices SET trusted = ? WHERE id = ?`, trusted, id)
+}
+
+func (s SQLiteDeviceStore) Delete(ctx context.Context, id string) error {
+	return s.exec(ctx, `DELETE FROM devices WHERE id = ?`, id)
+}
+
+type SQLiteAPIKeyStore struct{ DB *sql.DB }
+
+func (s SQLiteAPIKeyStore) Create(ctx context.Context, k *APIKey) error {
+	scopes, prefixes, err := encodeKeyLists(k)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, `INSERT INTO api_keys (`+apiKeyCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.ID, k.UserID, k.Name, k.TokenHash, scopes, prefixes, k.Created.Unix(), unixOrZero(k.Expires), unixOrZero(k.LastUsed), k.Signing)
+	return sqliteErr(err)
+}
+
+func scanSQLiteAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes, prefixes string
+	var created, expires, lastUsed int64
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.TokenHash, &scopes, &prefixes, &created, &expires, &lastUsed, &k.Signing); err != nil {
+		return k, sqliteErr(err)
+	}
+	k.Created, k.Expires, k.LastUsed = time.Unix(created, 0), timeOrZero(expires), timeOrZero(lastUsed)
+	return k, decodeKeyLists(&k, scopes, prefixes)
+}
+
+func (s SQLiteAPIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanSQLiteAPIKey(s.DB.QueryRowContext(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s SQLiteAPIKeyStore) ByToken(ctx context.Context, tokenHash string) (*APIKey, error) {
+	k, err := scanSQLiteAPIKey(s.DB.QueryRowContext(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE token_hash = ?`, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (s SQLiteAPIKeyStore) ListForUser(ctx context.Context, userID string) ([]APIKey, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+apiKeyCols+` FROM api_keys WHERE user_id = ? ORDER BY created DESC`, userID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []APIKey{}
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteAPIKeyStore) exec(ctx context.Context, query string, args ...any) error {
+	res, err := s.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteAPIKeyStore) Touch(ctx context.Context, id string, at time.Time) error {
+	return s.exec(ctx, `UPDATE api_keys SET last_used = ? WHERE id = ?`, at.Unix(), id)
+}
+
+func (s SQLiteAPIKeyStore) Delete(ctx context.Context, userID, id string) error {
+	return s.exec(ctx, `DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userID)
+}
+
+type SQLiteShareStore struct{ DB *sql.DB }
+
+func (s SQLiteShareStore) Create(ctx context.Context, sh *Share) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO shares (id, owner_id, org, path, grantee_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sh.ID, sh.OwnerID, sh.Org, sh.Path, sh.GranteeID, sh.Created.Unix(), unixOrZero(sh.Expires))
+	return sqliteErr(err)
+}
+
+type rowScanner interface{ Scan(dest ...any) error }
+
+func scanSQLiteShare(row rowScanner) (Share, error) {
+	var sh Share
+	var created, exp int64
+	if err := row.Scan(&sh.ID, &sh.OwnerID, &sh.Org, &sh.Path, &sh.GranteeID, &created, &exp); err != nil {
+		return sh, sqliteErr(err)
+	}
+	sh.Created = time.Unix(created, 0)
+	sh.Expires = timeOrZero(exp)
+	return sh, nil
+}
+
+func (s SQLiteShareStore) Get(ctx context.Context, id string) (*Share, error) {
+	sh, err := scanSQLiteShare(s.DB.QueryRowContext(ctx, `SELECT `+shareCols+` FROM shares WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &sh, nil
+}
+
+func (s SQLiteShareStore) list(ctx context.Context, where string, arg any) ([]Share, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+shareCols+` FROM shares WHERE `+where+` = ? ORDER BY created_at DESC`, arg)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Share{}
+	for rows.Next() {
+		sh, err := scanSQLiteShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sh)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteShareStore) ListByOwner(ctx context.Context, ownerID string) ([]Share, error) {
+	return s.list(ctx, "owner_id", ownerID)
+}
+
+func (s SQLiteShareStore) ListForGrantee(ctx context.Context, granteeID string) ([]Share, error) {
+	return s.list(ctx, "grantee_id", granteeID)
+}
+
+func (s SQLiteShareStore) Delete(ctx context.Context, id string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM shares WHERE id = ?`, id)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteBucketStore struct{ DB *sql.DB }
+
+func (s SQLiteBucketStore) Create(ctx context.Context, b *Bucket) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO buckets (slug, owner_id, org, path, created_at) VALUES (?, ?, ?, ?, ?)`,
+		b.Slug, b.OwnerID, b.Org, b.Path, b.Created.Unix())
+	return sqliteErr(err)
+}
+
+func scanSQLiteBucket(row rowScanner) (Bucket, error) {
+	var b Bucket
+	var created int64
+	if err := row.Scan(&b.Slug, &b.OwnerID, &b.Org, &b.Path, &created); err != nil {
+		return b, sqliteErr(err)
+	}
+	b.Created = time.Unix(created, 0)
+	return b, nil
+}
+
+func (s SQLiteBucketStore) Get(ctx context.Context, slug string) (*Bucket, error) {
+	b, err := scanSQLiteBucket(s.DB.QueryRowContext(ctx, `SELECT `+bucketCols+` FROM buckets WHERE slug = ?`, slug))
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s SQLiteBucketStore) ListByOwner(ctx context.Context, ownerID string) ([]Bucket, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+bucketCols+` FROM buckets WHERE owner_id = ? ORDER BY created_at DESC`, ownerID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Bucket{}
+	for rows.Next() {
+		b, err := scanSQLiteBucket(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteBucketStore) Delete(ctx context.Context, slug string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM buckets WHERE slug = ?`, slug)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteDropStore struct{ DB *sql.DB }
+
+func (s SQLiteDropStore) Create(ctx context.Context, d *Drop) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO drops (`+dropCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.Slug, d.OwnerID, d.Org, d.Path, d.Label, d.MaxSize, d.Created.Unix(), unixOrZero(d.Expires))
+	return sqliteErr(err)
+}
+
+func scanSQLiteDrop(row rowScanner) (Drop, error) {
+	var d Drop
+	var created, expires int64
+	if err := row.Scan(&d.Slug, &d.OwnerID, &d.Org, &d.Path, &d.Label, &d.MaxSize, &created, &expires); err != nil {
+		return d, sqliteErr(err)
+	}
+	d.Created, d.Expires = time.Unix(created, 0), timeOrZero(expires)
+	return d, nil
+}
+
+func (s SQLiteDropStore) Get(ctx context.Context, slug string) (*Drop, error) {
+	d, err := scanSQLiteDrop(s.DB.QueryRowContext(ctx, `SELECT `+dropCols+` FROM drops WHERE slug = ?`, slug))
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s SQLiteDropStore) ListByOwner(ctx context.Context, ownerID string) ([]Drop, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+dropCols+` FROM drops WHERE owner_id = ? ORDER BY created_at DESC`, ownerID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Drop{}
+	for rows.Next() {
+		d, err := scanSQLiteDrop(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteDropStore) Delete(ctx context.Context, slug string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM drops WHERE slug = ?`, slug)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteLinkAccessStore struct{ DB *sql.DB }
+
+func (s SQLiteLinkAccessStore) Add(ctx context.Context, a *LinkAccess) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO link_accesses (id, link_id, owner_id, path, at, ip, user_agent, method, status, bytes, complete) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.LinkID, a.OwnerID, a.Path, a.Time.UnixMilli(), a.IP, a.UserAgent, a.Method, a.Status, a.Bytes, a.Complete)
+	return sqliteErr(err)
+}
+
+func (s SQLiteLinkAccessStore) ListForLink(ctx context.Context, linkID string) ([]LinkAccess, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+linkAccessCols+` FROM link_accesses WHERE link_id = ? ORDER BY at`, linkID)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []LinkAccess{}
+	for rows.Next() {
+		var a LinkAccess
+		var at int64
+		if err := rows.Scan(&a.ID, &a.LinkID, &a.OwnerID, &a.Path, &at, &a.IP, &a.UserAgent, &a.Method, &a.Status, &a.Bytes, &a.Complete); err != nil {
+			return nil, sqliteErr(err)
+		}
+		a.Time = time.UnixMilli(at)
+		out = append(out, a)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteLinkAccessStore) DeleteBefore(ctx context.Context, t time.Time) (int, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM link_accesses WHERE at < ?`, t.UnixMilli())
+	if err != nil {
+		return 0, sqliteErr(err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+type SQLiteAbuseReportStore struct{ DB *sql.DB }
+
+func (s SQLiteAbuseReportStore) Add(ctx context.Context, r *AbuseReport) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO abuse_reports (`+abuseReportCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		r.ID, r.LinkID, r.OwnerID, r.Tree, r.Path, r.Category, r.Details, r.IP, r.Created.Unix(), r.Status, r.ReviewerID)
+	return sqliteErr(err)
+}
+
+func (s SQLiteAbuseReportStore) Get(ctx context.Context, id string) (*AbuseReport, error) {
+	r, err := scanSQLiteAbuseReport(s.DB.QueryRowContext(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s SQLiteAbuseReportStore) List(ctx context.Context, status string) ([]AbuseReport, error) {
+	return s.query(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE ? = '' OR status = ? ORDER BY created DESC, rowid DESC`, status, status)
+}
+
+func (s SQLiteAbuseReportStore) ListForLink(ctx context.Context, linkID string) ([]AbuseReport, error) {
+	return s.query(ctx, `SELECT `+abuseReportCols+` FROM abuse_reports WHERE link_id = ? ORDER BY created`, linkID)
+}
+
+func (s SQLiteAbuseReportStore) query(ctx context.Context, q string, args ...any) ([]AbuseReport, error) {
+	rows, err := s.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []AbuseReport{}
+	for rows.Next() {
+		r, err := scanSQLiteAbuseReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func scanSQLiteAbuseReport(row rowScanner) (AbuseReport, error) {
+	var r AbuseReport
+	var created, reviewed int64
+	if err := row.Scan(&r.ID, &r.LinkID, &r.OwnerID, &r.Tree, &r.Path, &r.Category, &r.Details, &r.IP, &created, &r.Status, &r.ReviewerID, &reviewed); err != nil {
+		return r, sqliteErr(err)
+	}
+	r.Created = time.Unix(created, 0)
+	if reviewed != 0 {
+		r.Reviewed = time.Unix(reviewed, 0)
+	}
+	return r, nil
+}
+
+func (s SQLiteAbuseReportStore) Review(ctx context.Context, id, status, reviewerID string, at time.Time) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE abuse_reports SET status = ?, reviewer_id = ?, reviewed = ? WHERE id = ? AND status = ?`,
+		status, reviewerID, at.Unix(), id, ReportOpen)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteAuditStore struct{ DB *sql.DB }
+
+func (s SQLiteAuditStore) Add(ctx context.Context, a *AuditEvent) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO audit_events (`+auditEventCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Time.UnixMilli(), a.ActorID, a.Action, a.Tree, a.Path, a.Detail, a.Seq, a.MAC)
+	return sqliteErr(err)
+}
+
+func (s SQLiteAuditStore) List(ctx context.Context, limit int) ([]AuditEvent, error) {
+	return s.query(ctx, `SELECT `+auditEventCols+` FROM audit_events ORDER BY at DESC, id DESC LIMIT ?`, limit)
+}
+
+func (s SQLiteAuditStore) Last(ctx context.Context) (*AuditEvent, error) {
+	a, err := scanSQLiteAuditEvent(s.DB.QueryRowContext(ctx, `SELECT `+auditEventCols+` FROM audit_events WHERE seq > 0 ORDER BY seq DESC LIMIT 1`))
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	return &a, nil
+}
+
+func (s SQLiteAuditStore) Since(ctx context.Context, seq int64, limit int) ([]AuditEvent, error) {
+	return s.query(ctx, `SELECT `+auditEventCols+` FROM audit_events WHERE seq > ? ORDER BY seq LIMIT ?`, seq, limit)
+}
+
+func (s SQLiteAuditStore) query(ctx context.Context, query string, args ...any) ([]AuditEvent, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []AuditEvent{}
+	for rows.Next() {
+		a, err := scanSQLiteAuditEvent(rows)
+		if err != nil {
+			return nil, sqliteErr(err)
+		}
+		out = append(out, a)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func scanSQLiteAuditEvent(r rowScanner) (AuditEvent, error) {
+	var a AuditEvent
+	var at int64
+	err := r.Scan(&a.ID, &at, &a.ActorID, &a.Action, &a.Tree, &a.Path, &a.Detail, &a.Seq, &a.MAC)
+	a.Time = time.UnixMilli(at)
+	return a, err
+}
+
+type SQLiteFileLockStore struct{ DB *sql.DB }
+
+func (s SQLiteFileLockStore) Acquire(ctx context.Context, l *FileLock) error {
+	res, err := s.DB.ExecContext(ctx, `INSERT INTO file_locks (`+fileLockCols+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (tree, path) DO UPDATE SET
+			token = excluded.token, owner_id = excluded.owner_id, owner = excluded.owner, expires = excluded.expires,
+			created = CASE WHEN file_locks.token = excluded.token THEN file_locks.created ELSE excluded.created END
+		WHERE file_locks.expires <= excluded.created OR (file_locks.token = excluded.token AND file_locks.owner_id = excluded.owner_id)`,
+		l.Tree, l.Path, l.Token, l.OwnerID, l.Owner, l.Created.Unix(), l.Expires.Unix())
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func scanSQLiteFileLock(r rowScanner) (*FileLock, error) {
+	var l FileLock
+	var created, expires int64
+	if err := r.Scan(&l.Tree, &l.Path, &l.Token, &l.OwnerID, &l.Owner, &created, &expires); err != nil {
+		return nil, sqliteErr(err)
+	}
+	l.Created, l.Expires = time.Unix(created, 0), time.Unix(expires, 0)
+	return &l, nil
+}
+
+func (s SQLiteFileLockStore) Get(ctx context.Context, tree, path string) (*FileLock, error) {
+	return scanSQLiteFileLock(s.DB.QueryRowContext(ctx, `SELECT `+fileLockCols+` FROM file_locks WHERE tree = ? AND path = ? AND expires > ?`, tree, path, time.Now().Unix()))
+}
+
+func (s SQLiteFileLockStore) List(ctx context.Context, tree string) ([]FileLock, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+fileLockCols+` FROM file_locks WHERE tree = ? AND expires > ? ORDER BY path`, tree, time.Now().Unix())
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []FileLock{}
+	for rows.Next() {
+		l, err := scanSQLiteFileLock(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *l)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteFileLockStore) Release(ctx context.Context, tree, path, token string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM file_locks WHERE tree = ? AND path = ? AND token = ?`, tree, path, token)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteFileLockStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM file_locks WHERE expires <= ?`, now.Unix())
+	if err != nil {
+		return 0, sqliteErr(err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+type SQLiteHoneytokenStore struct{ DB *sql.DB }
+
+func (s SQLiteHoneytokenStore) Add(ctx context.Context, t *Honeytoken) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO honeytokens (`+honeytokenCols+`) VALUES (?, ?, ?, ?, ?)`,
+		t.Tree, t.Path, t.Label, t.CreatorID, t.Created.Unix())
+	return sqliteErr(err)
+}
+
+func scanSQLiteHoneytoken(r rowScanner) (*Honeytoken, error) {
+	var t Honeytoken
+	var created int64
+	if err := r.Scan(&t.Tree, &t.Path, &t.Label, &t.CreatorID, &created); err != nil {
+		return nil, sqliteErr(err)
+	}
+	t.Created = time.Unix(created, 0)
+	return &t, nil
+}
+
+func (s SQLiteHoneytokenStore) Get(ctx context.Context, tree, path string) (*Honeytoken, error) {
+	return scanSQLiteHoneytoken(s.DB.QueryRowContext(ctx, `SELECT `+honeytokenCols+` FROM honeytokens WHERE tree = ? AND path = ?`, tree, path))
+}
+
+func (s SQLiteHoneytokenStore) List(ctx context.Context) ([]Honeytoken, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+honeytokenCols+` FROM honeytokens ORDER BY tree, path`)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Honeytoken{}
+	for rows.Next() {
+		t, err := scanSQLiteHoneytoken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *t)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteHoneytokenStore) Delete(ctx context.Context, tree, path string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM honeytokens WHERE tree = ? AND path = ?`, tree, path)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type SQLiteJobStore struct{ DB *sql.DB }
+
+func (s SQLiteJobStore) Save(ctx context.Context, j *Job) error {
+	result, err := json.Marshal(j.Result)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, `
+		INSERT INTO jobs (id, name, status, started_at, finished_at, done, total, result, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, finished_at = excluded.finished_at,
+			done = excluded.done, total = excluded.total, result = excluded.result, error = excluded.error`,
+		j.ID, j.Name, j.Status, j.StartedAt, j.FinishedAt, j.Done, j.Total, string(result), j.Error)
+	return sqliteErr(err)
+}
+
+func scanSQLiteJob(row rowScanner) (Job, error) {
+	var j Job
+	var result sql.NullString
+	if err := row.Scan(&j.ID, &j.Name, &j.Status, &j.StartedAt, &j.FinishedAt, &j.Done, &j.Total, &result, &j.Error); err != nil {
+		return j, sqliteErr(err)
+	}
+	if result.Valid && result.String != "" {
+		var v any
+		if json.Unmarshal([]byte(result.String), &v) == nil {
+			j.Result = v
+		}
+	}
+	return j, nil
+}
+
+func (s SQLiteJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	j, err := scanSQLiteJob(s.DB.QueryRowContext(ctx, `SELECT `+jobCols+` FROM jobs WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s SQLiteJobStore) List(ctx context.Context, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+jobCols+` FROM jobs ORDER BY started_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Job{}
+	for rows.Next() {
+		j, err := scanSQLiteJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+type SQLiteUsageStore struct{ DB *sql.DB }
+
+func (s SQLiteUsageStore) AddTransfer(ctx context.Context, userID, day string, upload, download int64) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO usage (user_id, day, upload_bytes, download_bytes) VALUES (?, ?, ?, ?)
+		ON CONFLICT (day, user_id) DO UPDATE SET upload_bytes = upload_bytes + excluded.upload_bytes,
+			download_bytes = download_bytes + excluded.download_bytes`,
+		userID, day, upload, download)
+	return sqliteErr(err)
+}
+
+func (s SQLiteUsageStore) SetStored(ctx context.Context, userID, day string, bytes int64) error {
+	_, err := s.DB.ExecContext(ctx, `
+		INSERT INTO usage (user_id, day, stored_bytes) VALUES (?, ?, ?)
+		ON CONFLICT (day, user_id) DO UPDATE SET stored_bytes = excluded.stored_bytes`,
+		userID, day, bytes)
+	return sqliteErr(err)
+}
+
+func (s SQLiteUsageStore) List(ctx context.Context, from, to string) ([]Usage, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT `+usageCols+` FROM usage WHERE day >= ? AND day <= ? ORDER BY day, user_id`, from, to)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	out := []Usage{}
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.UserID, &u.Day, &u.UploadBytes, &u.DownloadBytes, &u.StoredBytes); err != nil {
+			return nil, sqliteErr(err)
+		}
+		out = append(out, u)
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+type SQLiteOrgStore struct{ DB *sql.DB }
+
+func (s SQLiteOrgStore) Create(ctx context.Context, o *Org) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO orgs (id, name, quota_bytes) VALUES (?, ?, ?)`, o.ID, o.Name, o.QuotaBytes); err != nil {
+		return sqliteErr(err)
+	}
+	for id, role := range o.Members {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)`, o.ID, id, role); err != nil {
+			return sqliteErr(err)
+		}
+	}
+	return sqliteErr(tx.Commit())
+}
+
+// load reads the orgs where picks, with their members. The first query's
+// rows are closed before the second: the pool has one connection.
+func (s SQLiteOrgStore) load(ctx context.Context, where string, args ...any) ([]Org, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, name, quota_bytes FROM orgs `+where+` ORDER BY name`, args...)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	out := []Org{}
+	byID := map[string]int{}
+	for rows.Next() {
+		o := Org{Members: map[string]string{}}
+		if err := rows.Scan(&o.ID, &o.Name, &o.QuotaBytes); err != nil {
+			rows.Close()
+			return nil, sqliteErr(err)
+		}
+		byID[o.ID] = len(out)
+		out = append(out, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, sqliteErr(err)
+	}
+	rows, err = s.DB.QueryContext(ctx, `SELECT org_id, user_id, role FROM org_members WHERE org_id IN (SELECT id FROM orgs `+where+`)`, args...)
+	if err != nil {
+		return nil, sqliteErr(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orgID, userID, role string
+		if err := rows.Scan(&orgID, &userID, &role); err != nil {
+			return nil, sqliteErr(err)
+		}
+		if i, ok := byID[orgID]; ok {
+			out[i].Members[userID] = role
+		}
+	}
+	return out, sqliteErr(rows.Err())
+}
+
+func (s SQLiteOrgStore) Get(ctx context.Context, id string) (*Org, error) {
+	orgs, err := s.load(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(orgs) == 0 {
+		return nil, ErrNotFound
+	}
+	return &orgs[0], nil
+}
+
+func (s SQLiteOrgStore) List(ctx context.Context) ([]Org, error) {
+	return s.load(ctx, ``)
+}
+
+func (s SQLiteOrgStore) ListForUser(ctx context.Context, userID string) ([]Org, error) {
+	return s.load(ctx, `WHERE id IN (SELECT org_id FROM org_members WHERE user_id = ?)`, userID)
+}
+
+func (s SQLiteOrgStore) Rename(ctx context.Context, id, name string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE orgs SET name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteOrgStore) SetMember(ctx context.Context, orgID, userID, role string) error {
+	res, err := s.DB.ExecContext(ctx, `
+		INSERT INTO org_members (org_id, user_id, role)
+		SELECT ?1, ?2, ?3 WHERE EXISTS (SELECT 1 FROM orgs WHERE id = ?1)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role`, orgID, userID, role)
+	if err != nil {
+		return sqliteErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s SQLiteOrgStore) RemoveMember(ctx context.Context, orgID, userID string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM org_members WHERE org_id = ? AND user_id = ?`, orgID, userID)
+	return sqliteErr(err)
+}
@@ -0,0 +1,393 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+type User struct {
+	UserID   string
+	Email    string
+	Username string
+	Password string // bcrypt hash
+	Admin    bool
+	// set once the user follows the link mailed at registration
+	EmailVerified bool
+	// what uploads do with image metadata (EXIF GPS, camera, ...) unless
+	// an upload says otherwise: "" keeps it, "strip" removes it, "record"
+	// removes it from the file but keeps a copy in the manifest
+	ImageMetadata string
+	// admin override of how long the user's unfinished chunked uploads
+	// keep their staged chunks; 0 = UPLOAD_STAGING_MAX_AGE
+	StagingMaxAge time.Duration
+	// deprovisioned (SCIM): the account keeps its files but cannot sign in
+	Disabled bool
+	// locked by ANOMALY_ACTIONS until an admin unlocks it; kept apart from
+	// Disabled so that neither undoes the other
+	Locked bool
+}
+
+type Session struct {
+	SessionToken string // hex SHA-256 of the cookie value; the raw token is never stored
+	CSRFToken    string
+	UserID       string
+	ExpiryTime   time.Time // absolute expiry
+	LastSeen     time.Time // for the idle timeout
+	IP           string    // client address at login
+	UserAgent    string
+	DeviceID     string // device the session is bound to; "" for sessions that predate devices
+}
+
+func (s Session) IsExpired() bool {
+	return s.ExpiryTime.Before(time.Now())
+}
+
+// Share grants GranteeID access to Path in OwnerID's tree (or Org's tree).
+type Share struct {
+	ID        string    `json:"id"`
+	OwnerID   string    `json:"owner_id"`
+	Org       string    `json:"org,omitempty"`
+	Path      string    `json:"path"`
+	GranteeID string    `json:"grantee_id"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"` // zero = never
+}
+
+// Bucket publishes Path in OwnerID's tree (or Org's tree), read-only and
+// without sign-in, under /pub/<Slug>/.
+type Bucket struct {
+	Slug    string    `json:"slug"`
+	OwnerID string    `json:"owner_id"`
+	Org     string    `json:"org,omitempty"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+// Drop lets anyone with its URL upload files into Path in OwnerID's tree
+// (or Org's tree) under /api/drop/<Slug>, without listing or reading what
+// is there. The Slug is the secret.
+type Drop struct {
+	Slug    string    `json:"slug"`
+	OwnerID string    `json:"owner_id"`
+	Org     string    `json:"org,omitempty"`
+	Path    string    `json:"path"`
+	Label   string    `json:"label,omitempty"`    // shown to uploaders
+	MaxSize int64     `json:"max_size,omitempty"` // per file; 0 = no limit
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero = never
+}
+
+// LinkAccess is one use of a signed download link. LinkID is the link's
+// nonce; OwnerID minted it.
+type LinkAccess struct {
+	ID        string    `json:"id"`
+	LinkID    string    `json:"link_id"`
+	OwnerID   string    `json:"-"`
+	Path      string    `json:"path"`
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Method    string    `json:"method"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Complete  bool      `json:"complete"` // the whole file was sent
+}
+
+// AuditEvent records an administrative action: who (ActorID) did what
+// (Action) to Path in the tree stored at Tree, and why or with what
+// outcome (Detail). Seq and MAC chain it to the event before; events
+// from before the chain have neither.
+type AuditEvent struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	ActorID string    `json:"actor_id"`
+	Action  string    `json:"action"`
+	Tree    string    `json:"tree,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	Seq     int64     `json:"seq,omitempty"`
+	MAC     string    `json:"mac,omitempty"`
+}
+
+// Abuse report statuses.
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportActioned  = "actioned"
+)
+
+// AbuseReport is a flag raised by someone holding a link to Path, in the
+// tree stored at Tree, minted by OwnerID. It stays open until an admin
+// reviews it.
+type AbuseReport struct {
+	ID         string    `json:"id"`
+	LinkID     string    `json:"link_id"`
+	OwnerID    string    `json:"owner_id"`
+	Tree       string    `json:"root"`
+	Path       string    `json:"path"`
+	Category   string    `json:"category"`
+	Details    string    `json:"details,omitempty"`
+	IP         string    `json:"ip"`
+	Created    time.Time `json:"created"`
+	Status     string    `json:"status"`
+	ReviewerID string    `json:"reviewer_id,omitempty"`
+	Reviewed   time.Time `json:"reviewed,omitempty"` // zero = not yet
+}
+
+// FileLock is an advisory lock on Path in the tree stored at Tree. While it
+// is live, writes there by anyone but OwnerID are refused; its holder
+// refreshes or releases it with Token. Owner names the holder for others
+// to see, e.g. an editor's "Jane (LibreOffice)".
+type FileLock struct {
+	Tree    string    `json:"-"`
+	Path    string    `json:"path"`
+	Token   string    `json:"token,omitempty"`
+	OwnerID string    `json:"owner_id"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Honeytoken marks the file at Path, in the tree stored at Tree, as bait:
+// no legitimate client has a reason to read it, so every read alerts.
+type Honeytoken struct {
+	Tree      string    `json:"root"`
+	Path      string    `json:"path"`
+	Label     string    `json:"label,omitempty"`
+	CreatorID string    `json:"creator_id"`
+	Created   time.Time `json:"created"`
+}
+
+// Device is a browser or client a user has signed in from, recognised by a
+// long-lived device cookie. Only the cookie's hash is stored.
+type Device struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	TokenHash string    `json:"-"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"` // last seen from
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Trusted   bool      `json:"trusted"`
+}
+
+// APIKey is a bearer credential for a script or device acting as UserID,
+// limited to Scopes and, when Prefixes is set, to paths under them. Only
+// the token's hash is stored. A Signing key has no usable token: requests
+// are signed with a secret derived from its ID instead.
+type APIKey struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"-"`
+	Scopes    []string  `json:"scopes"`
+	Prefixes  []string  `json:"prefixes,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"`   // zero = never
+	LastUsed  time.Time `json:"last_used,omitempty"` // zero = not yet
+	Signing   bool      `json:"signing,omitempty"`
+}
+
+type Job struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+	Done       int64  `json:"done"`            // units processed so far
+	Total      int64  `json:"total,omitempty"` // 0 when unknown
+	Result     any    `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Usage is one user's metered use on one UTC day ("2006-01-02").
+type Usage struct {
+	UserID        string `json:"user_id"`
+	Day           string `json:"day"`
+	UploadBytes   int64  `json:"upload_bytes"`
+	DownloadBytes int64  `json:"download_bytes"`
+	StoredBytes   int64  `json:"stored_bytes"` // latest sample of the day
+}
+
+// Org is a workspace with its own storage root and members, each with a
+// role (owner, admin, member or viewer).
+type Org struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Members    map[string]string `json:"members"`               // userID -> role
+	QuotaBytes int64             `json:"quota_bytes,omitempty"` // 0 = unlimited
+}
+
+type UserStore interface {
+	Create(ctx context.Context, u *User) error // ErrExists for a taken email
+	ByEmail(ctx context.Context, email string) (*User, error)
+	ByID(ctx context.Context, id string) (*User, error)
+	Count(ctx context.Context) (int, error)
+	SetPassword(ctx context.Context, userID, hash string) error
+	SetEmailVerified(ctx context.Context, userID string) error
+	SetAdmin(ctx context.Context, userID string, admin bool) error
+	SetUsername(ctx context.Context, userID, username string) error
+	SetDisabled(ctx context.Context, userID string, disabled bool) error
+	SetLocked(ctx context.Context, userID string, locked bool) error
+	List(ctx context.Context) ([]User, error) // by email
+	SetImageMetadata(ctx context.Context, userID, policy string) error
+	SetStagingMaxAge(ctx context.Context, userID string, d time.Duration) error
+}
+
+type SessionStore interface {
+	Create(ctx context.Context, s *Session) error
+	Get(ctx context.Context, token string) (*Session, error)
+	Touch(ctx context.Context, token string, at time.Time) error
+	SetCSRF(ctx context.Context, token, csrf string) error
+	Rebind(ctx context.Context, token, ip, userAgent string) error // after the owner re-authenticates
+	Delete(ctx context.Context, token string) error
+	DeleteForUser(ctx context.Context, userID string) error
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+type DeviceStore interface {
+	Create(ctx context.Context, d *Device) error
+	Get(ctx context.Context, id string) (*Device, error)
+	ByToken(ctx context.Context, userID, tokenHash string) (*Device, error)
+	ListForUser(ctx context.Context, userID string) ([]Device, error) // most recently seen first
+	Touch(ctx context.Context, id, ip string, at time.Time) error
+	SetTrusted(ctx context.Context, id string, trusted bool) error
+	Delete(ctx context.Context, id string) error
+}
+
+type APIKeyStore interface {
+	Create(ctx context.Context, k *APIKey) error
+	Get(ctx context.Context, id string) (*APIKey, error)
+	ByToken(ctx context.Context, tokenHash string) (*APIKey, error)
+	ListForUser(ctx context.Context, userID string) ([]APIKey, error) // newest first
+	Touch(ctx context.Context, id string, at time.Time) error
+	Delete(ctx context.Context, userID, id string) error // ErrNotFound unless userID's
+}
+
+type ShareStore interface {
+	Create(ctx context.Context, sh *Share) error
+	Get(ctx context.Context, id string) (*Share, error)
+	ListByOwner(ctx context.Context, ownerID string) ([]Share, error)
+	ListForGrantee(ctx context.Context, granteeID string) ([]Share, error)
+	Delete(ctx context.Context, id string) error
+}
+
+type BucketStore interface {
+	Create(ctx context.Context, b *Bucket) error // ErrExists for a taken slug
+	Get(ctx context.Context, slug string) (*Bucket, error)
+	ListByOwner(ctx context.Context, ownerID string) ([]Bucket, error)
+	Delete(ctx context.Context, slug string) error
+}
+
+type DropStore interface {
+	Create(ctx context.Context, d *Drop) error // ErrExists for a taken slug
+	Get(ctx context.Context, slug string) (*Drop, error)
+	ListByOwner(ctx context.Context, ownerID string) ([]Drop, error) // newest first
+	Delete(ctx context.Context, slug string) error
+}
+
+type LinkAccessStore interface {
+	Add(ctx context.Context, a *LinkAccess) error
+	ListForLink(ctx context.Context, linkID string) ([]LinkAccess, error) // oldest first
+	DeleteBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+type FileLockStore interface {
+	// Acquire takes the lock on l.Path, or extends it when the live lock
+	// there has l's Token and OwnerID. Another holder's live lock is ErrExists.
+	Acquire(ctx context.Context, l *FileLock) error
+	Get(ctx context.Context, tree, path string) (*FileLock, error) // live locks only
+	List(ctx context.Context, tree string) ([]FileLock, error)     // live locks only
+	// Release drops the lock on path if it has token, else ErrNotFound.
+	Release(ctx context.Context, tree, path, token string) error
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+type AbuseReportStore interface {
+	Add(ctx context.Context, r *AbuseReport) error
+	Get(ctx context.Context, id string) (*AbuseReport, error)
+	List(ctx context.Context, status string) ([]AbuseReport, error)                // newest first; "" lists all
+	ListForLink(ctx context.Context, linkID string) ([]AbuseReport, error)         // every status, against one link
+	Review(ctx context.Context, id, status, reviewerID string, at time.Time) error // ErrNotFound unless open
+}
+
+type AuditStore interface {
+	Add(ctx context.Context, a *AuditEvent) error                          // ErrExists when a.Seq is taken
+	List(ctx context.Context, limit int) ([]AuditEvent, error)             // newest first
+	Last(ctx context.Context) (*AuditEvent, error)                         // highest Seq; ErrNotFound when none
+	Since(ctx context.Context, seq int64, limit int) ([]AuditEvent, error) // Seq above seq, in order
+}
+
+type HoneytokenStore interface {
+	Add(ctx context.Context, t *Honeytoken) error // ErrExists if the file already is one
+	Get(ctx context.Context, tree, path string) (*Honeytoken, error)
+	List(ctx context.Context) ([]Honeytoken, error) // by tree, then path
+	Delete(ctx context.Context, tree, path string) error
+}
+
+type JobStore interface {
+	Save(ctx context.Context, j *Job) error // insert or update by ID
+	Get(ctx context.Context, id string) (*Job, error)
+	List(ctx context.Context, limit int) ([]Job, error) // newest first
+}
+
+type UsageStore interface {
+	AddTransfer(ctx context.Context, userID, day string, upload, download int64) error
+	SetStored(ctx context.Context, userID, day string, bytes int64) error
+	List(ctx context.Context, from, to string) ([]Usage, error) // from <= day <= to, by day then user
+}
+
+type OrgStore interface {
+	Create(ctx context.Context, o *Org) error // with its members
+	Get(ctx context.Context, id string) (*Org, error)
+	List(ctx context.Context) ([]Org, error)                       // by name
+	ListForUser(ctx context.Context, userID string) ([]Org, error) // orgs userID belongs to, by name
+	Rename(ctx context.Context, id, name string) error
+	SetMember(ctx context.Context, orgID, userID, role string) error // adds or re-roles
+	RemoveMember(ctx context.Context, orgID, userID string) error
+}
+
+// Stores bundles one implementation of each store for the server to share.
+type Stores struct {
+	Users    UserStore
+	Sessions SessionStore
+	Devices  DeviceStore
+	APIKeys  APIKeyStore
+	Shares   ShareStore
+	Buckets  BucketStore
+	Drops    DropStore
+	Links    LinkAccessStore
+	Locks    FileLockStore
+	Audit    AuditStore
+	Reports  AbuseReportStore
+	Honey    HoneytokenStore
+	Jobs     JobStore
+	Usage    UsageStore
+	Orgs     OrgStore
+}
+
+func NewMemoryStores() Stores {
+	return Stores{
+		Users:    NewMemoryUserStore(),
+		Sessions: NewMemorySessionStore(),
+		Devices:  NewMemoryDeviceStore(),
+		APIKeys:  NewMemoryAPIKeyStore(),
+		Shares:   NewMemoryShareStore(),
+		Buckets:  NewMemoryBucketStore(),
+		Drops:    NewMemoryDropStore(),
+		Links:    NewMemoryLinkAccessStore(),
+		Locks:    NewMemoryFileLockStore(),
+		Audit:    NewMemoryAuditStore(),
+		Reports:  NewMemoryAbuseReportStore(),
+		Honey:    NewMemoryHoneytokenStore(),
+		Jobs:     NewMemoryJobStore(),
+		Usage:    NewMemoryUsageStore(),
+		Orgs:     NewMemoryOrgStore(),
+	}
+}
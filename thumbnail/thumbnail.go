@@ -0,0 +1,111 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Sizes are the bounding boxes thumbnails are made in; keeping to a few
+// keeps the renditions stored per image to a few.
+var Sizes = []int{128, 256, 512}
+
+// maxPixels bounds the images decoded, so a small file claiming huge
+// dimensions cannot take the server's memory.
+const maxPixels = 50 << 20
+
+var ErrTooLarge = errors.New("image too large to thumbnail")
+
+// ContentType is the media type of every thumbnail.
+const ContentType = "image/jpeg"
+
+var formats = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+// Wanted reports whether a file of this name gets thumbnails.
+func Wanted(name string) bool {
+	return formats[strings.ToLower(filepath.Ext(name))]
+}
+
+// Kind is the rendition a size thumbnail is stored as, "" for a size not
+// in Sizes.
+func Kind(size int) string {
+	if !slices.Contains(Sizes, size) {
+		return ""
+	}
+	return fmt.Sprintf("thumb.%d.jpg", size)
+}
+
+// SizeOf is the size a thumbnail rendition kind is made in; false for a
+// kind that is not a thumbnail.
+func SizeOf(kind string) (int, bool) {
+	for _, s := range Sizes {
+		if Kind(s) == kind {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// Make writes a JPEG of the image r holds, scaled to fit within size by
+// size, to w. Images already that small keep their dimensions.
+func Make(r io.ReadSeeker, size int, w io.Writer) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, scale(src, size), &jpeg.Options{Quality: 80})
+}
+
+// scale shrinks src to fit within size by size, averaging the source
+// pixels each destination pixel covers.
+func scale(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// JPEG has no alpha: flatten onto white
+			white := 0xffff - a/n
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((r/n + white) >> 8)
+			dst.Pix[i+1] = uint8((g/n + white) >> 8)
+			dst.Pix[i+2] = uint8((bl/n + white) >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
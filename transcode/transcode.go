@@ -0,0 +1,237 @@
+package transcode
+
+import (
+	"SCloud/config"
+	"SCloud/jobs"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rendition kinds, as stored beside the original.
+const (
+	Video = "stream.mp4"
+	Audio = "stream.m4a"
+)
+
+// Kind returns the rendition a file of this name gets: Video, Audio or ""
+// for none.
+func Kind(name string) string {
+	ct, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))))
+	switch {
+	case strings.HasPrefix(ct, "video/"):
+		return Video
+	case strings.HasPrefix(ct, "audio/"):
+		return Audio
+	}
+	return ""
+}
+
+// ContentType is the media type of a rendition of kind.
+func ContentType(kind string) string {
+	if kind == Audio {
+		return "audio/mp4"
+	}
+	return "video/mp4"
+}
+
+// FFmpeg transcodes by running the ffmpeg binary at Path. The output starts
+// with its index (faststart), so players can seek in it over range requests
+// without reading it all.
+type FFmpeg struct {
+	Path   string
+	Height int
+}
+
+// ErrUnknownFormat is an input whose content is not a container ffmpeg is
+// allowed to read.
+var ErrUnknownFormat = errors.New("unrecognized media format")
+
+// Transcode reads in only as the container its content says it is, and
+// only from the local file: never as a playlist, concat list or anything
+// else the name could suggest that makes ffmpeg open other files or URLs.
+func (f FFmpeg) Transcode(ctx context.Context, in, out, kind string) error {
+	format, err := sniffFile(in)
+	if err != nil {
+		return err
+	}
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y",
+		"-protocol_whitelist", "file,pipe", "-f", format, "-i", in}
+	if kind == Video {
+		args = append(args,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "26", "-maxrate", "2500k", "-bufsize", "5000k",
+			"-vf", "scale=-2:'min("+strconv.Itoa(f.Height)+",ih)'", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-map", "0:a:0", "-vn")
+	}
+	args = append(args, "-c:a", "aac", "-b:a", "128k", "-ac", "2", "-movflags", "+faststart", "-f", "mp4", out)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.Path, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 500 {
+			msg = msg[len(msg)-500:]
+		}
+		return fmt.Errorf("ffmpeg: %v: %s", err, msg)
+	}
+	return nil
+}
+
+func sniffFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if format := Sniff(head[:n]); format != "" {
+		return format, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// Sniff names the ffmpeg demuxer for the container head starts, or "" for
+// none it recognizes.
+func Sniff(head []byte) string {
+	has := func(off int, magic string) bool {
+		return len(head) >= off+len(magic) && string(head[off:off+len(magic)]) == magic
+	}
+	switch {
+	case has(4, "ftyp"), has(4, "moov"), has(4, "mdat"), has(4, "wide"), has(4, "free"):
+		return "mov"
+	case has(0, "\x1a\x45\xdf\xa3"):
+		return "matroska"
+	case has(0, "RIFF") && has(8, "AVI "):
+		return "avi"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "wav"
+	case has(0, "FORM") && (has(8, "AIFF") || has(8, "AIFC")):
+		return "aiff"
+	case has(0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11"):
+		return "asf"
+	case has(0, "FLV\x01"):
+		return "flv"
+	case has(0, "OggS"):
+		return "ogg"
+	case has(0, "fLaC"):
+		return "flac"
+	case has(0, "#!AMR"):
+		return "amr"
+	case has(0, "\x00\x00\x01\xba"):
+		return "mpeg"
+	case len(head) > 188 && head[0] == 0x47 && head[188] == 0x47:
+		return "mpegts"
+	case has(0, "ID3"):
+		return "mp3"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0:
+		return "aac" // ADTS
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0:
+		return "mp3"
+	}
+	return ""
+}
+
+// ErrGone is returned by Task.Open for a file removed or rewritten since
+// it was queued; the task is dropped.
+var ErrGone = errors.New("file gone")
+
+// Task is one file to transcode to Kind. Key identifies the rendition it
+// makes, so one asked for again while queued is only made once.
+type Task struct {
+	Key   string
+	Path  string
+	Kind  string
+	Open  func() (io.ReadCloser, error)
+	Store func(r io.Reader) error
+}
+
+// Queue transcodes in a "transcode" background job. ffmpeg needs to seek
+// in its input, so each file is decrypted to a private temp dir (TMPDIR,
+// i.e. UPLOAD_TMP_DIR) for the run and removed after.
+type Queue struct {
+	FFmpeg  FFmpeg
+	Timeout time.Duration
+	jobs    *jobs.Queue
+	pending sync.Map
+}
+
+// New returns a queue running FFMPEG, or nil when it is not set.
+func New(cfg *config.Config, runner *jobs.Runner, logger *log.Logger) *Queue {
+	if cfg.FFmpeg == "" {
+		return nil
+	}
+	return &Queue{
+		FFmpeg:  FFmpeg{Path: cfg.FFmpeg, Height: cfg.TranscodeHeight},
+		Timeout: cfg.TranscodeTimeout,
+		jobs:    &jobs.Queue{Name: "transcode", Runner: runner, Log: logger, Attempts: 1},
+	}
+}
+
+// Add queues t unless a task with its key is queued already.
+func (q *Queue) Add(t Task) {
+	if _, dup := q.pending.LoadOrStore(t.Key, true); dup {
+		return
+	}
+	q.jobs.Add(jobs.Task{Desc: t.Path, Run: func() error {
+		defer q.pending.Delete(t.Key)
+		return q.run(t)
+	}})
+}
+
+func (q *Queue) run(t Task) error {
+	src, err := t.Open()
+	if errors.Is(err, ErrGone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dir, err := os.MkdirTemp("", "transcode-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// no extension: the format comes from the content alone
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	f, err := os.OpenFile(in, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), q.Timeout)
+	defer cancel()
+	if err := q.FFmpeg.Transcode(ctx, in, out, t.Kind); err != nil {
+		return err
+	}
+	r, err := os.Open(out)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return t.Store(r)
+}
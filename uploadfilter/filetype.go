@@ -0,0 +1,239 @@
+package uploadfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func init() {
+	Register("filetype", newFileType)
+}
+
+// TypeRules lists file types by extension (".pdf") or media type
+// ("application/pdf", or "image/*" for a whole family).
+type TypeRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// TypePolicy is the filetype filter's policy file: rules for everyone,
+// and more for uploads into an org's tree or by a user. Deny lists add up;
+// of the allow lists, the most specific one present (user, then org, then
+// the default) is the one an upload must match.
+type TypePolicy struct {
+	TypeRules
+	Orgs  map[string]TypeRules `json:"orgs"`
+	Users map[string]TypeRules `json:"users"`
+}
+
+// lower makes every rule lower case, as extensions and media types are
+// compared.
+func (p *TypePolicy) lower() {
+	lower := func(r TypeRules) TypeRules {
+		for i := range r.Allow {
+			r.Allow[i] = strings.ToLower(r.Allow[i])
+		}
+		for i := range r.Deny {
+			r.Deny[i] = strings.ToLower(r.Deny[i])
+		}
+		return r
+	}
+	p.TypeRules = lower(p.TypeRules)
+	for id, r := range p.Orgs {
+		p.Orgs[id] = lower(r)
+	}
+	for id, r := range p.Users {
+		p.Users[id] = lower(r)
+	}
+}
+
+// sniffSize is how much of the content the media type is read from, as
+// much as http.DetectContentType looks at.
+const sniffSize = 512
+
+// fileType is "filetype:<policy.json>". Single-request uploads are judged
+// by their sniffed media type, staged and client-encrypted ones by their
+// name alone.
+type fileType struct{ policy TypePolicy }
+
+func newFileType(arg string) (Filter, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("want filetype:<policy file>")
+	}
+	b, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	var p TypePolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	all := []TypeRules{p.TypeRules}
+	for _, r := range p.Orgs {
+		all = append(all, r)
+	}
+	for _, r := range p.Users {
+		all = append(all, r)
+	}
+	for _, r := range all {
+		for _, e := range slices.Concat(r.Allow, r.Deny) {
+			if !strings.HasPrefix(e, ".") && !strings.Contains(e, "/") {
+				return nil, fmt.Errorf("%s: %q is neither an extension (.ext) nor a media type", arg, e)
+			}
+		}
+	}
+	p.lower()
+	return fileType{p}, nil
+}
+
+func (f fileType) Open(m Meta) (Scan, error) {
+	deny, allow := slices.Clip(f.policy.Deny), f.policy.Allow
+	for _, r := range []TypeRules{f.policy.Orgs[m.Org], f.policy.Users[m.UserID]} {
+		deny = append(deny, r.Deny...)
+		if r.Allow != nil {
+			allow = r.Allow
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(m.Path))
+	byExt, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	r := rules{ext: ext, byExt: byExt, deny: deny, allow: allow}
+	if err := r.denied(byExt); err != nil {
+		return nil, err
+	}
+	if r.namesTypes() && !m.Staged && !m.ClientEncrypted {
+		return &typeScan{rules: r}, nil
+	}
+	return nil, r.allowed(byExt)
+}
+
+// rules are the lists that apply to one upload.
+type rules struct {
+	ext, byExt  string // the name's extension and the media type it implies
+	deny, allow []string
+}
+
+// namesTypes reports whether any rule is a media type, which then needs
+// the content sniffed.
+func (r rules) namesTypes() bool {
+	for _, e := range slices.Concat(r.deny, r.allow) {
+		if strings.Contains(e, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) what() string {
+	if r.ext == "" {
+		return "files without an extension"
+	}
+	return r.ext + " files"
+}
+
+// denied refuses the upload if its extension or any of its types is on a
+// deny list.
+func (r rules) denied(types ...string) error {
+	for _, e := range r.deny {
+		if e == r.ext {
+			return refuse("%s are not accepted here", r.what())
+		}
+		for _, typ := range types {
+			if typ != "" && typeMatches(e, typ) {
+				return refuse("%s content is not accepted here", typ)
+			}
+		}
+	}
+	return nil
+}
+
+// allowed refuses the upload unless it matches the allow list, if there is
+// one. A list with both kinds of entry needs both its extension and its
+// media type typ to match.
+func (r rules) allowed(typ string) error {
+	if r.allow == nil {
+		return nil
+	}
+	var exts, types, extOK, typeOK bool
+	for _, e := range r.allow {
+		if strings.HasPrefix(e, ".") {
+			exts = true
+			extOK = extOK || e == r.ext
+		} else {
+			types = true
+			typeOK = typeOK || typ != "" && typeMatches(e, typ)
+		}
+	}
+	switch {
+	case exts && !extOK:
+		return refuse("%s are not accepted here", r.what())
+	case types && typ == "":
+		return refuse("the type of %s cannot be checked", r.what())
+	case types && !typeOK:
+		return refuse("%s content is not accepted here", typ)
+	}
+	return nil
+}
+
+func typeMatches(rule, typ string) bool {
+	if family, ok := strings.CutSuffix(rule, "/*"); ok {
+		return strings.HasPrefix(typ, family+"/")
+	}
+	return rule == typ
+}
+
+func refuse(format string, a ...any) error {
+	return &Denied{Status: http.StatusUnsupportedMediaType, Reason: fmt.Sprintf(format, a...)}
+}
+
+// typeScan holds back the start of the content until its type is judged.
+type typeScan struct {
+	rules
+	r      io.Reader
+	judged bool
+}
+
+func (s *typeScan) Wrap(r io.Reader) io.Reader {
+	s.r = r
+	return s
+}
+
+func (s *typeScan) Read(p []byte) (int, error) {
+	if !s.judged {
+		head := make([]byte, sniffSize)
+		n, err := io.ReadFull(s.r, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		typ := s.sniff(head[:n])
+		if err := s.denied(typ); err != nil {
+			return 0, err
+		}
+		if err := s.allowed(typ); err != nil {
+			return 0, err
+		}
+		s.judged = true
+		s.r = io.MultiReader(bytes.NewReader(head[:n]), s.r)
+	}
+	return s.r.Read(p)
+}
+
+// sniff is the media type of content starting with head. Where the sniffer
+// only sees plain text or a zip, the extension's type, if any, is the more
+// specific one (text/csv, the Office formats).
+func (s *typeScan) sniff(head []byte) string {
+	typ, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if (typ == "text/plain" || typ == "application/zip") && s.byExt != "" {
+		return s.byExt
+	}
+	return typ
+}
+
+func (s *typeScan) Verdict() error { return nil }
@@ -0,0 +1,56 @@
+package uploadfilter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func init() {
+	Register("maxsize", newMaxSize)
+}
+
+// maxSize refuses uploads larger than limit bytes: by their declared size
+// when there is one, else as the content passes.
+type maxSize struct{ limit int64 }
+
+func newMaxSize(arg string) (Filter, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("want maxsize:<bytes>, got %q", arg)
+	}
+	return maxSize{n}, nil
+}
+
+func (m maxSize) deny() error {
+	return &Denied{Status: http.StatusRequestEntityTooLarge, Reason: fmt.Sprintf("larger than %d bytes", m.limit)}
+}
+
+func (m maxSize) Open(meta Meta) (Scan, error) {
+	if meta.Size > m.limit {
+		return nil, m.deny()
+	}
+	return &sizeScan{max: m}, nil
+}
+
+type sizeScan struct {
+	max maxSize
+	r   io.Reader
+	n   int64
+}
+
+func (s *sizeScan) Wrap(r io.Reader) io.Reader {
+	s.r = r
+	return s
+}
+
+func (s *sizeScan) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.n += int64(n); s.n > s.max.limit {
+		return n, s.max.deny()
+	}
+	return n, err
+}
+
+func (s *sizeScan) Verdict() error { return nil }
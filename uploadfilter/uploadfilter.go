@@ -0,0 +1,200 @@
+package uploadfilter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Meta is what is known of an upload before its content arrives.
+type Meta struct {
+	Path        string // logical path it is stored at, in its tree
+	Size        int64  // as declared by the client; -1 when unknown
+	UserID      string
+	Org         string // "" outside organizations
+	ContentType string // as declared by the client; "" when it sent none
+
+	// ClientEncrypted uploads are ciphertext the server cannot read, and
+	// Staged ones are encrypted a chunk at a time as they arrive (chunked and
+	// resumable uploads): neither is shown to a Scan, so a filter that must
+	// see content should refuse them in Open.
+	ClientEncrypted bool
+	Staged          bool
+}
+
+// Filter is one check run on every upload. Open decides on the metadata:
+// it returns an error (a Denied, usually) to refuse the upload, nil to let
+// it through unread, or a Scan to see its content.
+type Filter interface {
+	Open(m Meta) (Scan, error)
+}
+
+// Scan sees one upload's plaintext on its way to storage. Wrap returns the
+// reader the upload is stored from: r itself behind a tee to inspect, or a
+// transform of it. A read error, a Denied included, fails the upload, as
+// does a non-nil Verdict once the whole content has been read.
+type Scan interface {
+	Wrap(r io.Reader) io.Reader
+	Verdict() error
+}
+
+// Denied is a filter refusing an upload, answered with Status (403 unless
+// set) and the reason.
+type Denied struct {
+	Filter string // set by the Chain
+	Status int
+	Reason string
+}
+
+func (d *Denied) Error() string {
+	return fmt.Sprintf("upload refused by %s: %s", d.Filter, d.Reason)
+}
+
+// Deny refuses an upload for reason.
+func Deny(reason string) error {
+	return &Denied{Status: http.StatusForbidden, Reason: reason}
+}
+
+// Factory makes a filter from the argument it was configured with, the
+// text after "name:" ("" with none).
+type Factory func(arg string) (Filter, error)
+
+var (
+	mu        sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a filter available to UPLOAD_FILTERS under name. It is
+// meant for init functions: filters outside this repository register
+// themselves from a package main imports for its side effects.
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := factories[name]; dup {
+		panic("uploadfilter: Register called twice for " + name)
+	}
+	factories[name] = f
+}
+
+// Names lists the registered filters.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(factories))
+	for n := range factories {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type link struct {
+	name string
+	f    Filter
+}
+
+// Chain is the configured filters, run in order on every upload.
+type Chain []link
+
+// Build makes a chain from specs of the form "name" or "name:arg".
+func Build(specs []string) (Chain, error) {
+	var c Chain
+	for _, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		mu.Lock()
+		factory := factories[name]
+		mu.Unlock()
+		if factory == nil {
+			return nil, fmt.Errorf("unknown filter %q (have %s)", name, strings.Join(Names(), ", "))
+		}
+		f, err := factory(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		c = append(c, link{name, f})
+	}
+	return c, nil
+}
+
+// Add appends a filter made in code, for servers embedding this one.
+func (c *Chain) Add(name string, f Filter) {
+	*c = append(*c, link{name, f})
+}
+
+// Open runs every filter's Open on m, stopping at the first refusal.
+func (c Chain) Open(m Meta) (*Run, error) {
+	run := &Run{}
+	for _, l := range c {
+		s, err := l.f.Open(m)
+		if err != nil {
+			return nil, named(l.name, err)
+		}
+		if s != nil && !m.ClientEncrypted && !m.Staged {
+			run.scans = append(run.scans, scan{l.name, s})
+		}
+	}
+	return run, nil
+}
+
+type scan struct {
+	name string
+	Scan
+}
+
+// Run is the chain's scans of one upload.
+type Run struct {
+	scans []scan
+}
+
+// Active reports whether any filter reads the content, which may then
+// differ in size from the upload.
+func (r *Run) Active() bool {
+	return len(r.scans) > 0
+}
+
+// Wrap passes r through every scan, in chain order.
+func (r *Run) Wrap(rd io.Reader) io.Reader {
+	for _, s := range r.scans {
+		rd = &namedReader{s.name, s.Wrap(rd)}
+	}
+	return rd
+}
+
+// Verdict asks every scan for its verdict on the content read.
+func (r *Run) Verdict() error {
+	for _, s := range r.scans {
+		if err := s.Verdict(); err != nil {
+			return named(s.name, err)
+		}
+	}
+	return nil
+}
+
+// namedReader names the filter in the denials its reader returns.
+type namedReader struct {
+	name string
+	r    io.Reader
+}
+
+func (n *namedReader) Read(p []byte) (int, error) {
+	k, err := n.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = named(n.name, err)
+	}
+	return k, err
+}
+
+func named(name string, err error) error {
+	var d *Denied
+	if errors.As(err, &d) && d.Filter == "" {
+		d.Filter = name
+		if d.Status == 0 {
+			d.Status = http.StatusForbidden
+		}
+	}
+	return err
+}
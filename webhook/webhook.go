@@ -0,0 +1,32 @@
+package webhook
+
+import (
+	"SCloud/egress"
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+var client = egress.Client(10 * time.Second)
+
+// Post sends v to url as JSON in the background. Delivery is best effort:
+// beyond the egress retries, failures are only logged.
+func Post(url string, v any, logger *log.Logger) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		logger.Printf("webhook %s: %v", url, err)
+		return
+	}
+	go func() {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Printf("webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Printf("webhook %s: %s", url, resp.Status)
+		}
+	}()
+}